@@ -2,43 +2,70 @@ package cmd
 
 // ==================== Root Command ====================
 const (
-	RootCmdUse   = "bms-api-server"
-	RootCmdShort = "A brief description of your application"
-	RootCmdLong  = `A longer description that spans multiple lines and likely contains
-examples and usage of using your application. For example:
+	RootCmdUse   = "devices-api-server"
+	RootCmdShort = "API server for BMS customers, sites and devices"
+	RootCmdLong  = `devices-api-server serves the device inventory used by the BMS gateways.
 
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`
+Running it without a subcommand starts the API server, the same as "serve".
+Use the subcommands to migrate the database, seed development data, issue
+tokens or check that the environment is set up correctly.`
 )
 
-// ==================== Version Command ====================
+// ==================== Serve Command ====================
 const (
-	VersionCmdUse   = "version"
-	VersionCmdShort = "Print the version number of bms-mqtt-worker-pi"
-	VersionCmdLong  = `All software has versions. This is bms-mqtt-worker-pi's`
+	ServeCmdUse   = "serve"
+	ServeCmdShort = "Start the API server"
+	ServeCmdLong  = `Start the API server and run until a stop signal or stop file is received.`
+)
+
+// ==================== Migrate Command ====================
+const (
+	MigrateCmdUse   = "migrate"
+	MigrateCmdShort = "Create missing tables and indexes"
+	MigrateCmdLong  = `Create any missing database tables and lookup indexes, then exit.`
 )
 
-// ==================== MQTT Command ====================
+// ==================== Seed Command ====================
 const (
-	MQTTCmdUse   = "mqtt"
-	MQTTCmdShort = "A brief description of your command"
-	MQTTCmdLong  = `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
+	SeedCmdUse   = "seed"
+	SeedCmdShort = "Insert demo data into the database"
+	SeedCmdLong  = `Insert a demo customer, site and device into the database.
 
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`
+Seeding is only allowed in environments whose profile has seed_data enabled.`
 )
 
-// ==================== InfluxDB Command ====================
+// ==================== Token Command ====================
 const (
-	InfluxDBCmdUse   = "influxdb"
-	InfluxDBCmdShort = "A brief description of your command"
-	InfluxDBCmdLong  = `A longer description that spans multiple lines and likely contains examples
-and usage of using your command. For example:
+	TokenCmdUse   = "token"
+	TokenCmdShort = "Issue an API token"
+	TokenCmdLong  = `Issue an API token and print it to stdout.
 
-Cobra is a CLI library for Go that empowers applications.
-This application is a tool to generate the needed files
-to quickly create a Cobra application.`
+Without flags an admin token is issued. With --customer-id and --action a
+customer token is issued and stored in the database.`
+)
+
+// ==================== Doctor Command ====================
+const (
+	DoctorCmdUse   = "doctor"
+	DoctorCmdShort = "Check the environment the server runs in"
+	DoctorCmdLong  = `Check environment variables, configuration files, certificates and the
+database connection, and report anything that would stop the server from starting.`
+)
+
+// ==================== Fixtures Command ====================
+const (
+	FixturesCmdUse   = "fixtures"
+	FixturesCmdShort = "Print request and response examples for every endpoint"
+	FixturesCmdLong  = `Print a canonical request and response example for every endpoint as a JSON array,
+generated from the request and response types of the handlers.
+
+Downstream teams use the examples as contract test fixtures. With --out every
+example is written to its own file in the directory instead.`
+)
+
+// ==================== Version Command ====================
+const (
+	VersionCmdUse   = "version"
+	VersionCmdShort = "Print the version and build information"
+	VersionCmdLong  = `Print the application version together with the Go version and VCS details it was built from.`
 )
@@ -0,0 +1,90 @@
+/*
+Copyright © 2025 Johandré van Deventer <johandre.vandeventer@rubiconsa.com>
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/johandrevandeventer/devices-api-server/initializers"
+	"github.com/johandrevandeventer/devices-api-server/internal/config"
+	"github.com/johandrevandeventer/devices-api-server/internal/flags"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	coreutils "github.com/johandrevandeventer/devices-api-server/utils"
+	"github.com/johandrevandeventer/textutils"
+	"github.com/spf13/cobra"
+)
+
+// requiredEnvVariables lists the environment variables the server cannot start without
+var requiredEnvVariables = []string{
+	"DB_URL",
+	"DEVICES_SERVER_PORT",
+	"DEVICES_SERVER_ADMIN_SECRET",
+	"DEVICES_SERVER_JWT_SECRET",
+}
+
+// doctorCmd represents the doctor command
+var doctorCmd = &cobra.Command{
+	Use:   DoctorCmdUse,
+	Short: DoctorCmdShort,
+	Long:  DoctorCmdLong,
+	Run: func(cmd *cobra.Command, args []string) {
+		failures := 0
+
+		check := func(ok bool, message string) {
+			if ok {
+				fmt.Println(textutils.ColorText(textutils.Green, fmt.Sprintf("-> OK: %s", message)))
+				return
+			}
+
+			failures++
+			fmt.Println(textutils.ColorText(textutils.Red, fmt.Sprintf("-> FAIL: %s", message)))
+		}
+
+		if err := initializers.LoadEnvVariable(); err != nil {
+			fmt.Println(textutils.ColorText(textutils.Yellow, fmt.Sprintf("-> WARN: %s", err)))
+		}
+
+		for _, name := range requiredEnvVariables {
+			check(os.Getenv(name) != "", fmt.Sprintf("environment variable %s is set", name))
+		}
+
+		if os.Getenv("DEVICES_SERVER_TOKEN_KEY") == "" {
+			fmt.Println(textutils.ColorText(textutils.Yellow, "-> WARN: DEVICES_SERVER_TOKEN_KEY is not set, device auth tokens are stored unencrypted"))
+		}
+
+		_, existingFiles, err := config.InitConfig()
+		check(err == nil, fmt.Sprintf("configuration files are readable %v", existingFiles))
+
+		profile := config.GetProfile()
+		certFound := coreutils.FileExists("server.crt") && coreutils.FileExists("server.key")
+		if profile.EnforceTLS {
+			check(certFound, "certificate and private key files exist")
+		} else if !certFound {
+			fmt.Println(textutils.ColorText(textutils.Yellow, fmt.Sprintf("-> WARN: certificate files missing, the server will use plain HTTP in %s", flags.FlagEnvironment)))
+		}
+
+		bmsDB, err := devicesdb.NewDB()
+		check(err == nil, "database is reachable")
+		if err == nil {
+			defer bmsDB.Close()
+
+			for _, table := range initializers.Tables {
+				exists, err := bmsDB.TableExists(table)
+				check(err == nil && exists, fmt.Sprintf("table %s exists", table))
+			}
+		}
+
+		if failures > 0 {
+			fmt.Println(textutils.ColorText(textutils.Red, textutils.BoldText(fmt.Sprintf("%d check(s) failed", failures))))
+			os.Exit(1)
+		}
+
+		fmt.Println(textutils.ColorText(textutils.Green, textutils.BoldText("All checks passed")))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+}
@@ -0,0 +1,63 @@
+/*
+Copyright © 2025 Johandré van Deventer <johandre.vandeventer@rubiconsa.com>
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/johandrevandeventer/devices-api-server/internal/fixtures"
+	"github.com/johandrevandeventer/devices-api-server/internal/flags"
+	"github.com/johandrevandeventer/textutils"
+	"github.com/spf13/cobra"
+)
+
+// fixturesCmd represents the fixtures command
+var fixturesCmd = &cobra.Command{
+	Use:   FixturesCmdUse,
+	Short: FixturesCmdShort,
+	Long:  FixturesCmdLong,
+	Run: func(cmd *cobra.Command, args []string) {
+		all := fixtures.All()
+
+		if flags.FlagFixturesDir == "" {
+			data, err := json.MarshalIndent(all, "", "  ")
+			if err != nil {
+				fixturesFail(err)
+			}
+			fmt.Println(string(data))
+			return
+		}
+
+		if err := os.MkdirAll(flags.FlagFixturesDir, 0o755); err != nil {
+			fixturesFail(err)
+		}
+
+		for _, fixture := range all {
+			data, err := fixture.Marshal()
+			if err != nil {
+				fixturesFail(err)
+			}
+			if err := os.WriteFile(filepath.Join(flags.FlagFixturesDir, fixture.FileName()), data, 0o644); err != nil {
+				fixturesFail(err)
+			}
+		}
+
+		fmt.Println(textutils.ColorText(textutils.Green, fmt.Sprintf("-> %d fixtures written to %s", len(all), flags.FlagFixturesDir)))
+	},
+}
+
+// fixturesFail reports the error and exits
+func fixturesFail(err error) {
+	fmt.Fprintln(os.Stderr, textutils.ColorText(textutils.Red, fmt.Sprintf("-> FAIL: %s", err)))
+	os.Exit(1)
+}
+
+func init() {
+	rootCmd.AddCommand(fixturesCmd)
+
+	fixturesCmd.Flags().StringVar(&flags.FlagFixturesDir, "out", "", "Directory to write one file per fixture to (default print to stdout)")
+}
@@ -0,0 +1,39 @@
+/*
+Copyright © 2025 Johandré van Deventer <johandre.vandeventer@rubiconsa.com>
+*/
+package cmd
+
+import (
+	"github.com/johandrevandeventer/devices-api-server/initializers"
+	"github.com/johandrevandeventer/logging"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+// migrateCmd represents the migrate command
+var migrateCmd = &cobra.Command{
+	Use:   MigrateCmdUse,
+	Short: MigrateCmdShort,
+	Long:  MigrateCmdLong,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := initApp()
+
+		// InitDB creates the missing tables, columns and indexes
+		initializers.InitDB(cfg)
+
+		report := initializers.Report()
+		logging.GetLogger("main").Info("Migration complete",
+			zap.Strings("tablesCreated", report.TablesCreated),
+			zap.Strings("tablesExisting", report.TablesExisting),
+			zap.Strings("indexesCreated", report.IndexesCreated),
+			zap.Strings("indexesMissing", report.IndexesMissing),
+			zap.Strings("indexesDropped", report.IndexesDropped),
+			zap.Strings("columnsAdded", report.ColumnsAdded),
+			zap.Strings("errors", report.Errors),
+		)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(migrateCmd)
+}
@@ -6,9 +6,12 @@ package cmd
 import (
 	"os"
 
+	"github.com/johandrevandeventer/devices-api-server/initializers"
 	"github.com/johandrevandeventer/devices-api-server/internal/config"
 	"github.com/johandrevandeventer/devices-api-server/internal/flags"
+	"github.com/johandrevandeventer/logging"
 	"github.com/spf13/cobra"
+	"go.uber.org/zap"
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -18,15 +21,14 @@ var rootCmd = &cobra.Command{
 	Long:  RootCmdLong,
 
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
-		if cmd.CalledAs() == RootCmdUse {
-			config.PrintInfo(false)
-		} else {
-			config.PrintInfo(true)
-			os.Exit(0)
+		// Quiet mode can be enabled by flag or by the app config
+		if config.GetConfig().App.Runtime.Quiet {
+			flags.FlagQuiet = true
 		}
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		// cmd.Help()
+		// Running without a subcommand starts the server
+		runServe()
 	},
 }
 
@@ -35,18 +37,32 @@ func Execute() {
 	if err != nil {
 		os.Exit(1)
 	}
+}
+
+// initApp loads the environment, configuration and logger shared by all commands
+func initApp() *config.Config {
+	initializers.LoadEnvVariable()
+	configErr := initializers.InitConfig()
+	cfg := config.GetConfig()
 
-	// Exit if the help flag is set
-	helpFlag, _ := rootCmd.Flags().GetBool("help")
-	if helpFlag {
-		os.Exit(0)
+	initializers.InitLogger(cfg)
+	if configErr != nil {
+		logging.GetLogger("initializers").Error("Using the default configuration", zap.Error(configErr))
 	}
+	initializers.InitTimezone(cfg)
+	initializers.InitDeviceTokens()
+
+	return cfg
 }
 
 func init() {
 	// Define persistent flags for the root command
-	rootCmd.PersistentFlags().StringVarP(&flags.FlagEnvironment, "environment", "e", "development", "Environment to run the application in (e.g. development, production) (default development)")
+	rootCmd.PersistentFlags().StringVarP(&flags.FlagEnvironment, "environment", "e", "development", "Environment to run the application in (e.g. development, staging, production) (default development)")
 	rootCmd.PersistentFlags().BoolVarP(&flags.FlagDebugMode, "debug", "x", false, "Enable debug mode (default false)")
 	rootCmd.PersistentFlags().BoolVarP(&flags.FlagVerbose, "verbose", "v", false, "Log verbose output (default false)")
+	rootCmd.PersistentFlags().BoolVarP(&flags.FlagQuiet, "quiet", "q", false, "Suppress the splash screen and verbose init output (default false)")
 	rootCmd.PersistentFlags().BoolVar(&flags.FlagLogPrefix, "log-prefix", true, "Add timestamps to logs and subprocess stderr/stdout output")
+
+	rootCmd.Flags().StringVarP(&flags.FlagPort, "port", "p", "", "Port to listen on, overrides DEVICES_SERVER_PORT")
+	rootCmd.Flags().BoolVar(&flags.FlagReadOnly, "read-only", false, "Start in read-only mode, rejecting mutating requests (default false)")
 }
@@ -0,0 +1,43 @@
+/*
+Copyright © 2025 Johandré van Deventer <johandre.vandeventer@rubiconsa.com>
+*/
+package cmd
+
+import (
+	"os"
+
+	"github.com/johandrevandeventer/devices-api-server/initializers"
+	"github.com/johandrevandeventer/devices-api-server/internal/flags"
+	"github.com/johandrevandeventer/logging"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+// seedCmd represents the seed command
+var seedCmd = &cobra.Command{
+	Use:   SeedCmdUse,
+	Short: SeedCmdShort,
+	Long:  SeedCmdLong,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := initApp()
+		logger := logging.GetLogger("main")
+
+		if !cfg.App.Profile(flags.FlagEnvironment).SeedData {
+			logger.Error("Seed data is not available in this environment", zap.String("environment", flags.FlagEnvironment))
+			os.Exit(1)
+		}
+
+		initializers.InitDB(cfg)
+
+		if err := initializers.SeedDB(); err != nil {
+			logger.Error("Failed to seed the database", zap.Error(err))
+			os.Exit(1)
+		}
+
+		logger.Info("Database seeded")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(seedCmd)
+}
@@ -0,0 +1,113 @@
+/*
+Copyright © 2025 Johandré van Deventer <johandre.vandeventer@rubiconsa.com>
+*/
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"sync"
+	"syscall"
+
+	"github.com/johandrevandeventer/devices-api-server/initializers"
+	"github.com/johandrevandeventer/devices-api-server/internal/config"
+	"github.com/johandrevandeventer/devices-api-server/internal/crashloop"
+	"github.com/johandrevandeventer/devices-api-server/internal/crashreport"
+	"github.com/johandrevandeventer/devices-api-server/internal/engine"
+	"github.com/johandrevandeventer/devices-api-server/internal/flags"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"github.com/johandrevandeventer/logging"
+	"github.com/johandrevandeventer/splashscreen"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+// serveCmd represents the serve command
+var serveCmd = &cobra.Command{
+	Use:   ServeCmdUse,
+	Short: ServeCmdShort,
+	Long:  ServeCmdLong,
+	Run: func(cmd *cobra.Command, args []string) {
+		runServe()
+	},
+}
+
+// runServe starts the engine and blocks until it has shut down
+func runServe() {
+	var wg sync.WaitGroup
+
+	// Increase WaitGroup counter
+	wg.Add(1)
+
+	if !flags.FlagQuiet {
+		splashscreen.PrintSplashScreen()
+		config.PrintInfo(false)
+	}
+
+	cfg := initApp()
+
+	logger := logging.GetLogger("main")
+
+	crashreport.Init(cfg.App.Runtime.CrashDir, cfg.System.AppVersion)
+
+	statePersister := initializers.InitPersist(cfg, logger)
+
+	// Back off before connecting to the database if the server keeps crashing
+	initializers.InitCrashLoopGuard(cfg, logger, statePersister)
+
+	initializers.InitDB(cfg)
+
+	initializers.ReportStartup(cfg, logger, statePersister)
+
+	// Graceful shutdown handling
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer stop()
+
+	svc := engine.NewEngine(cfg, logger, statePersister)
+
+	svc.OnShutdown("database", func(ctx context.Context) error {
+		return devicesdb.BMS_DB_Instance.Close()
+	})
+
+	// Goroutine to handle stop signals or stop file detection
+	go func() {
+		defer wg.Done() // Ensure the WaitGroup counter is decremented
+
+		select {
+		case <-ctx.Done(): // Handle system interrupt (e.g., Ctrl+C)
+			logger.Warn("Received signal to stop the application")
+			initializers.RecordExit(crashloop.ExitSignal, logger, statePersister)
+		case <-svc.StopFileDetected(): // Stop file detected by Engine
+			logger.Warn("Stop file detected, shutting down application")
+			initializers.RecordExit(crashloop.ExitStopFile, logger, statePersister)
+		}
+
+		// Ensure application cleanup and shutdown
+		svc.Stop() // Stop the engine
+		stop()     // Cancel the context
+	}()
+
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("recovered from panic", zap.Any("panic", r))
+			if _, err := crashreport.Write("main", r, debug.Stack(), nil); err != nil {
+				logger.Error("Failed to write crash report", zap.Error(err))
+			}
+			initializers.RecordExit(crashloop.ExitPanic, logger, statePersister)
+		}
+	}()
+
+	svc.Run(ctx)
+
+	// Wait for goroutine to complete before exiting
+	wg.Wait()
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+
+	serveCmd.Flags().StringVarP(&flags.FlagPort, "port", "p", "", "Port to listen on, overrides DEVICES_SERVER_PORT")
+	serveCmd.Flags().BoolVar(&flags.FlagReadOnly, "read-only", false, "Start in read-only mode, rejecting mutating requests (default false)")
+}
@@ -0,0 +1,88 @@
+/*
+Copyright © 2025 Johandré van Deventer <johandre.vandeventer@rubiconsa.com>
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/johandrevandeventer/devices-api-server/initializers"
+	"github.com/johandrevandeventer/devices-api-server/internal/flags"
+	"github.com/johandrevandeventer/devices-api-server/internal/server/handlers"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"github.com/johandrevandeventer/logging"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+// tokenCmd represents the token command
+var tokenCmd = &cobra.Command{
+	Use:   TokenCmdUse,
+	Short: TokenCmdShort,
+	Long:  TokenCmdLong,
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg := initApp()
+		logger := logging.GetLogger("main")
+
+		// Without a customer an admin token is issued
+		if flags.FlagCustomerID == "" {
+			token, err := serverutils.GenerateJWT(serverutils.GenerateID(), "Admin", "admin", serverutils.ActionAdmin, 0)
+			if err != nil {
+				logger.Error("Failed to generate token", zap.Error(err))
+				os.Exit(1)
+			}
+
+			fmt.Println(token)
+			return
+		}
+
+		if !serverutils.IsValidUUID(flags.FlagCustomerID) {
+			logger.Error("Invalid customer ID", zap.String("customerID", flags.FlagCustomerID))
+			os.Exit(1)
+		}
+
+		if !serverutils.IsValidAction(flags.FlagAction) {
+			logger.Error("Action not allowed", zap.String("action", flags.FlagAction))
+			os.Exit(1)
+		}
+
+		if flags.FlagSiteID != "" && !serverutils.IsValidUUID(flags.FlagSiteID) {
+			logger.Error("Invalid site ID", zap.String("siteID", flags.FlagSiteID))
+			os.Exit(1)
+		}
+
+		binding, err := handlers.NewTokenBinding(flags.FlagAllowedCIDRs, flags.FlagCertThumbprint)
+		if err != nil {
+			logger.Error("Invalid token binding", zap.Error(err))
+			os.Exit(1)
+		}
+
+		initializers.InitDB(cfg)
+
+		var authToken *models.AuthToken
+		if flags.FlagSiteID != "" {
+			authToken, err = handlers.IssueSiteToken(devicesdb.BMS_DB_Instance, flags.FlagCustomerID, flags.FlagSiteID, flags.FlagAction, binding)
+		} else {
+			authToken, err = handlers.IssueCustomerToken(devicesdb.BMS_DB_Instance, flags.FlagCustomerID, flags.FlagAction, binding)
+		}
+		if err != nil {
+			logger.Error("Failed to generate token", zap.Error(err))
+			os.Exit(1)
+		}
+
+		fmt.Println(authToken.Token)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(tokenCmd)
+
+	tokenCmd.Flags().StringVar(&flags.FlagCustomerID, "customer-id", "", "Customer to issue the token for (default admin token)")
+	tokenCmd.Flags().StringVar(&flags.FlagSiteID, "site-id", "", "Site to scope the customer token to (default all of the customer's sites)")
+	tokenCmd.Flags().StringVar(&flags.FlagAction, "action", "", "Action the customer token is allowed to perform")
+	tokenCmd.Flags().StringSliceVar(&flags.FlagAllowedCIDRs, "allowed-cidrs", nil, "Networks the customer token may only be presented from (default any)")
+	tokenCmd.Flags().StringVar(&flags.FlagCertThumbprint, "cert-thumbprint", "", "SHA-256 thumbprint of the client certificate the customer token must be presented with")
+}
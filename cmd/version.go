@@ -4,6 +4,11 @@ Copyright © 2025 Johandré van Deventer <johandre.vandeventer@rubiconsa.com>
 package cmd
 
 import (
+	"fmt"
+	"runtime/debug"
+
+	"github.com/johandrevandeventer/devices-api-server/internal/config"
+	"github.com/johandrevandeventer/textutils"
 	"github.com/spf13/cobra"
 )
 
@@ -13,9 +18,35 @@ var versionCmd = &cobra.Command{
 	Short: VersionCmdShort,
 	Long:  VersionCmdLong,
 	Run: func(cmd *cobra.Command, args []string) {
+		config.PrintInfo(true)
+		printBuildInfo()
 	},
 }
 
+// printBuildInfo prints the module and VCS details embedded by the Go toolchain
+func printBuildInfo() {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		fmt.Println(textutils.ColorText(textutils.Yellow, "Build information not available"))
+		return
+	}
+
+	fmt.Printf("Module: %s %s\n", info.Main.Path, info.Main.Version)
+
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			fmt.Printf("Commit: %s\n", setting.Value)
+		case "vcs.time":
+			fmt.Printf("Commit time: %s\n", setting.Value)
+		case "vcs.modified":
+			fmt.Printf("Modified: %s\n", setting.Value)
+		case "GOOS", "GOARCH":
+			fmt.Printf("%s: %s\n", setting.Key, setting.Value)
+		}
+	}
+}
+
 func init() {
 	rootCmd.AddCommand(versionCmd)
 }
@@ -2,7 +2,6 @@ package initializers
 
 import (
 	"fmt"
-	"os"
 
 	"github.com/johandrevandeventer/devices-api-server/internal/config"
 	"github.com/johandrevandeventer/devices-api-server/internal/flags"
@@ -10,32 +9,22 @@ import (
 	"github.com/johandrevandeventer/textutils"
 )
 
-// InitConfig initializes the configuration file
-func InitConfig() {
+// InitConfig initializes the configuration file. It runs before the logger is configured, so a
+// failure is recorded in the startup report and returned for the caller to log; the default
+// configuration is used in its place.
+func InitConfig() error {
 	if flags.FlagVerbose {
 		coreutils.VerbosePrintln(textutils.BoldText("Initializing config..."))
 	}
 
 	newFiles, existingFiles, err := config.InitConfig()
 	if err != nil {
-		coreutils.VerbosePrintln(textutils.ColorText(textutils.Red, fmt.Sprintf("Failed to initialize configuration file: %s", err)))
-		os.Exit(1)
-	}
-
-	if len(newFiles) > 0 {
-		for _, file := range newFiles {
-			coreutils.VerbosePrintln(textutils.ColorText(textutils.Green, fmt.Sprintf("-> Configuration file created: %s", file)))
-		}
-
-		coreutils.VerbosePrintln("")
-	}
-
-	if len(existingFiles) > 0 {
-		for _, file := range existingFiles {
-			coreutils.VerbosePrintln(textutils.ColorText(textutils.Yellow, fmt.Sprintf("-> Using configuration file: %s", file)))
-		}
-
-		coreutils.VerbosePrintln("")
+		err = fmt.Errorf("failed to initialize configuration file: %w", err)
+		startupReport.Errors = append(startupReport.Errors, err.Error())
+		return err
 	}
 
+	startupReport.ConfigFilesCreated = newFiles
+	startupReport.ConfigFilesUsed = existingFiles
+	return nil
 }
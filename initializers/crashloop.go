@@ -0,0 +1,71 @@
+package initializers
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/johandrevandeventer/devices-api-server/internal/config"
+	"github.com/johandrevandeventer/devices-api-server/internal/crashloop"
+	"github.com/johandrevandeventer/devices-api-server/internal/statestore"
+	"go.uber.org/zap"
+)
+
+// startHistory holds the runs of the application, including the current one
+var startHistory *crashloop.History
+
+// InitCrashLoopGuard records the start of this run and, if the application has been
+// crashing repeatedly, delays startup with an escalating backoff before the database is touched
+func InitCrashLoopGuard(cfg *config.Config, logger *zap.Logger, statePersister *statestore.Store) {
+	crashLoopCfg := cfg.App.Runtime.CrashLoop
+	historyPath := filepath.Join(filepath.Dir(cfg.App.Runtime.PersistFilePath), "start_history.json")
+
+	history, err := crashloop.Load(historyPath)
+	if err != nil {
+		logger.Warn("Failed to load start history, crash-loop detection disabled", zap.Error(err))
+		return
+	}
+
+	now := time.Now()
+	window := time.Duration(crashLoopCfg.WindowSeconds) * time.Second
+	crashes := history.RecentCrashes(window, now)
+	delay := crashloop.Backoff(
+		crashes,
+		crashLoopCfg.Threshold,
+		time.Duration(crashLoopCfg.BaseBackoffSeconds)*time.Second,
+		time.Duration(crashLoopCfg.MaxBackoffSeconds)*time.Second,
+	)
+
+	statePersister.Set("crash_loop", map[string]any{})
+	statePersister.Set("crash_loop.recent_crashes", crashes)
+	statePersister.Set("crash_loop.backoff", delay.String())
+
+	if delay > 0 {
+		logger.Error("CRITICAL: crash loop detected, delaying startup",
+			zap.Int("recentCrashes", crashes),
+			zap.Duration("window", window),
+			zap.Duration("backoff", delay),
+		)
+		time.Sleep(delay)
+	}
+
+	history.RecordStart(time.Now())
+	if err := history.Save(); err != nil {
+		logger.Warn("Failed to save start history", zap.Error(err))
+	}
+
+	startHistory = history
+}
+
+// RecordExit records why the current run stopped
+func RecordExit(reason string, logger *zap.Logger, statePersister *statestore.Store) {
+	statePersister.Set("app.exit_reason", reason)
+
+	if startHistory == nil {
+		return
+	}
+
+	startHistory.RecordExit(reason, time.Now())
+	if err := startHistory.Save(); err != nil {
+		logger.Warn("Failed to save start history", zap.Error(err))
+	}
+}
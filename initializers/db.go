@@ -3,27 +3,61 @@ package initializers
 import (
 	"fmt"
 	"os"
+	"slices"
+	"time"
 
+	"github.com/johandrevandeventer/devices-api-server/internal/cache"
+	"github.com/johandrevandeventer/devices-api-server/internal/config"
+	"github.com/johandrevandeventer/devices-api-server/internal/devicetoken"
 	"github.com/johandrevandeventer/devices-api-server/internal/flags"
+	"github.com/johandrevandeventer/devices-api-server/internal/server/handlers"
 	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
 	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
-	coreutils "github.com/johandrevandeventer/devices-api-server/utils"
-	"github.com/johandrevandeventer/textutils"
+	"github.com/johandrevandeventer/logging"
+	"go.uber.org/zap"
 )
 
-func InitDB() {
+func InitDB(cfg *config.Config) {
+	devicesdb.SetOptions(devicesdb.Options{
+		PrepareStmt:     cfg.App.Database.PrepareStmt,
+		MaxOpenConns:    cfg.App.Database.MaxOpenConns,
+		MaxIdleConns:    cfg.App.Database.MaxIdleConns,
+		ConnMaxLifetime: time.Duration(cfg.App.Database.ConnMaxLifetimeMinutes) * time.Minute,
+		VerboseSQL:      cfg.App.Profile(flags.FlagEnvironment).VerboseSQL,
+	})
+
+	logger := logging.GetLogger("initializers")
+
 	_, err := devicesdb.NewDB()
 	if err != nil {
-		fmt.Println(textutils.BoldText("Initializing db..."))
-		fmt.Println(textutils.ColorText(textutils.Red, fmt.Sprintf("Failed to initialize db: %s", err)))
+		logger.Error("Failed to initialize db", zap.Error(err))
 		os.Exit(1)
 	}
 
-	if flags.FlagVerbose {
-		coreutils.VerbosePrintln(textutils.BoldText("Initializing db..."))
+	if flags.FlagVerbose && !flags.FlagQuiet {
+		logger.Info("Initializing db")
+	}
+
+	serialScope := cfg.App.Devices.SerialScope
+	if serialScope != models.SerialScopeCustomer {
+		serialScope = models.SerialScopeGlobal
 	}
+	handlers.SetDeviceSerialScope(serialScope)
+	handlers.SetHeartbeatOnlineWindow(time.Duration(cfg.App.History.OnlineWindowMinutes) * time.Minute)
+	handlers.SetTokenTTLs(time.Duration(cfg.App.Tokens.AccessTTLMinutes)*time.Minute, time.Duration(cfg.App.Tokens.RefreshTTLHours)*time.Hour)
 
-	initTables(devicesdb.BMS_DB_Instance)
+	initTables(logger, devicesdb.BMS_DB_Instance)
+	initColumns(logger, devicesdb.BMS_DB_Instance)
+	initDeviceCustomers(logger, devicesdb.BMS_DB_Instance)
+	initDeviceReferences(logger, devicesdb.BMS_DB_Instance)
+	initDeviceControllers(logger, devicesdb.BMS_DB_Instance)
+	initDeviceGateways(logger, devicesdb.BMS_DB_Instance)
+	initDeviceTokens(logger, devicesdb.BMS_DB_Instance)
+	initIndexes(logger, devicesdb.BMS_DB_Instance, serialScope)
+
+	if err := cache.Names().Warm(devicesdb.BMS_DB_Instance); err != nil {
+		logger.Warn("Failed to warm name cache", zap.Error(err))
+	}
 
 	// defer db.Close()
 	// db.Migrate("auth_tokens", models.AuthToken{})
@@ -33,31 +67,56 @@ func InitDB() {
 	// db.Migrate("device_statuses", models.DeviceStatus{})
 }
 
-func initTables(db *devicesdb.BMS_DB) {
-	tablesList := []string{
-		"auth_tokens",
-		"customers",
-		"sites",
-		"devices",
-		"device_statuses",
-	}
+// Tables lists the tables the application manages
+var Tables = []string{
+	"auth_tokens",
+	"customers",
+	"sites",
+	"devices",
+	"device_statuses",
+	"device_status_transitions",
+	"device_uptime_rollups",
+	"device_energy_rollups",
+	"customer_api_usages",
+	"device_dependencies",
+	"device_meters",
+	"point_addresses",
+	"device_templates",
+	"device_template_points",
+	"tags",
+	"device_tags",
+	"tag_rules",
+	"saved_filters",
+	"site_health_snapshots",
+	"provisioning_sessions",
+	"point_readings",
+	"customer_settings",
+	"fleet_snapshots",
+	"gateway_credentials",
+	"controllers",
+	"gateways",
+	"api_keys",
+}
 
+func initTables(logger *zap.Logger, db *devicesdb.BMS_DB) {
 	existingTablesList := []string{}
 	newTablesList := []string{}
 
-	for _, table := range tablesList {
-		if !db.TableExists(table) {
-			newTablesList = append(newTablesList, table)
-		} else {
+	for _, table := range Tables {
+		exists, err := db.TableExists(table)
+		switch {
+		case err != nil:
+			// The table is left alone rather than migrated on a guess
+			logger.Error("Failed to check table", zap.String("table", table), zap.Error(err))
+			startupReport.Errors = append(startupReport.Errors, err.Error())
+		case exists:
 			existingTablesList = append(existingTablesList, table)
+		default:
+			newTablesList = append(newTablesList, table)
 		}
 	}
 
-	if len(existingTablesList) > 0 {
-		for _, table := range existingTablesList {
-			fmt.Println(textutils.ColorText(textutils.Yellow, fmt.Sprintf("-> Table exists: %s", table)))
-		}
-	}
+	startupReport.TablesExisting = existingTablesList
 
 	if len(newTablesList) > 0 {
 		for _, table := range newTablesList {
@@ -72,9 +131,455 @@ func initTables(db *devicesdb.BMS_DB) {
 				db.Migrate("devices", models.Device{})
 			case "device_statuses":
 				db.Migrate("device_statuses", models.DeviceStatus{})
+			case "device_status_transitions":
+				db.Migrate("device_status_transitions", models.DeviceStatusTransition{})
+			case "device_uptime_rollups":
+				db.Migrate("device_uptime_rollups", models.DeviceUptimeRollup{})
+			case "device_energy_rollups":
+				db.Migrate("device_energy_rollups", models.DeviceEnergyRollup{})
+			case "customer_api_usages":
+				db.Migrate("customer_api_usages", models.CustomerApiUsage{})
+			case "device_dependencies":
+				db.Migrate("device_dependencies", models.DeviceDependency{})
+			case "device_meters":
+				db.Migrate("device_meters", models.DeviceMeter{})
+			case "point_addresses":
+				db.Migrate("point_addresses", models.PointAddress{})
+			case "device_templates":
+				db.Migrate("device_templates", models.DeviceTemplate{})
+			case "device_template_points":
+				db.Migrate("device_template_points", models.DeviceTemplatePoint{})
+			case "tags":
+				db.Migrate("tags", models.Tag{})
+			case "device_tags":
+				db.Migrate("device_tags", models.DeviceTag{})
+			case "tag_rules":
+				db.Migrate("tag_rules", models.TagRule{})
+			case "saved_filters":
+				db.Migrate("saved_filters", models.SavedFilter{})
+			case "site_health_snapshots":
+				db.Migrate("site_health_snapshots", models.SiteHealthSnapshot{})
+			case "provisioning_sessions":
+				db.Migrate("provisioning_sessions", models.ProvisioningSession{})
+			case "point_readings":
+				db.Migrate("point_readings", models.PointReading{})
+			case "customer_settings":
+				db.Migrate("customer_settings", models.CustomerSetting{})
+			case "fleet_snapshots":
+				db.Migrate("fleet_snapshots", models.FleetSnapshot{})
+			case "gateway_credentials":
+				db.Migrate("gateway_credentials", models.GatewayCredential{})
+			case "controllers":
+				db.Migrate("controllers", models.Controller{})
+			case "gateways":
+				db.Migrate("gateways", models.Gateway{})
+			case "api_keys":
+				db.Migrate("api_keys", models.APIKey{})
 			}
 
-			fmt.Println(textutils.ColorText(textutils.Green, fmt.Sprintf("-> Table created: %s", table)))
+			startupReport.TablesCreated = append(startupReport.TablesCreated, table)
+		}
+	}
+}
+
+// expectedColumn describes a column added to a table after it was first created
+type expectedColumn struct {
+	table string
+	field string
+	model any
+}
+
+var expectedColumns = []expectedColumn{
+	{table: "customers", field: "ContractStart", model: models.Customer{}},
+	{table: "customers", field: "ContractEnd", model: models.Customer{}},
+	{table: "auth_tokens", field: "SiteID", model: models.AuthToken{}},
+	{table: "auth_tokens", field: "ExpiresAt", model: models.AuthToken{}},
+	{table: "auth_tokens", field: "RefreshTokenHash", model: models.AuthToken{}},
+	{table: "auth_tokens", field: "RefreshExpiresAt", model: models.AuthToken{}},
+	{table: "sites", field: "Address", model: models.Site{}},
+	{table: "sites", field: "Latitude", model: models.Site{}},
+	{table: "sites", field: "Longitude", model: models.Site{}},
+	{table: "sites", field: "Timezone", model: models.Site{}},
+	{table: "devices", field: "DeletedBy", model: models.Device{}},
+	{table: "devices", field: "CustomerID", model: models.Device{}},
+	{table: "devices", field: "FirmwareVersion", model: models.Device{}},
+	{table: "devices", field: "HardwareRevision", model: models.Device{}},
+	{table: "devices", field: "ControllerID", model: models.Device{}},
+	{table: "devices", field: "GatewayID", model: models.Device{}},
+	{table: "gateway_credentials", field: "GatewayID", model: models.GatewayCredential{}},
+	{table: "device_statuses", field: "State", model: models.DeviceStatus{}},
+	{table: "device_statuses", field: "Detail", model: models.DeviceStatus{}},
+	{table: "device_statuses", field: "DeviceID", model: models.DeviceStatus{}},
+	{table: "device_status_transitions", field: "DeviceID", model: models.DeviceStatusTransition{}},
+	{table: "device_uptime_rollups", field: "DeviceID", model: models.DeviceUptimeRollup{}},
+	{table: "device_meters", field: "DeviceID", model: models.DeviceMeter{}},
+	{table: "device_meters", field: "RegisterPoint", model: models.DeviceMeter{}},
+	{table: "point_addresses", field: "DeviceID", model: models.PointAddress{}},
+	{table: "device_tags", field: "DeviceID", model: models.DeviceTag{}},
+	{table: "device_tags", field: "RuleID", model: models.DeviceTag{}},
+	{table: "device_dependencies", field: "UpstreamDeviceID", model: models.DeviceDependency{}},
+	{table: "device_dependencies", field: "DownstreamDeviceID", model: models.DeviceDependency{}},
+}
+
+// initColumns adds any missing columns to existing tables
+func initColumns(logger *zap.Logger, db *devicesdb.BMS_DB) {
+	for _, column := range expectedColumns {
+		if db.HasColumn(column.model, column.field) {
+			continue
+		}
+
+		if err := db.AddColumn(column.model, column.field); err != nil {
+			logger.Error("Failed to add column", zap.String("table", column.table), zap.String("column", column.field), zap.Error(err))
+			continue
+		}
+
+		startupReport.ColumnsAdded = append(startupReport.ColumnsAdded, column.table+"."+column.field)
+	}
+}
+
+// initDeviceCustomers sets the customer of devices from their site, which devices created before
+// the customer was stored on the device are missing
+func initDeviceCustomers(logger *zap.Logger, db *devicesdb.BMS_DB) {
+	result := db.DB.Exec(`UPDATE devices JOIN sites ON sites.id = devices.site_id
+		SET devices.customer_id = sites.customer_id
+		WHERE devices.customer_id IS NULL OR devices.customer_id <> sites.customer_id`)
+	if result.Error != nil {
+		logger.Error("Failed to set device customers", zap.Error(result.Error))
+		return
+	}
+
+	if result.RowsAffected > 0 {
+		logger.Info("Set device customers", zap.Int64("devices", result.RowsAffected))
+	}
+}
+
+// deviceReference is a column of a child table that refers to a device by serial number, along
+// with the column that refers to the same device by ID
+type deviceReference struct {
+	table        string
+	serialColumn string
+	idColumn     string
+}
+
+// deviceReferences lists the child tables of devices, which were keyed by serial number before
+// serial numbers could be shared between customers
+var deviceReferences = []deviceReference{
+	{table: "device_statuses", serialColumn: "device_serial_number", idColumn: "device_id"},
+	{table: "device_status_transitions", serialColumn: "device_serial_number", idColumn: "device_id"},
+	{table: "device_uptime_rollups", serialColumn: "device_serial_number", idColumn: "device_id"},
+	{table: "device_meters", serialColumn: "device_serial_number", idColumn: "device_id"},
+	{table: "point_addresses", serialColumn: "device_serial_number", idColumn: "device_id"},
+	{table: "device_tags", serialColumn: "device_serial_number", idColumn: "device_id"},
+	{table: "device_dependencies", serialColumn: "upstream_serial_number", idColumn: "upstream_device_id"},
+	{table: "device_dependencies", serialColumn: "downstream_serial_number", idColumn: "downstream_device_id"},
+}
+
+// initDeviceReferences sets the device ID of child rows that only refer to their device by serial
+// number. Rows whose serial number is shared by several devices cannot be resolved and are left
+// for an administrator, so they are counted and logged.
+func initDeviceReferences(logger *zap.Logger, db *devicesdb.BMS_DB) {
+	for _, ref := range deviceReferences {
+		result := db.DB.Exec(fmt.Sprintf(`UPDATE %[1]s
+			JOIN (
+				SELECT device_serial_number, MIN(id) AS id FROM devices
+				GROUP BY device_serial_number HAVING COUNT(*) = 1
+			) unique_devices ON unique_devices.device_serial_number = %[1]s.%[2]s
+			SET %[1]s.%[3]s = unique_devices.id
+			WHERE %[1]s.%[3]s IS NULL`, ref.table, ref.serialColumn, ref.idColumn))
+		if result.Error != nil {
+			logger.Error("Failed to set device IDs", zap.String("table", ref.table), zap.String("column", ref.idColumn), zap.Error(result.Error))
+			continue
+		}
+
+		if result.RowsAffected > 0 {
+			logger.Info("Set device IDs", zap.String("table", ref.table), zap.String("column", ref.idColumn), zap.Int64("rows", result.RowsAffected))
 		}
+
+		var unresolved int64
+		if err := db.DB.Table(ref.table).Where(ref.idColumn + " IS NULL").Count(&unresolved).Error; err != nil {
+			logger.Error("Failed to count unresolved device references", zap.String("table", ref.table), zap.Error(err))
+			continue
+		}
+		if unresolved > 0 {
+			logger.Warn("Rows refer to a serial number shared by several devices and were not linked to a device",
+				zap.String("table", ref.table), zap.String("column", ref.idColumn), zap.Int64("rows", unresolved))
+		}
+	}
+}
+
+// initDeviceControllers creates the controllers that live devices name by controller serial number
+// but that have no row yet, then links every device to the controller at its site with its serial
+// number, and unlinks devices whose controller serial number no longer matches. Devices stored
+// before controllers had their own table, or written with a new controller serial number since the
+// last start, are brought in step this way.
+func initDeviceControllers(logger *zap.Logger, db *devicesdb.BMS_DB) {
+	result := db.DB.Exec(`INSERT INTO controllers (id, created_at, updated_at, customer_id, site_id, serial_number, controller_type)
+		SELECT UUID(), NOW(), NOW(), MIN(devices.customer_id), devices.site_id, devices.controller_serial_number, MIN(devices.controller)
+		FROM devices
+		LEFT JOIN controllers ON controllers.site_id = devices.site_id
+			AND controllers.serial_number = devices.controller_serial_number
+			AND controllers.deleted_at IS NULL
+		WHERE devices.deleted_at IS NULL AND devices.controller_serial_number <> '' AND controllers.id IS NULL
+		GROUP BY devices.site_id, devices.controller_serial_number`)
+	if result.Error != nil {
+		logger.Error("Failed to create device controllers", zap.Error(result.Error))
+		return
+	}
+	if result.RowsAffected > 0 {
+		logger.Info("Created device controllers", zap.Int64("controllers", result.RowsAffected))
+	}
+
+	result = db.DB.Exec(`UPDATE devices JOIN controllers ON controllers.site_id = devices.site_id
+			AND controllers.serial_number = devices.controller_serial_number
+			AND controllers.deleted_at IS NULL
+		SET devices.controller_id = controllers.id
+		WHERE devices.controller_id IS NULL OR devices.controller_id <> controllers.id`)
+	if result.Error != nil {
+		logger.Error("Failed to link devices to controllers", zap.Error(result.Error))
+		return
+	}
+	if result.RowsAffected > 0 {
+		logger.Info("Linked devices to controllers", zap.Int64("devices", result.RowsAffected))
+	}
+
+	result = db.DB.Exec(`UPDATE devices LEFT JOIN controllers ON controllers.id = devices.controller_id
+			AND controllers.site_id = devices.site_id
+			AND controllers.serial_number = devices.controller_serial_number
+			AND controllers.deleted_at IS NULL
+		SET devices.controller_id = NULL
+		WHERE devices.controller_id IS NOT NULL AND controllers.id IS NULL`)
+	if result.Error != nil {
+		logger.Error("Failed to unlink devices from controllers", zap.Error(result.Error))
+		return
+	}
+	if result.RowsAffected > 0 {
+		logger.Info("Unlinked devices from controllers", zap.Int64("devices", result.RowsAffected))
+	}
+}
+
+// initDeviceGateways creates the gateways that live devices or gateway credentials name but that
+// have no row yet, then links devices and credentials to the gateway at their site with their
+// gateway name, and unlinks devices whose gateway name no longer matches, like initDeviceControllers
+func initDeviceGateways(logger *zap.Logger, db *devicesdb.BMS_DB) {
+	result := db.DB.Exec(`INSERT INTO gateways (id, created_at, updated_at, customer_id, site_id, name)
+		SELECT UUID(), NOW(), NOW(), MIN(named.customer_id), named.site_id, named.gateway
+		FROM (
+			SELECT customer_id, site_id, gateway FROM devices WHERE deleted_at IS NULL AND gateway <> ''
+			UNION
+			SELECT customer_id, site_id, gateway FROM gateway_credentials WHERE deleted_at IS NULL
+		) named
+		LEFT JOIN gateways ON gateways.site_id = named.site_id AND gateways.name = named.gateway
+		WHERE gateways.id IS NULL
+		GROUP BY named.site_id, named.gateway`)
+	if result.Error != nil {
+		logger.Error("Failed to create gateways", zap.Error(result.Error))
+		return
+	}
+	if result.RowsAffected > 0 {
+		logger.Info("Created gateways", zap.Int64("gateways", result.RowsAffected))
+	}
+
+	for _, table := range []string{"devices", "gateway_credentials"} {
+		result = db.DB.Exec(fmt.Sprintf(`UPDATE %[1]s JOIN gateways ON gateways.site_id = %[1]s.site_id
+				AND gateways.name = %[1]s.gateway
+				AND gateways.deleted_at IS NULL
+			SET %[1]s.gateway_id = gateways.id
+			WHERE %[1]s.gateway_id IS NULL OR %[1]s.gateway_id <> gateways.id`, table))
+		if result.Error != nil {
+			logger.Error("Failed to link gateways", zap.String("table", table), zap.Error(result.Error))
+			return
+		}
+		if result.RowsAffected > 0 {
+			logger.Info("Linked gateways", zap.String("table", table), zap.Int64("rows", result.RowsAffected))
+		}
+	}
+
+	result = db.DB.Exec(`UPDATE devices LEFT JOIN gateways ON gateways.id = devices.gateway_id
+			AND gateways.site_id = devices.site_id
+			AND gateways.name = devices.gateway
+			AND gateways.deleted_at IS NULL
+		SET devices.gateway_id = NULL
+		WHERE devices.gateway_id IS NOT NULL AND gateways.id IS NULL`)
+	if result.Error != nil {
+		logger.Error("Failed to unlink devices from gateways", zap.Error(result.Error))
+		return
+	}
+	if result.RowsAffected > 0 {
+		logger.Info("Unlinked devices from gateways", zap.Int64("devices", result.RowsAffected))
+	}
+}
+
+// initDeviceTokens encrypts the auth tokens of devices stored before token encryption was enabled
+func initDeviceTokens(logger *zap.Logger, db *devicesdb.BMS_DB) {
+	if !devicetoken.Enabled() {
+		return
+	}
+
+	var devices []models.Device
+	if err := db.DB.Unscoped().Select("id", "auth_token").Find(&devices).Error; err != nil {
+		logger.Error("Failed to fetch unencrypted device tokens", zap.Error(err))
+		return
+	}
+
+	sealed := 0
+	for _, device := range devices {
+		if devicetoken.IsSealed(device.AuthToken) {
+			continue
+		}
+
+		token, err := devicetoken.Seal(device.AuthToken)
+		if err != nil {
+			logger.Error("Failed to encrypt device token", zap.String("device", device.ID.String()), zap.Error(err))
+			continue
+		}
+
+		if err := db.DB.Unscoped().Model(&models.Device{}).Where("id = ?", device.ID).UpdateColumn("auth_token", token).Error; err != nil {
+			logger.Error("Failed to store encrypted device token", zap.String("device", device.ID.String()), zap.Error(err))
+			continue
+		}
+		sealed++
+	}
+
+	if sealed > 0 {
+		logger.Info("Encrypted device tokens", zap.Int("devices", sealed))
+	}
+}
+
+// expectedIndex describes an index that lookup paths rely on
+type expectedIndex struct {
+	table string
+	name  string
+	model any
+}
+
+var expectedIndexes = []expectedIndex{
+	{table: "devices", name: "idx_devices_device_serial_number", model: models.Device{}},
+	{table: "devices", name: "idx_devices_serial_number_customer", model: models.Device{}},
+	{table: "devices", name: "idx_devices_site_id", model: models.Device{}},
+	{table: "devices", name: "idx_devices_gateway", model: models.Device{}},
+	{table: "devices", name: "idx_devices_controller_serial_number", model: models.Device{}},
+	{table: "devices", name: "idx_devices_firmware_version", model: models.Device{}},
+	{table: "devices", name: "idx_devices_controller_id", model: models.Device{}},
+	{table: "devices", name: "idx_devices_gateway_id", model: models.Device{}},
+	{table: "sites", name: "idx_sites_customer_id", model: models.Site{}},
+	{table: "sites", name: "idx_sites_customer_name", model: models.Site{}},
+	{table: "sites", name: "idx_sites_timezone", model: models.Site{}},
+	{table: "device_statuses", name: "idx_device_statuses_device_id", model: models.DeviceStatus{}},
+	{table: "device_status_transitions", name: "idx_device_status_transitions_device_id_changed", model: models.DeviceStatusTransition{}},
+	{table: "device_uptime_rollups", name: "idx_device_uptime_rollups_device_id_day", model: models.DeviceUptimeRollup{}},
+	{table: "device_energy_rollups", name: "idx_device_energy_rollups_device_site_day", model: models.DeviceEnergyRollup{}},
+	{table: "device_energy_rollups", name: "idx_device_energy_rollups_site_day", model: models.DeviceEnergyRollup{}},
+	{table: "device_meters", name: "idx_device_meters_device_id", model: models.DeviceMeter{}},
+	{table: "point_addresses", name: "idx_point_addresses_device_id_point", model: models.PointAddress{}},
+	{table: "point_readings", name: "idx_point_readings_device_id_point", model: models.PointReading{}},
+	{table: "customer_settings", name: "idx_customer_settings_customer_id_key", model: models.CustomerSetting{}},
+	{table: "fleet_snapshots", name: "idx_fleet_snapshots_day_customer_type", model: models.FleetSnapshot{}},
+	{table: "gateway_credentials", name: "idx_gateway_credentials_site_gateway", model: models.GatewayCredential{}},
+	{table: "controllers", name: "idx_controllers_site_serial_number", model: models.Controller{}},
+	{table: "gateways", name: "idx_gateways_site_name", model: models.Gateway{}},
+	{table: "api_keys", name: "idx_api_keys_customer_name", model: models.APIKey{}},
+	{table: "api_keys", name: "idx_api_keys_key_hash", model: models.APIKey{}},
+	{table: "gateway_credentials", name: "idx_gateway_credentials_gateway_id", model: models.GatewayCredential{}},
+	{table: "device_tags", name: "idx_device_tags_tag_device_id", model: models.DeviceTag{}},
+	{table: "device_tags", name: "idx_device_tags_device_id", model: models.DeviceTag{}},
+	{table: "device_tags", name: "idx_device_tags_rule_id", model: models.DeviceTag{}},
+	{table: "tag_rules", name: "idx_tag_rules_name", model: models.TagRule{}},
+	{table: "saved_filters", name: "idx_saved_filters_owner_name", model: models.SavedFilter{}},
+	{table: "site_health_snapshots", name: "idx_site_health_snapshots_site_id_computed", model: models.SiteHealthSnapshot{}},
+	{table: "site_health_snapshots", name: "idx_site_health_snapshots_computed_at", model: models.SiteHealthSnapshot{}},
+	{table: "device_dependencies", name: "idx_device_dependencies_device_edge", model: models.DeviceDependency{}},
+	{table: "device_dependencies", name: "idx_device_dependencies_downstream_device_id", model: models.DeviceDependency{}},
+	{table: "auth_tokens", name: "idx_auth_tokens_customer_site_action", model: models.AuthToken{}},
+	{table: "auth_tokens", name: "idx_auth_tokens_refresh_token_hash", model: models.AuthToken{}},
+}
+
+// replacedIndex is a unique index that a wider index replaced. It is dropped once the replacement
+// exists, since it would reject rows the replacement allows, e.g. rows of devices that share a
+// serial number, tokens of different customers for the same action or sites of different
+// customers with the same name.
+type replacedIndex struct {
+	table       string
+	name        string
+	replacement string
+	model       any
+}
+
+var replacedIndexes = []replacedIndex{
+	{table: "device_statuses", name: "uni_device_statuses_device_serial_number", replacement: "idx_device_statuses_device_id", model: models.DeviceStatus{}},
+	{table: "device_statuses", name: "device_serial_number", replacement: "idx_device_statuses_device_id", model: models.DeviceStatus{}},
+	{table: "device_uptime_rollups", name: "idx_device_uptime_rollups_device_day", replacement: "idx_device_uptime_rollups_device_id_day", model: models.DeviceUptimeRollup{}},
+	{table: "device_meters", name: "idx_device_meters_device_serial_number", replacement: "idx_device_meters_device_id", model: models.DeviceMeter{}},
+	{table: "point_addresses", name: "idx_point_addresses_device_point", replacement: "idx_point_addresses_device_id_point", model: models.PointAddress{}},
+	{table: "device_tags", name: "idx_device_tags_tag_device", replacement: "idx_device_tags_tag_device_id", model: models.DeviceTag{}},
+	{table: "device_dependencies", name: "idx_device_dependencies_edge", replacement: "idx_device_dependencies_device_edge", model: models.DeviceDependency{}},
+	{table: "auth_tokens", name: "idx_customer_action", replacement: "idx_auth_tokens_customer_site_action", model: models.AuthToken{}},
+	{table: "sites", name: "idx_sites_name", replacement: "idx_sites_customer_name", model: models.Site{}},
+	{table: "sites", name: "uni_sites_name", replacement: "idx_sites_customer_name", model: models.Site{}},
+}
+
+// globalSerialIndexes enforce that a serial number identifies a single device across all customers.
+// uni_devices_device_serial_number is the unique constraint GORM created for tables created before
+// the serial number index was named.
+var globalSerialIndexes = []string{"idx_devices_device_serial_number", "uni_devices_device_serial_number"}
+
+// initIndexes creates any missing lookup indexes and warns about those that could not be created.
+// When serial numbers are scoped per customer the global serial number indexes are dropped instead,
+// once the per-customer index exists. Every step checks the current schema first, so it can run on
+// every start.
+func initIndexes(logger *zap.Logger, db *devicesdb.BMS_DB, serialScope string) {
+	customerScope := serialScope == models.SerialScopeCustomer
+
+	for _, index := range expectedIndexes {
+		if customerScope && slices.Contains(globalSerialIndexes, index.name) {
+			continue
+		}
+
+		if db.HasIndex(index.model, index.name) {
+			continue
+		}
+
+		if err := db.CreateIndex(index.model, index.name); err != nil {
+			logger.Warn("Index missing", zap.String("table", index.table), zap.String("index", index.name), zap.Error(err))
+			startupReport.IndexesMissing = append(startupReport.IndexesMissing, index.table+"."+index.name)
+			continue
+		}
+
+		startupReport.IndexesCreated = append(startupReport.IndexesCreated, index.table+"."+index.name)
+	}
+
+	for _, index := range replacedIndexes {
+		if !db.HasIndex(index.model, index.name) || !db.HasIndex(index.model, index.replacement) {
+			continue
+		}
+
+		if err := db.DropIndex(index.model, index.name); err != nil {
+			logger.Error("Failed to drop index", zap.String("table", index.table), zap.String("index", index.name), zap.Error(err))
+			continue
+		}
+
+		startupReport.IndexesDropped = append(startupReport.IndexesDropped, index.table+"."+index.name)
+	}
+
+	if !customerScope {
+		return
+	}
+
+	// Dropping the global indexes without the per-customer index would leave serial numbers unchecked
+	if !db.HasIndex(models.Device{}, "idx_devices_serial_number_customer") {
+		logger.Error("Per-customer serial number index is missing, keeping the global serial number indexes")
+		return
+	}
+
+	for _, name := range globalSerialIndexes {
+		if !db.HasIndex(models.Device{}, name) {
+			continue
+		}
+
+		if err := db.DropIndex(models.Device{}, name); err != nil {
+			logger.Error("Failed to drop index", zap.String("table", "devices"), zap.String("index", name), zap.Error(err))
+			continue
+		}
+
+		startupReport.IndexesDropped = append(startupReport.IndexesDropped, "devices."+name)
 	}
 }
@@ -0,0 +1,29 @@
+package initializers
+
+import (
+	"os"
+
+	"github.com/johandrevandeventer/devices-api-server/internal/devicetoken"
+	"github.com/johandrevandeventer/logging"
+	"go.uber.org/zap"
+)
+
+// deviceTokenKeyVariable names the environment variable holding the device auth token encryption key
+const deviceTokenKeyVariable = "DEVICES_SERVER_TOKEN_KEY"
+
+// InitDeviceTokens sets the key device auth tokens are encrypted with. Without a key tokens are
+// stored as given and the credentials endpoint is disabled.
+func InitDeviceTokens() {
+	logger := logging.GetLogger("initializers")
+
+	key := os.Getenv(deviceTokenKeyVariable)
+	if key == "" {
+		logger.Warn(deviceTokenKeyVariable + " is not set, device auth tokens are stored unencrypted")
+		return
+	}
+
+	if err := devicetoken.Init(key); err != nil {
+		logger.Error("Failed to initialize device token encryption", zap.Error(err))
+		os.Exit(1)
+	}
+}
@@ -1,30 +1,34 @@
 package initializers
 
 import (
-	"fmt"
 	"os"
 	"path/filepath"
 
 	"github.com/johandrevandeventer/devices-api-server/internal/config"
+	"github.com/johandrevandeventer/devices-api-server/internal/statestore"
 	"github.com/johandrevandeventer/persist"
+	"go.uber.org/zap"
 )
 
-// InitPersist initializes the file persister.
-func InitPersist(cfg *config.Config) (*persist.FilePersister, error) {
+// InitPersist initializes the state store. The state is only used for bookkeeping, so if the
+// persist file cannot be used the store keeps the state in memory and the health check reports
+// the degradation instead of the application exiting.
+func InitPersist(cfg *config.Config, logger *zap.Logger) *statestore.Store {
 	statePersister, err := persist.NewFilePersister(cfg.App.Runtime.PersistFilePath)
 	if err != nil {
 		if delErr := deletePersistDir(cfg.App.Runtime.PersistFilePath); delErr != nil {
-			return nil, fmt.Errorf("failed to delete persist directory: %w", delErr)
+			logger.Warn("Failed to delete persist directory", zap.Error(delErr))
 		}
 
 		// Retry initialization after deleting the directory
 		statePersister, err = persist.NewFilePersister(cfg.App.Runtime.PersistFilePath)
 		if err != nil {
-			return nil, fmt.Errorf("failed to reinitialize state persister: %w", err)
+			logger.Warn("Failed to initialize the state persister, keeping state in memory", zap.Error(err))
+			return statestore.NewDegraded(err.Error())
 		}
 	}
 
-	return statePersister, nil
+	return statestore.New(statePersister)
 }
 
 // deletePersistDir removes the entire directory containing the persistence file.
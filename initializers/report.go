@@ -0,0 +1,68 @@
+package initializers
+
+import (
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/johandrevandeventer/devices-api-server/internal/config"
+	"github.com/johandrevandeventer/devices-api-server/internal/flags"
+	"github.com/johandrevandeventer/devices-api-server/internal/statestore"
+	"github.com/johandrevandeventer/devices-api-server/internal/status"
+	"github.com/johandrevandeventer/devices-api-server/internal/timefmt"
+	"go.uber.org/zap"
+)
+
+// startupReport is filled in by the initializers as they run
+var startupReport status.StartupReport
+
+// Report returns what the initializers have recorded so far
+func Report() status.StartupReport {
+	return startupReport
+}
+
+// ReportStartup completes the startup report, logs it and persists it via the state persister
+func ReportStartup(cfg *config.Config, logger *zap.Logger, statePersister *statestore.Store) {
+	startupReport.AppName = cfg.System.AppName
+	startupReport.AppVersion = cfg.System.AppVersion
+	startupReport.ReleaseDate = cfg.System.ReleaseDate
+	startupReport.GoVersion = strings.Replace(runtime.Version(), "go", "", 1)
+	startupReport.Environment = flags.FlagEnvironment
+	startupReport.StartTime = timefmt.Format(time.Now())
+
+	logger.Info("Startup complete",
+		zap.String("appName", startupReport.AppName),
+		zap.String("appVersion", startupReport.AppVersion),
+		zap.String("releaseDate", startupReport.ReleaseDate),
+		zap.String("goVersion", startupReport.GoVersion),
+		zap.String("environment", startupReport.Environment),
+		zap.Strings("configFilesCreated", startupReport.ConfigFilesCreated),
+		zap.Strings("configFilesUsed", startupReport.ConfigFilesUsed),
+		zap.Strings("tablesCreated", startupReport.TablesCreated),
+		zap.Strings("tablesExisting", startupReport.TablesExisting),
+		zap.Strings("indexesCreated", startupReport.IndexesCreated),
+		zap.Strings("indexesMissing", startupReport.IndexesMissing),
+		zap.Strings("indexesDropped", startupReport.IndexesDropped),
+		zap.Strings("columnsAdded", startupReport.ColumnsAdded),
+		zap.Strings("errors", startupReport.Errors),
+	)
+
+	statePersister.Set("startup", map[string]any{})
+	statePersister.Set("startup.app_name", startupReport.AppName)
+	statePersister.Set("startup.app_version", startupReport.AppVersion)
+	statePersister.Set("startup.release_date", startupReport.ReleaseDate)
+	statePersister.Set("startup.go_version", startupReport.GoVersion)
+	statePersister.Set("startup.environment", startupReport.Environment)
+	statePersister.Set("startup.start_time", startupReport.StartTime)
+	statePersister.Set("startup.config_files_created", startupReport.ConfigFilesCreated)
+	statePersister.Set("startup.config_files_used", startupReport.ConfigFilesUsed)
+	statePersister.Set("startup.tables_created", startupReport.TablesCreated)
+	statePersister.Set("startup.tables_existing", startupReport.TablesExisting)
+	statePersister.Set("startup.indexes_created", startupReport.IndexesCreated)
+	statePersister.Set("startup.indexes_missing", startupReport.IndexesMissing)
+	statePersister.Set("startup.indexes_dropped", startupReport.IndexesDropped)
+	statePersister.Set("startup.columns_added", startupReport.ColumnsAdded)
+	statePersister.Set("startup.errors", startupReport.Errors)
+
+	status.SetStartupReport(startupReport)
+}
@@ -0,0 +1,42 @@
+package initializers
+
+import (
+	"github.com/johandrevandeventer/devices-api-server/internal/devicetoken"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+)
+
+// SeedDB inserts a demo customer, site and device, reusing any that already exist
+func SeedDB() error {
+	bmsDB, err := devicesdb.GetDB()
+	if err != nil {
+		return err
+	}
+
+	var customer models.Customer
+	if err := bmsDB.DB.Where(models.Customer{Name: "Demo Customer"}).FirstOrCreate(&customer).Error; err != nil {
+		return err
+	}
+
+	var site models.Site
+	if err := bmsDB.DB.Where(models.Site{Name: "Demo Site", CustomerID: customer.ID}).FirstOrCreate(&site).Error; err != nil {
+		return err
+	}
+
+	authToken, err := devicetoken.Seal("demo")
+	if err != nil {
+		return err
+	}
+
+	var device models.Device
+	return bmsDB.DB.Where(models.Device{DeviceSerialNumber: "DEMO-0001", CustomerID: customer.ID}).Attrs(models.Device{
+		Gateway:                "demo-gateway",
+		Controller:             "demo-controller",
+		ControllerSerialNumber: "DEMO-CTRL-0001",
+		DeviceType:             "demo",
+		DeviceName:             "Demo Device",
+		BuildingURL:            "https://localhost",
+		AuthToken:              authToken,
+		SiteID:                 site.ID,
+	}).FirstOrCreate(&device).Error
+}
@@ -0,0 +1,21 @@
+package initializers
+
+import (
+	"github.com/johandrevandeventer/devices-api-server/internal/config"
+	"github.com/johandrevandeventer/devices-api-server/internal/timefmt"
+	"github.com/johandrevandeventer/logging"
+	"go.uber.org/zap"
+)
+
+// InitTimezone sets the zone timestamps are written in, falling back to UTC if the zone is unknown
+func InitTimezone(cfg *config.Config) {
+	timezone := cfg.App.Runtime.Timezone
+	if timezone == "" {
+		timezone = "UTC"
+	}
+
+	if err := timefmt.SetLocation(timezone); err != nil {
+		logging.GetLogger("initializers").Warn("Unknown timezone, using UTC", zap.String("timezone", timezone), zap.Error(err))
+		timefmt.SetLocation("UTC")
+	}
+}
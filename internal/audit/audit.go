@@ -0,0 +1,197 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/johandrevandeventer/devices-api-server/internal/config/app"
+	"github.com/johandrevandeventer/devices-api-server/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// Event names
+const (
+	EventAuthentication    = "authentication"
+	EventTokenValidation   = "token_validation"
+	EventAdminSecret       = "admin_secret"
+	EventTokenIssued       = "token_issued"
+	EventAdminTokenIssued  = "admin_token_issued"
+	EventCustomerCloned    = "customer_cloned"
+	EventDeviceCredentials = "device_credentials_revealed"
+	EventGatewayReplaced   = "gateway_replaced"
+	EventImpersonation     = "impersonation_issued"
+	EventImpersonated      = "impersonated_request"
+	EventCustomerExported  = "customer_exported"
+	EventCustomerImported  = "customer_imported"
+	EventTokenRefreshed    = "token_refreshed"
+)
+
+// Outcome values
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// defaultBufferSize is used when no buffer size is configured
+const defaultBufferSize = 1024
+
+// defaultTimeout is used when no send timeout is configured
+const defaultTimeout = 5 * time.Second
+
+// Event is a single audit record forwarded to the SIEM
+type Event struct {
+	Time       time.Time `json:"time"`
+	Name       string    `json:"name"`
+	Outcome    string    `json:"outcome"`
+	Reason     string    `json:"reason,omitempty"`
+	Subject    string    `json:"subject,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	Method     string    `json:"method,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	// ImpersonatedBy names the support operator when the action was taken with an impersonation token
+	ImpersonatedBy string `json:"impersonated_by,omitempty"`
+}
+
+// sink delivers events to a SIEM endpoint
+type sink interface {
+	Send(ctx context.Context, event Event) error
+	Close() error
+}
+
+var (
+	mu      sync.Mutex
+	events  chan Event
+	done    chan struct{}
+	dropped atomic.Int64
+)
+
+func init() {
+	metrics.Register(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "devices_api",
+			Name:      "audit_events_dropped_total",
+			Help:      "Audit events dropped because the forwarding buffer was full.",
+		}, func() float64 { return float64(dropped.Load()) }),
+	)
+}
+
+// Start starts forwarding audit events to the configured endpoint until Close is called.
+// Events recorded while forwarding is disabled are discarded.
+func Start(cfg app.AuditConfig, appName, appVersion string, logger *zap.Logger) error {
+	if !cfg.Enabled {
+		return nil
+	}
+
+	timeout := time.Duration(cfg.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	bufferSize := cfg.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultBufferSize
+	}
+
+	var s sink
+	switch cfg.Transport {
+	case "udp", "tcp":
+		s = newSyslogSink(cfg.Transport, cfg.Address, appName, appVersion, timeout)
+	case "http", "https":
+		s = newHTTPSink(cfg.Address, timeout)
+	default:
+		return errors.New("unsupported audit transport: " + cfg.Transport)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if events != nil {
+		return errors.New("audit forwarding already started")
+	}
+
+	events = make(chan Event, bufferSize)
+	done = make(chan struct{})
+
+	go forward(s, events, done, timeout, logger)
+
+	logger.Info("Forwarding audit events",
+		zap.String("transport", cfg.Transport),
+		zap.String("address", cfg.Address),
+	)
+
+	return nil
+}
+
+// forward sends events to the sink until the events channel is closed
+func forward(s sink, events <-chan Event, done chan<- struct{}, timeout time.Duration, logger *zap.Logger) {
+	defer close(done)
+	defer s.Close()
+
+	for event := range events {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		if err := s.Send(ctx, event); err != nil {
+			logger.Warn("Failed to forward audit event", zap.String("event", event.Name), zap.Error(err))
+		}
+		cancel()
+	}
+}
+
+// Record queues an event for forwarding without blocking the caller.
+// Events are dropped when the buffer is full.
+func Record(event Event) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if events == nil {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+
+	select {
+	case events <- event:
+	default:
+		dropped.Add(1)
+	}
+}
+
+// RecordRequest queues an event describing the request being handled
+func RecordRequest(c *gin.Context, name, outcome, reason string) {
+	Record(Event{
+		Name:           name,
+		Outcome:        outcome,
+		Reason:         reason,
+		Subject:        c.GetString("customer_id"),
+		RemoteAddr:     c.ClientIP(),
+		Method:         c.Request.Method,
+		Path:           c.FullPath(),
+		ImpersonatedBy: c.GetString("impersonated_by"),
+	})
+}
+
+// Close stops accepting events and waits for the queued events to be forwarded
+func Close(ctx context.Context) error {
+	mu.Lock()
+	if events == nil {
+		mu.Unlock()
+		return nil
+	}
+	close(events)
+	events = nil
+	wait := done
+	mu.Unlock()
+
+	select {
+	case <-wait:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
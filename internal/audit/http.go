@@ -0,0 +1,55 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// httpSink posts each event as JSON to a SIEM collector
+type httpSink struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPSink(url string, timeout time.Duration) *httpSink {
+	return &httpSink{
+		url:    url,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Send posts the event to the collector
+func (s *httpSink) Send(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector responded with status %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Close releases idle connections to the collector
+func (s *httpSink) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
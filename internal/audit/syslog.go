@@ -0,0 +1,156 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// facilityAuthPriv is the syslog facility for security and authorization messages
+const facilityAuthPriv = 10
+
+// Syslog severities
+const (
+	severityWarning = 4
+	severityInfo    = 6
+)
+
+// CEF header fields
+const (
+	cefVendor  = "johandrevandeventer"
+	cefVersion = 0
+)
+
+var cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+var cefExtensionEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+
+// syslogSink writes RFC 5424 syslog messages with a CEF payload
+type syslogSink struct {
+	network    string
+	address    string
+	hostname   string
+	appName    string
+	appVersion string
+	timeout    time.Duration
+	conn       net.Conn
+}
+
+func newSyslogSink(network, address, appName, appVersion string, timeout time.Duration) *syslogSink {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+
+	return &syslogSink{
+		network:    network,
+		address:    address,
+		hostname:   hostname,
+		appName:    appName,
+		appVersion: appVersion,
+		timeout:    timeout,
+	}
+}
+
+// Send writes the event, reconnecting once if the connection was lost
+func (s *syslogSink) Send(ctx context.Context, event Event) error {
+	msg := s.format(event)
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			dialer := net.Dialer{Timeout: s.timeout}
+			conn, err := dialer.DialContext(ctx, s.network, s.address)
+			if err != nil {
+				return err
+			}
+			s.conn = conn
+		}
+
+		if deadline, ok := ctx.Deadline(); ok {
+			s.conn.SetWriteDeadline(deadline)
+		}
+
+		if _, err := s.conn.Write([]byte(msg)); err != nil {
+			s.conn.Close()
+			s.conn = nil
+			if attempt == 1 {
+				return err
+			}
+			continue
+		}
+
+		return nil
+	}
+
+	return nil
+}
+
+// Close closes the connection to the syslog server
+func (s *syslogSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// format renders the event as a newline-terminated syslog message
+func (s *syslogSink) format(event Event) string {
+	severity := severityInfo
+	if event.Outcome == OutcomeFailure {
+		severity = severityWarning
+	}
+
+	return fmt.Sprintf("<%d>1 %s %s %s - - - %s\n",
+		facilityAuthPriv*8+severity,
+		event.Time.Format(time.RFC3339Nano),
+		s.hostname,
+		strings.ReplaceAll(s.appName, " ", "-"),
+		formatCEF(event, s.appName, s.appVersion, severity),
+	)
+}
+
+// formatCEF renders the event in the ArcSight Common Event Format
+func formatCEF(event Event, product, version string, severity int) string {
+	// CEF severities range from 0 to 10, with failures ranked higher
+	cefSeverity := 3
+	if severity == severityWarning {
+		cefSeverity = 6
+	}
+
+	extensions := []string{
+		"rt=" + strconv.FormatInt(event.Time.UnixMilli(), 10),
+		"outcome=" + cefExtensionEscaper.Replace(event.Outcome),
+	}
+	if event.Reason != "" {
+		extensions = append(extensions, "reason="+cefExtensionEscaper.Replace(event.Reason))
+	}
+	if event.Subject != "" {
+		extensions = append(extensions, "suser="+cefExtensionEscaper.Replace(event.Subject))
+	}
+	if event.RemoteAddr != "" {
+		extensions = append(extensions, "src="+cefExtensionEscaper.Replace(event.RemoteAddr))
+	}
+	if event.Method != "" {
+		extensions = append(extensions, "requestMethod="+cefExtensionEscaper.Replace(event.Method))
+	}
+	if event.Path != "" {
+		extensions = append(extensions, "request="+cefExtensionEscaper.Replace(event.Path))
+	}
+	if event.ImpersonatedBy != "" {
+		extensions = append(extensions, "cs1Label=impersonatedBy", "cs1="+cefExtensionEscaper.Replace(event.ImpersonatedBy))
+	}
+
+	return fmt.Sprintf("CEF:%d|%s|%s|%s|%s|%s|%d|%s",
+		cefVersion,
+		cefHeaderEscaper.Replace(cefVendor),
+		cefHeaderEscaper.Replace(product),
+		cefHeaderEscaper.Replace(version),
+		cefHeaderEscaper.Replace(event.Name),
+		cefHeaderEscaper.Replace(strings.ReplaceAll(event.Name, "_", " ")+" "+event.Outcome),
+		cefSeverity,
+		strings.Join(extensions, " "),
+	)
+}
@@ -0,0 +1,169 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/metrics"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// NameCache is an in-process cache of customer and site names used to decorate responses
+type NameCache struct {
+	mu        sync.RWMutex
+	customers map[uuid.UUID]models.Customer
+	sites     map[uuid.UUID]models.Site
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// Stats holds the cache counters
+type Stats struct {
+	Customers int    `json:"customers"`
+	Sites     int    `json:"sites"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+}
+
+var names = NewNameCache()
+
+func init() {
+	metrics.Register(
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "devices_api",
+			Name:      "name_cache_hits_total",
+			Help:      "Customer and site name lookups served from the cache.",
+		}, func() float64 { return float64(names.hits.Load()) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: "devices_api",
+			Name:      "name_cache_misses_total",
+			Help:      "Customer and site name lookups that went to the database.",
+		}, func() float64 { return float64(names.misses.Load()) }),
+	)
+}
+
+// NewNameCache creates an empty name cache
+func NewNameCache() *NameCache {
+	return &NameCache{
+		customers: make(map[uuid.UUID]models.Customer),
+		sites:     make(map[uuid.UUID]models.Site),
+	}
+}
+
+// Names returns the shared name cache
+func Names() *NameCache {
+	return names
+}
+
+// Warm loads all customers and sites into the cache
+func (nc *NameCache) Warm(bmsDB *devicesdb.BMS_DB) error {
+	var customers []models.Customer
+	if err := bmsDB.DB.Select("id", "name").Find(&customers).Error; err != nil {
+		return err
+	}
+
+	var sites []models.Site
+	if err := bmsDB.DB.Select("id", "name", "customer_id").Find(&sites).Error; err != nil {
+		return err
+	}
+
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	for _, customer := range customers {
+		nc.customers[customer.ID] = models.Customer{ID: customer.ID, Name: customer.Name}
+	}
+
+	for _, site := range sites {
+		nc.sites[site.ID] = models.Site{ID: site.ID, Name: site.Name, CustomerID: site.CustomerID}
+	}
+
+	return nil
+}
+
+// Customer returns the customer with the given ID, loading it from the database on a miss
+func (nc *NameCache) Customer(bmsDB *devicesdb.BMS_DB, id uuid.UUID) (models.Customer, error) {
+	nc.mu.RLock()
+	customer, ok := nc.customers[id]
+	nc.mu.RUnlock()
+
+	if ok {
+		nc.hits.Add(1)
+		return customer, nil
+	}
+
+	nc.misses.Add(1)
+
+	if err := bmsDB.DB.Select("id", "name").First(&customer, "id = ?", id).Error; err != nil {
+		return models.Customer{}, err
+	}
+
+	nc.SetCustomer(customer)
+	return models.Customer{ID: customer.ID, Name: customer.Name}, nil
+}
+
+// Site returns the site with the given ID, loading it from the database on a miss
+func (nc *NameCache) Site(bmsDB *devicesdb.BMS_DB, id uuid.UUID) (models.Site, error) {
+	nc.mu.RLock()
+	site, ok := nc.sites[id]
+	nc.mu.RUnlock()
+
+	if ok {
+		nc.hits.Add(1)
+		return site, nil
+	}
+
+	nc.misses.Add(1)
+
+	if err := bmsDB.DB.Select("id", "name", "customer_id").First(&site, "id = ?", id).Error; err != nil {
+		return models.Site{}, err
+	}
+
+	nc.SetSite(site)
+	return models.Site{ID: site.ID, Name: site.Name, CustomerID: site.CustomerID}, nil
+}
+
+// SetCustomer writes the customer through to the cache
+func (nc *NameCache) SetCustomer(customer models.Customer) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	nc.customers[customer.ID] = models.Customer{ID: customer.ID, Name: customer.Name}
+}
+
+// SetSite writes the site through to the cache
+func (nc *NameCache) SetSite(site models.Site) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	nc.sites[site.ID] = models.Site{ID: site.ID, Name: site.Name, CustomerID: site.CustomerID}
+}
+
+// InvalidateCustomer removes the customer from the cache
+func (nc *NameCache) InvalidateCustomer(id uuid.UUID) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	delete(nc.customers, id)
+}
+
+// InvalidateSite removes the site from the cache
+func (nc *NameCache) InvalidateSite(id uuid.UUID) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	delete(nc.sites, id)
+}
+
+// Stats returns the current cache counters
+func (nc *NameCache) Stats() Stats {
+	nc.mu.RLock()
+	defer nc.mu.RUnlock()
+
+	return Stats{
+		Customers: len(nc.customers),
+		Sites:     len(nc.sites),
+		Hits:      nc.hits.Load(),
+		Misses:    nc.misses.Load(),
+	}
+}
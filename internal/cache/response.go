@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+// variantSeparator separates a key from the variant of its response, see VariantKey
+const variantSeparator = "|"
+
+// siteDevicesTTL is how long a site's device list is served from the cache
+const siteDevicesTTL = 30 * time.Second
+
+// ResponseCache holds rendered responses for a short time. Concurrent requests for a key that
+// is missing or expired wait for a single load instead of each querying the database.
+type ResponseCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[string]*responseEntry
+}
+
+type responseEntry struct {
+	body    []byte
+	etag    string
+	expires time.Time
+	err     error
+	ready   chan struct{} // closed once the load has finished
+}
+
+var siteDevices = NewResponseCache(siteDevicesTTL)
+
+// SiteDevices returns the cache of device lists keyed by site ID
+func SiteDevices() *ResponseCache {
+	return siteDevices
+}
+
+// NewResponseCache creates an empty response cache whose entries expire after the TTL
+func NewResponseCache(ttl time.Duration) *ResponseCache {
+	return &ResponseCache{
+		ttl:     ttl,
+		entries: make(map[string]*responseEntry),
+	}
+}
+
+// Get returns the cached response for the key and its ETag, calling load to render it if it is
+// missing or expired. Failed loads are not cached.
+func (rc *ResponseCache) Get(key string, load func() ([]byte, error)) (body []byte, etag string, err error) {
+	rc.mu.Lock()
+	if entry, ok := rc.entries[key]; ok {
+		select {
+		case <-entry.ready:
+			if time.Now().Before(entry.expires) {
+				rc.mu.Unlock()
+				return entry.body, entry.etag, nil
+			}
+		default:
+			// Another request is loading the key, wait for it
+			rc.mu.Unlock()
+			<-entry.ready
+			return entry.body, entry.etag, entry.err
+		}
+	}
+
+	entry := &responseEntry{ready: make(chan struct{})}
+	rc.entries[key] = entry
+	rc.mu.Unlock()
+
+	entry.body, entry.err = load()
+	if entry.err == nil {
+		sum := sha256.Sum256(entry.body)
+		entry.etag = `"` + hex.EncodeToString(sum[:16]) + `"`
+		entry.expires = time.Now().Add(rc.ttl)
+	}
+	close(entry.ready)
+
+	if entry.err != nil {
+		rc.mu.Lock()
+		if rc.entries[key] == entry {
+			delete(rc.entries, key)
+		}
+		rc.mu.Unlock()
+	}
+
+	return entry.body, entry.etag, entry.err
+}
+
+// VariantKey returns the key of a variant of the response for the key, such as one rendered for
+// an opted-in API feature. Variants are invalidated along with the key.
+func VariantKey(key, variant string) string {
+	return key + variantSeparator + variant
+}
+
+// Invalidate removes the response for the key and its variants
+func (rc *ResponseCache) Invalidate(key string) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	delete(rc.entries, key)
+	for entryKey := range rc.entries {
+		if strings.HasPrefix(entryKey, key+variantSeparator) {
+			delete(rc.entries, entryKey)
+		}
+	}
+}
+
+// Clear removes every response
+func (rc *ResponseCache) Clear() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.entries = make(map[string]*responseEntry)
+}
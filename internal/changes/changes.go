@@ -0,0 +1,111 @@
+package changes
+
+import (
+	"context"
+	"sync"
+)
+
+// capacity is the number of changes kept for clients catching up. Clients further behind are
+// told to reset and fetch their devices again.
+const capacity = 1024
+
+// change records that the devices of a site changed, or of every site when siteID is empty
+type change struct {
+	seq    uint64
+	siteID string
+}
+
+var (
+	mu      sync.Mutex
+	seq     uint64
+	log     []change
+	changed = make(chan struct{})
+)
+
+// RecordSite records that the devices of the site changed, waking the clients waiting for changes
+func RecordSite(siteID string) {
+	record(siteID)
+}
+
+// RecordAll records that the devices of any site may have changed
+func RecordAll() {
+	record("")
+}
+
+func record(siteID string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	seq++
+	log = append(log, change{seq: seq, siteID: siteID})
+	if len(log) > 2*capacity {
+		log = append([]change(nil), log[len(log)-capacity:]...)
+	}
+
+	close(changed)
+	changed = make(chan struct{})
+}
+
+// Cursor returns the cursor of the last change
+func Cursor() uint64 {
+	mu.Lock()
+	defer mu.Unlock()
+	return seq
+}
+
+// Wait blocks until there are changes after the cursor or the context is done. It returns the
+// cursor to wait from next and the IDs of the sites whose devices changed, or reset when the
+// changes since the cursor are no longer known and every device must be fetched again.
+func Wait(ctx context.Context, cursor uint64) (next uint64, siteIDs []string, reset bool) {
+	for {
+		mu.Lock()
+		next, siteIDs, reset = since(cursor)
+		wake := changed
+		mu.Unlock()
+
+		if next != cursor || reset {
+			return next, siteIDs, reset
+		}
+
+		select {
+		case <-ctx.Done():
+			return cursor, nil, false
+		case <-wake:
+		}
+	}
+}
+
+// since returns the changes after the cursor, see Wait. The caller must hold mu.
+func since(cursor uint64) (uint64, []string, bool) {
+	// A cursor ahead of the log was issued before a restart
+	if cursor > seq {
+		return seq, nil, true
+	}
+	if cursor == seq {
+		return seq, nil, false
+	}
+	if len(log) == 0 || cursor+1 < log[0].seq {
+		return seq, nil, true
+	}
+
+	seen := make(map[string]bool)
+	var siteIDs []string
+	for _, change := range log[cursor+1-log[0].seq:] {
+		if change.siteID == "" {
+			return seq, nil, true
+		}
+		if !seen[change.siteID] {
+			seen[change.siteID] = true
+			siteIDs = append(siteIDs, change.siteID)
+		}
+	}
+	return seq, siteIDs, false
+}
+
+// Reset forgets every change
+func Reset() {
+	mu.Lock()
+	defer mu.Unlock()
+	seq = 0
+	log = nil
+}
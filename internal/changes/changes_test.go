@@ -0,0 +1,65 @@
+package changes
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestWait(t *testing.T) {
+	Reset()
+
+	RecordSite("site-1")
+	RecordSite("site-2")
+	RecordSite("site-1")
+
+	next, siteIDs, reset := Wait(context.Background(), 0)
+	if next != 3 || reset || !slices.Equal(siteIDs, []string{"site-1", "site-2"}) {
+		t.Fatalf("Wait(0) = %d, %v, %v, want 3 and both sites once", next, siteIDs, reset)
+	}
+
+	next, siteIDs, reset = Wait(context.Background(), 2)
+	if next != 3 || reset || !slices.Equal(siteIDs, []string{"site-1"}) {
+		t.Fatalf("Wait(2) = %d, %v, %v, want 3 and the last site", next, siteIDs, reset)
+	}
+
+	// A cursor from before a restart resets the client
+	if _, _, reset := Wait(context.Background(), 10); !reset {
+		t.Error("cursor ahead of the log did not reset")
+	}
+
+	RecordAll()
+	if _, _, reset := Wait(context.Background(), 3); !reset {
+		t.Error("change to every site did not reset")
+	}
+}
+
+func TestWaitBlocks(t *testing.T) {
+	Reset()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if next, siteIDs, reset := Wait(ctx, 0); next != 0 || siteIDs != nil || reset {
+		t.Fatalf("Wait without changes = %d, %v, %v, want the cursor back once timed out", next, siteIDs, reset)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		RecordSite("site-1")
+	}()
+	if next, siteIDs, _ := Wait(context.Background(), 0); next != 1 || !slices.Equal(siteIDs, []string{"site-1"}) {
+		t.Fatalf("Wait woken by a change = %d, %v, want the change", next, siteIDs)
+	}
+}
+
+func TestWaitBehindLog(t *testing.T) {
+	Reset()
+
+	for range 2*capacity + 1 {
+		RecordSite("site-1")
+	}
+	if _, _, reset := Wait(context.Background(), 1); !reset {
+		t.Error("cursor behind the log did not reset")
+	}
+}
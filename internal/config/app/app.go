@@ -3,6 +3,7 @@ package app
 import (
 	"os"
 	"path/filepath"
+	"strings"
 
 	coreutils "github.com/johandrevandeventer/devices-api-server/utils"
 )
@@ -13,6 +14,8 @@ var appConfig *AppConfig
 var defaultAppConfig *AppConfig
 var defaultRuntimeConfig *RuntimeConfig
 var defaultLoggingConfig *LoggingConfig
+var defaultDatabaseConfig *DatabaseConfig
+var defaultProfiles map[string]ProfileConfig
 
 var persistFilePath string
 var loggingFilePath string
@@ -31,6 +34,15 @@ func init() {
 		PersistFilePath:        persistFilePath,
 		StopFileFilepath:       stopFileFilePath,
 		ConnectionsLogFilePath: connectionsLogFilePath,
+		CrashDir:               coreutils.GetCrashDir(),
+		Timezone:               "UTC",
+		ShutdownTimeoutSeconds: 30,
+		CrashLoop: CrashLoopConfig{
+			WindowSeconds:      300,
+			Threshold:          3,
+			BaseBackoffSeconds: 5,
+			MaxBackoffSeconds:  300,
+		},
 	}
 
 	defaultLoggingConfig = &LoggingConfig{
@@ -43,9 +55,140 @@ func init() {
 		AddTime:    true,
 	}
 
+	defaultDatabaseConfig = &DatabaseConfig{
+		PrepareStmt:            true,
+		MaxOpenConns:           1,
+		MaxIdleConns:           5,
+		ConnMaxLifetimeMinutes: 30,
+	}
+
+	defaultProfiles = map[string]ProfileConfig{
+		"development": {
+			GinMode:       "debug",
+			EnforceTLS:    false,
+			SecureCookies: false,
+			VerboseSQL:    true,
+			SeedData:      true,
+			Email: EmailConfig{
+				Provider:        "log",
+				From:            "devices-api@localhost",
+				AlertRecipients: []string{},
+				TimeoutSeconds:  10,
+				SMTP: SMTPConfig{
+					Host: "localhost",
+					Port: 587,
+				},
+			},
+		},
+		"staging": {
+			GinMode:       "release",
+			EnforceTLS:    true,
+			SecureCookies: true,
+			VerboseSQL:    false,
+			SeedData:      true,
+			Email: EmailConfig{
+				Provider:        "smtp",
+				From:            "devices-api@localhost",
+				AlertRecipients: []string{},
+				TimeoutSeconds:  10,
+				SMTP: SMTPConfig{
+					Host: "localhost",
+					Port: 587,
+				},
+			},
+		},
+		"production": {
+			GinMode:       "release",
+			EnforceTLS:    true,
+			SecureCookies: true,
+			VerboseSQL:    false,
+			SeedData:      false,
+			Email: EmailConfig{
+				Provider:        "smtp",
+				From:            "devices-api@localhost",
+				AlertRecipients: []string{},
+				TimeoutSeconds:  10,
+				SMTP: SMTPConfig{
+					Host: "localhost",
+					Port: 587,
+				},
+			},
+		},
+	}
+
 	defaultAppConfig = &AppConfig{
-		Runtime: *defaultRuntimeConfig,
-		Logging: *defaultLoggingConfig,
+		Runtime:  *defaultRuntimeConfig,
+		Logging:  *defaultLoggingConfig,
+		Database: *defaultDatabaseConfig,
+		Profiles: defaultProfiles,
+		Payloads: PayloadLoggingConfig{
+			Enabled:      false,
+			MaxBodyBytes: 4096,
+			Routes:       []string{},
+		},
+		History: StatusHistoryConfig{
+			SampleIntervalSeconds: 60,
+			OnlineWindowMinutes:   15,
+			RawRetentionDays:      30,
+		},
+		Audit: AuditConfig{
+			Enabled:        false,
+			Transport:      "udp",
+			Address:        "localhost:514",
+			BufferSize:     1024,
+			TimeoutSeconds: 5,
+		},
+		Contract: ContractConfig{
+			CheckIntervalMinutes: 60,
+			WarnDays:             30,
+			GraceDays:            14,
+			SuspendAfterGrace:    false,
+		},
+		QoS: QoSConfig{
+			Enabled:           false,
+			MaxConcurrent:     32,
+			InteractiveWeight: 4,
+			BulkWeight:        1,
+			MaxWaitSeconds:    30,
+			BulkRoutes: []string{
+				"/devices/export",
+				"/devices/import",
+				"/customers/:customer_id/sites/bulk",
+				"/controllers/:controller_serial_number/points",
+				"/sites/:site_id/handover-package",
+			},
+		},
+		Devices: DevicesConfig{
+			SerialScope: "global",
+		},
+		TagRules: TagRuleConfig{
+			EvaluateIntervalMinutes: 15,
+		},
+		Health: SiteHealthConfig{
+			ComputeIntervalMinutes: 15,
+			FreshnessMinutes:       60,
+			RetentionDays:          90,
+		},
+		Integrity: IntegrityConfig{
+			CheckOnStartup:  true,
+			RepairOnStartup: false,
+		},
+		Deadline: RequestDeadlineConfig{
+			BudgetSeconds: 30,
+			ExemptRoutes: []string{
+				"/devices/changes/poll",
+				"/devices/export",
+				"/devices/import",
+				"/sites/:site_id/handover-package",
+			},
+		},
+		Meta: ResponseMetaConfig{
+			Enabled: false,
+		},
+		Tokens: TokenConfig{
+			AccessTTLMinutes: 24 * 60,
+			RefreshTTLHours:  30 * 24,
+		},
 	}
 
 	appConfig = defaultAppConfig
@@ -89,3 +232,16 @@ func SaveAppConfig(filePath string, createFile bool) error {
 
 	return nil
 }
+
+// Profile returns the profile for the given environment, falling back to the production profile
+func (c *AppConfig) Profile(environment string) ProfileConfig {
+	if profile, ok := c.Profiles[strings.ToLower(environment)]; ok {
+		return profile
+	}
+
+	if profile, ok := c.Profiles["production"]; ok {
+		return profile
+	}
+
+	return defaultProfiles["production"]
+}
@@ -3,16 +3,43 @@ package app
 // ======================== App ======================== //
 
 type AppConfig struct {
-	Runtime RuntimeConfig `mapstructure:"runtime" yaml:"runtime"`
-	Logging LoggingConfig `mapstructure:"logging" yaml:"logging"`
+	Runtime   RuntimeConfig            `mapstructure:"runtime" yaml:"runtime"`
+	Logging   LoggingConfig            `mapstructure:"logging" yaml:"logging"`
+	Database  DatabaseConfig           `mapstructure:"database" yaml:"database"`
+	Profiles  map[string]ProfileConfig `mapstructure:"profiles" yaml:"profiles"`
+	Payloads  PayloadLoggingConfig     `mapstructure:"payload_logging" yaml:"payload_logging"`
+	History   StatusHistoryConfig      `mapstructure:"status_history" yaml:"status_history"`
+	Audit     AuditConfig              `mapstructure:"audit" yaml:"audit"`
+	Contract  ContractConfig           `mapstructure:"contracts" yaml:"contracts"`
+	QoS       QoSConfig                `mapstructure:"qos" yaml:"qos"`
+	Devices   DevicesConfig            `mapstructure:"devices" yaml:"devices"`
+	TagRules  TagRuleConfig            `mapstructure:"tag_rules" yaml:"tag_rules"`
+	Health    SiteHealthConfig         `mapstructure:"site_health" yaml:"site_health"`
+	Integrity IntegrityConfig          `mapstructure:"integrity" yaml:"integrity"`
+	Deadline  RequestDeadlineConfig    `mapstructure:"request_deadline" yaml:"request_deadline"`
+	Meta      ResponseMetaConfig       `mapstructure:"response_meta" yaml:"response_meta"`
+	Tokens    TokenConfig              `mapstructure:"tokens" yaml:"tokens"`
 }
 
 type RuntimeConfig struct {
-	RootDir                string `mapstructure:"root_dir" yaml:"root_dir"`
-	TmpDir                 string `mapstructure:"tmp_dir" yaml:"tmp_dir"`
-	PersistFilePath        string `mapstructure:"persist_file_path" yaml:"persist_file_path"`
-	StopFileFilepath       string `mapstructure:"stop_file_filepath" yaml:"stop_file_filepath"`
-	ConnectionsLogFilePath string `mapstructure:"connections_log_file_path" yaml:"connections_log_file_path"`
+	RootDir                string          `mapstructure:"root_dir" yaml:"root_dir"`
+	TmpDir                 string          `mapstructure:"tmp_dir" yaml:"tmp_dir"`
+	PersistFilePath        string          `mapstructure:"persist_file_path" yaml:"persist_file_path"`
+	StopFileFilepath       string          `mapstructure:"stop_file_filepath" yaml:"stop_file_filepath"`
+	ConnectionsLogFilePath string          `mapstructure:"connections_log_file_path" yaml:"connections_log_file_path"`
+	CrashDir               string          `mapstructure:"crash_dir" yaml:"crash_dir"`
+	Timezone               string          `mapstructure:"timezone" yaml:"timezone"`
+	Quiet                  bool            `mapstructure:"quiet" yaml:"quiet"`
+	ShutdownTimeoutSeconds int             `mapstructure:"shutdown_timeout_seconds" yaml:"shutdown_timeout_seconds"`
+	CrashLoop              CrashLoopConfig `mapstructure:"crash_loop" yaml:"crash_loop"`
+	ReadOnly               bool            `mapstructure:"read_only" yaml:"read_only"`
+}
+
+type CrashLoopConfig struct {
+	WindowSeconds      int `mapstructure:"window_seconds" yaml:"window_seconds"`
+	Threshold          int `mapstructure:"threshold" yaml:"threshold"`
+	BaseBackoffSeconds int `mapstructure:"base_backoff_seconds" yaml:"base_backoff_seconds"`
+	MaxBackoffSeconds  int `mapstructure:"max_backoff_seconds" yaml:"max_backoff_seconds"`
 }
 
 type LoggingConfig struct {
@@ -24,3 +51,135 @@ type LoggingConfig struct {
 	Compress   bool   `mapstructure:"compress" yaml:"compress"`
 	AddTime    bool   `mapstructure:"add_time" yaml:"add_time"`
 }
+
+type DatabaseConfig struct {
+	PrepareStmt            bool `mapstructure:"prepare_stmt" yaml:"prepare_stmt"`
+	MaxOpenConns           int  `mapstructure:"max_open_conns" yaml:"max_open_conns"`
+	MaxIdleConns           int  `mapstructure:"max_idle_conns" yaml:"max_idle_conns"`
+	ConnMaxLifetimeMinutes int  `mapstructure:"conn_max_lifetime_minutes" yaml:"conn_max_lifetime_minutes"`
+}
+
+// ProfileConfig holds the settings that change with the environment the application runs in
+type ProfileConfig struct {
+	GinMode       string      `mapstructure:"gin_mode" yaml:"gin_mode"`
+	EnforceTLS    bool        `mapstructure:"enforce_tls" yaml:"enforce_tls"`
+	SecureCookies bool        `mapstructure:"secure_cookies" yaml:"secure_cookies"`
+	VerboseSQL    bool        `mapstructure:"verbose_sql" yaml:"verbose_sql"`
+	SeedData      bool        `mapstructure:"seed_data" yaml:"seed_data"`
+	Email         EmailConfig `mapstructure:"email" yaml:"email"`
+}
+
+// EmailConfig controls the delivery of emails. Provider is one of log (emails are only logged),
+// smtp or ses. The SMTP password and AWS credentials are read from the environment.
+type EmailConfig struct {
+	Provider        string     `mapstructure:"provider" yaml:"provider"`
+	From            string     `mapstructure:"from" yaml:"from"`
+	AlertRecipients []string   `mapstructure:"alert_recipients" yaml:"alert_recipients"`
+	TimeoutSeconds  int        `mapstructure:"timeout_seconds" yaml:"timeout_seconds"`
+	SMTP            SMTPConfig `mapstructure:"smtp" yaml:"smtp"`
+	SES             SESConfig  `mapstructure:"ses" yaml:"ses"`
+}
+
+type SMTPConfig struct {
+	Host     string `mapstructure:"host" yaml:"host"`
+	Port     int    `mapstructure:"port" yaml:"port"`
+	Username string `mapstructure:"username" yaml:"username"`
+}
+
+type SESConfig struct {
+	Region string `mapstructure:"region" yaml:"region"`
+}
+
+// PayloadLoggingConfig controls the logging of request and response bodies in debug mode
+type PayloadLoggingConfig struct {
+	Enabled      bool     `mapstructure:"enabled" yaml:"enabled"`
+	MaxBodyBytes int      `mapstructure:"max_body_bytes" yaml:"max_body_bytes"`
+	Routes       []string `mapstructure:"routes" yaml:"routes"`
+}
+
+// StatusHistoryConfig controls the recording, rollup and pruning of device status transitions
+type StatusHistoryConfig struct {
+	SampleIntervalSeconds int `mapstructure:"sample_interval_seconds" yaml:"sample_interval_seconds"`
+	OnlineWindowMinutes   int `mapstructure:"online_window_minutes" yaml:"online_window_minutes"`
+	RawRetentionDays      int `mapstructure:"raw_retention_days" yaml:"raw_retention_days"`
+}
+
+// AuditConfig controls the forwarding of audit and authentication events to a SIEM.
+// Transport is one of udp or tcp (syslog with a CEF payload) or http or https (JSON posted to Address).
+type AuditConfig struct {
+	Enabled        bool   `mapstructure:"enabled" yaml:"enabled"`
+	Transport      string `mapstructure:"transport" yaml:"transport"`
+	Address        string `mapstructure:"address" yaml:"address"`
+	BufferSize     int    `mapstructure:"buffer_size" yaml:"buffer_size"`
+	TimeoutSeconds int    `mapstructure:"timeout_seconds" yaml:"timeout_seconds"`
+}
+
+// ContractConfig controls the warnings ahead of customer contract expiry and the suspension of
+// customer tokens once the grace period after expiry has passed
+type ContractConfig struct {
+	CheckIntervalMinutes int  `mapstructure:"check_interval_minutes" yaml:"check_interval_minutes"`
+	WarnDays             int  `mapstructure:"warn_days" yaml:"warn_days"`
+	GraceDays            int  `mapstructure:"grace_days" yaml:"grace_days"`
+	SuspendAfterGrace    bool `mapstructure:"suspend_after_grace" yaml:"suspend_after_grace"`
+}
+
+// QoSConfig controls the prioritization of interactive requests over bulk requests, such as exports
+// and imports, once the number of concurrent requests reaches MaxConcurrent
+type QoSConfig struct {
+	Enabled           bool     `mapstructure:"enabled" yaml:"enabled"`
+	MaxConcurrent     int      `mapstructure:"max_concurrent" yaml:"max_concurrent"`
+	InteractiveWeight int      `mapstructure:"interactive_weight" yaml:"interactive_weight"`
+	BulkWeight        int      `mapstructure:"bulk_weight" yaml:"bulk_weight"`
+	MaxWaitSeconds    int      `mapstructure:"max_wait_seconds" yaml:"max_wait_seconds"`
+	BulkRoutes        []string `mapstructure:"bulk_routes" yaml:"bulk_routes"`
+}
+
+// DevicesConfig controls how devices are identified. SerialScope is global, where a serial number
+// identifies a single device, or customer, where customers may own devices with the same serial number.
+type DevicesConfig struct {
+	SerialScope string `mapstructure:"serial_scope" yaml:"serial_scope"`
+}
+
+// TagRuleConfig controls how often tag rules are evaluated against the devices
+type TagRuleConfig struct {
+	EvaluateIntervalMinutes int `mapstructure:"evaluate_interval_minutes" yaml:"evaluate_interval_minutes"`
+}
+
+// SiteHealthConfig controls how often site health scores are computed, how recently a device must
+// have reported a reading for its telemetry to count as fresh and how long the scores are kept
+type SiteHealthConfig struct {
+	ComputeIntervalMinutes int `mapstructure:"compute_interval_minutes" yaml:"compute_interval_minutes"`
+	FreshnessMinutes       int `mapstructure:"freshness_minutes" yaml:"freshness_minutes"`
+	RetentionDays          int `mapstructure:"retention_days" yaml:"retention_days"`
+}
+
+// IntegrityConfig controls the startup check for devices, sites and tokens whose parent record is
+// missing or deleted, and whether the orphaned records are soft-deleted when found
+type IntegrityConfig struct {
+	CheckOnStartup  bool `mapstructure:"check_on_startup" yaml:"check_on_startup"`
+	RepairOnStartup bool `mapstructure:"repair_on_startup" yaml:"repair_on_startup"`
+}
+
+// RequestDeadlineConfig controls the time budget of a request, which the database and other calls
+// made on its behalf are cancelled at, so a slow dependency cannot hold the request open. The calls
+// are cancelled as well when the client goes away. ExemptRoutes, such as long polls and exports,
+// run without a budget. A budget of 0 disables it.
+type RequestDeadlineConfig struct {
+	BudgetSeconds int      `mapstructure:"budget_seconds" yaml:"budget_seconds"`
+	ExemptRoutes  []string `mapstructure:"exempt_routes" yaml:"exempt_routes"`
+}
+
+// ResponseMetaConfig controls the meta object of JSON responses, which carries the request ID, the
+// time the request took and the pagination of lists, so clients and support share the same
+// correlation data. The request ID is sent in the X-Request-ID header either way.
+type ResponseMetaConfig struct {
+	Enabled bool `mapstructure:"enabled" yaml:"enabled"`
+}
+
+// TokenConfig controls how long customer and site tokens are accepted for once issued, and how long
+// the refresh token issued with each can be exchanged for a new token at /token/refresh. A TTL of 0
+// issues tokens that do not expire.
+type TokenConfig struct {
+	AccessTTLMinutes int `mapstructure:"access_ttl_minutes" yaml:"access_ttl_minutes"`
+	RefreshTTLHours  int `mapstructure:"refresh_ttl_hours" yaml:"refresh_ttl_hours"`
+}
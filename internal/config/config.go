@@ -60,6 +60,11 @@ func GetConfig() *Config {
 	}
 }
 
+// GetProfile returns the configuration profile of the environment the application runs in
+func GetProfile() app.ProfileConfig {
+	return GetConfig().App.Profile(flags.FlagEnvironment)
+}
+
 // SaveConfig saves the configuration
 func SaveConfig() error {
 	err := app.SaveAppConfig(appConfigFilePath, false)
@@ -92,6 +97,8 @@ func PrintInfo(versionOnly bool) {
 			fmt.Println(textutils.ColorText(textutils.Red, (textutils.BoldText("Running in Development mode"))))
 		case "testing":
 			fmt.Println(textutils.ColorText(textutils.Yellow, (textutils.BoldText("Running in Testing mode"))))
+		case "staging":
+			fmt.Println(textutils.ColorText(textutils.Yellow, (textutils.BoldText("Running in Staging mode"))))
 		case "production":
 			fmt.Println(textutils.ColorText(textutils.Green, (textutils.BoldText("Running in Production mode"))))
 		default:
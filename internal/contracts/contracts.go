@@ -0,0 +1,167 @@
+package contracts
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/audit"
+	"github.com/johandrevandeventer/devices-api-server/internal/config/app"
+	"github.com/johandrevandeventer/devices-api-server/internal/email"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"go.uber.org/zap"
+)
+
+const day = 24 * time.Hour
+
+// defaultCheckInterval is used when no check interval is configured
+const defaultCheckInterval = time.Hour
+
+// Audit event names
+const (
+	EventContractExpiring  = "contract_expiring"
+	EventContractExpired   = "contract_expired"
+	EventContractSuspended = "contract_suspended"
+)
+
+var (
+	mu        sync.RWMutex
+	suspended = make(map[string]bool)
+
+	// warned records the day each customer was last warned about, so warnings go out once a day
+	warned = make(map[uuid.UUID]time.Time)
+)
+
+// IsSuspended reports whether the customer's tokens are suspended because their contract has expired
+func IsSuspended(customerID string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return suspended[customerID]
+}
+
+// Run checks customer contracts on every interval until the context is cancelled
+func Run(ctx context.Context, bmsDB *devicesdb.BMS_DB, cfg app.ContractConfig, logger *zap.Logger) {
+	interval := time.Duration(cfg.CheckIntervalMinutes) * time.Minute
+	if interval <= 0 {
+		interval = defaultCheckInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := Check(bmsDB, time.Now().UTC(), cfg, logger); err != nil {
+			logger.Error("Failed to check customer contracts", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check warns about contracts that expire within the warning window or have expired, and
+// suspends the customers whose grace period has passed if suspension is enabled
+func Check(bmsDB *devicesdb.BMS_DB, now time.Time, cfg app.ContractConfig, logger *zap.Logger) error {
+	var customers []models.Customer
+	if err := bmsDB.DB.Where("contract_end IS NOT NULL").Find(&customers).Error; err != nil {
+		return err
+	}
+
+	today := now.Truncate(day)
+	warnBefore := today.AddDate(0, 0, cfg.WarnDays)
+	nextSuspended := make(map[string]bool)
+
+	for _, customer := range customers {
+		// The contract runs until the end of its last day
+		end := customer.ContractEnd.UTC().Truncate(day).Add(day)
+		graceEnd := end.AddDate(0, 0, cfg.GraceDays)
+
+		fields := []zap.Field{
+			zap.String("customerId", customer.ID.String()),
+			zap.String("customerName", customer.Name),
+			zap.Time("contractEnd", *customer.ContractEnd),
+		}
+
+		switch {
+		case cfg.SuspendAfterGrace && !now.Before(graceEnd):
+			nextSuspended[customer.ID.String()] = true
+			if !IsSuspended(customer.ID.String()) {
+				logger.Warn("Customer contract expired, suspending tokens", fields...)
+				recordEvent(EventContractSuspended, customer, "grace period ended")
+				notify(logger, email.TemplateAlert, email.AlertData{
+					Title:   "Tokens suspended for " + customer.Name,
+					Message: "The contract grace period has ended and the customer's API tokens have been suspended.",
+					Details: contractDetails(customer, graceEnd),
+				})
+			}
+		case !now.Before(end):
+			if shouldWarn(customer.ID, today) {
+				logger.Warn("Customer contract expired", append(fields, zap.Time("graceEnd", graceEnd))...)
+				recordEvent(EventContractExpired, customer, "")
+				notify(logger, email.TemplateAlert, email.AlertData{
+					Title:   "Contract expired for " + customer.Name,
+					Message: "The customer's contract has expired and is in its grace period.",
+					Details: contractDetails(customer, graceEnd),
+				})
+			}
+		case end.Before(warnBefore):
+			if shouldWarn(customer.ID, today) {
+				daysLeft := int(end.Sub(today) / day)
+				logger.Warn("Customer contract expiring", append(fields, zap.Int("daysLeft", daysLeft))...)
+				recordEvent(EventContractExpiring, customer, "")
+				notify(logger, email.TemplateTokenExpiry, email.TokenExpiryData{
+					CustomerName: customer.Name,
+					ExpiresAt:    customer.ContractEnd.Format(time.DateOnly),
+					DaysLeft:     daysLeft,
+				})
+			}
+		}
+	}
+
+	mu.Lock()
+	suspended = nextSuspended
+	mu.Unlock()
+
+	return nil
+}
+
+// shouldWarn reports whether the customer has not been warned about yet today
+func shouldWarn(customerID uuid.UUID, today time.Time) bool {
+	if warned[customerID].Equal(today) {
+		return false
+	}
+	warned[customerID] = today
+	return true
+}
+
+// notify emails the alert recipients, logging delivery failures
+func notify(logger *zap.Logger, template string, data any) {
+	if err := email.Alert(context.Background(), template, data); err != nil {
+		logger.Error("Failed to send contract notification", zap.String("template", template), zap.Error(err))
+	}
+}
+
+// contractDetails lists the contract dates of the customer for alerts
+func contractDetails(customer models.Customer, graceEnd time.Time) map[string]string {
+	return map[string]string{
+		"Customer":     customer.Name,
+		"Customer ID":  customer.ID.String(),
+		"Contract end": customer.ContractEnd.Format(time.DateOnly),
+		"Grace end":    graceEnd.Format(time.DateOnly),
+	}
+}
+
+// recordEvent forwards a contract event for the customer to the audit log
+func recordEvent(name string, customer models.Customer, reason string) {
+	audit.Record(audit.Event{
+		Name:    name,
+		Outcome: audit.OutcomeFailure,
+		Reason:  reason,
+		Subject: customer.ID.String(),
+	})
+}
@@ -0,0 +1,118 @@
+package crashloop
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Exit reasons recorded for a run
+const (
+	ExitSignal   = "signal"
+	ExitStopFile = "stop_file"
+	ExitPanic    = "panic"
+)
+
+// maxRecords is the number of runs kept in the history file
+const maxRecords = 20
+
+// Record describes a single run of the application
+type Record struct {
+	StartTime  time.Time `json:"start_time"`
+	ExitTime   time.Time `json:"exit_time,omitempty"`
+	ExitReason string    `json:"exit_reason,omitempty"`
+}
+
+// Crashed reports whether the run ended without a clean shutdown
+func (r Record) Crashed() bool {
+	return r.ExitReason == "" || r.ExitReason == ExitPanic
+}
+
+// History holds the most recent runs of the application
+type History struct {
+	path    string
+	Records []Record `json:"records"`
+}
+
+// Load reads the history file, starting a new history if it does not exist
+func Load(path string) (*History, error) {
+	history := &History{path: path}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return history, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read start history: %w", err)
+	}
+
+	if err := json.Unmarshal(data, history); err != nil {
+		// A corrupt history is not worth failing startup over
+		return &History{path: path}, nil
+	}
+
+	return history, nil
+}
+
+// Save writes the history file
+func (h *History) Save() error {
+	if err := os.MkdirAll(filepath.Dir(h.path), 0o770); err != nil {
+		return fmt.Errorf("failed to create start history directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(h, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode start history: %w", err)
+	}
+
+	return os.WriteFile(h.path, data, 0o644)
+}
+
+// RecentCrashes counts the previous runs started within the window that did not shut down cleanly
+func (h *History) RecentCrashes(window time.Duration, now time.Time) int {
+	count := 0
+	for _, record := range h.Records {
+		if now.Sub(record.StartTime) <= window && record.Crashed() {
+			count++
+		}
+	}
+	return count
+}
+
+// RecordStart appends a new run to the history
+func (h *History) RecordStart(now time.Time) {
+	h.Records = append(h.Records, Record{StartTime: now})
+	if len(h.Records) > maxRecords {
+		h.Records = h.Records[len(h.Records)-maxRecords:]
+	}
+}
+
+// RecordExit sets the exit time and reason of the current run
+func (h *History) RecordExit(reason string, now time.Time) {
+	if len(h.Records) == 0 {
+		return
+	}
+
+	h.Records[len(h.Records)-1].ExitTime = now
+	h.Records[len(h.Records)-1].ExitReason = reason
+}
+
+// Backoff returns how long to delay startup after the given number of recent crashes.
+// The delay doubles for every crash over the threshold and is capped at max.
+func Backoff(crashes, threshold int, base, max time.Duration) time.Duration {
+	if crashes < threshold {
+		return 0
+	}
+
+	delay := base
+	for i := threshold; i < crashes && delay < max; i++ {
+		delay *= 2
+	}
+
+	if delay > max {
+		delay = max
+	}
+
+	return delay
+}
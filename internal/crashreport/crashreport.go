@@ -0,0 +1,155 @@
+package crashreport
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johandrevandeventer/devices-api-server/internal/timefmt"
+)
+
+// maxReports is the number of crash reports kept in the crash directory
+const maxReports = 50
+
+// filePrefix is the prefix of crash report file names, which sort by the time they were written
+const filePrefix = "crash_"
+
+// Request describes the request that was being served when a panic occurred
+type Request struct {
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	Route      string `json:"route,omitempty"`
+	RemoteAddr string `json:"remote_addr"`
+	CustomerID string `json:"customer_id,omitempty"`
+}
+
+// Report describes a recovered panic
+type Report struct {
+	ID         string       `json:"id"`
+	Time       timefmt.Time `json:"time"`
+	Source     string       `json:"source"`
+	Panic      string       `json:"panic"`
+	Stack      string       `json:"stack"`
+	AppVersion string       `json:"app_version"`
+	GoVersion  string       `json:"go_version"`
+	Request    *Request     `json:"request,omitempty"`
+}
+
+var (
+	mu         sync.Mutex
+	dir        string
+	appVersion string
+)
+
+// Init sets the directory crash reports are written to and the version they are tagged with
+func Init(crashDir, version string) {
+	mu.Lock()
+	defer mu.Unlock()
+	dir = crashDir
+	appVersion = version
+}
+
+// Write stores a crash report for the panic and prunes the oldest reports, returning the report
+func Write(source string, recovered any, stack []byte, request *Request) (Report, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	now := time.Now().UTC()
+	report := Report{
+		ID:         now.Format("20060102T150405.000000000"),
+		Time:       timefmt.New(now),
+		Source:     source,
+		Panic:      fmt.Sprint(recovered),
+		Stack:      string(stack),
+		AppVersion: appVersion,
+		GoVersion:  strings.Replace(runtime.Version(), "go", "", 1),
+		Request:    request,
+	}
+
+	if dir == "" {
+		return report, fmt.Errorf("crash directory is not configured")
+	}
+
+	if err := os.MkdirAll(dir, 0o770); err != nil {
+		return report, fmt.Errorf("failed to create crash directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return report, fmt.Errorf("failed to encode crash report: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, filePrefix+report.ID+".json"), data, 0o644); err != nil {
+		return report, fmt.Errorf("failed to write crash report: %w", err)
+	}
+
+	// Keep the crash directory bounded on servers that crash repeatedly
+	names, err := reportFiles()
+	if err != nil {
+		return report, err
+	}
+	for len(names) > maxReports {
+		os.Remove(filepath.Join(dir, names[0]))
+		names = names[1:]
+	}
+
+	return report, nil
+}
+
+// Recent returns up to limit crash reports, newest first
+func Recent(limit int) ([]Report, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if dir == "" {
+		return []Report{}, nil
+	}
+
+	names, err := reportFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	reports := []Report{}
+	for i := len(names) - 1; i >= 0 && len(reports) < limit; i-- {
+		data, err := os.ReadFile(filepath.Join(dir, names[i]))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read crash report: %w", err)
+		}
+
+		var report Report
+		if err := json.Unmarshal(data, &report); err != nil {
+			// A corrupt report is skipped rather than hiding the others
+			continue
+		}
+		reports = append(reports, report)
+	}
+
+	return reports, nil
+}
+
+// reportFiles lists the crash report file names in the crash directory, oldest first
+func reportFiles() ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read crash directory: %w", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasPrefix(entry.Name(), filePrefix) && strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
@@ -0,0 +1,236 @@
+// Package dbtest provides a scripted database for tests of code that queries through GORM. Queries
+// are answered by the first registered result whose fragment the SQL contains, and with no rows
+// otherwise, so tests only script the queries they care about.
+package dbtest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Result is what a scripted query answers with
+type Result struct {
+	Columns      []string
+	Rows         [][]driver.Value
+	RowsAffected int64
+	Err          error
+}
+
+// Outcomes of the transactions run against the database
+const (
+	Committed  = "commit"
+	RolledBack = "rollback"
+)
+
+// Query is a statement run against the database
+type Query struct {
+	SQL  string
+	Args []driver.Value
+}
+
+type script struct {
+	fragment string
+	result   Result
+}
+
+// DB is a scripted database
+type DB struct {
+	mu           sync.Mutex
+	scripts      []script
+	queries      []Query
+	transactions []string
+	commitErr    error
+}
+
+// Install replaces the database instance with a scripted database for the duration of the test
+func Install(t testing.TB) *DB {
+	t.Helper()
+
+	db := &DB{}
+	gormDB, err := gorm.Open(mysql.New(mysql.Config{
+		Conn:                      sql.OpenDB(connector{db: db}),
+		SkipInitializeWithVersion: true,
+	}), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatalf("failed to open scripted database: %v", err)
+	}
+
+	previous := devicesdb.BMS_DB_Instance
+	devicesdb.BMS_DB_Instance = &devicesdb.BMS_DB{DB: gormDB}
+	t.Cleanup(func() { devicesdb.BMS_DB_Instance = previous })
+
+	return db
+}
+
+// On answers the queries containing the fragment with the result
+func (db *DB) On(fragment string, result Result) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.scripts = append(db.scripts, script{fragment: fragment, result: result})
+}
+
+// Fail answers every query with the error
+func (db *DB) Fail(err error) {
+	db.On("", Result{Err: err})
+}
+
+// FailCommit fails every commit with the error, after which the transaction counts as rolled back
+func (db *DB) FailCommit(err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.commitErr = err
+}
+
+// Queries returns the statements run so far
+func (db *DB) Queries() []Query {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]Query(nil), db.queries...)
+}
+
+// Transactions returns the outcome of every transaction ended so far
+func (db *DB) Transactions() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return append([]string(nil), db.transactions...)
+}
+
+// end records the outcome of a transaction
+func (db *DB) end(outcome string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if outcome == Committed && db.commitErr != nil {
+		db.transactions = append(db.transactions, RolledBack)
+		return db.commitErr
+	}
+	db.transactions = append(db.transactions, outcome)
+	return nil
+}
+
+// answer records the query and returns the result scripted for it
+func (db *DB) answer(query string, args []driver.NamedValue) Result {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	db.queries = append(db.queries, Query{SQL: query, Args: values})
+
+	for _, s := range db.scripts {
+		if strings.Contains(query, s.fragment) {
+			return s.result
+		}
+	}
+	return Result{}
+}
+
+type connector struct {
+	db *DB
+}
+
+func (c connector) Connect(context.Context) (driver.Conn, error) {
+	return &conn{db: c.db}, nil
+}
+
+func (c connector) Driver() driver.Driver {
+	return scriptedDriver{}
+}
+
+type scriptedDriver struct{}
+
+func (scriptedDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("the scripted database is opened through its connector")
+}
+
+type conn struct {
+	db *DB
+}
+
+func (c *conn) Prepare(string) (driver.Stmt, error) {
+	return nil, errors.New("the scripted database does not prepare statements")
+}
+
+func (c *conn) Close() error {
+	return nil
+}
+
+func (c *conn) Begin() (driver.Tx, error) {
+	return tx{db: c.db}, nil
+}
+
+func (c *conn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	result := c.db.answer(query, args)
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	return &rows{columns: result.Columns, values: result.Rows}, nil
+}
+
+func (c *conn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	result := c.db.answer(query, args)
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	return driver.RowsAffected(result.RowsAffected), nil
+}
+
+// CheckNamedValue accepts every argument, leaving UUIDs and times as they are passed. Nil pointers
+// to valuers are passed as NULL, as database/sql does.
+func (c *conn) CheckNamedValue(value *driver.NamedValue) error {
+	if rv := reflect.ValueOf(value.Value); rv.Kind() == reflect.Pointer && rv.IsNil() {
+		value.Value = nil
+		return nil
+	}
+	if valuer, ok := value.Value.(driver.Valuer); ok {
+		v, err := valuer.Value()
+		if err != nil {
+			return err
+		}
+		value.Value = v
+	}
+	return nil
+}
+
+type tx struct {
+	db *DB
+}
+
+func (t tx) Commit() error   { return t.db.end(Committed) }
+func (t tx) Rollback() error { return t.db.end(RolledBack) }
+
+type rows struct {
+	columns []string
+	values  [][]driver.Value
+	next    int
+}
+
+func (r *rows) Columns() []string {
+	return r.columns
+}
+
+func (r *rows) Close() error {
+	return nil
+}
+
+func (r *rows) Next(dest []driver.Value) error {
+	if r.next >= len(r.values) {
+		return io.EOF
+	}
+	copy(dest, r.values[r.next])
+	r.next++
+	return nil
+}
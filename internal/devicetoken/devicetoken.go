@@ -0,0 +1,131 @@
+package devicetoken
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// sealedPrefix marks stored tokens that are encrypted, so tokens written before encryption was
+// enabled can still be told apart and read
+const sealedPrefix = "enc:v1:"
+
+// maskVisible is the number of trailing characters a masked token shows
+const maskVisible = 4
+
+// ErrNoKey is returned when a sealed token is read without an encryption key
+var ErrNoKey = errors.New("device token key is not set")
+
+var (
+	mu   sync.RWMutex
+	aead cipher.AEAD
+)
+
+// Init sets the key device auth tokens are encrypted with. Any non-empty string is accepted and
+// hashed into an AES-256 key; an empty key stores tokens unencrypted.
+func Init(key string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if key == "" {
+		aead = nil
+		return nil
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return fmt.Errorf("failed to create token cipher: %w", err)
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("failed to create token cipher: %w", err)
+	}
+
+	aead = gcm
+	return nil
+}
+
+// Enabled reports whether tokens are encrypted at rest
+func Enabled() bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	return aead != nil
+}
+
+// IsSealed reports whether the stored token is encrypted
+func IsSealed(stored string) bool {
+	return strings.HasPrefix(stored, sealedPrefix)
+}
+
+// Seal returns the token as it is stored, encrypted when a key is set. Sealed tokens are returned unchanged.
+func Seal(token string) (string, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if aead == nil || IsSealed(token) {
+		return token, nil
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate token nonce: %w", err)
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(token), nil)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open returns the plain token of a stored token. Tokens stored before encryption was enabled are returned unchanged.
+func Open(stored string) (string, error) {
+	if !IsSealed(stored) {
+		return stored, nil
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	if aead == nil {
+		return "", ErrNoKey
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, sealedPrefix))
+	if err != nil || len(data) < aead.NonceSize() {
+		return "", errors.New("malformed device token")
+	}
+
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	token, err := aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt device token: %w", err)
+	}
+
+	return string(token), nil
+}
+
+// Mask hides all but the last characters of a token, e.g. ****1234. Short tokens are hidden entirely.
+func Mask(token string) string {
+	if token == "" {
+		return ""
+	}
+	if len(token) <= maskVisible*2 {
+		return "****"
+	}
+	return "****" + token[len(token)-maskVisible:]
+}
+
+// MaskStored masks a stored token, hiding it entirely when it cannot be decrypted
+func MaskStored(stored string) string {
+	token, err := Open(stored)
+	if err != nil {
+		return "****"
+	}
+	return Mask(token)
+}
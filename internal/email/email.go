@@ -0,0 +1,126 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/johandrevandeventer/devices-api-server/internal/config/app"
+	"go.uber.org/zap"
+)
+
+// defaultTimeout is used when no send timeout is configured
+const defaultTimeout = 10 * time.Second
+
+// Message is a rendered email ready to be delivered
+type Message struct {
+	From    string
+	To      []string
+	Subject string
+	Body    string
+}
+
+// Sender delivers rendered emails
+type Sender interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+var (
+	mu              sync.RWMutex
+	sender          Sender
+	from            string
+	alertRecipients []string
+	timeout         = defaultTimeout
+)
+
+// NewSender creates the sender for the configured provider
+func NewSender(cfg app.EmailConfig, logger *zap.Logger) (Sender, error) {
+	switch cfg.Provider {
+	case "", "log":
+		return &logSender{logger: logger}, nil
+	case "smtp":
+		return newSMTPSender(cfg.SMTP)
+	case "ses":
+		return newSESSender(cfg.SES)
+	default:
+		return nil, fmt.Errorf("unsupported email provider: %s", cfg.Provider)
+	}
+}
+
+// Init configures the sender used by Send and Alert
+func Init(cfg app.EmailConfig, logger *zap.Logger) error {
+	s, err := NewSender(cfg, logger)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	sender = s
+	from = cfg.From
+	alertRecipients = cfg.AlertRecipients
+	timeout = time.Duration(cfg.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	return nil
+}
+
+// Send renders the template with the data and delivers it to the recipients
+func Send(ctx context.Context, template string, to []string, data any) error {
+	mu.RLock()
+	s, sendFrom, sendTimeout := sender, from, timeout
+	mu.RUnlock()
+
+	if s == nil {
+		return errors.New("email delivery is not initialized")
+	}
+
+	if len(to) == 0 {
+		return errors.New("no recipients")
+	}
+
+	subject, body, err := Render(template, data)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sendTimeout)
+	defer cancel()
+
+	return s.Send(ctx, Message{From: sendFrom, To: to, Subject: subject, Body: body})
+}
+
+// Alert renders the template with the data and delivers it to the configured alert recipients.
+// Nothing is sent when no alert recipients are configured.
+func Alert(ctx context.Context, template string, data any) error {
+	mu.RLock()
+	to := alertRecipients
+	mu.RUnlock()
+
+	if len(to) == 0 {
+		return nil
+	}
+
+	return Send(ctx, template, to, data)
+}
+
+// logSender logs emails instead of delivering them, for development
+type logSender struct {
+	logger *zap.Logger
+}
+
+// Send logs the message
+func (s *logSender) Send(ctx context.Context, msg Message) error {
+	s.logger.Info("Email not delivered, logging only",
+		zap.String("from", msg.From),
+		zap.Strings("to", msg.To),
+		zap.String("subject", msg.Subject),
+		zap.String("body", msg.Body),
+	)
+	return nil
+}
@@ -0,0 +1,143 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/johandrevandeventer/devices-api-server/internal/config/app"
+)
+
+// sesPath is the SES v2 API path for sending email
+const sesPath = "/v2/email/outbound-emails"
+
+// sesSender delivers emails through the Amazon SES v2 API, signing requests with AWS Signature
+// Version 4 using the credentials in the standard AWS environment variables
+type sesSender struct {
+	region       string
+	host         string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+}
+
+func newSESSender(cfg app.SESConfig) (*sesSender, error) {
+	if cfg.Region == "" {
+		return nil, errors.New("ses region is not set")
+	}
+
+	accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+	secretKey := os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set to use ses")
+	}
+
+	return &sesSender{
+		region:       cfg.Region,
+		host:         "email." + cfg.Region + ".amazonaws.com",
+		accessKey:    accessKey,
+		secretKey:    secretKey,
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{},
+	}, nil
+}
+
+// Send delivers the message with the SendEmail API
+func (s *sesSender) Send(ctx context.Context, msg Message) error {
+	body, err := json.Marshal(map[string]any{
+		"FromEmailAddress": msg.From,
+		"Destination":      map[string]any{"ToAddresses": msg.To},
+		"Content": map[string]any{
+			"Simple": map[string]any{
+				"Subject": map[string]string{"Data": msg.Subject, "Charset": "UTF-8"},
+				"Body": map[string]any{
+					"Text": map[string]string{"Data": msg.Body, "Charset": "UTF-8"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+s.host+sesPath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	s.sign(req, body, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("ses responded with status %d: %s", resp.StatusCode, strings.TrimSpace(string(detail)))
+	}
+
+	return nil
+}
+
+// sign adds the AWS Signature Version 4 headers to the request
+func (s *sesSender) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	canonicalHeaders := "content-type:application/json\nhost:" + s.host + "\nx-amz-date:" + amzDate + "\n"
+	signedHeaders := "content-type;host;x-amz-date"
+	if s.sessionToken != "" {
+		canonicalHeaders += "x-amz-security-token:" + s.sessionToken + "\n"
+		signedHeaders += ";x-amz-security-token"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodPost,
+		sesPath,
+		"",
+		canonicalHeaders,
+		signedHeaders,
+		sha256Hex(body),
+	}, "\n")
+
+	scope := date + "/" + s.region + "/ses/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "ses")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
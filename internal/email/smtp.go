@@ -0,0 +1,95 @@
+package email
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+
+	"github.com/johandrevandeventer/devices-api-server/internal/config/app"
+)
+
+// smtpPasswordEnv holds the password of the SMTP user
+const smtpPasswordEnv = "DEVICES_SERVER_SMTP_PASSWORD"
+
+// smtpSender delivers emails through an SMTP relay, upgrading to TLS with STARTTLS when offered
+type smtpSender struct {
+	host     string
+	addr     string
+	username string
+	password string
+}
+
+func newSMTPSender(cfg app.SMTPConfig) (*smtpSender, error) {
+	if cfg.Host == "" {
+		return nil, errors.New("smtp host is not set")
+	}
+
+	return &smtpSender{
+		host:     cfg.Host,
+		addr:     net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		username: cfg.Username,
+		password: os.Getenv(smtpPasswordEnv),
+	}, nil
+}
+
+// Send delivers the message to the relay
+func (s *smtpSender) Send(ctx context.Context, msg Message) error {
+	data, err := formatMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+			return err
+		}
+	}
+
+	if s.username != "" {
+		if err := client.Auth(smtp.PlainAuth("", s.username, s.password, s.host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(msg.From); err != nil {
+		return err
+	}
+	for _, to := range msg.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
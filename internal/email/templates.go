@@ -0,0 +1,71 @@
+package email
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+// Template names
+const (
+	TemplateInvitation  = "invitation"
+	TemplateAlert       = "alert"
+	TemplateTokenExpiry = "token_expiry"
+)
+
+//go:embed templates/*.tmpl
+var templateFiles embed.FS
+
+// templates holds every template, each defining a "subject" and a "body"
+var templates = func() map[string]*template.Template {
+	parsed := make(map[string]*template.Template)
+	for _, name := range []string{TemplateInvitation, TemplateAlert, TemplateTokenExpiry} {
+		parsed[name] = template.Must(template.ParseFS(templateFiles, "templates/"+name+".tmpl"))
+	}
+	return parsed
+}()
+
+// Render executes the named template with the data, returning the subject and body
+func Render(name string, data any) (subject, body string, err error) {
+	tmpl, ok := templates[name]
+	if !ok {
+		return "", "", fmt.Errorf("unknown email template: %s", name)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, "subject", data); err != nil {
+		return "", "", fmt.Errorf("failed to render %s subject: %w", name, err)
+	}
+	subject = strings.TrimSpace(buf.String())
+
+	buf.Reset()
+	if err := tmpl.ExecuteTemplate(&buf, "body", data); err != nil {
+		return "", "", fmt.Errorf("failed to render %s body: %w", name, err)
+	}
+
+	return subject, strings.TrimSpace(buf.String()) + "\n", nil
+}
+
+// InvitationData is rendered by the invitation template
+type InvitationData struct {
+	CustomerName string
+	Role         string
+	Link         string
+	ExpiresAt    string
+}
+
+// AlertData is rendered by the alert template
+type AlertData struct {
+	Title   string
+	Message string
+	Details map[string]string
+}
+
+// TokenExpiryData is rendered by the token expiry template
+type TokenExpiryData struct {
+	CustomerName string
+	ExpiresAt    string
+	DaysLeft     int
+}
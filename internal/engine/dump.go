@@ -0,0 +1,82 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/pprof"
+	"time"
+
+	"github.com/johandrevandeventer/devices-api-server/internal/server"
+	"github.com/johandrevandeventer/devices-api-server/internal/timefmt"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+)
+
+// redactedEnvVariables are included in state dumps with their values hidden
+var redactedEnvVariables = []string{
+	"DB_URL",
+	"DEVICES_SERVER_ADMIN_SECRET",
+	"DEVICES_SERVER_JWT_SECRET",
+	"DEVICES_SERVER_SMTP_PASSWORD",
+	"AWS_SECRET_ACCESS_KEY",
+}
+
+// dumpState writes goroutine stacks, the config, DB pool stats and the in-flight
+// request count to a file in the tmp directory
+func (e *Engine) dumpState() {
+	now := time.Now()
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "State dump at %s\n\n", timefmt.Format(now))
+
+	fmt.Fprintf(&buf, "==================== Requests ====================\n")
+	fmt.Fprintf(&buf, "In-flight: %d\n\n", server.InFlightRequests())
+
+	fmt.Fprintf(&buf, "==================== Database ====================\n")
+	if devicesdb.BMS_DB_Instance != nil {
+		if stats, err := devicesdb.BMS_DB_Instance.Stats(); err != nil {
+			fmt.Fprintf(&buf, "Failed to get pool stats: %s\n", err)
+		} else {
+			fmt.Fprintf(&buf, "Open connections: %d\n", stats.OpenConnections)
+			fmt.Fprintf(&buf, "In use: %d\n", stats.InUse)
+			fmt.Fprintf(&buf, "Idle: %d\n", stats.Idle)
+			fmt.Fprintf(&buf, "Wait count: %d\n", stats.WaitCount)
+			fmt.Fprintf(&buf, "Wait duration: %s\n", stats.WaitDuration)
+		}
+	}
+	fmt.Fprintln(&buf)
+
+	fmt.Fprintf(&buf, "==================== Config ====================\n")
+	if data, err := yaml.Marshal(e.cfg); err != nil {
+		fmt.Fprintf(&buf, "Failed to encode config: %s\n", err)
+	} else {
+		buf.Write(data)
+	}
+	for _, name := range redactedEnvVariables {
+		value := "<not set>"
+		if os.Getenv(name) != "" {
+			value = "<redacted>"
+		}
+		fmt.Fprintf(&buf, "%s: %s\n", name, value)
+	}
+	fmt.Fprintln(&buf)
+
+	fmt.Fprintf(&buf, "==================== Goroutines ====================\n")
+	pprof.Lookup("goroutine").WriteTo(&buf, 2)
+
+	if err := os.MkdirAll(tmpFilePath, os.ModePerm); err != nil {
+		e.logger.Error("Failed to create tmp directory", zap.Error(err))
+		return
+	}
+
+	path := filepath.Join(tmpFilePath, fmt.Sprintf("state_dump_%s.txt", now.Format("20060102T150405")))
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		e.logger.Error("Failed to write state dump", zap.Error(err))
+		return
+	}
+
+	e.logger.Info("State dump written", zap.String("path", filepath.ToSlash(path)))
+}
@@ -0,0 +1,6 @@
+//go:build !unix
+
+package engine
+
+// WatchDumpSignal is a no-op on platforms without SIGUSR1
+func (e *Engine) WatchDumpSignal() {}
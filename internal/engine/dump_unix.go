@@ -0,0 +1,30 @@
+//go:build unix
+
+package engine
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/johandrevandeventer/devices-api-server/internal/status"
+)
+
+// WatchDumpSignal writes a state dump every time SIGUSR1 is received
+func (e *Engine) WatchDumpSignal() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGUSR1)
+
+	status.Go("dump-signal", func() {
+		defer signal.Stop(sigChan)
+
+		for {
+			select {
+			case <-e.ctx.Done():
+				return
+			case <-sigChan:
+				e.dumpState()
+			}
+		}
+	})
+}
@@ -7,11 +7,23 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/johandrevandeventer/devices-api-server/internal/audit"
 	"github.com/johandrevandeventer/devices-api-server/internal/config"
+	"github.com/johandrevandeventer/devices-api-server/internal/contracts"
+	"github.com/johandrevandeventer/devices-api-server/internal/email"
 	"github.com/johandrevandeventer/devices-api-server/internal/flags"
+	"github.com/johandrevandeventer/devices-api-server/internal/fleetstats"
+	"github.com/johandrevandeventer/devices-api-server/internal/integrity"
 	"github.com/johandrevandeventer/devices-api-server/internal/server"
+	"github.com/johandrevandeventer/devices-api-server/internal/sitehealth"
+	"github.com/johandrevandeventer/devices-api-server/internal/statestore"
+	"github.com/johandrevandeventer/devices-api-server/internal/status"
+	"github.com/johandrevandeventer/devices-api-server/internal/statushistory"
+	"github.com/johandrevandeventer/devices-api-server/internal/tagrules"
+	"github.com/johandrevandeventer/devices-api-server/internal/timefmt"
+	"github.com/johandrevandeventer/devices-api-server/internal/usage"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
 	coreutils "github.com/johandrevandeventer/devices-api-server/utils"
-	"github.com/johandrevandeventer/persist"
 	"go.uber.org/zap"
 )
 
@@ -25,7 +37,7 @@ var (
 )
 
 // NewEngine creates a new Engine instance
-func NewEngine(cfg *config.Config, logger *zap.Logger, statePersister *persist.FilePersister) *Engine {
+func NewEngine(cfg *config.Config, logger *zap.Logger, statePersister *statestore.Store) *Engine {
 	tmpFilePath = cfg.App.Runtime.TmpDir
 	stopFileFilePath = cfg.App.Runtime.StopFileFilepath
 	connectionsLogFilePath = cfg.App.Runtime.ConnectionsLogFilePath
@@ -40,7 +52,9 @@ func NewEngine(cfg *config.Config, logger *zap.Logger, statePersister *persist.F
 
 // Run starts the Engine
 func (e *Engine) Run(ctx context.Context) {
-	e.ctx = ctx
+	// Background goroutines run until Stop cancels them, so that Stop can wait for them to return
+	// before the database is closed, whether it was triggered by a signal or the stop file
+	e.ctx, e.cancel = context.WithCancel(ctx)
 	defer e.Cleanup()
 
 	e.logger.Info("Starting application")
@@ -63,9 +77,9 @@ func (e *Engine) Run(ctx context.Context) {
 	e.statePersister.Set("app.version", e.cfg.System.AppVersion)
 	e.statePersister.Set("app.release_date", e.cfg.System.ReleaseDate)
 	e.statePersister.Set("app.environment", flags.FlagEnvironment)
-	e.statePersister.Set("app.start_time", startTime.Format(time.RFC3339))
+	e.statePersister.Set("app.start_time", timefmt.Format(startTime))
 
-	coreutils.WriteToLogFile(connectionsLogFilePath, fmt.Sprintf("%s: App started\n", startTime.Format(time.RFC3339)))
+	coreutils.WriteToLogFile(connectionsLogFilePath, fmt.Sprintf("%s: App started\n", timefmt.Format(startTime)))
 
 	e.start()
 
@@ -74,13 +88,66 @@ func (e *Engine) Run(ctx context.Context) {
 }
 
 func (e *Engine) start() {
+	// Wait for the background goroutines once the server and the subsystems registered after this
+	// have stopped, but before the database is closed
+	e.OnShutdown("goroutines", status.WaitGoroutines)
+
 	e.WatchStopFile(stopFileFilePath)
+	e.WatchDumpSignal()
+
+	// Forward audit events to the SIEM, flushing them after the server has stopped
+	if err := audit.Start(e.cfg.App.Audit, e.cfg.System.AppName, e.cfg.System.AppVersion, e.logger); err != nil {
+		e.logger.Error("Failed to start audit forwarding", zap.Error(err))
+	} else {
+		e.OnShutdown("audit", audit.Close)
+	}
+
+	// Count customer API usage for billing, flushing the counts after the server has stopped
+	status.Go("api-usage", func() { usage.Run(e.ctx, devicesdb.BMS_DB_Instance, e.logger) })
+	e.OnShutdown("api-usage", func(ctx context.Context) error {
+		return usage.Flush(devicesdb.BMS_DB_Instance)
+	})
+
+	// A warm standby starts read-only until it is promoted through /admin/read-only
+	status.SetReadOnly(e.cfg.App.Runtime.ReadOnly || flags.FlagReadOnly)
+	if status.IsReadOnly() {
+		e.logger.Warn("Starting in read-only mode, mutating requests will be rejected")
+	}
+
+	server := server.NewApiServer(e.cfg.App.Profile(flags.FlagEnvironment), e.cfg.App.Payloads, e.cfg.App.QoS, e.cfg.App.Deadline, e.cfg.App.Meta)
+
+	status.Go("api-server", server.Start)
+
+	e.OnShutdown("api-server", server.Shutdown)
+
+	// Deliver notification emails with the provider of the environment
+	if err := email.Init(e.cfg.App.Profile(flags.FlagEnvironment).Email, e.logger); err != nil {
+		e.logger.Error("Failed to initialize email delivery", zap.Error(err))
+	}
 
-	server := server.NewApiServer()
+	// Warn about expiring customer contracts and suspend expired ones
+	status.Go("contracts", func() { contracts.Run(e.ctx, devicesdb.BMS_DB_Instance, e.cfg.App.Contract, e.logger) })
 
-	go server.Start()
+	// Record device status transitions for uptime reporting
+	status.Go("status-history", func() { statushistory.Run(e.ctx, devicesdb.BMS_DB_Instance, e.cfg.App.History, e.logger) })
 
-	coreutils.WriteToLogFile(connectionsLogFilePath, fmt.Sprintf("%s: Server started\n", time.Now().Format(time.RFC3339)))
+	// Keep rule-based tags current for saved filters and exports
+	status.Go("tag-rules", func() {
+		tagrules.Run(e.ctx, devicesdb.BMS_DB_Instance, e.cfg.App.TagRules, e.cfg.App.History, e.logger)
+	})
+
+	// Report records orphaned by deletes that did not cascade, repairing them when configured
+	status.Go("integrity", func() { integrity.Startup(devicesdb.BMS_DB_Instance, e.cfg.App.Integrity, e.logger) })
+
+	// Score the health of every site for dashboards
+	status.Go("site-health", func() {
+		sitehealth.Run(e.ctx, devicesdb.BMS_DB_Instance, e.cfg.App.Health, e.cfg.App.History, e.logger)
+	})
+
+	// Record the fleet composition daily for growth reporting
+	status.Go("fleet-stats", func() { fleetstats.Run(e.ctx, devicesdb.BMS_DB_Instance, e.logger) })
+
+	coreutils.WriteToLogFile(connectionsLogFilePath, fmt.Sprintf("%s: Server started\n", timefmt.Format(time.Now())))
 
 	e.statePersister.Set("app.server", map[string]any{})
 	e.statePersister.Set("app.server.status", "running")
@@ -109,34 +176,42 @@ func (e *Engine) Stop() {
 
 	duration := endTime.Sub(startTime)
 
-	coreutils.WriteToLogFile(connectionsLogFilePath, fmt.Sprintf("%s: App stopped\n", endTime.Format(time.RFC3339)))
-	coreutils.WriteToLogFile(connectionsLogFilePath, fmt.Sprintf("%s: Server stopped\n", endTime.Format(time.RFC3339)))
+	coreutils.WriteToLogFile(connectionsLogFilePath, fmt.Sprintf("%s: App stopped\n", timefmt.Format(endTime)))
+	coreutils.WriteToLogFile(connectionsLogFilePath, fmt.Sprintf("%s: Server stopped\n", timefmt.Format(endTime)))
 	e.logger.Info("Stopping application")
 
+	// Stop the background goroutines, which the goroutines hook waits for
+	if e.cancel != nil {
+		e.cancel()
+	}
+
+	e.runShutdownHooks()
+
 	e.statePersister.Set("app.status", "stopped")
-	e.statePersister.Set("app.end_time", endTime.Format(time.RFC3339))
+	e.statePersister.Set("app.end_time", timefmt.Format(endTime))
 	e.statePersister.Set("app.duration", duration.String())
 }
 
-// WatchStopFile watches for the presence of a stop file and closes the stop file channel when the file is detected
+// WatchStopFile watches for the presence of a stop file and closes the stop file channel when the file is detected.
+// Watching stops when the Engine is stopped another way.
 func (e *Engine) WatchStopFile(stopFileFilePath string) {
-	go func() {
+	status.Go("stop-file", func() {
 		ticker := time.NewTicker(1 * time.Second) // Polling interval
 		defer ticker.Stop()
 
 		for {
+			if _, err := os.Stat(stopFileFilePath); err == nil {
+				close(e.stopFileChan) // Signal stop file detection
+				return
+			}
+
 			select {
-			case <-e.stopFileChan: // Stop watching if channel is closed
+			case <-e.ctx.Done():
 				return
-			default:
-				if _, err := os.Stat(stopFileFilePath); err == nil {
-					close(e.stopFileChan) // Signal stop file detection
-					return
-				}
-				time.Sleep(1 * time.Second)
+			case <-ticker.C:
 			}
 		}
-	}()
+	})
 }
 
 // StopFileDetected returns a channel that is closed when the stop file is detected
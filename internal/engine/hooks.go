@@ -0,0 +1,62 @@
+package engine
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultShutdownTimeout is used when no shutdown timeout is configured
+const defaultShutdownTimeout = 30 * time.Second
+
+// ShutdownHook flushes and closes a subsystem when the application stops
+type ShutdownHook func(ctx context.Context) error
+
+type namedShutdownHook struct {
+	name string
+	hook ShutdownHook
+}
+
+// OnShutdown registers a hook that runs when the Engine stops.
+// Hooks run in reverse registration order, like deferred calls, so subsystems
+// registered first (e.g. the database) are closed after the ones that depend on them.
+func (e *Engine) OnShutdown(name string, hook ShutdownHook) {
+	e.hooksMu.Lock()
+	defer e.hooksMu.Unlock()
+
+	e.shutdownHooks = append(e.shutdownHooks, namedShutdownHook{name: name, hook: hook})
+}
+
+// runShutdownHooks runs the registered hooks within the configured shutdown deadline
+func (e *Engine) runShutdownHooks() {
+	e.hooksMu.Lock()
+	hooks := e.shutdownHooks
+	e.shutdownHooks = nil
+	e.hooksMu.Unlock()
+
+	timeout := time.Duration(e.cfg.App.Runtime.ShutdownTimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hook := hooks[i]
+
+		if ctx.Err() != nil {
+			e.logger.Error("Shutdown deadline exceeded, skipping hook", zap.String("hook", hook.name), zap.Duration("timeout", timeout))
+			continue
+		}
+
+		start := time.Now()
+		if err := hook.hook(ctx); err != nil {
+			e.logger.Error("Shutdown hook failed", zap.String("hook", hook.name), zap.Error(err))
+			continue
+		}
+
+		e.verboseDebug("Shutdown hook complete", zap.String("hook", hook.name), zap.Duration("duration", time.Since(start)))
+	}
+}
@@ -2,16 +2,21 @@ package engine
 
 import (
 	"context"
+	"sync"
 
 	"github.com/johandrevandeventer/devices-api-server/internal/config"
-	"github.com/johandrevandeventer/persist"
+	"github.com/johandrevandeventer/devices-api-server/internal/statestore"
 	"go.uber.org/zap"
 )
 
 type Engine struct {
 	cfg            *config.Config
 	logger         *zap.Logger
-	statePersister *persist.FilePersister
+	statePersister *statestore.Store
 	stopFileChan   chan struct{}
 	ctx            context.Context
+	cancel         context.CancelFunc
+
+	hooksMu       sync.Mutex
+	shutdownHooks []namedShutdownHook
 }
@@ -0,0 +1,97 @@
+// Package eventschema holds the versioned JSON Schemas of the event payloads the server sends, so
+// consumers can validate them. A schema is never changed once published: an incompatible change to
+// a payload adds schemas/<event>/v<version+1>.json instead.
+package eventschema
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Event names
+const (
+	EventAudit = "audit_event"
+)
+
+//go:embed schemas/*/*.json
+var schemaFiles embed.FS
+
+// Schema is a version of the payload schema of an event
+type Schema struct {
+	Event   string          `json:"event"`
+	Version int             `json:"version"`
+	Schema  json.RawMessage `json:"schema"`
+}
+
+// schemas holds every schema, ordered by event and version
+var schemas = func() []Schema {
+	files, err := schemaFiles.ReadDir("schemas")
+	if err != nil {
+		panic(err)
+	}
+
+	var parsed []Schema
+	for _, dir := range files {
+		versions, err := schemaFiles.ReadDir(path.Join("schemas", dir.Name()))
+		if err != nil {
+			panic(err)
+		}
+
+		for _, file := range versions {
+			version, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(file.Name(), "v"), ".json"))
+			if err != nil || version < 1 {
+				panic(fmt.Sprintf("invalid event schema file name: %s/%s", dir.Name(), file.Name()))
+			}
+
+			data, err := schemaFiles.ReadFile(path.Join("schemas", dir.Name(), file.Name()))
+			if err != nil {
+				panic(err)
+			}
+			if !json.Valid(data) {
+				panic(fmt.Sprintf("invalid event schema: %s/%s", dir.Name(), file.Name()))
+			}
+
+			parsed = append(parsed, Schema{Event: dir.Name(), Version: version, Schema: data})
+		}
+	}
+
+	sort.Slice(parsed, func(i, j int) bool {
+		if parsed[i].Event != parsed[j].Event {
+			return parsed[i].Event < parsed[j].Event
+		}
+		return parsed[i].Version < parsed[j].Version
+	})
+
+	return parsed
+}()
+
+// All returns every schema, ordered by event and version
+func All() []Schema {
+	return append([]Schema(nil), schemas...)
+}
+
+// Versions returns the schemas of the event, oldest first
+func Versions(event string) []Schema {
+	var versions []Schema
+	for _, schema := range schemas {
+		if schema.Event == event {
+			versions = append(versions, schema)
+		}
+	}
+	return versions
+}
+
+// Get returns a version of the schema of the event
+func Get(event string, version int) (Schema, bool) {
+	for _, schema := range schemas {
+		if schema.Event == event && schema.Version == version {
+			return schema, true
+		}
+	}
+	return Schema{}, false
+}
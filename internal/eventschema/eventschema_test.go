@@ -0,0 +1,100 @@
+package eventschema
+
+import (
+	"encoding/json"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/johandrevandeventer/devices-api-server/internal/audit"
+)
+
+// jsonSchema is the part of a schema the tests check
+type jsonSchema struct {
+	ID         string `json:"$id"`
+	Required   []string
+	Properties map[string]struct {
+		Enum []string
+	}
+}
+
+func decode(t *testing.T, schema Schema) jsonSchema {
+	t.Helper()
+
+	var decoded jsonSchema
+	if err := json.Unmarshal(schema.Schema, &decoded); err != nil {
+		t.Fatalf("failed to decode %s v%d: %v", schema.Event, schema.Version, err)
+	}
+	return decoded
+}
+
+func TestSchemasAreServedByID(t *testing.T) {
+	for _, schema := range All() {
+		decoded := decode(t, schema)
+
+		want := "/meta/event-schemas/" + schema.Event + "/" + strconv.Itoa(schema.Version)
+		if decoded.ID != want {
+			t.Errorf("%s v%d has $id %q, want %q", schema.Event, schema.Version, decoded.ID, want)
+		}
+
+		if got, ok := Get(schema.Event, schema.Version); !ok || got.Version != schema.Version {
+			t.Errorf("Get(%q, %d) did not return the schema", schema.Event, schema.Version)
+		}
+	}
+
+	if _, ok := Get(EventAudit, 0); ok {
+		t.Error("Get returned a schema for version 0")
+	}
+	if versions := Versions("unknown"); len(versions) != 0 {
+		t.Errorf("Versions returned %d schemas for an unknown event", len(versions))
+	}
+}
+
+// TestAuditEventSchema checks that the latest audit event schema describes the payload the HTTP sink posts
+func TestAuditEventSchema(t *testing.T) {
+	versions := Versions(EventAudit)
+	if len(versions) == 0 {
+		t.Fatal("no audit event schema")
+	}
+	schema := decode(t, versions[len(versions)-1])
+
+	var fields []string
+	eventType := reflect.TypeOf(audit.Event{})
+	for i := 0; i < eventType.NumField(); i++ {
+		fields = append(fields, strings.Split(eventType.Field(i).Tag.Get("json"), ",")[0])
+	}
+
+	var properties []string
+	for name := range schema.Properties {
+		properties = append(properties, name)
+	}
+
+	slices.Sort(fields)
+	slices.Sort(properties)
+	if !slices.Equal(fields, properties) {
+		t.Errorf("schema properties = %v, want the audit.Event fields %v", properties, fields)
+	}
+
+	names := []string{
+		audit.EventAuthentication,
+		audit.EventTokenValidation,
+		audit.EventAdminSecret,
+		audit.EventTokenIssued,
+		audit.EventAdminTokenIssued,
+		audit.EventCustomerCloned,
+		audit.EventDeviceCredentials,
+		audit.EventGatewayReplaced,
+		audit.EventImpersonation,
+		audit.EventImpersonated,
+		audit.EventCustomerExported,
+		audit.EventCustomerImported,
+		audit.EventTokenRefreshed,
+	}
+	for _, name := range names {
+		if !slices.Contains(schema.Properties["name"].Enum, name) {
+			t.Errorf("schema does not list the %q event", name)
+		}
+	}
+}
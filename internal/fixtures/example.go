@@ -0,0 +1,243 @@
+package fixtures
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/timefmt"
+)
+
+// exampleTime is the time every example is taken at
+var exampleTime = time.Date(2025, 1, 1, 8, 0, 0, 0, time.UTC)
+
+// maxDepth stops the examples of models that refer back to each other
+const maxDepth = 4
+
+// exampleStrings are the values of the string fields and route parameters with a known meaning.
+// Fields not listed here get their own name as value.
+var exampleStrings = map[string]string{
+	"action":                   "DSE_890_API",
+	"address":                  "1 Main Street, Cape Town, 8001",
+	"allowed_cidr":             "10.20.0.0/16",
+	"allowed_cidrs":            "10.20.0.0/16,192.0.2.10/32",
+	"auth_token":               "tok****7890",
+	"building_url":             "https://bms.example.com/buildings/main-street-tower",
+	"cert_thumbprint":          "3f7a1c9e5b2d8f4a6c0e1b3d5f7a9c2e4b6d8f0a1c3e5b7d9f2a4c6e8b0d1f3a",
+	"contract_end":             "2025-12-31",
+	"contract_start":           "2025-01-01",
+	"controller":               "DSE 890",
+	"controller_serial_number": "CTRL-0001",
+	"customer_name":            "Acme Facilities",
+	"data_type":                "float32",
+	"day":                      "2025-01-01",
+	"device_name":              "AHU-1",
+	"device_serial_number":     "SN-000123",
+	"device_type":              "AHU",
+	"downstream_serial_number": "SN-000124",
+	"event":                    "audit_event",
+	"external_ref":             "CRM-1042",
+	"gateway":                  "GW-01",
+	"impersonated_by":          "jane.support",
+	"key":                      "bms_9c2e4b6d8f0a1c3e5b7d9f2a4c6e8b0d1f3a3f7a1c9e5b2d8f4a6c0e1b3d5f7a",
+	"last_api_usage_day":       "2025-01-01",
+	"month":                    "2025-01",
+	"point_name":               "supply_air_temperature",
+	"ref":                      "CRM-1042",
+	"register_point":           "active_energy_import",
+	"relationship":             "feeds",
+	"scope":                    "devices:write",
+	"site_name":                "Main Street Tower",
+	"state":                    "online",
+	"tag":                      "rooftop",
+	"timezone":                 "Africa/Johannesburg",
+	"ttl":                      "15m",
+	"token":                    "eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9.eyJ1c2VyX2lkIjoiZXhhbXBsZSJ9.signature",
+	"unit":                     "kWh",
+	"upstream_serial_number":   "SN-000123",
+	"version":                  "1",
+}
+
+// exampleID returns the ID used for every field and route parameter of the name, so the customer
+// of a request and of its response are the same
+func exampleID(name string) uuid.UUID {
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte("devices-api-server/fixtures/"+name))
+}
+
+// exampleParam returns the value of a route parameter
+func exampleParam(name string) string {
+	if value, ok := exampleStrings[name]; ok {
+		return value
+	}
+	return exampleID(name).String()
+}
+
+var (
+	uuidType      = reflect.TypeOf(uuid.UUID{})
+	timeType      = reflect.TypeOf(time.Time{})
+	timefmtType   = reflect.TypeOf(timefmt.Time{})
+	rawType       = reflect.TypeOf(json.RawMessage{})
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+)
+
+// example returns a copy of the value with every zero field filled with an example, so handler
+// structs can be listed by their zero value. Fields that are already set are kept.
+func example(v any) any {
+	if v == nil {
+		return nil
+	}
+
+	value := reflect.New(reflect.TypeOf(v)).Elem()
+	value.Set(reflect.ValueOf(v))
+	fill(value, "", 0)
+	return value.Interface()
+}
+
+// fill sets the value to an example for the field of the name if it is zero
+func fill(value reflect.Value, name string, depth int) {
+	if depth > maxDepth || !value.CanSet() {
+		return
+	}
+
+	switch value.Type() {
+	case uuidType:
+		if value.IsZero() {
+			value.Set(reflect.ValueOf(exampleID(name)))
+		}
+		return
+	case timeType:
+		if value.IsZero() {
+			value.Set(reflect.ValueOf(exampleTime))
+		}
+		return
+	case timefmtType:
+		if value.IsZero() {
+			value.Set(reflect.ValueOf(timefmt.New(exampleTime)))
+		}
+		return
+	case rawType:
+		if value.Len() == 0 {
+			value.Set(reflect.ValueOf(json.RawMessage(`{}`)))
+		}
+		return
+	}
+
+	// Other types with their own encoding, like gorm.DeletedAt, keep their zero value
+	if value.Kind() != reflect.Pointer && value.Type().Implements(marshalerType) {
+		return
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		if value.Len() == 0 {
+			value.SetString(exampleString(name))
+		}
+	case reflect.Bool:
+		value.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if value.Int() == 0 {
+			value.SetInt(1)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if value.Uint() == 0 {
+			value.SetUint(1)
+		}
+	case reflect.Float32, reflect.Float64:
+		if value.Float() == 0 {
+			value.SetFloat(1.5)
+		}
+	case reflect.Pointer:
+		if value.IsNil() {
+			value.Set(reflect.New(value.Type().Elem()))
+		}
+		fill(value.Elem(), name, depth+1)
+	case reflect.Slice:
+		if value.Len() == 0 {
+			value.Set(reflect.MakeSlice(value.Type(), 1, 1))
+		}
+		for i := 0; i < value.Len(); i++ {
+			fill(value.Index(i), singular(name), depth+1)
+		}
+	case reflect.Map:
+		if value.Len() == 0 {
+			value.Set(reflect.MakeMap(value.Type()))
+			key := reflect.New(value.Type().Key()).Elem()
+			fill(key, singular(name), depth+1)
+			element := reflect.New(value.Type().Elem()).Elem()
+			fill(element, singular(name), depth+1)
+			value.SetMapIndex(key, element)
+		}
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			fieldName, ok := jsonName(field)
+			if !ok {
+				continue
+			}
+			fill(value.Field(i), fieldName, depth+1)
+		}
+	}
+}
+
+// jsonName returns the name of the field in JSON, reporting false for fields left out of JSON
+func jsonName(field reflect.StructField) (string, bool) {
+	if !field.IsExported() {
+		return "", false
+	}
+
+	tag, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	switch {
+	case tag == "-":
+		return "", false
+	case tag != "":
+		return tag, true
+	default:
+		return toSnakeCase(field.Name), true
+	}
+}
+
+// exampleString returns the value of a string field
+func exampleString(name string) string {
+	if value, ok := exampleStrings[name]; ok {
+		return value
+	}
+	if strings.HasSuffix(name, "_id") || name == "id" {
+		return exampleID(name).String()
+	}
+	if name == "" {
+		return "example"
+	}
+	return name
+}
+
+// singular returns the name of an element of a list field, e.g. tag for tags
+func singular(name string) string {
+	if trimmed, ok := strings.CutSuffix(name, "s"); ok && !strings.HasSuffix(trimmed, "s") {
+		return trimmed
+	}
+	return name
+}
+
+// toSnakeCase converts a Go field name like CustomerID to customer_id, so fields without a JSON tag
+// get the same examples as the tagged fields of the same name. A plural acronym like CIDRs stays a
+// single word.
+func toSnakeCase(name string) string {
+	runes := []rune(name)
+
+	var b strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			previousLower := unicode.IsLower(runes[i-1])
+			plural := i+1 < len(runes) && runes[i+1] == 's' && (i+2 == len(runes) || unicode.IsUpper(runes[i+2]))
+			endsAcronym := unicode.IsUpper(runes[i-1]) && i+1 < len(runes) && unicode.IsLower(runes[i+1]) && !plural
+			if previousLower || endsAcronym {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
@@ -0,0 +1,356 @@
+// Package fixtures builds canonical request and response examples for every endpoint from the
+// request and response structs of the handlers, for downstream teams to use as contract fixtures.
+// Every value is derived from the field names, so the fixtures only change when the API does.
+package fixtures
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+
+	"github.com/johandrevandeventer/devices-api-server/internal/cache"
+	"github.com/johandrevandeventer/devices-api-server/internal/crashreport"
+	"github.com/johandrevandeventer/devices-api-server/internal/eventschema"
+	"github.com/johandrevandeventer/devices-api-server/internal/integrity"
+	"github.com/johandrevandeventer/devices-api-server/internal/server/handlers"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+)
+
+// Fixture is an example exchange with an endpoint
+type Fixture struct {
+	Name     string   `json:"name"`
+	Request  Request  `json:"request"`
+	Response Response `json:"response"`
+}
+
+// Request is the example request of a fixture. Uploads are sent as multipart/form-data with the
+// body as JSON file in the file field.
+type Request struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Route   string            `json:"route"`
+	Query   string            `json:"query,omitempty"`
+	Headers map[string]string `json:"headers"`
+	Body    any               `json:"body,omitempty"`
+}
+
+// Response is the example response of a fixture. Responses that are not JSON have no body.
+type Response struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    any               `json:"body,omitempty"`
+}
+
+// Authentication schemes of the endpoints
+const (
+	authNone    = iota
+	authToken   // a customer or admin JWT
+	authAdmin   // the admin secret
+	authUpload  // a customer or admin JWT, with the body uploaded as file
+	authGateway // a gateway credential
+)
+
+// endpoint describes an endpoint by the structs its handler reads and writes
+type endpoint struct {
+	name        string
+	method      string
+	route       string
+	query       string
+	auth        int
+	request     any
+	status      int
+	message     string
+	data        any
+	paginated   bool
+	deprecated  bool              // the response carries the auth_token deprecation warning
+	contentType string            // set for responses that are not JSON
+	params      map[string]string // route parameters whose example differs from that of their name
+}
+
+var endpoints = []endpoint{
+	{name: "health", method: "GET", route: "/health", message: "OK", data: "Service is running: devices-api-server"},
+	{name: "metrics", method: "GET", route: "/metrics", auth: authAdmin, contentType: "text/plain; version=0.0.4; charset=utf-8"},
+
+	// Admin routes
+	{name: "generate-admin-token", method: "POST", route: "/admin/generate-admin-token", auth: authAdmin, message: "Token generated successfully", data: exampleStrings["token"]},
+	{name: "generate-token", method: "POST", route: "/admin/generate-token", auth: authAdmin, request: handlers.GenerateTokenRequest{}, message: "Token generated successfully", data: models.AuthToken{}},
+	{name: "impersonate", method: "POST", route: "/admin/impersonate/:customer_id", auth: authAdmin, request: handlers.ImpersonateRequest{}, message: "Impersonation token generated", data: handlers.ImpersonateResponse{}},
+	{name: "cache-stats", method: "GET", route: "/admin/cache", auth: authAdmin, message: "Cache stats fetched", data: cache.Stats{}},
+	{name: "status", method: "GET", route: "/admin/status", auth: authAdmin, message: "Status fetched", data: handlers.StatusResponse{}},
+	{name: "fleet-history", method: "GET", route: "/admin/stats/history", query: "from=2025-01-01&to=2025-01-31", auth: authAdmin, message: "Fleet history fetched", data: handlers.FleetHistoryResponse{From: "2025-01-01", To: "2025-01-31"}},
+	{name: "crashes", method: "GET", route: "/admin/crashes", auth: authAdmin, message: "Crash reports fetched", data: []crashreport.Report{}},
+	{name: "read-only-fetch", method: "GET", route: "/admin/read-only", auth: authAdmin, message: "Read-only mode fetched", data: handlers.ReadOnlyResponse{}},
+	{name: "read-only-set", method: "PUT", route: "/admin/read-only", auth: authAdmin, request: handlers.ReadOnlyRequest{}, message: "Read-only mode updated", data: handlers.ReadOnlyResponse{}},
+	{name: "billing-report", method: "GET", route: "/admin/customers/:customer_id/billing-report", query: "month=2025-01", auth: authAdmin, message: "Billing report generated", data: handlers.BillingReportResponse{}},
+	{name: "clone-customer", method: "POST", route: "/admin/clone-customer", auth: authAdmin, request: handlers.CloneCustomerRequest{}, status: 201, message: "Customer cloned", data: handlers.CloneCustomerResponse{}},
+	{name: "integrity-check", method: "GET", route: "/admin/integrity-check", auth: authAdmin, message: "Integrity checked", data: integrity.Report{}},
+	{name: "integrity-repair", method: "POST", route: "/admin/integrity-check/repair", auth: authAdmin, message: "Integrity repaired", data: integrity.Report{Repaired: true}},
+	{name: "gateway-credential-issue", method: "POST", route: "/admin/gateway-credentials", auth: authAdmin, request: handlers.GatewayCredentialRequest{}, message: "Gateway credential issued", data: handlers.GatewayCredentialResponse{}},
+	{name: "gateway-credential-revoke", method: "DELETE", route: "/admin/gateway-credentials/:credential_id", auth: authAdmin, message: "Gateway credential revoked"},
+	{name: "gateway-credential-rotate", method: "POST", route: "/admin/gateways/:gateway_id/credentials", auth: authAdmin, request: handlers.GatewayCredentialRotateRequest{}, message: "Gateway credential rotated", data: handlers.GatewayCredentialResponse{}},
+	{name: "api-key-create", method: "POST", route: "/admin/api-keys", auth: authAdmin, request: handlers.APIKeyRequest{}, status: 201, message: "API key created", data: handlers.APIKeyResponse{}},
+	{name: "api-key-fetch-by-customer", method: "GET", route: "/admin/customers/:customer_id/api-keys", auth: authAdmin, message: "API keys fetched", data: []handlers.APIKeyResponse{{}}},
+	{name: "api-key-rotate", method: "POST", route: "/admin/api-keys/:key_id/rotate", auth: authAdmin, message: "API key rotated", data: handlers.APIKeyResponse{}},
+	{name: "api-key-revoke", method: "DELETE", route: "/admin/api-keys/:key_id", auth: authAdmin, message: "API key revoked"},
+	{name: "template-create", method: "POST", route: "/admin/templates", auth: authAdmin, request: handlers.TemplateRequest{}, status: 201, message: "Template created", data: handlers.TemplateResponse{}, deprecated: true},
+	{name: "template-fetch-all", method: "GET", route: "/admin/templates", auth: authAdmin, message: "Templates fetched", data: []handlers.TemplateResponse{}},
+	{name: "template-fetch", method: "GET", route: "/admin/templates/:template_id", auth: authAdmin, message: "Template fetched", data: handlers.TemplateResponse{}},
+	{name: "template-update", method: "PUT", route: "/admin/templates/:template_id", auth: authAdmin, request: handlers.TemplateRequest{}, message: "Template updated", data: handlers.TemplateResponse{}},
+	{name: "template-delete", method: "DELETE", route: "/admin/templates/:template_id", auth: authAdmin, message: "Template deleted"},
+
+	{name: "authenticate", method: "POST", route: "/authenticate", request: handlers.AuthenticateRequest{}, message: "Token validated"},
+	{name: "token-refresh", method: "POST", route: "/token/refresh", request: handlers.TokenRefreshRequest{}, message: "Token refreshed", data: models.AuthToken{}},
+
+	// Customer routes
+	{name: "customer-create", method: "POST", route: "/customers", auth: authToken, request: handlers.CustomerRequest{}, status: 201, message: "Customer created", data: handlers.CustomerResponse{}},
+	{name: "customer-fetch-all", method: "GET", route: "/customers", query: "page=1&per_page=50&name_contains=Acme&sort=-created_at", auth: authToken, message: "Customers fetched", data: []handlers.CustomerResponse{}, paginated: true},
+	{name: "customer-batch-get", method: "POST", route: "/customers/batch-get", auth: authToken, request: handlers.BatchGetRequest{}, message: "Customers fetched", data: handlers.CustomerBatchGetResponse{}},
+	{name: "customer-import", method: "POST", route: "/customers/import", auth: authToken, request: handlers.CustomerExportDocument{FormatVersion: 1}, status: 201, message: "Customer imported", data: handlers.CustomerImportResponse{}},
+	{name: "customer-fetch-by-ref", method: "GET", route: "/customers/by-ref/:ref", auth: authToken, message: "Customer fetched", data: handlers.CustomerResponse{}},
+	{name: "customer-fetch", method: "GET", route: "/customers/:customer_id", auth: authToken, message: "Customer fetched", data: handlers.CustomerResponse{}},
+	{name: "customer-update", method: "PUT", route: "/customers/:customer_id", auth: authToken, request: handlers.CustomerRequest{}, message: "Customer updated", data: handlers.CustomerResponse{}},
+	{name: "customer-patch", method: "PATCH", route: "/customers/:customer_id", auth: authToken, request: handlers.CustomerPatchRequest{}, message: "Customer updated", data: handlers.CustomerResponse{}},
+	{name: "customer-delete", method: "DELETE", route: "/customers/:customer_id", query: "cascade=true&dry_run=true", auth: authToken, message: "Customer delete previewed", data: handlers.CustomerDeleteResponse{}},
+	{name: "customer-fetch-deleted", method: "GET", route: "/customers/deleted", query: "page=1&per_page=50", auth: authToken, message: "Deleted customers fetched", data: []handlers.DeletedCustomerResponse{}, paginated: true},
+	{name: "customer-restore", method: "POST", route: "/customers/:customer_id/restore", query: "cascade=true", auth: authToken, message: "Customer restored", data: handlers.CustomerRestoreResponse{}},
+	{name: "customer-export", method: "GET", route: "/customers/:customer_id/export", auth: authToken, message: "Customer exported", data: handlers.CustomerExportDocument{FormatVersion: 1}},
+
+	// Site routes
+	{name: "site-create", method: "POST", route: "/customers/:customer_id/sites", auth: authToken, request: handlers.SiteRequest{}, message: "Site created", data: handlers.SiteResponse{}},
+	{name: "site-bulk-create", method: "POST", route: "/customers/:customer_id/sites/bulk", auth: authToken, request: []handlers.SiteRequest{{Name: exampleStrings["site_name"]}}, message: "Sites created", data: siteBulkResponse()},
+	{name: "site-fetch-by-customer", method: "GET", route: "/customers/:customer_id/sites", auth: authToken, message: "Sites fetched", data: []handlers.SiteResponse{}},
+	{name: "site-fetch-all", method: "GET", route: "/sites", query: "page=1&per_page=50&name_contains=Tower&timezone=Africa/Johannesburg&bbox=18.3,-34.1,18.6,-33.8", auth: authToken, message: "Sites fetched", data: []handlers.SiteResponse{}, paginated: true},
+	{name: "site-search", method: "GET", route: "/sites/search", query: "q=Tower&page=1&per_page=50", auth: authToken, message: "Sites fetched", data: []handlers.SiteResponse{}, paginated: true},
+	{name: "site-batch-get", method: "POST", route: "/sites/batch-get", auth: authToken, request: handlers.BatchGetRequest{}, message: "Sites fetched", data: handlers.SiteBatchGetResponse{}},
+	{name: "site-fetch", method: "GET", route: "/sites/:site_id", auth: authToken, message: "Site fetched", data: handlers.SiteResponse{}},
+	{name: "site-update", method: "PUT", route: "/sites/:site_id", auth: authToken, request: handlers.SiteUpdateRequest{}, message: "Site updated", data: handlers.SiteResponse{}},
+	{name: "site-patch", method: "PATCH", route: "/sites/:site_id", auth: authToken, request: handlers.SiteUpdateRequest{}, message: "Site updated", data: handlers.SiteResponse{}},
+	{name: "site-delete", method: "DELETE", route: "/sites/:site_id", query: "cascade=devices&dry_run=true", auth: authToken, message: "Site delete previewed", data: handlers.SiteDeleteResponse{Devices: []string{exampleStrings["device_serial_number"]}}},
+	{name: "site-handover-package", method: "GET", route: "/sites/:site_id/handover-package", auth: authToken, contentType: "application/zip"},
+	{name: "site-health", method: "GET", route: "/sites/:site_id/health", query: "from=2024-01-01T00:00:00Z&to=2024-01-08T00:00:00Z", auth: authToken, message: "Site health fetched", data: handlers.SiteHealthResponse{}},
+	{name: "site-energy-daily", method: "GET", route: "/sites/:site_id/energy/daily", query: "from=2024-01-01&to=2024-01-31", auth: authToken, message: "Site energy fetched", data: handlers.SiteEnergyResponse{Interval: "daily", Rollups: []handlers.EnergyRollup{{Period: "2024-01-01"}}}},
+	{name: "site-energy-monthly", method: "GET", route: "/sites/:site_id/energy/monthly", query: "from=2024-01&to=2024-12", auth: authToken, message: "Site energy fetched", data: handlers.SiteEnergyResponse{Interval: "monthly", Rollups: []handlers.EnergyRollup{{Period: "2024-01"}}}},
+
+	// Device routes
+	{name: "device-create", method: "POST", route: "/customers/:customer_id/sites/:site_id/devices", auth: authToken, request: handlers.DeviceRequest{}, message: "Device created", data: handlers.DeviceResponse{}, deprecated: true},
+	{name: "device-create-from-template", method: "POST", route: "/customers/:customer_id/sites/:site_id/devices/from-template", auth: authToken, request: handlers.DeviceFromTemplateRequest{}, status: 201, message: "Device created from template", data: handlers.DeviceFromTemplateResponse{}, deprecated: true},
+	{name: "device-fetch-all", method: "GET", route: "/devices", query: "page=1&per_page=50", auth: authToken, message: "Devices fetched", data: []handlers.DeviceResponse{}, paginated: true, deprecated: true},
+	{name: "device-search", method: "GET", route: "/devices/search", query: "q=AHU", auth: authToken, message: "Devices fetched", data: []handlers.DeviceResponse{}, deprecated: true},
+	{name: "device-export", method: "GET", route: "/devices/export", auth: authToken, contentType: "text/csv"},
+	{name: "device-fetch-deleted", method: "GET", route: "/devices/deleted", query: "page=1&per_page=50", auth: authToken, message: "Deleted devices fetched", data: []handlers.DeletedDeviceResponse{}, paginated: true},
+	{name: "device-import", method: "POST", route: "/devices/import", query: "format=json", auth: authUpload, request: []handlers.DeviceImportRow{}, message: "Devices imported", data: handlers.DeviceImportResponse{}},
+	{name: "device-batch-get", method: "POST", route: "/devices/batch-get", auth: authToken, request: handlers.DeviceBatchGetRequest{}, message: "Devices fetched", data: handlers.DeviceBatchGetResponse{}},
+	{name: "device-changes-poll", method: "GET", route: "/devices/changes/poll", query: "since=41&timeout=30s", auth: authToken, message: "Device changes fetched", data: handlers.DeviceChangesResponse{}},
+	{name: "device-fetch-by-customer", method: "GET", route: "/customers/:customer_id/devices", auth: authToken, message: "Devices fetched", data: []handlers.DeviceResponse{}, deprecated: true},
+	{name: "device-fetch-by-site", method: "GET", route: "/sites/:site_id/devices", auth: authToken, message: "Devices fetched", data: []handlers.DeviceResponse{}, deprecated: true},
+	{name: "device-fetch", method: "GET", route: "/devices/:device_serial_number", auth: authToken, message: "Device fetched", data: handlers.DeviceResponse{}, deprecated: true},
+	{name: "customer-device-fetch", method: "GET", route: "/customers/:customer_id/devices/:device_serial_number", auth: authToken, message: "Device fetched", data: handlers.DeviceResponse{}, deprecated: true},
+	{name: "customer-device-update", method: "PUT", route: "/customers/:customer_id/devices/:device_serial_number", auth: authToken, request: handlers.DeviceRequest{}, message: "Device updated", data: handlers.DeviceResponse{}, deprecated: true},
+	{name: "customer-device-delete", method: "DELETE", route: "/customers/:customer_id/devices/:device_serial_number", auth: authToken, message: "Device deleted"},
+	{name: "device-update", method: "PUT", route: "/devices/:device_serial_number", auth: authToken, request: handlers.DeviceRequest{}, message: "Device updated", data: handlers.DeviceResponse{}, deprecated: true},
+	{name: "device-credentials", method: "GET", route: "/devices/:device_serial_number/credentials", auth: authToken, message: "Device credentials fetched", data: handlers.DeviceCredentialsResponse{AuthToken: "tok-1234567890"}},
+	{name: "device-delete", method: "DELETE", route: "/devices/:device_serial_number", auth: authToken, message: "Device deleted"},
+	{name: "device-restore", method: "POST", route: "/devices/:device_serial_number/restore", auth: authToken, message: "Device restored", data: handlers.DeviceResponse{}, deprecated: true},
+	{name: "device-purge", method: "DELETE", route: "/devices/:device_serial_number/purge", auth: authToken, message: "Device purged"},
+	{name: "device-bulk-delete", method: "DELETE", route: "/devices", auth: authToken, request: handlers.DeviceBulkDeleteRequest{}, message: "Devices deleted", data: handlers.DeviceBulkDeleteResponse{}},
+	{name: "device-register", method: "PUT", route: "/registrations/devices", auth: authToken, request: handlers.DeviceRegistrationRequest{}, message: "Device created", data: handlers.DeviceRegistrationResponse{Result: "created"}, deprecated: true},
+
+	// Dependency routes
+	{name: "dependency-create", method: "POST", route: "/devices/:device_serial_number/dependencies", auth: authToken, request: handlers.DeviceDependencyRequest{}, status: 201, message: "Dependency created", data: handlers.DeviceDependencyResponse{}},
+	{name: "dependency-fetch", method: "GET", route: "/devices/:device_serial_number/dependencies", auth: authToken, message: "Dependencies fetched", data: handlers.DeviceDependenciesResponse{}},
+	{name: "dependency-delete", method: "DELETE", route: "/devices/:device_serial_number/dependencies/:dependency_id", auth: authToken, message: "Dependency deleted"},
+	{name: "device-impact", method: "GET", route: "/devices/:device_serial_number/impact", auth: authToken, message: "Impact fetched", data: handlers.ImpactResponse{}},
+	{name: "controller-impact", method: "GET", route: "/controllers/:controller_serial_number/impact", auth: authToken, message: "Impact fetched", data: handlers.ImpactResponse{}},
+
+	// Controller routes
+	{name: "controller-fetch-by-site", method: "GET", route: "/sites/:site_id/controllers", auth: authToken, message: "Controllers fetched", data: []handlers.ControllerResponse{}},
+	{name: "controller-create", method: "POST", route: "/sites/:site_id/controllers", auth: authToken, request: handlers.ControllerRequest{}, status: 201, message: "Controller created", data: handlers.ControllerResponse{}},
+	{name: "controller-fetch", method: "GET", route: "/sites/:site_id/controllers/:controller_serial_number", auth: authToken, message: "Controller fetched", data: handlers.ControllerResponse{}},
+	{name: "controller-update", method: "PUT", route: "/sites/:site_id/controllers/:controller_serial_number", auth: authToken, request: handlers.ControllerRequest{}, message: "Controller updated", data: handlers.ControllerResponse{}},
+	{name: "controller-delete", method: "DELETE", route: "/sites/:site_id/controllers/:controller_serial_number", auth: authToken, message: "Controller deleted", data: handlers.ControllerResponse{}},
+
+	// Tag routes
+	{name: "tag-fetch-all", method: "GET", route: "/tags", auth: authToken, message: "Tags fetched", data: []handlers.TagResponse{}},
+	{name: "device-tag-fetch", method: "GET", route: "/devices/:device_serial_number/tags", auth: authToken, message: "Tags fetched", data: handlers.DeviceTagsResponse{}},
+	{name: "device-tag-add", method: "POST", route: "/devices/:device_serial_number/tags", auth: authToken, request: handlers.DeviceTagsRequest{}, message: "Tags added", data: handlers.DeviceTagsResponse{}},
+	{name: "device-tag-remove", method: "DELETE", route: "/devices/:device_serial_number/tags/:tag", auth: authToken, message: "Tag removed", data: handlers.DeviceTagsResponse{}},
+	{name: "tag-rule-fetch-all", method: "GET", route: "/tag-rules", auth: authToken, message: "Tag rules fetched", data: []handlers.TagRuleResponse{exampleTagRule}},
+	{name: "tag-rule-create", method: "POST", route: "/tag-rules", auth: authToken, request: handlers.TagRuleRequest{Name: exampleTagRule.Name, Tag: exampleTagRule.Tag, Field: exampleTagRule.Field, Operator: exampleTagRule.Operator, Value: exampleTagRule.Value}, status: 201, message: "Tag rule created", data: exampleTagRule},
+	{name: "tag-rule-delete", method: "DELETE", route: "/tag-rules/:rule_id", auth: authToken, message: "Tag rule deleted", data: exampleTagRule},
+
+	// Meter routes
+	{name: "saved-filter-fetch-all", method: "GET", route: "/filters", auth: authToken, message: "Filters fetched", data: []handlers.SavedFilterResponse{exampleSavedFilter}},
+	{name: "saved-filter-create", method: "POST", route: "/filters", auth: authToken, request: handlers.SavedFilterRequest{Name: exampleSavedFilter.Name, Query: exampleSavedFilter.Query}, status: 201, message: "Filter saved", data: exampleSavedFilter},
+	{name: "saved-filter-delete", method: "DELETE", route: "/filters/:filter_id", auth: authToken, message: "Filter deleted", data: exampleSavedFilter},
+	{name: "saved-filter-devices", method: "GET", route: "/filters/:filter_id/devices", query: "page=1&per_page=50", auth: authToken, message: "Devices fetched", data: []handlers.DeviceResponse{}, paginated: true, deprecated: true},
+	{name: "meter-set", method: "PUT", route: "/devices/:device_serial_number/meter", auth: authToken, request: handlers.DeviceMeterRequest{}, message: "Meter saved", data: handlers.DeviceMeterResponse{}},
+	{name: "meter-fetch", method: "GET", route: "/devices/:device_serial_number/meter", auth: authToken, message: "Meter fetched", data: handlers.DeviceMeterResponse{}},
+	{name: "meter-delete", method: "DELETE", route: "/devices/:device_serial_number/meter", auth: authToken, message: "Meter deleted"},
+
+	// Point address routes
+	{name: "points-export", method: "GET", route: "/controllers/:controller_serial_number/points", auth: authToken, message: "Points fetched", data: []handlers.PointAddressRow{}},
+	{name: "points-import", method: "PUT", route: "/controllers/:controller_serial_number/points", query: "format=json", auth: authUpload, request: []handlers.PointAddressRow{}, message: "Points imported", data: handlers.PointAddressImportResponse{}},
+
+	// Device status routes
+	{name: "status-report", method: "POST", route: "/devices/:device_serial_number/status", auth: authToken, request: handlers.DeviceStatusRequest{Readings: map[string]float64{exampleStrings["point_name"]: 18.5}}, message: "Device status recorded", data: handlers.DeviceStatusResponse{}},
+	{name: "status-fetch", method: "GET", route: "/devices/:device_serial_number/status", auth: authToken, message: "Device status fetched", data: handlers.DeviceStatusResponse{}},
+	{name: "status-history", method: "GET", route: "/devices/:device_serial_number/status/history", auth: authToken, message: "Device status history fetched", data: []handlers.DeviceStatusTransitionResponse{}, paginated: true},
+	{name: "latest-readings", method: "GET", route: "/devices/:device_serial_number/latest", auth: authToken, message: "Readings fetched", data: handlers.DeviceLatestResponse{}},
+
+	{name: "customer-stats", method: "GET", route: "/customers/:customer_id/stats", auth: authToken, message: "Customer statistics fetched", data: handlers.CustomerStatsResponse{}},
+	{name: "customer-tree", method: "GET", route: "/customers/:customer_id/tree", auth: authToken, message: "Customer tree fetched", data: handlers.CustomerTreeResponse{}},
+	{name: "customer-settings-fetch", method: "GET", route: "/customers/:customer_id/settings", auth: authToken, message: "Settings fetched", data: handlers.CustomerSettingsResponse{Settings: exampleSettings}},
+	{name: "customer-settings-update", method: "PUT", route: "/customers/:customer_id/settings", auth: authAdmin, request: handlers.CustomerSettingsRequest{Settings: exampleSettings}, message: "Settings updated", data: handlers.CustomerSettingsResponse{Settings: exampleSettings}},
+	{name: "device-stats", method: "GET", route: "/stats/devices", auth: authToken, message: "Device statistics fetched", data: handlers.DeviceStatsResponse{}},
+	{name: "gateway-presence", method: "GET", route: "/gateways/presence", query: "connected=false", auth: authToken, message: "Gateway presence fetched", data: []handlers.GatewayPresenceResponse{}},
+	{name: "gateway-presence-report", method: "POST", route: "/gateways/:gateway/presence", auth: authToken, request: handlers.GatewayPresenceRequest{}, message: "Gateway presence recorded", data: handlers.GatewayPresenceResponse{Sites: []string{}}},
+	{name: "gateway-summary", method: "GET", route: "/gateways/:gateway/summary", auth: authToken, message: "Gateway summary fetched", data: handlers.GatewaySummaryResponse{}},
+	{name: "gateway-devices", method: "GET", route: "/gateways/:gateway/devices", query: "page=1&per_page=50", auth: authToken, message: "Devices fetched", data: []handlers.DeviceResponse{}, paginated: true, deprecated: true, params: map[string]string{"gateway": exampleID("gateway_id").String()}},
+	{name: "gateway-fetch-by-site", method: "GET", route: "/sites/:site_id/gateways", auth: authToken, message: "Gateways fetched", data: []handlers.GatewayResponse{}},
+	{name: "gateway-device-fetch", method: "GET", route: "/gateway/devices", query: "page=1&per_page=50", auth: authGateway, message: "Devices fetched", data: []handlers.DeviceResponse{}, paginated: true, deprecated: true},
+	{name: "gateway-device-register", method: "PUT", route: "/gateway/devices", auth: authGateway, request: []handlers.DeviceRequest{}, message: "Devices registered", data: handlers.GatewayDevicesResponse{Devices: []handlers.DeviceRegistrationResponse{}}, deprecated: true},
+	{name: "gateway-replace", method: "POST", route: "/gateways/:gateway/replace", auth: authToken, request: handlers.GatewayReplaceRequest{Gateway: "GW-02"}, message: "Gateway replaced", data: handlers.GatewayReplaceResponse{ReplacedBy: "GW-02", Devices: []string{exampleStrings["device_serial_number"]}}},
+
+	// Provisioning session routes
+	{name: "provisioning-session-create", method: "POST", route: "/provisioning-sessions", auth: authToken, request: handlers.ProvisioningSessionRequest{}, status: 201, message: "Session created", data: provisioningSession(models.ProvisioningOpen)},
+	{name: "provisioning-session-fetch", method: "GET", route: "/provisioning-sessions/:session_id", auth: authToken, message: "Session fetched", data: provisioningSession(models.ProvisioningOpen)},
+	{name: "provisioning-session-site", method: "PUT", route: "/provisioning-sessions/:session_id/site", auth: authToken, request: handlers.SiteRequest{}, message: "Site staged", data: provisioningSession(models.ProvisioningOpen)},
+	{name: "provisioning-session-gateway", method: "PUT", route: "/provisioning-sessions/:session_id/gateway", auth: authToken, request: handlers.ProvisioningGatewayRequest{}, message: "Gateway staged", data: provisioningSession(models.ProvisioningOpen)},
+	{name: "provisioning-session-devices", method: "POST", route: "/provisioning-sessions/:session_id/devices", auth: authToken, request: []handlers.DeviceRequest{}, message: "Devices staged", data: provisioningSession(models.ProvisioningOpen)},
+	{name: "provisioning-session-tokens", method: "POST", route: "/provisioning-sessions/:session_id/tokens", auth: authToken, request: handlers.ProvisioningTokensRequest{}, message: "Tokens staged", data: provisioningSession(models.ProvisioningOpen)},
+	{name: "provisioning-session-commit", method: "POST", route: "/provisioning-sessions/:session_id/commit", auth: authToken, message: "Session committed", data: handlers.ProvisioningCommitResponse{Session: provisioningSession(models.ProvisioningCommitted)}, deprecated: true},
+	{name: "provisioning-session-abort", method: "POST", route: "/provisioning-sessions/:session_id/abort", auth: authToken, message: "Session aborted", data: provisioningSession(models.ProvisioningAborted)},
+
+	// Event schema routes
+	{name: "actions", method: "GET", route: "/meta/actions", auth: authToken, message: "Actions fetched", data: []handlers.ActionResponse{{}}},
+	{name: "event-schemas", method: "GET", route: "/meta/event-schemas", auth: authToken, message: "Event schemas fetched", data: eventschema.All()},
+	{name: "event-schema-versions", method: "GET", route: "/meta/event-schemas/:event", auth: authToken, message: "Event schemas fetched", data: eventschema.Versions(eventschema.EventAudit)},
+	{name: "event-schema", method: "GET", route: "/meta/event-schemas/:event/:version", auth: authToken, contentType: "application/schema+json"},
+}
+
+// provisioningSession returns a provisioning session in the state, staging a token for the example action
+func provisioningSession(state string) handlers.ProvisioningSessionResponse {
+	return handlers.ProvisioningSessionResponse{
+		State: state,
+		Plan:  handlers.ProvisioningPlan{Tokens: []string{exampleStrings["action"]}},
+	}
+}
+
+// siteBulkResponse returns the response to a bulk request that created the example site
+func siteBulkResponse() handlers.SiteBulkResponse {
+	site := example(handlers.SiteResponse{Name: exampleStrings["site_name"]}).(handlers.SiteResponse)
+	return handlers.SiteBulkResponse{
+		Results: []handlers.SiteBulkResult{{Name: site.Name, Result: "created", Site: &site}},
+	}
+}
+
+// exampleSavedFilter lists the chillers tagged gauteng
+var exampleSavedFilter = handlers.SavedFilterResponse{
+	Name:  "My chillers in Gauteng",
+	Query: "device_type=chiller&tag=gauteng",
+}
+
+// exampleTagRule tags the devices that have not communicated for a week
+var exampleTagRule = handlers.TagRuleResponse{
+	Name:     "no-comms-7d",
+	Tag:      "no-comms-7d",
+	Field:    models.TagRuleFieldNoCommsDays,
+	Operator: models.TagRuleOperatorAtLeast,
+	Value:    "7",
+}
+
+// exampleSettings keeps the data of a customer for a year and notifies its facilities team
+var exampleSettings = map[string]json.RawMessage{
+	"data_retention_days": json.RawMessage(`365`),
+	"notification_emails": json.RawMessage(`["facilities@example.com"]`),
+	"mqtt_topic_prefix":   json.RawMessage(`"acme/main-street"`),
+}
+
+// routeParam matches the parameters of a route
+var routeParam = regexp.MustCompile(`:[a-z_]+`)
+
+// All returns the fixtures of every endpoint, in the order the routes are registered
+func All() []Fixture {
+	fixtures := make([]Fixture, len(endpoints))
+	for i, e := range endpoints {
+		fixtures[i] = e.fixture()
+	}
+	return fixtures
+}
+
+// Routes returns the method and route of every endpoint with a fixture, e.g. "GET /devices"
+func Routes() []string {
+	routes := make([]string, len(endpoints))
+	for i, e := range endpoints {
+		routes[i] = e.method + " " + e.route
+	}
+	return routes
+}
+
+func (e endpoint) fixture() Fixture {
+	request := Request{
+		Method: e.method,
+		Path: routeParam.ReplaceAllStringFunc(e.route, func(param string) string {
+			if value, ok := e.params[param[1:]]; ok {
+				return value
+			}
+			return exampleParam(param[1:])
+		}),
+		Route:   e.route,
+		Query:   e.query,
+		Headers: map[string]string{},
+		Body:    example(e.request),
+	}
+
+	switch e.auth {
+	case authToken, authUpload, authGateway:
+		request.Headers["Authorization"] = "Bearer " + exampleStrings["token"]
+	case authAdmin:
+		request.Headers["Authorization"] = "$DEVICES_SERVER_ADMIN_SECRET"
+	}
+
+	switch {
+	case e.auth == authUpload:
+		request.Headers["Content-Type"] = "multipart/form-data"
+	case e.request != nil:
+		request.Headers["Content-Type"] = "application/json"
+	}
+
+	status := e.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	response := Response{Status: status, Headers: map[string]string{}}
+	if e.contentType != "" {
+		response.Headers["Content-Type"] = e.contentType
+		return Fixture{Name: e.name, Request: request, Response: response}
+	}
+
+	response.Headers["Content-Type"] = "application/json; charset=utf-8"
+	body := serverutils.Response{Status: status, Message: e.message, Data: example(e.data)}
+	if e.deprecated {
+		body.Warnings = []string{handlers.AuthTokenDeprecation}
+	}
+	if e.paginated {
+		body.Pagination = &serverutils.Pagination{Page: 1, PerPage: serverutils.DefaultPerPage, Total: 1, TotalPages: 1}
+	}
+	response.Body = body
+
+	return Fixture{Name: e.name, Request: request, Response: response}
+}
+
+// Marshal encodes the fixture as indented JSON
+func (f Fixture) Marshal() ([]byte, error) {
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// FileName returns the name the fixture is written to
+func (f Fixture) FileName() string {
+	return f.Name + ".json"
+}
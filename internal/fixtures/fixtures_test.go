@@ -0,0 +1,92 @@
+package fixtures
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/johandrevandeventer/devices-api-server/internal/testsupport"
+)
+
+func TestFixtures(t *testing.T) {
+	names := map[string]bool{}
+	for _, fixture := range All() {
+		if names[fixture.Name] {
+			t.Errorf("duplicate fixture name %s", fixture.Name)
+		}
+		names[fixture.Name] = true
+
+		if strings.Contains(fixture.Request.Path, ":") {
+			t.Errorf("%s: path %s has a route parameter left", fixture.Name, fixture.Request.Path)
+		}
+
+		data, err := fixture.Marshal()
+		if err != nil {
+			t.Errorf("%s: %v", fixture.Name, err)
+			continue
+		}
+		if !json.Valid(data) {
+			t.Errorf("%s: invalid JSON", fixture.Name)
+		}
+	}
+}
+
+// TestExamplesAreStable checks that the examples do not change between runs, so fixtures only change with the API
+func TestExamplesAreStable(t *testing.T) {
+	first, _ := json.Marshal(All())
+	second, _ := json.Marshal(All())
+	if string(first) != string(second) {
+		t.Error("fixtures differ between runs")
+	}
+}
+
+func TestExampleKeepsSetFields(t *testing.T) {
+	type request struct {
+		CustomerID string `json:"customer_id"`
+		Name       string `json:"name"`
+		Tags       []string
+		Hidden     string `json:"-"`
+	}
+
+	got := example(request{Name: "kept"}).(request)
+	if got.Name != "kept" {
+		t.Errorf("Name = %q, want the set value", got.Name)
+	}
+	if got.CustomerID != exampleID("customer_id").String() {
+		t.Errorf("CustomerID = %q, want the example ID", got.CustomerID)
+	}
+	if len(got.Tags) != 1 || got.Tags[0] != exampleStrings["tag"] {
+		t.Errorf("Tags = %v, want one example tag", got.Tags)
+	}
+	if got.Hidden != "" {
+		t.Errorf("Hidden = %q, want fields left out of JSON to stay empty", got.Hidden)
+	}
+}
+
+func TestToSnakeCase(t *testing.T) {
+	for name, want := range map[string]string{
+		"CustomerID":   "customer_id",
+		"ID":           "id",
+		"BuildingURL":  "building_url",
+		"HTTPServer":   "http_server",
+		"AllowedCIDRs": "allowed_cidrs",
+		"Name":         "name",
+	} {
+		if got := toSnakeCase(name); got != want {
+			t.Errorf("toSnakeCase(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+// TestFixturesGolden checks every fixture against its golden file, so a response field that
+// disappears or changes type fails the test rather than silently changing the published fixtures
+func TestFixturesGolden(t *testing.T) {
+	for _, fixture := range All() {
+		data, err := fixture.Marshal()
+		if err != nil {
+			t.Errorf("%s: %v", fixture.Name, err)
+			continue
+		}
+		testsupport.Golden(t, fixture.FileName(), data)
+	}
+}
@@ -9,4 +9,18 @@ var (
 	FlagDebugMode   bool
 	FlagLogPrefix   bool
 	FlagVerbose     bool
+	FlagQuiet       bool
+	FlagPort        string
+	FlagReadOnly    bool
+
+	// Token command
+	FlagCustomerID string
+	FlagAction     string
+	FlagSiteID     string
+
+	FlagAllowedCIDRs   []string
+	FlagCertThumbprint string
+
+	// Fixtures command
+	FlagFixturesDir string
 )
@@ -0,0 +1,71 @@
+package fleetstats
+
+import (
+	"context"
+	"time"
+
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+const day = 24 * time.Hour
+
+// checkInterval is how often Run checks whether the day's snapshot was taken
+const checkInterval = time.Hour
+
+// Run records the fleet composition once per UTC day until the context is cancelled
+func Run(ctx context.Context, bmsDB *devicesdb.BMS_DB, logger *zap.Logger) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	var lastSnapshot time.Time
+
+	for {
+		today := time.Now().UTC().Truncate(day)
+		if lastSnapshot.Before(today) {
+			if err := Snapshot(bmsDB, today); err != nil {
+				logger.Error("Failed to record fleet snapshot", zap.Error(err), zap.Time("day", today))
+			} else {
+				lastSnapshot = today
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Snapshot records the number of devices of every type each customer has on the day, replacing
+// any snapshot already taken that day
+func Snapshot(bmsDB *devicesdb.BMS_DB, dayStart time.Time) error {
+	var snapshots []models.FleetSnapshot
+	if err := bmsDB.DB.Table("devices").
+		Select("sites.customer_id, devices.device_type, COUNT(*) AS devices").
+		Joins("JOIN sites ON sites.id = devices.site_id AND sites.deleted_at IS NULL").
+		Joins("JOIN customers ON customers.id = sites.customer_id AND customers.deleted_at IS NULL").
+		Where("devices.deleted_at IS NULL").
+		Group("sites.customer_id, devices.device_type").
+		Scan(&snapshots).Error; err != nil {
+		return err
+	}
+
+	for i := range snapshots {
+		snapshots[i].Day = dayStart
+	}
+
+	// Device types a customer no longer has must not keep the count of an earlier snapshot
+	return bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("day = ?", dayStart).Delete(&models.FleetSnapshot{}).Error; err != nil {
+			return err
+		}
+		if len(snapshots) == 0 {
+			return nil
+		}
+		return tx.CreateInBatches(&snapshots, 500).Error
+	})
+}
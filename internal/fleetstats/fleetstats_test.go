@@ -0,0 +1,45 @@
+package fleetstats
+
+import (
+	"database/sql/driver"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/dbtest"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+)
+
+func TestSnapshot(t *testing.T) {
+	dayStart := time.Date(2025, 1, 10, 0, 0, 0, 0, time.UTC)
+	customerID := uuid.NewString()
+
+	db := dbtest.Install(t)
+	db.On("FROM `devices`", dbtest.Result{
+		Columns: []string{"customer_id", "device_type", "devices"},
+		Rows:    [][]driver.Value{{customerID, "inverter", int64(4)}, {customerID, "meter", int64(1)}},
+	})
+
+	if err := Snapshot(devicesdb.BMS_DB_Instance, dayStart); err != nil {
+		t.Fatal(err)
+	}
+
+	// The day's earlier snapshot is replaced in the same transaction
+	var statements []string
+	for _, query := range db.Queries() {
+		if statement, _, ok := strings.Cut(query.SQL, " `fleet_snapshots`"); ok && !strings.HasPrefix(statement, "SELECT") {
+			statements = append(statements, statement)
+			if statement == "INSERT INTO" && len(query.Args) == 0 {
+				t.Error("snapshot inserted without values")
+			}
+		}
+	}
+	if want := []string{"DELETE FROM", "INSERT INTO"}; !slices.Equal(statements, want) {
+		t.Errorf("statements = %q, want %q", statements, want)
+	}
+	if got := db.Transactions(); !slices.Equal(got, []string{dbtest.Committed}) {
+		t.Errorf("transactions = %v, want one commit", got)
+	}
+}
@@ -0,0 +1,213 @@
+package integrity
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/cache"
+	"github.com/johandrevandeventer/devices-api-server/internal/changes"
+	"github.com/johandrevandeventer/devices-api-server/internal/config/app"
+	"github.com/johandrevandeventer/devices-api-server/internal/status"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+)
+
+// Reasons a record is orphaned
+const (
+	ReasonSiteMissing     = "site_missing"
+	ReasonSiteDeleted     = "site_deleted"
+	ReasonCustomerMissing = "customer_missing"
+	ReasonCustomerDeleted = "customer_deleted"
+)
+
+// RepairedBy is recorded as who deleted the devices removed by a repair
+const RepairedBy = "integrity-check"
+
+// OrphanedDevice is a live device whose site is missing or deleted
+type OrphanedDevice struct {
+	ID                 uuid.UUID `json:"id"`
+	DeviceSerialNumber string    `json:"device_serial_number"`
+	SiteID             uuid.UUID `json:"site_id"`
+	Reason             string    `json:"reason"`
+}
+
+// OrphanedSite is a live site whose customer is missing or deleted
+type OrphanedSite struct {
+	ID         uuid.UUID `json:"id"`
+	Name       string    `json:"name"`
+	CustomerID uuid.UUID `json:"customer_id"`
+	Reason     string    `json:"reason"`
+}
+
+// OrphanedToken is a live auth token whose customer is missing or deleted
+type OrphanedToken struct {
+	ID         uuid.UUID  `json:"id"`
+	CustomerID uuid.UUID  `json:"customer_id"`
+	SiteID     *uuid.UUID `json:"site_id"`
+	Action     string     `json:"action"`
+	Reason     string     `json:"reason"`
+}
+
+// Report lists the orphaned records found, or removed when Repaired is set
+type Report struct {
+	Devices  []OrphanedDevice `json:"devices"`
+	Sites    []OrphanedSite   `json:"sites"`
+	Tokens   []OrphanedToken  `json:"tokens"`
+	Repaired bool             `json:"repaired"`
+}
+
+// Total returns the number of orphaned records in the report
+func (r *Report) Total() int {
+	return len(r.Devices) + len(r.Sites) + len(r.Tokens)
+}
+
+// Startup checks for orphaned records once, logging what was found and repairing it when
+// configured. A read-only instance only reports them.
+func Startup(bmsDB *devicesdb.BMS_DB, cfg app.IntegrityConfig, logger *zap.Logger) {
+	if !cfg.CheckOnStartup && !cfg.RepairOnStartup {
+		return
+	}
+
+	check := Check
+	if cfg.RepairOnStartup && !status.IsReadOnly() {
+		check = Repair
+	}
+
+	report, err := check(bmsDB)
+	if err != nil {
+		logger.Error("Failed to check the integrity of the database", zap.Error(err))
+		return
+	}
+	if report.Total() == 0 {
+		logger.Info("No orphaned records found")
+		return
+	}
+
+	logger.Warn("Found orphaned records",
+		zap.Int("devices", len(report.Devices)),
+		zap.Int("sites", len(report.Sites)),
+		zap.Int("tokens", len(report.Tokens)),
+		zap.Bool("repaired", report.Repaired),
+	)
+}
+
+// Check reports the live devices, sites and tokens whose parent record is missing or deleted
+func Check(bmsDB *devicesdb.BMS_DB) (*Report, error) {
+	report := &Report{}
+
+	var err error
+	if report.Devices, err = orphanedDevices(bmsDB.DB); err != nil {
+		return nil, err
+	}
+	if report.Sites, err = orphanedSites(bmsDB.DB); err != nil {
+		return nil, err
+	}
+	if report.Tokens, err = orphanedTokens(bmsDB.DB); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// Repair soft-deletes the orphaned records in a single transaction and reports what was deleted.
+// Sites go first, so the devices of the sites deleted are removed along with them.
+func Repair(bmsDB *devicesdb.BMS_DB) (*Report, error) {
+	report := &Report{Repaired: true}
+
+	err := bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		var err error
+		if report.Sites, err = orphanedSites(tx); err != nil {
+			return err
+		}
+		if len(report.Sites) > 0 {
+			ids := make([]uuid.UUID, len(report.Sites))
+			for i, site := range report.Sites {
+				ids[i] = site.ID
+			}
+			if err := tx.Table("sites").Where("id IN ?", ids).Update("deleted_at", now).Error; err != nil {
+				return err
+			}
+		}
+
+		if report.Devices, err = orphanedDevices(tx); err != nil {
+			return err
+		}
+		if len(report.Devices) > 0 {
+			ids := make([]uuid.UUID, len(report.Devices))
+			for i, device := range report.Devices {
+				ids[i] = device.ID
+			}
+			if err := tx.Table("devices").Where("id IN ?", ids).
+				Updates(map[string]any{"deleted_at": now, "deleted_by": RepairedBy}).Error; err != nil {
+				return err
+			}
+		}
+
+		if report.Tokens, err = orphanedTokens(tx); err != nil {
+			return err
+		}
+		if len(report.Tokens) > 0 {
+			ids := make([]uuid.UUID, len(report.Tokens))
+			for i, token := range report.Tokens {
+				ids[i] = token.ID
+			}
+			if err := tx.Table("auth_tokens").Where("id IN ?", ids).Update("deleted_at", now).Error; err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, device := range report.Devices {
+		cache.SiteDevices().Invalidate(device.SiteID.String())
+		changes.RecordSite(device.SiteID.String())
+	}
+
+	return report, nil
+}
+
+// orphanedDevices returns the live devices whose site is missing or deleted
+func orphanedDevices(db *gorm.DB) ([]OrphanedDevice, error) {
+	devices := []OrphanedDevice{}
+	err := db.Table("devices").
+		Select("devices.id, devices.device_serial_number, devices.site_id, "+
+			"CASE WHEN sites.id IS NULL THEN ? ELSE ? END AS reason", ReasonSiteMissing, ReasonSiteDeleted).
+		Joins("LEFT JOIN sites ON sites.id = devices.site_id").
+		Where("devices.deleted_at IS NULL AND (sites.id IS NULL OR sites.deleted_at IS NOT NULL)").
+		Order("devices.device_serial_number").
+		Scan(&devices).Error
+	return devices, err
+}
+
+// orphanedSites returns the live sites whose customer is missing or deleted
+func orphanedSites(db *gorm.DB) ([]OrphanedSite, error) {
+	sites := []OrphanedSite{}
+	err := db.Table("sites").
+		Select("sites.id, sites.name, sites.customer_id, "+
+			"CASE WHEN customers.id IS NULL THEN ? ELSE ? END AS reason", ReasonCustomerMissing, ReasonCustomerDeleted).
+		Joins("LEFT JOIN customers ON customers.id = sites.customer_id").
+		Where("sites.deleted_at IS NULL AND (customers.id IS NULL OR customers.deleted_at IS NOT NULL)").
+		Order("sites.name").
+		Scan(&sites).Error
+	return sites, err
+}
+
+// orphanedTokens returns the live auth tokens whose customer is missing or deleted
+func orphanedTokens(db *gorm.DB) ([]OrphanedToken, error) {
+	tokens := []OrphanedToken{}
+	err := db.Table("auth_tokens").
+		Select("auth_tokens.id, auth_tokens.customer_id, auth_tokens.site_id, auth_tokens.action, "+
+			"CASE WHEN customers.id IS NULL THEN ? ELSE ? END AS reason", ReasonCustomerMissing, ReasonCustomerDeleted).
+		Joins("LEFT JOIN customers ON customers.id = auth_tokens.customer_id").
+		Where("auth_tokens.deleted_at IS NULL AND (customers.id IS NULL OR customers.deleted_at IS NOT NULL)").
+		Order("auth_tokens.customer_id, auth_tokens.action").
+		Scan(&tokens).Error
+	return tokens, err
+}
@@ -0,0 +1,81 @@
+package integrity
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/dbtest"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+)
+
+func TestCheck(t *testing.T) {
+	db := dbtest.Install(t)
+	db.On("FROM `devices`", dbtest.Result{
+		Columns: []string{"id", "device_serial_number", "site_id", "reason"},
+		Rows:    [][]driver.Value{{uuid.NewString(), "SN-1", uuid.NewString(), ReasonSiteDeleted}},
+	})
+	db.On("FROM `auth_tokens`", dbtest.Result{
+		Columns: []string{"id", "customer_id", "site_id", "action", "reason"},
+		Rows:    [][]driver.Value{{uuid.NewString(), uuid.NewString(), nil, "read", ReasonCustomerMissing}},
+	})
+
+	report, err := Check(devicesdb.BMS_DB_Instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(report.Devices) != 1 || report.Devices[0].Reason != ReasonSiteDeleted {
+		t.Errorf("devices = %+v, want SN-1 on a deleted site", report.Devices)
+	}
+	if report.Sites == nil || len(report.Sites) != 0 {
+		t.Errorf("sites = %#v, want an empty list", report.Sites)
+	}
+	if len(report.Tokens) != 1 || report.Tokens[0].Reason != ReasonCustomerMissing {
+		t.Errorf("tokens = %+v, want a token of a missing customer", report.Tokens)
+	}
+	if report.Total() != 2 || report.Repaired {
+		t.Errorf("total = %d, repaired = %v, want 2 unrepaired", report.Total(), report.Repaired)
+	}
+
+	for _, query := range db.Queries() {
+		if !strings.HasPrefix(query.SQL, "SELECT") {
+			t.Errorf("check wrote to the database: %s", query.SQL)
+		}
+	}
+}
+
+func TestRepair(t *testing.T) {
+	db := dbtest.Install(t)
+	db.On("FROM `sites`", dbtest.Result{
+		Columns: []string{"id", "name", "customer_id", "reason"},
+		Rows:    [][]driver.Value{{uuid.NewString(), "Site", uuid.NewString(), ReasonCustomerDeleted}},
+	})
+	db.On("FROM `devices`", dbtest.Result{
+		Columns: []string{"id", "device_serial_number", "site_id", "reason"},
+		Rows:    [][]driver.Value{{uuid.NewString(), "SN-1", uuid.NewString(), ReasonSiteDeleted}},
+	})
+
+	report, err := Repair(devicesdb.BMS_DB_Instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Repaired || len(report.Sites) != 1 || len(report.Devices) != 1 || len(report.Tokens) != 0 {
+		t.Errorf("report = %+v, want a repaired site and device", report)
+	}
+
+	// Sites are deleted before their devices are looked up, and there were no tokens to delete
+	var updates []string
+	for _, query := range db.Queries() {
+		if table, ok := strings.CutPrefix(query.SQL, "UPDATE "); ok {
+			updates = append(updates, strings.Fields(table)[0])
+		}
+	}
+	if want := []string{"`sites`", "`devices`"}; strings.Join(updates, ",") != strings.Join(want, ",") {
+		t.Errorf("updated %v, want %v", updates, want)
+	}
+	if got := db.Transactions(); len(got) != 1 || got[0] != dbtest.Committed {
+		t.Errorf("transactions = %v, want a single commit", got)
+	}
+}
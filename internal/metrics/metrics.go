@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "devices_api"
+
+// Outcome label values
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+var registry = prometheus.NewRegistry()
+
+var (
+	// Authentications counts calls to the /authenticate route
+	Authentications = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "authentications_total",
+		Help:      "Authentication attempts by outcome and failure reason.",
+	}, []string{"outcome", "reason"})
+
+	// TokenValidations counts token checks made by the auth middleware
+	TokenValidations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "token_validations_total",
+		Help:      "Token validations on protected routes by outcome and failure reason.",
+	}, []string{"outcome", "reason"})
+
+	// AdminSecretFailures counts rejected requests to the admin routes
+	AdminSecretFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "admin_secret_failures_total",
+		Help:      "Requests to admin routes rejected because of the admin secret.",
+	}, []string{"reason"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		Authentications,
+		TokenValidations,
+		AdminSecretFailures,
+	)
+}
+
+// Register adds collectors to the metrics registry
+func Register(cs ...prometheus.Collector) {
+	registry.MustRegister(cs...)
+}
+
+// Handler serves the registered metrics in the OpenMetrics format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true})
+}
+
+// AuthenticationSucceeded records a successful authentication
+func AuthenticationSucceeded() {
+	Authentications.WithLabelValues(OutcomeSuccess, "").Inc()
+}
+
+// AuthenticationFailed records a failed authentication
+func AuthenticationFailed(reason string) {
+	Authentications.WithLabelValues(OutcomeFailure, reason).Inc()
+}
+
+// TokenValidationSucceeded records a successful token validation
+func TokenValidationSucceeded() {
+	TokenValidations.WithLabelValues(OutcomeSuccess, "").Inc()
+}
+
+// TokenValidationFailed records a failed token validation
+func TokenValidationFailed(reason string) {
+	TokenValidations.WithLabelValues(OutcomeFailure, reason).Inc()
+}
+
+// AdminSecretFailed records a request rejected because of the admin secret
+func AdminSecretFailed(reason string) {
+	AdminSecretFailures.WithLabelValues(reason).Inc()
+}
@@ -0,0 +1,112 @@
+package presence
+
+import (
+	"sync"
+	"time"
+)
+
+// State is the connection presence of a gateway. A connection reported by the MQTT bridge holds
+// until the bridge reports the disconnect, usually from the gateway's last will. A connection
+// derived from heartbeats lapses once the gateway has been silent for the online window.
+type State struct {
+	Connected      bool
+	Bridged        bool
+	ConnectedAt    time.Time
+	DisconnectedAt time.Time
+	LastSeen       time.Time
+}
+
+var (
+	mu           sync.RWMutex
+	gateways     = make(map[string]State)
+	onlineWindow = 15 * time.Minute
+)
+
+// SetOnlineWindow sets how long a connection derived from heartbeats lasts without another
+// heartbeat, keeping the default if the window is not positive
+func SetOnlineWindow(window time.Duration) {
+	if window <= 0 {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	onlineWindow = window
+}
+
+// at returns the state as it is at the time, disconnecting a heartbeat connection that lapsed
+func (s State) at(now time.Time, window time.Duration) State {
+	if s.Connected && !s.Bridged && now.Sub(s.LastSeen) > window {
+		s.Connected = false
+		s.DisconnectedAt = s.LastSeen.Add(window)
+	}
+	return s
+}
+
+// Seen records a heartbeat through the gateway, connecting it if it was disconnected
+func Seen(gateway string, at time.Time) {
+	if gateway == "" {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	state := State{}
+	if current, ok := gateways[gateway]; ok {
+		state = current.at(at, onlineWindow)
+	}
+
+	if !state.Connected {
+		state.Connected = true
+		state.ConnectedAt = at
+	}
+	if at.After(state.LastSeen) {
+		state.LastSeen = at
+	}
+	gateways[gateway] = state
+}
+
+// Set records a connect or disconnect of the gateway reported by the MQTT bridge
+func Set(gateway string, connected bool, at time.Time) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	state := State{}
+	if current, ok := gateways[gateway]; ok {
+		state = current.at(at, onlineWindow)
+	}
+
+	if connected {
+		if !state.Connected {
+			state.ConnectedAt = at
+		}
+		if at.After(state.LastSeen) {
+			state.LastSeen = at
+		}
+	} else if state.Connected {
+		state.DisconnectedAt = at
+	}
+	state.Connected = connected
+	state.Bridged = connected
+	gateways[gateway] = state
+}
+
+// Get returns the presence of the gateway at the time, and false if it has not been seen since startup
+func Get(gateway string, now time.Time) (State, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	state, ok := gateways[gateway]
+	if !ok {
+		return State{}, false
+	}
+	return state.at(now, onlineWindow), true
+}
+
+// Reset forgets the presence of every gateway
+func Reset() {
+	mu.Lock()
+	defer mu.Unlock()
+	gateways = make(map[string]State)
+}
@@ -0,0 +1,57 @@
+package presence
+
+import (
+	"testing"
+	"time"
+)
+
+var now = time.Date(2025, 1, 10, 12, 0, 0, 0, time.UTC)
+
+func TestHeartbeatPresence(t *testing.T) {
+	Reset()
+	SetOnlineWindow(15 * time.Minute)
+
+	Seen("GW-1", now)
+	Seen("GW-1", now.Add(10*time.Minute))
+
+	state, ok := Get("GW-1", now.Add(20*time.Minute))
+	if !ok || !state.Connected || !state.ConnectedAt.Equal(now) {
+		t.Fatalf("state = %+v, want connected since the first heartbeat", state)
+	}
+
+	// The connection lapses once the gateway has been silent for the online window
+	state, _ = Get("GW-1", now.Add(30*time.Minute))
+	if state.Connected || !state.DisconnectedAt.Equal(now.Add(25*time.Minute)) {
+		t.Fatalf("state = %+v, want disconnected when the window ran out", state)
+	}
+
+	// A heartbeat after the lapse starts a new connection
+	Seen("GW-1", now.Add(40*time.Minute))
+	state, _ = Get("GW-1", now.Add(40*time.Minute))
+	if !state.Connected || !state.ConnectedAt.Equal(now.Add(40*time.Minute)) {
+		t.Fatalf("state = %+v, want reconnected by the heartbeat", state)
+	}
+
+	if _, ok := Get("GW-2", now); ok {
+		t.Error("unseen gateway has a presence")
+	}
+}
+
+func TestBridgePresence(t *testing.T) {
+	Reset()
+	SetOnlineWindow(15 * time.Minute)
+
+	Set("GW-1", true, now)
+
+	// A bridged connection holds without heartbeats until the bridge reports the disconnect
+	state, _ := Get("GW-1", now.Add(time.Hour))
+	if !state.Connected {
+		t.Fatalf("state = %+v, want connected", state)
+	}
+
+	Set("GW-1", false, now.Add(2*time.Hour))
+	state, _ = Get("GW-1", now.Add(2*time.Hour))
+	if state.Connected || !state.ConnectedAt.Equal(now) || !state.DisconnectedAt.Equal(now.Add(2*time.Hour)) {
+		t.Fatalf("state = %+v, want disconnected by the bridge", state)
+	}
+}
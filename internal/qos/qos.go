@@ -0,0 +1,179 @@
+package qos
+
+import (
+	"context"
+	"sync"
+)
+
+// Class is the priority class of a request
+type Class int
+
+// Request classes, in the order they are considered when a slot frees up
+const (
+	Interactive Class = iota
+	Bulk
+	numClasses
+)
+
+// String returns the name of the class
+func (c Class) String() string {
+	if c == Bulk {
+		return "bulk"
+	}
+	return "interactive"
+}
+
+// tenantQueue holds the waiting requests of a class, served round-robin across tenants so a
+// single tenant cannot starve the others
+type tenantQueue struct {
+	tenants []string
+	waiting map[string][]chan struct{}
+}
+
+func (q *tenantQueue) len() int {
+	return len(q.tenants)
+}
+
+func (q *tenantQueue) push(tenant string, ready chan struct{}) {
+	if len(q.waiting[tenant]) == 0 {
+		q.tenants = append(q.tenants, tenant)
+	}
+	q.waiting[tenant] = append(q.waiting[tenant], ready)
+}
+
+// pop takes the oldest request of the next tenant and moves the tenant to the back of the queue
+func (q *tenantQueue) pop() chan struct{} {
+	tenant := q.tenants[0]
+	q.tenants = q.tenants[1:]
+
+	ready := q.waiting[tenant][0]
+	q.waiting[tenant] = q.waiting[tenant][1:]
+
+	if len(q.waiting[tenant]) > 0 {
+		q.tenants = append(q.tenants, tenant)
+	} else {
+		delete(q.waiting, tenant)
+	}
+
+	return ready
+}
+
+// remove drops a request that stopped waiting, reporting whether it was still queued
+func (q *tenantQueue) remove(tenant string, ready chan struct{}) bool {
+	waiting := q.waiting[tenant]
+	for i, candidate := range waiting {
+		if candidate != ready {
+			continue
+		}
+
+		waiting = append(waiting[:i], waiting[i+1:]...)
+		if len(waiting) > 0 {
+			q.waiting[tenant] = waiting
+			return true
+		}
+
+		delete(q.waiting, tenant)
+		for j, name := range q.tenants {
+			if name == tenant {
+				q.tenants = append(q.tenants[:j], q.tenants[j+1:]...)
+				break
+			}
+		}
+		return true
+	}
+
+	return false
+}
+
+// Scheduler limits the number of concurrent requests. Once the limit is reached, requests wait
+// and freed slots are handed out by weighted round-robin between the classes.
+type Scheduler struct {
+	mu       sync.Mutex
+	capacity int
+	active   int
+	weights  [numClasses]int
+	credits  [numClasses]int
+	queues   [numClasses]*tenantQueue
+}
+
+// NewScheduler creates a scheduler allowing capacity concurrent requests. Weights below 1 are raised to 1.
+func NewScheduler(capacity, interactiveWeight, bulkWeight int) *Scheduler {
+	s := &Scheduler{capacity: max(capacity, 1)}
+	s.weights[Interactive] = max(interactiveWeight, 1)
+	s.weights[Bulk] = max(bulkWeight, 1)
+	s.credits = s.weights
+
+	for class := range s.queues {
+		s.queues[class] = &tenantQueue{waiting: make(map[string][]chan struct{})}
+	}
+
+	return s
+}
+
+// Acquire waits for a slot for a request of the class and tenant, returning the context error if
+// the context is done first. Every successful Acquire must be followed by a Release.
+func (s *Scheduler) Acquire(ctx context.Context, class Class, tenant string) error {
+	s.mu.Lock()
+	if s.active < s.capacity && s.queued() == 0 {
+		s.active++
+		s.mu.Unlock()
+		return nil
+	}
+
+	ready := make(chan struct{})
+	s.queues[class].push(tenant, ready)
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		queued := s.queues[class].remove(tenant, ready)
+		s.mu.Unlock()
+
+		// The slot was handed over while the context was being cancelled, pass it on
+		if !queued {
+			s.Release()
+		}
+		return ctx.Err()
+	}
+}
+
+// Release frees the slot of a finished request, handing it to the next waiting request
+func (s *Scheduler) Release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ready := s.next(); ready != nil {
+		close(ready)
+		return
+	}
+
+	s.active--
+}
+
+// queued returns the number of tenants with waiting requests
+func (s *Scheduler) queued() int {
+	count := 0
+	for _, queue := range s.queues {
+		count += queue.len()
+	}
+	return count
+}
+
+// next picks the next waiting request. Each class is served up to its weight in a row while the
+// other class is waiting, after which the credits are topped up again.
+func (s *Scheduler) next() chan struct{} {
+	for pass := 0; pass < 2; pass++ {
+		for class, queue := range s.queues {
+			if s.credits[class] > 0 && queue.len() > 0 {
+				s.credits[class]--
+				return queue.pop()
+			}
+		}
+		s.credits = s.weights
+	}
+
+	return nil
+}
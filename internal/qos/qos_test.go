@@ -0,0 +1,185 @@
+package qos
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitTimeout bounds how long a test waits for a request that should get a slot
+const waitTimeout = time.Second
+
+// acquireAsync starts acquiring a slot, returning a channel that receives the result
+func acquireAsync(ctx context.Context, s *Scheduler, class Class, tenant string) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- s.Acquire(ctx, class, tenant) }()
+	return done
+}
+
+// waitQueued waits until the number of waiting requests reaches n
+func waitQueued(t *testing.T, s *Scheduler, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(waitTimeout)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		queued := 0
+		for _, queue := range s.queues {
+			for _, waiting := range queue.waiting {
+				queued += len(waiting)
+			}
+		}
+		s.mu.Unlock()
+
+		if queued == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d queued requests", n)
+}
+
+func TestAcquireWithinCapacity(t *testing.T) {
+	s := NewScheduler(2, 1, 1)
+
+	for i := 0; i < 2; i++ {
+		if err := s.Acquire(context.Background(), Interactive, "a"); err != nil {
+			t.Fatalf("Acquire %d: %v", i, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Acquire(ctx, Interactive, "a"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Acquire beyond capacity = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestReleaseHandsOverSlot(t *testing.T) {
+	s := NewScheduler(1, 1, 1)
+	if err := s.Acquire(context.Background(), Interactive, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	done := acquireAsync(context.Background(), s, Bulk, "b")
+	waitQueued(t, s, 1)
+
+	s.Release()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Acquire: %v", err)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatal("waiting request did not get the released slot")
+	}
+
+	if s.active != 1 {
+		t.Errorf("active = %d after handing over the slot, want 1", s.active)
+	}
+}
+
+// TestWeightedOrder checks that freed slots alternate between the classes by weight
+func TestWeightedOrder(t *testing.T) {
+	s := NewScheduler(1, 2, 1)
+	if err := s.Acquire(context.Background(), Interactive, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan Class, 6)
+	enqueue := func(class Class) {
+		done := acquireAsync(context.Background(), s, class, "a")
+		go func() {
+			if <-done == nil {
+				order <- class
+			}
+		}()
+	}
+
+	queued := 0
+	for i := 0; i < 3; i++ {
+		enqueue(Interactive)
+		queued++
+		waitQueued(t, s, queued)
+		enqueue(Bulk)
+		queued++
+		waitQueued(t, s, queued)
+	}
+
+	want := []Class{Interactive, Interactive, Bulk, Interactive, Bulk, Bulk}
+	for i, class := range want {
+		s.Release()
+
+		select {
+		case got := <-order:
+			if got != class {
+				t.Errorf("slot %d went to %v, want %v", i, got, class)
+			}
+		case <-time.After(waitTimeout):
+			t.Fatalf("slot %d was not handed out", i)
+		}
+	}
+}
+
+// TestTenantRoundRobin checks that a tenant with many waiting requests does not starve the others
+func TestTenantRoundRobin(t *testing.T) {
+	s := NewScheduler(1, 1, 1)
+	if err := s.Acquire(context.Background(), Interactive, "busy"); err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan string, 4)
+	enqueue := func(tenant string, queued int) {
+		done := acquireAsync(context.Background(), s, Interactive, tenant)
+		go func() {
+			if <-done == nil {
+				order <- tenant
+			}
+		}()
+		waitQueued(t, s, queued)
+	}
+
+	enqueue("busy", 1)
+	enqueue("busy", 2)
+	enqueue("busy", 3)
+	enqueue("quiet", 4)
+
+	want := []string{"busy", "quiet", "busy", "busy"}
+	for i, tenant := range want {
+		s.Release()
+
+		select {
+		case got := <-order:
+			if got != tenant {
+				t.Errorf("slot %d went to %s, want %s", i, got, tenant)
+			}
+		case <-time.After(waitTimeout):
+			t.Fatalf("slot %d was not handed out", i)
+		}
+	}
+}
+
+func TestCancelledWaiterLeavesQueue(t *testing.T) {
+	s := NewScheduler(1, 1, 1)
+	if err := s.Acquire(context.Background(), Interactive, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := acquireAsync(ctx, s, Bulk, "b")
+	waitQueued(t, s, 1)
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("Acquire = %v, want %v", err, context.Canceled)
+	}
+	waitQueued(t, s, 0)
+
+	// The slot is freed instead of being handed to the cancelled request
+	s.Release()
+	if s.active != 0 {
+		t.Errorf("active = %d after releasing the only slot, want 0", s.active)
+	}
+}
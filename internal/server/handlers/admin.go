@@ -1,13 +1,29 @@
 package handlers
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"net/http"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/audit"
+	"github.com/johandrevandeventer/devices-api-server/internal/cache"
+	"github.com/johandrevandeventer/devices-api-server/internal/crashreport"
 	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/internal/status"
 	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
 	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"github.com/johandrevandeventer/logging"
+	"go.uber.org/zap"
 	"gorm.io/gorm"
 )
 
@@ -16,22 +32,28 @@ func GenerateAdminTokenHandler(c *gin.Context) {
 	userID := serverutils.GenerateID()
 
 	// Generate the JWT token
-	token, err := serverutils.GenerateJWT(userID, "Admin", "admin", "ADMIN", false)
+	token, err := serverutils.GenerateJWT(userID, "Admin", "admin", serverutils.ActionAdmin, 0)
 	if err != nil {
 		serverutils.WriteError(c, http.StatusInternalServerError, "Failed to generate token", err.Error())
 		return
 	}
 
+	audit.RecordRequest(c, audit.EventAdminTokenIssued, audit.OutcomeSuccess, "")
 	serverutils.WriteJSON(c, http.StatusOK, "Token generated successfully", token)
 }
 
+type GenerateTokenRequest struct {
+	CustomerID     string   `json:"customer_id"`
+	SiteID         string   `json:"site_id"`
+	Action         string   `json:"action"`
+	AllowedCIDRs   []string `json:"allowed_cidrs"`
+	CertThumbprint string   `json:"cert_thumbprint"`
+}
+
 // Route: GenerateJWTToken (Admin Only)
 func GenerateTokenHandler(c *gin.Context) {
 	// Get data off request body
-	var body struct {
-		CustomerID string `json:"customer_id"`
-		Action     string `json:"action"`
-	}
+	var body GenerateTokenRequest
 	if err := c.BindJSON(&body); err != nil {
 		serverutils.WriteError(c, http.StatusBadRequest, "Invalid request body", err.Error())
 		return
@@ -48,6 +70,12 @@ func GenerateTokenHandler(c *gin.Context) {
 		return
 	}
 
+	// Validate the optional site_id field, which scopes the token to a single site
+	if body.SiteID != "" && !serverutils.IsValidUUID(body.SiteID) {
+		serverutils.WriteError(c, http.StatusBadRequest, "Invalid request body", "Invalid Site ID")
+		return
+	}
+
 	// Validate the action field
 	if body.Action == "" {
 		serverutils.WriteError(c, http.StatusBadRequest, "Invalid request body", "Action field is required")
@@ -60,50 +88,358 @@ func GenerateTokenHandler(c *gin.Context) {
 		return
 	}
 
+	// Validate the optional binding of the token to client networks and a client certificate
+	binding, err := NewTokenBinding(body.AllowedCIDRs, body.CertThumbprint)
+	if err != nil {
+		serverutils.WriteError(c, http.StatusBadRequest, "Invalid request body", err.Error())
+		return
+	}
+
 	// Get the database instance
-	bmsDB, err := devicesdb.GetDB()
+	bmsDB, err := serverutils.RequestDB(c)
 	if err != nil {
 		serverutils.WriteError(c, http.StatusInternalServerError, "Failed to get database instance", err.Error())
 		return
 	}
 
-	// Check if the customer exists
-	var customer models.Customer
-	result := bmsDB.DB.First(&customer, "id = ?", body.CustomerID)
-	if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+	var authToken *models.AuthToken
+	if body.SiteID != "" {
+		authToken, err = IssueSiteToken(bmsDB, body.CustomerID, body.SiteID, body.Action, binding)
+	} else {
+		authToken, err = IssueCustomerToken(bmsDB, body.CustomerID, body.Action, binding)
+	}
+	if errors.Is(err, ErrSiteNotFound) {
+		serverutils.WriteError(c, http.StatusNotFound, "Site not found", "Site does not exist for the customer")
+		return
+	} else if errors.Is(err, gorm.ErrRecordNotFound) {
 		serverutils.WriteError(c, http.StatusNotFound, "Customer not found", "Customer does not exist")
 		return
-	} else if result.Error != nil {
-		serverutils.WriteError(c, http.StatusInternalServerError, "Database error", result.Error.Error())
+	} else if err != nil {
+		serverutils.WriteError(c, http.StatusInternalServerError, "Failed to generate token", err.Error())
 		return
 	}
 
+	audit.Record(audit.Event{
+		Name:       audit.EventTokenIssued,
+		Outcome:    audit.OutcomeSuccess,
+		Reason:     body.Action,
+		Subject:    body.CustomerID,
+		RemoteAddr: c.ClientIP(),
+		Method:     c.Request.Method,
+		Path:       c.FullPath(),
+	})
+
+	// Return the response with the AuthToken and preloaded Customer details
+	serverutils.WriteJSON(c, http.StatusOK, "Token generated successfully", authToken)
+}
+
+// =====================================================================================================================
+
+// ErrSiteNotFound is returned when a site token is requested for a site the customer does not own
+var ErrSiteNotFound = errors.New("site not found for customer")
+
+// tokenTTL and refreshTokenTTL are how long issued tokens and their refresh tokens are accepted for
+var (
+	tokenTTL        = 24 * time.Hour
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// SetTokenTTLs sets how long issued tokens and their refresh tokens are accepted for. A TTL of 0
+// issues tokens that do not expire, and a negative TTL keeps the default.
+func SetTokenTTLs(access, refresh time.Duration) {
+	if access >= 0 {
+		tokenTTL = access
+	}
+	if refresh >= 0 {
+		refreshTokenTTL = refresh
+	}
+}
+
+// IssueCustomerToken generates a token for the customer and stores it with the Customer details preloaded
+func IssueCustomerToken(bmsDB *devicesdb.BMS_DB, customerID, action string, binding TokenBinding) (*models.AuthToken, error) {
+	return issueToken(bmsDB, customerID, nil, action, binding)
+}
+
+// IssueSiteToken generates a token scoped to one of the customer's sites and stores it with the Customer details preloaded
+func IssueSiteToken(bmsDB *devicesdb.BMS_DB, customerID, siteID, action string, binding TokenBinding) (*models.AuthToken, error) {
+	// Check if the site exists and belongs to the customer
+	var site models.Site
+	if err := bmsDB.DB.First(&site, "id = ? AND customer_id = ?", siteID, customerID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSiteNotFound
+		}
+		return nil, err
+	}
+
+	return issueToken(bmsDB, customerID, &site.ID, action, binding)
+}
+
+// issueToken generates a token for the customer, scoped to the site if one is given
+func issueToken(bmsDB *devicesdb.BMS_DB, customerID string, siteID *uuid.UUID, action string, binding TokenBinding) (*models.AuthToken, error) {
+	// Check if the customer exists
+	var customer models.Customer
+	if err := bmsDB.DB.First(&customer, "id = ?", customerID).Error; err != nil {
+		return nil, err
+	}
+
+	var authToken models.AuthToken
+	err := bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		authToken, err = storeToken(tx, customer, siteID, action, binding)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return loadIssuedToken(bmsDB, authToken)
+}
+
+// loadIssuedToken fetches the token just issued with the Customer details preloaded, keeping the
+// refresh token issued with it
+func loadIssuedToken(bmsDB *devicesdb.BMS_DB, issued models.AuthToken) (*models.AuthToken, error) {
+	var authToken models.AuthToken
+	if err := bmsDB.DB.Preload("Customer").First(&authToken, "id = ?", issued.ID).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch token details: %w", err)
+	}
+	authToken.RefreshToken = issued.RefreshToken
+
+	return &authToken, nil
+}
+
+// storeToken generates a token for the customer, scoped to the site if one is given, and saves it in
+// the transaction with a new refresh token, replacing the token previously issued for the same scope
+// and action
+func storeToken(tx *gorm.DB, customer models.Customer, siteID *uuid.UUID, action string, binding TokenBinding) (models.AuthToken, error) {
+	scope := ""
+	if siteID != nil {
+		scope = siteID.String()
+	}
+
 	// Generate the JWT token
-	token, err := serverutils.GenerateJWT(body.CustomerID, customer.Name, "user", body.Action, false)
+	issuedAt := time.Now()
+	token, err := serverutils.GenerateSiteJWT(customer.ID.String(), scope, customer.Name, "user", action, tokenTTL)
 	if err != nil {
-		serverutils.WriteError(c, http.StatusInternalServerError, "Failed to generate token", err.Error())
-		return
+		return models.AuthToken{}, err
+	}
+
+	refreshToken, err := generateSecret()
+	if err != nil {
+		return models.AuthToken{}, err
+	}
+	refreshTokenHash := hashSecret(refreshToken)
+
+	query := tx.Unscoped().Where("customer_id = ? AND action = ?", customer.ID, action)
+	if siteID != nil {
+		query = query.Where("site_id = ?", *siteID)
+	} else {
+		query = query.Where("site_id IS NULL")
+	}
+	if err := query.Delete(&models.AuthToken{}).Error; err != nil {
+		return models.AuthToken{}, fmt.Errorf("failed to save token: %w", err)
 	}
 
-	// Create the AuthToken record
 	authToken := models.AuthToken{
 		CustomerID: customer.ID,
-		Action:     body.Action,
+		SiteID:     siteID,
+		Action:     action,
 		Token:      token,
+
+		RefreshTokenHash: &refreshTokenHash,
+		RefreshToken:     refreshToken,
+	}
+	if tokenTTL > 0 {
+		expiresAt := issuedAt.Add(tokenTTL)
+		authToken.ExpiresAt = &expiresAt
+	}
+	if refreshTokenTTL > 0 {
+		refreshExpiresAt := issuedAt.Add(refreshTokenTTL)
+		authToken.RefreshExpiresAt = &refreshExpiresAt
+	}
+	if len(binding.AllowedCIDRs) > 0 {
+		cidrs := strings.Join(binding.AllowedCIDRs, ",")
+		authToken.AllowedCIDRs = &cidrs
+	}
+	if binding.CertThumbprint != "" {
+		authToken.CertThumbprint = &binding.CertThumbprint
+	}
+	if err := tx.Create(&authToken).Error; err != nil {
+		return models.AuthToken{}, fmt.Errorf("failed to save token: %w", err)
+	}
+
+	return authToken, nil
+}
+
+// generateSecret generates a random secret, such as a refresh token or API key
+func generateSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate secret: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashSecret returns the hex SHA-256 hash refresh tokens and API keys are stored and looked up by
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// tokenBinding returns the binding the token was issued with
+func tokenBinding(token models.AuthToken) TokenBinding {
+	var binding TokenBinding
+	if token.AllowedCIDRs != nil {
+		binding.AllowedCIDRs = strings.Split(*token.AllowedCIDRs, ",")
+	}
+	if token.CertThumbprint != nil {
+		binding.CertThumbprint = *token.CertThumbprint
+	}
+	return binding
+}
+
+// TokenBinding restricts the clients an issued token is accepted from. The zero value leaves the
+// token unbound.
+type TokenBinding struct {
+	AllowedCIDRs   []string
+	CertThumbprint string
+}
+
+// certThumbprintRegex matches a hex SHA-256 certificate thumbprint once colons are removed
+var certThumbprintRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// NewTokenBinding validates the networks and client certificate thumbprint a token is bound to.
+// A bare IP address allows that address only, and the thumbprint may be given with colons.
+func NewTokenBinding(allowedCIDRs []string, certThumbprint string) (TokenBinding, error) {
+	var binding TokenBinding
+
+	for _, cidr := range allowedCIDRs {
+		cidr = strings.TrimSpace(cidr)
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(cidr)
+			if addrErr != nil {
+				return TokenBinding{}, fmt.Errorf("%q is not a CIDR range or IP address", cidr)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		binding.AllowedCIDRs = append(binding.AllowedCIDRs, prefix.Masked().String())
+	}
+
+	if certThumbprint != "" {
+		thumbprint := strings.ToLower(strings.ReplaceAll(certThumbprint, ":", ""))
+		if !certThumbprintRegex.MatchString(thumbprint) {
+			return TokenBinding{}, errors.New("cert_thumbprint must be the hex SHA-256 thumbprint of the client certificate")
+		}
+		binding.CertThumbprint = thumbprint
+	}
+
+	return binding, nil
+}
+
+// TokenBindingMismatch returns why the request may not present the token, or an empty string when
+// the token is unbound or the request comes from a client it is bound to
+func TokenBindingMismatch(c *gin.Context, token models.AuthToken) string {
+	if token.AllowedCIDRs != nil {
+		addr, err := netip.ParseAddr(c.ClientIP())
+		allowed := false
+		for _, cidr := range strings.Split(*token.AllowedCIDRs, ",") {
+			if prefix, prefixErr := netip.ParsePrefix(cidr); err == nil && prefixErr == nil && prefix.Contains(addr.Unmap()) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return "network_not_allowed"
+		}
 	}
 
-	// Save the AuthToken to the database
-	if err := bmsDB.DB.Create(&authToken).Error; err != nil {
-		serverutils.WriteError(c, http.StatusInternalServerError, "Failed to save token", err.Error())
+	if token.CertThumbprint != nil && clientCertThumbprint(c) != *token.CertThumbprint {
+		return "certificate_mismatch"
+	}
+
+	return ""
+}
+
+// clientCertThumbprint returns the hex SHA-256 thumbprint of the certificate the client presented
+// over TLS, or an empty string without one
+func clientCertThumbprint(c *gin.Context) string {
+	if c.Request.TLS == nil || len(c.Request.TLS.PeerCertificates) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(c.Request.TLS.PeerCertificates[0].Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Route: CacheStats (Admin Only)
+func CacheStatsHandler(c *gin.Context) {
+	serverutils.WriteJSON(c, http.StatusOK, "Cache stats fetched", cache.Names().Stats())
+}
+
+type StatusResponse struct {
+	status.StartupReport
+	Degraded   map[string]string  `json:"degraded"`
+	Goroutines []status.Goroutine `json:"goroutines"`
+}
+
+// Route: Status (Admin Only)
+func StatusHandler(c *gin.Context) {
+	serverutils.WriteJSON(c, http.StatusOK, "Status fetched", StatusResponse{
+		StartupReport: status.GetStartupReport(),
+		Degraded:      status.Degraded(),
+		Goroutines:    status.Goroutines(),
+	})
+}
+
+// defaultCrashLimit is the number of crash reports returned when no limit is given
+const defaultCrashLimit = 10
+
+// Route: GET /admin/crashes (Admin Only)
+// Fetch the most recent crash reports, newest first. Supports ?limit= (1-50, default 10).
+func CrashFetchRecent(c *gin.Context) {
+	limit := defaultCrashLimit
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 50 {
+			serverutils.WriteError(c, http.StatusBadRequest, "Invalid limit", "limit must be a number between 1 and 50")
+			return
+		}
+		limit = parsed
+	}
+
+	reports, err := crashreport.Recent(limit)
+	if err != nil {
+		serverutils.WriteError(c, http.StatusInternalServerError, "Failed to fetch crash reports", err.Error())
 		return
 	}
 
-	// Preload the Customer details
-	if err := bmsDB.DB.Preload("Customer").First(&authToken, authToken.ID).Error; err != nil {
-		serverutils.WriteError(c, http.StatusInternalServerError, "Failed to fetch token details", err.Error())
+	serverutils.WriteJSON(c, http.StatusOK, "Crash reports fetched", reports)
+}
+
+type ReadOnlyRequest struct {
+	Enabled *bool `json:"enabled"`
+}
+
+type ReadOnlyResponse struct {
+	Enabled bool `json:"enabled"`
+}
+
+// Route: GET /admin/read-only (Admin Only)
+// Fetch whether the instance is in read-only mode
+func ReadOnlyFetch(c *gin.Context) {
+	serverutils.WriteJSON(c, http.StatusOK, "Read-only mode fetched", ReadOnlyResponse{Enabled: status.IsReadOnly()})
+}
+
+// Route: PUT /admin/read-only (Admin Only)
+// Switch the instance in or out of read-only mode, e.g. to promote a standby after failover
+func ReadOnlySet(c *gin.Context) {
+	var body ReadOnlyRequest
+	if err := c.BindJSON(&body); err != nil || body.Enabled == nil {
+		serverutils.WriteError(c, http.StatusBadRequest, "Invalid request body", "enabled field is required")
 		return
 	}
 
-	// Return the response with the AuthToken and preloaded Customer details
-	serverutils.WriteJSON(c, http.StatusOK, "Token generated successfully", authToken)
+	status.SetReadOnly(*body.Enabled)
+	logging.GetLogger("api-server").Warn("Read-only mode changed", zap.Bool("enabled", *body.Enabled))
+
+	serverutils.WriteJSON(c, http.StatusOK, "Read-only mode updated", ReadOnlyResponse{Enabled: *body.Enabled})
 }
@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/audit"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/internal/timefmt"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"gorm.io/gorm"
+)
+
+// apiKeyPrefix starts every API key, so leaked keys are easy to recognise
+const apiKeyPrefix = "bms_"
+
+type APIKeyRequest struct {
+	CustomerID uuid.UUID  `json:"customer_id"`
+	SiteID     *uuid.UUID `json:"site_id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+}
+
+type APIKeyResponse struct {
+	ID         uuid.UUID    `json:"id"`
+	CustomerID uuid.UUID    `json:"customer_id"`
+	SiteID     *uuid.UUID   `json:"site_id,omitempty"`
+	Name       string       `json:"name"`
+	Scopes     []string     `json:"scopes"`
+	Prefix     string       `json:"prefix"`
+	Key        string       `json:"key,omitempty"`
+	CreatedAt  timefmt.Time `json:"created_at"`
+}
+
+// errAPIKeyExists is returned when the customer already has an API key with the name
+var errAPIKeyExists = errors.New("api key already exists for customer")
+
+// Route: POST /admin/api-keys (Admin Only)
+// Issue an API key for a customer, or for one of its sites, limited to the given scopes. The key is
+// only returned in this response.
+func APIKeyCreate(c *gin.Context) {
+	var body APIKeyRequest
+	if err := c.BindJSON(&body); err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", "Invalid JSON format")
+		return
+	}
+
+	body.Name = strings.TrimSpace(body.Name)
+	if body.CustomerID == uuid.Nil || body.Name == "" || len(body.Scopes) == 0 {
+		serverutils.WriteError(c, 400, "Invalid request body", "customer_id, name and scopes fields are required")
+		return
+	}
+
+	var scopes []string
+	for _, scope := range body.Scopes {
+		scope = strings.TrimSpace(scope)
+		if !serverutils.IsValidScope(scope) {
+			serverutils.WriteError(c, 400, "Invalid request body", "Unknown scope "+scope+", expected one of "+strings.Join(serverutils.Scopes(), ", "))
+			return
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var apiKey models.APIKey
+	var key string
+	err := bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		if body.SiteID != nil {
+			if _, err := fetchRegistrationSite(tx, body.CustomerID, *body.SiteID); err != nil {
+				return err
+			}
+		} else if _, err := fetchAttachableCustomer(&devicesdb.BMS_DB{DB: tx}, body.CustomerID.String()); err != nil {
+			return err
+		}
+
+		var existing int64
+		if err := tx.Model(&models.APIKey{}).Where("customer_id = ? AND name = ?", body.CustomerID, body.Name).
+			Count(&existing).Error; err != nil {
+			return err
+		}
+		if existing > 0 {
+			return errAPIKeyExists
+		}
+
+		apiKey = models.APIKey{
+			CustomerID: body.CustomerID,
+			SiteID:     body.SiteID,
+			Name:       body.Name,
+			Scopes:     strings.Join(scopes, ","),
+		}
+		var err error
+		if key, err = newAPIKey(&apiKey); err != nil {
+			return err
+		}
+		return tx.Create(&apiKey).Error
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		serverutils.WriteError(c, 404, "Customer or site not found", "No customer or site found with the given ID")
+		return
+	case errors.Is(err, errSiteOtherCustomer):
+		serverutils.WriteError(c, 403, "Forbidden", "There is no site with the given ID for the given customer")
+		return
+	case errors.Is(err, errAPIKeyExists):
+		serverutils.WriteError(c, 409, "API key already exists", "The customer already has an API key with this name")
+		return
+	case err != nil:
+		writeAttachError(c, err, "Failed to create API key")
+		return
+	}
+
+	writeIssuedAPIKey(c, apiKey, key, 201, "API key created")
+}
+
+// Route: GET /admin/customers/:customer_id/api-keys (Admin Only)
+// Fetch the API keys of a customer, without the keys themselves
+func APIKeyFetchByCustomerID(c *gin.Context) {
+	customerID := c.Param("customer_id")
+	if !serverutils.IsValidUUID(customerID) {
+		serverutils.WriteError(c, 400, "Invalid customer ID", "Invalid UUID format")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var apiKeys []models.APIKey
+	if err := bmsDB.DB.Where("customer_id = ?", customerID).Order("name").Find(&apiKeys).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch API keys", err.Error())
+		return
+	}
+
+	response := make([]APIKeyResponse, len(apiKeys))
+	for i, apiKey := range apiKeys {
+		response[i] = newAPIKeyResponse(apiKey)
+	}
+	serverutils.WriteJSON(c, 200, "API keys fetched", response)
+}
+
+// Route: POST /admin/api-keys/:key_id/rotate (Admin Only)
+// Replace an API key with a new one with the same scopes. The old key is rejected from then on, and
+// the new key is only returned in this response.
+func APIKeyRotate(c *gin.Context) {
+	keyID, err := uuid.Parse(c.Param("key_id"))
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid API key ID", "Invalid UUID format")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var apiKey models.APIKey
+	var key string
+	err = bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&apiKey, "id = ?", keyID).Error; err != nil {
+			return err
+		}
+
+		var err error
+		if key, err = newAPIKey(&apiKey); err != nil {
+			return err
+		}
+		return tx.Model(&apiKey).Updates(map[string]any{"key_hash": apiKey.KeyHash, "prefix": apiKey.Prefix}).Error
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		serverutils.WriteError(c, 404, "API key not found", "No API key found with the given ID")
+		return
+	case err != nil:
+		serverutils.WriteError(c, 500, "Failed to rotate API key", err.Error())
+		return
+	}
+
+	writeIssuedAPIKey(c, apiKey, key, 200, "API key rotated")
+}
+
+// Route: DELETE /admin/api-keys/:key_id (Admin Only)
+// Revoke an API key, which is rejected from then on
+func APIKeyRevoke(c *gin.Context) {
+	keyID, err := uuid.Parse(c.Param("key_id"))
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid API key ID", "Invalid UUID format")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	// Revoked keys are deleted permanently so their name can be reused for the customer
+	result := bmsDB.DB.Unscoped().Where("id = ?", keyID).Delete(&models.APIKey{})
+	if result.Error != nil {
+		serverutils.WriteError(c, 500, "Failed to revoke API key", result.Error.Error())
+		return
+	}
+	if result.RowsAffected == 0 {
+		serverutils.WriteError(c, 404, "API key not found", "No API key found with the given ID")
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "API key revoked", nil)
+}
+
+// =====================================================================================================================
+
+// FetchAPIKey fetches the API key a request authenticates with. Revoked keys are not found.
+func FetchAPIKey(bmsDB *devicesdb.BMS_DB, key string) (models.APIKey, error) {
+	var apiKey models.APIKey
+	err := bmsDB.DB.First(&apiKey, "key_hash = ?", hashSecret(key)).Error
+	return apiKey, err
+}
+
+// APIKeyScopes returns the scopes the API key is granted
+func APIKeyScopes(apiKey models.APIKey) []string {
+	if apiKey.Scopes == "" {
+		return nil
+	}
+	return strings.Split(apiKey.Scopes, ",")
+}
+
+// newAPIKey generates a new key for the API key, setting its hash and prefix, and returns the key
+func newAPIKey(apiKey *models.APIKey) (string, error) {
+	secret, err := generateSecret()
+	if err != nil {
+		return "", err
+	}
+
+	key := apiKeyPrefix + secret
+	apiKey.KeyHash = hashSecret(key)
+	apiKey.Prefix = key[:len(apiKeyPrefix)+8]
+	return key, nil
+}
+
+// newAPIKeyResponse builds the response for an API key, without the key itself
+func newAPIKeyResponse(apiKey models.APIKey) APIKeyResponse {
+	return APIKeyResponse{
+		ID:         apiKey.ID,
+		CustomerID: apiKey.CustomerID,
+		SiteID:     apiKey.SiteID,
+		Name:       apiKey.Name,
+		Scopes:     APIKeyScopes(apiKey),
+		Prefix:     apiKey.Prefix,
+		CreatedAt:  timefmt.New(apiKey.CreatedAt),
+	}
+}
+
+// writeIssuedAPIKey audits the issue of the API key and writes it with the key
+func writeIssuedAPIKey(c *gin.Context, apiKey models.APIKey, key string, status int, message string) {
+	audit.Record(audit.Event{
+		Name:       audit.EventTokenIssued,
+		Outcome:    audit.OutcomeSuccess,
+		Reason:     serverutils.APIKeyAction,
+		Subject:    apiKey.CustomerID.String(),
+		RemoteAddr: c.ClientIP(),
+		Method:     c.Request.Method,
+		Path:       c.FullPath(),
+	})
+
+	response := newAPIKeyResponse(apiKey)
+	response.Key = key
+	serverutils.WriteJSON(c, status, message, response)
+}
@@ -1,60 +1,219 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/johandrevandeventer/devices-api-server/internal/audit"
+	"github.com/johandrevandeventer/devices-api-server/internal/config"
+	"github.com/johandrevandeventer/devices-api-server/internal/contracts"
+	"github.com/johandrevandeventer/devices-api-server/internal/metrics"
 	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
-	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
 	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+type AuthenticateRequest struct {
+	Token string `json:"token"`
+}
+
 // Route: Authenticate
 // Authenticate a user from the request body using JWT
 func AuthenticateHandler(c *gin.Context) {
 	// Get data off request body
-	var body struct {
-		Token string `json:"token"`
-	}
+	var body AuthenticateRequest
 	if err := c.BindJSON(&body); err != nil {
+		metrics.AuthenticationFailed("invalid_body")
+		audit.RecordRequest(c, audit.EventAuthentication, audit.OutcomeFailure, "invalid_body")
 		serverutils.WriteError(c, http.StatusBadRequest, "Invalid request body", err.Error())
 		return
 	}
 
 	// Validate the token field
 	if body.Token == "" {
+		metrics.AuthenticationFailed("missing_token")
+		audit.RecordRequest(c, audit.EventAuthentication, audit.OutcomeFailure, "missing_token")
 		serverutils.WriteError(c, http.StatusBadRequest, "Invalid request body", "Token field is required")
 		return
 	}
 
 	// Validate the JWT token
 	claims, err := serverutils.ValidateJWT(body.Token)
-	if err != nil {
+	if serverutils.IsTokenExpired(err) {
+		metrics.AuthenticationFailed("token_expired")
+		audit.RecordRequest(c, audit.EventAuthentication, audit.OutcomeFailure, "token_expired")
+		serverutils.WriteError(c, http.StatusUnauthorized, "Invalid token", "Token has expired, refresh it at /token/refresh")
+		return
+	} else if err != nil {
+		metrics.AuthenticationFailed("invalid_token")
+		audit.RecordRequest(c, audit.EventAuthentication, audit.OutcomeFailure, "invalid_token")
 		serverutils.WriteError(c, http.StatusUnauthorized, "Invalid token", err.Error())
 		return
 	}
 
 	// Get database instance
-	bmsDB, err := devicesdb.GetDB()
+	bmsDB, err := serverutils.RequestDB(c)
 	if err != nil {
+		metrics.AuthenticationFailed("database_error")
+		audit.RecordRequest(c, audit.EventAuthentication, audit.OutcomeFailure, "database_error")
 		serverutils.WriteError(c, http.StatusInternalServerError, "Failed to get database instance", err.Error())
 		return
 	}
 
 	role := claims["role"].(string)
-	if role != "admin" {
+	impersonatedBy, _ := claims["impersonated_by"].(string)
+	if impersonatedBy != "" {
+		// Impersonation tokens are not stored, so only their signature and short expiry admit them
+		if !IsImpersonationToken(claims) {
+			metrics.AuthenticationFailed("invalid_token")
+			audit.RecordRequest(c, audit.EventAuthentication, audit.OutcomeFailure, "invalid_token")
+			serverutils.WriteError(c, http.StatusUnauthorized, "Invalid token", "Invalid impersonation token")
+			return
+		}
+		c.Set("customer_id", claims["user_id"])
+		c.Set("impersonated_by", impersonatedBy)
+	} else if role != "admin" {
 		// See if the token exists in the database
 		var token models.AuthToken
 		bmsDB.DB.First(&token, "token = ?", body.Token)
 		if token.Token == "" {
+			metrics.AuthenticationFailed("token_not_found")
+			audit.RecordRequest(c, audit.EventAuthentication, audit.OutcomeFailure, "token_not_found")
 			serverutils.WriteError(c, http.StatusUnauthorized, "Invalid token", "Token not found")
 			return
 		}
+
+		if reason := TokenBindingMismatch(c, token); reason != "" {
+			metrics.AuthenticationFailed(reason)
+			audit.RecordRequest(c, audit.EventAuthentication, audit.OutcomeFailure, reason)
+			serverutils.WriteError(c, http.StatusUnauthorized, "Invalid token", "Token is not valid from this client")
+			return
+		}
+
+		if contracts.IsSuspended(token.CustomerID.String()) {
+			metrics.AuthenticationFailed("contract_suspended")
+			audit.RecordRequest(c, audit.EventAuthentication, audit.OutcomeFailure, "contract_suspended")
+			serverutils.WriteError(c, http.StatusForbidden, "Forbidden", "Customer contract has expired")
+			return
+		}
 	}
 
 	// Set the claims to the cookie
 	c.SetSameSite(http.SameSiteLaxMode)
-	c.SetCookie("Authorization", body.Token, 3600*24, "", "", false, true)
+	c.SetCookie("Authorization", body.Token, 3600*24, "", "", config.GetProfile().SecureCookies, true)
 
+	metrics.AuthenticationSucceeded()
+	audit.RecordRequest(c, audit.EventAuthentication, audit.OutcomeSuccess, "")
 	serverutils.WriteJSON(c, http.StatusOK, "Token validated", nil)
 }
+
+type TokenRefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Route: POST /token/refresh
+// Exchange the refresh token issued with a customer or site token for a new token and refresh token.
+// Each refresh token can be exchanged once, and the new token keeps the scope and binding of the old.
+func TokenRefreshHandler(c *gin.Context) {
+	// Get data off request body
+	var body TokenRefreshRequest
+	if err := c.BindJSON(&body); err != nil {
+		audit.RecordRequest(c, audit.EventTokenRefreshed, audit.OutcomeFailure, "invalid_body")
+		serverutils.WriteError(c, http.StatusBadRequest, "Invalid request body", err.Error())
+		return
+	}
+
+	// Validate the refresh_token field
+	if body.RefreshToken == "" {
+		audit.RecordRequest(c, audit.EventTokenRefreshed, audit.OutcomeFailure, "missing_token")
+		serverutils.WriteError(c, http.StatusBadRequest, "Invalid request body", "Refresh token field is required")
+		return
+	}
+
+	// Get database instance
+	bmsDB, err := serverutils.RequestDB(c)
+	if err != nil {
+		audit.RecordRequest(c, audit.EventTokenRefreshed, audit.OutcomeFailure, "database_error")
+		serverutils.WriteError(c, http.StatusInternalServerError, "Failed to get database instance", err.Error())
+		return
+	}
+
+	hash := hashSecret(body.RefreshToken)
+	var token models.AuthToken
+	if err := bmsDB.DB.First(&token, "refresh_token_hash = ?", hash).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		audit.RecordRequest(c, audit.EventTokenRefreshed, audit.OutcomeFailure, "token_not_found")
+		serverutils.WriteError(c, http.StatusUnauthorized, "Invalid refresh token", "Refresh token not found")
+		return
+	} else if err != nil {
+		audit.RecordRequest(c, audit.EventTokenRefreshed, audit.OutcomeFailure, "database_error")
+		serverutils.WriteError(c, http.StatusInternalServerError, "Failed to fetch token", err.Error())
+		return
+	}
+
+	if token.RefreshExpiresAt != nil && !time.Now().Before(*token.RefreshExpiresAt) {
+		audit.RecordRequest(c, audit.EventTokenRefreshed, audit.OutcomeFailure, "token_expired")
+		serverutils.WriteError(c, http.StatusUnauthorized, "Invalid refresh token", "Refresh token has expired")
+		return
+	}
+
+	if reason := TokenBindingMismatch(c, token); reason != "" {
+		audit.RecordRequest(c, audit.EventTokenRefreshed, audit.OutcomeFailure, reason)
+		serverutils.WriteError(c, http.StatusUnauthorized, "Invalid refresh token", "Token is not valid from this client")
+		return
+	}
+
+	if contracts.IsSuspended(token.CustomerID.String()) {
+		audit.RecordRequest(c, audit.EventTokenRefreshed, audit.OutcomeFailure, "contract_suspended")
+		serverutils.WriteError(c, http.StatusForbidden, "Forbidden", "Customer contract has expired")
+		return
+	}
+
+	var issued models.AuthToken
+	err = bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		// Lock the token, so a refresh token sent by concurrent requests is only exchanged once
+		var locked models.AuthToken
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			First(&locked, "id = ? AND refresh_token_hash = ?", token.ID, hash).Error; err != nil {
+			return err
+		}
+
+		var customer models.Customer
+		if err := tx.First(&customer, "id = ?", locked.CustomerID).Error; err != nil {
+			return err
+		}
+
+		var err error
+		issued, err = storeToken(tx, customer, locked.SiteID, locked.Action, tokenBinding(locked))
+		return err
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		audit.RecordRequest(c, audit.EventTokenRefreshed, audit.OutcomeFailure, "token_not_found")
+		serverutils.WriteError(c, http.StatusUnauthorized, "Invalid refresh token", "Refresh token not found")
+		return
+	} else if err != nil {
+		audit.RecordRequest(c, audit.EventTokenRefreshed, audit.OutcomeFailure, "database_error")
+		serverutils.WriteError(c, http.StatusInternalServerError, "Failed to refresh token", err.Error())
+		return
+	}
+
+	authToken, err := loadIssuedToken(bmsDB, issued)
+	if err != nil {
+		serverutils.WriteError(c, http.StatusInternalServerError, "Failed to refresh token", err.Error())
+		return
+	}
+
+	audit.Record(audit.Event{
+		Name:       audit.EventTokenRefreshed,
+		Outcome:    audit.OutcomeSuccess,
+		Reason:     authToken.Action,
+		Subject:    authToken.CustomerID.String(),
+		RemoteAddr: c.ClientIP(),
+		Method:     c.Request.Method,
+		Path:       c.FullPath(),
+	})
+
+	serverutils.WriteJSON(c, http.StatusOK, "Token refreshed", authToken)
+}
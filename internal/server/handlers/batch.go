@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+)
+
+// maxBatchGet is the largest number of records fetched in one batch request
+const maxBatchGet = 200
+
+type BatchGetRequest struct {
+	IDs []string `json:"ids"`
+}
+
+type DeviceBatchGetRequest struct {
+	CustomerID    string   `json:"customer_id"`
+	SerialNumbers []string `json:"serial_numbers"`
+}
+
+type DeviceBatchGetResponse struct {
+	Found     map[string]DeviceResponse `json:"found"`
+	NotFound  []string                  `json:"not_found"`
+	Ambiguous []string                  `json:"ambiguous"`
+}
+
+type SiteBatchGetResponse struct {
+	Found    map[string]SiteResponse `json:"found"`
+	NotFound []string                `json:"not_found"`
+}
+
+type CustomerBatchGetResponse struct {
+	Found    map[string]CustomerResponse `json:"found"`
+	NotFound []string                    `json:"not_found"`
+}
+
+// Route: POST /devices/batch-get
+// Fetch the devices with the given serial numbers in one request. Serial numbers shared by several
+// customers are reported as ambiguous unless customer_id narrows them to one customer.
+func DeviceBatchGet(c *gin.Context) {
+	role := c.GetString("role")
+	requesterID := c.GetString("customer_id")
+
+	var body DeviceBatchGetRequest
+	if err := c.BindJSON(&body); err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", err.Error())
+		return
+	}
+	serialNumbers, ok := parseBatchGet(c, body.SerialNumbers, "serial_numbers", false)
+	if !ok {
+		return
+	}
+
+	if body.CustomerID != "" && !serverutils.IsValidUUID(body.CustomerID) {
+		serverutils.WriteError(c, 400, "Invalid customer ID", "Invalid UUID format")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	// Devices of other customers are not found rather than forbidden
+	query := DeviceListQuery(bmsDB).Where("devices.device_serial_number IN ?", serialNumbers)
+	if role != "admin" {
+		query = query.Where("customers.id = ?", requesterID)
+	} else if body.CustomerID != "" {
+		query = query.Where("customers.id = ?", body.CustomerID)
+	}
+
+	var devices []DeviceResponse
+	if err := query.Scan(&devices).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch devices", err.Error())
+		return
+	}
+	maskDeviceTokens(devices)
+
+	response := DeviceBatchGetResponse{Found: make(map[string]DeviceResponse, len(devices)), NotFound: []string{}, Ambiguous: []string{}}
+	matches := make(map[string]int, len(devices))
+	for _, device := range devices {
+		matches[device.DeviceSerialNumber]++
+		response.Found[device.DeviceSerialNumber] = device
+	}
+	for _, serialNumber := range serialNumbers {
+		switch matches[serialNumber] {
+		case 0:
+			response.NotFound = append(response.NotFound, serialNumber)
+		case 1:
+		default:
+			delete(response.Found, serialNumber)
+			response.Ambiguous = append(response.Ambiguous, serialNumber)
+		}
+	}
+
+	if omitsDeviceTokens(c) {
+		for serialNumber, device := range response.Found {
+			device.AuthToken = ""
+			response.Found[serialNumber] = device
+		}
+	}
+
+	serverutils.WriteJSON(c, 200, "Devices fetched", response)
+}
+
+// Route: POST /sites/batch-get
+// Fetch the sites with the given IDs in one request
+func SiteBatchGet(c *gin.Context) {
+	role := c.GetString("role")
+	requesterID := c.GetString("customer_id")
+
+	var body BatchGetRequest
+	if err := c.BindJSON(&body); err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", err.Error())
+		return
+	}
+	ids, ok := parseBatchGet(c, body.IDs, "ids", true)
+	if !ok {
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	// Sites of other customers are not found rather than forbidden
+	query := SiteListQuery(bmsDB).Where("sites.id IN ?", ids)
+	if role != "admin" {
+		query = query.Where("customers.id = ?", requesterID)
+	}
+
+	var sites []SiteResponse
+	if err := query.Scan(&sites).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch sites", err.Error())
+		return
+	}
+
+	response := SiteBatchGetResponse{Found: make(map[string]SiteResponse, len(sites)), NotFound: []string{}}
+	for _, site := range sites {
+		response.Found[site.ID.String()] = site
+	}
+	for _, id := range ids {
+		if _, ok := response.Found[id]; !ok {
+			response.NotFound = append(response.NotFound, id)
+		}
+	}
+
+	serverutils.WriteJSON(c, 200, "Sites fetched", response)
+}
+
+// Route: POST /customers/batch-get
+// Fetch the customers with the given IDs in one request. Customers only find themselves.
+func CustomerBatchGet(c *gin.Context) {
+	role := c.GetString("role")
+	requesterID := c.GetString("customer_id")
+
+	var body BatchGetRequest
+	if err := c.BindJSON(&body); err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", err.Error())
+		return
+	}
+	ids, ok := parseBatchGet(c, body.IDs, "ids", true)
+	if !ok {
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	query := bmsDB.DB.Where("id IN ?", ids)
+	if role != "admin" {
+		query = query.Where("id = ?", requesterID)
+	}
+
+	var customers []models.Customer
+	if err := query.Find(&customers).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch customers", err.Error())
+		return
+	}
+
+	response := CustomerBatchGetResponse{Found: make(map[string]CustomerResponse, len(customers)), NotFound: []string{}}
+	for _, customer := range customers {
+		response.Found[customer.ID.String()] = newCustomerResponse(customer)
+	}
+	for _, id := range ids {
+		if _, ok := response.Found[id]; !ok {
+			response.NotFound = append(response.NotFound, id)
+		}
+	}
+
+	serverutils.WriteJSON(c, 200, "Customers fetched", response)
+}
+
+// =====================================================================================================================
+
+// parseBatchGet validates the keys of a batch request, returning them without duplicates in request
+// order. UUID keys are normalised so they match the IDs reported back.
+func parseBatchGet(c *gin.Context, keys []string, field string, uuids bool) ([]string, bool) {
+	if len(keys) == 0 || len(keys) > maxBatchGet {
+		serverutils.WriteError(c, 400, "Invalid request body", fmt.Sprintf("%s must list between 1 and %d entries", field, maxBatchGet))
+		return nil, false
+	}
+
+	unique := make([]string, 0, len(keys))
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if uuids {
+			id, err := uuid.Parse(key)
+			if err != nil {
+				serverutils.WriteError(c, 400, "Invalid request body", fmt.Sprintf("%s is not a valid UUID", key))
+				return nil, false
+			}
+			key = id.String()
+		}
+
+		if !seen[key] {
+			seen[key] = true
+			unique = append(unique, key)
+		}
+	}
+
+	return unique, true
+}
@@ -0,0 +1,174 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/internal/timefmt"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"gorm.io/gorm"
+)
+
+// billingMonthLayout is the layout of the month query parameter
+const billingMonthLayout = "2006-01"
+
+type BillingDeviceUsage struct {
+	DeviceSerialNumber string `json:"device_serial_number"`
+	DeviceName         string `json:"device_name"`
+	SiteName           string `json:"site_name"`
+	ActiveDays         int    `json:"active_days"`
+	UptimeMinutes      int    `json:"uptime_minutes"`
+}
+
+type BillingReportResponse struct {
+	CustomerID       string               `json:"customer_id"`
+	CustomerName     string               `json:"customer_name"`
+	Month            string               `json:"month"`
+	PeriodStart      timefmt.Time         `json:"period_start"`
+	PeriodEnd        timefmt.Time         `json:"period_end"`
+	ActiveDeviceDays int                  `json:"active_device_days"`
+	UptimeMinutes    int                  `json:"uptime_minutes"`
+	ApiRequests      int64                `json:"api_requests"`
+	Devices          []BillingDeviceUsage `json:"devices"`
+}
+
+// Route: GET /admin/customers/:customer_id/billing-report
+// Aggregate the active device-days and API usage of a customer for a month, as JSON or CSV (?format=csv)
+func BillingReport(c *gin.Context) {
+	customerID := c.Param("customer_id")
+	if !serverutils.IsValidUUID(customerID) {
+		serverutils.WriteError(c, 400, "Invalid customer ID", "Customer ID must be a valid UUID")
+		return
+	}
+
+	// Default to the previous month, which is the one being invoiced
+	month := c.Query("month")
+	if month == "" {
+		month = time.Now().UTC().AddDate(0, -1, 0).Format(billingMonthLayout)
+	}
+
+	periodStart, err := time.Parse(billingMonthLayout, month)
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid month", "Month must be formatted as YYYY-MM")
+		return
+	}
+	periodEnd := periodStart.AddDate(0, 1, 0)
+
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		serverutils.WriteError(c, 400, "Invalid format", "Format must be json or csv")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var customer models.Customer
+	if err := bmsDB.DB.First(&customer, "id = ?", customerID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			serverutils.WriteError(c, 404, "Customer not found", "Customer does not exist")
+			return
+		}
+		serverutils.WriteError(c, 500, "Failed to fetch customer", err.Error())
+		return
+	}
+
+	// Devices and sites deleted during the month are still billed for the days they were active
+	var devices []BillingDeviceUsage
+	err = bmsDB.DB.Table("device_uptime_rollups").
+		Select(`devices.device_serial_number, devices.device_name, sites.name AS site_name,
+			SUM(CASE WHEN device_uptime_rollups.uptime_minutes > 0 THEN 1 ELSE 0 END) AS active_days,
+			SUM(device_uptime_rollups.uptime_minutes) AS uptime_minutes`).
+		Joins("JOIN devices ON devices.id = device_uptime_rollups.device_id").
+		Joins("JOIN sites ON sites.id = devices.site_id").
+		Where("sites.customer_id = ?", customer.ID).
+		Where("device_uptime_rollups.day >= ? AND device_uptime_rollups.day < ?", periodStart, periodEnd).
+		Where("device_uptime_rollups.deleted_at IS NULL").
+		Group("devices.id, devices.device_serial_number, devices.device_name, sites.name").
+		Order("devices.device_serial_number").
+		Scan(&devices).Error
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch device usage", err.Error())
+		return
+	}
+
+	var apiRequests int64
+	err = bmsDB.DB.Model(&models.CustomerApiUsage{}).
+		Select("COALESCE(SUM(requests), 0)").
+		Where("customer_id = ? AND day >= ? AND day < ?", customer.ID, periodStart, periodEnd).
+		Scan(&apiRequests).Error
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch API usage", err.Error())
+		return
+	}
+
+	response := BillingReportResponse{
+		CustomerID:   customer.ID.String(),
+		CustomerName: customer.Name,
+		Month:        month,
+		PeriodStart:  timefmt.New(periodStart),
+		PeriodEnd:    timefmt.New(periodEnd),
+		ApiRequests:  apiRequests,
+		Devices:      devices,
+	}
+
+	for _, device := range devices {
+		response.ActiveDeviceDays += device.ActiveDays
+		response.UptimeMinutes += device.UptimeMinutes
+	}
+
+	if format == "csv" {
+		writeBillingReportCSV(c, response)
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Billing report generated", response)
+}
+
+// =====================================================================================================================
+
+// writeBillingReportCSV writes one row per device followed by a TOTAL row carrying the API usage
+func writeBillingReportCSV(c *gin.Context, report BillingReportResponse) {
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="billing-%s-%s.csv"`, report.CustomerID, report.Month))
+	c.Status(200)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"customer_id", "customer_name", "month", "device_serial_number", "device_name", "site_name", "active_days", "uptime_minutes", "api_requests"})
+
+	for _, device := range report.Devices {
+		w.Write([]string{
+			report.CustomerID,
+			report.CustomerName,
+			report.Month,
+			device.DeviceSerialNumber,
+			device.DeviceName,
+			device.SiteName,
+			strconv.Itoa(device.ActiveDays),
+			strconv.Itoa(device.UptimeMinutes),
+			"",
+		})
+	}
+
+	w.Write([]string{
+		report.CustomerID,
+		report.CustomerName,
+		report.Month,
+		"TOTAL",
+		"",
+		"",
+		strconv.Itoa(report.ActiveDeviceDays),
+		strconv.Itoa(report.UptimeMinutes),
+		strconv.FormatInt(report.ApiRequests, 10),
+	})
+
+	w.Flush()
+}
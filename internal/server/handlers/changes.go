@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/changes"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+)
+
+// defaultPollTimeout is how long a poll waits for changes when no timeout is given
+const defaultPollTimeout = 30 * time.Second
+
+// maxPollTimeout is the longest a poll may wait for changes
+const maxPollTimeout = 60 * time.Second
+
+// DeviceChangesResponse lists the current devices of every site whose devices changed since the
+// cursor, replacing what the client holds for those sites. On a reset the changes are not known
+// and the client must fetch its devices again.
+type DeviceChangesResponse struct {
+	Cursor uint64              `json:"cursor"`
+	Reset  bool                `json:"reset"`
+	Sites  []SiteDeviceChanges `json:"sites"`
+}
+
+type SiteDeviceChanges struct {
+	SiteID  uuid.UUID        `json:"site_id"`
+	Devices []DeviceResponse `json:"devices"`
+}
+
+// Route: GET /devices/changes/poll
+// Wait up to ?timeout= (30s by default) for changes to the devices the requester can see after the
+// ?since= cursor of the previous poll. Without a cursor the current one is returned straight away
+// along with a reset.
+func DeviceChangesPoll(c *gin.Context) {
+	timeout := defaultPollTimeout
+	if value := c.Query("timeout"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 || parsed > maxPollTimeout {
+			serverutils.WriteError(c, 400, "Invalid timeout", fmt.Sprintf("Timeout must be a duration of at most %s", maxPollTimeout))
+			return
+		}
+		timeout = parsed
+	}
+
+	value := c.Query("since")
+	if value == "" {
+		serverutils.WriteJSON(c, 200, "Device changes fetched", DeviceChangesResponse{Cursor: changes.Cursor(), Reset: true, Sites: []SiteDeviceChanges{}})
+		return
+	}
+	cursor, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid cursor", "Since must be the cursor of a previous poll")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+	defer cancel()
+
+	// Changes to sites the requester cannot see are skipped without answering the poll
+	for {
+		next, siteIDs, reset := changes.Wait(ctx, cursor)
+		if reset {
+			serverutils.WriteJSON(c, 200, "Device changes fetched", DeviceChangesResponse{Cursor: next, Reset: true, Sites: []SiteDeviceChanges{}})
+			return
+		}
+		cursor = next
+
+		visible, err := visibleSites(c, bmsDB, siteIDs)
+		if err != nil {
+			serverutils.WriteError(c, 500, "Failed to fetch sites", err.Error())
+			return
+		}
+
+		if len(visible) > 0 || ctx.Err() != nil {
+			sites, err := siteDeviceChanges(bmsDB, visible)
+			if err != nil {
+				serverutils.WriteError(c, 500, "Failed to fetch devices", err.Error())
+				return
+			}
+
+			if omitsDeviceTokens(c) {
+				for _, site := range sites {
+					clearDeviceTokens(site.Devices)
+				}
+			}
+			serverutils.WriteJSON(c, 200, "Device changes fetched", DeviceChangesResponse{Cursor: cursor, Sites: sites})
+			return
+		}
+	}
+}
+
+// =====================================================================================================================
+
+// visibleSites returns the sites of the IDs the requester can see: every site for admins, their own
+// site for site tokens and the sites of their customer otherwise. Deleted sites are included so
+// their devices are removed.
+func visibleSites(c *gin.Context, bmsDB *devicesdb.BMS_DB, siteIDs []string) ([]uuid.UUID, error) {
+	if len(siteIDs) == 0 {
+		return nil, nil
+	}
+
+	if siteID := c.GetString("site_id"); siteID != "" {
+		for _, id := range siteIDs {
+			if id == siteID {
+				return []uuid.UUID{uuid.MustParse(id)}, nil
+			}
+		}
+		return nil, nil
+	}
+
+	if c.GetString("role") == "admin" {
+		visible := make([]uuid.UUID, 0, len(siteIDs))
+		for _, id := range siteIDs {
+			if parsed, err := uuid.Parse(id); err == nil {
+				visible = append(visible, parsed)
+			}
+		}
+		return visible, nil
+	}
+
+	var visible []uuid.UUID
+	err := bmsDB.DB.Unscoped().Model(&models.Site{}).
+		Where("id IN ? AND customer_id = ?", siteIDs, c.GetString("customer_id")).
+		Pluck("id", &visible).Error
+	return visible, err
+}
+
+// siteDeviceChanges returns the current devices of the sites
+func siteDeviceChanges(bmsDB *devicesdb.BMS_DB, siteIDs []uuid.UUID) ([]SiteDeviceChanges, error) {
+	sites := make([]SiteDeviceChanges, len(siteIDs))
+	if len(siteIDs) == 0 {
+		return sites, nil
+	}
+
+	var devices []DeviceResponse
+	if err := DeviceListQuery(bmsDB).Where("devices.site_id IN ?", siteIDs).Scan(&devices).Error; err != nil {
+		return nil, err
+	}
+	maskDeviceTokens(devices)
+
+	index := make(map[uuid.UUID]int, len(siteIDs))
+	for i, siteID := range siteIDs {
+		index[siteID] = i
+		sites[i] = SiteDeviceChanges{SiteID: siteID, Devices: []DeviceResponse{}}
+	}
+	for _, device := range devices {
+		if i, ok := index[device.SiteID]; ok {
+			sites[i].Devices = append(sites[i].Devices, device)
+		}
+	}
+
+	return sites, nil
+}
@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/audit"
+	"github.com/johandrevandeventer/devices-api-server/internal/changes"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"gorm.io/gorm"
+)
+
+// maxNameLength is the length of the customer and site name columns
+const maxNameLength = 36
+
+// clonePrefixRegex matches the prefixes cloned identifiers can be given
+var clonePrefixRegex = regexp.MustCompile(`^[A-Za-z0-9_-]{1,16}$`)
+
+type CloneCustomerRequest struct {
+	SourceCustomerID string `json:"source_customer_id"`
+	Name             string `json:"name"`
+	Prefix           string `json:"prefix"`
+}
+
+type CloneCustomerResponse struct {
+	Customer CustomerResponse  `json:"customer"`
+	Prefix   string            `json:"prefix"`
+	Sites    map[string]string `json:"sites"`
+	Devices  map[string]string `json:"devices"`
+}
+
+// Route: POST /admin/clone-customer
+// Copy the sites and devices of a customer into a new sandbox customer. Auth tokens are not copied.
+// Site names and the serial numbers, controller serial numbers and gateways of the devices are
+// prefixed so the sandbox never collides with, or shows up in lookups of, the source customer.
+func CloneCustomer(c *gin.Context) {
+	var body CloneCustomerRequest
+	if err := c.BindJSON(&body); err != nil || body.Name == "" {
+		serverutils.WriteError(c, 400, "Invalid request body", "source_customer_id and name fields are required")
+		return
+	}
+
+	if !serverutils.IsValidUUID(body.SourceCustomerID) {
+		serverutils.WriteError(c, 400, "Invalid request body", "Invalid source customer ID")
+		return
+	}
+
+	if len(body.Name) > maxNameLength {
+		serverutils.WriteError(c, 400, "Invalid request body", fmt.Sprintf("Name must be at most %d characters", maxNameLength))
+		return
+	}
+
+	if body.Prefix == "" {
+		body.Prefix = "sandbox-"
+	}
+	if !clonePrefixRegex.MatchString(body.Prefix) {
+		serverutils.WriteError(c, 400, "Invalid request body", "Prefix must be 1-16 letters, digits, '-' or '_'")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	source, err := FetchCustomerByID(bmsDB, body.SourceCustomerID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 404, "Customer not found", "No customer found with the given ID")
+		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch customer", err.Error())
+		return
+	}
+
+	var sites []models.Site
+	if err := bmsDB.DB.Where("customer_id = ?", source.ID).Order("name").Find(&sites).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch sites", err.Error())
+		return
+	}
+
+	for _, site := range sites {
+		if len(body.Prefix+site.Name) > maxNameLength {
+			serverutils.WriteError(c, 400, "Invalid request body",
+				fmt.Sprintf("Prefixed site name %s would exceed %d characters, use a shorter prefix", body.Prefix+site.Name, maxNameLength))
+			return
+		}
+	}
+
+	siteIDs := make([]uuid.UUID, len(sites))
+	for i, site := range sites {
+		siteIDs[i] = site.ID
+	}
+
+	var devices []models.Device
+	if len(siteIDs) > 0 {
+		if err := bmsDB.DB.Where("site_id IN ?", siteIDs).Order("device_serial_number").Find(&devices).Error; err != nil {
+			serverutils.WriteError(c, 500, "Failed to fetch devices", err.Error())
+			return
+		}
+	}
+
+	response := CloneCustomerResponse{
+		Prefix:  body.Prefix,
+		Sites:   make(map[string]string, len(sites)),
+		Devices: make(map[string]string, len(devices)),
+	}
+
+	var sandbox models.Customer
+	err = bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Unscoped().Model(&models.Customer{}).Where("name = ?", body.Name).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return errCloneNameTaken
+		}
+
+		sandbox = models.Customer{Name: body.Name}
+		if err := tx.Create(&sandbox).Error; err != nil {
+			return err
+		}
+
+		clonedSites := make(map[uuid.UUID]uuid.UUID, len(sites))
+		for _, site := range sites {
+			clone := models.Site{
+				Name:       body.Prefix + site.Name,
+				CustomerID: sandbox.ID,
+				Address:    site.Address,
+				Latitude:   site.Latitude,
+				Longitude:  site.Longitude,
+				Timezone:   site.Timezone,
+			}
+			if err := tx.Omit("Customer").Create(&clone).Error; err != nil {
+				return fmt.Errorf("site %s: %w", site.Name, err)
+			}
+			clonedSites[site.ID] = clone.ID
+			response.Sites[site.ID.String()] = clone.ID.String()
+		}
+
+		clonedDevices := make(map[uuid.UUID]uuid.UUID, len(devices))
+		for _, device := range devices {
+			clone := models.Device{
+				SiteID:                 clonedSites[device.SiteID],
+				CustomerID:             sandbox.ID,
+				Gateway:                body.Prefix + device.Gateway,
+				Controller:             device.Controller,
+				ControllerSerialNumber: body.Prefix + device.ControllerSerialNumber,
+				DeviceType:             device.DeviceType,
+				DeviceName:             device.DeviceName,
+				DeviceSerialNumber:     body.Prefix + device.DeviceSerialNumber,
+				BuildingURL:            device.BuildingURL,
+			}
+			if err := tx.Omit("Site").Create(&clone).Error; err != nil {
+				return fmt.Errorf("device %s: %w", device.DeviceSerialNumber, err)
+			}
+			clonedDevices[device.ID] = clone.ID
+			response.Devices[device.DeviceSerialNumber] = clone.DeviceSerialNumber
+		}
+
+		if len(clonedDevices) == 0 {
+			return nil
+		}
+		return cloneDeviceConfiguration(tx, body.Prefix, clonedDevices)
+	})
+	if errors.Is(err, errCloneNameTaken) {
+		serverutils.WriteError(c, 400, "Customer already exists", "A customer with this name already exists")
+		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to clone customer", err.Error())
+		return
+	}
+
+	audit.RecordRequest(c, audit.EventCustomerCloned, audit.OutcomeSuccess, source.ID.String()+" -> "+sandbox.ID.String())
+	serverutils.AfterCommit(c, func() {
+		for _, siteID := range response.Sites {
+			changes.RecordSite(siteID)
+		}
+	})
+
+	response.Customer = newCustomerResponse(sandbox)
+	serverutils.WriteJSON(c, 201, "Customer cloned", response)
+}
+
+// =====================================================================================================================
+
+// errCloneNameTaken is returned when the sandbox customer name is already in use
+var errCloneNameTaken = errors.New("customer name already exists")
+
+// cloneDeviceConfiguration copies the point addresses, meter constants, tags and dependencies of the
+// devices to their prefixed clones, given as a map of device IDs to the IDs of their clones.
+// Dependencies are only copied between cloned devices.
+func cloneDeviceConfiguration(tx *gorm.DB, prefix string, clonedDevices map[uuid.UUID]uuid.UUID) error {
+	ids := make([]uuid.UUID, 0, len(clonedDevices))
+	for id := range clonedDevices {
+		ids = append(ids, id)
+	}
+
+	var points []models.PointAddress
+	if err := tx.Where("device_id IN ?", ids).Find(&points).Error; err != nil {
+		return err
+	}
+	for _, point := range points {
+		point.Model, point.ID = gorm.Model{}, uuid.Nil
+		point.DeviceID = clonedDevices[point.DeviceID]
+		point.DeviceSerialNumber = prefix + point.DeviceSerialNumber
+		point.ControllerSerialNumber = prefix + point.ControllerSerialNumber
+		if err := tx.Create(&point).Error; err != nil {
+			return err
+		}
+	}
+
+	var meters []models.DeviceMeter
+	if err := tx.Where("device_id IN ?", ids).Find(&meters).Error; err != nil {
+		return err
+	}
+	for _, meter := range meters {
+		meter.Model, meter.ID = gorm.Model{}, uuid.Nil
+		meter.DeviceID = clonedDevices[meter.DeviceID]
+		meter.DeviceSerialNumber = prefix + meter.DeviceSerialNumber
+		if err := tx.Create(&meter).Error; err != nil {
+			return err
+		}
+	}
+
+	var tags []models.DeviceTag
+	if err := tx.Where("device_id IN ?", ids).Find(&tags).Error; err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		tag.ID = uuid.Nil
+		tag.DeviceID = clonedDevices[tag.DeviceID]
+		tag.DeviceSerialNumber = prefix + tag.DeviceSerialNumber
+		if err := tx.Create(&tag).Error; err != nil {
+			return err
+		}
+	}
+
+	var dependencies []models.DeviceDependency
+	if err := tx.Where("upstream_device_id IN ? AND downstream_device_id IN ?", ids, ids).
+		Find(&dependencies).Error; err != nil {
+		return err
+	}
+	for _, dependency := range dependencies {
+		dependency.Model, dependency.ID = gorm.Model{}, uuid.Nil
+		dependency.UpstreamDeviceID = clonedDevices[dependency.UpstreamDeviceID]
+		dependency.DownstreamDeviceID = clonedDevices[dependency.DownstreamDeviceID]
+		dependency.UpstreamSerialNumber = prefix + dependency.UpstreamSerialNumber
+		dependency.DownstreamSerialNumber = prefix + dependency.DownstreamSerialNumber
+		if err := tx.Create(&dependency).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,331 @@
+package handlers
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/cache"
+	"github.com/johandrevandeventer/devices-api-server/internal/changes"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/internal/timefmt"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"gorm.io/gorm"
+)
+
+type ControllerRequest struct {
+	ControllerType  string `json:"controller_type"`
+	SerialNumber    string `json:"serial_number"`
+	FirmwareVersion string `json:"firmware_version"`
+}
+
+type ControllerResponse struct {
+	ID              uuid.UUID    `json:"id"`
+	CustomerID      uuid.UUID    `json:"customer_id"`
+	SiteID          uuid.UUID    `json:"site_id"`
+	ControllerType  string       `json:"controller_type"`
+	SerialNumber    string       `json:"serial_number"`
+	FirmwareVersion string       `json:"firmware_version"`
+	Devices         int          `json:"devices"`
+	CreatedAt       timefmt.Time `json:"created_at"`
+}
+
+var (
+	// errControllerExists is returned when a site already has a controller with the serial number
+	errControllerExists = errors.New("controller already exists at site")
+
+	// errControllerHasDevices is returned when deleting a controller that live devices are wired to
+	errControllerHasDevices = errors.New("controller has devices")
+)
+
+// Route: GET /sites/:site_id/controllers
+// Fetch the controllers of a site with the number of devices wired to each
+func ControllerFetchBySiteID(c *gin.Context) {
+	site, bmsDB, ok := fetchReadableSite(c)
+	if !ok {
+		return
+	}
+
+	response := []ControllerResponse{}
+	if err := ControllerListQuery(bmsDB).Where("controllers.site_id = ?", site.ID).Scan(&response).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch controllers", err.Error())
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Controllers fetched", response)
+}
+
+// Route: GET /sites/:site_id/controllers/:controller_serial_number
+// Fetch a controller of a site by serial number
+func ControllerFetchBySerialNumber(c *gin.Context) {
+	site, bmsDB, ok := fetchReadableSite(c)
+	if !ok {
+		return
+	}
+
+	writeController(c, bmsDB, site.ID, c.Param("controller_serial_number"), 200, "Controller fetched")
+}
+
+// Route: POST /sites/:site_id/controllers (Admin Only)
+// Create a controller at a site. Devices of the site that already name the controller by serial
+// number are linked to it and take its type.
+func ControllerCreate(c *gin.Context) {
+	body, ok := bindControllerRequest(c)
+	if !ok {
+		return
+	}
+
+	siteID := c.Param("site_id")
+	if !serverutils.IsValidUUID(siteID) {
+		serverutils.WriteError(c, 400, "Invalid site ID", "Invalid UUID format")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var controller models.Controller
+	var linked int64
+	err := bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		site, err := fetchAttachableSite(&devicesdb.BMS_DB{DB: tx}, siteID)
+		if err != nil {
+			return err
+		}
+
+		var existing int64
+		if err := tx.Model(&models.Controller{}).Where("site_id = ? AND serial_number = ?", site.ID, body.SerialNumber).
+			Count(&existing).Error; err != nil {
+			return err
+		}
+		if existing > 0 {
+			return errControllerExists
+		}
+
+		controller = models.Controller{
+			CustomerID:      site.CustomerID,
+			SiteID:          site.ID,
+			SerialNumber:    body.SerialNumber,
+			ControllerType:  body.ControllerType,
+			FirmwareVersion: body.FirmwareVersion,
+		}
+		if err := tx.Create(&controller).Error; err != nil {
+			return err
+		}
+
+		// Deleted devices are linked too, so they come back wired to the controller when restored
+		result := tx.Unscoped().Model(&models.Device{}).
+			Where("site_id = ? AND controller_serial_number = ?", site.ID, controller.SerialNumber).
+			Updates(map[string]any{"controller_id": controller.ID, "controller": controller.ControllerType})
+		linked = result.RowsAffected
+		return result.Error
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		serverutils.WriteError(c, 404, "Site not found", "No site found with the given ID")
+		return
+	case errors.Is(err, errControllerExists):
+		serverutils.WriteError(c, 409, "Controller already exists", "The site already has a controller with this serial number")
+		return
+	case err != nil:
+		writeAttachError(c, err, "Failed to create controller")
+		return
+	}
+
+	if linked > 0 {
+		recordControllerChanges(c, controller.SiteID)
+	}
+
+	writeController(c, bmsDB, controller.SiteID, controller.SerialNumber, 201, "Controller created")
+}
+
+// Route: PUT /sites/:site_id/controllers/:controller_serial_number (Admin Only)
+// Replace the type, serial number and firmware version of a controller. The devices wired to the
+// controller take its new type and serial number.
+func ControllerUpdate(c *gin.Context) {
+	body, ok := bindControllerRequest(c)
+	if !ok {
+		return
+	}
+
+	siteID := c.Param("site_id")
+	if !serverutils.IsValidUUID(siteID) {
+		serverutils.WriteError(c, 400, "Invalid site ID", "Invalid UUID format")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var controller models.Controller
+	err := bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&controller, "site_id = ? AND serial_number = ?", siteID, c.Param("controller_serial_number")).Error; err != nil {
+			return err
+		}
+
+		if body.SerialNumber != controller.SerialNumber {
+			var existing int64
+			if err := tx.Model(&models.Controller{}).Where("site_id = ? AND serial_number = ?", controller.SiteID, body.SerialNumber).
+				Count(&existing).Error; err != nil {
+				return err
+			}
+			if existing > 0 {
+				return errControllerExists
+			}
+		}
+
+		controller.ControllerType = body.ControllerType
+		controller.SerialNumber = body.SerialNumber
+		controller.FirmwareVersion = body.FirmwareVersion
+		if err := tx.Save(&controller).Error; err != nil {
+			return err
+		}
+
+		return tx.Unscoped().Model(&models.Device{}).Where("controller_id = ?", controller.ID).
+			Updates(map[string]any{"controller": controller.ControllerType, "controller_serial_number": controller.SerialNumber}).Error
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		serverutils.WriteError(c, 404, "Controller not found", "No controller found at the site with the given serial number")
+		return
+	case errors.Is(err, errControllerExists):
+		serverutils.WriteError(c, 409, "Controller already exists", "The site already has a controller with this serial number")
+		return
+	case err != nil:
+		serverutils.WriteError(c, 500, "Failed to update controller", err.Error())
+		return
+	}
+
+	recordControllerChanges(c, controller.SiteID)
+
+	writeController(c, bmsDB, controller.SiteID, controller.SerialNumber, 200, "Controller updated")
+}
+
+// Route: DELETE /sites/:site_id/controllers/:controller_serial_number (Admin Only)
+// Delete a controller that no live device is wired to. Deleted devices wired to it are unlinked.
+func ControllerDelete(c *gin.Context) {
+	siteID := c.Param("site_id")
+	if !serverutils.IsValidUUID(siteID) {
+		serverutils.WriteError(c, 400, "Invalid site ID", "Invalid UUID format")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var controller models.Controller
+	err := bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&controller, "site_id = ? AND serial_number = ?", siteID, c.Param("controller_serial_number")).Error; err != nil {
+			return err
+		}
+
+		var devices int64
+		if err := tx.Model(&models.Device{}).Where("controller_id = ?", controller.ID).Count(&devices).Error; err != nil {
+			return err
+		}
+		if devices > 0 {
+			return errControllerHasDevices
+		}
+
+		if err := tx.Unscoped().Model(&models.Device{}).Where("controller_id = ?", controller.ID).
+			Update("controller_id", nil).Error; err != nil {
+			return err
+		}
+
+		// Controllers are deleted permanently so their serial number can be reused at the site
+		return tx.Unscoped().Delete(&controller).Error
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		serverutils.WriteError(c, 404, "Controller not found", "No controller found at the site with the given serial number")
+		return
+	case errors.Is(err, errControllerHasDevices):
+		serverutils.WriteError(c, 409, "Controller has devices", "Move or delete the devices wired to the controller first")
+		return
+	case err != nil:
+		serverutils.WriteError(c, 500, "Failed to delete controller", err.Error())
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Controller deleted", newControllerResponse(controller))
+}
+
+// =====================================================================================================================
+
+// ControllerListQuery selects controllers with the number of live devices wired to each
+func ControllerListQuery(bmsDB *devicesdb.BMS_DB) *gorm.DB {
+	return bmsDB.DB.Table("controllers").
+		Select("controllers.id, controllers.customer_id, controllers.site_id, controllers.controller_type, controllers.serial_number, controllers.firmware_version, controllers.created_at, COUNT(devices.id) AS devices").
+		Joins("LEFT JOIN devices ON devices.controller_id = controllers.id AND devices.deleted_at IS NULL").
+		Where("controllers.deleted_at IS NULL").
+		Group("controllers.id").
+		Order("controllers.serial_number")
+}
+
+// bindControllerRequest binds and trims the controller in the request body, writing the error
+// response and returning false when it is invalid
+func bindControllerRequest(c *gin.Context) (ControllerRequest, bool) {
+	var body ControllerRequest
+	if err := c.BindJSON(&body); err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", "Invalid JSON format")
+		return body, false
+	}
+
+	body.ControllerType = strings.TrimSpace(body.ControllerType)
+	body.SerialNumber = strings.TrimSpace(body.SerialNumber)
+	body.FirmwareVersion = strings.TrimSpace(body.FirmwareVersion)
+	if body.ControllerType == "" || body.SerialNumber == "" {
+		serverutils.WriteError(c, 400, "Invalid request body", "controller_type and serial_number fields are required")
+		return body, false
+	}
+	return body, true
+}
+
+// writeController writes the controller of the site with the serial number
+func writeController(c *gin.Context, bmsDB *devicesdb.BMS_DB, siteID uuid.UUID, serialNumber string, status int, message string) {
+	var response []ControllerResponse
+	if err := ControllerListQuery(bmsDB).
+		Where("controllers.site_id = ? AND controllers.serial_number = ?", siteID, serialNumber).
+		Scan(&response).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch controller", err.Error())
+		return
+	}
+	if len(response) == 0 {
+		serverutils.WriteError(c, 404, "Controller not found", "No controller found at the site with the given serial number")
+		return
+	}
+
+	serverutils.WriteJSON(c, status, message, response[0])
+}
+
+// newControllerResponse builds the response for a controller without devices
+func newControllerResponse(controller models.Controller) ControllerResponse {
+	return ControllerResponse{
+		ID:              controller.ID,
+		CustomerID:      controller.CustomerID,
+		SiteID:          controller.SiteID,
+		ControllerType:  controller.ControllerType,
+		SerialNumber:    controller.SerialNumber,
+		FirmwareVersion: controller.FirmwareVersion,
+		CreatedAt:       timefmt.New(controller.CreatedAt),
+	}
+}
+
+// recordControllerChanges invalidates the cached devices of the site after its devices took the
+// type or serial number of a controller, and records the change for pollers
+func recordControllerChanges(c *gin.Context, siteID uuid.UUID) {
+	serverutils.AfterCommit(c, func() {
+		cache.SiteDevices().Invalidate(siteID.String())
+		changes.RecordSite(siteID.String())
+	})
+}
@@ -3,23 +3,78 @@ package handlers
 import (
 	"errors"
 	"fmt"
+	"regexp"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/cache"
+	"github.com/johandrevandeventer/devices-api-server/internal/changes"
 	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/internal/timefmt"
 	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
 	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// contractDateLayout is the layout of the contract dates in requests
+const contractDateLayout = "2006-01-02"
+
+// externalRefRegex matches the external references customers can be given
+var externalRefRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]{0,63}$`)
+
 type CustomerResponse struct {
-	ID   uuid.UUID `json:"id"`
-	Name string    `json:"name"`
+	ID            uuid.UUID  `json:"id"`
+	Name          string     `json:"name"`
+	ContractStart *time.Time `json:"contract_start,omitempty"`
+	ContractEnd   *time.Time `json:"contract_end,omitempty"`
+	ExternalRef   *string    `json:"external_ref,omitempty"`
+}
+
+// CustomerDeleteResponse counts the sites, devices and tokens of the customer, which are deleted
+// along with it when cascading, or would be on a dry run
+type CustomerDeleteResponse struct {
+	CustomerID uuid.UUID `json:"customer_id"`
+	Cascade    bool      `json:"cascade"`
+	DryRun     bool      `json:"dry_run"`
+	Sites      int64     `json:"sites"`
+	Devices    int64     `json:"devices"`
+	Tokens     int64     `json:"tokens"`
+}
+
+type DeletedCustomerResponse struct {
+	CustomerResponse
+	DeletedAt timefmt.Time `json:"deleted_at"`
+}
+
+// CustomerRestoreResponse counts the sites and devices restored along with the customer
+type CustomerRestoreResponse struct {
+	Customer CustomerResponse `json:"customer"`
+	Cascade  bool             `json:"cascade"`
+	Sites    int64            `json:"sites"`
+	Devices  int64            `json:"devices"`
 }
 
+// errCustomerNotDeleted is returned when restoring a customer that has not been deleted
+var errCustomerNotDeleted = errors.New("customer is not deleted")
+
 type CustomerRequest struct {
-	Name string `json:"name"`
+	Name          string  `json:"name"`
+	ContractStart *string `json:"contract_start"`
+	ContractEnd   *string `json:"contract_end"`
+	ExternalRef   *string `json:"external_ref"`
+}
+
+// CustomerPatchRequest changes the given fields of a customer, leaving the others unchanged. An empty
+// contract date or external reference clears it.
+type CustomerPatchRequest struct {
+	Name          *string `json:"name"`
+	ContractStart *string `json:"contract_start"`
+	ContractEnd   *string `json:"contract_end"`
+	ExternalRef   *string `json:"external_ref"`
 }
 
 // Create a new customer or restore a soft-deleted one
@@ -31,6 +86,18 @@ func CustomerCreate(c *gin.Context) {
 		return
 	}
 
+	contractStart, contractEnd, err := parseContractDates(body)
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", err.Error())
+		return
+	}
+
+	externalRef, err := parseExternalRef(body.ExternalRef)
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", err.Error())
+		return
+	}
+
 	bmsDB, ok := serverutils.GetDBInstance(c)
 	if !ok {
 		return
@@ -42,59 +109,98 @@ func CustomerCreate(c *gin.Context) {
 		return
 	}
 
+	if customer != nil && !customer.DeletedAt.Valid {
+		serverutils.WriteError(c, 400, "Customer already exists", "A customer with this name already exists")
+		return
+	}
+
+	if externalRef != nil {
+		excludeID := uuid.Nil
+		if customer != nil {
+			excludeID = customer.ID
+		}
+		if !checkExternalRefFree(c, bmsDB, *externalRef, excludeID) {
+			return
+		}
+	}
+
 	if customer == nil {
 		// Create new customer
-		newCustomer := models.Customer{Name: body.Name}
+		newCustomer := models.Customer{Name: body.Name, ContractStart: contractStart, ContractEnd: contractEnd, ExternalRef: externalRef}
 		if err := bmsDB.DB.Create(&newCustomer).Error; err != nil {
 			serverutils.WriteError(c, 500, "Failed to create customer", err.Error())
 			return
 		}
-		serverutils.WriteJSON(c, 201, "Customer created", CustomerResponse{ID: newCustomer.ID, Name: newCustomer.Name})
+		serverutils.WriteJSON(c, 201, "Customer created", newCustomerResponse(newCustomer))
 		return
 	}
 
 	// Restore soft-deleted customer
-	if customer.DeletedAt.Valid {
-		now := time.Now()
-		customer.DeletedAt = gorm.DeletedAt{}
-		customer.CreatedAt, customer.UpdatedAt = now, now
-
-		if err := bmsDB.DB.Unscoped().Save(&customer).Error; err != nil {
-			serverutils.WriteError(c, 500, "Failed to restore customer", err.Error())
-			return
-		}
-		serverutils.WriteJSON(c, 200, "Customer restored", CustomerResponse{ID: customer.ID, Name: customer.Name})
+	now := time.Now()
+	customer.DeletedAt = gorm.DeletedAt{}
+	customer.CreatedAt, customer.UpdatedAt = now, now
+	customer.ContractStart, customer.ContractEnd = contractStart, contractEnd
+	customer.ExternalRef = externalRef
+
+	if err := bmsDB.DB.Unscoped().Save(&customer).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to restore customer", err.Error())
 		return
 	}
-
-	serverutils.WriteError(c, 400, "Customer already exists", "A customer with this name already exists")
+	serverutils.WriteJSON(c, 200, "Customer restored", newCustomerResponse(*customer))
 }
 
-// Get all customers
+// Get all customers, narrowed to the names containing ?name_contains= and ordered by ?sort=, which
+// names a column with a leading - to sort descending. The results are paginated when page or
+// per_page is given.
 func CustomerFetchAll(c *gin.Context) {
+	pagination, err := serverutils.ParsePagination(c)
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid pagination", err.Error())
+		return
+	}
+
+	order, err := parseCustomerSort(c.Query("sort"))
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid sort", err.Error())
+		return
+	}
+
 	bmsDB, ok := serverutils.GetDBInstance(c)
 	if !ok {
 		return
 	}
 
+	// Order by ID last so pages are stable when the sort column has ties
+	query := bmsDB.DB.Model(&models.Customer{}).Order(order).Order("id")
+	if name := strings.TrimSpace(c.Query("name_contains")); name != "" {
+		query = query.Where("name LIKE ?", "%"+likeEscaper.Replace(name)+"%")
+	}
+
+	if pagination != nil {
+		query, err = pagination.Apply(query)
+		if err != nil {
+			serverutils.WriteError(c, 500, "Failed to count customers", err.Error())
+			return
+		}
+	}
+
 	var customers []models.Customer
-	if err := bmsDB.DB.Find(&customers).Error; err != nil {
+	if err := query.Find(&customers).Error; err != nil {
 		serverutils.WriteError(c, 500, "Failed to fetch customers", err.Error())
 		return
 	}
 
 	customerResponses := make([]CustomerResponse, len(customers))
 	for i, customer := range customers {
-		customerResponses[i] = CustomerResponse{ID: customer.ID, Name: customer.Name}
+		customerResponses[i] = newCustomerResponse(customer)
 	}
 
-	serverutils.WriteJSON(c, 200, "Customers fetched", customerResponses)
+	serverutils.WriteJSONPage(c, 200, "Customers fetched", customerResponses, pagination)
 }
 
 // Get a customer by ID
 func CustomerFetchByID(c *gin.Context) {
 	id := c.Param("customer_id")
-	fmt.Println("ID: ", id)
 	if !serverutils.IsValidUUID(id) {
 		serverutils.WriteError(c, 400, "Invalid customer ID", "Invalid UUID format")
 		return
@@ -121,7 +227,37 @@ func CustomerFetchByID(c *gin.Context) {
 		return
 	}
 
-	serverutils.WriteJSON(c, 200, "Customer fetched", CustomerResponse{ID: customer.ID, Name: customer.Name})
+	serverutils.WriteJSON(c, 200, "Customer fetched", newCustomerResponse(*customer))
+}
+
+// Route: GET /customers/by-ref/:ref
+// Fetch a customer by its external reference
+func CustomerFetchByRef(c *gin.Context) {
+	role := c.GetString("role")
+	requesterID := c.GetString("customer_id")
+	ref := c.Param("ref")
+
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var customer models.Customer
+	err := bmsDB.DB.Where("external_ref = ?", ref).First(&customer).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 404, "Customer not found", "No customer found with the given external reference")
+		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch customer", err.Error())
+		return
+	}
+
+	if role != "admin" && requesterID != customer.ID.String() {
+		serverutils.WriteError(c, 403, "Forbidden", "Unauthorized access")
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Customer fetched", newCustomerResponse(customer))
 }
 
 // Update a customer by ID
@@ -132,15 +268,74 @@ func CustomerUpdate(c *gin.Context) {
 		return
 	}
 
+	var body CustomerRequest
+	if err := c.BindJSON(&body); err != nil || body.Name == "" {
+		serverutils.WriteError(c, 400, "Invalid request body", "Name field is required")
+		return
+	}
+
+	updateCustomer(c, CustomerPatchRequest{
+		Name:          &body.Name,
+		ContractStart: body.ContractStart,
+		ContractEnd:   body.ContractEnd,
+		ExternalRef:   body.ExternalRef,
+	})
+}
+
+// Route: PATCH /customers/:customer_id (Admin Only)
+// Update only the given fields of a customer
+func CustomerPatch(c *gin.Context) {
+	var body CustomerPatchRequest
+	if err := c.BindJSON(&body); err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", "Invalid JSON format")
+		return
+	}
+
+	if body.Name == nil && body.ContractStart == nil && body.ContractEnd == nil && body.ExternalRef == nil {
+		serverutils.WriteError(c, 400, "Invalid request body", "Name, contract_start, contract_end or external_ref field is required")
+		return
+	}
+
+	if body.Name != nil && *body.Name == "" {
+		serverutils.WriteError(c, 400, "Invalid request body", "Name cannot be empty")
+		return
+	}
+
+	updateCustomer(c, body)
+}
+
+// Delete a customer by ID. With ?cascade=true its sites, devices and tokens are deleted along with
+// it in one transaction, and ?dry_run=true counts them without deleting anything.
+func CustomerDelete(c *gin.Context) {
+	role := c.GetString("role")
+	if role != "admin" {
+		serverutils.WriteError(c, 403, "Forbidden", "Unauthorized access")
+		return
+	}
+
 	id := c.Param("customer_id")
 	if !serverutils.IsValidUUID(id) {
 		serverutils.WriteError(c, 400, "Invalid customer ID", "Invalid UUID format")
 		return
 	}
 
-	var body CustomerRequest
-	if err := c.BindJSON(&body); err != nil || body.Name == "" {
-		serverutils.WriteError(c, 400, "Invalid request body", "Name field is required")
+	cascade := false
+	switch c.Query("cascade") {
+	case "", "false":
+	case "true":
+		cascade = true
+	default:
+		serverutils.WriteError(c, 400, "Invalid cascade", "Cascade must be true or false")
+		return
+	}
+
+	dryRun := false
+	switch c.Query("dry_run") {
+	case "", "false":
+	case "true":
+		dryRun = true
+	default:
+		serverutils.WriteError(c, 400, "Invalid dry run", "Dry run must be true or false")
 		return
 	}
 
@@ -158,44 +353,384 @@ func CustomerUpdate(c *gin.Context) {
 		return
 	}
 
-	if err := bmsDB.DB.Model(customer).Update("name", body.Name).Error; err != nil {
-		serverutils.WriteError(c, 500, "Failed to update customer", err.Error())
+	response := CustomerDeleteResponse{CustomerID: customer.ID, Cascade: cascade, DryRun: dryRun}
+	var siteIDs []uuid.UUID
+	err = bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Site{}).Where("customer_id = ?", customer.ID).Pluck("id", &siteIDs).Error; err != nil {
+			return err
+		}
+		response.Sites = int64(len(siteIDs))
+
+		var deviceIDs []uuid.UUID
+		if err := tx.Model(&models.Device{}).Where("customer_id = ?", customer.ID).Pluck("id", &deviceIDs).Error; err != nil {
+			return err
+		}
+		response.Devices = int64(len(deviceIDs))
+
+		if err := tx.Model(&models.AuthToken{}).Where("customer_id = ?", customer.ID).Count(&response.Tokens).Error; err != nil {
+			return err
+		}
+
+		if dryRun {
+			return nil
+		}
+
+		if cascade {
+			if len(deviceIDs) > 0 {
+				if err := softDeleteDevices(tx, c.GetString("customer_id"), deviceIDs...); err != nil {
+					return err
+				}
+			}
+			if err := tx.Where("customer_id = ?", customer.ID).Delete(&models.Site{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("customer_id = ?", customer.ID).Delete(&models.AuthToken{}).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(customer).Error
+	})
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to delete customer", err.Error())
 		return
 	}
 
-	serverutils.WriteJSON(c, 200, "Customer updated", CustomerResponse{ID: customer.ID, Name: body.Name})
+	if dryRun {
+		serverutils.WriteJSON(c, 200, "Customer delete previewed", response)
+		return
+	}
+
+	serverutils.AfterCommit(c, func() {
+		cache.Names().InvalidateCustomer(customer.ID)
+		if cascade {
+			for _, siteID := range siteIDs {
+				cache.Names().InvalidateSite(siteID)
+			}
+		}
+		cache.SiteDevices().Clear()
+		changes.RecordAll()
+	})
+
+	serverutils.WriteJSON(c, 200, "Customer deleted", response)
 }
 
-// Delete a customer by ID
-func CustomerDelete(c *gin.Context) {
-	role := c.GetString("role")
-	if role != "admin" {
-		serverutils.WriteError(c, 403, "Forbidden", "Unauthorized access")
+// Route: GET /customers/deleted (Admin Only)
+// Fetch the soft-deleted customers, most recently deleted first
+func CustomerFetchDeleted(c *gin.Context) {
+	pagination, err := serverutils.ParsePagination(c)
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid pagination", err.Error())
 		return
 	}
 
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	query := bmsDB.DB.Unscoped().Model(&models.Customer{}).
+		Where("deleted_at IS NOT NULL").
+		Order("deleted_at DESC, name")
+
+	if pagination != nil {
+		query, err = pagination.Apply(query)
+		if err != nil {
+			serverutils.WriteError(c, 500, "Failed to count customers", err.Error())
+			return
+		}
+	}
+
+	var customers []models.Customer
+	if err := query.Find(&customers).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch customers", err.Error())
+		return
+	}
+
+	response := make([]DeletedCustomerResponse, len(customers))
+	for i, customer := range customers {
+		response[i] = DeletedCustomerResponse{CustomerResponse: newCustomerResponse(customer), DeletedAt: timefmt.New(customer.DeletedAt.Time)}
+	}
+
+	serverutils.WriteJSONPage(c, 200, "Deleted customers fetched", response, pagination)
+}
+
+// Route: POST /customers/:customer_id/restore (Admin Only)
+// Restore a soft-deleted customer. With ?cascade=true its soft-deleted sites and devices are
+// restored along with it in one transaction; its tokens stay deleted.
+func CustomerRestore(c *gin.Context) {
 	id := c.Param("customer_id")
 	if !serverutils.IsValidUUID(id) {
 		serverutils.WriteError(c, 400, "Invalid customer ID", "Invalid UUID format")
 		return
 	}
 
+	cascade := false
+	switch c.Query("cascade") {
+	case "", "false":
+	case "true":
+		cascade = true
+	default:
+		serverutils.WriteError(c, 400, "Invalid cascade", "Cascade must be true or false")
+		return
+	}
+
 	bmsDB, ok := serverutils.GetDBInstance(c)
 	if !ok {
 		return
 	}
 
-	// Delete the customer from the database
-	if err := bmsDB.DB.Delete(&models.Customer{}, "id = ?", id).Error; err != nil {
-		serverutils.WriteError(c, 500, "Failed to delete customer", err.Error())
+	response := CustomerRestoreResponse{Cascade: cascade}
+	var customer models.Customer
+	err := bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ?", id).
+			First(&customer).Error; err != nil {
+			return err
+		}
+
+		if !customer.DeletedAt.Valid {
+			return errCustomerNotDeleted
+		}
+
+		customer.DeletedAt = gorm.DeletedAt{}
+		if err := tx.Unscoped().Model(&customer).Update("deleted_at", nil).Error; err != nil {
+			return err
+		}
+
+		if !cascade {
+			return nil
+		}
+
+		sites := tx.Unscoped().Model(&models.Site{}).
+			Where("customer_id = ? AND deleted_at IS NOT NULL", customer.ID).
+			Update("deleted_at", nil)
+		if sites.Error != nil {
+			return sites.Error
+		}
+		response.Sites = sites.RowsAffected
+
+		devices := tx.Unscoped().Model(&models.Device{}).
+			Where("customer_id = ? AND deleted_at IS NOT NULL", customer.ID).
+			Updates(map[string]any{"deleted_at": nil, "deleted_by": nil})
+		if devices.Error != nil {
+			return devices.Error
+		}
+		response.Devices = devices.RowsAffected
+
+		return nil
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		serverutils.WriteError(c, 404, "Customer not found", "No customer found with the given ID")
+		return
+	case errors.Is(err, errCustomerNotDeleted):
+		serverutils.WriteError(c, 409, "Customer is not deleted", "The customer with the given ID has not been deleted")
+		return
+	case err != nil:
+		serverutils.WriteError(c, 500, "Failed to restore customer", err.Error())
 		return
 	}
 
-	serverutils.WriteJSON(c, 200, "Customer deleted", nil)
+	serverutils.AfterCommit(c, func() {
+		cache.Names().SetCustomer(customer)
+		if cascade {
+			cache.SiteDevices().Clear()
+			changes.RecordAll()
+		}
+	})
+
+	response.Customer = newCustomerResponse(customer)
+	serverutils.WriteJSON(c, 200, "Customer restored", response)
 }
 
 // =====================================================================================================================
 
+// updateCustomer applies the given fields to the customer of the route
+func updateCustomer(c *gin.Context, body CustomerPatchRequest) {
+	id := c.Param("customer_id")
+	if !serverutils.IsValidUUID(id) {
+		serverutils.WriteError(c, 400, "Invalid customer ID", "Invalid UUID format")
+		return
+	}
+
+	contractStart, contractEnd, err := parseContractDates(CustomerRequest{ContractStart: body.ContractStart, ContractEnd: body.ContractEnd})
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", err.Error())
+		return
+	}
+
+	externalRef, err := parseExternalRef(body.ExternalRef)
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", err.Error())
+		return
+	}
+
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	customer, err := FetchCustomerByID(bmsDB, id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 404, "Customer not found", "No customer found with the given ID")
+		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch customer", err.Error())
+		return
+	}
+
+	// A single contract date is checked against the stored other one
+	start, end := customer.ContractStart, customer.ContractEnd
+	if body.ContractStart != nil {
+		start = contractStart
+	}
+	if body.ContractEnd != nil {
+		end = contractEnd
+	}
+	if start != nil && end != nil && end.Before(*start) {
+		serverutils.WriteError(c, 400, "Invalid request body", "contract_end must not be before contract_start")
+		return
+	}
+
+	if externalRef != nil && !checkExternalRefFree(c, bmsDB, *externalRef, customer.ID) {
+		return
+	}
+
+	// Fields are only changed when given; an empty contract date or external reference clears it
+	updates := map[string]any{}
+	if body.Name != nil {
+		updates["name"] = *body.Name
+	}
+	if body.ContractStart != nil {
+		updates["contract_start"] = contractStart
+	}
+	if body.ContractEnd != nil {
+		updates["contract_end"] = contractEnd
+	}
+	if body.ExternalRef != nil {
+		updates["external_ref"] = externalRef
+	}
+
+	if err := bmsDB.DB.Model(customer).Updates(updates).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to update customer", err.Error())
+		return
+	}
+
+	if body.Name != nil {
+		customer.Name = *body.Name
+		renamed := models.Customer{ID: customer.ID, Name: customer.Name}
+		serverutils.AfterCommit(c, func() {
+			cache.Names().SetCustomer(renamed)
+			cache.SiteDevices().Clear()
+			changes.RecordAll()
+		})
+	}
+	customer.ContractStart, customer.ContractEnd = start, end
+	if body.ExternalRef != nil {
+		customer.ExternalRef = externalRef
+	}
+
+	serverutils.WriteJSON(c, 200, "Customer updated", newCustomerResponse(*customer))
+}
+
+// newCustomerResponse builds the response for a customer
+func newCustomerResponse(customer models.Customer) CustomerResponse {
+	return CustomerResponse{
+		ID:            customer.ID,
+		Name:          customer.Name,
+		ContractStart: customer.ContractStart,
+		ContractEnd:   customer.ContractEnd,
+		ExternalRef:   customer.ExternalRef,
+	}
+}
+
+// customerSortColumns are the columns the customer list can be sorted on
+var customerSortColumns = []string{"name", "created_at", "contract_start", "contract_end"}
+
+// parseCustomerSort returns the ordering of the customer list for the sort query parameter,
+// sorting by name when none is given
+func parseCustomerSort(value string) (string, error) {
+	if value == "" {
+		return "name", nil
+	}
+
+	column, descending := strings.CutPrefix(value, "-")
+	if !slices.Contains(customerSortColumns, column) {
+		return "", fmt.Errorf("sort must be one of %s, optionally prefixed with -", strings.Join(customerSortColumns, ", "))
+	}
+
+	if descending {
+		return column + " DESC", nil
+	}
+	return column, nil
+}
+
+// parseExternalRef validates the optional external reference of a customer request, treating a
+// missing or empty value as no reference
+func parseExternalRef(value *string) (*string, error) {
+	if value == nil || *value == "" {
+		return nil, nil
+	}
+
+	if !externalRefRegex.MatchString(*value) {
+		return nil, errors.New("external_ref must be 1 to 64 letters, digits, dots, colons, underscores or dashes")
+	}
+
+	ref := *value
+	return &ref, nil
+}
+
+// checkExternalRefFree writes a conflict unless the external reference is free for the customer.
+// Soft-deleted customers keep their reference, as they still hold the unique index.
+func checkExternalRefFree(c *gin.Context, bmsDB *devicesdb.BMS_DB, ref string, customerID uuid.UUID) bool {
+	var count int64
+	if err := bmsDB.DB.Unscoped().Model(&models.Customer{}).
+		Where("external_ref = ? AND id <> ?", ref, customerID).
+		Count(&count).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch customer", err.Error())
+		return false
+	}
+
+	if count > 0 {
+		serverutils.WriteError(c, 409, "External reference already in use", "Another customer has this external reference")
+		return false
+	}
+	return true
+}
+
+// parseContractDates parses the optional contract dates of a customer request
+func parseContractDates(body CustomerRequest) (start, end *time.Time, err error) {
+	start, err = parseContractDate("contract_start", body.ContractStart)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	end, err = parseContractDate("contract_end", body.ContractEnd)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if start != nil && end != nil && end.Before(*start) {
+		return nil, nil, errors.New("contract_end must not be before contract_start")
+	}
+
+	return start, end, nil
+}
+
+// parseContractDate parses a YYYY-MM-DD date, treating a missing or empty value as no date
+func parseContractDate(field string, value *string) (*time.Time, error) {
+	if value == nil || *value == "" {
+		return nil, nil
+	}
+
+	date, err := time.Parse(contractDateLayout, *value)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be formatted as YYYY-MM-DD", field)
+	}
+
+	return &date, nil
+}
+
 // Fetch a customer by ID
 func FetchCustomerByID(bmsDB *devicesdb.BMS_DB, id string) (*models.Customer, error) {
 	var customer models.Customer
@@ -206,6 +741,22 @@ func FetchCustomerByID(bmsDB *devicesdb.BMS_DB, id string) (*models.Customer, er
 	return &customer, nil
 }
 
+// errCustomerDeleted is returned when attaching to a soft-deleted customer
+var errCustomerDeleted = errors.New("customer is deleted")
+
+// fetchAttachableCustomer fetches the customer sites are attached to. Soft-deleted customers are
+// found too, failing with errCustomerDeleted rather than as missing.
+func fetchAttachableCustomer(bmsDB *devicesdb.BMS_DB, id string) (*models.Customer, error) {
+	var customer models.Customer
+	if err := bmsDB.DB.Unscoped().First(&customer, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	if customer.DeletedAt.Valid {
+		return nil, errCustomerDeleted
+	}
+	return &customer, nil
+}
+
 // Fetch a customer by Name (including soft-deleted records)
 func FetchCustomerByName(bmsDB *devicesdb.BMS_DB, name string) (*models.Customer, error) {
 	var customer models.Customer
@@ -0,0 +1,361 @@
+package handlers
+
+import (
+	"errors"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"gorm.io/gorm"
+)
+
+// maxImpactDepth bounds how far impact analysis follows the dependency graph
+const maxImpactDepth = 32
+
+type DeviceDependencyRequest struct {
+	DownstreamSerialNumber string `json:"downstream_serial_number"`
+	Relationship           string `json:"relationship"`
+	Description            string `json:"description"`
+}
+
+type DeviceDependencyResponse struct {
+	ID                     uuid.UUID `json:"id"`
+	UpstreamSerialNumber   string    `json:"upstream_serial_number"`
+	DownstreamSerialNumber string    `json:"downstream_serial_number"`
+	Relationship           string    `json:"relationship"`
+	Description            string    `json:"description,omitempty"`
+}
+
+type DeviceDependenciesResponse struct {
+	DeviceSerialNumber string                     `json:"device_serial_number"`
+	Upstream           []DeviceDependencyResponse `json:"upstream"`
+	Downstream         []DeviceDependencyResponse `json:"downstream"`
+}
+
+type ImpactedDevice struct {
+	DeviceSerialNumber string `json:"device_serial_number"`
+	DeviceName         string `json:"device_name"`
+	DeviceType         string `json:"device_type"`
+	Depth              int    `json:"depth"`
+	Via                string `json:"via"`
+	Relationship       string `json:"relationship"`
+
+	deviceID uuid.UUID
+}
+
+type ImpactResponse struct {
+	Sources  []string         `json:"sources"`
+	Impacted []ImpactedDevice `json:"impacted"`
+}
+
+// Route: POST /devices/:device_serial_number/dependencies (Admin Only)
+// Record that another device depends on this device
+func DeviceDependencyCreate(c *gin.Context) {
+	upstream := c.Param("device_serial_number")
+
+	var body DeviceDependencyRequest
+	if err := c.BindJSON(&body); err != nil || body.DownstreamSerialNumber == "" || body.Relationship == "" {
+		serverutils.WriteError(c, 400, "Invalid request body", "downstream_serial_number and relationship fields are required")
+		return
+	}
+
+	if body.DownstreamSerialNumber == upstream {
+		serverutils.WriteError(c, 400, "Invalid dependency", "A device cannot depend on itself")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	upstreamDevice, ok := fetchReportingDevice(c, bmsDB, upstream)
+	if !ok {
+		return
+	}
+
+	// Dependencies link devices of the same customer
+	downstreamDevice, err := FetchCustomerDeviceBySerialNumber(bmsDB, upstreamDevice.CustomerID.String(), body.DownstreamSerialNumber)
+	if err == nil && downstreamDevice.DeletedAt.Valid {
+		err = gorm.ErrRecordNotFound
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 404, "Device not found", "No device found with serial number "+body.DownstreamSerialNumber)
+		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch device", err.Error())
+		return
+	}
+
+	// Reject edges that would make the graph cyclic
+	downstreamOfChild, err := downstreamDevices(bmsDB, []models.Device{*downstreamDevice})
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch dependencies", err.Error())
+		return
+	}
+	for _, impacted := range downstreamOfChild {
+		if impacted.deviceID == upstreamDevice.ID {
+			serverutils.WriteError(c, 400, "Invalid dependency", "The dependency would create a cycle")
+			return
+		}
+	}
+
+	dependency := models.DeviceDependency{
+		UpstreamDeviceID:       upstreamDevice.ID,
+		DownstreamDeviceID:     downstreamDevice.ID,
+		UpstreamSerialNumber:   upstreamDevice.DeviceSerialNumber,
+		DownstreamSerialNumber: downstreamDevice.DeviceSerialNumber,
+		Relationship:           body.Relationship,
+		Description:            body.Description,
+	}
+
+	var existing models.DeviceDependency
+	err = bmsDB.DB.Where("upstream_device_id = ? AND downstream_device_id = ?", upstreamDevice.ID, downstreamDevice.ID).
+		First(&existing).Error
+	if err == nil {
+		serverutils.WriteError(c, 400, "Dependency already exists", "The devices are already linked")
+		return
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 500, "Failed to fetch dependencies", err.Error())
+		return
+	}
+
+	// Replace a previously deleted edge between the same devices
+	if err := bmsDB.DB.Unscoped().
+		Where("upstream_device_id = ? AND downstream_device_id = ?", upstreamDevice.ID, downstreamDevice.ID).
+		Delete(&models.DeviceDependency{}).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to create dependency", err.Error())
+		return
+	}
+
+	if err := bmsDB.DB.Create(&dependency).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to create dependency", err.Error())
+		return
+	}
+
+	serverutils.WriteJSON(c, 201, "Dependency created", newDeviceDependencyResponse(dependency))
+}
+
+// Route: GET /devices/:device_serial_number/dependencies
+// Fetch the devices this device depends on and the devices that depend on it
+func DeviceDependencyFetch(c *gin.Context) {
+	serialNumber := c.Param("device_serial_number")
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	device, ok := fetchReportingDevice(c, bmsDB, serialNumber)
+	if !ok {
+		return
+	}
+
+	var dependencies []models.DeviceDependency
+	if err := bmsDB.DB.Where("upstream_device_id = ? OR downstream_device_id = ?", device.ID, device.ID).
+		Order("created_at").
+		Find(&dependencies).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch dependencies", err.Error())
+		return
+	}
+
+	response := DeviceDependenciesResponse{
+		DeviceSerialNumber: device.DeviceSerialNumber,
+		Upstream:           []DeviceDependencyResponse{},
+		Downstream:         []DeviceDependencyResponse{},
+	}
+	for _, dependency := range dependencies {
+		if dependency.DownstreamDeviceID == device.ID {
+			response.Upstream = append(response.Upstream, newDeviceDependencyResponse(dependency))
+		} else {
+			response.Downstream = append(response.Downstream, newDeviceDependencyResponse(dependency))
+		}
+	}
+
+	serverutils.WriteJSON(c, 200, "Dependencies fetched", response)
+}
+
+// Route: DELETE /devices/:device_serial_number/dependencies/:dependency_id (Admin Only)
+// Remove a dependency on this device
+func DeviceDependencyDelete(c *gin.Context) {
+	serialNumber := c.Param("device_serial_number")
+	dependencyID := c.Param("dependency_id")
+
+	if !serverutils.IsValidUUID(dependencyID) {
+		serverutils.WriteError(c, 400, "Invalid dependency ID", "Invalid UUID format")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	device, ok := fetchReportingDevice(c, bmsDB, serialNumber)
+	if !ok {
+		return
+	}
+
+	result := bmsDB.DB.Where("id = ? AND upstream_device_id = ?", dependencyID, device.ID).
+		Delete(&models.DeviceDependency{})
+	if result.Error != nil {
+		serverutils.WriteError(c, 500, "Failed to delete dependency", result.Error.Error())
+		return
+	}
+	if result.RowsAffected == 0 {
+		serverutils.WriteError(c, 404, "Dependency not found", "No dependency found with the given ID for the device")
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Dependency deleted", nil)
+}
+
+// Route: GET /devices/:device_serial_number/impact
+// Fetch every device that directly or indirectly depends on this device
+func DeviceImpact(c *gin.Context) {
+	serialNumber := c.Param("device_serial_number")
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	device, ok := fetchReportingDevice(c, bmsDB, serialNumber)
+	if !ok {
+		return
+	}
+
+	writeImpact(c, bmsDB, []models.Device{*device})
+}
+
+// Route: GET /controllers/:controller_serial_number/impact
+// Fetch every device behind the controller and every device that depends on those devices
+func ControllerImpact(c *gin.Context) {
+	controllerSerialNumber := c.Param("controller_serial_number")
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var sources []models.Device
+	if err := bmsDB.DB.Select("id", "device_serial_number").
+		Where("controller_serial_number = ?", controllerSerialNumber).
+		Order("device_serial_number").
+		Find(&sources).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch devices", err.Error())
+		return
+	}
+
+	if len(sources) == 0 {
+		serverutils.WriteError(c, 404, "Controller not found", "No devices found behind the given controller")
+		return
+	}
+
+	writeImpact(c, bmsDB, sources)
+}
+
+// =====================================================================================================================
+
+// writeImpact writes the sources and the devices downstream of them
+func writeImpact(c *gin.Context, bmsDB *devicesdb.BMS_DB, sources []models.Device) {
+	impacted, err := downstreamDevices(bmsDB, sources)
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch dependencies", err.Error())
+		return
+	}
+
+	serialNumbers := make([]string, len(sources))
+	for i, source := range sources {
+		serialNumbers[i] = source.DeviceSerialNumber
+	}
+
+	serverutils.WriteJSON(c, 200, "Impact fetched", ImpactResponse{Sources: serialNumbers, Impacted: impacted})
+}
+
+// downstreamDevices walks the dependency graph breadth first from the sources, returning each
+// device that depends on them once, at the depth it is first reached
+func downstreamDevices(bmsDB *devicesdb.BMS_DB, sources []models.Device) ([]ImpactedDevice, error) {
+	visited := make(map[uuid.UUID]bool, len(sources))
+	frontier := make([]uuid.UUID, len(sources))
+	for i, source := range sources {
+		visited[source.ID] = true
+		frontier[i] = source.ID
+	}
+
+	impacted := []ImpactedDevice{}
+
+	for depth := 1; len(frontier) > 0 && depth <= maxImpactDepth; depth++ {
+		var edges []models.DeviceDependency
+		if err := bmsDB.DB.Where("upstream_device_id IN ?", frontier).
+			Order("upstream_serial_number, downstream_serial_number").
+			Find(&edges).Error; err != nil {
+			return nil, err
+		}
+
+		var next []uuid.UUID
+		for _, edge := range edges {
+			if visited[edge.DownstreamDeviceID] {
+				continue
+			}
+			visited[edge.DownstreamDeviceID] = true
+			next = append(next, edge.DownstreamDeviceID)
+
+			impacted = append(impacted, ImpactedDevice{
+				DeviceSerialNumber: edge.DownstreamSerialNumber,
+				Depth:              depth,
+				Via:                edge.UpstreamSerialNumber,
+				Relationship:       edge.Relationship,
+				deviceID:           edge.DownstreamDeviceID,
+			})
+		}
+		frontier = next
+	}
+
+	if len(impacted) == 0 {
+		return impacted, nil
+	}
+
+	// Decorate the impacted devices with their names and types
+	ids := make([]uuid.UUID, len(impacted))
+	for i, device := range impacted {
+		ids[i] = device.deviceID
+	}
+
+	var devices []models.Device
+	if err := bmsDB.DB.Select("id", "device_name", "device_type").
+		Where("id IN ?", ids).
+		Find(&devices).Error; err != nil {
+		return nil, err
+	}
+
+	byID := make(map[uuid.UUID]models.Device, len(devices))
+	for _, device := range devices {
+		byID[device.ID] = device
+	}
+	for i := range impacted {
+		device := byID[impacted[i].deviceID]
+		impacted[i].DeviceName = device.DeviceName
+		impacted[i].DeviceType = device.DeviceType
+	}
+
+	return impacted, nil
+}
+
+// newDeviceDependencyResponse builds the response for a dependency
+func newDeviceDependencyResponse(dependency models.DeviceDependency) DeviceDependencyResponse {
+	return DeviceDependencyResponse{
+		ID:                     dependency.ID,
+		UpstreamSerialNumber:   dependency.UpstreamSerialNumber,
+		DownstreamSerialNumber: dependency.DownstreamSerialNumber,
+		Relationship:           dependency.Relationship,
+		Description:            dependency.Description,
+	}
+}
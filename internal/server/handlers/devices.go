@@ -1,16 +1,29 @@
 package handlers
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/audit"
+	"github.com/johandrevandeventer/devices-api-server/internal/cache"
+	"github.com/johandrevandeventer/devices-api-server/internal/changes"
+	"github.com/johandrevandeventer/devices-api-server/internal/devicetoken"
 	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/internal/timefmt"
 	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
 	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"github.com/johandrevandeventer/logging"
+	"go.uber.org/zap"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type DeviceRequest struct {
@@ -37,9 +50,14 @@ type DeviceResponse struct {
 	DeviceName             string    `json:"device_name"`
 	DeviceSerialNumber     string    `json:"device_serial_number"`
 	BuildingURL            string    `json:"building_url"`
-	AuthToken              string    `json:"auth_token"`
+	FirmwareVersion        string    `json:"firmware_version"`
+	HardwareRevision       string    `json:"hardware_revision"`
+	AuthToken              string    `json:"auth_token,omitempty"`
 }
 
+// AuthTokenDeprecation is the warning sent with device responses, whose auth_token only holds the masked token
+const AuthTokenDeprecation = "auth_token field will be removed from this endpoint in v2, fetch the token from /devices/:device_serial_number/credentials"
+
 // Route: POST /customers/:customer_id/sites/:site_id/devices
 // Create a new device
 func DeviceCreate(c *gin.Context) {
@@ -72,22 +90,22 @@ func DeviceCreate(c *gin.Context) {
 	}
 
 	// Fetch and validate customer
-	customer, err := FetchCustomerByID(bmsDB, customerID)
+	customer, err := fetchAttachableCustomer(bmsDB, customerID)
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		serverutils.WriteError(c, 404, "Customer not found", "No customer found with the given ID")
 		return
 	} else if err != nil {
-		serverutils.WriteError(c, 500, "Database error", err.Error())
+		writeAttachError(c, err, "Database error")
 		return
 	}
 
 	// Fetch and validate site
-	site, err := FetchSiteByID(bmsDB, siteID)
+	site, err := fetchAttachableSite(bmsDB, siteID)
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		serverutils.WriteError(c, 404, "Site not found", "No site found with the given ID")
 		return
 	} else if err != nil {
-		serverutils.WriteError(c, 500, "Database error", err.Error())
+		writeAttachError(c, err, "Database error")
 		return
 	}
 
@@ -97,8 +115,14 @@ func DeviceCreate(c *gin.Context) {
 		return
 	}
 
+	body.AuthToken, err = devicetoken.Seal(body.AuthToken)
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to encrypt auth token", err.Error())
+		return
+	}
+
 	// Check if device already exists
-	device, err := FetchDeviceBySerialNumber(bmsDB, body.DeviceSerialNumber)
+	device, err := fetchExistingDevice(bmsDB, customer.ID, body.DeviceSerialNumber)
 	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
 		serverutils.WriteError(c, 500, "Database error", err.Error())
 		return
@@ -108,6 +132,7 @@ func DeviceCreate(c *gin.Context) {
 		// Create new device
 		newDevice := models.Device{
 			SiteID:                 site.ID,
+			CustomerID:             customer.ID,
 			Gateway:                body.Gateway,
 			Controller:             body.Controller,
 			ControllerSerialNumber: body.ControllerSerialNumber,
@@ -121,7 +146,11 @@ func DeviceCreate(c *gin.Context) {
 			serverutils.WriteError(c, 500, "Failed to create device", err.Error())
 			return
 		}
-		serverutils.WriteJSON(c, 200, "Device created", DeviceResponse{
+		serverutils.AfterCommit(c, func() {
+			cache.SiteDevices().Invalidate(site.ID.String())
+			changes.RecordSite(site.ID.String())
+		})
+		response := DeviceResponse{
 			ID:                     newDevice.ID,
 			CustomerID:             customer.ID,
 			CustomerName:           customer.Name,
@@ -134,41 +163,18 @@ func DeviceCreate(c *gin.Context) {
 			DeviceName:             newDevice.DeviceName,
 			DeviceSerialNumber:     newDevice.DeviceSerialNumber,
 			BuildingURL:            newDevice.BuildingURL,
-			AuthToken:              newDevice.AuthToken,
-		})
+			AuthToken:              devicetoken.MaskStored(newDevice.AuthToken),
+		}
+		if omitsDeviceTokens(c) {
+			response.AuthToken = ""
+		}
+		serverutils.WriteJSON(c, 200, "Device created", response)
 		return
 	}
 
-	// Restore soft-deleted device
+	// Deleted devices are brought back through the restore endpoint rather than by recreating them
 	if device.DeletedAt.Valid {
-		now := time.Now()
-		device.DeletedAt = gorm.DeletedAt{}
-		device.CreatedAt, device.UpdatedAt = now, now
-
-		fmt.Println(device.Site)
-
-		if err := bmsDB.DB.Unscoped().
-			Model(&device).
-			Select("deleted_at", "created_at", "updated_at").
-			Updates(device).Error; err != nil {
-			serverutils.WriteError(c, 500, "Failed to restore device", err.Error())
-			return
-		}
-		serverutils.WriteJSON(c, 200, "Device restored", DeviceResponse{
-			ID:                     device.ID,
-			CustomerID:             customer.ID,
-			CustomerName:           customer.Name,
-			SiteID:                 site.ID,
-			SiteName:               site.Name,
-			Gateway:                device.Gateway,
-			Controller:             device.Controller,
-			ControllerSerialNumber: device.ControllerSerialNumber,
-			DeviceType:             device.DeviceType,
-			DeviceName:             device.DeviceName,
-			DeviceSerialNumber:     device.DeviceSerialNumber,
-			BuildingURL:            device.BuildingURL,
-			AuthToken:              device.AuthToken,
-		})
+		serverutils.WriteError(c, 409, "Device is deleted", "A deleted device with this serial number exists, restore it with POST /devices/"+device.DeviceSerialNumber+"/restore")
 		return
 	}
 
@@ -183,45 +189,80 @@ func DeviceFetchAll(c *gin.Context) {
 		return
 	}
 
-	var devices []models.Device
-	if err := bmsDB.DB.Preload("Site.Customer").Find(&devices).Error; err != nil {
-		serverutils.WriteError(c, 500, "Failed to fetch devices", err.Error())
+	// Stream one device per line if the client asked for JSON Lines
+	if serverutils.AcceptsNDJSON(c) {
+		streamDevices(c, bmsDB, filterDeviceList(c, DeviceListQuery(bmsDB)))
 		return
 	}
 
-	var response []DeviceResponse
-	for _, device := range devices {
-		customer, err := FetchCustomerByID(bmsDB, device.Site.CustomerID.String())
-		if err != nil {
-			serverutils.WriteError(c, 500, "Failed to fetch customer", err.Error())
-			return
-		}
+	writeDeviceList(c, bmsDB, DeviceListQuery(bmsDB))
+}
 
-		response = append(response, DeviceResponse{
-			ID:                     device.ID,
-			CustomerID:             customer.ID,
-			CustomerName:           customer.Name,
-			SiteID:                 device.Site.ID,
-			SiteName:               device.Site.Name,
-			Gateway:                device.Gateway,
-			Controller:             device.Controller,
-			ControllerSerialNumber: device.ControllerSerialNumber,
-			DeviceType:             device.DeviceType,
-			DeviceName:             device.DeviceName,
-			DeviceSerialNumber:     device.DeviceSerialNumber,
-			BuildingURL:            device.BuildingURL,
-			AuthToken:              device.AuthToken,
-		})
+// Route: GET /devices/export
+// Stream the device inventory, including customer and site columns, as a CSV download
+func DeviceExport(c *gin.Context) {
+	role := c.GetString("role")
+	requesterID := c.GetString("customer_id")
+
+	if format := c.DefaultQuery("format", "csv"); format != "csv" {
+		serverutils.WriteError(c, 400, "Invalid format", "Only the csv format is supported")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	query := filterDeviceList(c, DeviceListQuery(bmsDB))
+
+	// Non-admins only export their own devices
+	if role != "admin" {
+		query = query.Where("sites.customer_id = ?", requesterID)
+	}
+
+	exportDevicesCSV(c, bmsDB, query, fmt.Sprintf("devices-%s.csv", time.Now().UTC().Format("20060102")))
+}
+
+// Route: GET /devices/search
+// Search devices by name, serial numbers, controller and site or customer name
+func DeviceSearch(c *gin.Context) {
+	role := c.GetString("role")
+	requesterID := c.GetString("customer_id")
+
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		serverutils.WriteError(c, 400, "Invalid search", "Query parameter q is required")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
 	}
 
-	serverutils.WriteJSON(c, 200, "Devices fetched", response)
+	pattern := "%" + likeEscaper.Replace(q) + "%"
+	query := DeviceListQuery(bmsDB).Where(
+		`(devices.device_name LIKE ? OR devices.device_serial_number LIKE ? OR devices.controller_serial_number LIKE ?
+			OR devices.controller LIKE ? OR sites.name LIKE ? OR customers.name LIKE ?)`,
+		pattern, pattern, pattern, pattern, pattern, pattern,
+	)
+
+	// Non-admins only search their own devices
+	if role != "admin" {
+		query = query.Where("sites.customer_id = ?", requesterID)
+	}
+
+	writeDeviceList(c, bmsDB, query)
 }
 
 // Route: GET /customers/:customer_id/devices
 // Fetch all devices for a customer
 func DeviceFetchByCustomerID(c *gin.Context) {
 	role := c.GetString("role")
-	requesterID := c.GetString("user_id")
+	requesterID := c.GetString("customer_id")
 	customerID := c.Param("customer_id")
 
 	// Validate the customer ID
@@ -241,6 +282,9 @@ func DeviceFetchByCustomerID(c *gin.Context) {
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		serverutils.WriteError(c, 404, "Customer not found", "No customer found with the given ID")
 		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch customer", err.Error())
+		return
 	}
 
 	if role != "admin" && customer.ID.String() != requesterID {
@@ -248,32 +292,7 @@ func DeviceFetchByCustomerID(c *gin.Context) {
 		return
 	}
 
-	var devices []models.Device
-	if err := bmsDB.DB.Preload("Site.Customer").Where("site_id IN (SELECT id FROM sites WHERE customer_id = ?)", customer.ID).Find(&devices).Error; err != nil {
-		serverutils.WriteError(c, 500, "Failed to fetch devices", err.Error())
-		return
-	}
-
-	var response []DeviceResponse
-	for _, device := range devices {
-		response = append(response, DeviceResponse{
-			ID:                     device.ID,
-			CustomerID:             customer.ID,
-			CustomerName:           customer.Name,
-			SiteID:                 device.Site.ID,
-			SiteName:               device.Site.Name,
-			Gateway:                device.Gateway,
-			Controller:             device.Controller,
-			ControllerSerialNumber: device.ControllerSerialNumber,
-			DeviceType:             device.DeviceType,
-			DeviceName:             device.DeviceName,
-			DeviceSerialNumber:     device.DeviceSerialNumber,
-			BuildingURL:            device.BuildingURL,
-			AuthToken:              device.AuthToken,
-		})
-	}
-
-	serverutils.WriteJSON(c, 200, "Devices fetched", response)
+	writeDeviceList(c, bmsDB, DeviceListQuery(bmsDB).Where("sites.customer_id = ?", customer.ID))
 }
 
 // Route: GET /sites/:site_id/devices
@@ -298,52 +317,27 @@ func DeviceFetchBySiteID(c *gin.Context) {
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		serverutils.WriteError(c, 404, "Site not found", "No site found with the given ID")
 		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch site", err.Error())
+		return
 	}
 
-	var devices []models.Device
-	if err := bmsDB.DB.Preload("Site.Customer").Where("site_id = ?", site.ID).Find(&devices).Error; err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			serverutils.WriteError(c, 404, "No devices found", "No devices found for the given site")
-			return
-		} else {
-			serverutils.WriteError(c, 500, "Failed to fetch devices", err.Error())
-			return
-		}
-	}
-
-	var response []DeviceResponse
-	for _, device := range devices {
-		// customer, err := FetchCustomerByID(bmsDB, site.CustomerID.String())
-		// if err != nil {
-		// 	serverutils.WriteError(c, 500, "Failed to fetch customer", err.Error())
-		// 	return
-		// }
-
-		response = append(response, DeviceResponse{
-			ID:                     device.ID,
-			CustomerID:             device.Site.Customer.ID,
-			CustomerName:           device.Site.Customer.Name,
-			SiteID:                 site.ID,
-			SiteName:               site.Name,
-			Gateway:                device.Gateway,
-			Controller:             device.Controller,
-			ControllerSerialNumber: device.ControllerSerialNumber,
-			DeviceType:             device.DeviceType,
-			DeviceName:             device.DeviceName,
-			DeviceSerialNumber:     device.DeviceSerialNumber,
-			BuildingURL:            device.BuildingURL,
-			AuthToken:              device.AuthToken,
-		})
+	// Serve the unfiltered list from the per-site cache, so gateways booting at the same time
+	// share a single query and can revalidate their copy with If-None-Match
+	if c.Request.URL.RawQuery == "" {
+		writeCachedSiteDevices(c, bmsDB, site.ID)
+		return
 	}
 
-	serverutils.WriteJSON(c, 200, "Devices fetched", response)
+	writeDeviceList(c, bmsDB, DeviceListQuery(bmsDB).Where("devices.site_id = ?", site.ID))
 }
 
 // Route: GET /devices/:device_serial_number
+// Route: GET /customers/:customer_id/devices/:device_serial_number
 // Fetch a device by serial number
 func DeviceFetchBySerialNumber(c *gin.Context) {
 	role := c.GetString("role")
-	requesterID := c.GetString("user_id")
+	requesterID := c.GetString("customer_id")
 	serialNumber := c.Param("device_serial_number")
 
 	// Get the database instance
@@ -353,9 +347,9 @@ func DeviceFetchBySerialNumber(c *gin.Context) {
 	}
 
 	// Fetch and validate device
-	device, err := FetchDeviceBySerialNumber(bmsDB, serialNumber)
-	if errors.Is(err, gorm.ErrRecordNotFound) {
-		serverutils.WriteError(c, 404, "Device not found", "No device found with the given serial number")
+	device, err := lookupDevice(c, bmsDB, serialNumber)
+	if err != nil {
+		writeDeviceLookupError(c, err)
 		return
 	}
 
@@ -370,7 +364,23 @@ func DeviceFetchBySerialNumber(c *gin.Context) {
 		return
 	}
 
-	serverutils.WriteJSON(c, 200, "Device fetched", DeviceResponse{
+	// Site tokens only see the devices of their own site
+	if siteID := c.GetString("site_id"); siteID != "" && device.SiteID.String() != siteID {
+		serverutils.WriteError(c, 403, "Forbidden", "Site tokens can only access their own site")
+		return
+	}
+
+	// A device that never reported a status is most likely missing its heartbeat configuration
+	var statuses int64
+	if err := bmsDB.DB.Model(&models.DeviceStatus{}).Where("device_id = ?", device.ID).Count(&statuses).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch device status", err.Error())
+		return
+	}
+	if statuses == 0 {
+		serverutils.AddWarning(c, "Device has not reported a heartbeat, check its heartbeat configuration")
+	}
+
+	response := DeviceResponse{
 		ID:                     device.ID,
 		CustomerID:             device.Site.Customer.ID,
 		CustomerName:           device.Site.Customer.Name,
@@ -383,11 +393,61 @@ func DeviceFetchBySerialNumber(c *gin.Context) {
 		DeviceName:             device.DeviceName,
 		DeviceSerialNumber:     device.DeviceSerialNumber,
 		BuildingURL:            device.BuildingURL,
-		AuthToken:              device.AuthToken,
+		FirmwareVersion:        device.FirmwareVersion,
+		HardwareRevision:       device.HardwareRevision,
+		AuthToken:              devicetoken.MaskStored(device.AuthToken),
+	}
+	if omitsDeviceTokens(c) {
+		response.AuthToken = ""
+	}
+	serverutils.WriteJSON(c, 200, "Device fetched", response)
+}
+
+type DeviceCredentialsResponse struct {
+	DeviceSerialNumber string `json:"device_serial_number"`
+	AuthToken          string `json:"auth_token"`
+}
+
+// Route: GET /devices/:device_serial_number/credentials (Admin Only)
+// Reveal the unmasked auth token of a device. Every reveal is recorded in the audit log.
+func DeviceCredentialsFetch(c *gin.Context) {
+	serialNumber := c.Param("device_serial_number")
+
+	// Tokens are only revealed when they are encrypted at rest
+	if !devicetoken.Enabled() {
+		serverutils.WriteError(c, 503, "Credentials unavailable", "Device token encryption is not configured")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	device, err := lookupDevice(c, bmsDB, serialNumber)
+	if err != nil {
+		writeDeviceLookupError(c, err)
+		return
+	}
+
+	token, err := devicetoken.Open(device.AuthToken)
+	if err != nil {
+		audit.RecordRequest(c, audit.EventDeviceCredentials, audit.OutcomeFailure, serialNumber)
+		serverutils.WriteError(c, 500, "Failed to decrypt auth token", err.Error())
+		return
+	}
+
+	audit.RecordRequest(c, audit.EventDeviceCredentials, audit.OutcomeSuccess, serialNumber)
+
+	serverutils.WriteJSON(c, 200, "Device credentials fetched", DeviceCredentialsResponse{
+		DeviceSerialNumber: device.DeviceSerialNumber,
+		AuthToken:          token,
 	})
 }
 
 // Route: PUT /devices/:device_serial_number
+// Route: PUT /customers/:customer_id/devices/:device_serial_number
 // Update a device
 func DeviceUpdate(c *gin.Context) {
 	var body DeviceRequest
@@ -406,9 +466,9 @@ func DeviceUpdate(c *gin.Context) {
 	}
 
 	// Fetch and validate device
-	device, err := FetchDeviceBySerialNumber(bmsDB, serialNumber)
-	if errors.Is(err, gorm.ErrRecordNotFound) {
-		serverutils.WriteError(c, 404, "Device not found", "No device found with the given serial number")
+	device, err := lookupDevice(c, bmsDB, serialNumber)
+	if err != nil {
+		writeDeviceLookupError(c, err)
 		return
 	}
 
@@ -420,14 +480,19 @@ func DeviceUpdate(c *gin.Context) {
 	device.DeviceName = body.DeviceName
 	device.DeviceSerialNumber = body.DeviceSerialNumber
 	device.BuildingURL = body.BuildingURL
-	device.AuthToken = body.AuthToken
+	device.AuthToken, err = devicetoken.Seal(body.AuthToken)
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to encrypt auth token", err.Error())
+		return
+	}
 
 	if err := bmsDB.DB.Save(&device).Error; err != nil {
 		serverutils.WriteError(c, 500, "Failed to update device", err.Error())
 		return
 	}
+	recordDeviceChanges(c, device.SiteID)
 
-	serverutils.WriteJSON(c, 200, "Device updated", DeviceResponse{
+	response := DeviceResponse{
 		ID:                     device.ID,
 		CustomerID:             device.Site.Customer.ID,
 		CustomerName:           device.Site.Customer.Name,
@@ -440,11 +505,18 @@ func DeviceUpdate(c *gin.Context) {
 		DeviceName:             device.DeviceName,
 		DeviceSerialNumber:     device.DeviceSerialNumber,
 		BuildingURL:            device.BuildingURL,
-		AuthToken:              device.AuthToken,
-	})
+		FirmwareVersion:        device.FirmwareVersion,
+		HardwareRevision:       device.HardwareRevision,
+		AuthToken:              devicetoken.MaskStored(device.AuthToken),
+	}
+	if omitsDeviceTokens(c) {
+		response.AuthToken = ""
+	}
+	serverutils.WriteJSON(c, 200, "Device updated", response)
 }
 
 // Route: DELETE /devices/:device_serial_number
+// Route: DELETE /customers/:customer_id/devices/:device_serial_number
 // Delete a device
 func DeviceDelete(c *gin.Context) {
 	serialNumber := c.Param("device_serial_number")
@@ -455,30 +527,728 @@ func DeviceDelete(c *gin.Context) {
 		return
 	}
 
-	// Fetch and validate device
-	device, err := FetchDeviceBySerialNumber(bmsDB, serialNumber)
-	if errors.Is(err, gorm.ErrRecordNotFound) {
-		serverutils.WriteError(c, 404, "Device not found", "No device found with the given serial number")
+	// Fetch and validate device. Deleting it again would overwrite who deleted it and when.
+	device, err := lookupDevice(c, bmsDB, serialNumber)
+	if err == nil && device.DeletedAt.Valid {
+		err = gorm.ErrRecordNotFound
+	}
+	if err != nil {
+		writeDeviceLookupError(c, err)
 		return
 	}
 
-	// Soft-delete the device
-	if err := bmsDB.DB.Delete(&device).Error; err != nil {
+	// Soft-delete the device, recording who deleted it
+	if err := softDeleteDevices(bmsDB.DB, c.GetString("customer_id"), device.ID); err != nil {
 		serverutils.WriteError(c, 500, "Failed to delete device", err.Error())
 		return
 	}
+	recordDeviceChanges(c, device.SiteID)
 
 	serverutils.WriteJSON(c, 200, "Device deleted", nil)
 }
 
+// Route: DELETE /devices/:device_serial_number/purge
+// Permanently delete a soft-deleted device, freeing its serial number.
+// Its status history and uptime rollups are kept for reporting.
+func DevicePurge(c *gin.Context) {
+	serialNumber := c.Param("device_serial_number")
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	found, err := lookupDevice(c, bmsDB, serialNumber)
+	if err != nil {
+		writeDeviceLookupError(c, err)
+		return
+	}
+
+	var device models.Device
+	err = bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ?", found.ID).
+			First(&device).Error; err != nil {
+			return err
+		}
+
+		if !device.DeletedAt.Valid {
+			return errDeviceNotDeleted
+		}
+
+		// Remove the rows that describe the device itself rather than its history
+		for _, model := range []any{&models.DeviceStatus{}, &models.DeviceMeter{}, &models.PointAddress{}, &models.PointReading{}, &models.DeviceTag{}} {
+			if err := tx.Unscoped().Where("device_id = ?", device.ID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Unscoped().Where("upstream_device_id = ? OR downstream_device_id = ?", device.ID, device.ID).
+			Delete(&models.DeviceDependency{}).Error; err != nil {
+			return err
+		}
+
+		return tx.Unscoped().Delete(&device).Error
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		serverutils.WriteError(c, 404, "Device not found", "No device found with the given serial number")
+		return
+	case errors.Is(err, errDeviceNotDeleted):
+		serverutils.WriteError(c, 409, "Device is not deleted", "Only deleted devices can be purged, delete the device first")
+		return
+	case err != nil:
+		serverutils.WriteError(c, 500, "Failed to purge device", err.Error())
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Device purged", nil)
+}
+
+type DeletedDeviceResponse struct {
+	DeviceResponse
+	DeletedAt timefmt.Time `json:"deleted_at"`
+	DeletedBy *string      `json:"deleted_by"`
+}
+
+// Route: GET /devices/deleted
+// Fetch the soft-deleted devices, most recently deleted first
+func DeviceFetchDeleted(c *gin.Context) {
+	pagination, err := serverutils.ParsePagination(c)
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid pagination", err.Error())
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	// The site or customer may have been deleted along with the device
+	query := bmsDB.DB.Table("devices").
+		Select(`devices.id, customers.id AS customer_id, customers.name AS customer_name,
+			devices.site_id, sites.name AS site_name, devices.gateway, devices.controller,
+			devices.controller_serial_number, devices.device_type, devices.device_name,
+			devices.device_serial_number, devices.building_url, devices.firmware_version,
+			devices.hardware_revision, devices.auth_token,
+			devices.deleted_at, devices.deleted_by`).
+		Joins("LEFT JOIN sites ON sites.id = devices.site_id").
+		Joins("LEFT JOIN customers ON customers.id = sites.customer_id").
+		Where("devices.deleted_at IS NOT NULL").
+		Order("devices.deleted_at DESC, devices.device_serial_number")
+
+	query = filterDeviceList(c, query)
+
+	if pagination != nil {
+		query, err = pagination.Apply(query)
+		if err != nil {
+			serverutils.WriteError(c, 500, "Failed to count devices", err.Error())
+			return
+		}
+	}
+
+	response := []DeletedDeviceResponse{}
+	if err := query.Scan(&response).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch devices", err.Error())
+		return
+	}
+	for i := range response {
+		response[i].AuthToken = devicetoken.MaskStored(response[i].AuthToken)
+	}
+
+	serverutils.WriteJSONPage(c, 200, "Deleted devices fetched", response, pagination)
+}
+
+var (
+	// errDeviceNotDeleted is returned when restoring a device that has not been deleted
+	errDeviceNotDeleted = errors.New("device is not deleted")
+
+	// errDeviceSiteDeleted is returned when restoring a device whose site has been deleted
+	errDeviceSiteDeleted = errors.New("site of device is deleted")
+)
+
+// Route: POST /devices/:device_serial_number/restore
+// Restore a soft-deleted device
+func DeviceRestore(c *gin.Context) {
+	serialNumber := c.Param("device_serial_number")
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	found, err := lookupDevice(c, bmsDB, serialNumber)
+	if err != nil {
+		writeDeviceLookupError(c, err)
+		return
+	}
+
+	var device models.Device
+	err = bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id = ?", found.ID).
+			First(&device).Error; err != nil {
+			return err
+		}
+
+		if !device.DeletedAt.Valid {
+			return errDeviceNotDeleted
+		}
+
+		if _, err := fetchAttachableSite(&devicesdb.BMS_DB{DB: tx}, device.SiteID.String()); errors.Is(err, gorm.ErrRecordNotFound) {
+			return errDeviceSiteDeleted
+		} else if err != nil {
+			return err
+		}
+
+		device.DeletedAt, device.DeletedBy = gorm.DeletedAt{}, nil
+		return tx.Unscoped().Model(&device).Updates(map[string]any{"deleted_at": nil, "deleted_by": nil}).Error
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		serverutils.WriteError(c, 404, "Device not found", "No device found with the given serial number")
+		return
+	case errors.Is(err, errDeviceNotDeleted):
+		serverutils.WriteError(c, 409, "Device is not deleted", "The device with the given serial number has not been deleted")
+		return
+	case errors.Is(err, errDeviceSiteDeleted), errors.Is(err, errSiteDeleted):
+		serverutils.WriteError(c, 422, "Site is deleted", "The site of the device has been deleted, restore the site first")
+		return
+	case err != nil:
+		writeAttachError(c, err, "Failed to restore device")
+		return
+	}
+	recordDeviceChanges(c, device.SiteID)
+
+	if err := fillDeviceSite(bmsDB, &device); err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch site", err.Error())
+		return
+	}
+
+	response := DeviceResponse{
+		ID:                     device.ID,
+		CustomerID:             device.Site.Customer.ID,
+		CustomerName:           device.Site.Customer.Name,
+		SiteID:                 device.Site.ID,
+		SiteName:               device.Site.Name,
+		Gateway:                device.Gateway,
+		Controller:             device.Controller,
+		ControllerSerialNumber: device.ControllerSerialNumber,
+		DeviceType:             device.DeviceType,
+		DeviceName:             device.DeviceName,
+		DeviceSerialNumber:     device.DeviceSerialNumber,
+		BuildingURL:            device.BuildingURL,
+		FirmwareVersion:        device.FirmwareVersion,
+		HardwareRevision:       device.HardwareRevision,
+		AuthToken:              devicetoken.MaskStored(device.AuthToken),
+	}
+	if omitsDeviceTokens(c) {
+		response.AuthToken = ""
+	}
+	serverutils.WriteJSON(c, 200, "Device restored", response)
+}
+
+type DeviceBulkDeleteRequest struct {
+	CustomerID    string   `json:"customer_id"`
+	SerialNumbers []string `json:"serial_numbers"`
+}
+
+type DeviceBulkDeleteResponse struct {
+	Deleted  []string `json:"deleted"`
+	NotFound []string `json:"not_found"`
+}
+
+// errDevicesAmbiguous is returned when bulk deleting serial numbers shared by several customers
+var errDevicesAmbiguous = errors.New("serial numbers are used by several customers")
+
+// Route: DELETE /devices
+// Soft-delete the devices with the given serial numbers in a single transaction. Serial numbers
+// shared by several customers are only deleted for the customer given in customer_id.
+func DeviceBulkDelete(c *gin.Context) {
+	var body DeviceBulkDeleteRequest
+	if err := c.BindJSON(&body); err != nil || len(body.SerialNumbers) == 0 {
+		serverutils.WriteError(c, 400, "Invalid request body", "serial_numbers must list at least one device")
+		return
+	}
+
+	if body.CustomerID != "" && !serverutils.IsValidUUID(body.CustomerID) {
+		serverutils.WriteError(c, 400, "Invalid customer ID", "Invalid UUID format")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	response := DeviceBulkDeleteResponse{Deleted: []string{}, NotFound: []string{}}
+	var ambiguous []string
+
+	err := bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		query := tx.Select("id", "device_serial_number").Where("device_serial_number IN ?", body.SerialNumbers)
+		if body.CustomerID != "" {
+			query = query.Where("customer_id = ?", body.CustomerID)
+		}
+
+		var found []models.Device
+		if err := query.Find(&found).Error; err != nil {
+			return err
+		}
+
+		existing := make(map[string]bool, len(found))
+		ids := make([]uuid.UUID, len(found))
+		for i, device := range found {
+			if existing[device.DeviceSerialNumber] {
+				ambiguous = append(ambiguous, device.DeviceSerialNumber)
+			}
+			existing[device.DeviceSerialNumber] = true
+			ids[i] = device.ID
+		}
+
+		// Nothing is deleted unless every serial number names a single device
+		if len(ambiguous) > 0 {
+			return errDevicesAmbiguous
+		}
+
+		if len(ids) > 0 {
+			if err := softDeleteDevices(tx, c.GetString("customer_id"), ids...); err != nil {
+				return err
+			}
+		}
+
+		// Report each requested serial number once, in request order
+		reported := make(map[string]bool, len(body.SerialNumbers))
+		for _, serialNumber := range body.SerialNumbers {
+			if reported[serialNumber] {
+				continue
+			}
+			reported[serialNumber] = true
+
+			if existing[serialNumber] {
+				response.Deleted = append(response.Deleted, serialNumber)
+			} else {
+				response.NotFound = append(response.NotFound, serialNumber)
+			}
+		}
+
+		return nil
+	})
+	if errors.Is(err, errDevicesAmbiguous) {
+		slices.Sort(ambiguous)
+		serverutils.WriteError(c, 409, "Devices are ambiguous",
+			"Serial numbers used by several customers, select the customer with customer_id: "+strings.Join(slices.Compact(ambiguous), ", "))
+		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to delete devices", err.Error())
+		return
+	}
+	serverutils.AfterCommit(c, func() {
+		cache.SiteDevices().Clear()
+		changes.RecordAll()
+	})
+
+	serverutils.WriteJSON(c, 200, "Devices deleted", response)
+}
+
 // =====================================================================================================================
 
+// DeviceListQuery returns a query that joins devices with their site and customer,
+// producing flattened rows that scan directly into DeviceResponse
+func DeviceListQuery(bmsDB *devicesdb.BMS_DB) *gorm.DB {
+	return bmsDB.DB.Table("devices").
+		Select(`devices.id, customers.id AS customer_id, customers.name AS customer_name,
+			sites.id AS site_id, sites.name AS site_name, devices.gateway, devices.controller,
+			devices.controller_serial_number, devices.device_type, devices.device_name,
+			devices.device_serial_number, devices.building_url, devices.firmware_version,
+			devices.hardware_revision, devices.auth_token`).
+		Joins("JOIN sites ON sites.id = devices.site_id AND sites.deleted_at IS NULL").
+		Joins("JOIN customers ON customers.id = sites.customer_id AND customers.deleted_at IS NULL").
+		Where("devices.deleted_at IS NULL").
+		Order("devices.device_serial_number")
+}
+
+// likeEscaper escapes the LIKE wildcards in user input
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// deviceListFilters lists the query parameters the device lists can be filtered on, in a
+// fixed order so the generated statements can be reused
+var deviceListFilters = []string{"device_type", "gateway", "controller", "firmware_version", "hardware_revision"}
+
+// filterDeviceList narrows the device list query to the device_type, gateway, controller,
+// firmware_version and hardware_revision query parameters, and to the devices carrying every tag
+// given in a tag query parameter
+func filterDeviceList(c *gin.Context, query *gorm.DB) *gorm.DB {
+	return filterDevices(c.Request.URL.Query(), query)
+}
+
+// filterDevices narrows the device list query to the filters of the parameters, see filterDeviceList
+func filterDevices(params url.Values, query *gorm.DB) *gorm.DB {
+	for _, param := range deviceListFilters {
+		if value := strings.TrimSpace(params.Get(param)); value != "" {
+			query = query.Where("devices."+param+" = ?", value)
+		}
+	}
+
+	for _, tag := range params["tag"] {
+		name, _ := normalizeTagName(tag)
+		query = query.Where(`devices.id IN (SELECT device_tags.device_id FROM device_tags
+			JOIN tags ON tags.id = device_tags.tag_id AND tags.deleted_at IS NULL WHERE tags.name = ?)`, name)
+	}
+	return query
+}
+
+// maskDeviceTokens replaces the stored auth tokens of the devices with their masked values
+func maskDeviceTokens(devices []DeviceResponse) {
+	for i := range devices {
+		devices[i].AuthToken = devicetoken.MaskStored(devices[i].AuthToken)
+	}
+}
+
+// omitsDeviceTokens reports whether the client opted in to device responses without the deprecated
+// auth_token field, adding the deprecation warning to the response when it did not
+func omitsDeviceTokens(c *gin.Context) bool {
+	if serverutils.FeatureEnabled(c, serverutils.FeatureOmitAuthToken) {
+		return true
+	}
+	serverutils.AddWarning(c, AuthTokenDeprecation)
+	return false
+}
+
+// clearDeviceTokens clears the auth tokens of the devices, leaving the field out of the response
+func clearDeviceTokens(devices []DeviceResponse) {
+	for i := range devices {
+		devices[i].AuthToken = ""
+	}
+}
+
+// writeCachedSiteDevices writes the device list of the site from the per-site response cache,
+// answering 304 Not Modified when the client already has the current list. Lists without auth
+// tokens are cached as a variant of the list.
+func writeCachedSiteDevices(c *gin.Context, bmsDB *devicesdb.BMS_DB, siteID uuid.UUID) {
+	key := siteID.String()
+	omitTokens := serverutils.FeatureEnabled(c, serverutils.FeatureOmitAuthToken)
+	if omitTokens {
+		key = cache.VariantKey(key, serverutils.FeatureOmitAuthToken)
+	}
+
+	body, etag, err := cache.SiteDevices().Get(key, func() ([]byte, error) {
+		var response []DeviceResponse
+		if err := DeviceListQuery(bmsDB).Where("devices.site_id = ?", siteID).Scan(&response).Error; err != nil {
+			return nil, err
+		}
+		maskDeviceTokens(response)
+
+		rendered := serverutils.Response{Status: 200, Message: "Devices fetched", Data: response}
+		if omitTokens {
+			clearDeviceTokens(response)
+		} else {
+			rendered.Warnings = []string{AuthTokenDeprecation}
+		}
+		return json.Marshal(rendered)
+	})
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch devices", err.Error())
+		return
+	}
+
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "no-cache")
+
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(304)
+		return
+	}
+
+	c.Data(200, "application/json; charset=utf-8", body)
+}
+
+// etagMatches reports whether the If-None-Match header lists the ETag
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeDeviceList writes the devices matched by the query, paginated if the client asked for a page
+func writeDeviceList(c *gin.Context, bmsDB *devicesdb.BMS_DB, query *gorm.DB) {
+	pagination, err := serverutils.ParsePagination(c)
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid pagination", err.Error())
+		return
+	}
+
+	query = filterDeviceList(c, query)
+
+	if pagination != nil {
+		query, err = pagination.Apply(query)
+		if err != nil {
+			serverutils.WriteError(c, 500, "Failed to count devices", err.Error())
+			return
+		}
+	}
+
+	var response []DeviceResponse
+	if err := query.Scan(&response).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch devices", err.Error())
+		return
+	}
+	maskDeviceTokens(response)
+	if omitsDeviceTokens(c) {
+		clearDeviceTokens(response)
+	}
+
+	serverutils.WriteJSONPage(c, 200, "Devices fetched", response, pagination)
+}
+
+// streamFlushInterval is the number of streamed rows written between flushes
+const streamFlushInterval = 100
+
+// streamDevices writes the rows of the query as JSON Lines, reading them from the DB cursor
+// one at a time so the full result set is never buffered in memory
+func streamDevices(c *gin.Context, bmsDB *devicesdb.BMS_DB, query *gorm.DB) {
+	encoder := json.NewEncoder(c.Writer)
+	streamDeviceRows(c, bmsDB, query, serverutils.NDJSONContentType, nil, func(device DeviceResponse) error {
+		return encoder.Encode(device)
+	})
+}
+
+// deviceCSVHeader lists the columns of the device inventory export
+var deviceCSVHeader = []string{
+	"id", "customer_id", "customer_name", "site_id", "site_name", "gateway", "controller",
+	"controller_serial_number", "device_type", "device_name", "device_serial_number", "building_url",
+	"firmware_version", "hardware_revision",
+}
+
+// exportDevicesCSV streams the rows of the query as CSV, omitting the device auth tokens
+func exportDevicesCSV(c *gin.Context, bmsDB *devicesdb.BMS_DB, query *gorm.DB, filename string) {
+	w := csv.NewWriter(c.Writer)
+
+	writeHeader := func() error {
+		c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		w.Write(deviceCSVHeader)
+		w.Flush()
+		return w.Error()
+	}
+
+	streamDeviceRows(c, bmsDB, query, "text/csv; charset=utf-8", writeHeader, func(device DeviceResponse) error {
+		writeDeviceCSVRow(w, device)
+		w.Flush()
+		return w.Error()
+	})
+}
+
+// writeDeviceCSVRow writes a device in the columns of deviceCSVHeader
+func writeDeviceCSVRow(w *csv.Writer, device DeviceResponse) {
+	w.Write([]string{
+		device.ID.String(),
+		device.CustomerID.String(),
+		device.CustomerName,
+		device.SiteID.String(),
+		device.SiteName,
+		device.Gateway,
+		device.Controller,
+		device.ControllerSerialNumber,
+		device.DeviceType,
+		device.DeviceName,
+		device.DeviceSerialNumber,
+		device.BuildingURL,
+		device.FirmwareVersion,
+		device.HardwareRevision,
+	})
+}
+
+// streamDeviceRows reads the rows of the query from the DB cursor one at a time and writes each
+// with write, so the full result set is never buffered in memory. The optional header is written
+// once the query has succeeded, before the first row.
+func streamDeviceRows(c *gin.Context, bmsDB *devicesdb.BMS_DB, query *gorm.DB, contentType string, header func() error, write func(DeviceResponse) error) {
+	rows, err := query.Rows()
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch devices", err.Error())
+		return
+	}
+	defer rows.Close()
+
+	c.Header("Content-Type", contentType)
+	c.Status(200)
+
+	logger := logging.GetLogger("api-server")
+
+	if header != nil {
+		if err := header(); err != nil {
+			logger.Warn("Failed to stream devices", zap.Error(err))
+			return
+		}
+	}
+
+	count := 0
+	for rows.Next() {
+		var device DeviceResponse
+		if err := bmsDB.DB.ScanRows(rows, &device); err != nil {
+			logger.Error("Failed to scan device row", zap.Error(err))
+			return
+		}
+		device.AuthToken = devicetoken.MaskStored(device.AuthToken)
+
+		// The client has gone away, stop reading from the cursor
+		if err := write(device); err != nil {
+			logger.Warn("Failed to stream device", zap.Error(err))
+			return
+		}
+
+		count++
+		if count%streamFlushInterval == 0 {
+			c.Writer.Flush()
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		logger.Error("Failed to iterate device rows", zap.Error(err))
+	}
+
+	c.Writer.Flush()
+}
+
+// softDeleteDevices soft-deletes the devices with the IDs, recording who deleted them
+func softDeleteDevices(db *gorm.DB, deletedBy string, ids ...uuid.UUID) error {
+	var by *string
+	if deletedBy != "" {
+		by = &deletedBy
+	}
+
+	return db.Model(&models.Device{}).
+		Where("id IN ?", ids).
+		Updates(map[string]any{"deleted_at": time.Now(), "deleted_by": by}).Error
+}
+
+// deviceSerialScope is the scope device serial numbers are unique within
+var deviceSerialScope = models.SerialScopeGlobal
+
+// SetDeviceSerialScope sets the scope device serial numbers are unique within
+func SetDeviceSerialScope(scope string) {
+	deviceSerialScope = scope
+}
+
+// ErrDeviceAmbiguous is returned when a serial number is shared by the devices of several customers
+var ErrDeviceAmbiguous = errors.New("serial number is used by several customers")
+
 // Fetch a device by serial number
 func FetchDeviceBySerialNumber(bmsDB *devicesdb.BMS_DB, serialNumber string) (*models.Device, error) {
-	var device models.Device
-	result := bmsDB.DB.Debug().Unscoped().Preload("Site.Customer").Where("device_serial_number = ?", serialNumber).First(&device)
-	if result.Error != nil {
-		return nil, result.Error
+	return fetchDevice(bmsDB, serialNumber, "")
+}
+
+// Fetch a device of a customer by serial number
+func FetchCustomerDeviceBySerialNumber(bmsDB *devicesdb.BMS_DB, customerID, serialNumber string) (*models.Device, error) {
+	return fetchDevice(bmsDB, serialNumber, customerID)
+}
+
+// fetchDevice fetches the device with the serial number, limited to the customer if one is given
+func fetchDevice(bmsDB *devicesdb.BMS_DB, serialNumber, customerID string) (*models.Device, error) {
+	start := time.Now()
+
+	query := bmsDB.DB.Unscoped().Where("device_serial_number = ?", serialNumber)
+	if customerID != "" {
+		query = query.Where("customer_id = ?", customerID)
+	}
+
+	// Fetch a second device to detect serial numbers shared between customers
+	var devices []models.Device
+	err := query.Limit(2).Find(&devices).Error
+	switch {
+	case err != nil:
+	case len(devices) == 0:
+		err = gorm.ErrRecordNotFound
+	case len(devices) > 1:
+		err = ErrDeviceAmbiguous
+	default:
+		// Decorate the device with its site and customer from the name cache
+		err = fillDeviceSite(bmsDB, &devices[0])
+	}
+
+	// Log the lookup duration so the effect of statement caching can be measured
+	logging.GetLogger("api-server").Debug("Fetched device by serial number",
+		zap.String("serialNumber", serialNumber),
+		zap.Duration("duration", time.Since(start)),
+		zap.Int("preparedStatements", bmsDB.PreparedStatementCount()),
+	)
+
+	if err != nil {
+		return nil, err
 	}
-	return &device, nil
+	return &devices[0], nil
+}
+
+// fetchExistingDevice fetches the device a new device of the customer would collide with
+func fetchExistingDevice(bmsDB *devicesdb.BMS_DB, customerID uuid.UUID, serialNumber string) (*models.Device, error) {
+	if deviceSerialScope == models.SerialScopeCustomer {
+		return FetchCustomerDeviceBySerialNumber(bmsDB, customerID.String(), serialNumber)
+	}
+	return FetchDeviceBySerialNumber(bmsDB, serialNumber)
+}
+
+// lookupDevice fetches the device named by the route. Routes under a customer and, when serial
+// numbers are scoped per customer, requests made by customers only match that customer's devices.
+// Admins select the customer of a shared serial number with ?customer_id= on other routes.
+func lookupDevice(c *gin.Context, bmsDB *devicesdb.BMS_DB, serialNumber string) (*models.Device, error) {
+	customerID := c.Param("customer_id")
+	if customerID == "" && c.GetString("role") == "admin" {
+		customerID = c.Query("customer_id")
+	}
+	if customerID == "" && deviceSerialScope == models.SerialScopeCustomer && c.GetString("role") != "admin" {
+		customerID = c.GetString("customer_id")
+	}
+
+	if customerID != "" {
+		return FetchCustomerDeviceBySerialNumber(bmsDB, customerID, serialNumber)
+	}
+	return FetchDeviceBySerialNumber(bmsDB, serialNumber)
+}
+
+// recordDeviceChanges invalidates the cached devices of the site once the request commits, and
+// records the change for pollers
+func recordDeviceChanges(c *gin.Context, siteID uuid.UUID) {
+	serverutils.AfterCommit(c, func() {
+		cache.SiteDevices().Invalidate(siteID.String())
+		changes.RecordSite(siteID.String())
+	})
+}
+
+// writeDeviceLookupError writes the response for a failed device lookup
+func writeDeviceLookupError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		serverutils.WriteError(c, 404, "Device not found", "No device found with the given serial number")
+	case errors.Is(err, ErrDeviceAmbiguous):
+		serverutils.WriteError(c, 409, "Device is ambiguous",
+			"The serial number is used by several customers, select the customer with ?customer_id=")
+	default:
+		serverutils.WriteError(c, 500, "Failed to fetch device", err.Error())
+	}
+}
+
+// fillDeviceSite sets the site and customer of the device from the name cache,
+// leaving them empty if the site or customer has been deleted
+func fillDeviceSite(bmsDB *devicesdb.BMS_DB, device *models.Device) error {
+	site, err := cache.Names().Site(bmsDB, device.SiteID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	customer, err := cache.Names().Customer(bmsDB, site.CustomerID)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	site.Customer = customer
+	device.Site = site
+	return nil
 }
@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// energyDayLayout is the layout of the daily rollup periods and their query parameters
+const energyDayLayout = "2006-01-02"
+
+// meterUnitKWh converts a quantity in a meter unit to kWh
+var meterUnitKWh = map[string]float64{
+	"Wh":  0.001,
+	"kWh": 1,
+	"MWh": 1000,
+}
+
+// energyInterval describes the periods a site's energy is rolled up into
+type energyInterval struct {
+	name           string
+	layout         string
+	months         int
+	days           int
+	defaultPeriods int
+	maxPeriods     int
+}
+
+var (
+	dailyEnergy   = energyInterval{name: "daily", layout: energyDayLayout, days: 1, defaultPeriods: 30, maxPeriods: 366}
+	monthlyEnergy = energyInterval{name: "monthly", layout: billingMonthLayout, months: 1, defaultPeriods: 12, maxPeriods: 120}
+)
+
+type EnergyRollup struct {
+	Period string  `json:"period"`
+	KWh    float64 `json:"kwh"`
+}
+
+type SiteEnergyResponse struct {
+	SiteID   uuid.UUID      `json:"site_id"`
+	SiteName string         `json:"site_name"`
+	Interval string         `json:"interval"`
+	TotalKWh float64        `json:"total_kwh"`
+	Rollups  []EnergyRollup `json:"rollups"`
+}
+
+// Route: GET /sites/:site_id/energy/daily
+// Fetch the kWh the meters of a site registered on each day, oldest first. The rollup covers the
+// last 30 days unless ?from= and ?to= (YYYY-MM-DD, inclusive) are given. Days are in UTC, and only
+// meters with a register point contribute.
+func SiteEnergyDaily(c *gin.Context) {
+	siteEnergy(c, dailyEnergy)
+}
+
+// Route: GET /sites/:site_id/energy/monthly
+// Fetch the kWh the meters of a site registered in each month, oldest first. The rollup covers the
+// last 12 months unless ?from= and ?to= (YYYY-MM, inclusive) are given.
+func SiteEnergyMonthly(c *gin.Context) {
+	siteEnergy(c, monthlyEnergy)
+}
+
+// =====================================================================================================================
+
+// siteEnergy writes the energy rollups of the site in the route for the periods of the interval
+func siteEnergy(c *gin.Context, interval energyInterval) {
+	siteID := c.Param("site_id")
+
+	// Validate the site ID
+	if !serverutils.IsValidUUID(siteID) {
+		serverutils.WriteError(c, 400, "Invalid site ID", "Invalid UUID format")
+		return
+	}
+
+	current, _ := time.Parse(interval.layout, time.Now().UTC().Format(interval.layout))
+
+	to, err := parseEnergyPeriod(c, "to", interval, current)
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid to", err.Error())
+		return
+	}
+
+	from, err := parseEnergyPeriod(c, "from", interval, interval.step(to, 1-interval.defaultPeriods))
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid from", err.Error())
+		return
+	}
+
+	if from.After(to) {
+		serverutils.WriteError(c, 400, "Invalid time range", "from must not be after to")
+		return
+	}
+
+	var periods []time.Time
+	for period := from; !period.After(to); period = interval.step(period, 1) {
+		if len(periods) == interval.maxPeriods {
+			serverutils.WriteError(c, 400, "Invalid time range", fmt.Sprintf("The range can cover at most %d periods", interval.maxPeriods))
+			return
+		}
+		periods = append(periods, period)
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	site, err := FetchSiteByID(bmsDB, siteID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 404, "Site not found", "No site found with the given ID")
+		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch site", err.Error())
+		return
+	}
+
+	if c.GetString("role") != "admin" && site.CustomerID.String() != c.GetString("customer_id") {
+		serverutils.WriteError(c, 403, "Forbidden", "You are not authorized to access this site")
+		return
+	}
+
+	var days []struct {
+		Day   time.Time
+		Total float64
+	}
+	if err := bmsDB.DB.Model(&models.DeviceEnergyRollup{}).
+		Select("day, SUM(kwh) AS total").
+		Where("site_id = ? AND day >= ? AND day < ?", site.ID, from, interval.step(to, 1)).
+		Group("day").
+		Scan(&days).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch site energy", err.Error())
+		return
+	}
+
+	totals := make(map[string]float64, len(periods))
+	for _, day := range days {
+		totals[day.Day.UTC().Format(interval.layout)] += day.Total
+	}
+
+	// Periods without readings are listed with no energy so the rollup has no gaps
+	response := SiteEnergyResponse{SiteID: site.ID, SiteName: site.Name, Interval: interval.name, Rollups: make([]EnergyRollup, len(periods))}
+	for i, period := range periods {
+		key := period.Format(interval.layout)
+		response.Rollups[i] = EnergyRollup{Period: key, KWh: roundKWh(totals[key])}
+		response.TotalKWh += totals[key]
+	}
+	response.TotalKWh = roundKWh(response.TotalKWh)
+
+	serverutils.WriteJSON(c, 200, "Site energy fetched", response)
+}
+
+// step returns the period n periods after the given one
+func (i energyInterval) step(period time.Time, n int) time.Time {
+	return period.AddDate(0, i.months*n, i.days*n)
+}
+
+// parseEnergyPeriod parses the period in the query parameter, returning the fallback when it is not given
+func parseEnergyPeriod(c *gin.Context, name string, interval energyInterval, fallback time.Time) (time.Time, error) {
+	value := c.Query(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	period, err := time.Parse(interval.layout, value)
+	if err != nil {
+		if interval.layout == billingMonthLayout {
+			return time.Time{}, errors.New("must be formatted as YYYY-MM")
+		}
+		return time.Time{}, errors.New("must be formatted as YYYY-MM-DD")
+	}
+	return period, nil
+}
+
+// roundKWh rounds the energy to the Wh, hiding the error of summing floats
+func roundKWh(kwh float64) float64 {
+	return math.Round(kwh*1000) / 1000
+}
+
+// meterEnergy converts an increase of the meter's register into kWh
+func meterEnergy(meter models.DeviceMeter, increase float64) float64 {
+	if meter.PulseConstant > 0 {
+		increase /= meter.PulseConstant
+	}
+	return increase * meter.Multiplier * meterUnitKWh[meter.Unit]
+}
+
+// rollupEnergy adds the increase of the device's meter register since its last reading to the energy
+// rollup of the day of the new reading. It must run before the readings are saved. The first reading
+// of a register only sets the baseline, and a register that went backwards was reset or replaced, so
+// neither adds energy.
+func rollupEnergy(tx *gorm.DB, device *models.Device, readings []models.PointReading) error {
+	var meter models.DeviceMeter
+	err := tx.Where("device_id = ?", device.ID).First(&meter).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if meter.RegisterPoint == "" {
+		return nil
+	}
+
+	var reading *models.PointReading
+	for i := range readings {
+		if readings[i].PointName == meter.RegisterPoint {
+			reading = &readings[i]
+			break
+		}
+	}
+	if reading == nil {
+		return nil
+	}
+
+	// Locked so concurrent reports of the device do not both count the same increase
+	var previous models.PointReading
+	err = tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("device_id = ? AND point_name = ?", device.ID, meter.RegisterPoint).
+		First(&previous).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	increase := reading.Value - previous.Value
+	if increase <= 0 || !reading.ReportedAt.After(previous.ReportedAt) {
+		return nil
+	}
+
+	rollup := models.DeviceEnergyRollup{
+		DeviceID:           device.ID,
+		DeviceSerialNumber: device.DeviceSerialNumber,
+		SiteID:             device.SiteID,
+		Day:                reading.ReportedAt.UTC().Truncate(24 * time.Hour),
+		KWh:                meterEnergy(meter, increase),
+	}
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "device_id"}, {Name: "site_id"}, {Name: "day"}},
+		DoUpdates: clause.Assignments(map[string]any{"kwh": gorm.Expr("kwh + ?", rollup.KWh), "updated_at": time.Now()}),
+	}).Create(&rollup).Error
+}
@@ -0,0 +1,452 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/audit"
+	"github.com/johandrevandeventer/devices-api-server/internal/changes"
+	"github.com/johandrevandeventer/devices-api-server/internal/devicetoken"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/internal/timefmt"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"gorm.io/gorm"
+)
+
+// customerExportVersion is the version of the customer export document, raised whenever a change
+// to it could not be imported by an older server
+const customerExportVersion = 1
+
+// CustomerExportDocument is a customer with all its sites, devices and tokens, as moved between environments.
+// Device auth tokens are exported in plain text so they can be sealed with the key of the importing
+// environment. Token JWTs are signed per environment and are issued again on import.
+type CustomerExportDocument struct {
+	FormatVersion int                   `json:"format_version"`
+	ExportedAt    timefmt.Time          `json:"exported_at"`
+	Customer      CustomerRequest       `json:"customer"`
+	Sites         []CustomerExportSite  `json:"sites"`
+	Tokens        []CustomerExportToken `json:"tokens"`
+}
+
+type CustomerExportSite struct {
+	SiteRequest
+	Devices []CustomerExportDevice `json:"devices"`
+}
+
+type CustomerExportDevice struct {
+	DeviceRequest
+	FirmwareVersion  string `json:"firmware_version"`
+	HardwareRevision string `json:"hardware_revision"`
+}
+
+// CustomerExportToken is a token of the customer, scoped to the named site when one is given
+type CustomerExportToken struct {
+	SiteName       string   `json:"site_name,omitempty"`
+	Action         string   `json:"action"`
+	AllowedCIDRs   []string `json:"allowed_cidrs,omitempty"`
+	CertThumbprint string   `json:"cert_thumbprint,omitempty"`
+}
+
+type CustomerImportResponse struct {
+	Customer CustomerResponse      `json:"customer"`
+	Sites    int                   `json:"sites"`
+	Devices  int                   `json:"devices"`
+	Tokens   []CustomerImportToken `json:"tokens"`
+}
+
+type CustomerImportToken struct {
+	SiteName     string `json:"site_name,omitempty"`
+	Action       string `json:"action"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Route: GET /customers/:customer_id/export (Admin Only)
+// Export the customer with all its sites, devices and tokens as one document, which POST
+// /customers/import accepts in another environment. Every export is recorded in the audit log as
+// it holds the device credentials.
+func CustomerExport(c *gin.Context) {
+	customerID := c.Param("customer_id")
+
+	if !serverutils.IsValidUUID(customerID) {
+		serverutils.WriteError(c, 400, "Invalid customer ID", "Invalid UUID format")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	customer, err := FetchCustomerByID(bmsDB, customerID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 404, "Customer not found", "No customer found with the given ID")
+		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch customer", err.Error())
+		return
+	}
+
+	var sites []models.Site
+	if err := bmsDB.DB.Where("customer_id = ?", customer.ID).Order("name").Find(&sites).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch sites", err.Error())
+		return
+	}
+
+	var devices []models.Device
+	if err := bmsDB.DB.Where("customer_id = ?", customer.ID).Order("device_serial_number").Find(&devices).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch devices", err.Error())
+		return
+	}
+
+	var tokens []models.AuthToken
+	if err := bmsDB.DB.Where("customer_id = ?", customer.ID).Order("action").Find(&tokens).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch tokens", err.Error())
+		return
+	}
+
+	export, err := newCustomerExport(*customer, sites, devices, tokens)
+	if err != nil {
+		audit.RecordRequest(c, audit.EventCustomerExported, audit.OutcomeFailure, customer.ID.String())
+		serverutils.WriteError(c, 500, "Failed to decrypt auth token", err.Error())
+		return
+	}
+
+	audit.RecordRequest(c, audit.EventCustomerExported, audit.OutcomeSuccess, customer.ID.String())
+	serverutils.WriteJSON(c, 200, "Customer exported", export)
+}
+
+// Route: POST /customers/import (Admin Only)
+// Create a customer with all its sites, devices and tokens from the document of a customer export.
+// Nothing is created when the customer name, external reference or a device serial number is
+// already taken, and the tokens are issued again for this environment.
+func CustomerImport(c *gin.Context) {
+	var body CustomerExportDocument
+	if err := c.BindJSON(&body); err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", "Invalid JSON format")
+		return
+	}
+
+	if body.FormatVersion != customerExportVersion {
+		serverutils.WriteError(c, 400, "Invalid request body", fmt.Sprintf("format_version must be %d", customerExportVersion))
+		return
+	}
+
+	if reason := invalidCustomerExport(body); reason != "" {
+		serverutils.WriteError(c, 400, "Invalid request body", reason)
+		return
+	}
+
+	contractStart, contractEnd, err := parseContractDates(body.Customer)
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", err.Error())
+		return
+	}
+
+	externalRef, err := parseExternalRef(body.Customer.ExternalRef)
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", err.Error())
+		return
+	}
+
+	bindings := make([]TokenBinding, len(body.Tokens))
+	for i, token := range body.Tokens {
+		if bindings[i], err = NewTokenBinding(token.AllowedCIDRs, token.CertThumbprint); err != nil {
+			serverutils.WriteError(c, 400, "Invalid request body", fmt.Sprintf("token %s: %s", token.Action, err))
+			return
+		}
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	response := CustomerImportResponse{Tokens: make([]CustomerImportToken, 0, len(body.Tokens))}
+	var customer models.Customer
+	var siteIDs []uuid.UUID
+	err = bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		if err := checkCustomerImportConflicts(tx, body, externalRef); err != nil {
+			return err
+		}
+
+		customer = models.Customer{Name: body.Customer.Name, ContractStart: contractStart, ContractEnd: contractEnd, ExternalRef: externalRef}
+		if err := tx.Create(&customer).Error; err != nil {
+			return err
+		}
+
+		sites := make(map[string]uuid.UUID, len(body.Sites))
+		for _, export := range body.Sites {
+			site := siteFromRequest(export.SiteRequest, customer.ID)
+			if err := tx.Omit("Customer").Create(&site).Error; err != nil {
+				return fmt.Errorf("site %s: %w", site.Name, err)
+			}
+			sites[site.Name] = site.ID
+			siteIDs = append(siteIDs, site.ID)
+
+			for _, body := range export.Devices {
+				authToken, err := devicetoken.Seal(body.AuthToken)
+				if err != nil {
+					return err
+				}
+
+				device := models.Device{
+					SiteID:                 site.ID,
+					CustomerID:             customer.ID,
+					Gateway:                body.Gateway,
+					Controller:             body.Controller,
+					ControllerSerialNumber: body.ControllerSerialNumber,
+					DeviceType:             body.DeviceType,
+					DeviceName:             body.DeviceName,
+					DeviceSerialNumber:     body.DeviceSerialNumber,
+					BuildingURL:            body.BuildingURL,
+					FirmwareVersion:        body.FirmwareVersion,
+					HardwareRevision:       body.HardwareRevision,
+					AuthToken:              authToken,
+				}
+				if err := tx.Omit("Site").Create(&device).Error; err != nil {
+					return fmt.Errorf("device %s: %w", device.DeviceSerialNumber, err)
+				}
+				response.Devices++
+			}
+		}
+
+		for i, token := range body.Tokens {
+			var siteID *uuid.UUID
+			if token.SiteName != "" {
+				id := sites[token.SiteName]
+				siteID = &id
+			}
+
+			authToken, err := storeToken(tx, customer, siteID, token.Action, bindings[i])
+			if err != nil {
+				return fmt.Errorf("token %s: %w", token.Action, err)
+			}
+			response.Tokens = append(response.Tokens, CustomerImportToken{SiteName: token.SiteName, Action: token.Action, Token: authToken.Token, RefreshToken: authToken.RefreshToken})
+		}
+
+		return nil
+	})
+
+	var conflict *provisioningConflict
+	if errors.As(err, &conflict) {
+		audit.RecordRequest(c, audit.EventCustomerImported, audit.OutcomeFailure, body.Customer.Name)
+		serverutils.WriteError(c, 409, "Customer cannot be imported", conflict.Error())
+		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to import customer", err.Error())
+		return
+	}
+
+	audit.RecordRequest(c, audit.EventCustomerImported, audit.OutcomeSuccess, customer.ID.String())
+	serverutils.AfterCommit(c, func() {
+		for _, siteID := range siteIDs {
+			changes.RecordSite(siteID.String())
+		}
+	})
+
+	response.Customer = newCustomerResponse(customer)
+	response.Sites = len(siteIDs)
+	serverutils.WriteJSON(c, 201, "Customer imported", response)
+}
+
+// =====================================================================================================================
+
+// newCustomerExport returns the export document of the customer, opening the sealed device auth tokens
+func newCustomerExport(customer models.Customer, sites []models.Site, devices []models.Device, tokens []models.AuthToken) (CustomerExportDocument, error) {
+	export := CustomerExportDocument{
+		FormatVersion: customerExportVersion,
+		ExportedAt:    timefmt.New(time.Now()),
+		Customer: CustomerRequest{
+			Name:          customer.Name,
+			ContractStart: formatContractDate(customer.ContractStart),
+			ContractEnd:   formatContractDate(customer.ContractEnd),
+			ExternalRef:   customer.ExternalRef,
+		},
+		Sites:  make([]CustomerExportSite, len(sites)),
+		Tokens: make([]CustomerExportToken, 0, len(tokens)),
+	}
+
+	index := make(map[uuid.UUID]int, len(sites))
+	for i, site := range sites {
+		index[site.ID] = i
+		export.Sites[i] = CustomerExportSite{
+			SiteRequest: SiteRequest{
+				Name:      site.Name,
+				Address:   site.Address,
+				Latitude:  site.Latitude,
+				Longitude: site.Longitude,
+				Timezone:  site.Timezone,
+			},
+			Devices: []CustomerExportDevice{},
+		}
+	}
+
+	for _, device := range devices {
+		i, ok := index[device.SiteID]
+		if !ok {
+			continue
+		}
+
+		authToken, err := devicetoken.Open(device.AuthToken)
+		if err != nil {
+			return CustomerExportDocument{}, fmt.Errorf("device %s: %w", device.DeviceSerialNumber, err)
+		}
+
+		export.Sites[i].Devices = append(export.Sites[i].Devices, CustomerExportDevice{
+			DeviceRequest: DeviceRequest{
+				Gateway:                device.Gateway,
+				Controller:             device.Controller,
+				ControllerSerialNumber: device.ControllerSerialNumber,
+				DeviceType:             device.DeviceType,
+				DeviceName:             device.DeviceName,
+				DeviceSerialNumber:     device.DeviceSerialNumber,
+				BuildingURL:            device.BuildingURL,
+				AuthToken:              authToken,
+			},
+			FirmwareVersion:  device.FirmwareVersion,
+			HardwareRevision: device.HardwareRevision,
+		})
+	}
+
+	// Tokens of deleted sites are left out, as the site is not exported
+	for _, token := range tokens {
+		exported := CustomerExportToken{Action: token.Action}
+		if token.SiteID != nil {
+			i, ok := index[*token.SiteID]
+			if !ok {
+				continue
+			}
+			exported.SiteName = sites[i].Name
+		}
+		if token.AllowedCIDRs != nil {
+			exported.AllowedCIDRs = strings.Split(*token.AllowedCIDRs, ",")
+		}
+		if token.CertThumbprint != nil {
+			exported.CertThumbprint = *token.CertThumbprint
+		}
+		export.Tokens = append(export.Tokens, exported)
+	}
+
+	return export, nil
+}
+
+// formatContractDate formats a contract date as it is given in requests
+func formatContractDate(date *time.Time) *string {
+	if date == nil {
+		return nil
+	}
+	value := date.Format(contractDateLayout)
+	return &value
+}
+
+// invalidCustomerExport returns why the customer export cannot be imported, or an empty string
+// when its sites, devices and tokens are complete and do not repeat each other
+func invalidCustomerExport(body CustomerExportDocument) string {
+	if body.Customer.Name == "" {
+		return "customer name is required"
+	}
+	if len(body.Customer.Name) > maxNameLength {
+		return fmt.Sprintf("customer name must be at most %d characters", maxNameLength)
+	}
+
+	siteNames := make(map[string]bool, len(body.Sites))
+	serials := make(map[string]bool)
+	for _, site := range body.Sites {
+		if site.Name == "" || len(site.Name) > maxNameLength {
+			return fmt.Sprintf("site names must be 1 to %d characters", maxNameLength)
+		}
+		if siteNames[site.Name] {
+			return fmt.Sprintf("site %s is listed more than once", site.Name)
+		}
+		siteNames[site.Name] = true
+
+		if reason := invalidSiteLocation(site.Address, site.Latitude, site.Longitude, site.Timezone); reason != "" {
+			return fmt.Sprintf("site %s: %s", site.Name, reason)
+		}
+
+		for _, device := range site.Devices {
+			if missing := missingFields(deviceRequiredFields(device.DeviceRequest)); len(missing) > 0 {
+				return fmt.Sprintf("site %s: a device is missing %s", site.Name, strings.Join(missing, ", "))
+			}
+			if serials[device.DeviceSerialNumber] {
+				return fmt.Sprintf("device %s is listed more than once", device.DeviceSerialNumber)
+			}
+			serials[device.DeviceSerialNumber] = true
+		}
+	}
+
+	type tokenScope struct{ site, action string }
+	scopes := make(map[tokenScope]bool, len(body.Tokens))
+	for _, token := range body.Tokens {
+		if !serverutils.IsValidAction(token.Action) {
+			return fmt.Sprintf("token action %s is not allowed", token.Action)
+		}
+		if token.SiteName != "" && !siteNames[token.SiteName] {
+			return fmt.Sprintf("token %s is scoped to site %s, which is not listed", token.Action, token.SiteName)
+		}
+		scope := tokenScope{token.SiteName, token.Action}
+		if scopes[scope] {
+			return fmt.Sprintf("token %s is listed more than once for the same scope", token.Action)
+		}
+		scopes[scope] = true
+	}
+
+	return ""
+}
+
+// checkCustomerImportConflicts returns a provisioningConflict when the customer name, external
+// reference or the device serial numbers of the export are already taken. Deleted customers and
+// devices keep theirs, so they are checked as well.
+func checkCustomerImportConflicts(tx *gorm.DB, body CustomerExportDocument, externalRef *string) error {
+	var count int64
+	if err := tx.Unscoped().Model(&models.Customer{}).Where("name = ?", body.Customer.Name).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return &provisioningConflict{reason: "A customer with this name already exists", items: []string{body.Customer.Name}}
+	}
+
+	if externalRef != nil {
+		if err := tx.Unscoped().Model(&models.Customer{}).Where("external_ref = ?", *externalRef).Count(&count).Error; err != nil {
+			return err
+		}
+		if count > 0 {
+			return &provisioningConflict{reason: "Another customer has this external reference", items: []string{*externalRef}}
+		}
+	}
+
+	// Serial numbers scoped to a customer cannot collide with those of a new customer
+	if deviceSerialScope == models.SerialScopeCustomer {
+		return nil
+	}
+
+	var serials []string
+	for _, site := range body.Sites {
+		for _, device := range site.Devices {
+			serials = append(serials, device.DeviceSerialNumber)
+		}
+	}
+	if len(serials) == 0 {
+		return nil
+	}
+
+	var taken []string
+	if err := tx.Unscoped().Model(&models.Device{}).Where("device_serial_number IN ?", serials).
+		Distinct().Pluck("device_serial_number", &taken).Error; err != nil {
+		return err
+	}
+	if len(taken) > 0 {
+		slices.Sort(taken)
+		return &provisioningConflict{reason: "Devices with these serial numbers already exist", items: taken}
+	}
+
+	return nil
+}
@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/internal/timefmt"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"gorm.io/gorm"
+)
+
+// Lengths of the saved filter name and query columns
+const (
+	maxFilterNameLength  = 64
+	maxFilterQueryLength = 1024
+)
+
+type SavedFilterRequest struct {
+	Name  string `json:"name"`
+	Query string `json:"query"`
+}
+
+type SavedFilterResponse struct {
+	ID        uuid.UUID    `json:"id"`
+	Name      string       `json:"name"`
+	Query     string       `json:"query"`
+	CreatedAt timefmt.Time `json:"created_at"`
+}
+
+// Route: GET /filters
+// Fetch the saved device filters of the requester
+func SavedFilterFetchAll(c *gin.Context) {
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var filters []models.SavedFilter
+	if err := bmsDB.DB.Where("owner = ?", filterOwner(c)).Order("name").Find(&filters).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch filters", err.Error())
+		return
+	}
+
+	response := make([]SavedFilterResponse, len(filters))
+	for i, filter := range filters {
+		response[i] = newSavedFilterResponse(filter)
+	}
+
+	serverutils.WriteJSON(c, 200, "Filters fetched", response)
+}
+
+// Route: POST /filters
+// Save a named device filter, given as the query string of GET /devices, e.g.
+// device_type=chiller&tag=gauteng. Filters are shared by every client of the customer.
+func SavedFilterCreate(c *gin.Context) {
+	var body SavedFilterRequest
+	if err := c.BindJSON(&body); err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", err.Error())
+		return
+	}
+
+	name := strings.TrimSpace(body.Name)
+	if name == "" || len(name) > maxFilterNameLength {
+		serverutils.WriteError(c, 400, "Invalid request body", fmt.Sprintf("name must be 1-%d characters", maxFilterNameLength))
+		return
+	}
+
+	params, reason := parseFilterQuery(body.Query)
+	if reason != "" {
+		serverutils.WriteError(c, 400, "Invalid filter", reason)
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	filter := models.SavedFilter{Owner: filterOwner(c), Name: name, Query: params.Encode()}
+
+	var existing int64
+	if err := bmsDB.DB.Model(&models.SavedFilter{}).Where("owner = ? AND name = ?", filter.Owner, filter.Name).Count(&existing).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to save filter", err.Error())
+		return
+	}
+	if existing > 0 {
+		serverutils.WriteError(c, 400, "Filter already exists", "A filter with this name already exists")
+		return
+	}
+
+	if err := bmsDB.DB.Create(&filter).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to save filter", err.Error())
+		return
+	}
+
+	serverutils.WriteJSON(c, 201, "Filter saved", newSavedFilterResponse(filter))
+}
+
+// Route: DELETE /filters/:filter_id
+// Delete a saved device filter of the requester
+func SavedFilterDelete(c *gin.Context) {
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	filter, ok := fetchSavedFilter(c)
+	if !ok {
+		return
+	}
+
+	// Filters are deleted permanently so their name can be reused
+	if err := bmsDB.DB.Unscoped().Delete(&filter).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to delete filter", err.Error())
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Filter deleted", newSavedFilterResponse(filter))
+}
+
+// Route: GET /filters/:filter_id/devices
+// Fetch the devices matching a saved filter. Filters given as query parameters narrow the list
+// further, and non-admins only see their own devices.
+func SavedFilterDevices(c *gin.Context) {
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	filter, ok := fetchSavedFilter(c)
+	if !ok {
+		return
+	}
+
+	params, err := url.ParseQuery(filter.Query)
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to read filter", err.Error())
+		return
+	}
+
+	query := filterDevices(params, DeviceListQuery(bmsDB))
+	if c.GetString("role") != "admin" {
+		query = query.Where("sites.customer_id = ?", c.GetString("customer_id"))
+	}
+
+	writeDeviceList(c, bmsDB, query)
+}
+
+// =====================================================================================================================
+
+// filterOwner returns the owner of the saved filters of the requester
+func filterOwner(c *gin.Context) string {
+	if c.GetString("role") == "admin" {
+		return models.SavedFilterOwnerAdmin
+	}
+	return c.GetString("customer_id")
+}
+
+// fetchSavedFilter fetches the saved filter of the filter_id route parameter, writing an error
+// response if it is invalid or not one of the requester's filters
+func fetchSavedFilter(c *gin.Context) (models.SavedFilter, bool) {
+	var filter models.SavedFilter
+
+	filterID := c.Param("filter_id")
+	if !serverutils.IsValidUUID(filterID) {
+		serverutils.WriteError(c, 400, "Invalid filter ID", "Invalid UUID format")
+		return filter, false
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return filter, false
+	}
+
+	err := bmsDB.DB.First(&filter, "id = ? AND owner = ?", filterID, filterOwner(c)).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 404, "Filter not found", "No filter found with the given ID")
+		return filter, false
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch filter", err.Error())
+		return filter, false
+	}
+
+	return filter, true
+}
+
+// parseFilterQuery parses the query string of a saved filter, returning why it is invalid if it
+// sets no device list filter or a parameter that is not one
+func parseFilterQuery(query string) (url.Values, string) {
+	query = strings.TrimPrefix(strings.TrimSpace(query), "?")
+	if len(query) > maxFilterQueryLength {
+		return nil, fmt.Sprintf("query must be at most %d characters", maxFilterQueryLength)
+	}
+
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, "query must be a URL query string, e.g. device_type=chiller&tag=gauteng"
+	}
+	if len(params) == 0 {
+		return nil, "query must set at least one filter"
+	}
+
+	allowed := append(slices.Clone(deviceListFilters), "tag")
+	for param := range params {
+		if !slices.Contains(allowed, param) {
+			return nil, fmt.Sprintf("Unknown filter %s, filters are %s", param, strings.Join(allowed, ", "))
+		}
+	}
+	return params, ""
+}
+
+// newSavedFilterResponse returns the saved filter as it is written in responses
+func newSavedFilterResponse(filter models.SavedFilter) SavedFilterResponse {
+	return SavedFilterResponse{
+		ID:        filter.ID,
+		Name:      filter.Name,
+		Query:     filter.Query,
+		CreatedAt: timefmt.New(filter.CreatedAt),
+	}
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/johandrevandeventer/devices-api-server/internal/dbtest"
+)
+
+// fuzzEndpoint is a handler the fuzz tests send malformed requests to, with a valid body to start from
+type fuzzEndpoint struct {
+	method  string
+	route   string
+	handler gin.HandlerFunc
+	body    string
+}
+
+var fuzzEndpoints = []fuzzEndpoint{
+	{method: "POST", route: "/customers", handler: CustomerCreate, body: `{"name": "Acme"}`},
+	{method: "PUT", route: "/customers/:customer_id", handler: CustomerUpdate, body: `{"name": "Acme"}`},
+	{method: "PATCH", route: "/customers/:customer_id", handler: CustomerPatch, body: `{"external_ref": "CRM-1"}`},
+	{method: "PUT", route: "/customers/:customer_id/settings", handler: CustomerSettingsUpdate, body: `{"data_retention_days": 365}`},
+	{method: "POST", route: "/customers/batch-get", handler: CustomerBatchGet, body: `{"ids": ["7d8c7e0e-8f55-4b3a-9a57-0f1f4d1f7f1a"]}`},
+	{method: "POST", route: "/customers/:customer_id/sites", handler: SiteCreate, body: `{"name": "Tower", "latitude": -33.9, "longitude": 18.4}`},
+	{method: "POST", route: "/customers/:customer_id/sites/bulk", handler: SiteBulkCreate, body: `[{"name": "Tower"}]`},
+	{method: "PUT", route: "/sites/:site_id", handler: SiteUpdate, body: `{"name": "Tower"}`},
+	{method: "POST", route: "/sites/batch-get", handler: SiteBatchGet, body: `{"ids": []}`},
+	{method: "GET", route: "/sites/:site_id/health", handler: SiteHealth},
+	{method: "GET", route: "/sites/:site_id/energy/daily", handler: SiteEnergyDaily},
+	{method: "GET", route: "/sites/:site_id/energy/monthly", handler: SiteEnergyMonthly},
+	{method: "POST", route: "/customers/:customer_id/sites/:site_id/devices", handler: DeviceCreate, body: `{"device_name": "AHU-1", "device_serial_number": "SN-1", "device_type": "AHU"}`},
+	{method: "PUT", route: "/registrations/devices", handler: DeviceRegister, body: `{"customer_id": "7d8c7e0e-8f55-4b3a-9a57-0f1f4d1f7f1a", "devices": [{"device_serial_number": "SN-1"}]}`},
+	{method: "GET", route: "/devices", handler: DeviceFetchAll},
+	{method: "GET", route: "/devices/:device_serial_number", handler: DeviceFetchBySerialNumber},
+	{method: "PUT", route: "/devices/:device_serial_number", handler: DeviceUpdate, body: `{"device_name": "AHU-2"}`},
+	{method: "DELETE", route: "/devices", handler: DeviceBulkDelete, body: `{"device_serial_numbers": ["SN-1"]}`},
+	{method: "POST", route: "/devices/batch-get", handler: DeviceBatchGet, body: `{"device_serial_numbers": ["SN-1"]}`},
+	{method: "GET", route: "/devices/changes/poll", handler: DeviceChangesPoll},
+	{method: "POST", route: "/devices/:device_serial_number/dependencies", handler: DeviceDependencyCreate, body: `{"downstream_serial_number": "SN-2", "relationship": "feeds"}`},
+	{method: "POST", route: "/devices/:device_serial_number/tags", handler: DeviceTagAdd, body: `{"tag": "rooftop"}`},
+	{method: "PUT", route: "/devices/:device_serial_number/meter", handler: DeviceMeterSet, body: `{"unit": "kWh", "multiplier": 40, "register_point": "energy"}`},
+	{method: "POST", route: "/devices/:device_serial_number/status", handler: DeviceStatusReport, body: `{"state": "online", "readings": {"energy": 12.5}}`},
+	{method: "GET", route: "/devices/:device_serial_number/status/history", handler: DeviceStatusHistory},
+	{method: "POST", route: "/sites/:site_id/controllers", handler: ControllerCreate, body: `{"controller_serial_number": "CTRL-1", "controller": "DSE 890"}`},
+	{method: "POST", route: "/tag-rules", handler: TagRuleCreate, body: `{"name": "no-comms", "tag": "no-comms", "field": "no_comms_days", "operator": "at_least", "value": "7"}`},
+	{method: "POST", route: "/filters", handler: SavedFilterCreate, body: `{"name": "Chillers", "query": "device_type=chiller"}`},
+	{method: "POST", route: "/gateways/:gateway/presence", handler: GatewayPresenceReport, body: `{}`},
+	{method: "POST", route: "/gateways/:gateway/replace", handler: GatewayReplace, body: `{"replacement": "GW-02"}`},
+	{method: "POST", route: "/provisioning-sessions", handler: ProvisioningSessionCreate, body: `{"customer_id": "7d8c7e0e-8f55-4b3a-9a57-0f1f4d1f7f1a"}`},
+	{method: "POST", route: "/provisioning-sessions/:session_id/devices", handler: ProvisioningSessionAddDevices, body: `{"devices": [{"device_serial_number": "SN-1"}]}`},
+	{method: "POST", route: "/api-keys", handler: APIKeyCreate, body: `{"customer_id": "7d8c7e0e-8f55-4b3a-9a57-0f1f4d1f7f1a", "name": "bms", "scopes": ["read"]}`},
+	{method: "POST", route: "/templates", handler: TemplateCreate, body: `{"name": "AHU", "device_type": "AHU"}`},
+}
+
+// fuzzRouteParam matches the parameters of a route
+var fuzzRouteParam = regexp.MustCompile(`:[a-z_]+`)
+
+// fuzzServe sends the request to the endpoint as an admin, with the database answering every query
+// with no rows, and fails the test if the handler panics or fails. The route parameters are set to
+// param, or to a valid value when param is empty.
+func fuzzServe(t *testing.T, e fuzzEndpoint, param, query string, body []byte) {
+	dbtest.Install(t)
+
+	path := fuzzRouteParam.ReplaceAllStringFunc(e.route, func(name string) string {
+		switch {
+		case param != "":
+			return url.PathEscape(param)
+		case strings.HasSuffix(name, "_id"):
+			return "7d8c7e0e-8f55-4b3a-9a57-0f1f4d1f7f1a"
+		default:
+			return "SN-1"
+		}
+	})
+	if query != "" {
+		path += "?" + query
+	}
+
+	request, err := http.NewRequest(e.method, path, bytes.NewReader(body))
+	if err != nil {
+		// Not a request a client could send
+		return
+	}
+
+	r := gin.New()
+	r.Handle(e.method, e.route, func(c *gin.Context) { c.Set("role", "admin") }, e.handler)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, request)
+
+	if w.Code >= http.StatusInternalServerError {
+		t.Errorf("%s %s: status = %d: %s", e.method, path, w.Code, w.Body)
+	}
+}
+
+// FuzzRequestBody sends malformed bodies to the endpoints that read one
+func FuzzRequestBody(f *testing.F) {
+	for i, e := range fuzzEndpoints {
+		if e.body != "" {
+			f.Add(uint8(i), []byte(e.body))
+			f.Add(uint8(i), []byte(`{}`))
+			f.Add(uint8(i), []byte(`null`))
+			f.Add(uint8(i), []byte(strings.Repeat("[", 64)))
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, endpoint uint8, body []byte) {
+		e := fuzzEndpoints[int(endpoint)%len(fuzzEndpoints)]
+		fuzzServe(t, e, "", "", body)
+	})
+}
+
+// FuzzPathParam sends malformed route parameters to every endpoint
+func FuzzPathParam(f *testing.F) {
+	for i := range fuzzEndpoints {
+		f.Add(uint8(i), "SN-1")
+		f.Add(uint8(i), "7d8c7e0e-8f55-4b3a-9a57-0f1f4d1f7f1a")
+		f.Add(uint8(i), "%00")
+		f.Add(uint8(i), "../../admin")
+		f.Add(uint8(i), strings.Repeat("x", 300))
+	}
+
+	f.Fuzz(func(t *testing.T, endpoint uint8, param string) {
+		if param == "" {
+			// An empty parameter does not match the route
+			return
+		}
+		e := fuzzEndpoints[int(endpoint)%len(fuzzEndpoints)]
+		fuzzServe(t, e, param, "", []byte(e.body))
+	})
+}
+
+// FuzzQuery sends malformed query strings, such as time ranges and pagination, to every endpoint
+func FuzzQuery(f *testing.F) {
+	for i := range fuzzEndpoints {
+		f.Add(uint8(i), "page=1&per_page=50")
+		f.Add(uint8(i), "page=-1&per_page=99999999999999999999")
+		f.Add(uint8(i), "from=2025-01-01T00:00:00Z&to=2024-01-01T00:00:00Z")
+		f.Add(uint8(i), "from=2025-01&to=0000-01")
+		f.Add(uint8(i), "from=9999-12-31&to=9999-12-31")
+		f.Add(uint8(i), "since=not-a-time&cascade=devices&dry_run=maybe")
+	}
+
+	f.Fuzz(func(t *testing.T, endpoint uint8, query string) {
+		e := fuzzEndpoints[int(endpoint)%len(fuzzEndpoints)]
+		fuzzServe(t, e, "", query, []byte(e.body))
+	})
+}
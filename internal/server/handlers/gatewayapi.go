@@ -0,0 +1,377 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/audit"
+	"github.com/johandrevandeventer/devices-api-server/internal/devicetoken"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"gorm.io/gorm"
+)
+
+// maxGatewayDevices is the largest number of devices a gateway registers in one request
+const maxGatewayDevices = 500
+
+type GatewayCredentialRequest struct {
+	CustomerID     uuid.UUID `json:"customer_id"`
+	SiteID         uuid.UUID `json:"site_id"`
+	Gateway        string    `json:"gateway"`
+	AllowedCIDRs   []string  `json:"allowed_cidrs"`
+	CertThumbprint string    `json:"cert_thumbprint"`
+}
+
+type GatewayCredentialRotateRequest struct {
+	AllowedCIDRs   []string `json:"allowed_cidrs"`
+	CertThumbprint string   `json:"cert_thumbprint"`
+}
+
+type GatewayCredentialResponse struct {
+	ID         uuid.UUID `json:"id"`
+	CustomerID uuid.UUID `json:"customer_id"`
+	SiteID     uuid.UUID `json:"site_id"`
+	GatewayID  uuid.UUID `json:"gateway_id"`
+	Gateway    string    `json:"gateway"`
+	Token      string    `json:"token"`
+}
+
+type GatewayDevicesResponse struct {
+	Devices []DeviceRegistrationResponse `json:"devices"`
+}
+
+// Route: POST /admin/gateway-credentials (Admin Only)
+// Issue the credential an edge gateway authenticates with on the /gateway routes, replacing the
+// credential previously issued for the gateway at the site. The credential only reaches the devices
+// of its site, unlike a customer token. The gateway is created if the site has none with the name.
+func GatewayCredentialIssue(c *gin.Context) {
+	var body GatewayCredentialRequest
+	if err := c.BindJSON(&body); err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", "Invalid JSON format")
+		return
+	}
+
+	body.Gateway = strings.TrimSpace(body.Gateway)
+	if body.CustomerID == uuid.Nil || body.SiteID == uuid.Nil || body.Gateway == "" {
+		serverutils.WriteError(c, 400, "Invalid request body", "customer_id, site_id and gateway fields are required")
+		return
+	}
+
+	binding, err := NewTokenBinding(body.AllowedCIDRs, body.CertThumbprint)
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", err.Error())
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var credential models.GatewayCredential
+	err = bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		site, err := fetchRegistrationSite(tx, body.CustomerID, body.SiteID)
+		if err != nil {
+			return err
+		}
+
+		credential, err = issueGatewayCredential(tx, site, body.Gateway, binding)
+		return err
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		serverutils.WriteError(c, 404, "Customer or site not found", "No customer or site found with the given ID")
+		return
+	case errors.Is(err, errSiteOtherCustomer):
+		serverutils.WriteError(c, 403, "Forbidden", "There is no site with the given ID for the given customer")
+		return
+	case err != nil:
+		writeAttachError(c, err, "Failed to issue gateway credential")
+		return
+	}
+
+	writeGatewayCredential(c, credential, "Gateway credential issued")
+}
+
+// Route: POST /admin/gateways/:gateway_id/credentials (Admin Only)
+// Rotate the credential of a gateway: issue a new credential and revoke the one it replaces, which
+// is rejected from then on. The devices of the gateway are left as they are.
+func GatewayCredentialRotate(c *gin.Context) {
+	gatewayID := c.Param("gateway_id")
+	if !serverutils.IsValidUUID(gatewayID) {
+		serverutils.WriteError(c, 400, "Invalid gateway ID", "Invalid UUID format")
+		return
+	}
+
+	// The binding is optional, so an empty body rotates an unbound credential
+	var body GatewayCredentialRotateRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.BindJSON(&body); err != nil {
+			serverutils.WriteError(c, 400, "Invalid request body", "Invalid JSON format")
+			return
+		}
+	}
+
+	binding, err := NewTokenBinding(body.AllowedCIDRs, body.CertThumbprint)
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", err.Error())
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var credential models.GatewayCredential
+	err = bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		var gateway models.Gateway
+		if err := tx.First(&gateway, "id = ?", gatewayID).Error; err != nil {
+			return err
+		}
+
+		site, err := fetchAttachableSite(&devicesdb.BMS_DB{DB: tx}, gateway.SiteID.String())
+		if err != nil {
+			return err
+		}
+
+		credential, err = issueGatewayCredential(tx, site, gateway.Name, binding)
+		return err
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		serverutils.WriteError(c, 404, "Gateway not found", "No gateway found with the given ID")
+		return
+	case err != nil:
+		writeAttachError(c, err, "Failed to rotate gateway credential")
+		return
+	}
+
+	writeGatewayCredential(c, credential, "Gateway credential rotated")
+}
+
+// Route: DELETE /admin/gateway-credentials/:credential_id (Admin Only)
+// Revoke a gateway credential, which is rejected from then on
+func GatewayCredentialRevoke(c *gin.Context) {
+	credentialID, err := uuid.Parse(c.Param("credential_id"))
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid credential ID", "Invalid UUID format")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	result := bmsDB.DB.Unscoped().Where("id = ?", credentialID).Delete(&models.GatewayCredential{})
+	if result.Error != nil {
+		serverutils.WriteError(c, 500, "Failed to revoke gateway credential", result.Error.Error())
+		return
+	}
+	if result.RowsAffected == 0 {
+		serverutils.WriteError(c, 404, "Gateway credential not found", "No gateway credential found with the given ID")
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Gateway credential revoked", nil)
+}
+
+// Route: GET /gateway/devices (Gateway Only)
+// Fetch the devices hosted by the authenticated gateway
+func GatewayDeviceFetch(c *gin.Context) {
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	writeDeviceList(c, bmsDB, DeviceListQuery(bmsDB).
+		Where("devices.site_id = ? AND devices.gateway = ?", c.GetString("site_id"), c.GetString("gateway")))
+}
+
+// Route: PUT /gateway/devices (Gateway Only)
+// Register or refresh the devices hosted by the authenticated gateway at its site, creating missing
+// devices, restoring deleted ones and updating the others, all or none. The gateway field of the
+// devices is set to the gateway, and devices of other sites are rejected.
+func GatewayDeviceRegister(c *gin.Context) {
+	var body []DeviceRequest
+	if err := c.BindJSON(&body); err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", "Invalid JSON format")
+		return
+	}
+
+	if len(body) == 0 || len(body) > maxGatewayDevices {
+		serverutils.WriteError(c, 400, "Invalid request body", fmt.Sprintf("Between 1 and %d devices are required", maxGatewayDevices))
+		return
+	}
+
+	gateway := c.GetString("gateway")
+	for i := range body {
+		body[i].Gateway = gateway
+		if missing := missingFields(deviceRequiredFields(body[i])); len(missing) > 0 {
+			serverutils.WriteError(c, 400, "Invalid request body", fmt.Sprintf("Device %d is missing required fields: %s", i+1, strings.Join(missing, ", ")))
+			return
+		}
+	}
+
+	customerID, err := uuid.Parse(c.GetString("customer_id"))
+	if err != nil {
+		serverutils.WriteError(c, 403, "Forbidden", "The gateway is not assigned to a customer")
+		return
+	}
+	siteID, err := uuid.Parse(c.GetString("site_id"))
+	if err != nil {
+		serverutils.WriteError(c, 403, "Forbidden", "The gateway is not assigned to a site")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var registrations []deviceRegistration
+	var failed string
+	err = bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		site, err := fetchRegistrationSite(tx, customerID, siteID)
+		if err != nil {
+			return err
+		}
+
+		for _, device := range body {
+			sealed, err := devicetoken.Seal(device.AuthToken)
+			if err != nil {
+				return err
+			}
+
+			registration, err := registerDevice(tx, site, device, sealed, false)
+			if err != nil {
+				failed = device.DeviceSerialNumber
+				return err
+			}
+			registrations = append(registrations, registration)
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound), errors.Is(err, errSiteOtherCustomer):
+		serverutils.WriteError(c, 403, "Forbidden", "The site of the gateway no longer exists")
+		return
+	case errors.Is(err, errDeviceOtherCustomer), errors.Is(err, errDeviceOtherSite):
+		serverutils.WriteError(c, 409, "Device belongs to another site", "Device "+failed+" is registered at another site")
+		return
+	case errors.Is(err, ErrDeviceAmbiguous):
+		serverutils.WriteError(c, 409, "Device is ambiguous", "Device "+failed+" is used by several customers")
+		return
+	case err != nil:
+		writeAttachError(c, err, "Failed to register devices")
+		return
+	}
+
+	omitTokens := omitsDeviceTokens(c)
+	response := GatewayDevicesResponse{Devices: make([]DeviceRegistrationResponse, 0, len(registrations))}
+	for _, registration := range registrations {
+		registration.recordChanges(c)
+
+		device, err := registration.response(bmsDB)
+		if err != nil {
+			serverutils.WriteError(c, 500, "Failed to fetch site", err.Error())
+			return
+		}
+		if omitTokens {
+			device.AuthToken = ""
+		}
+		response.Devices = append(response.Devices, device)
+	}
+
+	serverutils.WriteJSON(c, 200, "Devices registered", response)
+}
+
+// =====================================================================================================================
+
+// issueGatewayCredential issues a credential for the gateway with the name at the site, replacing
+// the credential previously issued for it. The gateway is created if the site has none with the
+// name yet, and the devices of the site that name it are linked to it.
+func issueGatewayCredential(tx *gorm.DB, site *models.Site, name string, binding TokenBinding) (models.GatewayCredential, error) {
+	var gateways []models.Gateway
+	if err := tx.Where("site_id = ? AND name = ?", site.ID, name).Limit(1).Find(&gateways).Error; err != nil {
+		return models.GatewayCredential{}, err
+	}
+
+	var gateway models.Gateway
+	if len(gateways) > 0 {
+		gateway = gateways[0]
+	} else {
+		gateway = models.Gateway{CustomerID: site.CustomerID, SiteID: site.ID, Name: name}
+		if err := tx.Create(&gateway).Error; err != nil {
+			return models.GatewayCredential{}, err
+		}
+	}
+
+	if err := tx.Unscoped().Model(&models.Device{}).Where("site_id = ? AND gateway = ?", site.ID, name).
+		Update("gateway_id", gateway.ID).Error; err != nil {
+		return models.GatewayCredential{}, err
+	}
+
+	token, err := serverutils.GenerateGatewayJWT(site.CustomerID.String(), site.ID.String(), name)
+	if err != nil {
+		return models.GatewayCredential{}, err
+	}
+
+	if err := tx.Unscoped().Where("site_id = ? AND gateway = ?", site.ID, name).
+		Delete(&models.GatewayCredential{}).Error; err != nil {
+		return models.GatewayCredential{}, err
+	}
+
+	credential := models.GatewayCredential{
+		CustomerID: site.CustomerID,
+		SiteID:     site.ID,
+		Gateway:    name,
+		Token:      token,
+		GatewayID:  &gateway.ID,
+	}
+	if len(binding.AllowedCIDRs) > 0 {
+		cidrs := strings.Join(binding.AllowedCIDRs, ",")
+		credential.AllowedCIDRs = &cidrs
+	}
+	if binding.CertThumbprint != "" {
+		credential.CertThumbprint = &binding.CertThumbprint
+	}
+	if err := tx.Create(&credential).Error; err != nil {
+		return models.GatewayCredential{}, err
+	}
+	return credential, nil
+}
+
+// writeGatewayCredential audits the issue of the credential and writes it
+func writeGatewayCredential(c *gin.Context, credential models.GatewayCredential, message string) {
+	audit.Record(audit.Event{
+		Name:       audit.EventTokenIssued,
+		Outcome:    audit.OutcomeSuccess,
+		Reason:     serverutils.GatewayAction,
+		Subject:    credential.CustomerID.String(),
+		RemoteAddr: c.ClientIP(),
+		Method:     c.Request.Method,
+		Path:       c.FullPath(),
+	})
+
+	response := GatewayCredentialResponse{
+		ID:         credential.ID,
+		CustomerID: credential.CustomerID,
+		SiteID:     credential.SiteID,
+		Gateway:    credential.Gateway,
+		Token:      credential.Token,
+	}
+	if credential.GatewayID != nil {
+		response.GatewayID = *credential.GatewayID
+	}
+	serverutils.WriteJSON(c, 200, message, response)
+}
@@ -0,0 +1,466 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/audit"
+	"github.com/johandrevandeventer/devices-api-server/internal/presence"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/internal/status"
+	"github.com/johandrevandeventer/devices-api-server/internal/statushistory"
+	"github.com/johandrevandeventer/devices-api-server/internal/timefmt"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"github.com/johandrevandeventer/logging"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxGatewayLength is the length of the device gateway column
+const maxGatewayLength = 255
+
+// errGatewayInUse is returned when replacing a gateway with one that already has devices
+var errGatewayInUse = errors.New("gateway already in use")
+
+// heartbeatOnlineWindow is how recently a device must have been seen to count as online
+var heartbeatOnlineWindow = 15 * time.Minute
+
+// SetHeartbeatOnlineWindow sets how recently a device must have been seen to count as online,
+// keeping the default if the window is not positive
+func SetHeartbeatOnlineWindow(window time.Duration) {
+	if window > 0 {
+		heartbeatOnlineWindow = window
+	}
+	presence.SetOnlineWindow(window)
+}
+
+type GatewayDeviceHeartbeat struct {
+	DeviceSerialNumber string        `json:"device_serial_number"`
+	DeviceName         string        `json:"device_name"`
+	DeviceType         string        `json:"device_type"`
+	LastSeen           *timefmt.Time `json:"last_seen"`
+	State              string        `json:"state"`
+	Online             bool          `json:"online"`
+}
+
+type GatewayReplaceRequest struct {
+	Gateway string `json:"gateway"`
+}
+
+type GatewayReplaceResponse struct {
+	Gateway    string   `json:"gateway"`
+	ReplacedBy string   `json:"replaced_by"`
+	Devices    []string `json:"devices"`
+}
+
+type GatewayPresenceRequest struct {
+	Connected *bool `json:"connected"`
+}
+
+// GatewayPresenceResponse is the connection presence of a gateway and the sites behind it. The
+// timestamps are missing for gateways that have not been seen since the server started.
+type GatewayPresenceResponse struct {
+	Gateway        string        `json:"gateway"`
+	Connected      bool          `json:"connected"`
+	ConnectedAt    *timefmt.Time `json:"connected_at"`
+	DisconnectedAt *timefmt.Time `json:"disconnected_at"`
+	LastSeen       *timefmt.Time `json:"last_seen"`
+	Sites          []string      `json:"sites"`
+}
+
+// GatewayResponse is a gateway with the number of live devices it hosts. LastSeenAt is missing for
+// gateways that have not authenticated or relayed a heartbeat yet.
+type GatewayResponse struct {
+	ID         uuid.UUID     `json:"id"`
+	CustomerID uuid.UUID     `json:"customer_id"`
+	SiteID     uuid.UUID     `json:"site_id"`
+	Name       string        `json:"name"`
+	LastSeenAt *timefmt.Time `json:"last_seen_at"`
+	Devices    int           `json:"devices"`
+	CreatedAt  timefmt.Time  `json:"created_at"`
+}
+
+type GatewaySummaryResponse struct {
+	Gateway          string                   `json:"gateway"`
+	DeviceCount      int                      `json:"device_count"`
+	OnlineCount      int                      `json:"online_count"`
+	OfflineCount     int                      `json:"offline_count"`
+	FaultCount       int                      `json:"fault_count"`
+	NeverSeenCount   int                      `json:"never_seen_count"`
+	DeviceTypeCounts map[string]int           `json:"device_type_counts"`
+	HealthScore      float64                  `json:"health_score"`
+	Devices          []GatewayDeviceHeartbeat `json:"devices"`
+}
+
+// Route: GET /gateways/:gateway/summary
+// Fetch device counts, heartbeats and a health score for the devices behind a gateway. A device is
+// online when it was seen within the status history's online window and did not report a fault.
+func GatewaySummary(c *gin.Context) {
+	role := c.GetString("role")
+	requesterID := c.GetString("customer_id")
+	gateway := c.Param("gateway")
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	query := bmsDB.DB.Table("devices").
+		Select("devices.device_serial_number, devices.device_name, devices.device_type, device_statuses.last_seen, COALESCE(device_statuses.state, '') AS state").
+		Joins("JOIN sites ON sites.id = devices.site_id AND sites.deleted_at IS NULL").
+		Joins("LEFT JOIN device_statuses ON device_statuses.device_id = devices.id AND device_statuses.deleted_at IS NULL").
+		Where("devices.gateway = ? AND devices.deleted_at IS NULL", gateway).
+		Order("devices.device_serial_number")
+
+	// Non-admins only see their own devices behind the gateway
+	if role != "admin" {
+		query = query.Where("sites.customer_id = ?", requesterID)
+	}
+
+	var devices []GatewayDeviceHeartbeat
+	if err := query.Scan(&devices).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch gateway devices", err.Error())
+		return
+	}
+
+	if len(devices) == 0 {
+		serverutils.WriteError(c, 404, "Gateway not found", "No devices found behind the given gateway")
+		return
+	}
+
+	response := GatewaySummaryResponse{
+		Gateway:          gateway,
+		DeviceCount:      len(devices),
+		DeviceTypeCounts: make(map[string]int),
+	}
+
+	now := time.Now()
+	for i := range devices {
+		device := &devices[i]
+		response.DeviceTypeCounts[device.DeviceType]++
+
+		if device.LastSeen == nil {
+			response.NeverSeenCount++
+			continue
+		}
+
+		device.State = statushistory.State(device.State, device.LastSeen.Time, now, heartbeatOnlineWindow)
+		switch device.State {
+		case models.DeviceStatusOnline:
+			device.Online = true
+			response.OnlineCount++
+		case models.DeviceStatusFault:
+			response.FaultCount++
+		default:
+			response.OfflineCount++
+		}
+	}
+
+	// The health score is the percentage of devices that are online
+	response.HealthScore = math.Round(float64(response.OnlineCount)/float64(response.DeviceCount)*1000) / 10
+	response.Devices = devices
+
+	serverutils.WriteJSON(c, 200, "Gateway summary fetched", response)
+}
+
+// Route: GET /sites/:site_id/gateways
+// Fetch the gateways of a site with the number of devices each hosts and when each was last seen
+func GatewayFetchBySiteID(c *gin.Context) {
+	site, bmsDB, ok := fetchReadableSite(c)
+	if !ok {
+		return
+	}
+
+	response := []GatewayResponse{}
+	if err := bmsDB.DB.Table("gateways").
+		Select("gateways.id, gateways.customer_id, gateways.site_id, gateways.name, gateways.last_seen_at, gateways.created_at, COUNT(devices.id) AS devices").
+		Joins("LEFT JOIN devices ON devices.gateway_id = gateways.id AND devices.deleted_at IS NULL").
+		Where("gateways.site_id = ? AND gateways.deleted_at IS NULL", site.ID).
+		Group("gateways.id").
+		Order("gateways.name").
+		Scan(&response).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch gateways", err.Error())
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Gateways fetched", response)
+}
+
+// Route: GET /gateways/:gateway/devices
+// Fetch the devices hosted by a gateway, given by ID rather than by name
+func GatewayFetchDevices(c *gin.Context) {
+	role := c.GetString("role")
+	requesterID := c.GetString("customer_id")
+	gatewayID := c.Param("gateway")
+
+	if !serverutils.IsValidUUID(gatewayID) {
+		serverutils.WriteError(c, 400, "Invalid gateway ID", "Invalid UUID format")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var gateway models.Gateway
+	err := bmsDB.DB.First(&gateway, "id = ?", gatewayID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 404, "Gateway not found", "No gateway found with the given ID")
+		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch gateway", err.Error())
+		return
+	}
+
+	if role != "admin" && requesterID != gateway.CustomerID.String() {
+		serverutils.WriteError(c, 403, "Forbidden", "You are not authorized to access this gateway")
+		return
+	}
+
+	writeDeviceList(c, bmsDB, DeviceListQuery(bmsDB).Where("devices.gateway_id = ?", gateway.ID))
+}
+
+// Route: GET /gateways/presence
+// Fetch the connection presence of every gateway with devices, with the sites behind it. Gateways
+// connect when the MQTT bridge reports them connected or a device behind them reports a heartbeat.
+// Filter on ?connected=true or ?connected=false.
+func GatewayPresence(c *gin.Context) {
+	role := c.GetString("role")
+	requesterID := c.GetString("customer_id")
+
+	connected := c.Query("connected")
+	switch connected {
+	case "", "true", "false":
+	default:
+		serverutils.WriteError(c, 400, "Invalid connected", "Connected must be true or false")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	query := bmsDB.DB.Table("devices").
+		Select("DISTINCT devices.gateway, sites.name AS site_name").
+		Joins("JOIN sites ON sites.id = devices.site_id AND sites.deleted_at IS NULL").
+		Where("devices.deleted_at IS NULL").
+		Order("devices.gateway, sites.name")
+
+	// Non-admins only see the gateways of their own devices
+	if role != "admin" {
+		query = query.Where("sites.customer_id = ?", requesterID)
+	}
+
+	var rows []struct {
+		Gateway  string
+		SiteName string
+	}
+	if err := query.Scan(&rows).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch gateways", err.Error())
+		return
+	}
+
+	now := time.Now()
+	response := []GatewayPresenceResponse{}
+	for _, row := range rows {
+		if n := len(response); n > 0 && response[n-1].Gateway == row.Gateway {
+			response[n-1].Sites = append(response[n-1].Sites, row.SiteName)
+			continue
+		}
+
+		state, _ := presence.Get(row.Gateway, now)
+		if connected != "" && strconv.FormatBool(state.Connected) != connected {
+			continue
+		}
+		gateway := newGatewayPresenceResponse(row.Gateway, state)
+		gateway.Sites = append(gateway.Sites, row.SiteName)
+		response = append(response, gateway)
+	}
+
+	serverutils.WriteJSON(c, 200, "Gateway presence fetched", response)
+}
+
+// Route: POST /gateways/:gateway/presence (Admin Only)
+// Record a connect or disconnect of a gateway reported by the MQTT bridge, such as its last will
+func GatewayPresenceReport(c *gin.Context) {
+	gateway := c.Param("gateway")
+	if len(gateway) > maxGatewayLength {
+		serverutils.WriteError(c, 400, "Invalid gateway", fmt.Sprintf("gateway must be at most %d characters", maxGatewayLength))
+		return
+	}
+
+	var body GatewayPresenceRequest
+	if err := c.BindJSON(&body); err != nil || body.Connected == nil {
+		serverutils.WriteError(c, 400, "Invalid request body", "Connected field is required")
+		return
+	}
+
+	now := time.Now()
+	presence.Set(gateway, *body.Connected, now)
+
+	state, _ := presence.Get(gateway, now)
+	serverutils.WriteJSON(c, 200, "Gateway presence recorded", newGatewayPresenceResponse(gateway, state))
+}
+
+// Route: POST /gateways/:gateway/replace (Admin Only)
+// Move every device behind a gateway to the gateway replacing it, including deleted devices so they
+// are restored behind the new gateway. The new gateway must not have devices yet. Every moved device
+// is audited.
+func GatewayReplace(c *gin.Context) {
+	gateway := c.Param("gateway")
+
+	var body GatewayReplaceRequest
+	if err := c.BindJSON(&body); err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", err.Error())
+		return
+	}
+
+	replacement := strings.TrimSpace(body.Gateway)
+	if replacement == "" || len(replacement) > maxGatewayLength {
+		serverutils.WriteError(c, 400, "Invalid request body", fmt.Sprintf("gateway must be 1-%d characters", maxGatewayLength))
+		return
+	}
+	if replacement == gateway {
+		serverutils.WriteError(c, 400, "Invalid request body", "The new gateway must differ from the gateway it replaces")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var devices []models.Device
+	err := bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("id", "device_serial_number", "site_id").
+			Where("gateway = ?", gateway).
+			Order("device_serial_number").
+			Find(&devices).Error; err != nil {
+			return err
+		}
+		if len(devices) == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		var inUse int64
+		if err := tx.Unscoped().Model(&models.Device{}).Where("gateway = ?", replacement).Count(&inUse).Error; err != nil {
+			return err
+		}
+		if inUse > 0 {
+			return errGatewayInUse
+		}
+
+		// The devices leave the gateway record of the old gateway, and are linked to that of the
+		// replacement when it is issued a credential
+		return tx.Unscoped().Model(&models.Device{}).Where("gateway = ?", gateway).
+			Updates(map[string]any{"gateway": replacement, "gateway_id": nil}).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 404, "Gateway not found", "No devices found behind the given gateway")
+		return
+	} else if errors.Is(err, errGatewayInUse) {
+		serverutils.WriteError(c, 409, "Gateway already in use", "Devices are already behind the new gateway")
+		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to replace gateway", err.Error())
+		return
+	}
+
+	response := GatewayReplaceResponse{Gateway: gateway, ReplacedBy: replacement, Devices: make([]string, len(devices))}
+	invalidated := make(map[uuid.UUID]bool)
+	for i, device := range devices {
+		response.Devices[i] = device.DeviceSerialNumber
+
+		if !invalidated[device.SiteID] {
+			recordDeviceChanges(c, device.SiteID)
+			invalidated[device.SiteID] = true
+		}
+
+		audit.Record(audit.Event{
+			Name:       audit.EventGatewayReplaced,
+			Outcome:    audit.OutcomeSuccess,
+			Reason:     gateway + " replaced by " + replacement,
+			Subject:    device.DeviceSerialNumber,
+			RemoteAddr: c.ClientIP(),
+			Method:     c.Request.Method,
+			Path:       c.FullPath(),
+		})
+	}
+
+	serverutils.WriteJSON(c, 200, "Gateway replaced", response)
+}
+
+// =====================================================================================================================
+
+// gatewaySeenInterval is how stale the last seen time of a gateway gets before it is written again,
+// so busy gateways do not write it on every request
+const gatewaySeenInterval = time.Minute
+
+var (
+	gatewaysSeenMu sync.Mutex
+	// gatewaysSeen holds when this instance last wrote the last seen time of each gateway
+	gatewaysSeen = make(map[uuid.UUID]time.Time)
+)
+
+// TouchGateway records that the gateway was seen at the time. Writes are debounced per gateway, so
+// only the first request in every interval reaches the database. It is best effort: failures are
+// only logged, as they must not fail the request the gateway was seen through.
+func TouchGateway(db *gorm.DB, gatewayID *uuid.UUID, at time.Time) {
+	if gatewayID == nil || status.IsReadOnly() {
+		return
+	}
+
+	gatewaysSeenMu.Lock()
+	if last, ok := gatewaysSeen[*gatewayID]; ok && at.Sub(last) < gatewaySeenInterval {
+		gatewaysSeenMu.Unlock()
+		return
+	}
+	gatewaysSeen[*gatewayID] = at
+	gatewaysSeenMu.Unlock()
+
+	// Other instances may have written it more recently
+	err := db.Model(&models.Gateway{}).
+		Where("id = ? AND (last_seen_at IS NULL OR last_seen_at < ?)", *gatewayID, at.Add(-gatewaySeenInterval)).
+		UpdateColumn("last_seen_at", at).Error
+	if err != nil {
+		gatewaysSeenMu.Lock()
+		delete(gatewaysSeen, *gatewayID)
+		gatewaysSeenMu.Unlock()
+		logging.GetLogger("api-server").Warn("Failed to record gateway last seen", zap.String("gateway", gatewayID.String()), zap.Error(err))
+	}
+}
+
+// newGatewayPresenceResponse builds the presence response of a gateway, without its sites
+func newGatewayPresenceResponse(gateway string, state presence.State) GatewayPresenceResponse {
+	return GatewayPresenceResponse{
+		Gateway:        gateway,
+		Connected:      state.Connected,
+		ConnectedAt:    presenceTime(state.ConnectedAt),
+		DisconnectedAt: presenceTime(state.DisconnectedAt),
+		LastSeen:       presenceTime(state.LastSeen),
+		Sites:          []string{},
+	}
+}
+
+// presenceTime wraps a presence time, returning nil if it was never recorded
+func presenceTime(t time.Time) *timefmt.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return timefmt.NewPtr(&t)
+}
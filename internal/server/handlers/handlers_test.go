@@ -0,0 +1,3274 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/cache"
+	"github.com/johandrevandeventer/devices-api-server/internal/changes"
+	"github.com/johandrevandeventer/devices-api-server/internal/dbtest"
+	"github.com/johandrevandeventer/devices-api-server/internal/presence"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/internal/status"
+	"github.com/johandrevandeventer/devices-api-server/internal/testsupport"
+	"github.com/johandrevandeventer/devices-api-server/internal/timefmt"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"github.com/johandrevandeventer/logging"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+
+	dir, err := os.MkdirTemp("", "handlers-test")
+	if err != nil {
+		panic(err)
+	}
+	logging.NewLogger(logging.NewLoggingConfig("error", filepath.Join(dir, "test.log"), 1, 1, 1, false, false, false))
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// requester is the identity the auth middleware would have set for a request
+type requester struct {
+	role       string
+	customerID string
+	siteID     string
+}
+
+var admin = requester{role: "admin"}
+
+// serve runs a single request through the handler registered on the route
+func serve(method, route, path string, who requester, handler gin.HandlerFunc) *httptest.ResponseRecorder {
+	r := gin.New()
+	r.Handle(method, route, func(c *gin.Context) {
+		c.Set("role", who.role)
+		c.Set("customer_id", who.customerID)
+		if who.siteID != "" {
+			c.Set("site_id", who.siteID)
+		}
+	}, handler)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	return w
+}
+
+// fixture is a customer with a site, registered in the name cache so device lookups can be scripted
+// with the devices query alone
+type fixture struct {
+	customerID uuid.UUID
+	siteID     uuid.UUID
+}
+
+func newFixture() fixture {
+	f := fixture{customerID: uuid.New(), siteID: uuid.New()}
+	cache.Names().SetCustomer(models.Customer{ID: f.customerID, Name: "Customer"})
+	cache.Names().SetSite(models.Site{ID: f.siteID, Name: "Site", CustomerID: f.customerID})
+	return f
+}
+
+// devices answers a devices query with a device of the fixture per serial number
+func (f fixture) devices(deleted bool, serialNumbers ...string) dbtest.Result {
+	var deletedAt driver.Value
+	if deleted {
+		deletedAt = time.Now()
+	}
+
+	result := dbtest.Result{Columns: []string{"id", "site_id", "customer_id", "device_serial_number", "device_name", "deleted_at"}}
+	for _, serialNumber := range serialNumbers {
+		result.Rows = append(result.Rows, []driver.Value{
+			uuid.NewString(), f.siteID.String(), f.customerID.String(), serialNumber, "AHU", deletedAt,
+		})
+	}
+	return result
+}
+
+var errDatabase = errors.New("database is unavailable")
+
+func TestDeviceFetchBySerialNumber(t *testing.T) {
+	owner := newFixture()
+	other := newFixture()
+
+	tests := []struct {
+		name    string
+		who     requester
+		devices *dbtest.Result
+		fail    bool
+		want    int
+	}{
+		{name: "database error", who: admin, fail: true, want: http.StatusInternalServerError},
+		{name: "not found", who: admin, want: http.StatusNotFound},
+		{name: "shared serial number", who: admin, devices: ptr(owner.devices(false, "SN-1", "SN-1")), want: http.StatusConflict},
+		{name: "admin", who: admin, devices: ptr(owner.devices(false, "SN-1")), want: http.StatusOK},
+		{name: "owner", who: requester{role: "user", customerID: owner.customerID.String()}, devices: ptr(owner.devices(false, "SN-1")), want: http.StatusOK},
+		{name: "other customer", who: requester{role: "user", customerID: other.customerID.String()}, devices: ptr(owner.devices(false, "SN-1")), want: http.StatusForbidden},
+		{
+			name:    "site token of another site",
+			who:     requester{role: "user", customerID: owner.customerID.String(), siteID: uuid.NewString()},
+			devices: ptr(owner.devices(false, "SN-1")),
+			want:    http.StatusForbidden,
+		},
+		{
+			name:    "site token of the device's site",
+			who:     requester{role: "user", customerID: owner.customerID.String(), siteID: owner.siteID.String()},
+			devices: ptr(owner.devices(false, "SN-1")),
+			want:    http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			if tt.fail {
+				db.Fail(errDatabase)
+			}
+			if tt.devices != nil {
+				db.On("FROM `devices`", *tt.devices)
+			}
+
+			w := serve("GET", "/devices/:device_serial_number", "/devices/SN-1", tt.who, DeviceFetchBySerialNumber)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestDeviceFetchWarnings(t *testing.T) {
+	owner := newFixture()
+	heartbeat := "Device has not reported a heartbeat, check its heartbeat configuration"
+
+	tests := []struct {
+		name     string
+		statuses int64
+		want     []string
+	}{
+		{name: "reporting device", statuses: 1, want: []string{AuthTokenDeprecation}},
+		{name: "silent device", statuses: 0, want: []string{heartbeat, AuthTokenDeprecation}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `devices`", owner.devices(false, "SN-1"))
+			db.On("FROM `device_statuses`", dbtest.Result{Columns: []string{"count(*)"}, Rows: [][]driver.Value{{tt.statuses}}})
+
+			w := serve("GET", "/devices/:device_serial_number", "/devices/SN-1", admin, DeviceFetchBySerialNumber)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+
+			var response serverutils.Response
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if !slices.Equal(response.Warnings, tt.want) {
+				t.Errorf("warnings = %q, want %q", response.Warnings, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeviceFetchOmitAuthToken(t *testing.T) {
+	owner := newFixture()
+
+	tests := []struct {
+		name         string
+		features     string
+		wantToken    bool
+		wantWarnings []string
+	}{
+		{name: "default", wantToken: true, wantWarnings: []string{AuthTokenDeprecation}},
+		{name: "opted in", features: serverutils.FeatureOmitAuthToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			device := owner.devices(false, "SN-1")
+			device.Columns = append(device.Columns, "auth_token")
+			device.Rows[0] = append(device.Rows[0], "token-1234567890")
+
+			db := dbtest.Install(t)
+			db.On("FROM `devices`", device)
+			db.On("FROM `device_statuses`", dbtest.Result{Columns: []string{"count(*)"}, Rows: [][]driver.Value{{int64(1)}}})
+
+			r := gin.New()
+			r.GET("/devices/:device_serial_number", func(c *gin.Context) {
+				c.Set("role", "admin")
+				serverutils.EnableFeatures(c)
+			}, DeviceFetchBySerialNumber)
+			req := httptest.NewRequest("GET", "/devices/SN-1", nil)
+			req.Header.Set(serverutils.FeaturesHeader, tt.features)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+
+			var response struct {
+				Data     map[string]any `json:"data"`
+				Warnings []string       `json:"warnings"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if _, ok := response.Data["auth_token"]; ok != tt.wantToken {
+				t.Errorf("auth_token in response = %v, want %v", ok, tt.wantToken)
+			}
+			if !slices.Equal(response.Warnings, tt.wantWarnings) {
+				t.Errorf("warnings = %q, want %q", response.Warnings, tt.wantWarnings)
+			}
+		})
+	}
+}
+
+func TestDeviceLookupSerialScope(t *testing.T) {
+	owner := newFixture()
+
+	SetDeviceSerialScope(models.SerialScopeCustomer)
+	t.Cleanup(func() { SetDeviceSerialScope(models.SerialScopeGlobal) })
+
+	tests := []struct {
+		name         string
+		who          requester
+		path         string
+		wantCustomer string
+	}{
+		{name: "customer", who: requester{role: "user", customerID: owner.customerID.String()}, path: "/devices/SN-1", wantCustomer: owner.customerID.String()},
+		{name: "admin", who: admin, path: "/devices/SN-1"},
+		{name: "admin selecting a customer", who: admin, path: "/devices/SN-1?customer_id=" + owner.customerID.String(), wantCustomer: owner.customerID.String()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `devices`", owner.devices(false, "SN-1"))
+
+			w := serve("GET", "/devices/:device_serial_number", tt.path, tt.who, DeviceFetchBySerialNumber)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+
+			queries := db.Queries()
+			if len(queries) == 0 {
+				t.Fatal("no device query was run")
+			}
+
+			var customer string
+			if args := queries[0].Args; len(args) > 1 {
+				customer, _ = args[1].(string)
+			}
+			if customer != tt.wantCustomer {
+				t.Errorf("device query limited to customer %q, want %q", customer, tt.wantCustomer)
+			}
+		})
+	}
+}
+
+func TestDeviceDeleteAlreadyDeleted(t *testing.T) {
+	owner := newFixture()
+
+	db := dbtest.Install(t)
+	db.On("FROM `devices`", owner.devices(true, "SN-1"))
+
+	w := serve("DELETE", "/devices/:device_serial_number", "/devices/SN-1", admin, DeviceDelete)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("status = %d, want %d: %s", w.Code, http.StatusNotFound, w.Body)
+	}
+
+	for _, query := range db.Queries() {
+		if strings.HasPrefix(query.SQL, "UPDATE") {
+			t.Errorf("deleted device was updated: %s", query.SQL)
+		}
+	}
+}
+
+func TestSiteFetchByID(t *testing.T) {
+	owner := newFixture()
+	other := newFixture()
+
+	sites := dbtest.Result{
+		Columns: []string{"id", "name", "customer_id"},
+		Rows:    [][]driver.Value{{owner.siteID.String(), "Site", owner.customerID.String()}},
+	}
+	customers := dbtest.Result{
+		Columns: []string{"id", "name"},
+		Rows:    [][]driver.Value{{owner.customerID.String(), "Customer"}},
+	}
+
+	tests := []struct {
+		name  string
+		who   requester
+		found bool
+		fail  bool
+		want  int
+	}{
+		{name: "database error", who: admin, fail: true, want: http.StatusInternalServerError},
+		{name: "not found", who: admin, want: http.StatusNotFound},
+		{name: "owner", who: requester{role: "user", customerID: owner.customerID.String()}, found: true, want: http.StatusOK},
+		{name: "other customer", who: requester{role: "user", customerID: other.customerID.String()}, found: true, want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			if tt.fail {
+				db.Fail(errDatabase)
+			}
+			if tt.found {
+				db.On("FROM `sites`", sites)
+				db.On("FROM `customers`", customers)
+			}
+
+			w := serve("GET", "/sites/:site_id", "/sites/"+owner.siteID.String(), tt.who, SiteFetchByID)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestSiteUpdateMove(t *testing.T) {
+	owner := newFixture()
+	target := newFixture()
+
+	sites := dbtest.Result{
+		Columns: []string{"id", "name", "customer_id"},
+		Rows:    [][]driver.Value{{owner.siteID.String(), "Site", owner.customerID.String()}},
+	}
+	customer := func(f fixture) dbtest.Result {
+		return dbtest.Result{Columns: []string{"id", "name"}, Rows: [][]driver.Value{{f.customerID.String(), "Customer"}}}
+	}
+
+	tests := []struct {
+		name        string
+		body        string
+		scope       string
+		targetFound bool
+		scripts     map[string]dbtest.Result
+		want        int
+		wantUpdates []string // table.column of each update, in order
+	}{
+		{name: "empty body", body: `{}`, want: http.StatusBadRequest},
+		{name: "invalid customer", body: `{"customer_id": "nope"}`, want: http.StatusBadRequest},
+		{name: "unknown customer", body: `{"customer_id": "` + target.customerID.String() + `"}`, want: http.StatusNotFound},
+		{
+			name:        "dependency on another site",
+			body:        `{"customer_id": "` + target.customerID.String() + `"}`,
+			targetFound: true,
+			scripts: map[string]dbtest.Result{
+				"FROM `device_dependencies`": {Columns: []string{"upstream", "downstream"}, Rows: [][]driver.Value{{"SN-1", "SN-9"}}},
+			},
+			want: http.StatusConflict,
+		},
+		{
+			name:        "serial number taken by the customer",
+			body:        `{"customer_id": "` + target.customerID.String() + `"}`,
+			scope:       models.SerialScopeCustomer,
+			targetFound: true,
+			scripts: map[string]dbtest.Result{
+				"SELECT DISTINCT `device_serial_number`": {Columns: []string{"device_serial_number"}, Rows: [][]driver.Value{{"SN-1"}}},
+			},
+			want: http.StatusConflict,
+		},
+		{
+			name:        "name taken by the customer",
+			body:        `{"customer_id": "` + target.customerID.String() + `"}`,
+			targetFound: true,
+			scripts: map[string]dbtest.Result{
+				"count(*) FROM `sites`": {Columns: []string{"count"}, Rows: [][]driver.Value{{int64(1)}}},
+			},
+			want: http.StatusBadRequest,
+		},
+		{
+			name:        "move",
+			body:        `{"name": "Renamed", "customer_id": "` + target.customerID.String() + `"}`,
+			targetFound: true,
+			want:        http.StatusOK,
+			wantUpdates: []string{"sites.name", "sites.customer_id", "devices.customer_id", "controllers.customer_id", "auth_tokens.deleted_at"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.scope != "" {
+				SetDeviceSerialScope(tt.scope)
+				t.Cleanup(func() { SetDeviceSerialScope(models.SerialScopeGlobal) })
+			}
+
+			db := dbtest.Install(t)
+			for fragment, result := range tt.scripts {
+				db.On(fragment, result)
+			}
+			if tt.targetFound {
+				db.On("FROM `customers` WHERE id = ?", customer(target))
+			} else {
+				db.On("FROM `customers` WHERE id = ?", dbtest.Result{Columns: []string{"id"}})
+			}
+			db.On("count(*) FROM `sites`", dbtest.Result{Columns: []string{"count"}, Rows: [][]driver.Value{{int64(0)}}})
+			db.On("FROM `sites`", sites)
+			db.On("FROM `customers`", customer(owner))
+
+			r := gin.New()
+			r.PUT("/sites/:site_id", func(c *gin.Context) { c.Set("role", "admin") }, SiteUpdate)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("PUT", "/sites/"+owner.siteID.String(), strings.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+
+			var updates []string
+			for _, query := range db.Queries() {
+				if strings.HasPrefix(query.SQL, "UPDATE") {
+					updates = append(updates, query.SQL)
+				}
+			}
+			if len(updates) != len(tt.wantUpdates) {
+				t.Fatalf("updates = %q, want %d updates", updates, len(tt.wantUpdates))
+			}
+			for i, update := range tt.wantUpdates {
+				table, column, _ := strings.Cut(update, ".")
+				if !strings.HasPrefix(updates[i], "UPDATE `"+table+"`") || !strings.Contains(updates[i], "`"+column+"`=") {
+					t.Errorf("update %d = %q, want an update of %s", i, updates[i], update)
+				}
+			}
+		})
+	}
+}
+
+// TestDatabaseErrors checks that handlers answer a failing database with an error response
+// instead of dereferencing the results they did not get
+func TestDatabaseErrors(t *testing.T) {
+	siteID := uuid.NewString()
+
+	tests := []struct {
+		method  string
+		route   string
+		path    string
+		handler gin.HandlerFunc
+	}{
+		{"GET", "/devices/:device_serial_number", "/devices/SN-1", DeviceFetchBySerialNumber},
+		{"DELETE", "/devices/:device_serial_number", "/devices/SN-1", DeviceDelete},
+		{"DELETE", "/devices/:device_serial_number/purge", "/devices/SN-1/purge", DevicePurge},
+		{"POST", "/devices/:device_serial_number/restore", "/devices/SN-1/restore", DeviceRestore},
+		{"GET", "/devices/:device_serial_number/status", "/devices/SN-1/status", DeviceStatusFetch},
+		{"GET", "/devices/:device_serial_number/status/history", "/devices/SN-1/status/history", DeviceStatusHistory},
+		{"GET", "/devices/:device_serial_number/meter", "/devices/SN-1/meter", DeviceMeterFetch},
+		{"GET", "/devices/:device_serial_number/tags", "/devices/SN-1/tags", DeviceTagFetch},
+		{"GET", "/devices/:device_serial_number/dependencies", "/devices/SN-1/dependencies", DeviceDependencyFetch},
+		{"GET", "/devices/:device_serial_number/impact", "/devices/SN-1/impact", DeviceImpact},
+		{"GET", "/sites/:site_id", "/sites/" + siteID, SiteFetchByID},
+		{"GET", "/sites/:site_id/devices", "/sites/" + siteID + "/devices", DeviceFetchBySiteID},
+		{"GET", "/gateways/:gateway/summary", "/gateways/GW-1/summary", GatewaySummary},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.route, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.Fail(errDatabase)
+
+			w := serve(tt.method, tt.route, tt.path, admin, tt.handler)
+			if w.Code != http.StatusInternalServerError {
+				t.Errorf("status = %d, want %d: %s", w.Code, http.StatusInternalServerError, w.Body)
+			}
+		})
+	}
+}
+
+// TestDeviceNotFound checks that routes under a device answer 404 for unknown and deleted devices
+func TestDeviceNotFound(t *testing.T) {
+	owner := newFixture()
+
+	tests := []struct {
+		method  string
+		route   string
+		path    string
+		handler gin.HandlerFunc
+	}{
+		{"GET", "/devices/:device_serial_number/status", "/devices/SN-1/status", DeviceStatusFetch},
+		{"GET", "/devices/:device_serial_number/meter", "/devices/SN-1/meter", DeviceMeterFetch},
+		{"GET", "/devices/:device_serial_number/tags", "/devices/SN-1/tags", DeviceTagFetch},
+		{"GET", "/devices/:device_serial_number/dependencies", "/devices/SN-1/dependencies", DeviceDependencyFetch},
+	}
+
+	for _, tt := range tests {
+		for _, deleted := range []bool{false, true} {
+			name := tt.route + " unknown"
+			if deleted {
+				name = tt.route + " deleted"
+			}
+
+			t.Run(name, func(t *testing.T) {
+				db := dbtest.Install(t)
+				if deleted {
+					db.On("FROM `devices`", owner.devices(true, "SN-1"))
+				}
+
+				w := serve(tt.method, tt.route, tt.path, admin, tt.handler)
+				if w.Code != http.StatusNotFound {
+					t.Errorf("status = %d, want %d: %s", w.Code, http.StatusNotFound, w.Body)
+				}
+			})
+		}
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestProvisioningSessionCommit(t *testing.T) {
+	owner := newFixture()
+	sessionID := uuid.NewString()
+
+	plan := `{"site": {"name": "New Site"}, "gateway": "GW-1", "devices": [` +
+		`{"controller": "DSE 890", "controller_serial_number": "C-1", "device_type": "AHU", "device_name": "AHU-1", "device_serial_number": "SN-1"},` +
+		`{"gateway": "GW-2", "controller": "DSE 890", "controller_serial_number": "C-1", "device_type": "AHU", "device_name": "AHU-2", "device_serial_number": "SN-2"}` +
+		`], "tokens": ["DSE_890_API"]}`
+	session := func(state, plan string, expiresAt time.Time) dbtest.Result {
+		return dbtest.Result{
+			Columns: []string{"id", "customer_id", "state", "plan", "expires_at"},
+			Rows:    [][]driver.Value{{sessionID, owner.customerID.String(), state, plan, expiresAt}},
+		}
+	}
+	open := session(models.ProvisioningOpen, plan, time.Now().Add(time.Hour))
+
+	tests := []struct {
+		name        string
+		session     dbtest.Result
+		scripts     map[string]dbtest.Result
+		want        int
+		wantInserts []string // tables inserted into, in order
+	}{
+		{name: "not found", session: dbtest.Result{Columns: []string{"id"}}, want: http.StatusNotFound},
+		{name: "committed", session: session(models.ProvisioningCommitted, plan, time.Now().Add(time.Hour)), want: http.StatusConflict},
+		{name: "expired", session: session(models.ProvisioningOpen, plan, time.Now().Add(-time.Minute)), want: http.StatusConflict},
+		{name: "no site", session: session(models.ProvisioningOpen, `{}`, time.Now().Add(time.Hour)), want: http.StatusConflict},
+		{
+			name:    "site name taken",
+			session: open,
+			scripts: map[string]dbtest.Result{"count(*) FROM `sites`": {Columns: []string{"count(*)"}, Rows: [][]driver.Value{{int64(1)}}}},
+			want:    http.StatusConflict,
+		},
+		{
+			name:    "serial number taken",
+			session: open,
+			scripts: map[string]dbtest.Result{
+				"SELECT DISTINCT `device_serial_number`": {Columns: []string{"device_serial_number"}, Rows: [][]driver.Value{{"SN-2"}}},
+			},
+			want: http.StatusConflict,
+		},
+		{name: "commit", session: open, want: http.StatusOK, wantInserts: []string{"sites", "devices", "devices", "auth_tokens"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DEVICES_SERVER_JWT_SECRET", "secret")
+
+			db := dbtest.Install(t)
+			for fragment, result := range tt.scripts {
+				db.On(fragment, result)
+			}
+			db.On("FROM `provisioning_sessions`", tt.session)
+			db.On("FROM `customers`", dbtest.Result{Columns: []string{"id", "name"}, Rows: [][]driver.Value{{owner.customerID.String(), "Customer"}}})
+
+			path := "/provisioning-sessions/" + sessionID + "/commit"
+			w := serve("POST", "/provisioning-sessions/:session_id/commit", path, admin, ProvisioningSessionCommit)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+
+			var inserts []string
+			committed := false
+			for _, query := range db.Queries() {
+				if table, ok := strings.CutPrefix(query.SQL, "INSERT INTO `"); ok {
+					inserts = append(inserts, table[:strings.Index(table, "`")])
+				}
+				if strings.HasPrefix(query.SQL, "UPDATE `provisioning_sessions`") && strings.Contains(query.SQL, "`state`=") {
+					committed = true
+				}
+			}
+			if !slices.Equal(inserts, tt.wantInserts) {
+				t.Errorf("inserts = %q, want %q", inserts, tt.wantInserts)
+			}
+			if committed != (tt.want == http.StatusOK) {
+				t.Errorf("session state updated = %v, want %v", committed, tt.want == http.StatusOK)
+			}
+
+			if tt.want != http.StatusOK {
+				return
+			}
+
+			var response struct {
+				Data ProvisioningCommitResponse `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			var gateways []string
+			for _, device := range response.Data.Devices {
+				gateways = append(gateways, device.Gateway)
+			}
+			if !slices.Equal(gateways, []string{"GW-1", "GW-2"}) {
+				t.Errorf("device gateways = %q, want the session gateway unless a device names its own", gateways)
+			}
+			if len(response.Data.Tokens) != 1 || response.Data.Tokens[0].Token == "" {
+				t.Errorf("tokens = %+v, want one issued token", response.Data.Tokens)
+			}
+			if response.Data.Session.State != models.ProvisioningCommitted {
+				t.Errorf("session state = %q, want %q", response.Data.Session.State, models.ProvisioningCommitted)
+			}
+		})
+	}
+}
+
+func TestProvisioningSessionAddDevices(t *testing.T) {
+	sessionID := uuid.NewString()
+	device := `{"controller": "DSE 890", "controller_serial_number": "C-1", "device_type": "AHU", "device_name": "AHU-1", "device_serial_number": "SN-1"}`
+
+	tests := []struct {
+		name string
+		plan string
+		body string
+		want int
+	}{
+		{name: "empty list", plan: `{"gateway": "GW-1"}`, body: `[]`, want: http.StatusBadRequest},
+		{name: "no gateway", plan: `{}`, body: `[` + device + `]`, want: http.StatusBadRequest},
+		{name: "staged twice", plan: `{"gateway": "GW-1", "devices": [` + device + `]}`, body: `[` + device + `]`, want: http.StatusBadRequest},
+		{name: "duplicate in request", plan: `{"gateway": "GW-1"}`, body: `[` + device + `, ` + device + `]`, want: http.StatusBadRequest},
+		{name: "staged", plan: `{"gateway": "GW-1"}`, body: `[` + device + `]`, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `provisioning_sessions`", dbtest.Result{
+				Columns: []string{"id", "customer_id", "state", "plan", "expires_at"},
+				Rows:    [][]driver.Value{{sessionID, uuid.NewString(), models.ProvisioningOpen, tt.plan, time.Now().Add(time.Hour)}},
+			})
+
+			r := gin.New()
+			r.POST("/provisioning-sessions/:session_id/devices", ProvisioningSessionAddDevices)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("POST", "/provisioning-sessions/"+sessionID+"/devices", strings.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+
+			updated := false
+			for _, query := range db.Queries() {
+				if strings.HasPrefix(query.SQL, "UPDATE `provisioning_sessions`") {
+					updated = true
+				}
+			}
+			if updated != (tt.want == http.StatusOK) {
+				t.Errorf("plan updated = %v, want %v", updated, tt.want == http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestInvalidSiteLocation(t *testing.T) {
+	tests := []struct {
+		name      string
+		address   string
+		latitude  *float64
+		longitude *float64
+		timezone  string
+		valid     bool
+	}{
+		{name: "empty", valid: true},
+		{name: "full", address: "1 Main Street", latitude: ptr(-33.9), longitude: ptr(18.4), timezone: "Africa/Johannesburg", valid: true},
+		{name: "latitude only", latitude: ptr(-33.9)},
+		{name: "latitude out of range", latitude: ptr(91.0), longitude: ptr(18.4)},
+		{name: "longitude out of range", latitude: ptr(-33.9), longitude: ptr(-181.0)},
+		{name: "unknown timezone", timezone: "Mars/Olympus_Mons"},
+		{name: "local timezone", timezone: "Local"},
+		{name: "long address", address: strings.Repeat("a", maxAddressLength+1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason := invalidSiteLocation(tt.address, tt.latitude, tt.longitude, tt.timezone)
+			if (reason == "") != tt.valid {
+				t.Errorf("invalidSiteLocation = %q, want valid %v", reason, tt.valid)
+			}
+		})
+	}
+}
+
+func TestCustomerFetchAll(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		want      int
+		wantSQL   []string
+		paginated bool
+	}{
+		{name: "default", want: http.StatusOK, wantSQL: []string{"ORDER BY name,id"}},
+		{name: "name contains", query: "?name_contains=Acme", want: http.StatusOK, wantSQL: []string{"name LIKE ?"}},
+		{name: "sort descending", query: "?sort=-created_at", want: http.StatusOK, wantSQL: []string{"ORDER BY created_at DESC,id"}},
+		{name: "invalid sort", query: "?sort=id", want: http.StatusBadRequest},
+		{name: "paginated", query: "?page=2&per_page=10", want: http.StatusOK, wantSQL: []string{"LIMIT ? OFFSET ?"}, paginated: true},
+		{name: "invalid page", query: "?per_page=0", want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+
+			w := serve("GET", "/customers", "/customers"+tt.query, admin, CustomerFetchAll)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			queries := db.Queries()
+			page := queries[len(queries)-1].SQL
+			for _, want := range tt.wantSQL {
+				if !strings.Contains(page, want) {
+					t.Errorf("query %q does not contain %q", page, want)
+				}
+			}
+
+			var body struct {
+				Pagination *serverutils.Pagination `json:"pagination"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if (body.Pagination != nil) != tt.paginated {
+				t.Errorf("pagination = %+v, want present %v", body.Pagination, tt.paginated)
+			}
+		})
+	}
+}
+
+func TestSiteFetchAllFilters(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		want      int
+		wantWhere []string
+		paginated bool
+	}{
+		{name: "customer", query: "?customer_id=" + uuid.NewString(), want: http.StatusOK, wantWhere: []string{"sites.customer_id = ?"}},
+		{name: "invalid customer", query: "?customer_id=acme", want: http.StatusBadRequest},
+		{name: "name contains", query: "?name_contains=Tower", want: http.StatusOK, wantWhere: []string{"sites.name LIKE ?"}},
+		{name: "paginated", query: "?page=2&per_page=10&name_contains=Tower", want: http.StatusOK, wantWhere: []string{"sites.name LIKE ?", "LIMIT ? OFFSET ?"}, paginated: true},
+		{name: "invalid page", query: "?page=0", want: http.StatusBadRequest},
+		{name: "timezone", query: "?timezone=Africa/Johannesburg", want: http.StatusOK, wantWhere: []string{"sites.timezone = ?"}},
+		{name: "bbox", query: "?bbox=18.3,-34.1,18.6,-33.8", want: http.StatusOK, wantWhere: []string{"sites.longitude BETWEEN ? AND ? AND sites.latitude BETWEEN ? AND ?"}},
+		{name: "bbox with three values", query: "?bbox=18.3,-34.1,18.6", want: http.StatusBadRequest},
+		{name: "bbox not a number", query: "?bbox=a,b,c,d", want: http.StatusBadRequest},
+		{name: "bbox inverted", query: "?bbox=18.6,-33.8,18.3,-34.1", want: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+
+			w := serve("GET", "/sites", "/sites"+tt.query, admin, SiteFetchAll)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+
+			queries := db.Queries()
+			if tt.want != http.StatusOK {
+				if len(queries) > 0 {
+					t.Errorf("sites were queried for an invalid filter: %s", queries[0].SQL)
+				}
+				return
+			}
+			// A paginated list is counted before the page is fetched
+			wantQueries := 1
+			if tt.paginated {
+				wantQueries = 2
+			}
+			if len(queries) != wantQueries {
+				t.Fatalf("ran %d queries, want %d", len(queries), wantQueries)
+			}
+			page := queries[len(queries)-1].SQL
+			for _, where := range tt.wantWhere {
+				if !strings.Contains(page, where) {
+					t.Errorf("query %q does not filter on %q", page, where)
+				}
+			}
+
+			var body struct {
+				Pagination *serverutils.Pagination `json:"pagination"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if (body.Pagination != nil) != tt.paginated {
+				t.Errorf("pagination = %+v, want present %v", body.Pagination, tt.paginated)
+			}
+		})
+	}
+}
+
+func TestDeviceStatusReportReadings(t *testing.T) {
+	owner := newFixture()
+
+	db := dbtest.Install(t)
+	db.On("FROM `devices`", owner.devices(false, "SN-1"))
+	db.On("FROM `point_addresses`", dbtest.Result{Columns: []string{"point_name"}, Rows: [][]driver.Value{{"supply_air_temperature"}}})
+
+	r := gin.New()
+	r.POST("/devices/:device_serial_number/status", func(c *gin.Context) { c.Set("role", "admin") }, DeviceStatusReport)
+	w := httptest.NewRecorder()
+	body := `{"readings": {"supply_air_temperature": 18.5, "unknown_point": 1}}`
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/devices/SN-1/status", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	var response serverutils.Response
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if len(response.Warnings) != 1 || !strings.HasSuffix(response.Warnings[0], ": unknown_point") {
+		t.Errorf("warnings = %q, want one naming the unknown point", response.Warnings)
+	}
+
+	var saved []driver.Value
+	for _, query := range db.Queries() {
+		if strings.HasPrefix(query.SQL, "INSERT INTO `point_readings`") {
+			saved = append(saved, query.Args...)
+		}
+	}
+	if !slices.Contains(saved, driver.Value("supply_air_temperature")) || slices.Contains(saved, driver.Value("unknown_point")) {
+		t.Errorf("saved readings %v, want only the registered point", saved)
+	}
+}
+
+func TestDeviceLatestReadings(t *testing.T) {
+	owner := newFixture()
+	reportedAt := time.Date(2025, 1, 1, 8, 0, 0, 0, time.UTC)
+
+	db := dbtest.Install(t)
+	db.On("FROM `devices`", owner.devices(false, "SN-1"))
+	db.On("FROM `point_addresses`", dbtest.Result{
+		Columns: []string{"point_name", "unit", "value", "reported_at"},
+		Rows: [][]driver.Value{
+			{"return_air_temperature", "°C", nil, nil},
+			{"supply_air_temperature", "°C", 18.5, reportedAt},
+		},
+	})
+
+	w := serve("GET", "/devices/:device_serial_number/latest", "/devices/SN-1/latest", admin, DeviceLatestReadings)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	var response struct {
+		Data DeviceLatestResponse `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+
+	points := response.Data.Points
+	if len(points) != 2 {
+		t.Fatalf("got %d points, want 2", len(points))
+	}
+	if points[0].Value != nil || points[0].ReportedAt != nil {
+		t.Errorf("unreported point = %+v, want no value", points[0])
+	}
+	if points[1].Value == nil || *points[1].Value != 18.5 || points[1].ReportedAt == nil {
+		t.Errorf("reported point = %+v, want value 18.5", points[1])
+	}
+}
+
+func TestTagRuleCreate(t *testing.T) {
+	rule := `{"name": "no-comms-7d", "tag": "no-comms-7d", "field": "no_comms_days", "operator": "gte", "value": "7"}`
+
+	tests := []struct {
+		name     string
+		body     string
+		existing int64
+		want     int
+	}{
+		{name: "invalid tag", body: `{"name": "r", "tag": "no comms", "field": "status", "operator": "eq", "value": "offline"}`, want: http.StatusBadRequest},
+		{name: "invalid condition", body: `{"name": "r", "tag": "t", "field": "no_comms_days", "operator": "eq", "value": "7"}`, want: http.StatusBadRequest},
+		{name: "name taken", body: rule, existing: 1, want: http.StatusBadRequest},
+		{name: "created", body: rule, want: http.StatusCreated},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("count(*) FROM `tag_rules`", dbtest.Result{Columns: []string{"count"}, Rows: [][]driver.Value{{tt.existing}}})
+
+			r := gin.New()
+			r.POST("/tag-rules", TagRuleCreate)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("POST", "/tag-rules", strings.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestSiteBulkCreate(t *testing.T) {
+	owner := newFixture()
+	deletedAt := time.Date(2025, 1, 1, 8, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		body         string
+		existing     [][]driver.Value // name, deleted_at
+		want         int
+		wantResults  []string
+		wantRestored int
+	}{
+		{name: "empty", body: `[]`, want: http.StatusBadRequest},
+		{name: "duplicate name", body: `[{"name": "A"}, {"name": "A"}]`, want: http.StatusUnprocessableEntity, wantResults: []string{"skipped", "invalid"}},
+		{name: "name taken", body: `[{"name": "A"}, {"name": "B"}]`, existing: [][]driver.Value{{"B", nil}}, want: http.StatusUnprocessableEntity, wantResults: []string{"skipped", "invalid"}},
+		{name: "invalid location", body: `[{"name": "A", "latitude": 91, "longitude": 0}]`, want: http.StatusUnprocessableEntity, wantResults: []string{"invalid"}},
+		{name: "created and restored", body: `[{"name": "A"}, {"name": "B"}]`, existing: [][]driver.Value{{"B", deletedAt}}, want: http.StatusOK, wantResults: []string{"created", "restored"}, wantRestored: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `customers`", dbtest.Result{Columns: []string{"id", "name"}, Rows: [][]driver.Value{{owner.customerID.String(), "Customer"}}})
+			rows := [][]driver.Value{}
+			for _, site := range tt.existing {
+				rows = append(rows, []driver.Value{uuid.NewString(), site[0], owner.customerID.String(), site[1]})
+			}
+			db.On("FROM `sites`", dbtest.Result{Columns: []string{"id", "name", "customer_id", "deleted_at"}, Rows: rows})
+
+			r := gin.New()
+			r.POST("/customers/:customer_id/sites/bulk", SiteBulkCreate)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("POST", "/customers/"+owner.customerID.String()+"/sites/bulk", strings.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.wantResults == nil {
+				return
+			}
+
+			var response struct {
+				Data SiteBulkResponse `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			var results []string
+			for _, result := range response.Data.Results {
+				results = append(results, result.Result)
+			}
+			if !slices.Equal(results, tt.wantResults) {
+				t.Errorf("results = %v, want %v", results, tt.wantResults)
+			}
+			if response.Data.Restored != tt.wantRestored {
+				t.Errorf("restored = %d, want %d", response.Data.Restored, tt.wantRestored)
+			}
+
+			written := false
+			for _, query := range db.Queries() {
+				if strings.HasPrefix(query.SQL, "INSERT INTO `sites`") || strings.HasPrefix(query.SQL, "UPDATE `sites`") {
+					written = true
+				}
+			}
+			if written != (tt.want == http.StatusOK) {
+				t.Errorf("sites written = %v, want %v", written, tt.want == http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestParseFilterQuery(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+		valid bool
+	}{
+		{query: "?tag=Gauteng&device_type=chiller", want: "device_type=chiller&tag=Gauteng", valid: true},
+		{query: "tag=a&tag=b", want: "tag=a&tag=b", valid: true},
+		{query: ""},
+		{query: "page=2"},
+		{query: "device_type=%zz"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			params, reason := parseFilterQuery(tt.query)
+			if (reason == "") != tt.valid {
+				t.Fatalf("reason = %q, want valid %v", reason, tt.valid)
+			}
+			if tt.valid && params.Encode() != tt.want {
+				t.Errorf("query = %q, want %q", params.Encode(), tt.want)
+			}
+		})
+	}
+}
+
+func TestSavedFilterDevices(t *testing.T) {
+	owner := newFixture()
+	filterID := uuid.NewString()
+
+	tests := []struct {
+		name      string
+		who       requester
+		wantOwner string
+		wantScope bool
+	}{
+		{name: "admin", who: admin, wantOwner: models.SavedFilterOwnerAdmin},
+		{name: "customer", who: requester{role: "user", customerID: owner.customerID.String()}, wantOwner: owner.customerID.String(), wantScope: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `saved_filters`", dbtest.Result{
+				Columns: []string{"id", "owner", "name", "query"},
+				Rows:    [][]driver.Value{{filterID, tt.wantOwner, "Chillers", "device_type=chiller"}},
+			})
+
+			w := serve("GET", "/filters/:filter_id/devices", "/filters/"+filterID+"/devices", tt.who, SavedFilterDevices)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+
+			var lookup, list *dbtest.Query
+			queries := db.Queries()
+			for i := range queries {
+				switch {
+				case strings.Contains(queries[i].SQL, "FROM `saved_filters`"):
+					lookup = &queries[i]
+				case strings.Contains(queries[i].SQL, "FROM `devices`"):
+					list = &queries[i]
+				}
+			}
+			if lookup == nil || !slices.Contains(lookup.Args, driver.Value(tt.wantOwner)) {
+				t.Fatalf("filter lookup %v, want it scoped to owner %s", lookup, tt.wantOwner)
+			}
+			if list == nil || !strings.Contains(list.SQL, "devices.device_type = ?") {
+				t.Fatalf("device query %v, want the saved filter applied", list)
+			}
+			if scoped := strings.Contains(list.SQL, "sites.customer_id = ?"); scoped != tt.wantScope {
+				t.Errorf("scoped to the customer = %v, want %v", scoped, tt.wantScope)
+			}
+		})
+	}
+}
+
+func TestGatewayReplace(t *testing.T) {
+	owner := newFixture()
+
+	tests := []struct {
+		name    string
+		body    string
+		devices []string
+		inUse   int64
+		want    int
+	}{
+		{name: "same gateway", body: `{"gateway": "GW-1"}`, want: http.StatusBadRequest},
+		{name: "unknown gateway", body: `{"gateway": "GW-2"}`, want: http.StatusNotFound},
+		{name: "new gateway in use", body: `{"gateway": "GW-2"}`, devices: []string{"SN-1"}, inUse: 1, want: http.StatusConflict},
+		{name: "replaced", body: `{"gateway": "GW-2"}`, devices: []string{"SN-1", "SN-2"}, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("count(*) FROM `devices`", dbtest.Result{Columns: []string{"count"}, Rows: [][]driver.Value{{tt.inUse}}})
+			db.On("FROM `devices`", owner.devices(false, tt.devices...))
+
+			r := gin.New()
+			r.POST("/gateways/:gateway/replace", GatewayReplace)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("POST", "/gateways/GW-1/replace", strings.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+
+			updated := false
+			for _, query := range db.Queries() {
+				if strings.HasPrefix(query.SQL, "UPDATE `devices` SET `gateway`") {
+					updated = true
+				}
+			}
+			if updated != (tt.want == http.StatusOK) {
+				t.Errorf("devices updated = %v, want %v", updated, tt.want == http.StatusOK)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+
+			var response struct {
+				Data GatewayReplaceResponse `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if !slices.Equal(response.Data.Devices, tt.devices) {
+				t.Errorf("devices = %v, want %v", response.Data.Devices, tt.devices)
+			}
+		})
+	}
+}
+
+func TestSiteDeleteCascade(t *testing.T) {
+	owner := newFixture()
+
+	tests := []struct {
+		name        string
+		query       string
+		devices     []string
+		want        int
+		wantDeleted bool
+	}{
+		{name: "invalid cascade", query: "?cascade=sites", want: http.StatusBadRequest},
+		{name: "no devices", want: http.StatusOK, wantDeleted: true},
+		{name: "devices without cascade", devices: []string{"SN-1"}, want: http.StatusConflict},
+		{name: "dry run", query: "?cascade=devices&dry_run=true", devices: []string{"SN-1"}, want: http.StatusOK},
+		{name: "dry run without cascade", query: "?dry_run=true", devices: []string{"SN-1"}, want: http.StatusConflict},
+		{name: "cascade", query: "?cascade=devices", devices: []string{"SN-1", "SN-2"}, want: http.StatusOK, wantDeleted: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `sites`", dbtest.Result{
+				Columns: []string{"id", "name", "customer_id"},
+				Rows:    [][]driver.Value{{owner.siteID.String(), "Site", owner.customerID.String()}},
+			})
+			db.On("FROM `customers`", dbtest.Result{Columns: []string{"id", "name"}, Rows: [][]driver.Value{{owner.customerID.String(), "Customer"}}})
+			db.On("FROM `devices`", owner.devices(false, tt.devices...))
+
+			w := serve("DELETE", "/sites/:site_id", "/sites/"+owner.siteID.String()+tt.query, admin, SiteDelete)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+
+			var siteDeleted, devicesDeleted bool
+			for _, query := range db.Queries() {
+				switch {
+				case strings.HasPrefix(query.SQL, "UPDATE `sites` SET `deleted_at`"):
+					siteDeleted = true
+				case strings.HasPrefix(query.SQL, "UPDATE `devices` SET `deleted_at`"):
+					devicesDeleted = true
+				}
+			}
+			if siteDeleted != tt.wantDeleted {
+				t.Errorf("site deleted = %v, want %v", siteDeleted, tt.wantDeleted)
+			}
+			if wantDevices := tt.wantDeleted && len(tt.devices) > 0; devicesDeleted != wantDevices {
+				t.Errorf("devices deleted = %v, want %v", devicesDeleted, wantDevices)
+			}
+		})
+	}
+}
+
+func TestSiteHealth(t *testing.T) {
+	owner, other := newFixture(), newFixture()
+	computedAt := time.Date(2025, 1, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		query       string
+		who         requester
+		snapshots   int
+		want        int
+		wantCurrent bool
+	}{
+		{name: "inverted range", query: "?from=2025-01-10T00:00:00Z&to=2025-01-09T00:00:00Z", who: admin, want: http.StatusBadRequest},
+		{name: "other customer", who: requester{role: "user", customerID: other.customerID.String()}, want: http.StatusForbidden},
+		{name: "not scored yet", who: admin, want: http.StatusOK},
+		{name: "owner", who: requester{role: "user", customerID: owner.customerID.String()}, snapshots: 2, want: http.StatusOK, wantCurrent: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `sites`", dbtest.Result{
+				Columns: []string{"id", "name", "customer_id"},
+				Rows:    [][]driver.Value{{owner.siteID.String(), "Site", owner.customerID.String()}},
+			})
+			snapshots := dbtest.Result{Columns: []string{"site_id", "computed_at", "score", "devices"}}
+			for i := 0; i < tt.snapshots; i++ {
+				snapshots.Rows = append(snapshots.Rows, []driver.Value{owner.siteID.String(), computedAt.Add(time.Duration(i) * time.Hour), 87.5, 4})
+			}
+			db.On("FROM `site_health_snapshots`", snapshots)
+
+			w := serve("GET", "/sites/:site_id/health", "/sites/"+owner.siteID.String()+"/health"+tt.query, tt.who, SiteHealth)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var body struct {
+				Data SiteHealthResponse `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if (body.Data.Current != nil) != tt.wantCurrent {
+				t.Errorf("current = %+v, want present %v", body.Data.Current, tt.wantCurrent)
+			}
+			if len(body.Data.History) != tt.snapshots {
+				t.Errorf("history has %d points, want %d", len(body.Data.History), tt.snapshots)
+			}
+		})
+	}
+}
+
+func TestSiteSearch(t *testing.T) {
+	owner := newFixture()
+
+	tests := []struct {
+		name      string
+		query     string
+		who       requester
+		want      int
+		wantWhere []string
+	}{
+		{name: "no query", who: admin, want: http.StatusBadRequest},
+		{name: "admin", query: "?q=Tower", who: admin, want: http.StatusOK, wantWhere: []string{"sites.name LIKE ? OR sites.address LIKE ? OR customers.name LIKE ?"}},
+		{name: "customer", query: "?q=Tower", who: requester{role: "user", customerID: owner.customerID.String()}, want: http.StatusOK, wantWhere: []string{"sites.name LIKE ?", "sites.customer_id = ?"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `sites`", dbtest.Result{
+				Columns: []string{"id", "name", "customer_id", "customer_name"},
+				Rows:    [][]driver.Value{{owner.siteID.String(), "North Tower", owner.customerID.String(), "Customer"}},
+			})
+
+			w := serve("GET", "/sites/search", "/sites/search"+tt.query, tt.who, SiteSearch)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			queries := db.Queries()
+			if len(queries) != 1 {
+				t.Fatalf("ran %d queries, want 1", len(queries))
+			}
+			for _, where := range tt.wantWhere {
+				if !strings.Contains(queries[0].SQL, where) {
+					t.Errorf("query %q does not filter on %q", queries[0].SQL, where)
+				}
+			}
+			if args := queries[0].Args; len(args) == 0 || args[0] != "%Tower%" {
+				t.Errorf("args = %v, want the pattern %%Tower%% first", args)
+			}
+
+			var body struct {
+				Data []SiteResponse `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if len(body.Data) != 1 || body.Data[0].Name != "North Tower" {
+				t.Errorf("sites = %+v, want North Tower", body.Data)
+			}
+		})
+	}
+}
+
+func TestDeviceRegister(t *testing.T) {
+	owner := newFixture()
+	other := newFixture()
+	body := func(f fixture) string {
+		return `{"customer_id": "` + f.customerID.String() + `", "site_id": "` + f.siteID.String() + `", "gateway": "GW-1", "controller": "C",
+			"controller_serial_number": "C-1", "device_type": "AHU", "device_name": "AHU", "device_serial_number": "SN-1"}`
+	}
+	sites := func(customerID uuid.UUID) dbtest.Result {
+		return dbtest.Result{Columns: []string{"id", "name", "customer_id"}, Rows: [][]driver.Value{{owner.siteID.String(), "Site", customerID.String()}}}
+	}
+
+	tests := []struct {
+		name       string
+		body       string
+		siteOwner  *fixture
+		devices    dbtest.Result
+		want       int
+		wantResult string
+		wantWrite  string
+	}{
+		{name: "missing fields", body: `{"device_serial_number": "SN-1"}`, want: http.StatusBadRequest},
+		{name: "site of another customer", body: body(owner), siteOwner: &other, want: http.StatusForbidden},
+		{name: "created", body: body(owner), want: http.StatusOK, wantResult: "created", wantWrite: "INSERT INTO `devices`"},
+		{name: "restored", body: body(owner), devices: owner.devices(true, "SN-1"), want: http.StatusOK, wantResult: "restored", wantWrite: "UPDATE `devices`"},
+		{name: "updated", body: body(owner), devices: owner.devices(false, "SN-1"), want: http.StatusOK, wantResult: "updated", wantWrite: "UPDATE `devices`"},
+		{name: "device of another customer", body: body(owner), devices: other.devices(false, "SN-1"), want: http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `customers`", dbtest.Result{Columns: []string{"id", "name"}, Rows: [][]driver.Value{{owner.customerID.String(), "Customer"}}})
+			siteOwner := owner
+			if tt.siteOwner != nil {
+				siteOwner = *tt.siteOwner
+			}
+			db.On("FROM `sites`", sites(siteOwner.customerID))
+			db.On("FROM `devices`", tt.devices)
+			db.On("UPDATE `devices`", dbtest.Result{RowsAffected: 1})
+
+			r := gin.New()
+			r.PUT("/registrations/devices", DeviceRegister)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("PUT", "/registrations/devices", strings.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+
+			var writes []string
+			for _, query := range db.Queries() {
+				if strings.HasPrefix(query.SQL, "INSERT") || strings.HasPrefix(query.SQL, "UPDATE") {
+					writes = append(writes, query.SQL)
+				}
+			}
+			if tt.wantWrite == "" {
+				if len(writes) > 0 {
+					t.Errorf("wrote %v, want no writes", writes)
+				}
+				return
+			}
+			if len(writes) != 1 || !strings.HasPrefix(writes[0], tt.wantWrite) {
+				t.Errorf("writes = %v, want one %s", writes, tt.wantWrite)
+			}
+
+			var response struct {
+				Data DeviceRegistrationResponse `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if response.Data.Result != tt.wantResult || response.Data.SiteID != owner.siteID {
+				t.Errorf("response = %+v, want %s at the owner's site", response.Data, tt.wantResult)
+			}
+		})
+	}
+}
+
+func TestGatewayDeviceRegister(t *testing.T) {
+	owner := newFixture()
+	elsewhere := newFixture()
+	elsewhere.customerID = owner.customerID
+	device := func(gateway string) string {
+		return `{"gateway": "` + gateway + `", "controller": "C", "controller_serial_number": "C-1", "device_type": "AHU", "device_name": "AHU", "device_serial_number": "SN-1"}`
+	}
+
+	tests := []struct {
+		name      string
+		body      string
+		devices   dbtest.Result
+		want      int
+		wantWrite string
+	}{
+		{name: "no devices", body: `[]`, want: http.StatusBadRequest},
+		{name: "missing fields", body: `[{"device_serial_number": "SN-1"}]`, want: http.StatusBadRequest},
+		{name: "created without a gateway field", body: "[" + device("") + "]", want: http.StatusOK, wantWrite: "INSERT INTO `devices`"},
+		{name: "refreshed", body: "[" + device("GW-OTHER") + "]", devices: owner.devices(false, "SN-1"), want: http.StatusOK, wantWrite: "UPDATE `devices`"},
+		{name: "device of another site", body: "[" + device("") + "]", devices: elsewhere.devices(false, "SN-1"), want: http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `customers`", dbtest.Result{Columns: []string{"id", "name"}, Rows: [][]driver.Value{{owner.customerID.String(), "Customer"}}})
+			db.On("FROM `sites`", dbtest.Result{Columns: []string{"id", "name", "customer_id"}, Rows: [][]driver.Value{{owner.siteID.String(), "Site", owner.customerID.String()}}})
+			db.On("FROM `devices`", tt.devices)
+			db.On("UPDATE `devices`", dbtest.Result{RowsAffected: 1})
+
+			r := gin.New()
+			r.PUT("/gateway/devices", func(c *gin.Context) {
+				c.Set("role", serverutils.GatewayRole)
+				c.Set("customer_id", owner.customerID.String())
+				c.Set("site_id", owner.siteID.String())
+				c.Set("gateway", "GW-01")
+			}, GatewayDeviceRegister)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("PUT", "/gateway/devices", strings.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+
+			var writes []dbtest.Query
+			for _, query := range db.Queries() {
+				if strings.HasPrefix(query.SQL, "INSERT") || strings.HasPrefix(query.SQL, "UPDATE") {
+					writes = append(writes, query)
+				}
+			}
+			if tt.wantWrite == "" {
+				if len(writes) > 0 {
+					t.Errorf("wrote %v, want no writes", writes)
+				}
+				return
+			}
+			if len(writes) != 1 || !strings.HasPrefix(writes[0].SQL, tt.wantWrite) || !slices.Contains(writes[0].Args, driver.Value("GW-01")) {
+				t.Errorf("writes = %v, want one %s of the device at GW-01", writes, tt.wantWrite)
+			}
+		})
+	}
+}
+
+func TestControllerCreate(t *testing.T) {
+	owner := newFixture()
+	controllers := dbtest.Result{
+		Columns: []string{"id", "site_id", "serial_number", "controller_type", "devices"},
+		Rows:    [][]driver.Value{{uuid.NewString(), owner.siteID.String(), "C-1", "Carel", int64(2)}},
+	}
+
+	tests := []struct {
+		name     string
+		body     string
+		existing int64
+		want     int
+	}{
+		{name: "missing fields", body: `{"serial_number": "C-1"}`, want: http.StatusBadRequest},
+		{name: "created", body: `{"controller_type": "Carel", "serial_number": " C-1 "}`, want: http.StatusCreated},
+		{name: "already exists", body: `{"controller_type": "Carel", "serial_number": "C-1"}`, existing: 1, want: http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `customers`", dbtest.Result{Columns: []string{"id", "name"}, Rows: [][]driver.Value{{owner.customerID.String(), "Customer"}}})
+			db.On("FROM `sites`", dbtest.Result{Columns: []string{"id", "name", "customer_id"}, Rows: [][]driver.Value{{owner.siteID.String(), "Site", owner.customerID.String()}}})
+			db.On("count(*) FROM `controllers`", dbtest.Result{Columns: []string{"count(*)"}, Rows: [][]driver.Value{{tt.existing}}})
+			db.On("FROM `controllers`", controllers)
+			db.On("UPDATE `devices`", dbtest.Result{RowsAffected: 2})
+
+			r := gin.New()
+			r.POST("/sites/:site_id/controllers", ControllerCreate)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("POST", "/sites/"+owner.siteID.String()+"/controllers", strings.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+
+			var created, linked bool
+			for _, query := range db.Queries() {
+				if strings.HasPrefix(query.SQL, "INSERT INTO `controllers`") {
+					created = true
+				}
+				if strings.HasPrefix(query.SQL, "UPDATE `devices`") && strings.Contains(query.SQL, "`controller_id`=") &&
+					slices.Contains(query.Args, driver.Value("C-1")) {
+					linked = true
+				}
+			}
+			if created != (tt.want == http.StatusCreated) || linked != created {
+				t.Errorf("created = %v, linked devices = %v, want both %v", created, linked, tt.want == http.StatusCreated)
+			}
+		})
+	}
+}
+
+func TestControllerUpdate(t *testing.T) {
+	owner := newFixture()
+	controllerID := uuid.NewString()
+
+	db := dbtest.Install(t)
+	db.On("count(*) FROM `controllers`", dbtest.Result{Columns: []string{"count(*)"}, Rows: [][]driver.Value{{int64(0)}}})
+	db.On("FROM `controllers`", dbtest.Result{
+		Columns: []string{"id", "site_id", "serial_number", "controller_type"},
+		Rows:    [][]driver.Value{{controllerID, owner.siteID.String(), "C-1", "Carel"}},
+	})
+	db.On("UPDATE `controllers`", dbtest.Result{RowsAffected: 1})
+
+	r := gin.New()
+	r.PUT("/sites/:site_id/controllers/:controller_serial_number", ControllerUpdate)
+	w := httptest.NewRecorder()
+	body := `{"controller_type": "Siemens", "serial_number": "C-2", "firmware_version": "1.2"}`
+	r.ServeHTTP(w, httptest.NewRequest("PUT", "/sites/"+owner.siteID.String()+"/controllers/C-1", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	for _, query := range db.Queries() {
+		if strings.HasPrefix(query.SQL, "UPDATE `devices`") {
+			if !strings.Contains(query.SQL, "`controller_serial_number`=") || !slices.Contains(query.Args, driver.Value("C-2")) ||
+				!slices.Contains(query.Args, driver.Value(controllerID)) {
+				t.Errorf("device update = %v, want the devices of the controller moved to C-2", query)
+			}
+			return
+		}
+	}
+	t.Error("devices of the controller were not updated")
+}
+
+func TestControllerDelete(t *testing.T) {
+	owner := newFixture()
+	controllers := dbtest.Result{
+		Columns: []string{"id", "site_id", "serial_number", "controller_type"},
+		Rows:    [][]driver.Value{{uuid.NewString(), owner.siteID.String(), "C-1", "Carel"}},
+	}
+
+	tests := []struct {
+		name        string
+		controllers dbtest.Result
+		devices     int64
+		want        int
+	}{
+		{name: "not found", want: http.StatusNotFound},
+		{name: "devices wired", controllers: controllers, devices: 1, want: http.StatusConflict},
+		{name: "deleted", controllers: controllers, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `controllers`", tt.controllers)
+			db.On("count(*) FROM `devices`", dbtest.Result{Columns: []string{"count(*)"}, Rows: [][]driver.Value{{tt.devices}}})
+
+			path := "/sites/" + owner.siteID.String() + "/controllers/C-1"
+			w := serve("DELETE", "/sites/:site_id/controllers/:controller_serial_number", path, admin, ControllerDelete)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+
+			deleted := slices.ContainsFunc(db.Queries(), func(query dbtest.Query) bool {
+				return strings.HasPrefix(query.SQL, "DELETE FROM `controllers`")
+			})
+			if deleted != (tt.want == http.StatusOK) {
+				t.Errorf("controller deleted = %v, want %v", deleted, tt.want == http.StatusOK)
+			}
+		})
+	}
+}
+
+// TestResponsesGolden checks the exact responses of handlers against their golden files, so fields
+// that disappear from or change in a response fail the test. Run with -update to accept a change.
+func TestResponsesGolden(t *testing.T) {
+	customer := testsupport.Customer("Acme Facilities")
+	site := testsupport.Site(customer, "Main Street Tower")
+	device := testsupport.Device(site, "SN-000123")
+	controller := testsupport.Controller(site, "CTRL-0001")
+	owner := requester{role: "customer", customerID: customer.ID.String()}
+	listed := DeviceResponse{
+		ID:                     device.ID,
+		CustomerID:             customer.ID,
+		CustomerName:           customer.Name,
+		SiteID:                 site.ID,
+		SiteName:               site.Name,
+		Gateway:                device.Gateway,
+		Controller:             device.Controller,
+		ControllerSerialNumber: device.ControllerSerialNumber,
+		DeviceType:             device.DeviceType,
+		DeviceName:             device.DeviceName,
+		DeviceSerialNumber:     device.DeviceSerialNumber,
+		BuildingURL:            device.BuildingURL,
+		FirmwareVersion:        device.FirmwareVersion,
+		HardwareRevision:       device.HardwareRevision,
+		AuthToken:              device.AuthToken,
+	}
+
+	tests := []struct {
+		name    string
+		method  string
+		route   string
+		path    string
+		who     requester
+		handler gin.HandlerFunc
+		scripts []string
+		results []dbtest.Result
+	}{
+		{
+			name: "customer-fetch", method: "GET", route: "/customers/:customer_id", path: "/customers/" + customer.ID.String(),
+			who: owner, handler: CustomerFetchByID,
+			scripts: []string{"FROM `customers`"}, results: []dbtest.Result{testsupport.Rows(customer)},
+		},
+		{
+			name: "site-fetch", method: "GET", route: "/sites/:site_id", path: "/sites/" + site.ID.String(),
+			who: owner, handler: SiteFetchByID,
+			scripts: []string{"FROM `sites`", "FROM `customers`"}, results: []dbtest.Result{testsupport.Rows(site), testsupport.Rows(customer)},
+		},
+		{
+			name: "site-fetch-by-customer", method: "GET", route: "/customers/:customer_id/sites", path: "/customers/" + customer.ID.String() + "/sites",
+			who: owner, handler: SiteFetchByCustomerID,
+			scripts: []string{"FROM `customers`", "FROM `sites`"},
+			results: []dbtest.Result{testsupport.Rows(customer), testsupport.Rows(SiteResponse{
+				ID: site.ID, Name: site.Name, CustomerID: customer.ID, CustomerName: customer.Name, Timezone: site.Timezone,
+			})},
+		},
+		{
+			name: "device-fetch", method: "GET", route: "/devices/:device_serial_number", path: "/devices/" + device.DeviceSerialNumber,
+			who: admin, handler: DeviceFetchBySerialNumber,
+			scripts: []string{"FROM `devices`", "FROM `device_statuses`"},
+			results: []dbtest.Result{testsupport.Rows(device), {Columns: []string{"count(*)"}, Rows: [][]driver.Value{{int64(1)}}}},
+		},
+		{
+			name: "device-fetch-not-found", method: "GET", route: "/devices/:device_serial_number", path: "/devices/SN-MISSING",
+			who: admin, handler: DeviceFetchBySerialNumber,
+		},
+		{
+			name: "device-fetch-by-site", method: "GET", route: "/sites/:site_id/devices", path: "/sites/" + site.ID.String() + "/devices?page=1&per_page=50",
+			who: owner, handler: DeviceFetchBySiteID,
+			scripts: []string{"FROM `sites`", "FROM `customers`", "AS page_rows", "FROM `devices`"},
+			results: []dbtest.Result{
+				testsupport.Rows(site), testsupport.Rows(customer),
+				{Columns: []string{"count(*)"}, Rows: [][]driver.Value{{int64(1)}}}, testsupport.Rows(listed),
+			},
+		},
+		{
+			name: "controller-fetch-by-site", method: "GET", route: "/sites/:site_id/controllers", path: "/sites/" + site.ID.String() + "/controllers",
+			who: owner, handler: ControllerFetchBySiteID,
+			scripts: []string{"FROM `sites`", "FROM `customers`", "FROM `controllers`"},
+			results: []dbtest.Result{
+				testsupport.Rows(site), testsupport.Rows(customer),
+				testsupport.Rows(ControllerResponse{
+					ID: controller.ID, CustomerID: customer.ID, SiteID: site.ID, ControllerType: controller.ControllerType,
+					SerialNumber: controller.SerialNumber, FirmwareVersion: controller.FirmwareVersion, Devices: 1,
+					CreatedAt: timefmt.New(controller.CreatedAt),
+				}),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			for i, script := range tt.scripts {
+				db.On(script, tt.results[i])
+			}
+
+			w := serve(tt.method, tt.route, tt.path, tt.who, tt.handler)
+			testsupport.Golden(t, tt.name+".json", w.Body.Bytes())
+		})
+	}
+}
+
+func TestGatewayFetchDevices(t *testing.T) {
+	owner := newFixture()
+	gatewayID := uuid.NewString()
+	gateways := dbtest.Result{
+		Columns: []string{"id", "customer_id", "site_id", "name"},
+		Rows:    [][]driver.Value{{gatewayID, owner.customerID.String(), owner.siteID.String(), "GW-01"}},
+	}
+
+	tests := []struct {
+		name     string
+		path     string
+		who      requester
+		gateways dbtest.Result
+		want     int
+	}{
+		{name: "invalid ID", path: "/gateways/GW-01/devices", who: admin, want: http.StatusBadRequest},
+		{name: "not found", path: "/gateways/" + gatewayID + "/devices", who: admin, want: http.StatusNotFound},
+		{name: "other customer", path: "/gateways/" + gatewayID + "/devices", who: requester{role: "customer", customerID: uuid.NewString()}, gateways: gateways, want: http.StatusForbidden},
+		{name: "owner", path: "/gateways/" + gatewayID + "/devices", who: requester{role: "customer", customerID: owner.customerID.String()}, gateways: gateways, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `gateways`", tt.gateways)
+
+			w := serve("GET", "/gateways/:gateway/devices", tt.path, tt.who, GatewayFetchDevices)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+
+			listed := slices.ContainsFunc(db.Queries(), func(query dbtest.Query) bool {
+				return strings.Contains(query.SQL, "devices.gateway_id = ?") && slices.Contains(query.Args, driver.Value(gatewayID))
+			})
+			if listed != (tt.want == http.StatusOK) {
+				t.Errorf("devices of the gateway listed = %v, want %v", listed, tt.want == http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestGatewayCredentialRotate(t *testing.T) {
+	t.Setenv("DEVICES_SERVER_JWT_SECRET", "secret")
+	owner := newFixture()
+	gatewayID := uuid.NewString()
+
+	tests := []struct {
+		name     string
+		body     string
+		gateways dbtest.Result
+		want     int
+	}{
+		{name: "not found", want: http.StatusNotFound},
+		{name: "invalid binding", body: `{"allowed_cidrs": ["not-a-network"]}`, want: http.StatusBadRequest},
+		{
+			name: "rotated", want: http.StatusOK,
+			gateways: dbtest.Result{
+				Columns: []string{"id", "customer_id", "site_id", "name"},
+				Rows:    [][]driver.Value{{gatewayID, owner.customerID.String(), owner.siteID.String(), "GW-01"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `gateways`", tt.gateways)
+			db.On("FROM `customers`", dbtest.Result{Columns: []string{"id", "name"}, Rows: [][]driver.Value{{owner.customerID.String(), "Customer"}}})
+			db.On("FROM `sites`", dbtest.Result{Columns: []string{"id", "name", "customer_id"}, Rows: [][]driver.Value{{owner.siteID.String(), "Site", owner.customerID.String()}}})
+
+			r := gin.New()
+			r.POST("/admin/gateways/:gateway_id/credentials", GatewayCredentialRotate)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("POST", "/admin/gateways/"+gatewayID+"/credentials", strings.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+
+			var revoked, issued bool
+			for _, query := range db.Queries() {
+				if strings.HasPrefix(query.SQL, "DELETE FROM `gateway_credentials`") && slices.Contains(query.Args, driver.Value("GW-01")) {
+					revoked = true
+				}
+				if strings.HasPrefix(query.SQL, "INSERT INTO `gateway_credentials`") && slices.Contains(query.Args, driver.Value(gatewayID)) {
+					issued = true
+				}
+			}
+			if revoked != (tt.want == http.StatusOK) || issued != revoked {
+				t.Errorf("revoked = %v, issued = %v, want both %v", revoked, issued, tt.want == http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestTokenRefresh(t *testing.T) {
+	customerID := uuid.NewString()
+	refreshToken := "refresh-token"
+	token := func(refreshExpiresAt time.Time, allowedCIDRs any) dbtest.Result {
+		return dbtest.Result{
+			Columns: []string{"id", "customer_id", "site_id", "action", "refresh_token_hash", "refresh_expires_at", "allowed_c_id_rs"},
+			Rows:    [][]driver.Value{{uuid.NewString(), customerID, nil, "DSE_890_API", hashSecret(refreshToken), refreshExpiresAt, allowedCIDRs}},
+		}
+	}
+	future, past := time.Now().Add(time.Hour), time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name       string
+		body       string
+		token      dbtest.Result
+		want       int
+		wantIssued bool
+	}{
+		{name: "missing refresh token", body: `{}`, want: http.StatusBadRequest},
+		{name: "unknown refresh token", body: `{"refresh_token": "unknown"}`, want: http.StatusUnauthorized},
+		{name: "expired refresh token", body: `{"refresh_token": "refresh-token"}`, token: token(past, nil), want: http.StatusUnauthorized},
+		{name: "other network", body: `{"refresh_token": "refresh-token"}`, token: token(future, "10.0.0.0/8"), want: http.StatusUnauthorized},
+		{name: "refresh", body: `{"refresh_token": "refresh-token"}`, token: token(future, "192.0.2.0/24"), want: http.StatusOK, wantIssued: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DEVICES_SERVER_JWT_SECRET", "secret")
+
+			db := dbtest.Install(t)
+			db.On("FROM `auth_tokens`", tt.token)
+			db.On("FROM `customers`", dbtest.Result{Columns: []string{"id", "name"}, Rows: [][]driver.Value{{customerID, "Customer"}}})
+
+			r := gin.New()
+			r.POST("/token/refresh", TokenRefreshHandler)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("POST", "/token/refresh", strings.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+
+			var insert *dbtest.Query
+			for _, query := range db.Queries() {
+				if strings.HasPrefix(query.SQL, "INSERT INTO `auth_tokens`") {
+					insert = &query
+				}
+			}
+			if (insert != nil) != tt.wantIssued {
+				t.Fatalf("token issued = %v, want %v", insert != nil, tt.wantIssued)
+			}
+			if !tt.wantIssued {
+				return
+			}
+
+			var response struct {
+				Data models.AuthToken `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			issued := response.Data.RefreshToken
+			if issued == "" || issued == refreshToken {
+				t.Fatalf("refresh token = %q, want a new one", issued)
+			}
+			// Optional columns are passed as pointers
+			hasArg := func(want string) bool {
+				return slices.ContainsFunc(insert.Args, func(arg driver.Value) bool {
+					if p, ok := arg.(*string); ok {
+						return *p == want
+					}
+					return arg == want
+				})
+			}
+			if !hasArg(hashSecret(issued)) || !hasArg("192.0.2.0/24") {
+				t.Errorf("insert args = %v, want the new refresh token hash and the binding of the old token", insert.Args)
+			}
+
+			// The new token expires
+			for _, arg := range insert.Args {
+				if s, ok := arg.(string); ok && strings.Count(s, ".") == 2 {
+					claims, err := serverutils.ValidateJWT(s)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if _, ok := claims["exp"]; !ok {
+						t.Errorf("claims = %v, want an expiry", claims)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	t.Setenv("DEVICES_SERVER_JWT_SECRET", "secret")
+	customerID := uuid.NewString()
+
+	SetTokenTTLs(time.Minute, time.Hour)
+	t.Cleanup(func() { SetTokenTTLs(24*time.Hour, 30*24*time.Hour) })
+
+	dbtest.Install(t)
+	authToken, err := storeToken(devicesdb.BMS_DB_Instance.DB, models.Customer{ID: uuid.MustParse(customerID), Name: "Customer"}, nil, "DSE_890_API", TokenBinding{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authToken.ExpiresAt == nil || time.Until(*authToken.ExpiresAt) > time.Minute || authToken.RefreshExpiresAt == nil || time.Until(*authToken.RefreshExpiresAt) > time.Hour {
+		t.Errorf("expires at %v, refresh expires at %v, want a minute and an hour from now", authToken.ExpiresAt, authToken.RefreshExpiresAt)
+	}
+
+	expired, err := jwt.NewWithClaims(jwt.SigningMethodHS256, serverutils.Claims{
+		UserID:           customerID,
+		Role:             "user",
+		Action:           "DSE_890_API",
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute))},
+	}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := serverutils.ValidateJWT(expired); !serverutils.IsTokenExpired(err) {
+		t.Errorf("ValidateJWT() error = %v, want the token expired", err)
+	}
+}
+
+func TestAPIKeyCreate(t *testing.T) {
+	owner := newFixture()
+
+	tests := []struct {
+		name       string
+		body       string
+		existing   int64
+		want       int
+		wantScopes string
+	}{
+		{name: "missing scopes", body: `{"customer_id": "` + owner.customerID.String() + `", "name": "BMS gateway"}`, want: http.StatusBadRequest},
+		{name: "unknown scope", body: `{"customer_id": "` + owner.customerID.String() + `", "name": "BMS gateway", "scopes": ["admin"]}`, want: http.StatusBadRequest},
+		{name: "name taken", body: `{"customer_id": "` + owner.customerID.String() + `", "name": "BMS gateway", "scopes": ["read"]}`, existing: 1, want: http.StatusConflict},
+		{
+			name:       "created",
+			body:       `{"customer_id": "` + owner.customerID.String() + `", "name": " BMS gateway ", "scopes": ["read", "devices:write", "read"]}`,
+			want:       http.StatusCreated,
+			wantScopes: "read,devices:write",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `customers`", dbtest.Result{Columns: []string{"id", "name"}, Rows: [][]driver.Value{{owner.customerID.String(), "Customer"}}})
+			db.On("count(*) FROM `api_keys`", dbtest.Result{Columns: []string{"count(*)"}, Rows: [][]driver.Value{{tt.existing}}})
+
+			r := gin.New()
+			r.POST("/admin/api-keys", APIKeyCreate)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("POST", "/admin/api-keys", strings.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want != http.StatusCreated {
+				return
+			}
+
+			var response struct {
+				Data APIKeyResponse `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			key := response.Data
+			if !strings.HasPrefix(key.Key, apiKeyPrefix) || !strings.HasPrefix(key.Key, key.Prefix) || key.Name != "BMS gateway" {
+				t.Errorf("API key = %+v, want the named key with its prefix", key)
+			}
+
+			// Only the hash of the key is stored
+			insert := slices.IndexFunc(db.Queries(), func(query dbtest.Query) bool {
+				return strings.HasPrefix(query.SQL, "INSERT INTO `api_keys`")
+			})
+			if insert < 0 {
+				t.Fatal("API key not stored")
+			}
+			args := db.Queries()[insert].Args
+			if !slices.Contains(args, driver.Value(hashSecret(key.Key))) || !slices.Contains(args, driver.Value(tt.wantScopes)) || slices.Contains(args, driver.Value(key.Key)) {
+				t.Errorf("insert args = %v, want the key hash and scopes %q without the key", args, tt.wantScopes)
+			}
+		})
+	}
+}
+
+func TestAPIKeyRotate(t *testing.T) {
+	owner := newFixture()
+	keyID := uuid.NewString()
+
+	db := dbtest.Install(t)
+	db.On("FROM `api_keys`", dbtest.Result{
+		Columns: []string{"id", "customer_id", "name", "scopes", "key_hash", "prefix"},
+		Rows:    [][]driver.Value{{keyID, owner.customerID.String(), "BMS gateway", "read", hashSecret("bms_old"), "bms_old"}},
+	})
+
+	w := serve("POST", "/admin/api-keys/:key_id/rotate", "/admin/api-keys/"+keyID+"/rotate", admin, APIKeyRotate)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	var response struct {
+		Data APIKeyResponse `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if key := response.Data; key.Key == "" || key.Key == "bms_old" || !slices.Equal(key.Scopes, []string{"read"}) {
+		t.Fatalf("API key = %+v, want a new key with the same scopes", key)
+	}
+
+	updated := slices.ContainsFunc(db.Queries(), func(query dbtest.Query) bool {
+		return strings.HasPrefix(query.SQL, "UPDATE `api_keys`") && slices.Contains(query.Args, driver.Value(hashSecret(response.Data.Key)))
+	})
+	if !updated {
+		t.Error("API key hash not replaced")
+	}
+}
+
+func TestSiteEnergy(t *testing.T) {
+	owner, other := newFixture(), newFixture()
+
+	tests := []struct {
+		name        string
+		route       string
+		query       string
+		handler     gin.HandlerFunc
+		who         requester
+		want        int
+		wantRollups []EnergyRollup
+	}{
+		{name: "bad day", route: "daily", query: "?from=2025-01", handler: SiteEnergyDaily, who: admin, want: http.StatusBadRequest},
+		{name: "inverted range", route: "daily", query: "?from=2025-01-10&to=2025-01-09", handler: SiteEnergyDaily, who: admin, want: http.StatusBadRequest},
+		{name: "range too long", route: "monthly", query: "?from=2000-01&to=2025-01", handler: SiteEnergyMonthly, who: admin, want: http.StatusBadRequest},
+		{name: "other customer", route: "daily", handler: SiteEnergyDaily, who: requester{role: "user", customerID: other.customerID.String()}, want: http.StatusForbidden},
+		{
+			name: "daily", route: "daily", query: "?from=2025-01-01&to=2025-01-03", handler: SiteEnergyDaily,
+			who: requester{role: "user", customerID: owner.customerID.String()}, want: http.StatusOK,
+			wantRollups: []EnergyRollup{{Period: "2025-01-01", KWh: 1.5}, {Period: "2025-01-02", KWh: 0}, {Period: "2025-01-03", KWh: 2.25}},
+		},
+		{
+			name: "monthly", route: "monthly", query: "?from=2024-12&to=2025-01", handler: SiteEnergyMonthly, who: admin, want: http.StatusOK,
+			wantRollups: []EnergyRollup{{Period: "2024-12", KWh: 0}, {Period: "2025-01", KWh: 3.75}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `sites`", dbtest.Result{
+				Columns: []string{"id", "name", "customer_id"},
+				Rows:    [][]driver.Value{{owner.siteID.String(), "Site", owner.customerID.String()}},
+			})
+			db.On("FROM `device_energy_rollups`", dbtest.Result{
+				Columns: []string{"day", "total"},
+				Rows: [][]driver.Value{
+					{time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC), 1.5},
+					{time.Date(2025, 1, 3, 0, 0, 0, 0, time.UTC), 2.25},
+				},
+			})
+
+			route := "/sites/:site_id/energy/" + tt.route
+			w := serve("GET", route, "/sites/"+owner.siteID.String()+"/energy/"+tt.route+tt.query, tt.who, tt.handler)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var body struct {
+				Data SiteEnergyResponse `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(body.Data.Rollups, tt.wantRollups) {
+				t.Errorf("rollups = %+v, want %+v", body.Data.Rollups, tt.wantRollups)
+			}
+			if body.Data.TotalKWh != 3.75 {
+				t.Errorf("total = %v, want 3.75", body.Data.TotalKWh)
+			}
+		})
+	}
+}
+
+func TestMeterEnergy(t *testing.T) {
+	tests := []struct {
+		name     string
+		meter    models.DeviceMeter
+		increase float64
+		want     float64
+	}{
+		{name: "kWh", meter: models.DeviceMeter{Unit: "kWh", Multiplier: 1}, increase: 12, want: 12},
+		{name: "Wh with CT ratio", meter: models.DeviceMeter{Unit: "Wh", Multiplier: 40}, increase: 500, want: 20},
+		{name: "MWh", meter: models.DeviceMeter{Unit: "MWh", Multiplier: 1}, increase: 0.5, want: 500},
+		{name: "pulses", meter: models.DeviceMeter{Unit: "kWh", Multiplier: 1, PulseConstant: 1000}, increase: 2500, want: 2.5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := meterEnergy(tt.meter, tt.increase); got != tt.want {
+				t.Errorf("energy = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeviceStatusReportEnergy(t *testing.T) {
+	owner := newFixture()
+	previousAt := time.Now().Add(-time.Hour)
+
+	tests := []struct {
+		name     string
+		previous []driver.Value
+		reading  float64
+		want     []driver.Value
+	}{
+		{name: "first reading", reading: 150},
+		{name: "register increased", previous: []driver.Value{"energy", 100.0, previousAt}, reading: 150, want: []driver.Value{2.0}},
+		{name: "register reset", previous: []driver.Value{"energy", 100.0, previousAt}, reading: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `devices`", owner.devices(false, "SN-1"))
+			db.On("FROM `point_addresses`", dbtest.Result{Columns: []string{"point_name"}, Rows: [][]driver.Value{{"energy"}}})
+			db.On("FROM `device_meters`", dbtest.Result{
+				Columns: []string{"id", "unit", "multiplier", "pulse_constant", "register_point"},
+				Rows:    [][]driver.Value{{uuid.NewString(), "Wh", 40.0, 0.0, "energy"}},
+			})
+			previous := dbtest.Result{Columns: []string{"point_name", "value", "reported_at"}}
+			if tt.previous != nil {
+				previous.Rows = [][]driver.Value{tt.previous}
+			}
+			db.On("FROM `point_readings`", previous)
+
+			r := gin.New()
+			r.POST("/devices/:device_serial_number/status", func(c *gin.Context) { c.Set("role", "admin") }, DeviceStatusReport)
+			w := httptest.NewRecorder()
+			body := fmt.Sprintf(`{"readings": {"energy": %v}}`, tt.reading)
+			r.ServeHTTP(w, httptest.NewRequest("POST", "/devices/SN-1/status", strings.NewReader(body)))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+			}
+
+			var added []driver.Value
+			for _, query := range db.Queries() {
+				if strings.HasPrefix(query.SQL, "INSERT INTO `device_energy_rollups`") {
+					added = append(added, query.Args[len(query.Args)-2])
+				}
+			}
+			if !slices.Equal(added, tt.want) {
+				t.Errorf("added energy %v, want %v", added, tt.want)
+			}
+		})
+	}
+}
+
+func TestReportingDeviceOwner(t *testing.T) {
+	// The site of the device is missing from the name cache, so ownership comes from the device alone
+	owner := fixture{customerID: uuid.New(), siteID: uuid.New()}
+
+	tests := []struct {
+		name string
+		who  requester
+		want int
+	}{
+		{name: "owner", who: requester{role: "user", customerID: owner.customerID.String()}, want: http.StatusOK},
+		{name: "other customer", who: requester{role: "user", customerID: uuid.NewString()}, want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `devices`", owner.devices(false, "SN-1"))
+
+			w := serve("GET", "/devices/:device_serial_number/latest", "/devices/SN-1/latest", tt.who, DeviceLatestReadings)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestTouchGateway(t *testing.T) {
+	touches := func(db *dbtest.DB) int {
+		n := 0
+		for _, query := range db.Queries() {
+			if strings.HasPrefix(query.SQL, "UPDATE `gateways` SET `last_seen_at`") {
+				n++
+			}
+		}
+		return n
+	}
+	now := time.Now()
+
+	t.Run("debounced", func(t *testing.T) {
+		db := dbtest.Install(t)
+		gatewayID := uuid.New()
+
+		TouchGateway(devicesdb.BMS_DB_Instance.DB, &gatewayID, now)
+		TouchGateway(devicesdb.BMS_DB_Instance.DB, &gatewayID, now.Add(time.Second))
+		if n := touches(db); n != 1 {
+			t.Errorf("wrote last seen %d times within the interval, want once", n)
+		}
+
+		TouchGateway(devicesdb.BMS_DB_Instance.DB, &gatewayID, now.Add(gatewaySeenInterval))
+		if n := touches(db); n != 2 {
+			t.Errorf("wrote last seen %d times, want again after the interval", n)
+		}
+	})
+
+	t.Run("read-only", func(t *testing.T) {
+		db := dbtest.Install(t)
+		gatewayID := uuid.New()
+
+		status.SetReadOnly(true)
+		defer status.SetReadOnly(false)
+		TouchGateway(devicesdb.BMS_DB_Instance.DB, &gatewayID, now)
+		if n := touches(db); n != 0 {
+			t.Errorf("wrote last seen %d times in read-only mode, want none", n)
+		}
+	})
+}
+
+func TestAttachToDeletedParent(t *testing.T) {
+	owner := newFixture()
+	deletedAt := time.Date(2025, 1, 1, 8, 0, 0, 0, time.UTC)
+	customers := func(deletedAt driver.Value) dbtest.Result {
+		return dbtest.Result{Columns: []string{"id", "name", "deleted_at"}, Rows: [][]driver.Value{{owner.customerID.String(), "Customer", deletedAt}}}
+	}
+	sites := func(deletedAt driver.Value) dbtest.Result {
+		return dbtest.Result{Columns: []string{"id", "name", "customer_id", "deleted_at"}, Rows: [][]driver.Value{{owner.siteID.String(), "Site", owner.customerID.String(), deletedAt}}}
+	}
+	deviceBody := `{"gateway": "GW-1", "controller": "C", "controller_serial_number": "C-1", "device_type": "AHU", "device_name": "AHU", "device_serial_number": "SN-1"}`
+
+	tests := []struct {
+		name      string
+		method    string
+		route     string
+		path      string
+		body      string
+		handler   gin.HandlerFunc
+		customers dbtest.Result
+		sites     dbtest.Result
+		devices   dbtest.Result
+		want      int
+	}{
+		{
+			name: "site on a deleted customer", method: "POST", route: "/customers/:customer_id/sites", path: "/customers/" + owner.customerID.String() + "/sites",
+			body: `{"name": "Site"}`, handler: SiteCreate, customers: customers(deletedAt), sites: sites(nil), want: http.StatusUnprocessableEntity,
+		},
+		{
+			name: "device on a deleted customer", method: "POST", route: "/customers/:customer_id/sites/:site_id/devices", path: "/customers/" + owner.customerID.String() + "/sites/" + owner.siteID.String() + "/devices",
+			body: deviceBody, handler: DeviceCreate, customers: customers(deletedAt), sites: sites(nil), want: http.StatusUnprocessableEntity,
+		},
+		{
+			name: "device on a deleted site", method: "POST", route: "/customers/:customer_id/sites/:site_id/devices", path: "/customers/" + owner.customerID.String() + "/sites/" + owner.siteID.String() + "/devices",
+			body: deviceBody, handler: DeviceCreate, customers: customers(nil), sites: sites(deletedAt), want: http.StatusUnprocessableEntity,
+		},
+		{
+			name: "device restored on a deleted site", method: "POST", route: "/devices/:device_serial_number/restore", path: "/devices/SN-1/restore",
+			handler: DeviceRestore, customers: customers(nil), sites: sites(deletedAt), devices: owner.devices(true, "SN-1"), want: http.StatusUnprocessableEntity,
+		},
+		{
+			name: "device restored on a site of a deleted customer", method: "POST", route: "/devices/:device_serial_number/restore", path: "/devices/SN-1/restore",
+			handler: DeviceRestore, customers: customers(deletedAt), sites: sites(nil), devices: owner.devices(true, "SN-1"), want: http.StatusUnprocessableEntity,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `customers`", tt.customers)
+			db.On("FROM `sites`", tt.sites)
+			db.On("FROM `devices`", tt.devices)
+
+			r := gin.New()
+			r.Handle(tt.method, tt.route, func(c *gin.Context) {
+				c.Set("role", "admin")
+			}, tt.handler)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+
+			for _, query := range db.Queries() {
+				if strings.HasPrefix(query.SQL, "INSERT") || strings.HasPrefix(query.SQL, "UPDATE") {
+					t.Errorf("wrote to a deleted parent: %s", query.SQL)
+				}
+			}
+		})
+	}
+}
+
+func TestCustomerDeleteCascade(t *testing.T) {
+	owner := newFixture()
+
+	tests := []struct {
+		name        string
+		query       string
+		want        int
+		wantUpdated []string
+	}{
+		{name: "invalid cascade", query: "?cascade=sites", want: http.StatusBadRequest},
+		{name: "customer only", want: http.StatusOK, wantUpdated: []string{"`customers`"}},
+		{name: "dry run", query: "?cascade=true&dry_run=true", want: http.StatusOK},
+		{name: "cascade", query: "?cascade=true", want: http.StatusOK, wantUpdated: []string{"`devices`", "`sites`", "`auth_tokens`", "`customers`"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `customers`", dbtest.Result{Columns: []string{"id", "name"}, Rows: [][]driver.Value{{owner.customerID.String(), "Customer"}}})
+			db.On("FROM `sites`", dbtest.Result{Columns: []string{"id"}, Rows: [][]driver.Value{{owner.siteID.String()}}})
+			db.On("FROM `devices`", dbtest.Result{Columns: []string{"id"}, Rows: [][]driver.Value{{uuid.NewString()}, {uuid.NewString()}}})
+			db.On("count(*) FROM `auth_tokens`", dbtest.Result{Columns: []string{"count(*)"}, Rows: [][]driver.Value{{int64(3)}}})
+
+			w := serve("DELETE", "/customers/:customer_id", "/customers/"+owner.customerID.String()+tt.query, admin, CustomerDelete)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var updated []string
+			for _, query := range db.Queries() {
+				if table, ok := strings.CutPrefix(query.SQL, "UPDATE "); ok {
+					updated = append(updated, strings.Fields(table)[0])
+				}
+			}
+			if !slices.Equal(updated, tt.wantUpdated) {
+				t.Errorf("updated %v, want %v", updated, tt.wantUpdated)
+			}
+
+			var body struct {
+				Data CustomerDeleteResponse `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Data.Sites != 1 || body.Data.Devices != 2 || body.Data.Tokens != 3 {
+				t.Errorf("counted %+v, want 1 site, 2 devices and 3 tokens", body.Data)
+			}
+		})
+	}
+}
+
+func TestCustomerStats(t *testing.T) {
+	owner := newFixture()
+
+	tests := []struct {
+		name string
+		who  requester
+		want int
+	}{
+		{name: "other customer", who: requester{role: "customer", customerID: uuid.NewString()}, want: http.StatusForbidden},
+		{name: "owner", who: requester{role: "customer", customerID: owner.customerID.String()}, want: http.StatusOK},
+		{name: "admin", who: admin, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lastSeen := time.Date(2025, 1, 31, 12, 0, 0, 0, time.UTC)
+			db := dbtest.Install(t)
+			db.On("count(*) FROM `sites`", dbtest.Result{Columns: []string{"count(*)"}, Rows: [][]driver.Value{{int64(2)}}})
+			db.On("count(*) FROM `auth_tokens`", dbtest.Result{Columns: []string{"count(*)"}, Rows: [][]driver.Value{{int64(3)}}})
+			db.On("FROM `customers`", dbtest.Result{Columns: []string{"id", "name"}, Rows: [][]driver.Value{{owner.customerID.String(), "Customer"}}})
+			db.On("FROM `devices`", dbtest.Result{Columns: []string{"device_type", "devices"}, Rows: [][]driver.Value{{"inverter", int64(4)}, {"meter", int64(1)}}})
+			db.On("FROM `device_statuses`", dbtest.Result{Columns: []string{"last_seen"}, Rows: [][]driver.Value{{lastSeen}}})
+			db.On("FROM `customer_api_usages`", dbtest.Result{Columns: []string{"day"}, Rows: [][]driver.Value{{lastSeen}}})
+
+			w := serve("GET", "/customers/:customer_id/stats", "/customers/"+owner.customerID.String()+"/stats", tt.who, CustomerStats)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var body struct {
+				Data CustomerStatsResponse `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Data.Sites != 2 || body.Data.Devices != 5 || body.Data.Tokens != 3 || len(body.Data.ByDeviceType) != 2 {
+				t.Errorf("counted %+v, want 2 sites, 5 devices of 2 types and 3 tokens", body.Data)
+			}
+			if body.Data.LastActivity == nil {
+				t.Error("last activity missing")
+			}
+			if body.Data.LastApiUsageDay == nil || *body.Data.LastApiUsageDay != "2025-01-31" {
+				t.Errorf("last API usage day = %v, want 2025-01-31", body.Data.LastApiUsageDay)
+			}
+		})
+	}
+}
+
+func TestCustomerTree(t *testing.T) {
+	owner := newFixture()
+	emptySiteID := uuid.NewString()
+	deviceIDs := []string{uuid.NewString(), uuid.NewString()}
+
+	rows := dbtest.Result{
+		Columns: []string{"customer_id", "customer_name", "site_id", "site_name", "device_id", "device_serial_number", "device_name", "device_type"},
+		Rows: [][]driver.Value{
+			{owner.customerID.String(), "Customer", emptySiteID, "Empty", nil, "", "", ""},
+			{owner.customerID.String(), "Customer", owner.siteID.String(), "Site", deviceIDs[0], "SN-1", "AHU-1", "AHU"},
+			{owner.customerID.String(), "Customer", owner.siteID.String(), "Site", deviceIDs[1], "SN-2", "AHU-2", "AHU"},
+		},
+	}
+
+	tests := []struct {
+		name string
+		who  requester
+		rows dbtest.Result
+		want int
+	}{
+		{name: "other customer", who: requester{role: "user", customerID: uuid.NewString()}, rows: rows, want: http.StatusForbidden},
+		{name: "not found", who: admin, want: http.StatusNotFound},
+		{name: "owner", who: requester{role: "user", customerID: owner.customerID.String()}, rows: rows, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `customers`", tt.rows)
+
+			path := "/customers/" + owner.customerID.String() + "/tree"
+			w := serve("GET", "/customers/:customer_id/tree", path, tt.who, CustomerTree)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+
+			if queries := len(db.Queries()); queries != 1 {
+				t.Errorf("queries = %d, want a single joined query", queries)
+			}
+
+			var response struct {
+				Data CustomerTreeResponse `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+
+			tree := response.Data
+			if tree.ID != owner.customerID || len(tree.Sites) != 2 {
+				t.Fatalf("tree = %+v, want the customer with both sites", tree)
+			}
+			if len(tree.Sites[0].Devices) != 0 {
+				t.Errorf("empty site devices = %+v, want none", tree.Sites[0].Devices)
+			}
+			if devices := tree.Sites[1].Devices; len(devices) != 2 || devices[0].DeviceSerialNumber != "SN-1" || devices[1].DeviceSerialNumber != "SN-2" {
+				t.Errorf("site devices = %+v, want SN-1 and SN-2", devices)
+			}
+		})
+	}
+}
+
+func TestDeviceBatchGet(t *testing.T) {
+	tests := []struct {
+		name          string
+		body          string
+		want          int
+		wantFound     []string
+		wantNotFound  []string
+		wantAmbiguous []string
+	}{
+		{name: "empty", body: `{"serial_numbers": []}`, want: http.StatusBadRequest},
+		{name: "invalid customer", body: `{"serial_numbers": ["SN-1"], "customer_id": "x"}`, want: http.StatusBadRequest},
+		{
+			name: "found, missing and shared", body: `{"serial_numbers": ["SN-1", "SN-2", "SN-3", "SN-1"]}`, want: http.StatusOK,
+			wantFound: []string{"SN-1"}, wantNotFound: []string{"SN-3"}, wantAmbiguous: []string{"SN-2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `devices`", dbtest.Result{
+				Columns: []string{"id", "customer_id", "device_serial_number"},
+				Rows: [][]driver.Value{
+					{uuid.NewString(), uuid.NewString(), "SN-1"},
+					{uuid.NewString(), uuid.NewString(), "SN-2"},
+					{uuid.NewString(), uuid.NewString(), "SN-2"},
+				},
+			})
+
+			r := gin.New()
+			r.POST("/devices/batch-get", func(c *gin.Context) { c.Set("role", "admin") }, DeviceBatchGet)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("POST", "/devices/batch-get", strings.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var body struct {
+				Data DeviceBatchGetResponse `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			var found []string
+			for serialNumber := range body.Data.Found {
+				found = append(found, serialNumber)
+			}
+			if !slices.Equal(found, tt.wantFound) || !slices.Equal(body.Data.NotFound, tt.wantNotFound) || !slices.Equal(body.Data.Ambiguous, tt.wantAmbiguous) {
+				t.Errorf("found %v, not found %v, ambiguous %v", found, body.Data.NotFound, body.Data.Ambiguous)
+			}
+		})
+	}
+}
+
+func TestSiteBatchGet(t *testing.T) {
+	owner := newFixture()
+	missing := uuid.NewString()
+
+	tests := []struct {
+		name       string
+		role       string
+		body       string
+		want       int
+		wantScoped bool
+	}{
+		{name: "invalid id", role: "admin", body: `{"ids": ["x"]}`, want: http.StatusBadRequest},
+		{name: "admin", role: "admin", body: `{"ids": ["` + owner.siteID.String() + `", "` + missing + `"]}`, want: http.StatusOK},
+		{name: "customer", role: "customer", body: `{"ids": ["` + owner.siteID.String() + `", "` + missing + `"]}`, want: http.StatusOK, wantScoped: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `sites`", dbtest.Result{Columns: []string{"id", "name"}, Rows: [][]driver.Value{{owner.siteID.String(), "Site"}}})
+
+			r := gin.New()
+			r.POST("/sites/batch-get", func(c *gin.Context) {
+				c.Set("role", tt.role)
+				c.Set("customer_id", owner.customerID.String())
+			}, SiteBatchGet)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("POST", "/sites/batch-get", strings.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			scoped := strings.Contains(db.Queries()[0].SQL, "customers.id = ?")
+			if scoped != tt.wantScoped {
+				t.Errorf("scoped to the customer = %v, want %v", scoped, tt.wantScoped)
+			}
+
+			var body struct {
+				Data SiteBatchGetResponse `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := body.Data.Found[owner.siteID.String()]; !ok || !slices.Equal(body.Data.NotFound, []string{missing}) {
+				t.Errorf("found %v, not found %v", body.Data.Found, body.Data.NotFound)
+			}
+		})
+	}
+}
+
+func TestCustomerUpdateExternalRef(t *testing.T) {
+	owner := newFixture()
+
+	tests := []struct {
+		name       string
+		body       string
+		taken      int64
+		want       int
+		wantUpdate bool
+	}{
+		{name: "invalid", body: `{"name": "Customer", "external_ref": "crm ref"}`, want: http.StatusBadRequest},
+		{name: "taken", body: `{"name": "Customer", "external_ref": "CRM-1"}`, taken: 1, want: http.StatusConflict},
+		{name: "set", body: `{"name": "Customer", "external_ref": "CRM-1"}`, want: http.StatusOK, wantUpdate: true},
+		{name: "cleared", body: `{"name": "Customer", "external_ref": ""}`, want: http.StatusOK, wantUpdate: true},
+		{name: "kept", body: `{"name": "Customer"}`, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("count(*) FROM `customers`", dbtest.Result{Columns: []string{"count(*)"}, Rows: [][]driver.Value{{tt.taken}}})
+			db.On("FROM `customers`", dbtest.Result{Columns: []string{"id", "name"}, Rows: [][]driver.Value{{owner.customerID.String(), "Customer"}}})
+
+			r := gin.New()
+			r.PUT("/customers/:customer_id", func(c *gin.Context) { c.Set("role", "admin") }, CustomerUpdate)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("PUT", "/customers/"+owner.customerID.String(), strings.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+
+			updated := false
+			for _, query := range db.Queries() {
+				if strings.HasPrefix(query.SQL, "UPDATE `customers`") && strings.Contains(query.SQL, "`external_ref`") {
+					updated = true
+				}
+			}
+			if updated != tt.wantUpdate {
+				t.Errorf("external_ref updated = %v, want %v", updated, tt.wantUpdate)
+			}
+		})
+	}
+}
+
+func TestCustomerPatch(t *testing.T) {
+	owner := newFixture()
+	contractStart := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		body        string
+		want        int
+		wantColumns []string // columns updated
+	}{
+		{name: "no fields", body: `{}`, want: http.StatusBadRequest},
+		{name: "empty name", body: `{"name": ""}`, want: http.StatusBadRequest},
+		{name: "end before stored start", body: `{"contract_end": "2025-01-31"}`, want: http.StatusBadRequest},
+		{name: "contract end", body: `{"contract_end": "2025-12-31"}`, want: http.StatusOK, wantColumns: []string{"contract_end"}},
+		{name: "name", body: `{"name": "Renamed"}`, want: http.StatusOK, wantColumns: []string{"name"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `customers`", dbtest.Result{
+				Columns: []string{"id", "name", "contract_start"},
+				Rows:    [][]driver.Value{{owner.customerID.String(), "Customer", contractStart}},
+			})
+
+			r := gin.New()
+			r.PATCH("/customers/:customer_id", CustomerPatch)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("PATCH", "/customers/"+owner.customerID.String(), strings.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+
+			var columns []string
+			for _, query := range db.Queries() {
+				if !strings.HasPrefix(query.SQL, "UPDATE `customers`") {
+					continue
+				}
+				for _, column := range []string{"name", "contract_start", "contract_end", "external_ref"} {
+					if strings.Contains(query.SQL, "`"+column+"`=") {
+						columns = append(columns, column)
+					}
+				}
+			}
+			if !slices.Equal(columns, tt.wantColumns) {
+				t.Errorf("updated columns = %q, want %q", columns, tt.wantColumns)
+			}
+		})
+	}
+}
+
+func TestCustomerFetchByRef(t *testing.T) {
+	owner := newFixture()
+
+	tests := []struct {
+		name  string
+		who   requester
+		found bool
+		want  int
+	}{
+		{name: "missing", who: admin, want: http.StatusNotFound},
+		{name: "admin", who: admin, found: true, want: http.StatusOK},
+		{name: "owner", who: requester{role: "customer", customerID: owner.customerID.String()}, found: true, want: http.StatusOK},
+		{name: "other customer", who: requester{role: "customer", customerID: uuid.NewString()}, found: true, want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			customers := dbtest.Result{Columns: []string{"id", "name", "external_ref"}}
+			if tt.found {
+				customers.Rows = [][]driver.Value{{owner.customerID.String(), "Customer", "CRM-1"}}
+			}
+			db.On("FROM `customers`", customers)
+
+			w := serve("GET", "/customers/by-ref/:ref", "/customers/by-ref/CRM-1", tt.who, CustomerFetchByRef)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestDeviceChangesPoll(t *testing.T) {
+	owner := newFixture()
+
+	tests := []struct {
+		name      string
+		who       requester
+		query     string
+		visible   bool
+		want      int
+		wantReset bool
+		wantSites int
+	}{
+		{name: "invalid timeout", who: admin, query: "?since=0&timeout=5m", want: http.StatusBadRequest},
+		{name: "invalid cursor", who: admin, query: "?since=x", want: http.StatusBadRequest},
+		{name: "no cursor", who: admin, want: http.StatusOK, wantReset: true},
+		{name: "admin", who: admin, query: "?since=0", want: http.StatusOK, wantSites: 1},
+		{name: "owner", who: requester{role: "customer", customerID: owner.customerID.String()}, query: "?since=0", visible: true, want: http.StatusOK, wantSites: 1},
+		{name: "other customer", who: requester{role: "customer", customerID: uuid.NewString()}, query: "?since=0&timeout=10ms", want: http.StatusOK},
+		{name: "other site", who: requester{role: "customer", customerID: owner.customerID.String(), siteID: uuid.NewString()}, query: "?since=0&timeout=10ms", want: http.StatusOK},
+		{name: "up to date", who: admin, query: "?since=1&timeout=10ms", want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes.Reset()
+			t.Cleanup(changes.Reset)
+			changes.RecordSite(owner.siteID.String())
+
+			db := dbtest.Install(t)
+			sites := dbtest.Result{Columns: []string{"id"}}
+			if tt.visible {
+				sites.Rows = [][]driver.Value{{owner.siteID.String()}}
+			}
+			db.On("FROM `sites`", sites)
+			db.On("FROM `devices`", dbtest.Result{
+				Columns: []string{"id", "site_id", "device_serial_number"},
+				Rows:    [][]driver.Value{{uuid.NewString(), owner.siteID.String(), "SN-1"}},
+			})
+
+			w := serve("GET", "/devices/changes/poll", "/devices/changes/poll"+tt.query, tt.who, DeviceChangesPoll)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var body struct {
+				Data DeviceChangesResponse `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Data.Cursor != 1 || body.Data.Reset != tt.wantReset || len(body.Data.Sites) != tt.wantSites {
+				t.Fatalf("poll = %+v, want cursor 1, reset %v and %d sites", body.Data, tt.wantReset, tt.wantSites)
+			}
+			if tt.wantSites > 0 && len(body.Data.Sites[0].Devices) != 1 {
+				t.Errorf("devices = %+v, want the device of the site", body.Data.Sites[0].Devices)
+			}
+		})
+	}
+}
+
+func TestCustomerRestore(t *testing.T) {
+	owner := newFixture()
+
+	tests := []struct {
+		name        string
+		query       string
+		deleted     bool
+		want        int
+		wantUpdated []string
+	}{
+		{name: "invalid cascade", query: "?cascade=sites", deleted: true, want: http.StatusBadRequest},
+		{name: "not deleted", want: http.StatusConflict},
+		{name: "customer only", deleted: true, want: http.StatusOK, wantUpdated: []string{"`customers`"}},
+		{name: "cascade", query: "?cascade=true", deleted: true, want: http.StatusOK, wantUpdated: []string{"`customers`", "`sites`", "`devices`"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var deletedAt driver.Value
+			if tt.deleted {
+				deletedAt = time.Now()
+			}
+
+			db := dbtest.Install(t)
+			db.On("FROM `customers`", dbtest.Result{Columns: []string{"id", "name", "deleted_at"}, Rows: [][]driver.Value{{owner.customerID.String(), "Customer", deletedAt}}})
+			db.On("UPDATE `sites`", dbtest.Result{RowsAffected: 2})
+			db.On("UPDATE `devices`", dbtest.Result{RowsAffected: 5})
+
+			w := serve("POST", "/customers/:customer_id/restore", "/customers/"+owner.customerID.String()+"/restore"+tt.query, admin, CustomerRestore)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var updated []string
+			for _, query := range db.Queries() {
+				if table, ok := strings.CutPrefix(query.SQL, "UPDATE "); ok {
+					updated = append(updated, strings.Fields(table)[0])
+				}
+			}
+			if !slices.Equal(updated, tt.wantUpdated) {
+				t.Errorf("updated %v, want %v", updated, tt.wantUpdated)
+			}
+
+			var body struct {
+				Data CustomerRestoreResponse `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if tt.query != "" && (body.Data.Sites != 2 || body.Data.Devices != 5) {
+				t.Errorf("restored %+v, want 2 sites and 5 devices", body.Data)
+			}
+		})
+	}
+}
+
+func TestNewTokenBinding(t *testing.T) {
+	binding, err := NewTokenBinding([]string{"10.20.1.7/16", " 192.0.2.10 ", "2001:db8::/32"}, "AB:CD"+strings.Repeat("0", 60))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.20.0.0/16", "192.0.2.10/32", "2001:db8::/32"}; !slices.Equal(binding.AllowedCIDRs, want) {
+		t.Errorf("allowed CIDRs = %v, want %v", binding.AllowedCIDRs, want)
+	}
+	if want := "abcd" + strings.Repeat("0", 60); binding.CertThumbprint != want {
+		t.Errorf("thumbprint = %q, want %q", binding.CertThumbprint, want)
+	}
+
+	if _, err := NewTokenBinding([]string{"10.20.0.0/33"}, ""); err == nil {
+		t.Error("invalid CIDR accepted")
+	}
+	if _, err := NewTokenBinding(nil, "abcd"); err == nil {
+		t.Error("short thumbprint accepted")
+	}
+}
+
+func TestTokenBindingMismatch(t *testing.T) {
+	cert := []byte("client certificate")
+	sum := sha256.Sum256(cert)
+	thumbprint := hex.EncodeToString(sum[:])
+	cidrs := "10.20.0.0/16,192.0.2.10/32"
+
+	tests := []struct {
+		name       string
+		token      models.AuthToken
+		remoteAddr string
+		cert       []byte
+		want       string
+	}{
+		{name: "unbound", token: models.AuthToken{}, remoteAddr: "203.0.113.1:1234"},
+		{name: "allowed network", token: models.AuthToken{AllowedCIDRs: &cidrs}, remoteAddr: "10.20.4.5:1234"},
+		{name: "allowed address", token: models.AuthToken{AllowedCIDRs: &cidrs}, remoteAddr: "192.0.2.10:1234"},
+		{name: "other network", token: models.AuthToken{AllowedCIDRs: &cidrs}, remoteAddr: "203.0.113.1:1234", want: "network_not_allowed"},
+		{name: "certificate", token: models.AuthToken{CertThumbprint: &thumbprint}, remoteAddr: "203.0.113.1:1234", cert: cert},
+		{name: "other certificate", token: models.AuthToken{CertThumbprint: &thumbprint}, remoteAddr: "203.0.113.1:1234", cert: []byte("other"), want: "certificate_mismatch"},
+		{name: "no certificate", token: models.AuthToken{CertThumbprint: &thumbprint}, remoteAddr: "203.0.113.1:1234", want: "certificate_mismatch"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.cert != nil {
+				req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Raw: tt.cert}}}
+			}
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = req
+
+			if got := TokenBindingMismatch(c, tt.token); got != tt.want {
+				t.Errorf("mismatch = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImpersonateHandler(t *testing.T) {
+	customerID := uuid.NewString()
+
+	tests := []struct {
+		name     string
+		body     string
+		customer bool
+		want     int
+	}{
+		{name: "missing reason", body: `{"operator": "jane", "action": "DSE_890_API"}`, customer: true, want: http.StatusBadRequest},
+		{name: "ttl too long", body: `{"operator": "jane", "reason": "ticket 42", "action": "DSE_890_API", "ttl": "2h"}`, customer: true, want: http.StatusBadRequest},
+		{name: "unknown customer", body: `{"operator": "jane", "reason": "ticket 42", "action": "DSE_890_API"}`, want: http.StatusNotFound},
+		{name: "issued", body: `{"operator": "jane", "reason": "ticket 42", "action": "DSE_890_API", "ttl": "10m"}`, customer: true, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DEVICES_SERVER_JWT_SECRET", "secret")
+
+			db := dbtest.Install(t)
+			if tt.customer {
+				db.On("FROM `customers`", dbtest.Result{Columns: []string{"id", "name"}, Rows: [][]driver.Value{{customerID, "Customer"}}})
+			}
+
+			r := gin.New()
+			r.POST("/admin/impersonate/:customer_id", ImpersonateHandler)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("POST", "/admin/impersonate/"+customerID, strings.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var body struct {
+				Data ImpersonateResponse `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+
+			claims, err := serverutils.ValidateJWT(body.Data.Token)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims["user_id"] != customerID || claims["impersonated_by"] != "jane" || !IsImpersonationToken(claims) {
+				t.Errorf("claims = %v, want an impersonation token for the customer by jane", claims)
+			}
+			if expiresAt, _ := claims.GetExpirationTime(); expiresAt == nil || time.Until(expiresAt.Time) > 10*time.Minute {
+				t.Errorf("token expires at %v, want within the ttl", expiresAt)
+			}
+		})
+	}
+}
+
+func TestIsImpersonationToken(t *testing.T) {
+	// Decoded tokens hold their expiry as a number
+	soon := float64(time.Now().Add(time.Minute).Unix())
+	later := float64(time.Now().Add(24 * time.Hour).Unix())
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		want   bool
+	}{
+		{name: "impersonation", claims: jwt.MapClaims{"role": "user", "impersonated_by": "jane", "exp": soon}, want: true},
+		{name: "customer token", claims: jwt.MapClaims{"role": "user", "exp": soon}},
+		{name: "no expiry", claims: jwt.MapClaims{"role": "user", "impersonated_by": "jane"}},
+		{name: "long lived", claims: jwt.MapClaims{"role": "user", "impersonated_by": "jane", "exp": later}},
+		{name: "admin", claims: jwt.MapClaims{"role": "admin", "impersonated_by": "jane", "exp": soon}},
+		{name: "site token", claims: jwt.MapClaims{"role": "user", "impersonated_by": "jane", "site_id": uuid.NewString(), "exp": soon}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsImpersonationToken(tt.claims); got != tt.want {
+				t.Errorf("IsImpersonationToken = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCustomerSettingsFetch(t *testing.T) {
+	owner := newFixture()
+
+	tests := []struct {
+		name string
+		who  requester
+		want int
+	}{
+		{name: "other customer", who: requester{role: "customer", customerID: uuid.NewString()}, want: http.StatusForbidden},
+		{name: "owner", who: requester{role: "customer", customerID: owner.customerID.String()}, want: http.StatusOK},
+		{name: "admin", who: admin, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `customers`", dbtest.Result{Columns: []string{"id", "name"}, Rows: [][]driver.Value{{owner.customerID.String(), "Customer"}}})
+			db.On("FROM `customer_settings`", dbtest.Result{Columns: []string{"key", "value"}, Rows: [][]driver.Value{{"data_retention_days", "365"}}})
+
+			path := "/customers/" + owner.customerID.String() + "/settings"
+			w := serve("GET", "/customers/:customer_id/settings", path, tt.who, CustomerSettingsFetch)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var body struct {
+				Data CustomerSettingsResponse `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if len(body.Data.Settings) != 1 || string(body.Data.Settings["data_retention_days"]) != "365" {
+				t.Errorf("settings = %s, want the data retention days", body.Data.Settings)
+			}
+		})
+	}
+}
+
+func TestCustomerSettingsUpdate(t *testing.T) {
+	owner := newFixture()
+
+	tests := []struct {
+		name        string
+		body        string
+		want        int
+		wantInsert  bool
+		wantRemoved bool
+	}{
+		{name: "no settings", body: `{"settings": {}}`, want: http.StatusBadRequest},
+		{name: "unknown setting", body: `{"settings": {"colour": "blue"}}`, want: http.StatusBadRequest},
+		{name: "invalid retention", body: `{"settings": {"data_retention_days": 0}}`, want: http.StatusBadRequest},
+		{name: "invalid email", body: `{"settings": {"notification_emails": ["Ops <ops@example.com>"]}}`, want: http.StatusBadRequest},
+		{name: "wildcard topic", body: `{"settings": {"mqtt_topic_prefix": "acme/#"}}`, want: http.StatusBadRequest},
+		{name: "set", body: `{"settings": {"data_retention_days": 90, "notification_emails": ["ops@example.com"]}}`, want: http.StatusOK, wantInsert: true},
+		{name: "remove", body: `{"settings": {"mqtt_topic_prefix": null}}`, want: http.StatusOK, wantRemoved: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `customers`", dbtest.Result{Columns: []string{"id", "name"}, Rows: [][]driver.Value{{owner.customerID.String(), "Customer"}}})
+
+			r := gin.New()
+			r.PUT("/customers/:customer_id/settings", CustomerSettingsUpdate)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("PUT", "/customers/"+owner.customerID.String()+"/settings", strings.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+
+			var inserted, removed bool
+			for _, query := range db.Queries() {
+				if strings.HasPrefix(query.SQL, "INSERT INTO `customer_settings`") {
+					inserted = true
+					if !strings.Contains(query.SQL, "ON DUPLICATE KEY UPDATE") {
+						t.Errorf("settings inserted without replacing existing ones: %s", query.SQL)
+					}
+				}
+				if strings.HasPrefix(query.SQL, "UPDATE `customer_settings` SET `deleted_at`") {
+					removed = true
+				}
+			}
+			if inserted != tt.wantInsert || removed != tt.wantRemoved {
+				t.Errorf("inserted = %v, removed = %v, want %v and %v", inserted, removed, tt.wantInsert, tt.wantRemoved)
+			}
+		})
+	}
+}
+
+func TestFleetHistory(t *testing.T) {
+	customerA, customerB := uuid.New(), uuid.New()
+	first := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	second := first.AddDate(0, 0, 1)
+
+	tests := []struct {
+		name  string
+		query string
+		want  int
+	}{
+		{name: "invalid date", query: "?from=01-01-2025", want: http.StatusBadRequest},
+		{name: "reversed range", query: "?from=2025-02-01&to=2025-01-01", want: http.StatusBadRequest},
+		{name: "range too long", query: "?from=2024-01-01&to=2025-01-31", want: http.StatusBadRequest},
+		{name: "invalid customer", query: "?customer_id=x", want: http.StatusBadRequest},
+		{name: "history", query: "?from=2025-01-01&to=2025-01-31", want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `fleet_snapshots`", dbtest.Result{
+				Columns: []string{"day", "customer_id", "customer_name", "device_type", "devices"},
+				Rows: [][]driver.Value{
+					{first, customerA.String(), "Alpha", "inverter", int64(4)},
+					{second, customerA.String(), "Alpha", "inverter", int64(5)},
+					{second, customerA.String(), "Alpha", "meter", int64(1)},
+					{second, customerB.String(), "Beta", "inverter", int64(2)},
+				},
+			})
+
+			w := serve("GET", "/admin/stats/history", "/admin/stats/history"+tt.query, admin, FleetHistory)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var body struct {
+				Data FleetHistoryResponse `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+
+			days := body.Data.Days
+			if len(days) != 2 || days[0].Day != "2025-01-01" || days[1].Day != "2025-01-02" {
+				t.Fatalf("days = %+v, want 2025-01-01 and 2025-01-02", days)
+			}
+			if days[0].Devices != 4 || days[1].Devices != 8 {
+				t.Errorf("devices = %d and %d, want 4 and 8", days[0].Devices, days[1].Devices)
+			}
+			if len(days[1].ByCustomer) != 2 || days[1].ByCustomer[0].Devices != 6 || days[1].ByCustomer[1].Devices != 2 {
+				t.Errorf("by customer = %+v, want Alpha with 6 and Beta with 2", days[1].ByCustomer)
+			}
+			if len(days[1].ByDeviceType) != 2 || days[1].ByDeviceType[0].Devices != 7 {
+				t.Errorf("by device type = %+v, want 7 inverters and a meter", days[1].ByDeviceType)
+			}
+		})
+	}
+}
+
+func TestCustomerExport(t *testing.T) {
+	owner := newFixture()
+	otherSiteID := uuid.NewString()
+
+	db := dbtest.Install(t)
+	db.On("FROM `customers`", dbtest.Result{
+		Columns: []string{"id", "name", "contract_start"},
+		Rows:    [][]driver.Value{{owner.customerID.String(), "Customer", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}},
+	})
+	db.On("FROM `sites`", dbtest.Result{
+		Columns: []string{"id", "customer_id", "name", "timezone"},
+		Rows:    [][]driver.Value{{owner.siteID.String(), owner.customerID.String(), "Site", "Africa/Johannesburg"}},
+	})
+	db.On("FROM `devices`", dbtest.Result{
+		Columns: []string{"id", "site_id", "customer_id", "device_serial_number", "firmware_version", "auth_token"},
+		Rows: [][]driver.Value{
+			{uuid.NewString(), owner.siteID.String(), owner.customerID.String(), "SN-1", "1.2.0", "secret-1"},
+			{uuid.NewString(), otherSiteID, owner.customerID.String(), "SN-2", "", "secret-2"},
+		},
+	})
+	db.On("FROM `auth_tokens`", dbtest.Result{
+		Columns: []string{"id", "customer_id", "site_id", "action", "allowed_c_id_rs"},
+		Rows: [][]driver.Value{
+			{uuid.NewString(), owner.customerID.String(), nil, "DSE_890_API", "10.0.0.0/8,192.0.2.1/32"},
+			{uuid.NewString(), owner.customerID.String(), owner.siteID.String(), "DSE_890_API", nil},
+			{uuid.NewString(), owner.customerID.String(), otherSiteID, "DSE_890_API", nil},
+		},
+	})
+
+	path := "/customers/" + owner.customerID.String() + "/export"
+	w := serve("GET", "/customers/:customer_id/export", path, admin, CustomerExport)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	var response struct {
+		Data CustomerExportDocument `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+
+	export := response.Data
+	if export.FormatVersion != customerExportVersion || export.Customer.ContractStart == nil || *export.Customer.ContractStart != "2025-01-01" {
+		t.Errorf("customer = %+v, want version %d and the contract start date", export.Customer, customerExportVersion)
+	}
+	if len(export.Sites) != 1 || len(export.Sites[0].Devices) != 1 {
+		t.Fatalf("sites = %+v, want the site with its device", export.Sites)
+	}
+	if device := export.Sites[0].Devices[0]; device.DeviceSerialNumber != "SN-1" || device.AuthToken != "secret-1" || device.FirmwareVersion != "1.2.0" {
+		t.Errorf("device = %+v, want SN-1 with its plain auth token", device)
+	}
+
+	// The token of the site missing from the export is left out
+	want := []CustomerExportToken{
+		{Action: "DSE_890_API", AllowedCIDRs: []string{"10.0.0.0/8", "192.0.2.1/32"}},
+		{SiteName: "Site", Action: "DSE_890_API"},
+	}
+	if !reflect.DeepEqual(export.Tokens, want) {
+		t.Errorf("tokens = %+v, want %+v", export.Tokens, want)
+	}
+}
+
+func TestCustomerImport(t *testing.T) {
+	document := func(sites, tokens string) string {
+		return `{"format_version": 1, "customer": {"name": "Imported", "contract_start": "2025-01-01"}, "sites": ` + sites + `, "tokens": ` + tokens + `}`
+	}
+	device := func(serialNumber string) string {
+		return `{"gateway": "GW-1", "controller": "DSE 890", "controller_serial_number": "C-1", "device_type": "AHU", "device_name": "AHU", "device_serial_number": "` + serialNumber + `", "auth_token": "secret"}`
+	}
+	sites := `[{"name": "Site", "devices": [` + device("SN-1") + `, ` + device("SN-2") + `]}, {"name": "Empty", "devices": []}]`
+	tokens := `[{"action": "DSE_890_API"}, {"site_name": "Site", "action": "DSE_890_API"}]`
+
+	tests := []struct {
+		name        string
+		body        string
+		scripts     map[string]dbtest.Result
+		want        int
+		wantInserts []string // tables inserted into, in order
+	}{
+		{name: "unknown version", body: `{"format_version": 2, "customer": {"name": "Imported"}}`, want: http.StatusBadRequest},
+		{name: "repeated serial number", body: document(`[{"name": "Site", "devices": [`+device("SN-1")+`, `+device("SN-1")+`]}]`, `[]`), want: http.StatusBadRequest},
+		{name: "token of unknown site", body: document(`[]`, `[{"site_name": "Site", "action": "DSE_890_API"}]`), want: http.StatusBadRequest},
+		{
+			name:    "name taken",
+			body:    document(sites, tokens),
+			scripts: map[string]dbtest.Result{"count(*) FROM `customers`": {Columns: []string{"count(*)"}, Rows: [][]driver.Value{{int64(1)}}}},
+			want:    http.StatusConflict,
+		},
+		{
+			name: "serial number taken",
+			body: document(sites, tokens),
+			scripts: map[string]dbtest.Result{
+				"SELECT DISTINCT `device_serial_number`": {Columns: []string{"device_serial_number"}, Rows: [][]driver.Value{{"SN-2"}}},
+			},
+			want: http.StatusConflict,
+		},
+		{
+			name:        "import",
+			body:        document(sites, tokens),
+			want:        http.StatusCreated,
+			wantInserts: []string{"customers", "sites", "devices", "devices", "sites", "auth_tokens", "auth_tokens"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DEVICES_SERVER_JWT_SECRET", "secret")
+
+			db := dbtest.Install(t)
+			for fragment, result := range tt.scripts {
+				db.On(fragment, result)
+			}
+
+			r := gin.New()
+			r.POST("/customers/import", CustomerImport)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("POST", "/customers/import", strings.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+
+			var inserts []string
+			for _, query := range db.Queries() {
+				if table, ok := strings.CutPrefix(query.SQL, "INSERT INTO `"); ok {
+					inserts = append(inserts, table[:strings.Index(table, "`")])
+				}
+			}
+			if !slices.Equal(inserts, tt.wantInserts) {
+				t.Errorf("inserts = %q, want %q", inserts, tt.wantInserts)
+			}
+		})
+	}
+}
+
+func TestGatewayPresence(t *testing.T) {
+	presence.Reset()
+	t.Cleanup(presence.Reset)
+	presence.Seen("GW-1", time.Now())
+
+	tests := []struct {
+		name  string
+		query string
+		want  int
+		// gateway and its sites
+		wantGateways map[string][]string
+	}{
+		{name: "invalid filter", query: "?connected=yes", want: http.StatusBadRequest},
+		{name: "all", want: http.StatusOK, wantGateways: map[string][]string{"GW-1": {"North", "South"}, "GW-2": {"East"}}},
+		{name: "connected", query: "?connected=true", want: http.StatusOK, wantGateways: map[string][]string{"GW-1": {"North", "South"}}},
+		{name: "disconnected", query: "?connected=false", want: http.StatusOK, wantGateways: map[string][]string{"GW-2": {"East"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `devices`", dbtest.Result{
+				Columns: []string{"gateway", "site_name"},
+				Rows:    [][]driver.Value{{"GW-1", "North"}, {"GW-1", "South"}, {"GW-2", "East"}},
+			})
+
+			w := serve("GET", "/gateways/presence", "/gateways/presence"+tt.query, admin, GatewayPresence)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			var body struct {
+				Data []GatewayPresenceResponse `json:"data"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if len(body.Data) != len(tt.wantGateways) {
+				t.Fatalf("gateways = %+v, want %v", body.Data, tt.wantGateways)
+			}
+			for _, gateway := range body.Data {
+				if !slices.Equal(gateway.Sites, tt.wantGateways[gateway.Gateway]) {
+					t.Errorf("sites of %s = %v, want %v", gateway.Gateway, gateway.Sites, tt.wantGateways[gateway.Gateway])
+				}
+				if wantConnected := gateway.Gateway == "GW-1"; gateway.Connected != wantConnected || (gateway.LastSeen != nil) != wantConnected {
+					t.Errorf("%s connected = %v, last seen %v, want connected %v", gateway.Gateway, gateway.Connected, gateway.LastSeen, wantConnected)
+				}
+			}
+		})
+	}
+}
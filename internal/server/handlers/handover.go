@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/internal/timefmt"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"gorm.io/gorm"
+)
+
+// handoverReadme describes the contents of a handover package. Attachments and commissioning
+// checklists are kept outside this service and have to be added to the package by hand.
+const handoverReadme = `Handover package for site %s (%s)
+Customer: %s
+Generated: %s
+
+devices.csv  Device list of the site
+points.csv   Point schedule of every device on the site
+
+Attachments and commissioning checklists are not stored by the devices API and are not included.
+`
+
+// Route: GET /sites/:site_id/handover-package
+// Download a zip of the device list and point schedules of a site, for handing a completed building
+// over to the client's facilities management team
+func SiteHandoverPackage(c *gin.Context) {
+	siteID := c.Param("site_id")
+
+	// Validate the site ID
+	if !serverutils.IsValidUUID(siteID) {
+		serverutils.WriteError(c, 400, "Invalid site ID", "Invalid UUID format")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	site, err := FetchSiteByID(bmsDB, siteID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 404, "Site not found", "No site found with the given ID")
+		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch site", err.Error())
+		return
+	}
+
+	if c.GetString("role") != "admin" && site.CustomerID.String() != c.GetString("customer_id") {
+		serverutils.WriteError(c, 403, "Forbidden", "You are not authorized to access this site")
+		return
+	}
+
+	// The package is built in memory so a failed query can still be reported as a JSON error
+	var buf bytes.Buffer
+	if err := writeHandoverPackage(&buf, bmsDB, site); err != nil {
+		serverutils.WriteError(c, 500, "Failed to build handover package", err.Error())
+		return
+	}
+
+	filename := fmt.Sprintf("handover-%s-%s.zip", site.ID, time.Now().UTC().Format("20060102"))
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	c.Data(200, "application/zip", buf.Bytes())
+}
+
+// =====================================================================================================================
+
+// writeHandoverPackage writes the zip of the site's device list, point schedules and readme
+func writeHandoverPackage(out io.Writer, bmsDB *devicesdb.BMS_DB, site *models.Site) error {
+	var devices []DeviceResponse
+	if err := DeviceListQuery(bmsDB).Where("devices.site_id = ?", site.ID).Scan(&devices).Error; err != nil {
+		return fmt.Errorf("failed to fetch devices: %w", err)
+	}
+
+	ids := make([]uuid.UUID, len(devices))
+	for i, device := range devices {
+		ids[i] = device.ID
+	}
+
+	var points []models.PointAddress
+	if len(ids) > 0 {
+		if err := bmsDB.DB.Where("device_id IN ?", ids).
+			Order("device_serial_number, point_name").
+			Find(&points).Error; err != nil {
+			return fmt.Errorf("failed to fetch points: %w", err)
+		}
+	}
+
+	archive := zip.NewWriter(out)
+
+	if err := writeHandoverCSV(archive, "devices.csv", func(w *csv.Writer) {
+		w.Write(deviceCSVHeader)
+		for _, device := range devices {
+			writeDeviceCSVRow(w, device)
+		}
+	}); err != nil {
+		return err
+	}
+
+	if err := writeHandoverCSV(archive, "points.csv", func(w *csv.Writer) {
+		writePointAddressRows(w, newPointAddressRows(points))
+	}); err != nil {
+		return err
+	}
+
+	readme, err := archive.Create("README.txt")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(readme, handoverReadme, site.Name, site.ID, site.Customer.Name, timefmt.Format(time.Now()))
+
+	return archive.Close()
+}
+
+// writeHandoverCSV adds a CSV file to the handover package
+func writeHandoverCSV(archive *zip.Writer, name string, write func(w *csv.Writer)) error {
+	file, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+
+	w := csv.NewWriter(file)
+	write(w)
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/internal/timefmt"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"gorm.io/gorm"
+)
+
+// defaultHealthHistory is how far back the health history goes when no range is given
+const defaultHealthHistory = 7 * 24 * time.Hour
+
+// latestSiteHealthQuery selects the latest health snapshot of each of the given sites
+const latestSiteHealthQuery = `SELECT s.* FROM site_health_snapshots s
+	JOIN (
+		SELECT site_id, MAX(computed_at) AS computed_at
+		FROM site_health_snapshots
+		WHERE site_id IN ?
+		GROUP BY site_id
+	) latest ON latest.site_id = s.site_id AND latest.computed_at = s.computed_at`
+
+type SiteHealthPoint struct {
+	ComputedAt    timefmt.Time `json:"computed_at"`
+	Score         float64      `json:"score"`
+	Devices       int          `json:"devices"`
+	OnlineDevices int          `json:"online_devices"`
+	FaultDevices  int          `json:"fault_devices"`
+	FreshDevices  int          `json:"fresh_devices"`
+}
+
+type SiteHealthResponse struct {
+	SiteID   uuid.UUID         `json:"site_id"`
+	SiteName string            `json:"site_name"`
+	Current  *SiteHealthPoint  `json:"current"`
+	History  []SiteHealthPoint `json:"history"`
+}
+
+// Route: GET /sites/:site_id/health
+// Fetch the latest health score of a site and its trend, oldest first. The trend covers the last
+// 7 days unless ?from= and ?to= (RFC 3339) are given. Sites are scored on a schedule, so a new
+// site has no score until the next run.
+func SiteHealth(c *gin.Context) {
+	siteID := c.Param("site_id")
+
+	// Validate the site ID
+	if !serverutils.IsValidUUID(siteID) {
+		serverutils.WriteError(c, 400, "Invalid site ID", "Invalid UUID format")
+		return
+	}
+
+	from, err := parseTimeQuery(c, "from")
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid from", err.Error())
+		return
+	}
+
+	to, err := parseTimeQuery(c, "to")
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid to", err.Error())
+		return
+	}
+
+	if to.IsZero() {
+		to = time.Now().UTC()
+	}
+	if from.IsZero() {
+		from = to.Add(-defaultHealthHistory)
+	}
+	if !from.Before(to) {
+		serverutils.WriteError(c, 400, "Invalid time range", "from must be before to")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	site, err := FetchSiteByID(bmsDB, siteID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 404, "Site not found", "No site found with the given ID")
+		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch site", err.Error())
+		return
+	}
+
+	if c.GetString("role") != "admin" && site.CustomerID.String() != c.GetString("customer_id") {
+		serverutils.WriteError(c, 403, "Forbidden", "You are not authorized to access this site")
+		return
+	}
+
+	response := SiteHealthResponse{SiteID: site.ID, SiteName: site.Name, History: []SiteHealthPoint{}}
+
+	var latest models.SiteHealthSnapshot
+	err = bmsDB.DB.Where("site_id = ?", site.ID).Order("computed_at DESC").First(&latest).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 500, "Failed to fetch site health", err.Error())
+		return
+	} else if err == nil {
+		current := newSiteHealthPoint(latest)
+		response.Current = &current
+	}
+
+	var snapshots []models.SiteHealthSnapshot
+	if err := bmsDB.DB.Where("site_id = ? AND computed_at >= ? AND computed_at < ?", site.ID, from, to).
+		Order("computed_at").
+		Find(&snapshots).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch site health", err.Error())
+		return
+	}
+	for _, snapshot := range snapshots {
+		response.History = append(response.History, newSiteHealthPoint(snapshot))
+	}
+
+	serverutils.WriteJSON(c, 200, "Site health fetched", response)
+}
+
+// =====================================================================================================================
+
+// newSiteHealthPoint returns the health snapshot as it is written in responses
+func newSiteHealthPoint(snapshot models.SiteHealthSnapshot) SiteHealthPoint {
+	return SiteHealthPoint{
+		ComputedAt:    timefmt.New(snapshot.ComputedAt),
+		Score:         snapshot.Score,
+		Devices:       snapshot.Devices,
+		OnlineDevices: snapshot.OnlineDevices,
+		FaultDevices:  snapshot.FaultDevices,
+		FreshDevices:  snapshot.FreshDevices,
+	}
+}
+
+// latestSiteHealthScores returns the latest health score of each of the sites that has been scored
+func latestSiteHealthScores(bmsDB *devicesdb.BMS_DB, siteIDs []uuid.UUID) (map[uuid.UUID]float64, error) {
+	scores := make(map[uuid.UUID]float64)
+	if len(siteIDs) == 0 {
+		return scores, nil
+	}
+
+	var latest []models.SiteHealthSnapshot
+	if err := bmsDB.DB.Raw(latestSiteHealthQuery, siteIDs).Scan(&latest).Error; err != nil {
+		return nil, err
+	}
+
+	for _, snapshot := range latest {
+		scores[snapshot.SiteID] = snapshot.Score
+	}
+	return scores, nil
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/audit"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/internal/timefmt"
+	"gorm.io/gorm"
+)
+
+// defaultImpersonationTTL is how long an impersonation token lasts when no ttl is given
+const defaultImpersonationTTL = 15 * time.Minute
+
+// maxImpersonationTTL is the longest an impersonation token may last
+const maxImpersonationTTL = time.Hour
+
+// maxOperatorLength is the longest operator name recorded in the audit log
+const maxOperatorLength = 64
+
+type ImpersonateRequest struct {
+	Operator string `json:"operator"`
+	Reason   string `json:"reason"`
+	Action   string `json:"action"`
+	TTL      string `json:"ttl"`
+}
+
+type ImpersonateResponse struct {
+	Token          string       `json:"token"`
+	CustomerID     uuid.UUID    `json:"customer_id"`
+	Action         string       `json:"action"`
+	ImpersonatedBy string       `json:"impersonated_by"`
+	ExpiresAt      timefmt.Time `json:"expires_at"`
+}
+
+// Route: POST /admin/impersonate/:customer_id (Admin Only)
+// Issue a short-lived token that acts as the customer so support can reproduce what the customer
+// sees. The token is not stored and every request made with it is audited under the operator's name.
+func ImpersonateHandler(c *gin.Context) {
+	customerID := c.Param("customer_id")
+	if !serverutils.IsValidUUID(customerID) {
+		serverutils.WriteError(c, 400, "Invalid customer ID", "Invalid UUID format")
+		return
+	}
+
+	var body ImpersonateRequest
+	if err := c.BindJSON(&body); err != nil || body.Operator == "" || body.Reason == "" || body.Action == "" {
+		serverutils.WriteError(c, 400, "Invalid request body", "operator, reason and action fields are required")
+		return
+	}
+
+	if len(body.Operator) > maxOperatorLength {
+		serverutils.WriteError(c, 400, "Invalid request body", fmt.Sprintf("Operator must be at most %d characters", maxOperatorLength))
+		return
+	}
+
+	if !serverutils.IsValidAction(body.Action) {
+		serverutils.WriteError(c, 400, "Invalid request body", "Action not allowed")
+		return
+	}
+
+	ttl := defaultImpersonationTTL
+	if body.TTL != "" {
+		parsed, err := time.ParseDuration(body.TTL)
+		if err != nil || parsed <= 0 || parsed > maxImpersonationTTL {
+			serverutils.WriteError(c, 400, "Invalid request body", fmt.Sprintf("TTL must be a duration of at most %s", maxImpersonationTTL))
+			return
+		}
+		ttl = parsed
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	customer, err := FetchCustomerByID(bmsDB, customerID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 404, "Customer not found", "No customer found with the given ID")
+		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch customer", err.Error())
+		return
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	token, err := serverutils.GenerateImpersonationJWT(customer.ID.String(), customer.Name, body.Action, body.Operator, ttl)
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to generate token", err.Error())
+		return
+	}
+
+	audit.Record(audit.Event{
+		Name:           audit.EventImpersonation,
+		Outcome:        audit.OutcomeSuccess,
+		Reason:         body.Reason,
+		Subject:        customer.ID.String(),
+		RemoteAddr:     c.ClientIP(),
+		Method:         c.Request.Method,
+		Path:           c.FullPath(),
+		ImpersonatedBy: body.Operator,
+	})
+
+	serverutils.WriteJSON(c, 200, "Impersonation token generated", ImpersonateResponse{
+		Token:          token,
+		CustomerID:     customer.ID,
+		Action:         body.Action,
+		ImpersonatedBy: body.Operator,
+		ExpiresAt:      timefmt.New(expiresAt),
+	})
+}
+
+// =====================================================================================================================
+
+// IsImpersonationToken reports whether the claims of a validated token are those of an impersonation
+// token, which must be a customer token expiring within maxImpersonationTTL
+func IsImpersonationToken(claims jwt.MapClaims) bool {
+	if impersonatedBy, _ := claims["impersonated_by"].(string); impersonatedBy == "" {
+		return false
+	}
+	if role, _ := claims["role"].(string); role != "user" {
+		return false
+	}
+	if siteID, _ := claims["site_id"].(string); siteID != "" {
+		return false
+	}
+
+	expiresAt, err := claims.GetExpirationTime()
+	return err == nil && expiresAt != nil && time.Until(expiresAt.Time) <= maxImpersonationTTL
+}
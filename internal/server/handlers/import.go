@@ -0,0 +1,367 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/johandrevandeventer/devices-api-server/internal/cache"
+	"github.com/johandrevandeventer/devices-api-server/internal/changes"
+	"github.com/johandrevandeventer/devices-api-server/internal/devicetoken"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"gorm.io/gorm"
+)
+
+// maxImportBytes is the largest import file accepted
+const maxImportBytes = 10 << 20
+
+type DeviceImportRow struct {
+	CustomerName string `json:"customer_name"`
+	SiteName     string `json:"site_name"`
+	DeviceRequest
+}
+
+type DeviceImportError struct {
+	Row                int    `json:"row"`
+	DeviceSerialNumber string `json:"device_serial_number,omitempty"`
+	Error              string `json:"error"`
+}
+
+type DeviceImportResponse struct {
+	Rows    int                 `json:"rows"`
+	Created int                 `json:"created"`
+	Updated int                 `json:"updated"`
+	Errors  []DeviceImportError `json:"errors"`
+}
+
+// Route: POST /devices/import (Admin Only)
+// Create or update devices from an uploaded CSV or JSON file, resolving customers and sites by name.
+// Nothing is written unless every row is valid; rows are numbered from 1, excluding the CSV header.
+// Rows matching deleted devices are rejected unless ?restore=true is given, and rows never move a
+// device to another customer.
+func DeviceImport(c *gin.Context) {
+	restore := false
+	switch c.Query("restore") {
+	case "", "false":
+	case "true":
+		restore = true
+	default:
+		serverutils.WriteError(c, 400, "Invalid restore", "Restore must be true or false")
+		return
+	}
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes)
+
+	file, header, err := c.Request.FormFile("file")
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid import", "A CSV or JSON file must be uploaded in the file field")
+		return
+	}
+	defer file.Close()
+
+	format := c.Query("format")
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(header.Filename)), ".")
+	}
+
+	var rows []DeviceImportRow
+	switch format {
+	case "csv":
+		rows, err = readDeviceImportCSV(file)
+	case "json":
+		err = json.NewDecoder(file).Decode(&rows)
+	default:
+		serverutils.WriteError(c, 400, "Invalid import", "The file must be CSV or JSON")
+		return
+	}
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid import", err.Error())
+		return
+	}
+
+	if len(rows) == 0 {
+		serverutils.WriteError(c, 400, "Invalid import", "The file has no rows")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	response := DeviceImportResponse{Rows: len(rows), Errors: []DeviceImportError{}}
+
+	sites, importErrors, err := resolveDeviceImport(bmsDB, rows, restore)
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to resolve customers and sites", err.Error())
+		return
+	}
+
+	if len(importErrors) > 0 {
+		response.Errors = importErrors
+		serverutils.WriteJSON(c, 422, "Import rejected", response)
+		return
+	}
+
+	err = bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		for i, row := range rows {
+			created, err := importDevice(tx, sites[i], row.DeviceRequest)
+			if err != nil {
+				return fmt.Errorf("row %d: %w", i+1, err)
+			}
+
+			if created {
+				response.Created++
+			} else {
+				response.Updated++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to import devices", err.Error())
+		return
+	}
+	serverutils.AfterCommit(c, func() {
+		cache.SiteDevices().Clear()
+		changes.RecordAll()
+	})
+
+	serverutils.WriteJSON(c, 200, "Devices imported", response)
+}
+
+// =====================================================================================================================
+
+// readDeviceImportCSV reads the rows of a CSV file whose header names the columns
+func readDeviceImportCSV(r io.Reader) ([]DeviceImportRow, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	var rows []DeviceImportRow
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CSV: %w", err)
+		}
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		rows = append(rows, DeviceImportRow{
+			CustomerName: field("customer_name"),
+			SiteName:     field("site_name"),
+			DeviceRequest: DeviceRequest{
+				Gateway:                field("gateway"),
+				Controller:             field("controller"),
+				ControllerSerialNumber: field("controller_serial_number"),
+				DeviceType:             field("device_type"),
+				DeviceName:             field("device_name"),
+				DeviceSerialNumber:     field("device_serial_number"),
+				BuildingURL:            field("building_url"),
+				AuthToken:              field("auth_token"),
+			},
+		})
+	}
+
+	return rows, nil
+}
+
+// resolveDeviceImport validates every row and resolves its site, returning the site of each row
+// and an error for each invalid row. Rows matching deleted devices are only valid when restoring.
+func resolveDeviceImport(bmsDB *devicesdb.BMS_DB, rows []DeviceImportRow, restore bool) ([]*models.Site, []DeviceImportError, error) {
+	sites := make([]*models.Site, len(rows))
+	var importErrors []DeviceImportError
+
+	customers := make(map[string]*models.Customer)
+	customerSites := make(map[[2]string]*models.Site)
+	seen := make(map[string]int)
+
+	for i, row := range rows {
+		rowError := func(msg string) {
+			importErrors = append(importErrors, DeviceImportError{Row: i + 1, DeviceSerialNumber: row.DeviceSerialNumber, Error: msg})
+		}
+
+		if missing := missingDeviceImportFields(row); len(missing) > 0 {
+			rowError("missing " + strings.Join(missing, ", "))
+			continue
+		}
+
+		customer, ok := customers[row.CustomerName]
+		if !ok {
+			var found models.Customer
+			err := bmsDB.DB.Where("name = ?", row.CustomerName).First(&found).Error
+			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, nil, err
+			}
+			if err == nil {
+				customer = &found
+			}
+			customers[row.CustomerName] = customer
+		}
+		if customer == nil {
+			rowError("customer not found: " + row.CustomerName)
+			continue
+		}
+
+		key := [2]string{row.CustomerName, row.SiteName}
+		site, ok := customerSites[key]
+		if !ok {
+			var found models.Site
+			err := bmsDB.DB.Where("name = ? AND customer_id = ?", row.SiteName, customer.ID).First(&found).Error
+			if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, nil, err
+			}
+			if err == nil {
+				site = &found
+			}
+			customerSites[key] = site
+		}
+		if site == nil {
+			rowError("site not found for customer: " + row.SiteName)
+			continue
+		}
+
+		// Customers may share serial numbers when serial numbers are scoped per customer
+		serialKey := row.DeviceSerialNumber
+		if deviceSerialScope == models.SerialScopeCustomer {
+			serialKey = customer.ID.String() + "/" + row.DeviceSerialNumber
+		}
+		if first, ok := seen[serialKey]; ok {
+			rowError(fmt.Sprintf("duplicate device_serial_number, first seen on row %d", first))
+			continue
+		}
+		seen[serialKey] = i + 1
+
+		existing, err := fetchExistingDevice(bmsDB, customer.ID, row.DeviceSerialNumber)
+		if errors.Is(err, ErrDeviceAmbiguous) {
+			rowError("serial number is used by several customers")
+			continue
+		} else if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, err
+		}
+		if err == nil {
+			if existing.CustomerID != customer.ID {
+				rowError("device belongs to another customer")
+				continue
+			}
+			if existing.DeletedAt.Valid && !restore {
+				rowError("device is deleted, import with restore=true to restore it")
+				continue
+			}
+		}
+
+		sites[i] = site
+	}
+
+	return sites, importErrors, nil
+}
+
+// missingDeviceImportFields lists the required fields the row leaves empty
+func missingDeviceImportFields(row DeviceImportRow) []string {
+	return missingFields(append([]requiredField{
+		{"customer_name", row.CustomerName},
+		{"site_name", row.SiteName},
+	}, deviceRequiredFields(row.DeviceRequest)...))
+}
+
+// requiredField is a named field that may not be left empty
+type requiredField struct {
+	name  string
+	value string
+}
+
+// deviceRequiredFields returns the fields a device cannot be created without
+func deviceRequiredFields(body DeviceRequest) []requiredField {
+	return []requiredField{
+		{"gateway", body.Gateway},
+		{"controller", body.Controller},
+		{"controller_serial_number", body.ControllerSerialNumber},
+		{"device_type", body.DeviceType},
+		{"device_name", body.DeviceName},
+		{"device_serial_number", body.DeviceSerialNumber},
+	}
+}
+
+// missingFields lists the names of the fields that are empty
+func missingFields(fields []requiredField) []string {
+	var missing []string
+	for _, field := range fields {
+		if strings.TrimSpace(field.value) == "" {
+			missing = append(missing, field.name)
+		}
+	}
+	return missing
+}
+
+// importDevice creates the device or updates the device with the same serial number, restoring it
+// if it was soft-deleted. Rows are checked by resolveDeviceImport first, so the device keeps its customer.
+func importDevice(tx *gorm.DB, site *models.Site, body DeviceRequest) (created bool, err error) {
+	query := tx.Unscoped().Where("device_serial_number = ?", body.DeviceSerialNumber)
+	if deviceSerialScope == models.SerialScopeCustomer {
+		query = query.Where("customer_id = ?", site.CustomerID)
+	}
+
+	authToken, err := devicetoken.Seal(body.AuthToken)
+	if err != nil {
+		return false, err
+	}
+
+	var device models.Device
+	err = query.First(&device).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		device = models.Device{
+			SiteID:                 site.ID,
+			CustomerID:             site.CustomerID,
+			Gateway:                body.Gateway,
+			Controller:             body.Controller,
+			ControllerSerialNumber: body.ControllerSerialNumber,
+			DeviceType:             body.DeviceType,
+			DeviceName:             body.DeviceName,
+			DeviceSerialNumber:     body.DeviceSerialNumber,
+			BuildingURL:            body.BuildingURL,
+			AuthToken:              authToken,
+		}
+		return true, tx.Create(&device).Error
+	} else if err != nil {
+		return false, err
+	}
+
+	device.SiteID = site.ID
+	device.Gateway = body.Gateway
+	device.Controller = body.Controller
+	device.ControllerSerialNumber = body.ControllerSerialNumber
+	device.DeviceType = body.DeviceType
+	device.DeviceName = body.DeviceName
+	device.BuildingURL = body.BuildingURL
+	device.AuthToken = authToken
+	device.DeletedAt = gorm.DeletedAt{}
+	device.DeletedBy = nil
+
+	return false, tx.Unscoped().Omit("Site").Save(&device).Error
+}
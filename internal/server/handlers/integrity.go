@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/johandrevandeventer/devices-api-server/internal/integrity"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+)
+
+// Route: GET /admin/integrity-check (Admin Only)
+// Report the devices on missing or deleted sites, the sites of missing or deleted customers and
+// the tokens of missing or deleted customers
+func IntegrityCheck(c *gin.Context) {
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	report, err := integrity.Check(bmsDB)
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to check integrity", err.Error())
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Integrity checked", report)
+}
+
+// Route: POST /admin/integrity-check/repair (Admin Only)
+// Soft-delete the orphaned records the integrity check reports, reporting what was deleted
+func IntegrityRepair(c *gin.Context) {
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	report, err := integrity.Repair(bmsDB)
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to repair integrity", err.Error())
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Integrity repaired", report)
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/johandrevandeventer/devices-api-server/internal/eventschema"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+)
+
+type ActionResponse struct {
+	Action      string   `json:"action"`
+	Description string   `json:"description"`
+	Scopes      []string `json:"scopes"`
+}
+
+// Route: GET /meta/actions
+// List the actions tokens can be issued for, with the scopes that limit the routes their tokens reach
+func ActionFetchAll(c *gin.Context) {
+	actions := serverutils.Actions()
+	response := make([]ActionResponse, len(actions))
+	for i, action := range actions {
+		response[i] = ActionResponse{Action: action.Name, Description: action.Description, Scopes: action.Scopes}
+	}
+
+	serverutils.WriteJSON(c, 200, "Actions fetched", response)
+}
+
+// Route: GET /meta/event-schemas
+// List the versioned JSON Schemas of the event payloads the server sends
+func EventSchemaFetchAll(c *gin.Context) {
+	serverutils.WriteJSON(c, 200, "Event schemas fetched", eventschema.All())
+}
+
+// Route: GET /meta/event-schemas/:event
+// List the versions of the schema of an event, oldest first
+func EventSchemaFetchVersions(c *gin.Context) {
+	versions := eventschema.Versions(c.Param("event"))
+	if len(versions) == 0 {
+		serverutils.WriteError(c, 404, "Event schema not found", "No schema found for the given event")
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Event schemas fetched", versions)
+}
+
+// Route: GET /meta/event-schemas/:event/:version
+// Serve a version of the schema of an event as is, so validators can load it by its $id
+func EventSchemaFetch(c *gin.Context) {
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid version", "The version must be an integer")
+		return
+	}
+
+	schema, ok := eventschema.Get(c.Param("event"), version)
+	if !ok {
+		serverutils.WriteError(c, 404, "Event schema not found", "No schema found for the given event and version")
+		return
+	}
+
+	c.Data(200, "application/schema+json", schema.Schema)
+}
@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"gorm.io/gorm"
+)
+
+// meterUnits lists the energy units a meter register can count in
+var meterUnits = map[string]bool{
+	"Wh":  true,
+	"kWh": true,
+	"MWh": true,
+}
+
+type DeviceMeterRequest struct {
+	Unit          string   `json:"unit"`
+	Multiplier    *float64 `json:"multiplier"`
+	PulseConstant float64  `json:"pulse_constant"`
+	Phases        int      `json:"phases"`
+	RegisterPoint string   `json:"register_point"`
+}
+
+type DeviceMeterResponse struct {
+	DeviceSerialNumber string  `json:"device_serial_number"`
+	Unit               string  `json:"unit"`
+	Multiplier         float64 `json:"multiplier"`
+	PulseConstant      float64 `json:"pulse_constant"`
+	Phases             int     `json:"phases"`
+	RegisterPoint      string  `json:"register_point"`
+}
+
+// Route: PUT /devices/:device_serial_number/meter (Admin Only)
+// Register or replace the meter constants of a device. Increases of the reading of the register point
+// are rolled up into the daily and monthly energy of the device's site.
+func DeviceMeterSet(c *gin.Context) {
+	serialNumber := c.Param("device_serial_number")
+
+	var body DeviceMeterRequest
+	if err := c.BindJSON(&body); err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", "Invalid JSON format")
+		return
+	}
+
+	if body.Unit == "" {
+		body.Unit = "kWh"
+	}
+	if !meterUnits[body.Unit] {
+		serverutils.WriteError(c, 400, "Invalid unit", "Unit must be Wh, kWh or MWh")
+		return
+	}
+
+	multiplier := 1.0
+	if body.Multiplier != nil {
+		multiplier = *body.Multiplier
+	}
+	if multiplier <= 0 {
+		serverutils.WriteError(c, 400, "Invalid multiplier", "Multiplier must be greater than 0")
+		return
+	}
+
+	body.RegisterPoint = strings.TrimSpace(body.RegisterPoint)
+
+	if body.PulseConstant < 0 {
+		serverutils.WriteError(c, 400, "Invalid pulse constant", "Pulse constant must not be negative")
+		return
+	}
+
+	if body.Phases == 0 {
+		body.Phases = 3
+	}
+	if body.Phases != 1 && body.Phases != 3 {
+		serverutils.WriteError(c, 400, "Invalid phases", "Phases must be 1 or 3")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	device, ok := fetchReportingDevice(c, bmsDB, serialNumber)
+	if !ok {
+		return
+	}
+
+	// The register point must be in the point address book, or its readings are never stored
+	if body.RegisterPoint != "" {
+		var registered int64
+		if err := bmsDB.DB.Model(&models.PointAddress{}).Where("device_id = ? AND point_name = ?", device.ID, body.RegisterPoint).
+			Count(&registered).Error; err != nil {
+			serverutils.WriteError(c, 500, "Failed to fetch points", err.Error())
+			return
+		}
+		if registered == 0 {
+			serverutils.WriteError(c, 400, "Invalid register point", "The register point is not in the device's point address book")
+			return
+		}
+	}
+
+	var meter models.DeviceMeter
+	err := bmsDB.DB.Unscoped().Where("device_id = ?", device.ID).First(&meter).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 500, "Failed to fetch meter", err.Error())
+		return
+	}
+
+	meter.DeviceID = device.ID
+	meter.DeviceSerialNumber = device.DeviceSerialNumber
+	meter.Unit = body.Unit
+	meter.Multiplier = multiplier
+	meter.PulseConstant = body.PulseConstant
+	meter.Phases = body.Phases
+	meter.RegisterPoint = body.RegisterPoint
+	meter.DeletedAt = gorm.DeletedAt{}
+
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = bmsDB.DB.Create(&meter).Error
+	} else {
+		err = bmsDB.DB.Unscoped().Save(&meter).Error
+	}
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to save meter", err.Error())
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Meter saved", newDeviceMeterResponse(meter))
+}
+
+// Route: GET /devices/:device_serial_number/meter
+// Fetch the meter constants of a device
+func DeviceMeterFetch(c *gin.Context) {
+	serialNumber := c.Param("device_serial_number")
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	device, ok := fetchReportingDevice(c, bmsDB, serialNumber)
+	if !ok {
+		return
+	}
+
+	var meter models.DeviceMeter
+	if err := bmsDB.DB.Where("device_id = ?", device.ID).First(&meter).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			serverutils.WriteError(c, 404, "Meter not found", "The device has no meter constants registered")
+			return
+		}
+		serverutils.WriteError(c, 500, "Failed to fetch meter", err.Error())
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Meter fetched", newDeviceMeterResponse(meter))
+}
+
+// Route: DELETE /devices/:device_serial_number/meter (Admin Only)
+// Remove the meter constants of a device
+func DeviceMeterDelete(c *gin.Context) {
+	serialNumber := c.Param("device_serial_number")
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	device, ok := fetchReportingDevice(c, bmsDB, serialNumber)
+	if !ok {
+		return
+	}
+
+	result := bmsDB.DB.Where("device_id = ?", device.ID).Delete(&models.DeviceMeter{})
+	if result.Error != nil {
+		serverutils.WriteError(c, 500, "Failed to delete meter", result.Error.Error())
+		return
+	}
+	if result.RowsAffected == 0 {
+		serverutils.WriteError(c, 404, "Meter not found", "The device has no meter constants registered")
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Meter deleted", nil)
+}
+
+// =====================================================================================================================
+
+// newDeviceMeterResponse builds the response for the meter constants of a device
+func newDeviceMeterResponse(meter models.DeviceMeter) DeviceMeterResponse {
+	return DeviceMeterResponse{
+		DeviceSerialNumber: meter.DeviceSerialNumber,
+		Unit:               meter.Unit,
+		Multiplier:         meter.Multiplier,
+		PulseConstant:      meter.PulseConstant,
+		Phases:             meter.Phases,
+		RegisterPoint:      meter.RegisterPoint,
+	}
+}
@@ -0,0 +1,461 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"gorm.io/gorm"
+)
+
+// pointAddressCSVHeader lists the columns of the point address book, in the order the commissioning tools emit them
+var pointAddressCSVHeader = []string{
+	"device_serial_number", "point_name", "protocol", "object_type", "register",
+	"function_code", "data_type", "scale", "offset", "unit",
+}
+
+// bacnetObjectTypes lists the BACnet object types a point can be read from
+var bacnetObjectTypes = map[string]bool{
+	"analog-input":       true,
+	"analog-output":      true,
+	"analog-value":       true,
+	"binary-input":       true,
+	"binary-output":      true,
+	"binary-value":       true,
+	"multi-state-input":  true,
+	"multi-state-output": true,
+	"multi-state-value":  true,
+}
+
+// pointDataTypes lists the register encodings a Modbus point can use
+var pointDataTypes = map[string]bool{
+	"bool":    true,
+	"int16":   true,
+	"uint16":  true,
+	"int32":   true,
+	"uint32":  true,
+	"float32": true,
+}
+
+type PointAddressRow struct {
+	DeviceSerialNumber string   `json:"device_serial_number"`
+	PointName          string   `json:"point_name"`
+	Protocol           string   `json:"protocol"`
+	ObjectType         string   `json:"object_type,omitempty"`
+	Register           int      `json:"register"`
+	FunctionCode       int      `json:"function_code,omitempty"`
+	DataType           string   `json:"data_type,omitempty"`
+	Scale              *float64 `json:"scale,omitempty"`
+	Offset             float64  `json:"offset"`
+	Unit               string   `json:"unit,omitempty"`
+}
+
+type PointAddressImportError struct {
+	Row                int    `json:"row"`
+	DeviceSerialNumber string `json:"device_serial_number,omitempty"`
+	PointName          string `json:"point_name,omitempty"`
+	Error              string `json:"error"`
+}
+
+type PointAddressImportResponse struct {
+	ControllerSerialNumber string                    `json:"controller_serial_number"`
+	Rows                   int                       `json:"rows"`
+	Replaced               int64                     `json:"replaced"`
+	Errors                 []PointAddressImportError `json:"errors"`
+}
+
+// Route: GET /controllers/:controller_serial_number/points (Admin Only)
+// Export the point address book of a controller as JSON or CSV (?format=csv)
+func PointAddressExport(c *gin.Context) {
+	controllerSerialNumber := c.Param("controller_serial_number")
+
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		serverutils.WriteError(c, 400, "Invalid format", "Format must be json or csv")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var points []models.PointAddress
+	if err := bmsDB.DB.Where("controller_serial_number = ?", controllerSerialNumber).
+		Order("device_serial_number, point_name").
+		Find(&points).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch points", err.Error())
+		return
+	}
+
+	rows := newPointAddressRows(points)
+
+	if format == "csv" {
+		writePointAddressCSV(c, controllerSerialNumber, rows)
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Points fetched", rows)
+}
+
+// Route: PUT /controllers/:controller_serial_number/points (Admin Only)
+// Replace the point address book of a controller from an uploaded CSV or JSON file.
+// Nothing is written unless every row is valid; rows are numbered from 1, excluding the CSV header.
+func PointAddressImport(c *gin.Context) {
+	controllerSerialNumber := c.Param("controller_serial_number")
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxImportBytes)
+
+	file, header, err := c.Request.FormFile("file")
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid import", "A CSV or JSON file must be uploaded in the file field")
+		return
+	}
+	defer file.Close()
+
+	format := c.Query("format")
+	if format == "" {
+		format = strings.TrimPrefix(strings.ToLower(filepath.Ext(header.Filename)), ".")
+	}
+
+	var rows []PointAddressRow
+	var importErrors []PointAddressImportError
+	switch format {
+	case "csv":
+		rows, importErrors, err = readPointAddressCSV(file)
+	case "json":
+		err = json.NewDecoder(file).Decode(&rows)
+	default:
+		serverutils.WriteError(c, 400, "Invalid import", "The file must be CSV or JSON")
+		return
+	}
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid import", err.Error())
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var devices []models.Device
+	if err := bmsDB.DB.Select("id", "device_serial_number").
+		Where("controller_serial_number = ?", controllerSerialNumber).
+		Find(&devices).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch devices", err.Error())
+		return
+	}
+
+	if len(devices) == 0 {
+		serverutils.WriteError(c, 404, "Controller not found", "No devices found behind the given controller")
+		return
+	}
+
+	// Serial numbers shared by several devices behind the controller map to the nil ID
+	controllerDevices := make(map[string]uuid.UUID, len(devices))
+	for _, device := range devices {
+		if _, ok := controllerDevices[device.DeviceSerialNumber]; ok {
+			controllerDevices[device.DeviceSerialNumber] = uuid.Nil
+			continue
+		}
+		controllerDevices[device.DeviceSerialNumber] = device.ID
+	}
+
+	importErrors = append(importErrors, validatePointAddresses(rows, controllerDevices)...)
+
+	response := PointAddressImportResponse{
+		ControllerSerialNumber: controllerSerialNumber,
+		Rows:                   len(rows),
+		Errors:                 []PointAddressImportError{},
+	}
+
+	if len(importErrors) > 0 {
+		response.Errors = importErrors
+		serverutils.WriteJSON(c, 422, "Import rejected", response)
+		return
+	}
+
+	err = bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Unscoped().Where("controller_serial_number = ?", controllerSerialNumber).Delete(&models.PointAddress{})
+		if result.Error != nil {
+			return result.Error
+		}
+		response.Replaced = result.RowsAffected
+
+		if len(rows) == 0 {
+			return nil
+		}
+
+		points := make([]models.PointAddress, len(rows))
+		for i, row := range rows {
+			points[i] = models.PointAddress{
+				ControllerSerialNumber: controllerSerialNumber,
+				DeviceID:               controllerDevices[row.DeviceSerialNumber],
+				DeviceSerialNumber:     row.DeviceSerialNumber,
+				PointName:              row.PointName,
+				Protocol:               row.Protocol,
+				ObjectType:             row.ObjectType,
+				Register:               row.Register,
+				FunctionCode:           row.FunctionCode,
+				DataType:               row.DataType,
+				Scale:                  *row.Scale,
+				Offset:                 row.Offset,
+				Unit:                   row.Unit,
+			}
+		}
+		return tx.CreateInBatches(&points, 500).Error
+	})
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to import points", err.Error())
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Points imported", response)
+}
+
+// =====================================================================================================================
+
+// readPointAddressCSV reads the rows of a point address book whose header names the columns,
+// returning an error for each row whose numbers cannot be parsed
+func readPointAddressCSV(r io.Reader) ([]PointAddressRow, []PointAddressImportError, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+
+	var rows []PointAddressRow
+	var importErrors []PointAddressImportError
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read CSV: %w", err)
+		}
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		row := PointAddressRow{
+			DeviceSerialNumber: field("device_serial_number"),
+			PointName:          field("point_name"),
+			Protocol:           field("protocol"),
+			ObjectType:         field("object_type"),
+			DataType:           field("data_type"),
+			Unit:               field("unit"),
+		}
+
+		var parseErrors []string
+		parseInt := func(name string, dst *int) {
+			if value := field(name); value != "" {
+				n, err := strconv.Atoi(value)
+				if err != nil {
+					parseErrors = append(parseErrors, name+" must be a whole number")
+				}
+				*dst = n
+			}
+		}
+		parseFloat := func(name string, dst *float64) bool {
+			value := field(name)
+			if value == "" {
+				return false
+			}
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				parseErrors = append(parseErrors, name+" must be a number")
+			}
+			*dst = f
+			return true
+		}
+
+		if field("register") == "" {
+			parseErrors = append(parseErrors, "missing register")
+		}
+		parseInt("register", &row.Register)
+		parseInt("function_code", &row.FunctionCode)
+		parseFloat("offset", &row.Offset)
+		var scale float64
+		if parseFloat("scale", &scale) {
+			row.Scale = &scale
+		}
+
+		if len(parseErrors) > 0 {
+			importErrors = append(importErrors, PointAddressImportError{
+				Row:                len(rows) + 1,
+				DeviceSerialNumber: row.DeviceSerialNumber,
+				PointName:          row.PointName,
+				Error:              strings.Join(parseErrors, "; "),
+			})
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, importErrors, nil
+}
+
+// validatePointAddresses checks every row against the devices behind the controller and the
+// protocol of the point, defaulting the scale to 1
+func validatePointAddresses(rows []PointAddressRow, controllerDevices map[string]uuid.UUID) []PointAddressImportError {
+	var importErrors []PointAddressImportError
+	seen := make(map[[2]string]int, len(rows))
+
+	for i := range rows {
+		row := &rows[i]
+		rowError := func(msg string) {
+			importErrors = append(importErrors, PointAddressImportError{
+				Row:                i + 1,
+				DeviceSerialNumber: row.DeviceSerialNumber,
+				PointName:          row.PointName,
+				Error:              msg,
+			})
+		}
+
+		if row.DeviceSerialNumber == "" || row.PointName == "" {
+			rowError("device_serial_number and point_name are required")
+			continue
+		}
+
+		deviceID, ok := controllerDevices[row.DeviceSerialNumber]
+		if !ok {
+			rowError("device not found behind controller")
+			continue
+		}
+		if deviceID == uuid.Nil {
+			rowError("serial number is used by several devices behind controller")
+			continue
+		}
+
+		key := [2]string{row.DeviceSerialNumber, row.PointName}
+		if first, ok := seen[key]; ok {
+			rowError(fmt.Sprintf("duplicate point_name for device, first seen on row %d", first))
+			continue
+		}
+		seen[key] = i + 1
+
+		if err := normalizePointAddress(row); err != nil {
+			rowError(err.Error())
+		}
+	}
+
+	return importErrors
+}
+
+// normalizePointAddress checks the address of a point against its protocol, lower-casing the
+// enumerated fields, clearing the fields the protocol does not use and defaulting the scale to 1
+func normalizePointAddress(row *PointAddressRow) error {
+	row.Protocol = strings.ToLower(row.Protocol)
+	row.ObjectType = strings.ToLower(row.ObjectType)
+	row.DataType = strings.ToLower(row.DataType)
+
+	switch row.Protocol {
+	case "modbus":
+		if row.FunctionCode < 1 || row.FunctionCode > 4 {
+			return errors.New("function_code must be 1, 2, 3 or 4 for Modbus points")
+		}
+		if row.Register < 0 || row.Register > 65535 {
+			return errors.New("register must be between 0 and 65535 for Modbus points")
+		}
+		if row.DataType != "" && !pointDataTypes[row.DataType] {
+			return errors.New("unknown data_type: " + row.DataType)
+		}
+		row.ObjectType = ""
+	case "bacnet":
+		if !bacnetObjectTypes[row.ObjectType] {
+			return errors.New("object_type must be a BACnet object type such as analog-input")
+		}
+		if row.Register < 0 || row.Register > 4194303 {
+			return errors.New("register must be a BACnet instance number between 0 and 4194303")
+		}
+		row.FunctionCode = 0
+	default:
+		return errors.New("protocol must be modbus or bacnet")
+	}
+
+	if row.Scale == nil {
+		scale := 1.0
+		row.Scale = &scale
+	} else if *row.Scale == 0 {
+		return errors.New("scale must not be 0")
+	}
+
+	return nil
+}
+
+// writePointAddressCSV writes the point address book of a controller as a CSV attachment
+func writePointAddressCSV(c *gin.Context, controllerSerialNumber string, rows []PointAddressRow) {
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="points-%s.csv"`, controllerSerialNumber))
+	c.Status(200)
+
+	w := csv.NewWriter(c.Writer)
+	writePointAddressRows(w, rows)
+	w.Flush()
+}
+
+// newPointAddressRows converts stored points to the rows of the point address book
+func newPointAddressRows(points []models.PointAddress) []PointAddressRow {
+	rows := make([]PointAddressRow, len(points))
+	for i, point := range points {
+		scale := point.Scale
+		rows[i] = PointAddressRow{
+			DeviceSerialNumber: point.DeviceSerialNumber,
+			PointName:          point.PointName,
+			Protocol:           point.Protocol,
+			ObjectType:         point.ObjectType,
+			Register:           point.Register,
+			FunctionCode:       point.FunctionCode,
+			DataType:           point.DataType,
+			Scale:              &scale,
+			Offset:             point.Offset,
+			Unit:               point.Unit,
+		}
+	}
+	return rows
+}
+
+// writePointAddressRows writes the header and rows of a point address book
+func writePointAddressRows(w *csv.Writer, rows []PointAddressRow) {
+	w.Write(pointAddressCSVHeader)
+
+	for _, row := range rows {
+		w.Write([]string{
+			row.DeviceSerialNumber,
+			row.PointName,
+			row.Protocol,
+			row.ObjectType,
+			strconv.Itoa(row.Register),
+			strconv.Itoa(row.FunctionCode),
+			row.DataType,
+			strconv.FormatFloat(*row.Scale, 'f', -1, 64),
+			strconv.FormatFloat(row.Offset, 'f', -1, 64),
+			row.Unit,
+		})
+	}
+}
@@ -0,0 +1,599 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/audit"
+	"github.com/johandrevandeventer/devices-api-server/internal/changes"
+	"github.com/johandrevandeventer/devices-api-server/internal/devicetoken"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/internal/timefmt"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// provisioningSessionTTL is how long a session can be changed and committed after it is started
+const provisioningSessionTTL = 24 * time.Hour
+
+// maxProvisioningDevices is the most devices a session can stage
+const maxProvisioningDevices = 1000
+
+// ProvisioningPlan is the work staged in a provisioning session. Devices without a gateway are
+// created on the gateway of the plan.
+type ProvisioningPlan struct {
+	Site    *SiteRequest    `json:"site"`
+	Gateway string          `json:"gateway"`
+	Devices []DeviceRequest `json:"devices"`
+	Tokens  []string        `json:"tokens"`
+}
+
+type ProvisioningSessionRequest struct {
+	CustomerID string `json:"customer_id"`
+}
+
+type ProvisioningGatewayRequest struct {
+	Gateway string `json:"gateway"`
+}
+
+type ProvisioningTokensRequest struct {
+	Actions []string `json:"actions"`
+}
+
+type ProvisioningSessionResponse struct {
+	ID         uuid.UUID        `json:"id"`
+	CustomerID uuid.UUID        `json:"customer_id"`
+	State      string           `json:"state"`
+	Plan       ProvisioningPlan `json:"plan"`
+	SiteID     *uuid.UUID       `json:"site_id"`
+	ExpiresAt  timefmt.Time     `json:"expires_at"`
+}
+
+type ProvisioningToken struct {
+	Action       string `json:"action"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type ProvisioningCommitResponse struct {
+	Session ProvisioningSessionResponse `json:"session"`
+	Site    SiteResponse                `json:"site"`
+	Devices []DeviceResponse            `json:"devices"`
+	Tokens  []ProvisioningToken         `json:"tokens"`
+}
+
+// Route: POST /provisioning-sessions (Admin Only)
+// Start a provisioning session for a customer. The site, gateway, devices and tokens staged in the
+// session are only created when it is committed, and are all created or none are.
+func ProvisioningSessionCreate(c *gin.Context) {
+	var body ProvisioningSessionRequest
+	if err := c.BindJSON(&body); err != nil || body.CustomerID == "" {
+		serverutils.WriteError(c, 400, "Invalid request body", "customer_id field is required")
+		return
+	}
+
+	if !serverutils.IsValidUUID(body.CustomerID) {
+		serverutils.WriteError(c, 400, "Invalid customer ID", "Invalid UUID format")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	customer, err := fetchAttachableCustomer(bmsDB, body.CustomerID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 404, "Customer not found", "No customer found with the given ID")
+		return
+	} else if err != nil {
+		writeAttachError(c, err, "Failed to fetch customer")
+		return
+	}
+
+	var plan ProvisioningPlan
+	encoded, err := json.Marshal(plan)
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to create session", err.Error())
+		return
+	}
+
+	session := models.ProvisioningSession{
+		CustomerID: customer.ID,
+		State:      models.ProvisioningOpen,
+		Plan:       string(encoded),
+		ExpiresAt:  time.Now().UTC().Add(provisioningSessionTTL),
+	}
+	if err := bmsDB.DB.Create(&session).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to create session", err.Error())
+		return
+	}
+
+	serverutils.WriteJSON(c, 201, "Session created", newProvisioningSessionResponse(session, plan))
+}
+
+// Route: GET /provisioning-sessions/:session_id (Admin Only)
+// Fetch a provisioning session with the work staged in it
+func ProvisioningSessionFetch(c *gin.Context) {
+	sessionID := c.Param("session_id")
+	if !serverutils.IsValidUUID(sessionID) {
+		serverutils.WriteError(c, 400, "Invalid session ID", "Invalid UUID format")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var session models.ProvisioningSession
+	var plan ProvisioningPlan
+	err := bmsDB.DB.First(&session, "id = ?", sessionID).Error
+	if err == nil {
+		err = decodeProvisioningPlan(session, &plan)
+	}
+	if err != nil {
+		writeProvisioningError(c, err, "Failed to fetch session")
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Session fetched", newProvisioningSessionResponse(session, plan))
+}
+
+// Route: PUT /provisioning-sessions/:session_id/site (Admin Only)
+// Stage the site the session creates, replacing the site staged before
+func ProvisioningSessionSetSite(c *gin.Context) {
+	var body SiteRequest
+	if err := c.BindJSON(&body); err != nil || body.Name == "" {
+		serverutils.WriteError(c, 400, "Invalid request body", "Name field is required")
+		return
+	}
+
+	if len(body.Name) > maxNameLength {
+		serverutils.WriteError(c, 400, "Invalid request body", fmt.Sprintf("Name must be at most %d characters", maxNameLength))
+		return
+	}
+
+	if reason := invalidSiteLocation(body.Address, body.Latitude, body.Longitude, body.Timezone); reason != "" {
+		serverutils.WriteError(c, 400, "Invalid request body", reason)
+		return
+	}
+
+	stageProvisioning(c, "Site staged", func(plan *ProvisioningPlan) error {
+		plan.Site = &body
+		return nil
+	})
+}
+
+// Route: PUT /provisioning-sessions/:session_id/gateway (Admin Only)
+// Stage the gateway the devices of the session are created on, unless a device names its own
+func ProvisioningSessionSetGateway(c *gin.Context) {
+	var body ProvisioningGatewayRequest
+	if err := c.BindJSON(&body); err != nil || strings.TrimSpace(body.Gateway) == "" {
+		serverutils.WriteError(c, 400, "Invalid request body", "gateway field is required")
+		return
+	}
+
+	stageProvisioning(c, "Gateway staged", func(plan *ProvisioningPlan) error {
+		plan.Gateway = body.Gateway
+		return nil
+	})
+}
+
+// Route: POST /provisioning-sessions/:session_id/devices (Admin Only)
+// Stage devices for the session to create, adding them to the devices staged before
+func ProvisioningSessionAddDevices(c *gin.Context) {
+	var body []DeviceRequest
+	if err := c.BindJSON(&body); err != nil || len(body) == 0 {
+		serverutils.WriteError(c, 400, "Invalid request body", "A list of devices is required")
+		return
+	}
+
+	for i := range body {
+		authToken, err := devicetoken.Seal(body[i].AuthToken)
+		if err != nil {
+			serverutils.WriteError(c, 500, "Failed to encrypt auth token", err.Error())
+			return
+		}
+		body[i].AuthToken = authToken
+	}
+
+	stageProvisioning(c, "Devices staged", func(plan *ProvisioningPlan) error {
+		if len(plan.Devices)+len(body) > maxProvisioningDevices {
+			return provisioningInvalid(fmt.Sprintf("A session can stage at most %d devices", maxProvisioningDevices))
+		}
+
+		for i, device := range body {
+			if device.Gateway == "" {
+				device.Gateway = plan.Gateway
+			}
+			if missing := missingFields(deviceRequiredFields(device)); len(missing) > 0 {
+				return provisioningInvalid(fmt.Sprintf("Device %d is missing %s", i+1, strings.Join(missing, ", ")))
+			}
+
+			if slices.ContainsFunc(plan.Devices, func(staged DeviceRequest) bool {
+				return staged.DeviceSerialNumber == device.DeviceSerialNumber
+			}) {
+				return provisioningInvalid("Device serial number is staged twice: " + device.DeviceSerialNumber)
+			}
+			plan.Devices = append(plan.Devices, body[i])
+		}
+		return nil
+	})
+}
+
+// Route: POST /provisioning-sessions/:session_id/tokens (Admin Only)
+// Stage site tokens for the session to issue, one for each action
+func ProvisioningSessionAddTokens(c *gin.Context) {
+	var body ProvisioningTokensRequest
+	if err := c.BindJSON(&body); err != nil || len(body.Actions) == 0 {
+		serverutils.WriteError(c, 400, "Invalid request body", "actions field is required")
+		return
+	}
+
+	for _, action := range body.Actions {
+		if !serverutils.IsValidAction(action) {
+			serverutils.WriteError(c, 400, "Invalid action", "Action not allowed: "+action)
+			return
+		}
+	}
+
+	stageProvisioning(c, "Tokens staged", func(plan *ProvisioningPlan) error {
+		for _, action := range body.Actions {
+			if !slices.Contains(plan.Tokens, action) {
+				plan.Tokens = append(plan.Tokens, action)
+			}
+		}
+		return nil
+	})
+}
+
+// Route: POST /provisioning-sessions/:session_id/commit (Admin Only)
+// Create the site, devices and tokens staged in the session in one transaction. Nothing is created
+// when the site name or a device serial number is taken. The issued tokens are only returned here.
+func ProvisioningSessionCommit(c *gin.Context) {
+	sessionID := c.Param("session_id")
+	if !serverutils.IsValidUUID(sessionID) {
+		serverutils.WriteError(c, 400, "Invalid session ID", "Invalid UUID format")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var session models.ProvisioningSession
+	var plan ProvisioningPlan
+	var response ProvisioningCommitResponse
+	err := bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		if err := lockOpenProvisioningSession(tx, sessionID, &session, &plan); err != nil {
+			return err
+		}
+
+		var err error
+		response, err = commitProvisioningPlan(tx, session, plan)
+		if err != nil {
+			return err
+		}
+
+		session.State = models.ProvisioningCommitted
+		session.SiteID = &response.Site.ID
+		return tx.Model(&session).Updates(map[string]any{"state": session.State, "site_id": session.SiteID}).Error
+	})
+	if err != nil {
+		writeProvisioningError(c, err, "Failed to commit session")
+		return
+	}
+	serverutils.AfterCommit(c, func() { changes.RecordSite(response.Site.ID.String()) })
+
+	for _, token := range response.Tokens {
+		audit.Record(audit.Event{
+			Name:       audit.EventTokenIssued,
+			Outcome:    audit.OutcomeSuccess,
+			Reason:     token.Action,
+			Subject:    session.CustomerID.String(),
+			RemoteAddr: c.ClientIP(),
+			Method:     c.Request.Method,
+			Path:       c.FullPath(),
+		})
+	}
+
+	response.Session = newProvisioningSessionResponse(session, plan)
+	if omitsDeviceTokens(c) {
+		clearDeviceTokens(response.Devices)
+	}
+	serverutils.WriteJSON(c, 200, "Session committed", response)
+}
+
+// Route: POST /provisioning-sessions/:session_id/abort (Admin Only)
+// Abort a session, discarding the work staged in it. Committed sessions cannot be aborted.
+func ProvisioningSessionAbort(c *gin.Context) {
+	sessionID := c.Param("session_id")
+	if !serverutils.IsValidUUID(sessionID) {
+		serverutils.WriteError(c, 400, "Invalid session ID", "Invalid UUID format")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var session models.ProvisioningSession
+	var plan ProvisioningPlan
+	err := bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&session, "id = ?", sessionID).Error; err != nil {
+			return err
+		}
+		if err := decodeProvisioningPlan(session, &plan); err != nil {
+			return err
+		}
+
+		switch session.State {
+		case models.ProvisioningAborted:
+			return nil
+		case models.ProvisioningCommitted:
+			return errProvisioningClosed
+		}
+
+		session.State = models.ProvisioningAborted
+		return tx.Model(&session).Update("state", session.State).Error
+	})
+	if err != nil {
+		writeProvisioningError(c, err, "Failed to abort session")
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Session aborted", newProvisioningSessionResponse(session, plan))
+}
+
+// =====================================================================================================================
+
+var (
+	// errProvisioningClosed is returned when a committed or aborted session is changed
+	errProvisioningClosed = errors.New("session is closed")
+
+	// errProvisioningExpired is returned when an open session is changed after it expired
+	errProvisioningExpired = errors.New("session expired")
+)
+
+// provisioningInvalid is returned when a change would leave the plan of a session invalid
+type provisioningInvalid string
+
+func (e provisioningInvalid) Error() string {
+	return string(e)
+}
+
+// provisioningConflict is returned when the plan of a session cannot be committed
+type provisioningConflict struct {
+	reason string
+	items  []string
+}
+
+func (e *provisioningConflict) Error() string {
+	if len(e.items) == 0 {
+		return e.reason
+	}
+	return e.reason + ": " + strings.Join(e.items, ", ")
+}
+
+// writeProvisioningError writes the response for an error of a session handler
+func writeProvisioningError(c *gin.Context, err error, failure string) {
+	var invalid provisioningInvalid
+	var conflict *provisioningConflict
+
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		serverutils.WriteError(c, 404, "Session not found", "No provisioning session found with the given ID")
+	case errors.Is(err, errProvisioningClosed):
+		serverutils.WriteError(c, 409, "Session is closed", "The session is already committed or aborted")
+	case errors.Is(err, errProvisioningExpired):
+		serverutils.WriteError(c, 409, "Session expired", "The session can no longer be changed, start a new session")
+	case errors.As(err, &invalid):
+		serverutils.WriteError(c, 400, "Invalid request body", invalid.Error())
+	case errors.As(err, &conflict):
+		serverutils.WriteError(c, 409, "Session cannot be committed", conflict.Error())
+	default:
+		serverutils.WriteError(c, 500, failure, err.Error())
+	}
+}
+
+// stageProvisioning applies the change to the plan of the open session in the route and writes the
+// updated session. Changes to the same session are serialized by locking its row.
+func stageProvisioning(c *gin.Context, message string, change func(plan *ProvisioningPlan) error) {
+	sessionID := c.Param("session_id")
+	if !serverutils.IsValidUUID(sessionID) {
+		serverutils.WriteError(c, 400, "Invalid session ID", "Invalid UUID format")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var session models.ProvisioningSession
+	var plan ProvisioningPlan
+	err := bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		if err := lockOpenProvisioningSession(tx, sessionID, &session, &plan); err != nil {
+			return err
+		}
+
+		if err := change(&plan); err != nil {
+			return err
+		}
+
+		encoded, err := json.Marshal(plan)
+		if err != nil {
+			return err
+		}
+		session.Plan = string(encoded)
+		return tx.Model(&session).Update("plan", session.Plan).Error
+	})
+	if err != nil {
+		writeProvisioningError(c, err, "Failed to update session")
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, message, newProvisioningSessionResponse(session, plan))
+}
+
+// lockOpenProvisioningSession locks the row of the session for the transaction and decodes its
+// plan, returning an error unless the session is open and has not expired
+func lockOpenProvisioningSession(tx *gorm.DB, sessionID string, session *models.ProvisioningSession, plan *ProvisioningPlan) error {
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(session, "id = ?", sessionID).Error; err != nil {
+		return err
+	}
+
+	if session.State != models.ProvisioningOpen {
+		return errProvisioningClosed
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return errProvisioningExpired
+	}
+
+	return decodeProvisioningPlan(*session, plan)
+}
+
+// decodeProvisioningPlan decodes the plan stored with the session
+func decodeProvisioningPlan(session models.ProvisioningSession, plan *ProvisioningPlan) error {
+	if err := json.Unmarshal([]byte(session.Plan), plan); err != nil {
+		return fmt.Errorf("failed to decode session plan: %w", err)
+	}
+	return nil
+}
+
+// commitProvisioningPlan creates the site, devices and tokens of the plan in the transaction
+func commitProvisioningPlan(tx *gorm.DB, session models.ProvisioningSession, plan ProvisioningPlan) (ProvisioningCommitResponse, error) {
+	var response ProvisioningCommitResponse
+
+	if plan.Site == nil {
+		return response, &provisioningConflict{reason: "The session has no site, stage one with PUT /provisioning-sessions/:session_id/site"}
+	}
+
+	var customer models.Customer
+	err := tx.First(&customer, "id = ?", session.CustomerID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return response, &provisioningConflict{reason: "The customer of the session no longer exists"}
+	} else if err != nil {
+		return response, err
+	}
+
+	// Deleted sites and devices keep their name and serial number, so they are checked as well
+	var sites int64
+	if err := tx.Unscoped().Model(&models.Site{}).Where("customer_id = ? AND name = ?", customer.ID, plan.Site.Name).Count(&sites).Error; err != nil {
+		return response, err
+	}
+	if sites > 0 {
+		return response, &provisioningConflict{reason: "The customer already has a site with this name", items: []string{plan.Site.Name}}
+	}
+
+	if len(plan.Devices) > 0 {
+		serials := make([]string, len(plan.Devices))
+		for i, device := range plan.Devices {
+			serials[i] = device.DeviceSerialNumber
+		}
+
+		query := tx.Unscoped().Model(&models.Device{}).Where("device_serial_number IN ?", serials)
+		if deviceSerialScope == models.SerialScopeCustomer {
+			query = query.Where("customer_id = ?", customer.ID)
+		}
+
+		var taken []string
+		if err := query.Distinct().Pluck("device_serial_number", &taken).Error; err != nil {
+			return response, err
+		}
+		if len(taken) > 0 {
+			return response, &provisioningConflict{reason: "Devices with these serial numbers already exist", items: taken}
+		}
+	}
+
+	site := siteFromRequest(*plan.Site, customer.ID)
+	if err := tx.Omit("Customer").Create(&site).Error; err != nil {
+		return response, fmt.Errorf("site %s: %w", site.Name, err)
+	}
+	response.Site = newSiteResponse(site, customer)
+
+	response.Devices = make([]DeviceResponse, 0, len(plan.Devices))
+	for _, body := range plan.Devices {
+		gateway := body.Gateway
+		if gateway == "" {
+			gateway = plan.Gateway
+		}
+
+		device := models.Device{
+			SiteID:                 site.ID,
+			CustomerID:             customer.ID,
+			Gateway:                gateway,
+			Controller:             body.Controller,
+			ControllerSerialNumber: body.ControllerSerialNumber,
+			DeviceType:             body.DeviceType,
+			DeviceName:             body.DeviceName,
+			DeviceSerialNumber:     body.DeviceSerialNumber,
+			BuildingURL:            body.BuildingURL,
+			AuthToken:              body.AuthToken,
+		}
+		if err := tx.Omit("Site").Create(&device).Error; err != nil {
+			return response, fmt.Errorf("device %s: %w", device.DeviceSerialNumber, err)
+		}
+
+		response.Devices = append(response.Devices, DeviceResponse{
+			ID:                     device.ID,
+			CustomerID:             customer.ID,
+			CustomerName:           customer.Name,
+			SiteID:                 site.ID,
+			SiteName:               site.Name,
+			Gateway:                device.Gateway,
+			Controller:             device.Controller,
+			ControllerSerialNumber: device.ControllerSerialNumber,
+			DeviceType:             device.DeviceType,
+			DeviceName:             device.DeviceName,
+			DeviceSerialNumber:     device.DeviceSerialNumber,
+			BuildingURL:            device.BuildingURL,
+			AuthToken:              devicetoken.MaskStored(device.AuthToken),
+		})
+	}
+
+	response.Tokens = make([]ProvisioningToken, 0, len(plan.Tokens))
+	for _, action := range plan.Tokens {
+		authToken, err := storeToken(tx, customer, &site.ID, action, TokenBinding{})
+		if err != nil {
+			return response, fmt.Errorf("token %s: %w", action, err)
+		}
+		response.Tokens = append(response.Tokens, ProvisioningToken{Action: action, Token: authToken.Token, RefreshToken: authToken.RefreshToken})
+	}
+
+	return response, nil
+}
+
+// newProvisioningSessionResponse returns the session with the auth tokens of its staged devices masked
+func newProvisioningSessionResponse(session models.ProvisioningSession, plan ProvisioningPlan) ProvisioningSessionResponse {
+	devices := make([]DeviceRequest, len(plan.Devices))
+	for i, device := range plan.Devices {
+		device.AuthToken = devicetoken.MaskStored(device.AuthToken)
+		devices[i] = device
+	}
+	plan.Devices = devices
+
+	return ProvisioningSessionResponse{
+		ID:         session.ID,
+		CustomerID: session.CustomerID,
+		State:      session.State,
+		Plan:       plan,
+		SiteID:     session.SiteID,
+		ExpiresAt:  timefmt.New(session.ExpiresAt),
+	}
+}
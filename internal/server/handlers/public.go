@@ -3,14 +3,30 @@ package handlers
 import (
 	"fmt"
 	"net/http"
+	"sort"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/johandrevandeventer/devices-api-server/internal/config"
 	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/internal/status"
 )
 
 func HealthHandler(c *gin.Context) {
 	cfg := config.GetConfig()
 	data := fmt.Sprintf("Service is running: %s", cfg.System.AppName)
+
+	// Degraded components do not stop the service from answering, so the check still passes
+	if degraded := status.Degraded(); len(degraded) > 0 {
+		components := make([]string, 0, len(degraded))
+		for component := range degraded {
+			components = append(components, component)
+		}
+		sort.Strings(components)
+
+		serverutils.WriteJSON(c, http.StatusOK, "Degraded", fmt.Sprintf("%s (degraded: %s)", data, strings.Join(components, ", ")))
+		return
+	}
+
 	serverutils.WriteJSON(c, http.StatusOK, "OK", data)
 }
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/internal/timefmt"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxReadingsPerReport is the most point readings a single status report can carry
+const maxReadingsPerReport = 1000
+
+type PointReadingResponse struct {
+	PointName  string        `json:"point_name"`
+	Unit       string        `json:"unit"`
+	Value      *float64      `json:"value"`
+	ReportedAt *timefmt.Time `json:"reported_at"`
+}
+
+type DeviceLatestResponse struct {
+	DeviceSerialNumber string                 `json:"device_serial_number"`
+	Points             []PointReadingResponse `json:"points"`
+}
+
+// Route: GET /devices/:device_serial_number/latest
+// Fetch the last value the device reported for each point in its point address book. Points the
+// device has not reported yet are listed without a value.
+func DeviceLatestReadings(c *gin.Context) {
+	serialNumber := c.Param("device_serial_number")
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	device, ok := fetchReportingDevice(c, bmsDB, serialNumber)
+	if !ok {
+		return
+	}
+
+	var rows []struct {
+		PointName  string
+		Unit       string
+		Value      *float64
+		ReportedAt *time.Time
+	}
+	if err := bmsDB.DB.Table("point_addresses").
+		Select("point_addresses.point_name, point_addresses.unit, point_readings.value, point_readings.reported_at").
+		Joins(`LEFT JOIN point_readings ON point_readings.device_id = point_addresses.device_id
+			AND point_readings.point_name = point_addresses.point_name AND point_readings.deleted_at IS NULL`).
+		Where("point_addresses.device_id = ? AND point_addresses.deleted_at IS NULL", device.ID).
+		Order("point_addresses.point_name").
+		Scan(&rows).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch readings", err.Error())
+		return
+	}
+
+	response := DeviceLatestResponse{
+		DeviceSerialNumber: device.DeviceSerialNumber,
+		Points:             make([]PointReadingResponse, len(rows)),
+	}
+	for i, row := range rows {
+		response.Points[i] = PointReadingResponse{PointName: row.PointName, Unit: row.Unit, Value: row.Value}
+		if row.ReportedAt != nil {
+			reportedAt := timefmt.New(*row.ReportedAt)
+			response.Points[i].ReportedAt = &reportedAt
+		}
+	}
+
+	serverutils.WriteJSON(c, 200, "Readings fetched", response)
+}
+
+// =====================================================================================================================
+
+// registeredReadings returns the readings of the points in the device's point address book,
+// adding a warning that names the points it does not have
+func registeredReadings(c *gin.Context, tx *gorm.DB, device *models.Device, readings map[string]float64, reportedAt time.Time) ([]models.PointReading, error) {
+	var registered []string
+	if err := tx.Model(&models.PointAddress{}).Where("device_id = ?", device.ID).Pluck("point_name", &registered).Error; err != nil {
+		return nil, err
+	}
+
+	known := make(map[string]bool, len(registered))
+	for _, name := range registered {
+		known[name] = true
+	}
+
+	var kept []models.PointReading
+	var unknown []string
+	for name, value := range readings {
+		if !known[name] {
+			unknown = append(unknown, name)
+			continue
+		}
+		kept = append(kept, models.PointReading{DeviceID: device.ID, PointName: name, Value: value, ReportedAt: reportedAt})
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		serverutils.AddWarning(c, "Readings of points missing from the point address book were ignored: "+strings.Join(unknown, ", "))
+	}
+
+	// Sorted so concurrent reports lock the rows in the same order
+	sort.Slice(kept, func(i, j int) bool { return kept[i].PointName < kept[j].PointName })
+	return kept, nil
+}
+
+// saveReadings overwrites the last readings of the points
+func saveReadings(tx *gorm.DB, readings []models.PointReading) error {
+	if len(readings) == 0 {
+		return nil
+	}
+
+	return tx.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "device_id"}, {Name: "point_name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"value", "reported_at", "updated_at", "deleted_at"}),
+	}).Create(&readings).Error
+}
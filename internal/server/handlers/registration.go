@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/devicetoken"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// DeviceRegistrationRequest is a device as registered by its gateway, with the site it is installed at
+type DeviceRegistrationRequest struct {
+	CustomerID uuid.UUID `json:"customer_id"`
+	SiteID     uuid.UUID `json:"site_id"`
+	DeviceRequest
+}
+
+// DeviceRegistrationResponse is the registered device, with whether it was created, restored or updated
+type DeviceRegistrationResponse struct {
+	Result string `json:"result"`
+	DeviceResponse
+}
+
+// Results of a device registration
+const (
+	registrationCreated  = "created"
+	registrationRestored = "restored"
+	registrationUpdated  = "updated"
+)
+
+var (
+	// errDeviceOtherCustomer is returned when registering a device whose serial number belongs to another customer
+	errDeviceOtherCustomer = errors.New("device belongs to another customer")
+
+	// errSiteOtherCustomer is returned when registering a device at a site of another customer
+	errSiteOtherCustomer = errors.New("site belongs to another customer")
+
+	// errDeviceOtherSite is returned when a gateway registers a device of another site
+	errDeviceOtherSite = errors.New("device belongs to another site")
+)
+
+// Route: PUT /registrations/devices (Admin Only)
+// Register a device by serial number: create it if missing, restore it if deleted, or update it if
+// present, so gateways can repeat the call safely. The device may move between sites of its customer.
+// An empty auth_token keeps the stored token of an existing device.
+func DeviceRegister(c *gin.Context) {
+	var body DeviceRegistrationRequest
+
+	if err := c.BindJSON(&body); err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", "Invalid JSON format")
+		return
+	}
+
+	if missing := missingFields(deviceRequiredFields(body.DeviceRequest)); len(missing) > 0 {
+		serverutils.WriteError(c, 400, "Invalid request body", "Missing required fields: "+strings.Join(missing, ", "))
+		return
+	}
+	if body.CustomerID == uuid.Nil || body.SiteID == uuid.Nil {
+		serverutils.WriteError(c, 400, "Invalid request body", "customer_id and site_id are required")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	sealed, err := devicetoken.Seal(body.AuthToken)
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to encrypt auth token", err.Error())
+		return
+	}
+
+	var registration deviceRegistration
+	err = bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		site, err := fetchRegistrationSite(tx, body.CustomerID, body.SiteID)
+		if err != nil {
+			return err
+		}
+
+		registration, err = registerDevice(tx, site, body.DeviceRequest, sealed, true)
+		return err
+	})
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		serverutils.WriteError(c, 404, "Customer or site not found", "No customer or site found with the given ID")
+		return
+	case errors.Is(err, errSiteOtherCustomer):
+		serverutils.WriteError(c, 403, "Forbidden", "There is no site with the given ID for the given customer")
+		return
+	case errors.Is(err, errDeviceOtherCustomer):
+		serverutils.WriteError(c, 409, "Device belongs to another customer", "A device with this serial number is registered to another customer")
+		return
+	case errors.Is(err, ErrDeviceAmbiguous):
+		serverutils.WriteError(c, 409, "Device is ambiguous", "The serial number is used by several customers")
+		return
+	case err != nil:
+		writeAttachError(c, err, "Failed to register device")
+		return
+	}
+
+	registration.recordChanges(c)
+
+	response, err := registration.response(bmsDB)
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch site", err.Error())
+		return
+	}
+	if omitsDeviceTokens(c) {
+		response.AuthToken = ""
+	}
+	serverutils.WriteJSON(c, 200, "Device "+registration.result, response)
+}
+
+// =====================================================================================================================
+
+// deviceRegistration is a device written by registerDevice, with whether it was created, restored or
+// updated and the site it moved from, if any
+type deviceRegistration struct {
+	device    models.Device
+	result    string
+	movedFrom uuid.UUID
+}
+
+// fetchRegistrationSite fetches the site devices are registered at, checking that it and its
+// customer can have devices attached and that the site belongs to the customer
+func fetchRegistrationSite(tx *gorm.DB, customerID, siteID uuid.UUID) (*models.Site, error) {
+	txDB := &devicesdb.BMS_DB{DB: tx}
+
+	customer, err := fetchAttachableCustomer(txDB, customerID.String())
+	if err != nil {
+		return nil, err
+	}
+	site, err := fetchAttachableSite(txDB, siteID.String())
+	if err != nil {
+		return nil, err
+	}
+	if site.CustomerID != customer.ID {
+		return nil, errSiteOtherCustomer
+	}
+	return site, nil
+}
+
+// registerDevice creates the device with the serial number at the site if it is missing, or restores
+// and updates it. The device keeps its customer, and only moves from another site of the customer
+// when allowMove is set. An empty auth token keeps the stored token of an existing device.
+func registerDevice(tx *gorm.DB, site *models.Site, body DeviceRequest, sealedToken string, allowMove bool) (deviceRegistration, error) {
+	// Lock the device, deleted or not, so concurrent registrations of it are applied in turn
+	query := tx.Unscoped().Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("device_serial_number = ?", body.DeviceSerialNumber)
+	if deviceSerialScope == models.SerialScopeCustomer {
+		query = query.Where("customer_id = ?", site.CustomerID)
+	}
+	var existing []models.Device
+	if err := query.Limit(2).Find(&existing).Error; err != nil {
+		return deviceRegistration{}, err
+	}
+
+	switch {
+	case len(existing) > 1:
+		return deviceRegistration{}, ErrDeviceAmbiguous
+	case len(existing) == 0:
+		device := models.Device{
+			SiteID:             site.ID,
+			CustomerID:         site.CustomerID,
+			DeviceSerialNumber: body.DeviceSerialNumber,
+			AuthToken:          sealedToken,
+		}
+		applyDeviceRegistration(&device, body)
+		if err := tx.Create(&device).Error; err != nil {
+			return deviceRegistration{}, err
+		}
+		return deviceRegistration{device: device, result: registrationCreated}, nil
+	case existing[0].CustomerID != site.CustomerID:
+		return deviceRegistration{}, errDeviceOtherCustomer
+	case existing[0].SiteID != site.ID && !allowMove:
+		return deviceRegistration{}, errDeviceOtherSite
+	}
+
+	registration := deviceRegistration{device: existing[0], result: registrationUpdated}
+	device := &registration.device
+	if device.DeletedAt.Valid {
+		registration.result = registrationRestored
+	}
+	if device.SiteID != site.ID {
+		registration.movedFrom = device.SiteID
+	}
+
+	device.SiteID = site.ID
+	device.DeletedAt, device.DeletedBy = gorm.DeletedAt{}, nil
+	applyDeviceRegistration(device, body)
+	if body.AuthToken != "" {
+		device.AuthToken = sealedToken
+	}
+	return registration, tx.Unscoped().Omit("Site").Save(device).Error
+}
+
+// recordChanges invalidates the cached devices of the sites the registration changed and records
+// the change for pollers
+func (r deviceRegistration) recordChanges(c *gin.Context) {
+	recordDeviceChanges(c, r.device.SiteID)
+	if r.movedFrom != uuid.Nil {
+		recordDeviceChanges(c, r.movedFrom)
+	}
+}
+
+// response returns the registered device with its site and customer
+func (r deviceRegistration) response(bmsDB *devicesdb.BMS_DB) (DeviceRegistrationResponse, error) {
+	device := r.device
+	if err := fillDeviceSite(bmsDB, &device); err != nil {
+		return DeviceRegistrationResponse{}, err
+	}
+
+	return DeviceRegistrationResponse{
+		Result: r.result,
+		DeviceResponse: DeviceResponse{
+			ID:                     device.ID,
+			CustomerID:             device.Site.Customer.ID,
+			CustomerName:           device.Site.Customer.Name,
+			SiteID:                 device.Site.ID,
+			SiteName:               device.Site.Name,
+			Gateway:                device.Gateway,
+			Controller:             device.Controller,
+			ControllerSerialNumber: device.ControllerSerialNumber,
+			DeviceType:             device.DeviceType,
+			DeviceName:             device.DeviceName,
+			DeviceSerialNumber:     device.DeviceSerialNumber,
+			BuildingURL:            device.BuildingURL,
+			FirmwareVersion:        device.FirmwareVersion,
+			HardwareRevision:       device.HardwareRevision,
+			AuthToken:              devicetoken.MaskStored(device.AuthToken),
+		},
+	}, nil
+}
+
+// applyDeviceRegistration sets the mutable fields of the device from the registration
+func applyDeviceRegistration(device *models.Device, body DeviceRequest) {
+	device.Gateway = body.Gateway
+	device.Controller = body.Controller
+	device.ControllerSerialNumber = body.ControllerSerialNumber
+	device.DeviceType = body.DeviceType
+	device.DeviceName = body.DeviceName
+	device.BuildingURL = body.BuildingURL
+}
@@ -0,0 +1,233 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxNotificationEmails is the most notification email addresses a customer may set
+const maxNotificationEmails = 20
+
+// mqttTopicPrefixRegex matches MQTT topic prefixes without wildcards or empty levels
+var mqttTopicPrefixRegex = regexp.MustCompile(`^[A-Za-z0-9_-]+(/[A-Za-z0-9_-]+)*$`)
+
+// customerSettings validates the value of each setting a customer can be given. A new setting only
+// needs an entry here.
+var customerSettings = map[string]func(value json.RawMessage) error{
+	"data_retention_days": validateDataRetentionDays,
+	"notification_emails": validateNotificationEmails,
+	"mqtt_topic_prefix":   validateMQTTTopicPrefix,
+}
+
+type CustomerSettingsRequest struct {
+	Settings map[string]json.RawMessage `json:"settings"`
+}
+
+type CustomerSettingsResponse struct {
+	CustomerID uuid.UUID                  `json:"customer_id"`
+	Settings   map[string]json.RawMessage `json:"settings"`
+}
+
+// Route: GET /customers/:customer_id/settings
+// Fetch the settings of a customer. Settings the customer was not given are left out.
+func CustomerSettingsFetch(c *gin.Context) {
+	role := c.GetString("role")
+	requesterID := c.GetString("customer_id")
+	customerID := c.Param("customer_id")
+
+	// Validate the customer ID
+	if !serverutils.IsValidUUID(customerID) {
+		serverutils.WriteError(c, 400, "Invalid customer ID", "Invalid UUID format")
+		return
+	}
+
+	// Check if the requester is an admin or the customer owner
+	if role != "admin" && requesterID != customerID {
+		serverutils.WriteError(c, 403, "Forbidden", "You are not authorized to access this customer's settings")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	customer, err := FetchCustomerByID(bmsDB, customerID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 404, "Customer not found", "No customer found with the given ID")
+		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch customer", err.Error())
+		return
+	}
+
+	response, err := fetchCustomerSettings(bmsDB, customer.ID)
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch settings", err.Error())
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Settings fetched", response)
+}
+
+// Route: PUT /customers/:customer_id/settings (Admin Only)
+// Set the given settings of a customer, leaving the others unchanged. A null value removes the
+// setting.
+func CustomerSettingsUpdate(c *gin.Context) {
+	customerID := c.Param("customer_id")
+
+	// Validate the customer ID
+	if !serverutils.IsValidUUID(customerID) {
+		serverutils.WriteError(c, 400, "Invalid customer ID", "Invalid UUID format")
+		return
+	}
+
+	var body CustomerSettingsRequest
+	if err := c.BindJSON(&body); err != nil || len(body.Settings) == 0 {
+		serverutils.WriteError(c, 400, "Invalid request body", "settings must hold at least one setting")
+		return
+	}
+
+	// Sorted so the rows are written, and errors reported, in the same order
+	keys := make([]string, 0, len(body.Settings))
+	for key := range body.Settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var set []models.CustomerSetting
+	var removed []string
+	for _, key := range keys {
+		validate, ok := customerSettings[key]
+		if !ok {
+			serverutils.WriteError(c, 400, "Unknown setting", fmt.Sprintf("%s is not a customer setting", key))
+			return
+		}
+
+		value := body.Settings[key]
+		if bytes.Equal(value, []byte("null")) {
+			removed = append(removed, key)
+			continue
+		}
+		if err := validate(value); err != nil {
+			serverutils.WriteError(c, 400, "Invalid setting", fmt.Sprintf("%s: %s", key, err))
+			return
+		}
+
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, value); err != nil {
+			serverutils.WriteError(c, 400, "Invalid setting", fmt.Sprintf("%s: %s", key, err))
+			return
+		}
+		set = append(set, models.CustomerSetting{Key: key, Value: compact.String()})
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	customer, err := FetchCustomerByID(bmsDB, customerID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 404, "Customer not found", "No customer found with the given ID")
+		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch customer", err.Error())
+		return
+	}
+
+	err = bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		if len(removed) > 0 {
+			if err := tx.Where("customer_id = ? AND `key` IN ?", customer.ID, removed).Delete(&models.CustomerSetting{}).Error; err != nil {
+				return err
+			}
+		}
+		if len(set) == 0 {
+			return nil
+		}
+
+		for i := range set {
+			set[i].CustomerID = customer.ID
+		}
+		return tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "customer_id"}, {Name: "key"}},
+			DoUpdates: clause.AssignmentColumns([]string{"value", "updated_at", "deleted_at"}),
+		}).Create(&set).Error
+	})
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to update settings", err.Error())
+		return
+	}
+
+	response, err := fetchCustomerSettings(bmsDB, customer.ID)
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch settings", err.Error())
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Settings updated", response)
+}
+
+// =====================================================================================================================
+
+// fetchCustomerSettings returns the settings the customer was given
+func fetchCustomerSettings(bmsDB *devicesdb.BMS_DB, customerID uuid.UUID) (CustomerSettingsResponse, error) {
+	var settings []models.CustomerSetting
+	if err := bmsDB.DB.Where("customer_id = ?", customerID).Find(&settings).Error; err != nil {
+		return CustomerSettingsResponse{}, err
+	}
+
+	response := CustomerSettingsResponse{CustomerID: customerID, Settings: make(map[string]json.RawMessage, len(settings))}
+	for _, setting := range settings {
+		response.Settings[setting.Key] = json.RawMessage(setting.Value)
+	}
+	return response, nil
+}
+
+// validateDataRetentionDays checks the number of days the data of the customer is kept
+func validateDataRetentionDays(value json.RawMessage) error {
+	var days int
+	if err := json.Unmarshal(value, &days); err != nil || days < 1 || days > 3650 {
+		return errors.New("must be a number of days between 1 and 3650")
+	}
+	return nil
+}
+
+// validateNotificationEmails checks the addresses notifications for the customer are sent to
+func validateNotificationEmails(value json.RawMessage) error {
+	var emails []string
+	if err := json.Unmarshal(value, &emails); err != nil || len(emails) > maxNotificationEmails {
+		return fmt.Errorf("must be a list of at most %d email addresses", maxNotificationEmails)
+	}
+
+	for _, email := range emails {
+		if address, err := mail.ParseAddress(email); err != nil || address.Address != email {
+			return fmt.Errorf("%q is not an email address", email)
+		}
+	}
+	return nil
+}
+
+// validateMQTTTopicPrefix checks the prefix of the MQTT topics of the customer
+func validateMQTTTopicPrefix(value json.RawMessage) error {
+	var prefix string
+	if err := json.Unmarshal(value, &prefix); err != nil || len(prefix) > 64 || !mqttTopicPrefixRegex.MatchString(prefix) {
+		return errors.New("must be at most 64 letters, digits, '-' or '_' in '/' separated levels")
+	}
+	return nil
+}
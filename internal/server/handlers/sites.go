@@ -2,14 +2,34 @@ package handlers
 
 import (
 	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/cache"
 	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
 	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
 	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxAddressLength is the length of the site address column
+const maxAddressLength = 255
+
+// maxBulkSites is the largest number of sites created in one bulk request
+const maxBulkSites = 500
+
+// Results of the sites of a bulk request
+const (
+	siteBulkCreated  = "created"
+	siteBulkRestored = "restored"
+	siteBulkInvalid  = "invalid"
+	siteBulkSkipped  = "skipped"
 )
 
 type SiteResponse struct {
@@ -17,10 +37,52 @@ type SiteResponse struct {
 	Name         string    `json:"name"`
 	CustomerID   uuid.UUID `json:"customer_id"`
 	CustomerName string    `json:"customer_name"`
+	Address      string    `json:"address"`
+	Latitude     *float64  `json:"latitude"`
+	Longitude    *float64  `json:"longitude"`
+	Timezone     string    `json:"timezone"`
 }
 
 type SiteRequest struct {
-	Name string `json:"name"`
+	Name      string   `json:"name"`
+	Address   string   `json:"address"`
+	Latitude  *float64 `json:"latitude"`
+	Longitude *float64 `json:"longitude"`
+	Timezone  string   `json:"timezone"`
+}
+
+// SiteUpdateRequest renames a site, changes its location or moves it to another customer, leaving
+// unset fields unchanged
+type SiteUpdateRequest struct {
+	Name       string   `json:"name"`
+	CustomerID string   `json:"customer_id"`
+	Address    *string  `json:"address"`
+	Latitude   *float64 `json:"latitude"`
+	Longitude  *float64 `json:"longitude"`
+	Timezone   *string  `json:"timezone"`
+}
+
+// SiteBulkResult is the outcome of a site of a bulk request, indexed from 0 in request order. Valid
+// sites of a rejected request are skipped.
+type SiteBulkResult struct {
+	Index  int           `json:"index"`
+	Name   string        `json:"name"`
+	Result string        `json:"result"`
+	Error  string        `json:"error,omitempty"`
+	Site   *SiteResponse `json:"site,omitempty"`
+}
+
+// SiteDeleteResponse lists the devices deleted with the site, or that would be on a dry run
+type SiteDeleteResponse struct {
+	SiteID  uuid.UUID `json:"site_id"`
+	DryRun  bool      `json:"dry_run"`
+	Devices []string  `json:"devices"`
+}
+
+type SiteBulkResponse struct {
+	Created  int              `json:"created"`
+	Restored int              `json:"restored"`
+	Results  []SiteBulkResult `json:"results"`
 }
 
 // Route: POST /sites
@@ -41,6 +103,11 @@ func SiteCreate(c *gin.Context) {
 		return
 	}
 
+	if reason := invalidSiteLocation(body.Address, body.Latitude, body.Longitude, body.Timezone); reason != "" {
+		serverutils.WriteError(c, 400, "Invalid request body", reason)
+		return
+	}
+
 	// Get the database instance
 	bmsDB, ok := serverutils.GetDBInstance(c)
 	if !ok {
@@ -48,16 +115,16 @@ func SiteCreate(c *gin.Context) {
 	}
 
 	// Check if the customer exists
-	customer, err := FetchCustomerByID(bmsDB, customerID)
+	customer, err := fetchAttachableCustomer(bmsDB, customerID)
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		serverutils.WriteError(c, 404, "Customer not found", "No customer found with the given ID")
 		return
 	} else if err != nil {
-		serverutils.WriteError(c, 500, "Failed to fetch customer", err.Error())
+		writeAttachError(c, err, "Failed to fetch customer")
 		return
 	}
 
-	site, err := FetchSiteByName(bmsDB, body.Name)
+	site, err := FetchSiteByName(bmsDB, customer.ID, body.Name)
 	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
 		serverutils.WriteError(c, 500, "Failed to fetch site", err.Error())
 		return
@@ -65,65 +132,233 @@ func SiteCreate(c *gin.Context) {
 
 	if site == nil {
 		// Create new site
-		newSite := models.Site{Name: body.Name, CustomerID: customer.ID}
+		newSite := siteFromRequest(body, customer.ID)
 		if err := bmsDB.DB.Create(&newSite).Error; err != nil {
 			serverutils.WriteError(c, 500, "Failed to create site", err.Error())
 			return
 		}
-		serverutils.WriteJSON(c, 200, "Site created", SiteResponse{ID: newSite.ID, Name: newSite.Name, CustomerID: customer.ID, CustomerName: customer.Name})
+		serverutils.WriteJSON(c, 200, "Site created", newSiteResponse(newSite, *customer))
 		return
 	}
 
 	if site.DeletedAt.Valid {
-		// Restore the site
-		now := time.Now()
-		site.DeletedAt = gorm.DeletedAt{}
-		site.CreatedAt, site.UpdatedAt = now, now
-
-		if err := bmsDB.DB.Unscoped().Save(&site).Error; err != nil {
+		if err := restoreSite(bmsDB.DB, site, body); err != nil {
 			serverutils.WriteError(c, 500, "Failed to restore site", err.Error())
 			return
 		}
-		serverutils.WriteJSON(c, 200, "Site restored", SiteResponse{ID: site.ID, Name: site.Name, CustomerID: customer.ID, CustomerName: customer.Name})
+		serverutils.WriteJSON(c, 200, "Site restored", newSiteResponse(*site, *customer))
 		return
 	}
 
-	serverutils.WriteError(c, 400, "Site already exists", "A site with this name already exists")
+	serverutils.WriteError(c, 400, "Site already exists", "The customer already has a site with this name")
 }
 
-// Route: GET /sites
-// Fetch all sites
+// Route: POST /customers/:customer_id/sites/bulk (Admin Only)
+// Create the sites of a customer in one transaction, restoring deleted sites with the same name.
+// Nothing is written unless every site is valid; the result of every site is reported either way.
+func SiteBulkCreate(c *gin.Context) {
+	customerID := c.Param("customer_id")
+
+	// Validate the customer ID
+	if !serverutils.IsValidUUID(customerID) {
+		serverutils.WriteError(c, 400, "Invalid customer ID", "Invalid UUID format")
+		return
+	}
+
+	var body []SiteRequest
+	if err := c.BindJSON(&body); err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", err.Error())
+		return
+	}
+	if len(body) == 0 || len(body) > maxBulkSites {
+		serverutils.WriteError(c, 400, "Invalid request body", fmt.Sprintf("Between 1 and %d sites must be given", maxBulkSites))
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	customer, err := fetchAttachableCustomer(bmsDB, customerID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 404, "Customer not found", "No customer found with the given ID")
+		return
+	} else if err != nil {
+		writeAttachError(c, err, "Failed to fetch customer")
+		return
+	}
+
+	names := make([]string, 0, len(body))
+	for _, site := range body {
+		names = append(names, site.Name)
+	}
+
+	var existing []models.Site
+	if err := bmsDB.DB.Unscoped().Where("customer_id = ? AND name IN ?", customer.ID, names).Find(&existing).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch sites", err.Error())
+		return
+	}
+	existingByName := make(map[string]*models.Site, len(existing))
+	for i := range existing {
+		existingByName[existing[i].Name] = &existing[i]
+	}
+
+	response := SiteBulkResponse{Results: make([]SiteBulkResult, len(body))}
+	rejected := false
+	seen := make(map[string]bool, len(body))
+	for i, site := range body {
+		result := SiteBulkResult{Index: i, Name: site.Name, Result: siteBulkSkipped}
+		if reason := invalidBulkSite(site, seen, existingByName); reason != "" {
+			result.Result, result.Error = siteBulkInvalid, reason
+			rejected = true
+		}
+		seen[site.Name] = true
+		response.Results[i] = result
+	}
+
+	if rejected {
+		serverutils.WriteJSON(c, 422, "Sites rejected", response)
+		return
+	}
+
+	err = bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		for i, request := range body {
+			site := existingByName[request.Name]
+			if site != nil {
+				if err := restoreSite(tx, site, request); err != nil {
+					return fmt.Errorf("site %d: %w", i, err)
+				}
+				response.Results[i].Result = siteBulkRestored
+				response.Restored++
+			} else {
+				created := siteFromRequest(request, customer.ID)
+				if err := tx.Create(&created).Error; err != nil {
+					return fmt.Errorf("site %d: %w", i, err)
+				}
+				site = &created
+				response.Results[i].Result = siteBulkCreated
+				response.Created++
+			}
+
+			siteResponse := newSiteResponse(*site, *customer)
+			response.Results[i].Site = &siteResponse
+		}
+		return nil
+	})
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to create sites", err.Error())
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Sites created", response)
+}
+
+// Route: GET /sites (Admin Only)
+// Fetch all sites, optionally of a single customer given by ?customer_id=. The list is paginated
+// when page or per_page is given.
 func SiteFetchAll(c *gin.Context) {
+	pagination, err := serverutils.ParsePagination(c)
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid pagination", err.Error())
+		return
+	}
+
+	customerID := strings.TrimSpace(c.Query("customer_id"))
+	if customerID != "" && !serverutils.IsValidUUID(customerID) {
+		serverutils.WriteError(c, 400, "Invalid customer ID", "Invalid UUID format")
+		return
+	}
+
 	bmsDB, ok := serverutils.GetDBInstance(c)
 	if !ok {
 		return
 	}
 
-	var sites []models.Site
-	if err := bmsDB.DB.Find(&sites).Error; err != nil {
+	query := SiteListQuery(bmsDB)
+	if customerID != "" {
+		query = query.Where("sites.customer_id = ?", customerID)
+	}
+
+	query, err = filterSiteList(c, query)
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid filter", err.Error())
+		return
+	}
+
+	if pagination != nil {
+		query, err = pagination.Apply(query)
+		if err != nil {
+			serverutils.WriteError(c, 500, "Failed to count sites", err.Error())
+			return
+		}
+	}
+
+	response := []SiteResponse{}
+	if err := query.Scan(&response).Error; err != nil {
 		serverutils.WriteError(c, 500, "Failed to fetch sites", err.Error())
 		return
 	}
 
-	var response []SiteResponse
-	for _, site := range sites {
-		customer, err := FetchCustomerByID(bmsDB, site.CustomerID.String())
+	serverutils.WriteJSONPage(c, 200, "Sites fetched", response, pagination)
+}
+
+// Route: GET /sites/search
+// Search sites by name, address and customer name. The results are paginated when page or
+// per_page is given.
+func SiteSearch(c *gin.Context) {
+	role := c.GetString("role")
+	requesterID := c.GetString("customer_id")
+
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		serverutils.WriteError(c, 400, "Invalid search", "Query parameter q is required")
+		return
+	}
+
+	pagination, err := serverutils.ParsePagination(c)
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid pagination", err.Error())
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	pattern := "%" + likeEscaper.Replace(q) + "%"
+	query := SiteListQuery(bmsDB).Where("(sites.name LIKE ? OR sites.address LIKE ? OR customers.name LIKE ?)", pattern, pattern, pattern)
+
+	// Non-admins only search their own sites
+	if role != "admin" {
+		query = query.Where("sites.customer_id = ?", requesterID)
+	}
+
+	if pagination != nil {
+		query, err = pagination.Apply(query)
 		if err != nil {
-			serverutils.WriteError(c, 500, "Failed to fetch customer", err.Error())
+			serverutils.WriteError(c, 500, "Failed to count sites", err.Error())
 			return
 		}
+	}
 
-		response = append(response, SiteResponse{ID: site.ID, Name: site.Name, CustomerID: customer.ID, CustomerName: customer.Name})
+	response := []SiteResponse{}
+	if err := query.Scan(&response).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch sites", err.Error())
+		return
 	}
 
-	serverutils.WriteJSON(c, 200, "Sites fetched", response)
+	serverutils.WriteJSONPage(c, 200, "Sites fetched", response, pagination)
 }
 
 // Route: GET /sites/:site_id
 // Fetch a site by ID
 func SiteFetchByID(c *gin.Context) {
 	role := c.GetString("role")
-	requesterID := c.GetString("user_id")
+	requesterID := c.GetString("customer_id")
 	siteID := c.Param("site_id")
 
 	// Validate the site ID
@@ -164,14 +399,14 @@ func SiteFetchByID(c *gin.Context) {
 		return
 	}
 
-	serverutils.WriteJSON(c, 200, "Site fetched", SiteResponse{ID: site.ID, Name: site.Name, CustomerID: customer.ID, CustomerName: customer.Name})
+	serverutils.WriteJSON(c, 200, "Site fetched", newSiteResponse(*site, *customer))
 }
 
 // Route: GET /customers/:customer_id/sites
 // Fetch all sites for a customer
 func SiteFetchByCustomerID(c *gin.Context) {
 	role := c.GetString("role")
-	requesterID := c.GetString("user_id")
+	requesterID := c.GetString("customer_id")
 	customerID := c.Param("customer_id")
 
 	// Validate the customer ID
@@ -202,23 +437,26 @@ func SiteFetchByCustomerID(c *gin.Context) {
 		return
 	}
 
-	// Fetch the sites
-	var sites []models.Site
-	if err := bmsDB.DB.Where("customer_id = ?", customer.ID).Find(&sites).Error; err != nil {
-		serverutils.WriteError(c, 500, "Failed to fetch sites", err.Error())
+	query, err := filterSiteList(c, SiteListQuery(bmsDB).Where("sites.customer_id = ?", customer.ID))
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid filter", err.Error())
 		return
 	}
 
+	// Fetch the sites
 	var response []SiteResponse
-	for _, site := range sites {
-		response = append(response, SiteResponse{ID: site.ID, Name: site.Name, CustomerID: customer.ID, CustomerName: customer.Name})
+	if err := query.Scan(&response).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch sites", err.Error())
+		return
 	}
 
 	serverutils.WriteJSON(c, 200, "Sites fetched", response)
 }
 
-// Route: PUT /sites/:site_id
-// Update a site by ID
+// Route: PUT /sites/:site_id (Admin Only)
+// Route: PATCH /sites/:site_id (Admin Only)
+// Update the given fields of a site by ID. Setting customer_id moves the site and its devices to
+// another customer.
 func SiteUpdate(c *gin.Context) {
 	siteID := c.Param("site_id")
 
@@ -229,9 +467,20 @@ func SiteUpdate(c *gin.Context) {
 	}
 
 	// Parse the request body
-	var body SiteRequest
-	if err := c.BindJSON(&body); err != nil || body.Name == "" {
-		serverutils.WriteError(c, 400, "Invalid request body", "Name field is required")
+	var body SiteUpdateRequest
+	if err := c.BindJSON(&body); err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", "Invalid JSON format")
+		return
+	}
+
+	updates := siteLocationUpdates(body)
+	if body.Name == "" && body.CustomerID == "" && len(updates) == 0 {
+		serverutils.WriteError(c, 400, "Invalid request body", "Name, customer_id, address, latitude, longitude or timezone field is required")
+		return
+	}
+
+	if body.CustomerID != "" && !serverutils.IsValidUUID(body.CustomerID) {
+		serverutils.WriteError(c, 400, "Invalid customer ID", "Invalid UUID format")
 		return
 	}
 
@@ -246,18 +495,101 @@ func SiteUpdate(c *gin.Context) {
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		serverutils.WriteError(c, 404, "Site not found", "No site found with the given ID")
 		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch site", err.Error())
+		return
 	}
 
-	if result := bmsDB.DB.Model(&site).Select("Name").Updates(models.Site{Name: body.Name}); result.Error != nil {
-		serverutils.WriteError(c, 500, "Failed to update site", result.Error.Error())
+	// Fetch the customer the site moves to
+	var customer *models.Customer
+	if body.CustomerID != "" && body.CustomerID != site.CustomerID.String() {
+		customer, err = fetchAttachableCustomer(bmsDB, body.CustomerID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			serverutils.WriteError(c, 404, "Customer not found", "No customer found with the given ID")
+			return
+		} else if err != nil {
+			writeAttachError(c, err, "Failed to fetch customer")
+			return
+		}
+	}
+
+	// The location is checked as it will be after the update; coordinates are always replaced together
+	latitude, longitude := site.Latitude, site.Longitude
+	if body.Latitude != nil || body.Longitude != nil {
+		latitude, longitude = body.Latitude, body.Longitude
+	}
+	timezone := site.Timezone
+	if body.Timezone != nil {
+		timezone = *body.Timezone
+	}
+	address := site.Address
+	if body.Address != nil {
+		address = *body.Address
+	}
+	if reason := invalidSiteLocation(address, latitude, longitude, timezone); reason != "" {
+		serverutils.WriteError(c, 400, "Invalid request body", reason)
+		return
+	}
+
+	if body.Name != "" {
+		updates["name"] = body.Name
+	}
+
+	err = bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		// Renamed and moved sites must keep their name unique among the sites of their customer
+		if body.Name != "" || customer != nil {
+			name, customerID := site.Name, site.CustomerID
+			if body.Name != "" {
+				name = body.Name
+			}
+			if customer != nil {
+				customerID = customer.ID
+			}
+
+			var taken int64
+			if err := tx.Unscoped().Model(&models.Site{}).
+				Where("customer_id = ? AND name = ? AND id <> ?", customerID, name, site.ID).
+				Count(&taken).Error; err != nil {
+				return err
+			}
+			if taken > 0 {
+				return errSiteNameTaken
+			}
+		}
+
+		if len(updates) > 0 {
+			if err := tx.Model(site).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+
+		if customer != nil {
+			return moveSite(tx, site, customer)
+		}
+		return nil
+	})
+	var conflict *siteMoveConflict
+	if errors.Is(err, errSiteNameTaken) {
+		serverutils.WriteError(c, 400, "Site already exists", "The customer already has a site with this name")
+		return
+	} else if errors.As(err, &conflict) {
+		serverutils.WriteError(c, 409, "Site cannot be moved", conflict.Error())
+		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to update site", err.Error())
 		return
 	}
 
-	serverutils.WriteJSON(c, 200, "Site updated", SiteResponse{ID: site.ID, Name: site.Name, CustomerID: site.Customer.ID, CustomerName: site.Customer.Name})
+	updated := *site
+	serverutils.AfterCommit(c, func() { cache.Names().SetSite(updated) })
+	recordDeviceChanges(c, site.ID)
+
+	serverutils.WriteJSON(c, 200, "Site updated", newSiteResponse(*site, site.Customer))
 }
 
 // Route: DELETE /sites/:site_id
-// Delete a site by ID
+// Delete a site by ID. Sites with devices are only deleted with ?cascade=devices, which deletes the
+// devices in the same transaction; ?dry_run=true reports the devices that would be deleted instead.
 func SiteDelete(c *gin.Context) {
 	siteID := c.Param("site_id")
 
@@ -267,6 +599,26 @@ func SiteDelete(c *gin.Context) {
 		return
 	}
 
+	cascade := false
+	switch c.Query("cascade") {
+	case "":
+	case "devices":
+		cascade = true
+	default:
+		serverutils.WriteError(c, 400, "Invalid cascade", "Cascade must be devices")
+		return
+	}
+
+	dryRun := false
+	switch c.Query("dry_run") {
+	case "", "false":
+	case "true":
+		dryRun = true
+	default:
+		serverutils.WriteError(c, 400, "Invalid dry run", "Dry run must be true or false")
+		return
+	}
+
 	// Get the database instance
 	bmsDB, ok := serverutils.GetDBInstance(c)
 	if !ok {
@@ -278,18 +630,210 @@ func SiteDelete(c *gin.Context) {
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		serverutils.WriteError(c, 404, "Site not found", "No site found with the given ID")
 		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch site", err.Error())
+		return
 	}
 
-	if err := bmsDB.DB.Delete(&site).Error; err != nil {
+	response := SiteDeleteResponse{SiteID: site.ID, DryRun: dryRun, Devices: []string{}}
+	err = bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		var devices []models.Device
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Select("id", "device_serial_number").
+			Where("site_id = ?", site.ID).
+			Order("device_serial_number").
+			Find(&devices).Error; err != nil {
+			return err
+		}
+
+		ids := make([]uuid.UUID, len(devices))
+		for i, device := range devices {
+			ids[i] = device.ID
+			response.Devices = append(response.Devices, device.DeviceSerialNumber)
+		}
+
+		if len(devices) > 0 && !cascade {
+			return errSiteHasDevices
+		}
+		if dryRun {
+			return nil
+		}
+
+		if len(ids) > 0 {
+			if err := softDeleteDevices(tx, c.GetString("customer_id"), ids...); err != nil {
+				return err
+			}
+		}
+		return tx.Delete(site).Error
+	})
+	if errors.Is(err, errSiteHasDevices) {
+		serverutils.WriteError(c, 409, "Site has devices",
+			fmt.Sprintf("Delete the %d devices of the site first or delete it with ?cascade=devices", len(response.Devices)))
+		return
+	} else if err != nil {
 		serverutils.WriteError(c, 500, "Failed to delete site", err.Error())
 		return
 	}
 
-	serverutils.WriteJSON(c, 200, "Site deleted", nil)
+	if dryRun {
+		serverutils.WriteJSON(c, 200, "Site delete previewed", response)
+		return
+	}
+
+	serverutils.AfterCommit(c, func() { cache.Names().InvalidateSite(site.ID) })
+	recordDeviceChanges(c, site.ID)
+
+	serverutils.WriteJSON(c, 200, "Site deleted", response)
 }
 
 // =====================================================================================================================
 
+// SiteListQuery returns a query that joins sites with their customer,
+// producing flattened rows that scan directly into SiteResponse
+func SiteListQuery(bmsDB *devicesdb.BMS_DB) *gorm.DB {
+	return bmsDB.DB.Table("sites").
+		Select("sites.id, sites.name, customers.id AS customer_id, customers.name AS customer_name, " +
+			"sites.address, sites.latitude, sites.longitude, sites.timezone").
+		Joins("JOIN customers ON customers.id = sites.customer_id AND customers.deleted_at IS NULL").
+		Where("sites.deleted_at IS NULL").
+		Order("sites.name")
+}
+
+// siteListFilters are the query parameters the site lists can be filtered on by equality
+var siteListFilters = []string{"timezone"}
+
+// filterSiteList narrows the site list query to the timezone query parameter, to the sites whose
+// name contains the name_contains query parameter and to the sites inside the bbox query
+// parameter, given as min_longitude,min_latitude,max_longitude,max_latitude
+func filterSiteList(c *gin.Context, query *gorm.DB) (*gorm.DB, error) {
+	for _, param := range siteListFilters {
+		if value := strings.TrimSpace(c.Query(param)); value != "" {
+			query = query.Where("sites."+param+" = ?", value)
+		}
+	}
+
+	if name := strings.TrimSpace(c.Query("name_contains")); name != "" {
+		query = query.Where("sites.name LIKE ?", "%"+likeEscaper.Replace(name)+"%")
+	}
+
+	if bbox := c.Query("bbox"); bbox != "" {
+		parts := strings.Split(bbox, ",")
+		if len(parts) != 4 {
+			return nil, errors.New("bbox must be min_longitude,min_latitude,max_longitude,max_latitude")
+		}
+
+		var bounds [4]float64
+		for i, part := range parts {
+			value, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+			if err != nil {
+				return nil, errors.New("bbox must be min_longitude,min_latitude,max_longitude,max_latitude")
+			}
+			bounds[i] = value
+		}
+		if bounds[0] > bounds[2] || bounds[1] > bounds[3] {
+			return nil, errors.New("bbox minimums must not exceed its maximums")
+		}
+
+		query = query.Where("sites.longitude BETWEEN ? AND ? AND sites.latitude BETWEEN ? AND ?", bounds[0], bounds[2], bounds[1], bounds[3])
+	}
+
+	return query, nil
+}
+
+// invalidSiteLocation returns why the address, coordinates or timezone of a site are invalid, or an
+// empty string if they are valid. The coordinates are set together or not at all, and the timezone
+// must be an IANA zone name.
+func invalidSiteLocation(address string, latitude, longitude *float64, timezone string) string {
+	if len(address) > maxAddressLength {
+		return fmt.Sprintf("Address must be at most %d characters", maxAddressLength)
+	}
+
+	if (latitude == nil) != (longitude == nil) {
+		return "Latitude and longitude must be set together"
+	}
+	if latitude != nil && (*latitude < -90 || *latitude > 90) {
+		return "Latitude must be between -90 and 90"
+	}
+	if longitude != nil && (*longitude < -180 || *longitude > 180) {
+		return "Longitude must be between -180 and 180"
+	}
+
+	if timezone != "" {
+		if _, err := time.LoadLocation(timezone); err != nil || timezone == "Local" {
+			return "Timezone must be an IANA timezone name, e.g. Africa/Johannesburg"
+		}
+	}
+
+	return ""
+}
+
+// siteLocationUpdates returns the columns the update request changes the location of a site with
+func siteLocationUpdates(body SiteUpdateRequest) map[string]any {
+	updates := map[string]any{}
+	if body.Address != nil {
+		updates["address"] = *body.Address
+	}
+	if body.Latitude != nil || body.Longitude != nil {
+		updates["latitude"] = body.Latitude
+		updates["longitude"] = body.Longitude
+	}
+	if body.Timezone != nil {
+		updates["timezone"] = *body.Timezone
+	}
+	return updates
+}
+
+// invalidBulkSite returns why a site of a bulk request cannot be created, or an empty string if it
+// can. Names seen earlier in the request and names of active sites of the customer are taken.
+func invalidBulkSite(site SiteRequest, seen map[string]bool, existing map[string]*models.Site) string {
+	if site.Name == "" {
+		return "Name field is required"
+	}
+	if seen[site.Name] {
+		return "The name is given more than once"
+	}
+	if found, ok := existing[site.Name]; ok && !found.DeletedAt.Valid {
+		return "The customer already has a site with this name"
+	}
+	return invalidSiteLocation(site.Address, site.Latitude, site.Longitude, site.Timezone)
+}
+
+// restoreSite restores a deleted site with the location of the request
+func restoreSite(db *gorm.DB, site *models.Site, body SiteRequest) error {
+	now := time.Now()
+	site.DeletedAt = gorm.DeletedAt{}
+	site.CreatedAt, site.UpdatedAt = now, now
+	site.Address, site.Latitude, site.Longitude, site.Timezone = body.Address, body.Latitude, body.Longitude, body.Timezone
+
+	return db.Unscoped().Save(site).Error
+}
+
+// siteFromRequest returns the site the request creates for the customer
+func siteFromRequest(body SiteRequest, customerID uuid.UUID) models.Site {
+	return models.Site{
+		Name:       body.Name,
+		CustomerID: customerID,
+		Address:    body.Address,
+		Latitude:   body.Latitude,
+		Longitude:  body.Longitude,
+		Timezone:   body.Timezone,
+	}
+}
+
+// newSiteResponse returns the site as it is written in responses
+func newSiteResponse(site models.Site, customer models.Customer) SiteResponse {
+	return SiteResponse{
+		ID:           site.ID,
+		Name:         site.Name,
+		CustomerID:   customer.ID,
+		CustomerName: customer.Name,
+		Address:      site.Address,
+		Latitude:     site.Latitude,
+		Longitude:    site.Longitude,
+		Timezone:     site.Timezone,
+	}
+}
+
 // Fetch a site by ID and preload the associated Customer
 func FetchSiteByID(bmsDB *devicesdb.BMS_DB, id string) (*models.Site, error) {
 	var site models.Site
@@ -300,10 +844,158 @@ func FetchSiteByID(bmsDB *devicesdb.BMS_DB, id string) (*models.Site, error) {
 	return &site, nil
 }
 
-// Fetch a site by Name (including soft-deleted records)
-func FetchSiteByName(bmsDB *devicesdb.BMS_DB, name string) (*models.Site, error) {
+// fetchReadableSite fetches the site of the request, checking that the requester is an admin or
+// its customer. It writes the error response and returns false when the site cannot be served.
+func fetchReadableSite(c *gin.Context) (*models.Site, *devicesdb.BMS_DB, bool) {
+	siteID := c.Param("site_id")
+	if !serverutils.IsValidUUID(siteID) {
+		serverutils.WriteError(c, 400, "Invalid site ID", "Invalid UUID format")
+		return nil, nil, false
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return nil, nil, false
+	}
+
+	site, err := FetchSiteByID(bmsDB, siteID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 404, "Site not found", "No site found with the given ID")
+		return nil, nil, false
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch site", err.Error())
+		return nil, nil, false
+	}
+
+	if c.GetString("role") != "admin" && c.GetString("customer_id") != site.CustomerID.String() {
+		serverutils.WriteError(c, 403, "Forbidden", "You are not authorized to access this site")
+		return nil, nil, false
+	}
+
+	return site, bmsDB, true
+}
+
+// errSiteDeleted is returned when attaching to a soft-deleted site
+var errSiteDeleted = errors.New("site is deleted")
+
+// fetchAttachableSite fetches the site devices are attached to, with its customer. Soft-deleted
+// sites are found too, failing with errSiteDeleted rather than as missing, and sites of a
+// soft-deleted customer fail with errCustomerDeleted.
+func fetchAttachableSite(bmsDB *devicesdb.BMS_DB, id string) (*models.Site, error) {
+	var site models.Site
+	if err := bmsDB.DB.Unscoped().First(&site, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	if site.DeletedAt.Valid {
+		return nil, errSiteDeleted
+	}
+
+	customer, err := fetchAttachableCustomer(bmsDB, site.CustomerID.String())
+	if err != nil {
+		return nil, err
+	}
+	site.Customer = *customer
+	return &site, nil
+}
+
+// writeAttachError writes the response for a failed fetch of the customer or site being attached
+// to, other than it not being found
+func writeAttachError(c *gin.Context, err error, msg string) {
+	switch {
+	case errors.Is(err, errCustomerDeleted):
+		serverutils.WriteError(c, 422, "Customer is deleted", "The customer has been deleted, nothing can be attached to it")
+	case errors.Is(err, errSiteDeleted):
+		serverutils.WriteError(c, 422, "Site is deleted", "The site has been deleted, restore it before attaching devices to it")
+	default:
+		serverutils.WriteError(c, 500, msg, err.Error())
+	}
+}
+
+// errSiteHasDevices is returned when deleting a site with devices without cascading to them
+var errSiteHasDevices = errors.New("site has devices")
+
+// errSiteNameTaken is returned when a site would get the name of another site of its customer
+var errSiteNameTaken = errors.New("site name already exists for customer")
+
+// siteMoveConflict is returned when devices of a site keep it from moving to another customer
+type siteMoveConflict struct {
+	reason  string
+	devices []string
+}
+
+func (e *siteMoveConflict) Error() string {
+	return e.reason + ": " + strings.Join(e.devices, ", ")
+}
+
+// moveSite moves the site with its devices and controllers to the customer, revoking the site tokens of the previous
+// customer. The move is refused while a device of the site depends on a device on another site, or,
+// when serial numbers are scoped per customer, while the customer already has a device with the
+// serial number of one of the site's devices.
+func moveSite(tx *gorm.DB, site *models.Site, customer *models.Customer) error {
+	var edges []struct {
+		Upstream   string
+		Downstream string
+	}
+	if err := tx.Model(&models.DeviceDependency{}).
+		Select("upstream.device_serial_number AS upstream, downstream.device_serial_number AS downstream").
+		Joins("JOIN devices AS upstream ON upstream.id = device_dependencies.upstream_device_id").
+		Joins("JOIN devices AS downstream ON downstream.id = device_dependencies.downstream_device_id").
+		Where("(upstream.site_id = ? AND downstream.site_id <> ?) OR (downstream.site_id = ? AND upstream.site_id <> ?)",
+			site.ID, site.ID, site.ID, site.ID).
+		Scan(&edges).Error; err != nil {
+		return err
+	}
+	if len(edges) > 0 {
+		linked := make([]string, len(edges))
+		for i, edge := range edges {
+			linked[i] = edge.Upstream + " -> " + edge.Downstream
+		}
+		slices.Sort(linked)
+		return &siteMoveConflict{reason: "Devices depend on devices on other sites, remove the dependencies first", devices: linked}
+	}
+
+	// Deleted devices keep their serial number, so they are checked as well
+	if deviceSerialScope == models.SerialScopeCustomer {
+		var taken []string
+		if err := tx.Unscoped().Model(&models.Device{}).
+			Where("customer_id = ? AND device_serial_number IN (?)", customer.ID,
+				tx.Unscoped().Model(&models.Device{}).Select("device_serial_number").Where("site_id = ?", site.ID)).
+			Distinct().
+			Pluck("device_serial_number", &taken).Error; err != nil {
+			return err
+		}
+		if len(taken) > 0 {
+			slices.Sort(taken)
+			return &siteMoveConflict{reason: "The customer already has devices with these serial numbers", devices: taken}
+		}
+	}
+
+	if err := tx.Model(site).Update("customer_id", customer.ID).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Unscoped().Model(&models.Device{}).Where("site_id = ?", site.ID).Update("customer_id", customer.ID).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Model(&models.Controller{}).Where("site_id = ?", site.ID).Update("customer_id", customer.ID).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Where("site_id = ?", site.ID).Delete(&models.AuthToken{}).Error; err != nil {
+		return err
+	}
+
+	site.CustomerID = customer.ID
+	site.Customer = *customer
+	return nil
+}
+
+// Fetch a site of the customer by Name (including soft-deleted records). Site names are unique per customer.
+func FetchSiteByName(bmsDB *devicesdb.BMS_DB, customerID uuid.UUID, name string) (*models.Site, error) {
 	var site models.Site
-	result := bmsDB.DB.Unscoped().Where("name = ?", name).First(&site)
+	result := bmsDB.DB.Unscoped().Where("customer_id = ? AND name = ?", customerID, name).First(&site)
 	if result.Error != nil {
 		return nil, result.Error
 	}
@@ -0,0 +1,408 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/internal/timefmt"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"gorm.io/gorm"
+)
+
+type CustomerDeviceCount struct {
+	CustomerID   uuid.UUID `json:"customer_id"`
+	CustomerName string    `json:"customer_name"`
+	Devices      int       `json:"devices"`
+}
+
+// SiteDeviceCount counts the devices of a site. HealthScore is the latest health score of the
+// site, which is missing until the site has been scored.
+type SiteDeviceCount struct {
+	SiteID      uuid.UUID `json:"site_id"`
+	SiteName    string    `json:"site_name"`
+	CustomerID  uuid.UUID `json:"customer_id"`
+	Devices     int       `json:"devices"`
+	HealthScore *float64  `json:"health_score"`
+}
+
+type DeviceTypeCount struct {
+	DeviceType string `json:"device_type"`
+	Devices    int    `json:"devices"`
+}
+
+type GatewayDeviceCount struct {
+	Gateway string `json:"gateway"`
+	Devices int    `json:"devices"`
+}
+
+type DeviceStatsResponse struct {
+	Total        int                   `json:"total"`
+	ByCustomer   []CustomerDeviceCount `json:"by_customer"`
+	BySite       []SiteDeviceCount     `json:"by_site"`
+	ByDeviceType []DeviceTypeCount     `json:"by_device_type"`
+	ByGateway    []GatewayDeviceCount  `json:"by_gateway"`
+}
+
+// CustomerStatsResponse is an overview of a customer. LastActivity is the latest heartbeat of any of
+// its devices and LastApiUsageDay the latest day its tokens were used, both missing if there was none.
+type CustomerStatsResponse struct {
+	CustomerID      uuid.UUID         `json:"customer_id"`
+	CustomerName    string            `json:"customer_name"`
+	Sites           int64             `json:"sites"`
+	Devices         int               `json:"devices"`
+	ByDeviceType    []DeviceTypeCount `json:"by_device_type"`
+	Tokens          int64             `json:"tokens"`
+	LastActivity    *timefmt.Time     `json:"last_activity"`
+	LastApiUsageDay *string           `json:"last_api_usage_day"`
+}
+
+// defaultFleetHistoryDays is the number of days of fleet history fetched when no range is given
+const defaultFleetHistoryDays = 30
+
+// maxFleetHistoryDays is the longest range of fleet history fetched in one request
+const maxFleetHistoryDays = 366
+
+// FleetHistoryDay is the fleet composition recorded on a day
+type FleetHistoryDay struct {
+	Day          string                `json:"day"`
+	Devices      int                   `json:"devices"`
+	ByCustomer   []CustomerDeviceCount `json:"by_customer"`
+	ByDeviceType []DeviceTypeCount     `json:"by_device_type"`
+}
+
+// FleetHistoryResponse lists the recorded days of a range, oldest first. Days without a snapshot,
+// e.g. while the server was down, are left out.
+type FleetHistoryResponse struct {
+	From string            `json:"from"`
+	To   string            `json:"to"`
+	Days []FleetHistoryDay `json:"days"`
+}
+
+// fleetHistoryRow is a recorded device count of a customer and device type on a day
+type fleetHistoryRow struct {
+	Day          time.Time
+	CustomerID   uuid.UUID
+	CustomerName string
+	DeviceType   string
+	Devices      int
+}
+
+// deviceStatsRow is a device count at the finest grouping, which the other groupings are rolled up from
+type deviceStatsRow struct {
+	CustomerID   uuid.UUID
+	CustomerName string
+	SiteID       uuid.UUID
+	SiteName     string
+	DeviceType   string
+	Gateway      string
+	Devices      int
+}
+
+// Route: GET /stats/devices
+// Count devices by customer, site, device type and gateway. Non-admins only count their own devices.
+func DeviceStats(c *gin.Context) {
+	role := c.GetString("role")
+	requesterID := c.GetString("customer_id")
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	query := bmsDB.DB.Table("devices").
+		Select(`customers.id AS customer_id, customers.name AS customer_name, sites.id AS site_id,
+			sites.name AS site_name, devices.device_type, devices.gateway, COUNT(*) AS devices`).
+		Joins("JOIN sites ON sites.id = devices.site_id AND sites.deleted_at IS NULL").
+		Joins("JOIN customers ON customers.id = sites.customer_id AND customers.deleted_at IS NULL").
+		Where("devices.deleted_at IS NULL").
+		Group("customers.id, customers.name, sites.id, sites.name, devices.device_type, devices.gateway")
+
+	query = filterDeviceList(c, query)
+
+	// Non-admins only count their own devices
+	if role != "admin" {
+		query = query.Where("sites.customer_id = ?", requesterID)
+	}
+
+	var rows []deviceStatsRow
+	if err := query.Scan(&rows).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to count devices", err.Error())
+		return
+	}
+
+	response := rollUpDeviceStats(rows)
+
+	siteIDs := make([]uuid.UUID, len(response.BySite))
+	for i, site := range response.BySite {
+		siteIDs[i] = site.SiteID
+	}
+	scores, err := latestSiteHealthScores(bmsDB, siteIDs)
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch site health", err.Error())
+		return
+	}
+	for i := range response.BySite {
+		if score, ok := scores[response.BySite[i].SiteID]; ok {
+			response.BySite[i].HealthScore = &score
+		}
+	}
+
+	serverutils.WriteJSON(c, 200, "Device statistics fetched", response)
+}
+
+// Route: GET /customers/:customer_id/stats
+// Fetch an overview of a customer: its site count, device counts by type, token count and last activity
+func CustomerStats(c *gin.Context) {
+	role := c.GetString("role")
+	requesterID := c.GetString("customer_id")
+	customerID := c.Param("customer_id")
+
+	// Validate the customer ID
+	if !serverutils.IsValidUUID(customerID) {
+		serverutils.WriteError(c, 400, "Invalid customer ID", "Invalid UUID format")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	customer, err := FetchCustomerByID(bmsDB, customerID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 404, "Customer not found", "No customer found with the given ID")
+		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch customer", err.Error())
+		return
+	}
+
+	// Check if the requester is an admin or the customer owner
+	if role != "admin" && requesterID != customer.ID.String() {
+		serverutils.WriteError(c, 403, "Forbidden", "You are not authorized to access this customer's statistics")
+		return
+	}
+
+	response := CustomerStatsResponse{CustomerID: customer.ID, CustomerName: customer.Name, ByDeviceType: []DeviceTypeCount{}}
+
+	if err := bmsDB.DB.Model(&models.Site{}).Where("customer_id = ?", customer.ID).Count(&response.Sites).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to count sites", err.Error())
+		return
+	}
+
+	if err := bmsDB.DB.Table("devices").
+		Select("devices.device_type, COUNT(*) AS devices").
+		Joins("JOIN sites ON sites.id = devices.site_id AND sites.deleted_at IS NULL").
+		Where("sites.customer_id = ? AND devices.deleted_at IS NULL", customer.ID).
+		Group("devices.device_type").
+		Order("devices.device_type").
+		Scan(&response.ByDeviceType).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to count devices", err.Error())
+		return
+	}
+	for _, deviceType := range response.ByDeviceType {
+		response.Devices += deviceType.Devices
+	}
+
+	if err := bmsDB.DB.Model(&models.AuthToken{}).Where("customer_id = ?", customer.ID).Count(&response.Tokens).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to count tokens", err.Error())
+		return
+	}
+
+	var activity struct {
+		LastSeen *time.Time
+	}
+	if err := bmsDB.DB.Table("device_statuses").
+		Select("MAX(device_statuses.last_seen) AS last_seen").
+		Joins("JOIN devices ON devices.id = device_statuses.device_id AND devices.deleted_at IS NULL").
+		Joins("JOIN sites ON sites.id = devices.site_id AND sites.deleted_at IS NULL").
+		Where("sites.customer_id = ? AND device_statuses.deleted_at IS NULL", customer.ID).
+		Scan(&activity).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch last activity", err.Error())
+		return
+	}
+	response.LastActivity = timefmt.NewPtr(activity.LastSeen)
+
+	var usage struct {
+		Day *time.Time
+	}
+	if err := bmsDB.DB.Model(&models.CustomerApiUsage{}).
+		Select("MAX(day) AS day").
+		Where("customer_id = ?", customer.ID).
+		Scan(&usage).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch API usage", err.Error())
+		return
+	}
+	if usage.Day != nil {
+		day := usage.Day.Format(time.DateOnly)
+		response.LastApiUsageDay = &day
+	}
+
+	serverutils.WriteJSON(c, 200, "Customer statistics fetched", response)
+}
+
+// Route: GET /admin/stats/history (Admin Only)
+// Fetch the daily snapshots of the fleet composition from ?from= to ?to= (the last 30 days by
+// default), optionally narrowed to one ?customer_id= and ?device_type=
+func FleetHistory(c *gin.Context) {
+	to := time.Now().UTC().Truncate(24 * time.Hour)
+	if value := c.Query("to"); value != "" {
+		parsed, err := time.Parse(time.DateOnly, value)
+		if err != nil {
+			serverutils.WriteError(c, 400, "Invalid date", "to must be a date in YYYY-MM-DD format")
+			return
+		}
+		to = parsed
+	}
+
+	from := to.AddDate(0, 0, -(defaultFleetHistoryDays - 1))
+	if value := c.Query("from"); value != "" {
+		parsed, err := time.Parse(time.DateOnly, value)
+		if err != nil {
+			serverutils.WriteError(c, 400, "Invalid date", "from must be a date in YYYY-MM-DD format")
+			return
+		}
+		from = parsed
+	}
+
+	if from.After(to) || to.Sub(from) >= maxFleetHistoryDays*24*time.Hour {
+		serverutils.WriteError(c, 400, "Invalid date range", fmt.Sprintf("from must be on or before to and the range at most %d days", maxFleetHistoryDays))
+		return
+	}
+
+	customerID := c.Query("customer_id")
+	if customerID != "" && !serverutils.IsValidUUID(customerID) {
+		serverutils.WriteError(c, 400, "Invalid customer ID", "Invalid UUID format")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	// Customers deleted since keep their name in the history
+	query := bmsDB.DB.Model(&models.FleetSnapshot{}).
+		Select("fleet_snapshots.day, fleet_snapshots.customer_id, COALESCE(customers.name, '') AS customer_name, fleet_snapshots.device_type, fleet_snapshots.devices").
+		Joins("LEFT JOIN customers ON customers.id = fleet_snapshots.customer_id").
+		Where("fleet_snapshots.day BETWEEN ? AND ?", from, to).
+		Order("fleet_snapshots.day")
+	if customerID != "" {
+		query = query.Where("fleet_snapshots.customer_id = ?", customerID)
+	}
+	if deviceType := c.Query("device_type"); deviceType != "" {
+		query = query.Where("fleet_snapshots.device_type = ?", deviceType)
+	}
+
+	var rows []fleetHistoryRow
+	if err := query.Scan(&rows).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch fleet history", err.Error())
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Fleet history fetched", FleetHistoryResponse{
+		From: from.Format(time.DateOnly),
+		To:   to.Format(time.DateOnly),
+		Days: rollUpFleetHistory(rows),
+	})
+}
+
+// =====================================================================================================================
+
+// rollUpDeviceStats sums the grouped device counts per customer, site, device type and gateway,
+// ordering each grouping by name
+func rollUpDeviceStats(rows []deviceStatsRow) DeviceStatsResponse {
+	customers := make(map[uuid.UUID]*CustomerDeviceCount)
+	sites := make(map[uuid.UUID]*SiteDeviceCount)
+	deviceTypes := make(map[string]int)
+	gateways := make(map[string]int)
+
+	response := DeviceStatsResponse{}
+	for _, row := range rows {
+		response.Total += row.Devices
+
+		if customer, ok := customers[row.CustomerID]; ok {
+			customer.Devices += row.Devices
+		} else {
+			customers[row.CustomerID] = &CustomerDeviceCount{CustomerID: row.CustomerID, CustomerName: row.CustomerName, Devices: row.Devices}
+		}
+
+		if site, ok := sites[row.SiteID]; ok {
+			site.Devices += row.Devices
+		} else {
+			sites[row.SiteID] = &SiteDeviceCount{SiteID: row.SiteID, SiteName: row.SiteName, CustomerID: row.CustomerID, Devices: row.Devices}
+		}
+
+		deviceTypes[row.DeviceType] += row.Devices
+		gateways[row.Gateway] += row.Devices
+	}
+
+	response.ByCustomer = make([]CustomerDeviceCount, 0, len(customers))
+	for _, customer := range customers {
+		response.ByCustomer = append(response.ByCustomer, *customer)
+	}
+	sort.Slice(response.ByCustomer, func(i, j int) bool {
+		return response.ByCustomer[i].CustomerName < response.ByCustomer[j].CustomerName
+	})
+
+	response.BySite = make([]SiteDeviceCount, 0, len(sites))
+	for _, site := range sites {
+		response.BySite = append(response.BySite, *site)
+	}
+	sort.Slice(response.BySite, func(i, j int) bool {
+		return response.BySite[i].SiteName < response.BySite[j].SiteName
+	})
+
+	response.ByDeviceType = make([]DeviceTypeCount, 0, len(deviceTypes))
+	for deviceType, devices := range deviceTypes {
+		response.ByDeviceType = append(response.ByDeviceType, DeviceTypeCount{DeviceType: deviceType, Devices: devices})
+	}
+	sort.Slice(response.ByDeviceType, func(i, j int) bool {
+		return response.ByDeviceType[i].DeviceType < response.ByDeviceType[j].DeviceType
+	})
+
+	response.ByGateway = make([]GatewayDeviceCount, 0, len(gateways))
+	for gateway, devices := range gateways {
+		response.ByGateway = append(response.ByGateway, GatewayDeviceCount{Gateway: gateway, Devices: devices})
+	}
+	sort.Slice(response.ByGateway, func(i, j int) bool {
+		return response.ByGateway[i].Gateway < response.ByGateway[j].Gateway
+	})
+
+	return response
+}
+
+// rollUpFleetHistory sums the recorded device counts of each day per customer and device type. The
+// rows must be ordered by day.
+func rollUpFleetHistory(rows []fleetHistoryRow) []FleetHistoryDay {
+	days := []FleetHistoryDay{}
+	for start := 0; start < len(rows); {
+		end := start
+		for end < len(rows) && rows[end].Day.Equal(rows[start].Day) {
+			end++
+		}
+
+		stats := make([]deviceStatsRow, 0, end-start)
+		for _, row := range rows[start:end] {
+			stats = append(stats, deviceStatsRow{CustomerID: row.CustomerID, CustomerName: row.CustomerName, DeviceType: row.DeviceType, Devices: row.Devices})
+		}
+		rolled := rollUpDeviceStats(stats)
+
+		days = append(days, FleetHistoryDay{
+			Day:          rows[start].Day.Format(time.DateOnly),
+			Devices:      rolled.Total,
+			ByCustomer:   rolled.ByCustomer,
+			ByDeviceType: rolled.ByDeviceType,
+		})
+		start = end
+	}
+	return days
+}
@@ -0,0 +1,320 @@
+package handlers
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/johandrevandeventer/devices-api-server/internal/presence"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/internal/timefmt"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// maxStatusDetailLength is the length of the device status detail column
+const maxStatusDetailLength = 255
+
+// maxVersionLength is the length of the device firmware version and hardware revision columns
+const maxVersionLength = 64
+
+// deviceStates lists the states a gateway can report for a device
+var deviceStates = map[string]bool{
+	models.DeviceStatusOnline:  true,
+	models.DeviceStatusOffline: true,
+	models.DeviceStatusFault:   true,
+}
+
+type DeviceStatusRequest struct {
+	State            string             `json:"state"`
+	Detail           string             `json:"detail"`
+	FirmwareVersion  string             `json:"firmware_version"`
+	HardwareRevision string             `json:"hardware_revision"`
+	Readings         map[string]float64 `json:"readings"`
+}
+
+type DeviceStatusResponse struct {
+	DeviceSerialNumber string       `json:"device_serial_number"`
+	State              string       `json:"state"`
+	Detail             string       `json:"detail"`
+	LastSeen           timefmt.Time `json:"last_seen"`
+}
+
+// Route: POST /devices/:device_serial_number/status
+// Record a heartbeat for a device along with its online, offline or fault state. The firmware version
+// and hardware revision of the device are updated when reported, as are the last readings of the
+// points given in readings, keyed by point name.
+func DeviceStatusReport(c *gin.Context) {
+	serialNumber := c.Param("device_serial_number")
+
+	var body DeviceStatusRequest
+	if err := c.BindJSON(&body); err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", "Invalid JSON format")
+		return
+	}
+
+	if body.State == "" {
+		body.State = models.DeviceStatusOnline
+	}
+	if !deviceStates[body.State] {
+		serverutils.WriteError(c, 400, "Invalid state", "State must be online, offline or fault")
+		return
+	}
+
+	if len(body.Detail) > maxStatusDetailLength {
+		serverutils.WriteError(c, 400, "Invalid detail", "Detail must be at most 255 characters")
+		return
+	}
+
+	body.FirmwareVersion = strings.TrimSpace(body.FirmwareVersion)
+	body.HardwareRevision = strings.TrimSpace(body.HardwareRevision)
+	if len(body.FirmwareVersion) > maxVersionLength || len(body.HardwareRevision) > maxVersionLength {
+		serverutils.WriteError(c, 400, "Invalid version", "Firmware version and hardware revision must be at most 64 characters")
+		return
+	}
+
+	if len(body.Readings) > maxReadingsPerReport {
+		serverutils.WriteError(c, 400, "Invalid readings", "A report can carry at most 1000 readings")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	device, ok := fetchReportingDevice(c, bmsDB, serialNumber)
+	if !ok {
+		return
+	}
+
+	// Only the reported versions that changed are written, so most heartbeats leave the device alone
+	versions := map[string]any{}
+	if body.FirmwareVersion != "" && body.FirmwareVersion != device.FirmwareVersion {
+		versions["firmware_version"] = body.FirmwareVersion
+	}
+	if body.HardwareRevision != "" && body.HardwareRevision != device.HardwareRevision {
+		versions["hardware_revision"] = body.HardwareRevision
+	}
+
+	status := models.DeviceStatus{
+		DeviceID:           device.ID,
+		DeviceSerialNumber: device.DeviceSerialNumber,
+		LastSeen:           time.Now().UTC(),
+		State:              body.State,
+		Detail:             body.Detail,
+	}
+
+	err := bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		// A device has a single status row which every report overwrites
+		if err := tx.Omit("Device").Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "device_id"}},
+			DoUpdates: clause.AssignmentColumns([]string{"last_seen", "state", "detail", "updated_at", "deleted_at"}),
+		}).Create(&status).Error; err != nil {
+			return err
+		}
+
+		if len(versions) > 0 {
+			if err := tx.Model(&models.Device{}).Where("id = ?", device.ID).Updates(versions).Error; err != nil {
+				return err
+			}
+		}
+
+		if len(body.Readings) > 0 {
+			readings, err := registeredReadings(c, tx, device, body.Readings, status.LastSeen)
+			if err != nil {
+				return err
+			}
+			if err := rollupEnergy(tx, device, readings); err != nil {
+				return err
+			}
+			if err := saveReadings(tx, readings); err != nil {
+				return err
+			}
+		}
+
+		// Record the transition straight away instead of waiting for the next status sample
+		var latest models.DeviceStatusTransition
+		err := tx.Where("device_id = ?", device.ID).Order("changed_at DESC").First(&latest).Error
+		if err == nil && latest.Status == status.State {
+			return nil
+		} else if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		}
+
+		return tx.Create(&models.DeviceStatusTransition{
+			DeviceID:           device.ID,
+			DeviceSerialNumber: device.DeviceSerialNumber,
+			Status:             status.State,
+			ChangedAt:          status.LastSeen,
+		}).Error
+	})
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to record device status", err.Error())
+		return
+	}
+
+	if len(versions) > 0 {
+		recordDeviceChanges(c, device.SiteID)
+	}
+	presence.Seen(device.Gateway, status.LastSeen)
+	TouchGateway(bmsDB.DB, device.GatewayID, status.LastSeen)
+
+	serverutils.WriteJSON(c, 200, "Device status recorded", newDeviceStatusResponse(status))
+}
+
+// Route: GET /devices/:device_serial_number/status
+// Fetch the last reported status of a device
+func DeviceStatusFetch(c *gin.Context) {
+	serialNumber := c.Param("device_serial_number")
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	device, ok := fetchReportingDevice(c, bmsDB, serialNumber)
+	if !ok {
+		return
+	}
+
+	var status models.DeviceStatus
+	err := bmsDB.DB.Where("device_id = ?", device.ID).First(&status).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 404, "Device status not found", "No status has been reported for the given device")
+		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch device status", err.Error())
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Device status fetched", newDeviceStatusResponse(status))
+}
+
+type DeviceStatusTransitionResponse struct {
+	Status    string       `json:"status"`
+	ChangedAt timefmt.Time `json:"changed_at"`
+}
+
+// Route: GET /devices/:device_serial_number/status/history
+// Fetch the status transitions of a device, newest first. Supports ?from= and ?to= (RFC 3339) and
+// pagination, returning the first page when no page is given.
+func DeviceStatusHistory(c *gin.Context) {
+	serialNumber := c.Param("device_serial_number")
+
+	from, err := parseTimeQuery(c, "from")
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid from", err.Error())
+		return
+	}
+
+	to, err := parseTimeQuery(c, "to")
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid to", err.Error())
+		return
+	}
+
+	if !from.IsZero() && !to.IsZero() && !from.Before(to) {
+		serverutils.WriteError(c, 400, "Invalid time range", "from must be before to")
+		return
+	}
+
+	pagination, err := serverutils.ParsePagination(c)
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid pagination", err.Error())
+		return
+	}
+
+	// Raw transitions are kept for weeks, so the history is always paginated
+	if pagination == nil {
+		pagination = &serverutils.Pagination{Page: 1, PerPage: serverutils.DefaultPerPage}
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	device, ok := fetchReportingDevice(c, bmsDB, serialNumber)
+	if !ok {
+		return
+	}
+
+	query := bmsDB.DB.Model(&models.DeviceStatusTransition{}).
+		Select("status, changed_at").
+		Where("device_id = ?", device.ID).
+		Order("changed_at DESC")
+
+	if !from.IsZero() {
+		query = query.Where("changed_at >= ?", from)
+	}
+	if !to.IsZero() {
+		query = query.Where("changed_at < ?", to)
+	}
+
+	query, err = pagination.Apply(query)
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to count status transitions", err.Error())
+		return
+	}
+
+	response := []DeviceStatusTransitionResponse{}
+	if err := query.Scan(&response).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch status history", err.Error())
+		return
+	}
+
+	serverutils.WriteJSONPage(c, 200, "Device status history fetched", response, pagination)
+}
+
+// =====================================================================================================================
+
+// parseTimeQuery parses an optional RFC 3339 query parameter, returning the zero time if it is not set
+func parseTimeQuery(c *gin.Context, name string) (time.Time, error) {
+	value := c.Query(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errors.New(name + " must be an RFC 3339 timestamp")
+	}
+
+	return parsed.UTC(), nil
+}
+
+// fetchReportingDevice fetches a device that is not deleted and belongs to the requester, writing
+// the error response and returning false otherwise
+func fetchReportingDevice(c *gin.Context, bmsDB *devicesdb.BMS_DB, serialNumber string) (*models.Device, bool) {
+	device, err := lookupDevice(c, bmsDB, serialNumber)
+	if err == nil && device.DeletedAt.Valid {
+		err = gorm.ErrRecordNotFound
+	}
+	if err != nil {
+		writeDeviceLookupError(c, err)
+		return nil, false
+	}
+
+	if c.GetString("role") != "admin" && device.CustomerID.String() != c.GetString("customer_id") {
+		serverutils.WriteError(c, 403, "Forbidden", "You are not authorized to access this customer's devices")
+		return nil, false
+	}
+
+	return device, true
+}
+
+func newDeviceStatusResponse(status models.DeviceStatus) DeviceStatusResponse {
+	return DeviceStatusResponse{
+		DeviceSerialNumber: status.DeviceSerialNumber,
+		State:              status.State,
+		Detail:             status.Detail,
+		LastSeen:           timefmt.New(status.LastSeen),
+	}
+}
@@ -0,0 +1,362 @@
+package handlers
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/internal/tagrules"
+	"github.com/johandrevandeventer/devices-api-server/internal/timefmt"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// tagNameRegex matches the lower-case names tags are stored under
+var tagNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+type DeviceTagsRequest struct {
+	Tags []string `json:"tags"`
+}
+
+type DeviceTagsResponse struct {
+	DeviceSerialNumber string   `json:"device_serial_number"`
+	Tags               []string `json:"tags"`
+}
+
+type TagResponse struct {
+	Name    string `json:"name"`
+	Devices int    `json:"devices"`
+}
+
+type TagRuleRequest struct {
+	Name     string `json:"name"`
+	Tag      string `json:"tag"`
+	Field    string `json:"field"`
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+}
+
+type TagRuleResponse struct {
+	ID        uuid.UUID    `json:"id"`
+	Name      string       `json:"name"`
+	Tag       string       `json:"tag"`
+	Field     string       `json:"field"`
+	Operator  string       `json:"operator"`
+	Value     string       `json:"value"`
+	Devices   int          `json:"devices"`
+	CreatedAt timefmt.Time `json:"created_at"`
+}
+
+// Route: GET /tags (Admin Only)
+// Fetch all tags with the number of devices carrying each
+func TagFetchAll(c *gin.Context) {
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	response := []TagResponse{}
+	err := bmsDB.DB.Table("tags").
+		Select("tags.name, COUNT(devices.id) AS devices").
+		Joins("LEFT JOIN device_tags ON device_tags.tag_id = tags.id").
+		Joins("LEFT JOIN devices ON devices.id = device_tags.device_id AND devices.deleted_at IS NULL").
+		Where("tags.deleted_at IS NULL").
+		Group("tags.name").
+		Order("tags.name").
+		Scan(&response).Error
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch tags", err.Error())
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Tags fetched", response)
+}
+
+// Route: GET /devices/:device_serial_number/tags
+// Fetch the tags of a device
+func DeviceTagFetch(c *gin.Context) {
+	serialNumber := c.Param("device_serial_number")
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	device, ok := fetchReportingDevice(c, bmsDB, serialNumber)
+	if !ok {
+		return
+	}
+
+	writeDeviceTags(c, bmsDB, device, "Tags fetched")
+}
+
+// Route: POST /devices/:device_serial_number/tags (Admin Only)
+// Add tags to a device, creating tags that do not exist yet
+func DeviceTagAdd(c *gin.Context) {
+	serialNumber := c.Param("device_serial_number")
+
+	var body DeviceTagsRequest
+	if err := c.BindJSON(&body); err != nil || len(body.Tags) == 0 {
+		serverutils.WriteError(c, 400, "Invalid request body", "tags must list at least one tag")
+		return
+	}
+
+	names := make([]string, 0, len(body.Tags))
+	for _, tag := range body.Tags {
+		name, ok := normalizeTagName(tag)
+		if !ok {
+			serverutils.WriteError(c, 400, "Invalid tag", "Tags must be 1-64 letters, digits, '-' or '_': "+tag)
+			return
+		}
+		names = append(names, name)
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	device, ok := fetchReportingDevice(c, bmsDB, serialNumber)
+	if !ok {
+		return
+	}
+
+	err := bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		for _, name := range names {
+			var tag models.Tag
+			err := tx.Where("name = ?", name).First(&tag).Error
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				tag = models.Tag{Name: name}
+				err = tx.Create(&tag).Error
+			}
+			if err != nil {
+				return err
+			}
+
+			// Adding a tag the device already has keeps the link, but a tag applied by a rule
+			// becomes a manual tag that the rule no longer removes
+			link := models.DeviceTag{TagID: tag.ID, DeviceID: device.ID, DeviceSerialNumber: device.DeviceSerialNumber}
+			if err := tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "tag_id"}, {Name: "device_id"}},
+				DoUpdates: clause.Assignments(map[string]any{"rule_id": nil}),
+			}).Create(&link).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to add tags", err.Error())
+		return
+	}
+
+	writeDeviceTags(c, bmsDB, device, "Tags added")
+}
+
+// Route: DELETE /devices/:device_serial_number/tags/:tag (Admin Only)
+// Remove a tag from a device
+func DeviceTagRemove(c *gin.Context) {
+	serialNumber := c.Param("device_serial_number")
+
+	name, ok := normalizeTagName(c.Param("tag"))
+	if !ok {
+		serverutils.WriteError(c, 400, "Invalid tag", "Tags must be 1-64 letters, digits, '-' or '_'")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	device, ok := fetchReportingDevice(c, bmsDB, serialNumber)
+	if !ok {
+		return
+	}
+
+	result := bmsDB.DB.
+		Where("device_id = ? AND tag_id IN (?)", device.ID,
+			bmsDB.DB.Model(&models.Tag{}).Select("id").Where("name = ?", name)).
+		Delete(&models.DeviceTag{})
+	if result.Error != nil {
+		serverutils.WriteError(c, 500, "Failed to remove tag", result.Error.Error())
+		return
+	}
+	if result.RowsAffected == 0 {
+		serverutils.WriteError(c, 404, "Tag not found", "The device does not have the given tag")
+		return
+	}
+
+	writeDeviceTags(c, bmsDB, device, "Tag removed")
+}
+
+// Route: GET /tag-rules (Admin Only)
+// Fetch all tag rules with the number of devices each rule currently tags
+func TagRuleFetchAll(c *gin.Context) {
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	response := []TagRuleResponse{}
+	err := bmsDB.DB.Table("tag_rules").
+		Select("tag_rules.id, tag_rules.name, tag_rules.tag, tag_rules.field, tag_rules.operator, tag_rules.value, tag_rules.created_at, COUNT(device_tags.id) AS devices").
+		Joins("LEFT JOIN device_tags ON device_tags.rule_id = tag_rules.id").
+		Where("tag_rules.deleted_at IS NULL").
+		Group("tag_rules.id").
+		Order("tag_rules.name").
+		Scan(&response).Error
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch tag rules", err.Error())
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Tag rules fetched", response)
+}
+
+// Route: POST /tag-rules (Admin Only)
+// Create a rule that keeps its tag on the devices matching its condition. Rules are applied by the
+// scheduler, so the tag appears on matching devices at the next evaluation.
+func TagRuleCreate(c *gin.Context) {
+	var body TagRuleRequest
+	if err := c.BindJSON(&body); err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", err.Error())
+		return
+	}
+
+	name, ok := normalizeTagName(body.Name)
+	if !ok {
+		serverutils.WriteError(c, 400, "Invalid request body", "name must be 1-64 letters, digits, '-' or '_'")
+		return
+	}
+	tag, ok := normalizeTagName(body.Tag)
+	if !ok {
+		serverutils.WriteError(c, 400, "Invalid tag", "Tags must be 1-64 letters, digits, '-' or '_': "+body.Tag)
+		return
+	}
+
+	rule := models.TagRule{
+		Name:     name,
+		Tag:      tag,
+		Field:    strings.TrimSpace(body.Field),
+		Operator: strings.TrimSpace(body.Operator),
+		Value:    strings.TrimSpace(body.Value),
+	}
+	if reason := tagrules.Invalid(rule); reason != "" {
+		serverutils.WriteError(c, 400, "Invalid tag rule", reason)
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var existing int64
+	if err := bmsDB.DB.Model(&models.TagRule{}).Where("name = ?", rule.Name).Count(&existing).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to create tag rule", err.Error())
+		return
+	}
+	if existing > 0 {
+		serverutils.WriteError(c, 400, "Tag rule already exists", "A tag rule with this name already exists")
+		return
+	}
+
+	if err := bmsDB.DB.Create(&rule).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to create tag rule", err.Error())
+		return
+	}
+
+	serverutils.WriteJSON(c, 201, "Tag rule created", newTagRuleResponse(rule, 0))
+}
+
+// Route: DELETE /tag-rules/:rule_id (Admin Only)
+// Delete a tag rule, removing its tag from the devices the rule applied it to
+func TagRuleDelete(c *gin.Context) {
+	ruleID := c.Param("rule_id")
+	if !serverutils.IsValidUUID(ruleID) {
+		serverutils.WriteError(c, 400, "Invalid rule ID", "Invalid UUID format")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var rule models.TagRule
+	var removed int64
+	err := bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&rule, "id = ?", ruleID).Error; err != nil {
+			return err
+		}
+
+		result := tx.Where("rule_id = ?", rule.ID).Delete(&models.DeviceTag{})
+		if result.Error != nil {
+			return result.Error
+		}
+		removed = result.RowsAffected
+
+		// Rules are deleted permanently so their name can be reused
+		return tx.Unscoped().Delete(&rule).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 404, "Tag rule not found", "No tag rule found with the given ID")
+		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to delete tag rule", err.Error())
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Tag rule deleted", newTagRuleResponse(rule, int(removed)))
+}
+
+// =====================================================================================================================
+
+// newTagRuleResponse builds the response for a tag rule tagging the given number of devices
+func newTagRuleResponse(rule models.TagRule, devices int) TagRuleResponse {
+	return TagRuleResponse{
+		ID:        rule.ID,
+		Name:      rule.Name,
+		Tag:       rule.Tag,
+		Field:     rule.Field,
+		Operator:  rule.Operator,
+		Value:     rule.Value,
+		Devices:   devices,
+		CreatedAt: timefmt.New(rule.CreatedAt),
+	}
+}
+
+// normalizeTagName lower-cases the tag and reports whether it is a valid tag name
+func normalizeTagName(tag string) (string, bool) {
+	name := strings.ToLower(strings.TrimSpace(tag))
+	return name, tagNameRegex.MatchString(name)
+}
+
+// writeDeviceTags writes the tags of a device
+func writeDeviceTags(c *gin.Context, bmsDB *devicesdb.BMS_DB, device *models.Device, message string) {
+	response := DeviceTagsResponse{DeviceSerialNumber: device.DeviceSerialNumber, Tags: []string{}}
+	err := bmsDB.DB.Table("device_tags").
+		Joins("JOIN tags ON tags.id = device_tags.tag_id AND tags.deleted_at IS NULL").
+		Where("device_tags.device_id = ?", device.ID).
+		Order("tags.name").
+		Pluck("tags.name", &response.Tags).Error
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch tags", err.Error())
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, message, response)
+}
@@ -0,0 +1,553 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/devicetoken"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"gorm.io/gorm"
+)
+
+type TemplatePoint struct {
+	PointName    string   `json:"point_name"`
+	Protocol     string   `json:"protocol"`
+	ObjectType   string   `json:"object_type,omitempty"`
+	Register     int      `json:"register"`
+	FunctionCode int      `json:"function_code,omitempty"`
+	DataType     string   `json:"data_type,omitempty"`
+	Scale        *float64 `json:"scale,omitempty"`
+	Offset       float64  `json:"offset"`
+	Unit         string   `json:"unit,omitempty"`
+}
+
+type TemplateRequest struct {
+	Name         string          `json:"name"`
+	DeviceType   string          `json:"device_type"`
+	Manufacturer string          `json:"manufacturer"`
+	Model        string          `json:"model"`
+	Description  string          `json:"description"`
+	Points       []TemplatePoint `json:"points"`
+}
+
+type TemplateResponse struct {
+	ID           uuid.UUID       `json:"id"`
+	Name         string          `json:"name"`
+	DeviceType   string          `json:"device_type"`
+	Manufacturer string          `json:"manufacturer,omitempty"`
+	Model        string          `json:"model,omitempty"`
+	Description  string          `json:"description,omitempty"`
+	Points       []TemplatePoint `json:"points"`
+}
+
+type DeviceFromTemplateRequest struct {
+	TemplateID string `json:"template_id"`
+	DeviceRequest
+}
+
+type DeviceFromTemplateResponse struct {
+	DeviceResponse
+	TemplateID uuid.UUID `json:"template_id"`
+	Points     int       `json:"points"`
+}
+
+// Route: POST /admin/templates
+// Create a device template
+func TemplateCreate(c *gin.Context) {
+	var body TemplateRequest
+	if err := c.BindJSON(&body); err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", "Invalid JSON format")
+		return
+	}
+
+	points, err := parseTemplateRequest(&body)
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid template", err.Error())
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var count int64
+	if err := bmsDB.DB.Model(&models.DeviceTemplate{}).Where("name = ?", body.Name).Count(&count).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch templates", err.Error())
+		return
+	}
+	if count > 0 {
+		serverutils.WriteError(c, 400, "Template already exists", "A template with this name already exists")
+		return
+	}
+
+	template := models.DeviceTemplate{
+		Name:         body.Name,
+		DeviceType:   body.DeviceType,
+		Manufacturer: body.Manufacturer,
+		ModelNumber:  body.Model,
+		Description:  body.Description,
+	}
+
+	err = bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&template).Error; err != nil {
+			return err
+		}
+		return createTemplatePoints(tx, template.ID, points)
+	})
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to create template", err.Error())
+		return
+	}
+
+	serverutils.WriteJSON(c, 201, "Template created", newTemplateResponse(template, points))
+}
+
+// Route: GET /admin/templates
+// Fetch all device templates
+func TemplateFetchAll(c *gin.Context) {
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var templates []models.DeviceTemplate
+	if err := bmsDB.DB.Order("name").Find(&templates).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch templates", err.Error())
+		return
+	}
+
+	var points []models.DeviceTemplatePoint
+	if err := bmsDB.DB.Order("point_name").Find(&points).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch template points", err.Error())
+		return
+	}
+
+	templatePoints := make(map[uuid.UUID][]models.DeviceTemplatePoint)
+	for _, point := range points {
+		templatePoints[point.TemplateID] = append(templatePoints[point.TemplateID], point)
+	}
+
+	response := make([]TemplateResponse, len(templates))
+	for i, template := range templates {
+		response[i] = newTemplateResponse(template, templatePoints[template.ID])
+	}
+
+	serverutils.WriteJSON(c, 200, "Templates fetched", response)
+}
+
+// Route: GET /admin/templates/:template_id
+// Fetch a device template by ID
+func TemplateFetchByID(c *gin.Context) {
+	templateID := c.Param("template_id")
+
+	if !serverutils.IsValidUUID(templateID) {
+		serverutils.WriteError(c, 400, "Invalid template ID", "Invalid UUID format")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	template, points, err := FetchTemplateByID(bmsDB, templateID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 404, "Template not found", "No template found with the given ID")
+		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch template", err.Error())
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Template fetched", newTemplateResponse(*template, points))
+}
+
+// Route: PUT /admin/templates/:template_id
+// Replace a device template and its default points.
+// Devices already created from the template are not changed.
+func TemplateUpdate(c *gin.Context) {
+	templateID := c.Param("template_id")
+
+	if !serverutils.IsValidUUID(templateID) {
+		serverutils.WriteError(c, 400, "Invalid template ID", "Invalid UUID format")
+		return
+	}
+
+	var body TemplateRequest
+	if err := c.BindJSON(&body); err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", "Invalid JSON format")
+		return
+	}
+
+	points, err := parseTemplateRequest(&body)
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid template", err.Error())
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	template, _, err := FetchTemplateByID(bmsDB, templateID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 404, "Template not found", "No template found with the given ID")
+		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch template", err.Error())
+		return
+	}
+
+	var count int64
+	if err := bmsDB.DB.Model(&models.DeviceTemplate{}).Where("name = ? AND id <> ?", body.Name, template.ID).Count(&count).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch templates", err.Error())
+		return
+	}
+	if count > 0 {
+		serverutils.WriteError(c, 400, "Template already exists", "A template with this name already exists")
+		return
+	}
+
+	template.Name = body.Name
+	template.DeviceType = body.DeviceType
+	template.Manufacturer = body.Manufacturer
+	template.ModelNumber = body.Model
+	template.Description = body.Description
+
+	err = bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(template).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Where("template_id = ?", template.ID).Delete(&models.DeviceTemplatePoint{}).Error; err != nil {
+			return err
+		}
+		return createTemplatePoints(tx, template.ID, points)
+	})
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to update template", err.Error())
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Template updated", newTemplateResponse(*template, points))
+}
+
+// Route: DELETE /admin/templates/:template_id
+// Delete a device template, freeing its name.
+// Devices already created from the template are not changed.
+func TemplateDelete(c *gin.Context) {
+	templateID := c.Param("template_id")
+
+	if !serverutils.IsValidUUID(templateID) {
+		serverutils.WriteError(c, 400, "Invalid template ID", "Invalid UUID format")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var deleted int64
+	err := bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Where("template_id = ?", templateID).Delete(&models.DeviceTemplatePoint{}).Error; err != nil {
+			return err
+		}
+		result := tx.Unscoped().Where("id = ?", templateID).Delete(&models.DeviceTemplate{})
+		deleted = result.RowsAffected
+		return result.Error
+	})
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to delete template", err.Error())
+		return
+	}
+	if deleted == 0 {
+		serverutils.WriteError(c, 404, "Template not found", "No template found with the given ID")
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Template deleted", nil)
+}
+
+// Route: POST /customers/:customer_id/sites/:site_id/devices/from-template
+// Create a device of the template's type together with the template's default points
+func DeviceCreateFromTemplate(c *gin.Context) {
+	var body DeviceFromTemplateRequest
+	if err := c.BindJSON(&body); err != nil {
+		serverutils.WriteError(c, 400, "Invalid request body", "Invalid JSON format")
+		return
+	}
+
+	if !serverutils.IsValidUUID(body.TemplateID) {
+		serverutils.WriteError(c, 400, "Invalid template ID", "template_id must be a valid UUID")
+		return
+	}
+
+	if body.DeviceSerialNumber == "" || body.DeviceName == "" || body.ControllerSerialNumber == "" {
+		serverutils.WriteError(c, 400, "Invalid request body", "device_serial_number, device_name and controller_serial_number fields are required")
+		return
+	}
+
+	customerID := c.Param("customer_id")
+	siteID := c.Param("site_id")
+
+	// Validate the customer ID
+	if !serverutils.IsValidUUID(customerID) {
+		serverutils.WriteError(c, 400, "Invalid customer ID", "Invalid UUID format")
+		return
+	}
+
+	// Validate the site ID
+	if !serverutils.IsValidUUID(siteID) {
+		serverutils.WriteError(c, 400, "Invalid site ID", "Invalid UUID format")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	template, points, err := FetchTemplateByID(bmsDB, body.TemplateID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 404, "Template not found", "No template found with the given ID")
+		return
+	} else if err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch template", err.Error())
+		return
+	}
+
+	// Fetch and validate customer
+	customer, err := fetchAttachableCustomer(bmsDB, customerID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 404, "Customer not found", "No customer found with the given ID")
+		return
+	} else if err != nil {
+		writeAttachError(c, err, "Database error")
+		return
+	}
+
+	// Fetch and validate site
+	site, err := fetchAttachableSite(bmsDB, siteID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 404, "Site not found", "No site found with the given ID")
+		return
+	} else if err != nil {
+		writeAttachError(c, err, "Database error")
+		return
+	}
+
+	// Check if the customer owns the site
+	if site.CustomerID != customer.ID {
+		serverutils.WriteError(c, 403, "Forbidden", "There is no site with the given ID for the given customer")
+		return
+	}
+
+	// Check if device already exists, including deleted devices which must be restored instead
+	existing, err := fetchExistingDevice(bmsDB, customer.ID, body.DeviceSerialNumber)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		serverutils.WriteError(c, 500, "Database error", err.Error())
+		return
+	}
+	if existing != nil {
+		serverutils.WriteError(c, 400, "Device already exists", "A device with this serial number already exists")
+		return
+	}
+
+	authToken, err := devicetoken.Seal(body.AuthToken)
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to encrypt auth token", err.Error())
+		return
+	}
+
+	device := models.Device{
+		SiteID:                 site.ID,
+		CustomerID:             customer.ID,
+		Gateway:                body.Gateway,
+		Controller:             body.Controller,
+		ControllerSerialNumber: body.ControllerSerialNumber,
+		DeviceType:             template.DeviceType,
+		DeviceName:             body.DeviceName,
+		DeviceSerialNumber:     body.DeviceSerialNumber,
+		BuildingURL:            body.BuildingURL,
+		AuthToken:              authToken,
+	}
+
+	err = bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&device).Error; err != nil {
+			return err
+		}
+
+		if len(points) == 0 {
+			return nil
+		}
+
+		addresses := make([]models.PointAddress, len(points))
+		for i, point := range points {
+			addresses[i] = models.PointAddress{
+				ControllerSerialNumber: device.ControllerSerialNumber,
+				DeviceID:               device.ID,
+				DeviceSerialNumber:     device.DeviceSerialNumber,
+				PointName:              point.PointName,
+				Protocol:               point.Protocol,
+				ObjectType:             point.ObjectType,
+				Register:               point.Register,
+				FunctionCode:           point.FunctionCode,
+				DataType:               point.DataType,
+				Scale:                  point.Scale,
+				Offset:                 point.Offset,
+				Unit:                   point.Unit,
+			}
+		}
+		return tx.Create(&addresses).Error
+	})
+	if err != nil {
+		serverutils.WriteError(c, 500, "Failed to create device", err.Error())
+		return
+	}
+	recordDeviceChanges(c, site.ID)
+
+	response := DeviceFromTemplateResponse{
+		DeviceResponse: DeviceResponse{
+			ID:                     device.ID,
+			CustomerID:             customer.ID,
+			CustomerName:           customer.Name,
+			SiteID:                 site.ID,
+			SiteName:               site.Name,
+			Gateway:                device.Gateway,
+			Controller:             device.Controller,
+			ControllerSerialNumber: device.ControllerSerialNumber,
+			DeviceType:             device.DeviceType,
+			DeviceName:             device.DeviceName,
+			DeviceSerialNumber:     device.DeviceSerialNumber,
+			BuildingURL:            device.BuildingURL,
+			AuthToken:              devicetoken.MaskStored(device.AuthToken),
+		},
+		TemplateID: template.ID,
+		Points:     len(points),
+	}
+	if omitsDeviceTokens(c) {
+		response.AuthToken = ""
+	}
+	serverutils.WriteJSON(c, 201, "Device created from template", response)
+}
+
+// =====================================================================================================================
+
+// Fetch a device template and its points by ID
+func FetchTemplateByID(bmsDB *devicesdb.BMS_DB, templateID string) (*models.DeviceTemplate, []models.DeviceTemplatePoint, error) {
+	var template models.DeviceTemplate
+	if err := bmsDB.DB.Where("id = ?", templateID).First(&template).Error; err != nil {
+		return nil, nil, err
+	}
+
+	var points []models.DeviceTemplatePoint
+	if err := bmsDB.DB.Where("template_id = ?", template.ID).Order("point_name").Find(&points).Error; err != nil {
+		return nil, nil, err
+	}
+
+	return &template, points, nil
+}
+
+// parseTemplateRequest validates the template and its points, returning the points to store
+func parseTemplateRequest(body *TemplateRequest) ([]models.DeviceTemplatePoint, error) {
+	if body.Name == "" || body.DeviceType == "" {
+		return nil, errors.New("name and device_type fields are required")
+	}
+
+	points := make([]models.DeviceTemplatePoint, 0, len(body.Points))
+	seen := make(map[string]bool, len(body.Points))
+
+	for i, point := range body.Points {
+		if point.PointName == "" {
+			return nil, fmt.Errorf("point %d: point_name is required", i+1)
+		}
+		if seen[point.PointName] {
+			return nil, fmt.Errorf("point %d: duplicate point_name %s", i+1, point.PointName)
+		}
+		seen[point.PointName] = true
+
+		// Templates hold the same addresses as a point address book, without the device
+		row := PointAddressRow{
+			PointName:    point.PointName,
+			Protocol:     point.Protocol,
+			ObjectType:   point.ObjectType,
+			Register:     point.Register,
+			FunctionCode: point.FunctionCode,
+			DataType:     point.DataType,
+			Scale:        point.Scale,
+			Offset:       point.Offset,
+			Unit:         point.Unit,
+		}
+		if err := normalizePointAddress(&row); err != nil {
+			return nil, fmt.Errorf("point %d: %w", i+1, err)
+		}
+
+		points = append(points, models.DeviceTemplatePoint{
+			PointName:    row.PointName,
+			Protocol:     row.Protocol,
+			ObjectType:   row.ObjectType,
+			Register:     row.Register,
+			FunctionCode: row.FunctionCode,
+			DataType:     row.DataType,
+			Scale:        *row.Scale,
+			Offset:       row.Offset,
+			Unit:         row.Unit,
+		})
+	}
+
+	return points, nil
+}
+
+// createTemplatePoints stores the points of a template
+func createTemplatePoints(tx *gorm.DB, templateID uuid.UUID, points []models.DeviceTemplatePoint) error {
+	if len(points) == 0 {
+		return nil
+	}
+
+	for i := range points {
+		points[i].TemplateID = templateID
+	}
+	return tx.Create(&points).Error
+}
+
+// newTemplateResponse builds the response for a template and its points
+func newTemplateResponse(template models.DeviceTemplate, points []models.DeviceTemplatePoint) TemplateResponse {
+	response := TemplateResponse{
+		ID:           template.ID,
+		Name:         template.Name,
+		DeviceType:   template.DeviceType,
+		Manufacturer: template.Manufacturer,
+		Model:        template.ModelNumber,
+		Description:  template.Description,
+		Points:       make([]TemplatePoint, len(points)),
+	}
+
+	for i, point := range points {
+		scale := point.Scale
+		response.Points[i] = TemplatePoint{
+			PointName:    point.PointName,
+			Protocol:     point.Protocol,
+			ObjectType:   point.ObjectType,
+			Register:     point.Register,
+			FunctionCode: point.FunctionCode,
+			DataType:     point.DataType,
+			Scale:        &scale,
+			Offset:       point.Offset,
+			Unit:         point.Unit,
+		}
+	}
+
+	return response
+}
@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+)
+
+// CustomerTreeResponse is a customer with its sites and their devices, as shown in navigation trees
+type CustomerTreeResponse struct {
+	ID    uuid.UUID      `json:"id"`
+	Name  string         `json:"name"`
+	Sites []SiteTreeNode `json:"sites"`
+}
+
+type SiteTreeNode struct {
+	ID      uuid.UUID        `json:"id"`
+	Name    string           `json:"name"`
+	Devices []DeviceTreeNode `json:"devices"`
+}
+
+type DeviceTreeNode struct {
+	ID                 uuid.UUID `json:"id"`
+	DeviceSerialNumber string    `json:"device_serial_number"`
+	DeviceName         string    `json:"device_name"`
+	DeviceType         string    `json:"device_type"`
+}
+
+// customerTreeRow is a row of the tree query, a device joined with its site and customer. Sites
+// without devices and customers without sites are joined with a NULL ID.
+type customerTreeRow struct {
+	CustomerID         uuid.UUID
+	CustomerName       string
+	SiteID             *uuid.UUID
+	SiteName           string
+	DeviceID           *uuid.UUID
+	DeviceSerialNumber string
+	DeviceName         string
+	DeviceType         string
+}
+
+// Route: GET /customers/:customer_id/tree
+// Fetch the customer with its sites and their devices as one nested document, sorted by name
+func CustomerTree(c *gin.Context) {
+	role := c.GetString("role")
+	requesterID := c.GetString("customer_id")
+
+	// Validate the customer ID
+	customerID, err := uuid.Parse(c.Param("customer_id"))
+	if err != nil {
+		serverutils.WriteError(c, 400, "Invalid customer ID", "Invalid UUID format")
+		return
+	}
+
+	// Check if the requester is an admin or the customer owner
+	if role != "admin" && requesterID != customerID.String() {
+		serverutils.WriteError(c, 403, "Forbidden", "You are not authorized to access this customer's tree")
+		return
+	}
+
+	// Get the database instance
+	bmsDB, ok := serverutils.GetDBInstance(c)
+	if !ok {
+		return
+	}
+
+	var rows []customerTreeRow
+	if err := bmsDB.DB.Table("customers").
+		Select(`customers.id AS customer_id, customers.name AS customer_name,
+			sites.id AS site_id, COALESCE(sites.name, '') AS site_name, devices.id AS device_id,
+			COALESCE(devices.device_serial_number, '') AS device_serial_number,
+			COALESCE(devices.device_name, '') AS device_name,
+			COALESCE(devices.device_type, '') AS device_type`).
+		Joins("LEFT JOIN sites ON sites.customer_id = customers.id AND sites.deleted_at IS NULL").
+		Joins("LEFT JOIN devices ON devices.site_id = sites.id AND devices.deleted_at IS NULL").
+		Where("customers.id = ? AND customers.deleted_at IS NULL", customerID).
+		Order("sites.name, devices.device_name, devices.device_serial_number").
+		Scan(&rows).Error; err != nil {
+		serverutils.WriteError(c, 500, "Failed to fetch customer tree", err.Error())
+		return
+	}
+
+	if len(rows) == 0 {
+		serverutils.WriteError(c, 404, "Customer not found", "No customer found with the given ID")
+		return
+	}
+
+	serverutils.WriteJSON(c, 200, "Customer tree fetched", buildCustomerTree(rows))
+}
+
+// =====================================================================================================================
+
+// buildCustomerTree nests the rows of the tree query, which are ordered by site, under their customer
+func buildCustomerTree(rows []customerTreeRow) CustomerTreeResponse {
+	tree := CustomerTreeResponse{ID: rows[0].CustomerID, Name: rows[0].CustomerName, Sites: []SiteTreeNode{}}
+
+	for _, row := range rows {
+		if row.SiteID == nil {
+			continue
+		}
+
+		if last := len(tree.Sites) - 1; last < 0 || tree.Sites[last].ID != *row.SiteID {
+			tree.Sites = append(tree.Sites, SiteTreeNode{ID: *row.SiteID, Name: row.SiteName, Devices: []DeviceTreeNode{}})
+		}
+
+		if row.DeviceID == nil {
+			continue
+		}
+
+		site := &tree.Sites[len(tree.Sites)-1]
+		site.Devices = append(site.Devices, DeviceTreeNode{
+			ID:                 *row.DeviceID,
+			DeviceSerialNumber: row.DeviceSerialNumber,
+			DeviceName:         row.DeviceName,
+			DeviceType:         row.DeviceType,
+		})
+	}
+
+	return tree
+}
@@ -1,16 +1,86 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
 	"net/http"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/johandrevandeventer/devices-api-server/internal/audit"
+	"github.com/johandrevandeventer/devices-api-server/internal/config/app"
+	"github.com/johandrevandeventer/devices-api-server/internal/contracts"
+	"github.com/johandrevandeventer/devices-api-server/internal/crashreport"
+	"github.com/johandrevandeventer/devices-api-server/internal/metrics"
+	"github.com/johandrevandeventer/devices-api-server/internal/qos"
+	"github.com/johandrevandeventer/devices-api-server/internal/server/handlers"
 	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/internal/status"
+	"github.com/johandrevandeventer/devices-api-server/internal/usage"
 	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
 	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
 	"go.uber.org/zap"
+	"gorm.io/gorm"
 )
 
+// inFlightRequests counts the requests currently being handled
+var inFlightRequests atomic.Int64
+
+// InFlightRequests returns the number of requests currently being handled
+func InFlightRequests() int64 {
+	return inFlightRequests.Load()
+}
+
+// inFlightMiddleware tracks the number of requests currently being handled
+func inFlightMiddleware(c *gin.Context) {
+	inFlightRequests.Add(1)
+	defer inFlightRequests.Add(-1)
+
+	c.Next()
+}
+
+// deadlineMiddleware limits the request to the time budget, which the database calls made on its
+// behalf inherit through the request context. Exempt routes keep the context of the client
+// connection alone.
+func deadlineMiddleware(cfg app.RequestDeadlineConfig) gin.HandlerFunc {
+	budget := time.Duration(cfg.BudgetSeconds) * time.Second
+
+	return func(c *gin.Context) {
+		if budget <= 0 || slices.Contains(cfg.ExemptRoutes, c.FullPath()) {
+			c.Next()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), budget)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+
+		c.Next()
+	}
+}
+
+// featuresMiddleware enables the API features the client opted in to with the X-API-Features header
+func featuresMiddleware(c *gin.Context) {
+	serverutils.EnableFeatures(c)
+	c.Next()
+}
+
+// requestMetaMiddleware assigns the request its ID, which is logged and sent back in the X-Request-ID
+// header, and adds meta to the JSON responses when enabled
+func requestMetaMiddleware(cfg app.ResponseMetaConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		serverutils.StartRequest(c, cfg.Enabled)
+		c.Next()
+	}
+}
+
 // loggingMiddleware logs HTTP requests with response status and duration
 func loggingMiddleware(logger *zap.Logger) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -32,10 +102,239 @@ func loggingMiddleware(logger *zap.Logger) gin.HandlerFunc {
 			zap.String("remoteAddr", c.ClientIP()),
 			zap.Int("statusCode", statusCode),
 			zap.Duration("duration", time.Since(start)),
+			zap.String("requestID", serverutils.RequestID(c)),
+		)
+	}
+}
+
+// recoveryMiddleware recovers from panics in handlers, writing a crash report before responding with a 500
+func recoveryMiddleware(logger *zap.Logger) gin.HandlerFunc {
+	return gin.CustomRecovery(func(c *gin.Context, recovered any) {
+		request := &crashreport.Request{
+			Method:     c.Request.Method,
+			Path:       c.Request.URL.Path,
+			Route:      c.FullPath(),
+			RemoteAddr: c.ClientIP(),
+			CustomerID: c.GetString("customer_id"),
+		}
+
+		report, err := crashreport.Write("request", recovered, debug.Stack(), request)
+		if err != nil {
+			logger.Error("Failed to write crash report", zap.Error(err))
+		}
+
+		logger.Error("Recovered from panic in request",
+			zap.Any("panic", recovered),
+			zap.String("method", request.Method),
+			zap.String("path", request.Path),
+			zap.String("crashReport", report.ID),
 		)
+
+		serverutils.WriteError(c, http.StatusInternalServerError, "Internal server error", "The request caused a server error, crash report "+report.ID)
+		c.Abort()
+	})
+}
+
+// defaultQoSMaxWaitSeconds is how long a request waits for a slot when no wait is configured
+const defaultQoSMaxWaitSeconds = 30
+
+// qosMiddleware queues requests once the server is saturated, handing freed slots to interactive
+// requests ahead of bulk requests and round-robin across customers within each class
+func qosMiddleware(cfg app.QoSConfig) gin.HandlerFunc {
+	scheduler := qos.NewScheduler(cfg.MaxConcurrent, cfg.InteractiveWeight, cfg.BulkWeight)
+	if cfg.MaxWaitSeconds <= 0 {
+		cfg.MaxWaitSeconds = defaultQoSMaxWaitSeconds
+	}
+	maxWait := time.Duration(cfg.MaxWaitSeconds) * time.Second
+
+	bulkRoutes := make(map[string]bool, len(cfg.BulkRoutes))
+	for _, route := range cfg.BulkRoutes {
+		bulkRoutes[route] = true
+	}
+
+	return func(c *gin.Context) {
+		class := qos.Interactive
+		if bulkRoutes[c.FullPath()] || serverutils.AcceptsNDJSON(c) {
+			class = qos.Bulk
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), maxWait)
+		err := scheduler.Acquire(ctx, class, c.GetString("customer_id"))
+		cancel()
+		if err != nil {
+			c.Header("Retry-After", strconv.Itoa(cfg.MaxWaitSeconds))
+			serverutils.WriteError(c, http.StatusServiceUnavailable, "Server busy", "The server is saturated, retry the "+class.String()+" request later")
+			c.Abort()
+			return
+		}
+		defer scheduler.Release()
+
+		c.Next()
 	}
 }
 
+// transactionWriter holds back the response of a request that runs in a transaction until the
+// transaction has been committed, so clients never see a success that was not persisted
+type transactionWriter struct {
+	gin.ResponseWriter
+	header  http.Header
+	status  int
+	written bool
+	body    bytes.Buffer
+}
+
+func newTransactionWriter(w gin.ResponseWriter) *transactionWriter {
+	return &transactionWriter{ResponseWriter: w, header: w.Header().Clone(), status: http.StatusOK}
+}
+
+func (w *transactionWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *transactionWriter) WriteHeader(code int) {
+	if code > 0 && !w.written {
+		w.status = code
+	}
+}
+
+func (w *transactionWriter) WriteHeaderNow() {
+	w.written = true
+}
+
+func (w *transactionWriter) Write(b []byte) (int, error) {
+	w.written = true
+	return w.body.Write(b)
+}
+
+func (w *transactionWriter) WriteString(s string) (int, error) {
+	w.written = true
+	return w.body.WriteString(s)
+}
+
+func (w *transactionWriter) Status() int {
+	return w.status
+}
+
+func (w *transactionWriter) Size() int {
+	if !w.written {
+		return -1
+	}
+	return w.body.Len()
+}
+
+func (w *transactionWriter) Written() bool {
+	return w.written
+}
+
+// Flush is a no-op, the response is only sent once the transaction has ended
+func (w *transactionWriter) Flush() {}
+
+// send writes the held back response to the client
+func (w *transactionWriter) send() {
+	header := w.ResponseWriter.Header()
+	for key, values := range w.header {
+		header[key] = values
+	}
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.WriteHeaderNow()
+	w.ResponseWriter.Write(w.body.Bytes())
+}
+
+// transactionMiddleware runs mutating requests in a database transaction, which handlers pick up
+// through serverutils.GetDBInstance. It runs after authentication and prioritization, so only
+// admitted requests hold a connection. The transaction is committed when the request succeeds and
+// rolled back when it fails or panics. The response is held back until the transaction has ended,
+// so a failed commit is answered with a 500, and the functions handlers passed to
+// serverutils.AfterCommit only run once the transaction has been committed.
+func transactionMiddleware(logger *zap.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+
+		bmsDB, err := devicesdb.GetDB()
+		if err != nil {
+			serverutils.WriteError(c, http.StatusInternalServerError, "Database error", err.Error())
+			c.Abort()
+			return
+		}
+
+		// The transaction is rolled back by the driver once the request deadline passes
+		tx := bmsDB.DB.WithContext(c.Request.Context()).Begin()
+		if tx.Error != nil {
+			serverutils.WriteError(c, http.StatusInternalServerError, "Database error", tx.Error.Error())
+			c.Abort()
+			return
+		}
+		c.Set(serverutils.TransactionKey, &devicesdb.BMS_DB{DB: tx})
+
+		writer := newTransactionWriter(c.Writer)
+		c.Writer = writer
+
+		// Roll back when the handler panics. The held back response is dropped so the recovery
+		// middleware answers on the original writer.
+		ended := false
+		defer func() {
+			c.Writer = writer.ResponseWriter
+			if !ended {
+				tx.Rollback()
+			}
+		}()
+
+		c.Next()
+		ended = true
+
+		if writer.Status() >= http.StatusBadRequest {
+			tx.Rollback()
+			writer.send()
+			return
+		}
+
+		if err := tx.Commit().Error; err != nil {
+			logger.Error("Failed to commit request transaction",
+				zap.Error(err),
+				zap.String("method", c.Request.Method),
+				zap.String("path", c.Request.URL.Path),
+				zap.Int("statusCode", writer.Status()),
+			)
+			c.Writer = writer.ResponseWriter
+			serverutils.WriteError(c, http.StatusInternalServerError, "Database error", "Failed to commit the changes")
+			return
+		}
+
+		serverutils.RunAfterCommit(c)
+		writer.send()
+	}
+}
+
+// readOnlyExemptRoutes lists the mutating routes that stay available in read-only mode,
+// none of which write to the database
+var readOnlyExemptRoutes = map[string]bool{
+	"/authenticate":               true,
+	"/admin/generate-admin-token": true,
+	"/admin/read-only":            true,
+}
+
+// readOnlyMiddleware rejects requests that could write to the database while the instance is read-only
+func readOnlyMiddleware(c *gin.Context) {
+	if !status.IsReadOnly() || c.FullPath() == "" || readOnlyExemptRoutes[c.FullPath()] {
+		c.Next()
+		return
+	}
+
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		c.Next()
+		return
+	}
+
+	c.Header("Retry-After", "60")
+	serverutils.WriteError(c, http.StatusServiceUnavailable, "Service is read-only", "The instance is in read-only mode, retry against the primary instance")
+	c.Abort()
+}
+
 // AdminMiddleware is a Gin middleware to check for a valid admin secret
 func AdminMiddleware(adminSecret string) gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -44,6 +343,13 @@ func AdminMiddleware(adminSecret string) gin.HandlerFunc {
 
 		// Check if the secret matches the expected admin secret
 		if secret != adminSecret {
+			reason := "invalid_secret"
+			if secret == "" {
+				reason = "missing_secret"
+			}
+			metrics.AdminSecretFailed(reason)
+			audit.RecordRequest(c, audit.EventAdminSecret, audit.OutcomeFailure, reason)
+
 			// If the secret is invalid, return a 401 Unauthorized response
 			c.JSON(http.StatusUnauthorized, gin.H{
 				"error":   "Unauthorized",
@@ -68,11 +374,20 @@ func AdminOnlyMiddleware(c *gin.Context) {
 	c.Next()
 }
 
-// AuthMiddleware is a Gin middleware to check for a valid JWT token
+// AuthMiddleware is a Gin middleware to check for a valid JWT token, sent as a bearer token in the
+// Authorization header or in the Authorization cookie set by /authenticate. An API key sent in the
+// X-API-Key header is accepted in place of a token.
 func AuthMiddleware(c *gin.Context) {
-	// Get the cookie off request
-	tokenString, err := c.Cookie("Authorization")
-	if err != nil {
+	if key := c.GetHeader(serverutils.APIKeyHeader); key != "" {
+		apiKeyAuth(c, key)
+		return
+	}
+
+	// Get the token off request
+	tokenString := requestToken(c)
+	if tokenString == "" {
+		metrics.TokenValidationFailed("missing_token")
+		audit.RecordRequest(c, audit.EventTokenValidation, audit.OutcomeFailure, "missing_token")
 		serverutils.WriteError(c, http.StatusUnauthorized, "Unauthorized", "Please authenticate first")
 		c.Abort()
 		return
@@ -80,33 +395,368 @@ func AuthMiddleware(c *gin.Context) {
 
 	// Validate the JWT token
 	claims, err := serverutils.ValidateJWT(tokenString)
-	if err != nil {
+	if serverutils.IsTokenExpired(err) {
+		metrics.TokenValidationFailed("token_expired")
+		audit.RecordRequest(c, audit.EventTokenValidation, audit.OutcomeFailure, "token_expired")
+		serverutils.WriteError(c, http.StatusUnauthorized, "Unauthorized", "Token has expired, refresh it at /token/refresh")
+		c.Abort()
+		return
+	} else if err != nil {
+		metrics.TokenValidationFailed("invalid_token")
+		audit.RecordRequest(c, audit.EventTokenValidation, audit.OutcomeFailure, "invalid_token")
 		serverutils.WriteError(c, http.StatusUnauthorized, "Unauthorized", "Invalid token")
 		c.Abort()
 		return
 	}
 
 	// Get database instance
-	bmsDB, err := devicesdb.GetDB()
+	bmsDB, err := serverutils.RequestDB(c)
 	if err != nil {
+		metrics.TokenValidationFailed("database_error")
+		audit.RecordRequest(c, audit.EventTokenValidation, audit.OutcomeFailure, "database_error")
 		serverutils.WriteError(c, http.StatusInternalServerError, "Failed to get database instance", err.Error())
 		c.Abort()
 		return
 	}
 
+	siteID, _ := claims["site_id"].(string)
+	impersonatedBy, _ := claims["impersonated_by"].(string)
+
 	role := claims["role"].(string)
-	if role != "admin" {
+	if impersonatedBy != "" {
+		// Impersonation tokens are not stored, so only their signature and short expiry admit them
+		if !handlers.IsImpersonationToken(claims) {
+			metrics.TokenValidationFailed("invalid_token")
+			audit.RecordRequest(c, audit.EventTokenValidation, audit.OutcomeFailure, "invalid_token")
+			serverutils.WriteError(c, http.StatusUnauthorized, "Unauthorized", "Invalid token")
+			c.Abort()
+			return
+		}
+	} else if role != "admin" {
+		// Customer and site tokens for the same action are stored separately
+		tokenQuery := bmsDB.DB.Where("customer_id = ? and action = ?", claims["user_id"], claims["action"])
+		if siteID != "" {
+			tokenQuery = tokenQuery.Where("site_id = ?", siteID)
+		} else {
+			tokenQuery = tokenQuery.Where("site_id IS NULL")
+		}
+
 		var token models.AuthToken
-		bmsDB.DB.First(&token, "customer_id = ? and action = ?", claims["user_id"], claims["action"])
-		if token.Token == "" {
+		err = tokenQuery.First(&token).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			metrics.TokenValidationFailed("token_not_found")
+			audit.RecordRequest(c, audit.EventTokenValidation, audit.OutcomeFailure, "token_not_found")
 			serverutils.WriteError(c, http.StatusUnauthorized, "Unauthorized", "Token not found")
 			c.Abort()
 			return
+		} else if err != nil {
+			metrics.TokenValidationFailed("database_error")
+			audit.RecordRequest(c, audit.EventTokenValidation, audit.OutcomeFailure, "database_error")
+			serverutils.WriteError(c, http.StatusInternalServerError, "Failed to fetch token", err.Error())
+			c.Abort()
+			return
 		}
+
+		// Only the latest token issued for the customer, site and action is accepted, so a token
+		// replaced by a refresh or a re-issue stops working
+		if subtle.ConstantTimeCompare([]byte(token.Token), []byte(tokenString)) != 1 {
+			metrics.TokenValidationFailed("token_replaced")
+			audit.RecordRequest(c, audit.EventTokenValidation, audit.OutcomeFailure, "token_replaced")
+			serverutils.WriteError(c, http.StatusUnauthorized, "Unauthorized", "Token has been replaced, use the latest token")
+			c.Abort()
+			return
+		}
+
+		if token.ExpiresAt != nil && !time.Now().Before(*token.ExpiresAt) {
+			metrics.TokenValidationFailed("token_expired")
+			audit.RecordRequest(c, audit.EventTokenValidation, audit.OutcomeFailure, "token_expired")
+			serverutils.WriteError(c, http.StatusUnauthorized, "Unauthorized", "Token has expired, refresh it at /token/refresh")
+			c.Abort()
+			return
+		}
+
+		if reason := handlers.TokenBindingMismatch(c, token); reason != "" {
+			metrics.TokenValidationFailed(reason)
+			audit.RecordRequest(c, audit.EventTokenValidation, audit.OutcomeFailure, reason)
+			serverutils.WriteError(c, http.StatusUnauthorized, "Unauthorized", "Token is not valid from this client")
+			c.Abort()
+			return
+		}
+	}
+
+	if customerID, _ := claims["user_id"].(string); role != "admin" && contracts.IsSuspended(customerID) {
+		metrics.TokenValidationFailed("contract_suspended")
+		audit.RecordRequest(c, audit.EventTokenValidation, audit.OutcomeFailure, "contract_suspended")
+		serverutils.WriteError(c, http.StatusForbidden, "Forbidden", "Customer contract has expired")
+		c.Abort()
+		return
 	}
 
+	metrics.TokenValidationSucceeded()
+
 	// Set the claims to the context
+	action, _ := claims["action"].(string)
 	c.Set("customer_id", claims["user_id"])
 	c.Set("role", claims["role"])
-	c.Set("action", claims["action"])
+	c.Set("action", action)
+	c.Set("scopes", serverutils.ActionScopes(action))
+	if siteID != "" {
+		c.Set("site_id", siteID)
+	}
+
+	// Every request made while impersonating a customer is audited
+	if impersonatedBy != "" {
+		c.Set("impersonated_by", impersonatedBy)
+		audit.RecordRequest(c, audit.EventImpersonated, audit.OutcomeSuccess, "")
+	}
+}
+
+// scopeRoutes maps the routes that change data but need less than the admin scope to the scope they
+// need. Other requests need the read scope if they do not change anything, and the admin scope otherwise.
+var scopeRoutes = map[string]string{
+	"POST /customers/batch-get":                  serverutils.ScopeRead,
+	"POST /sites/batch-get":                      serverutils.ScopeRead,
+	"POST /devices/batch-get":                    serverutils.ScopeRead,
+	"POST /devices/:device_serial_number/status": serverutils.ScopeDevicesWrite,
+	"POST /filters":                              serverutils.ScopeFiltersWrite,
+	"DELETE /filters/:filter_id":                 serverutils.ScopeFiltersWrite,
+}
+
+// requiredScope returns the scope the request needs
+func requiredScope(c *gin.Context) string {
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return serverutils.ScopeRead
+	}
+
+	if scope, ok := scopeRoutes[c.Request.Method+" "+c.FullPath()]; ok {
+		return scope
+	}
+	return serverutils.ScopeAdmin
+}
+
+// ScopeMiddleware limits requests to the routes the scopes granted by the action of their token, or
+// by their API key, allow
+func ScopeMiddleware(c *gin.Context) {
+	granted := c.GetStringSlice("scopes")
+	if slices.Contains(granted, serverutils.ScopeAdmin) {
+		c.Next()
+		return
+	}
+
+	if scope := requiredScope(c); !slices.Contains(granted, scope) {
+		metrics.TokenValidationFailed("scope_not_granted")
+		audit.RecordRequest(c, audit.EventTokenValidation, audit.OutcomeFailure, "scope_not_granted")
+		detail := "The token is not granted the " + scope + " scope"
+		if scope == serverutils.ScopeAdmin {
+			detail = "Only admin tokens can make this request"
+		}
+		serverutils.WriteError(c, http.StatusForbidden, "Forbidden", detail)
+		c.Abort()
+		return
+	}
+	c.Next()
+}
+
+// apiKeyAuth authenticates the request with the API key, which acts as a token of its customer or
+// site limited to its scopes by ScopeMiddleware
+func apiKeyAuth(c *gin.Context, key string) {
+	// Get database instance
+	bmsDB, err := serverutils.RequestDB(c)
+	if err != nil {
+		metrics.TokenValidationFailed("database_error")
+		audit.RecordRequest(c, audit.EventTokenValidation, audit.OutcomeFailure, "database_error")
+		serverutils.WriteError(c, http.StatusInternalServerError, "Failed to get database instance", err.Error())
+		c.Abort()
+		return
+	}
+
+	// Revoked keys are deleted, so only current keys are found
+	apiKey, err := handlers.FetchAPIKey(bmsDB, key)
+	if err != nil {
+		metrics.TokenValidationFailed("api_key_not_found")
+		audit.RecordRequest(c, audit.EventTokenValidation, audit.OutcomeFailure, "api_key_not_found")
+		serverutils.WriteError(c, http.StatusUnauthorized, "Unauthorized", "Invalid API key")
+		c.Abort()
+		return
+	}
+
+	if contracts.IsSuspended(apiKey.CustomerID.String()) {
+		metrics.TokenValidationFailed("contract_suspended")
+		audit.RecordRequest(c, audit.EventTokenValidation, audit.OutcomeFailure, "contract_suspended")
+		serverutils.WriteError(c, http.StatusForbidden, "Forbidden", "Customer contract has expired")
+		c.Abort()
+		return
+	}
+
+	metrics.TokenValidationSucceeded()
+
+	c.Set("customer_id", apiKey.CustomerID.String())
+	c.Set("role", "user")
+	c.Set("action", serverutils.APIKeyAction)
+	c.Set("scopes", handlers.APIKeyScopes(apiKey))
+	c.Set("api_key_id", apiKey.ID.String())
+	if apiKey.SiteID != nil {
+		c.Set("site_id", apiKey.SiteID.String())
+	}
+}
+
+// requestToken returns the bearer token of the Authorization header, or the Authorization cookie
+// when the request has no bearer token
+func requestToken(c *gin.Context) string {
+	if token, found := bearerToken(c); found {
+		return token
+	}
+
+	token, _ := c.Cookie("Authorization")
+	return token
+}
+
+// bearerToken returns the token of the Authorization header when it uses the Bearer scheme, which
+// is matched case-insensitively
+func bearerToken(c *gin.Context) (string, bool) {
+	scheme, token, found := strings.Cut(c.GetHeader("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
+
+// GatewayAuthMiddleware admits edge gateways on the /gateway routes with the credential issued for
+// them, sent as a bearer token. Gateways act for their own site only, and customer tokens are not
+// accepted in their place.
+func GatewayAuthMiddleware(c *gin.Context) {
+	tokenString, found := bearerToken(c)
+	if !found || tokenString == "" {
+		metrics.TokenValidationFailed("missing_token")
+		audit.RecordRequest(c, audit.EventTokenValidation, audit.OutcomeFailure, "missing_token")
+		serverutils.WriteError(c, http.StatusUnauthorized, "Unauthorized", "Please authenticate with the gateway credential")
+		c.Abort()
+		return
+	}
+
+	claims, err := serverutils.ValidateJWT(tokenString)
+	if role, _ := claims["role"].(string); err != nil || role != serverutils.GatewayRole {
+		metrics.TokenValidationFailed("invalid_token")
+		audit.RecordRequest(c, audit.EventTokenValidation, audit.OutcomeFailure, "invalid_token")
+		serverutils.WriteError(c, http.StatusUnauthorized, "Unauthorized", "Invalid token")
+		c.Abort()
+		return
+	}
+
+	// Get database instance
+	bmsDB, err := serverutils.RequestDB(c)
+	if err != nil {
+		metrics.TokenValidationFailed("database_error")
+		audit.RecordRequest(c, audit.EventTokenValidation, audit.OutcomeFailure, "database_error")
+		serverutils.WriteError(c, http.StatusInternalServerError, "Failed to get database instance", err.Error())
+		c.Abort()
+		return
+	}
+
+	// Revoked and replaced credentials are deleted, so only the current one is found
+	var credential models.GatewayCredential
+	bmsDB.DB.Where("token = ?", tokenString).First(&credential)
+	if credential.Token == "" {
+		metrics.TokenValidationFailed("token_not_found")
+		audit.RecordRequest(c, audit.EventTokenValidation, audit.OutcomeFailure, "token_not_found")
+		serverutils.WriteError(c, http.StatusUnauthorized, "Unauthorized", "Token not found")
+		c.Abort()
+		return
+	}
+
+	binding := models.AuthToken{AllowedCIDRs: credential.AllowedCIDRs, CertThumbprint: credential.CertThumbprint}
+	if reason := handlers.TokenBindingMismatch(c, binding); reason != "" {
+		metrics.TokenValidationFailed(reason)
+		audit.RecordRequest(c, audit.EventTokenValidation, audit.OutcomeFailure, reason)
+		serverutils.WriteError(c, http.StatusUnauthorized, "Unauthorized", "Token is not valid from this client")
+		c.Abort()
+		return
+	}
+
+	if contracts.IsSuspended(credential.CustomerID.String()) {
+		metrics.TokenValidationFailed("contract_suspended")
+		audit.RecordRequest(c, audit.EventTokenValidation, audit.OutcomeFailure, "contract_suspended")
+		serverutils.WriteError(c, http.StatusForbidden, "Forbidden", "Customer contract has expired")
+		c.Abort()
+		return
+	}
+
+	metrics.TokenValidationSucceeded()
+	handlers.TouchGateway(bmsDB.DB, credential.GatewayID, time.Now())
+
+	c.Set("customer_id", credential.CustomerID.String())
+	c.Set("role", serverutils.GatewayRole)
+	c.Set("action", serverutils.GatewayAction)
+	c.Set("site_id", credential.SiteID.String())
+	c.Set("gateway", credential.Gateway)
+}
+
+// siteScopedRoutes lists the routes a site token may use, all of which identify a single site or device
+// or only answer with the token's own site
+var siteScopedRoutes = map[string]bool{
+	"/sites/:site_id":                               true,
+	"/sites/:site_id/devices":                       true,
+	"/sites/:site_id/handover-package":              true,
+	"/sites/:site_id/health":                        true,
+	"/sites/:site_id/energy/daily":                  true,
+	"/sites/:site_id/energy/monthly":                true,
+	"/devices/:device_serial_number":                true,
+	"/devices/changes/poll":                         true,
+	"/devices/:device_serial_number/status":         true,
+	"/devices/:device_serial_number/status/history": true,
+}
+
+// SiteScopeMiddleware restricts site tokens to the site they were issued for
+func SiteScopeMiddleware(c *gin.Context) {
+	siteID := c.GetString("site_id")
+	if siteID == "" {
+		c.Next()
+		return
+	}
+
+	if !siteScopedRoutes[c.FullPath()] {
+		serverutils.WriteError(c, http.StatusForbidden, "Forbidden", "Site tokens can only access their own site")
+		c.Abort()
+		return
+	}
+
+	if id := c.Param("site_id"); id != "" && id != siteID {
+		serverutils.WriteError(c, http.StatusForbidden, "Forbidden", "Site tokens can only access their own site")
+		c.Abort()
+		return
+	}
+
+	if serialNumber := c.Param("device_serial_number"); serialNumber != "" {
+		bmsDB, ok := serverutils.GetDBInstance(c)
+		if !ok {
+			c.Abort()
+			return
+		}
+
+		var count int64
+		if err := bmsDB.DB.Model(&models.Device{}).
+			Where("device_serial_number = ? AND site_id = ?", serialNumber, siteID).
+			Count(&count).Error; err != nil {
+			serverutils.WriteError(c, http.StatusInternalServerError, "Failed to fetch device", err.Error())
+			c.Abort()
+			return
+		}
+
+		if count == 0 {
+			serverutils.WriteError(c, http.StatusForbidden, "Forbidden", "Site tokens can only access their own site")
+			c.Abort()
+			return
+		}
+	}
+
+	c.Next()
+}
+
+// usageMiddleware counts the requests made by customers for billing
+func usageMiddleware(c *gin.Context) {
+	if c.GetString("role") != "admin" {
+		usage.Record(c.GetString("customer_id"))
+	}
+	c.Next()
 }
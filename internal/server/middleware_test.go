@@ -0,0 +1,694 @@
+package server
+
+import (
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/config/app"
+	"github.com/johandrevandeventer/devices-api-server/internal/dbtest"
+	"github.com/johandrevandeventer/devices-api-server/internal/server/handlers"
+	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/logging"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+
+	dir, err := os.MkdirTemp("", "server-test")
+	if err != nil {
+		panic(err)
+	}
+	logging.NewLogger(logging.NewLoggingConfig("error", filepath.Join(dir, "test.log"), 1, 1, 1, false, false, false))
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestSiteScopeMiddleware(t *testing.T) {
+	siteID := uuid.NewString()
+	count := func(n int64) *dbtest.Result {
+		return &dbtest.Result{Columns: []string{"count(*)"}, Rows: [][]driver.Value{{n}}}
+	}
+
+	tests := []struct {
+		name    string
+		siteID  string
+		route   string
+		path    string
+		devices *dbtest.Result
+		fail    bool
+		want    int
+	}{
+		{name: "customer token", route: "/customers/:customer_id", path: "/customers/" + uuid.NewString(), want: http.StatusOK},
+		{name: "route outside the site", siteID: siteID, route: "/customers/:customer_id", path: "/customers/" + uuid.NewString(), want: http.StatusForbidden},
+		{name: "own site", siteID: siteID, route: "/sites/:site_id", path: "/sites/" + siteID, want: http.StatusOK},
+		{name: "another site", siteID: siteID, route: "/sites/:site_id", path: "/sites/" + uuid.NewString(), want: http.StatusForbidden},
+		{name: "device on the site", siteID: siteID, route: "/devices/:device_serial_number", path: "/devices/SN-1", devices: count(1), want: http.StatusOK},
+		{name: "device on another site", siteID: siteID, route: "/devices/:device_serial_number", path: "/devices/SN-1", devices: count(0), want: http.StatusForbidden},
+		{name: "database error", siteID: siteID, route: "/devices/:device_serial_number", path: "/devices/SN-1", fail: true, want: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			if tt.fail {
+				db.Fail(errors.New("database is unavailable"))
+			}
+			if tt.devices != nil {
+				db.On("FROM `devices`", *tt.devices)
+			}
+
+			r := gin.New()
+			r.GET(tt.route, func(c *gin.Context) {
+				if tt.siteID != "" {
+					c.Set("site_id", tt.siteID)
+				}
+			}, SiteScopeMiddleware, func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestDeadlineMiddleware(t *testing.T) {
+	cfg := app.RequestDeadlineConfig{BudgetSeconds: 5, ExemptRoutes: []string{"/devices/changes/poll"}}
+
+	tests := []struct {
+		name         string
+		cfg          app.RequestDeadlineConfig
+		route        string
+		wantDeadline bool
+	}{
+		{name: "budgeted", cfg: cfg, route: "/devices", wantDeadline: true},
+		{name: "exempt", cfg: cfg, route: "/devices/changes/poll"},
+		{name: "disabled", route: "/devices"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbtest.Install(t)
+
+			var deadline time.Time
+			var bound bool
+			r := gin.New()
+			r.Use(deadlineMiddleware(tt.cfg))
+			r.GET(tt.route, func(c *gin.Context) {
+				deadline, _ = c.Request.Context().Deadline()
+				bmsDB, ok := serverutils.GetDBInstance(c)
+				if !ok {
+					return
+				}
+				bound = bmsDB.DB.Statement.Context == c.Request.Context()
+				c.Status(http.StatusNoContent)
+			})
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest("GET", tt.route, nil))
+
+			if got := !deadline.IsZero(); got != tt.wantDeadline {
+				t.Fatalf("request has a deadline = %v, want %v", got, tt.wantDeadline)
+			}
+			if tt.wantDeadline && time.Until(deadline) > 5*time.Second {
+				t.Errorf("deadline = %v, want within the 5s budget", deadline)
+			}
+			if !bound {
+				t.Error("database is not bound to the request context")
+			}
+		})
+	}
+}
+
+func TestFeaturesMiddleware(t *testing.T) {
+	tests := []struct {
+		name         string
+		header       string
+		wantHeader   string
+		wantEnabled  bool
+		wantWarnings []string
+	}{
+		{name: "none"},
+		{name: "known", header: "Omit-Auth-Token, omit-auth-token", wantHeader: "omit-auth-token", wantEnabled: true},
+		{
+			name:         "unknown",
+			header:       "omit-auth-token,time-travel",
+			wantHeader:   "omit-auth-token",
+			wantEnabled:  true,
+			wantWarnings: []string{"API feature time-travel is not known and was ignored"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var enabled bool
+			var warnings []string
+
+			r := gin.New()
+			r.GET("/", featuresMiddleware, func(c *gin.Context) {
+				enabled = serverutils.FeatureEnabled(c, serverutils.FeatureOmitAuthToken)
+				warnings = serverutils.Warnings(c)
+				c.Status(http.StatusNoContent)
+			})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				req.Header.Set(serverutils.FeaturesHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if got := w.Header().Get(serverutils.FeaturesHeader); got != tt.wantHeader {
+				t.Errorf("%s = %q, want %q", serverutils.FeaturesHeader, got, tt.wantHeader)
+			}
+			if enabled != tt.wantEnabled {
+				t.Errorf("feature enabled = %v, want %v", enabled, tt.wantEnabled)
+			}
+			if !slices.Equal(warnings, tt.wantWarnings) {
+				t.Errorf("warnings = %q, want %q", warnings, tt.wantWarnings)
+			}
+		})
+	}
+}
+
+func TestRequestMetaMiddleware(t *testing.T) {
+	tests := []struct {
+		name          string
+		enabled       bool
+		header        string
+		wantRequestID string
+	}{
+		{name: "disabled", header: "gw-01.42"},
+		{name: "client request ID", enabled: true, header: "gw-01.42", wantRequestID: "gw-01.42"},
+		{name: "generated request ID", enabled: true},
+		{name: "unusable request ID", enabled: true, header: "id with spaces"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.GET("/", requestMetaMiddleware(app.ResponseMetaConfig{Enabled: tt.enabled}), func(c *gin.Context) {
+				serverutils.WriteJSONPage(c, http.StatusOK, "Listed", []string{}, &serverutils.Pagination{Page: 2, PerPage: 10})
+			})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				req.Header.Set(serverutils.RequestIDHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			requestID := w.Header().Get(serverutils.RequestIDHeader)
+			switch {
+			case tt.wantRequestID != "" && requestID != tt.wantRequestID:
+				t.Errorf("%s = %q, want %q", serverutils.RequestIDHeader, requestID, tt.wantRequestID)
+			case tt.wantRequestID == "" && tt.enabled && uuid.Validate(requestID) != nil:
+				t.Errorf("%s = %q, want a generated ID", serverutils.RequestIDHeader, requestID)
+			}
+
+			var response serverutils.Response
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if !tt.enabled {
+				if response.Meta != nil {
+					t.Errorf("meta = %+v, want none when disabled", response.Meta)
+				}
+				return
+			}
+			if response.Meta == nil || response.Meta.RequestID != requestID || response.Meta.Pagination == nil || response.Meta.Pagination.Page != 2 {
+				t.Errorf("meta = %+v, want the request ID %q and the pagination", response.Meta, requestID)
+			}
+		})
+	}
+}
+
+func TestTransactionMiddleware(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		status        int
+		panics        bool
+		commitErr     error
+		want          []string
+		wantInTx      bool
+		wantStatus    int
+		wantCommitted bool
+	}{
+		{name: "read", method: "GET", status: http.StatusOK, wantStatus: http.StatusOK, wantCommitted: true},
+		{name: "success", method: "POST", status: http.StatusCreated, want: []string{dbtest.Committed}, wantInTx: true, wantStatus: http.StatusCreated, wantCommitted: true},
+		{name: "failure", method: "PUT", status: http.StatusConflict, want: []string{dbtest.RolledBack}, wantInTx: true, wantStatus: http.StatusConflict},
+		{name: "panic", method: "DELETE", panics: true, want: []string{dbtest.RolledBack}, wantInTx: true, wantStatus: http.StatusInternalServerError},
+		{name: "commit fails", method: "POST", status: http.StatusCreated, commitErr: errors.New("connection lost"), want: []string{dbtest.RolledBack}, wantInTx: true, wantStatus: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			if tt.commitErr != nil {
+				db.FailCommit(tt.commitErr)
+			}
+
+			var inTx, committed bool
+			r := gin.New()
+			r.Use(gin.CustomRecovery(func(c *gin.Context, _ any) {
+				c.AbortWithStatus(http.StatusInternalServerError)
+			}))
+			r.Use(transactionMiddleware(zap.NewNop()))
+			r.Handle(tt.method, "/sites/:site_id", func(c *gin.Context) {
+				bmsDB, ok := serverutils.GetDBInstance(c)
+				if !ok {
+					return
+				}
+				tx, ok := c.Get(serverutils.TransactionKey)
+				inTx = ok && bmsDB == tx
+				serverutils.AfterCommit(c, func() { committed = true })
+				if tt.panics {
+					panic("handler failed")
+				}
+				serverutils.WriteJSON(c, tt.status, "Site saved", nil)
+			})
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(tt.method, "/sites/"+uuid.NewString(), nil))
+
+			if inTx != tt.wantInTx {
+				t.Errorf("ran in a transaction = %v, want %v", inTx, tt.wantInTx)
+			}
+			if got := db.Transactions(); !slices.Equal(got, tt.want) {
+				t.Errorf("transactions = %v, want %v", got, tt.want)
+			}
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if committed != tt.wantCommitted {
+				t.Errorf("after commit ran = %v, want %v", committed, tt.wantCommitted)
+			}
+			if tt.wantStatus == http.StatusInternalServerError && strings.Contains(w.Body.String(), "Site saved") {
+				t.Errorf("body = %s, want the held back response dropped", w.Body)
+			}
+		})
+	}
+}
+
+func TestAuthMiddlewareImpersonation(t *testing.T) {
+	t.Setenv("DEVICES_SERVER_JWT_SECRET", "secret")
+	customerID := uuid.NewString()
+
+	impersonation, err := serverutils.GenerateImpersonationJWT(customerID, "Customer", "DSE_890_API", "jane", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unstored, err := serverutils.GenerateJWT(customerID, "Customer", "user", "DSE_890_API", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name               string
+		token              string
+		want               int
+		wantImpersonatedBy string
+	}{
+		{name: "impersonation token", token: impersonation, want: http.StatusOK, wantImpersonatedBy: "jane"},
+		{name: "customer token not stored", token: unstored, want: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbtest.Install(t)
+
+			var impersonatedBy string
+			r := gin.New()
+			r.GET("/customers/:customer_id", AuthMiddleware, func(c *gin.Context) {
+				impersonatedBy = c.GetString("impersonated_by")
+				c.Status(http.StatusOK)
+			})
+
+			req := httptest.NewRequest("GET", "/customers/"+customerID, nil)
+			req.AddCookie(&http.Cookie{Name: "Authorization", Value: tt.token})
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if impersonatedBy != tt.wantImpersonatedBy {
+				t.Errorf("impersonated_by = %q, want %q", impersonatedBy, tt.wantImpersonatedBy)
+			}
+		})
+	}
+}
+
+func TestAuthMiddlewareBearerToken(t *testing.T) {
+	t.Setenv("DEVICES_SERVER_JWT_SECRET", "secret")
+	customerID := uuid.NewString()
+
+	// Impersonation tokens are accepted without being stored
+	token, err := serverutils.GenerateImpersonationJWT(customerID, "Customer", "DSE_890_API", "jane", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		cookie string
+		want   int
+	}{
+		{name: "missing token", want: http.StatusUnauthorized},
+		{name: "cookie", cookie: token, want: http.StatusOK},
+		{name: "bearer header", header: "Bearer " + token, want: http.StatusOK},
+		{name: "lowercase scheme", header: "bearer " + token, want: http.StatusOK},
+		{name: "other scheme", header: "Basic " + token, want: http.StatusUnauthorized},
+		{name: "other scheme with cookie", header: "Basic dXNlcjpwYXNz", cookie: token, want: http.StatusOK},
+		{name: "invalid bearer token over cookie", header: "Bearer invalid", cookie: token, want: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbtest.Install(t)
+
+			r := gin.New()
+			r.GET("/customers/:customer_id", AuthMiddleware, func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			req := httptest.NewRequest("GET", "/customers/"+customerID, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "Authorization", Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestAuthMiddlewareStoredToken(t *testing.T) {
+	t.Setenv("DEVICES_SERVER_JWT_SECRET", "secret")
+	customerID := uuid.NewString()
+
+	token, err := serverutils.GenerateJWT(customerID, "Customer", "user", "DSE_890_API", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replaced, err := serverutils.GenerateJWT(customerID, "Customer", "user", "DSE_890_API", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := func(token string, expiresAt any) dbtest.Result {
+		return dbtest.Result{
+			Columns: []string{"id", "customer_id", "site_id", "action", "token", "expires_at"},
+			Rows:    [][]driver.Value{{uuid.NewString(), customerID, nil, "DSE_890_API", token, expiresAt}},
+		}
+	}
+	future, past := time.Now().Add(time.Hour), time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		name   string
+		stored dbtest.Result
+		dbErr  error
+		want   int
+	}{
+		{name: "stored token", stored: stored(token, future), want: http.StatusOK},
+		{name: "stored token without expiry", stored: stored(token, nil), want: http.StatusOK},
+		{name: "token not stored", want: http.StatusUnauthorized},
+		{name: "token replaced", stored: stored(replaced, future), want: http.StatusUnauthorized},
+		{name: "stored token expired", stored: stored(token, past), want: http.StatusUnauthorized},
+		{name: "database error", dbErr: errors.New("connection lost"), want: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			if tt.dbErr != nil {
+				db.Fail(tt.dbErr)
+			} else {
+				db.On("FROM `auth_tokens`", tt.stored)
+			}
+
+			r := gin.New()
+			r.GET("/customers/:customer_id", AuthMiddleware, func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			req := httptest.NewRequest("GET", "/customers/"+customerID, nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestAuthMiddlewareAfterRefresh(t *testing.T) {
+	t.Setenv("DEVICES_SERVER_JWT_SECRET", "secret")
+	customerID := uuid.NewString()
+
+	old, err := serverutils.GenerateJWT(customerID, "Customer", "user", "DSE_890_API", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refreshHash := sha256.Sum256([]byte("refresh-token"))
+	stored := func(token string) dbtest.Result {
+		return dbtest.Result{
+			Columns: []string{"id", "customer_id", "site_id", "action", "token", "expires_at", "refresh_token_hash", "refresh_expires_at"},
+			Rows:    [][]driver.Value{{uuid.NewString(), customerID, nil, "DSE_890_API", token, time.Now().Add(time.Hour), hex.EncodeToString(refreshHash[:]), time.Now().Add(time.Hour)}},
+		}
+	}
+
+	r := gin.New()
+	r.GET("/customers/:customer_id", AuthMiddleware, func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	r.POST("/token/refresh", handlers.TokenRefreshHandler)
+	get := func(token string) int {
+		req := httptest.NewRequest("GET", "/customers/"+customerID, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	db := dbtest.Install(t)
+	db.On("FROM `auth_tokens`", stored(old))
+	db.On("FROM `customers`", dbtest.Result{Columns: []string{"id", "name"}, Rows: [][]driver.Value{{customerID, "Customer"}}})
+	if code := get(old); code != http.StatusOK {
+		t.Fatalf("status before refresh = %d, want %d", code, http.StatusOK)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("POST", "/token/refresh", strings.NewReader(`{"refresh_token": "refresh-token"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("refresh status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+
+	// The refreshed token is the JWT saved in place of the old one
+	var refreshed string
+	for _, query := range db.Queries() {
+		if !strings.HasPrefix(query.SQL, "INSERT INTO `auth_tokens`") {
+			continue
+		}
+		for _, arg := range query.Args {
+			if s, ok := arg.(string); ok {
+				if _, err := serverutils.ValidateJWT(s); err == nil {
+					refreshed = s
+				}
+			}
+		}
+	}
+	if refreshed == "" || refreshed == old {
+		t.Fatalf("refreshed token = %q, want a new one", refreshed)
+	}
+
+	db = dbtest.Install(t)
+	db.On("FROM `auth_tokens`", stored(refreshed))
+	if code := get(old); code != http.StatusUnauthorized {
+		t.Errorf("status with the old token = %d, want %d", code, http.StatusUnauthorized)
+	}
+	if code := get(refreshed); code != http.StatusOK {
+		t.Errorf("status with the refreshed token = %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestAuthMiddlewareAPIKey(t *testing.T) {
+	customerID, siteID := uuid.NewString(), uuid.NewString()
+	apiKey := func(scopes string) dbtest.Result {
+		return dbtest.Result{
+			Columns: []string{"id", "customer_id", "site_id", "name", "scopes"},
+			Rows:    [][]driver.Value{{uuid.NewString(), customerID, siteID, "BMS gateway", scopes}},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		route  string
+		apiKey dbtest.Result
+		want   int
+	}{
+		{name: "unknown key", method: "GET", route: "/devices/:device_serial_number", want: http.StatusUnauthorized},
+		{name: "read", method: "GET", route: "/devices/:device_serial_number", apiKey: apiKey("read"), want: http.StatusOK},
+		{name: "read with write scope only", method: "GET", route: "/devices/:device_serial_number", apiKey: apiKey("devices:write"), want: http.StatusForbidden},
+		{name: "read by post", method: "POST", route: "/devices/batch-get", apiKey: apiKey("read"), want: http.StatusOK},
+		{name: "status report", method: "POST", route: "/devices/:device_serial_number/status", apiKey: apiKey("read,devices:write"), want: http.StatusOK},
+		{name: "status report without scope", method: "POST", route: "/devices/:device_serial_number/status", apiKey: apiKey("read"), want: http.StatusForbidden},
+		{name: "route without scope", method: "DELETE", route: "/devices/:device_serial_number", apiKey: apiKey("read,devices:write,filters:write"), want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := dbtest.Install(t)
+			db.On("FROM `api_keys`", tt.apiKey)
+
+			var role, gotCustomer, gotSite string
+			r := gin.New()
+			r.Handle(tt.method, tt.route, AuthMiddleware, ScopeMiddleware, func(c *gin.Context) {
+				role, gotCustomer, gotSite = c.GetString("role"), c.GetString("customer_id"), c.GetString("site_id")
+				c.Status(http.StatusOK)
+			})
+
+			path := strings.ReplaceAll(tt.route, ":device_serial_number", "SN-1")
+			req := httptest.NewRequest(tt.method, path, nil)
+			req.Header.Set(serverutils.APIKeyHeader, "bms_key")
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want == http.StatusOK && (role != "user" || gotCustomer != customerID || gotSite != siteID) {
+				t.Errorf("role, customer_id, site_id = %q, %q, %q, want user, %q, %q", role, gotCustomer, gotSite, customerID, siteID)
+			}
+		})
+	}
+}
+
+func TestScopeMiddleware(t *testing.T) {
+	tests := []struct {
+		name   string
+		action string
+		method string
+		route  string
+		want   int
+	}{
+		{name: "admin write", action: "ADMIN", method: "DELETE", route: "/devices/:device_serial_number", want: http.StatusOK},
+		{name: "read", action: "READ", method: "GET", route: "/devices/:device_serial_number", want: http.StatusOK},
+		{name: "read by post", action: "READ", method: "POST", route: "/devices/batch-get", want: http.StatusOK},
+		{name: "read-only status report", action: "READ", method: "POST", route: "/devices/:device_serial_number/status", want: http.StatusForbidden},
+		{name: "read-only admin write", action: "READ", method: "DELETE", route: "/devices/:device_serial_number", want: http.StatusForbidden},
+		{name: "integration status report", action: "DSE_890_API", method: "POST", route: "/devices/:device_serial_number/status", want: http.StatusOK},
+		{name: "integration admin write", action: "DSE_890_API", method: "DELETE", route: "/devices/:device_serial_number", want: http.StatusForbidden},
+		{name: "unknown action", action: "UNKNOWN", method: "GET", route: "/devices/:device_serial_number", want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.Handle(tt.method, tt.route, func(c *gin.Context) {
+				c.Set("scopes", serverutils.ActionScopes(tt.action))
+			}, ScopeMiddleware, func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(tt.method, strings.ReplaceAll(tt.route, ":device_serial_number", "SN-1"), nil))
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestGatewayAuthMiddleware(t *testing.T) {
+	t.Setenv("DEVICES_SERVER_JWT_SECRET", "secret")
+	customerID, siteID := uuid.NewString(), uuid.NewString()
+
+	gateway, err := serverutils.GenerateGatewayJWT(customerID, siteID, "GW-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	customer, err := serverutils.GenerateSiteJWT(customerID, siteID, "Customer", "user", "DSE_890_API", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		stored bool
+		want   int
+	}{
+		{name: "missing token", want: http.StatusUnauthorized},
+		{name: "customer token", header: "Bearer " + customer, stored: true, want: http.StatusUnauthorized},
+		{name: "revoked credential", header: "Bearer " + gateway, want: http.StatusUnauthorized},
+		{name: "gateway credential", header: "Bearer " + gateway, stored: true, want: http.StatusOK},
+		{name: "lowercase scheme", header: "bearer " + gateway, stored: true, want: http.StatusOK},
+		{name: "other scheme", header: "Basic " + gateway, stored: true, want: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gatewayID := uuid.NewString()
+			db := dbtest.Install(t)
+			if tt.stored {
+				db.On("FROM `gateway_credentials`", dbtest.Result{
+					Columns: []string{"id", "customer_id", "site_id", "gateway", "token", "gateway_id"},
+					Rows:    [][]driver.Value{{uuid.NewString(), customerID, siteID, "GW-01", gateway, gatewayID}},
+				})
+			}
+
+			var gotSite, gotGateway string
+			r := gin.New()
+			r.GET("/gateway/devices", GatewayAuthMiddleware, func(c *gin.Context) {
+				gotSite, gotGateway = c.GetString("site_id"), c.GetString("gateway")
+				c.Status(http.StatusOK)
+			})
+
+			req := httptest.NewRequest("GET", "/gateway/devices", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if tt.want == http.StatusOK && (gotSite != siteID || gotGateway != "GW-01") {
+				t.Errorf("site_id, gateway = %q, %q, want %q, GW-01", gotSite, gotGateway, siteID)
+			}
+
+			seen := slices.ContainsFunc(db.Queries(), func(query dbtest.Query) bool {
+				return strings.HasPrefix(query.SQL, "UPDATE `gateways` SET `last_seen_at`") && slices.Contains(query.Args, driver.Value(gatewayID))
+			})
+			if seen != (tt.want == http.StatusOK) {
+				t.Errorf("gateway last seen recorded = %v, want %v", seen, tt.want == http.StatusOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/johandrevandeventer/devices-api-server/internal/config/app"
+	"go.uber.org/zap"
+)
+
+// redactedKeys are JSON keys whose values are never logged, matched case-insensitively as substrings
+var redactedKeys = []string{
+	"token",
+	"secret",
+	"password",
+	"authorization",
+}
+
+// payloadLogWriter keeps a capped copy of the response body while writing it
+type payloadLogWriter struct {
+	gin.ResponseWriter
+	body     *bytes.Buffer
+	maxBytes int
+}
+
+func (w *payloadLogWriter) Write(b []byte) (int, error) {
+	if remaining := w.maxBytes - w.body.Len(); remaining > 0 {
+		w.body.Write(b[:min(len(b), remaining)])
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// payloadLoggingMiddleware logs the request and response bodies of the configured routes
+// with secrets redacted and bodies capped at the configured size
+func payloadLoggingMiddleware(logger *zap.Logger, cfg app.PayloadLoggingConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !payloadRouteEnabled(cfg.Routes, c.Request.Method, c.FullPath()) {
+			c.Next()
+			return
+		}
+
+		// Read up to the cap for logging and hand the full body on to the handler
+		var requestBody []byte
+		if c.Request.Body != nil {
+			requestBody, _ = io.ReadAll(io.LimitReader(c.Request.Body, int64(cfg.MaxBodyBytes)))
+			c.Request.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(requestBody), c.Request.Body), c.Request.Body}
+		}
+
+		writer := &payloadLogWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}, maxBytes: cfg.MaxBodyBytes}
+		c.Writer = writer
+
+		c.Next()
+
+		logger.Debug("Request payload",
+			zap.String("method", c.Request.Method),
+			zap.String("path", c.Request.URL.Path),
+			zap.String("customerID", c.GetString("customer_id")),
+			zap.String("requestBody", redactPayload(requestBody)),
+			zap.Int("statusCode", c.Writer.Status()),
+			zap.String("responseBody", redactPayload(writer.body.Bytes())),
+		)
+	}
+}
+
+// payloadRouteEnabled checks if payload logging is enabled for the route.
+// Routes are matched as "METHOD /path/:param" or "/path/:param", an empty list enables all routes.
+func payloadRouteEnabled(routes []string, method, fullPath string) bool {
+	if len(routes) == 0 {
+		return true
+	}
+
+	for _, route := range routes {
+		if route == fullPath || route == method+" "+fullPath {
+			return true
+		}
+	}
+
+	return false
+}
+
+// redactPayload returns the payload with the values of secret JSON keys replaced
+func redactPayload(payload []byte) string {
+	if len(payload) == 0 {
+		return ""
+	}
+
+	var data any
+	if err := json.Unmarshal(payload, &data); err != nil {
+		// Not (complete) JSON, so there are no keys to redact by
+		return "<non-JSON or truncated payload omitted>"
+	}
+
+	redacted, err := json.Marshal(redactValue(data))
+	if err != nil {
+		return "<unencodable payload omitted>"
+	}
+
+	return string(redacted)
+}
+
+// redactValue walks a decoded JSON value and replaces the values of secret keys
+func redactValue(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, inner := range v {
+			if isRedactedKey(key) {
+				v[key] = "<redacted>"
+				continue
+			}
+			v[key] = redactValue(inner)
+		}
+		return v
+	case []any:
+		for i, inner := range v {
+			v[i] = redactValue(inner)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// isRedactedKey checks if the key names a secret
+func isRedactedKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, redactedKey := range redactedKeys {
+		if strings.Contains(key, redactedKey) {
+			return true
+		}
+	}
+	return false
+}
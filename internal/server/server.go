@@ -1,14 +1,22 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/johandrevandeventer/devices-api-server/internal/config/app"
+	"github.com/johandrevandeventer/devices-api-server/internal/flags"
+	"github.com/johandrevandeventer/devices-api-server/internal/metrics"
 	"github.com/johandrevandeventer/devices-api-server/internal/server/handlers"
 	serverutils "github.com/johandrevandeventer/devices-api-server/internal/server/utils"
+	"github.com/johandrevandeventer/devices-api-server/internal/status"
+	coreutils "github.com/johandrevandeventer/devices-api-server/utils"
 	"github.com/johandrevandeventer/logging"
 	"go.uber.org/zap"
 )
@@ -17,6 +25,15 @@ import (
 type APIServer struct {
 	listenAddr string
 	logger     *zap.Logger
+	profile    app.ProfileConfig
+	payloads   app.PayloadLoggingConfig
+	qos        app.QoSConfig
+	deadline   app.RequestDeadlineConfig
+	meta       app.ResponseMetaConfig
+	httpServer *http.Server
+
+	// metricsServer serves /metrics on its own port, nil if metrics are served behind the admin secret
+	metricsServer *http.Server
 }
 
 // Custom writer to redirect logs
@@ -30,31 +47,79 @@ func (w zapRedirectWriter) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
-func NewApiServer() *APIServer {
+func NewApiServer(profile app.ProfileConfig, payloads app.PayloadLoggingConfig, qos app.QoSConfig, deadline app.RequestDeadlineConfig, meta app.ResponseMetaConfig) *APIServer {
 	logger := logging.GetLogger("api-server")
 
-	port := os.Getenv("DEVICES_SERVER_PORT")
+	// The --port flag takes precedence over the environment
+	port := flags.FlagPort
+	if port == "" {
+		port = os.Getenv("DEVICES_SERVER_PORT")
+	}
 	if port == "" {
 		logger.Fatal("PORT environment variable is not set")
 	}
 
+	listenAddr := fmt.Sprintf(":%s", port)
+
+	// Metrics can be served on a port that is only reachable from the monitoring network
+	var metricsServer *http.Server
+	if metricsPort := os.Getenv("DEVICES_SERVER_METRICS_PORT"); metricsPort != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		metricsServer = &http.Server{
+			Addr:     fmt.Sprintf(":%s", metricsPort),
+			Handler:  mux,
+			ErrorLog: zap.NewStdLog(logger),
+		}
+	}
+
 	return &APIServer{
-		listenAddr: fmt.Sprintf(":%s", port),
+		listenAddr: listenAddr,
 		logger:     logger,
+		profile:    profile,
+		payloads:   payloads,
+		qos:        qos,
+		deadline:   deadline,
+		meta:       meta,
+		// Create a custom HTTP server, the handler is set when the server starts
+		httpServer: &http.Server{
+			Addr:     listenAddr,
+			ErrorLog: zap.NewStdLog(logger), // Redirect server logs to zap logger
+			// Client certificates are requested but not verified, so tokens bound to a certificate
+			// thumbprint can be checked against the one presented
+			TLSConfig: &tls.Config{ClientAuth: tls.RequestClientCert},
+		},
+		metricsServer: metricsServer,
 	}
 }
 
 // Start the API server
 func (s *APIServer) Start() {
-	gin.SetMode(gin.ReleaseMode)
+	switch s.profile.GinMode {
+	case gin.DebugMode, gin.ReleaseMode, gin.TestMode:
+		gin.SetMode(s.profile.GinMode)
+	default:
+		gin.SetMode(gin.ReleaseMode)
+	}
+
 	gin.DefaultWriter = zapRedirectWriter{logger: s.logger}      // Redirects Gin debug logs
 	gin.DefaultErrorWriter = zapRedirectWriter{logger: s.logger} // Redirects Gin error logs
 
 	r := gin.New()
 
 	// Middleware
+	r.Use(requestMetaMiddleware(s.meta))
+	r.Use(inFlightMiddleware)
 	r.Use(loggingMiddleware(s.logger))
-	r.Use(gin.Recovery())
+
+	// Payload logging is opt-in and only active in debug mode
+	if s.payloads.Enabled && flags.FlagDebugMode {
+		r.Use(payloadLoggingMiddleware(s.logger, s.payloads))
+	}
+	r.Use(recoveryMiddleware(s.logger))
+	r.Use(deadlineMiddleware(s.deadline))
+	r.Use(featuresMiddleware)
+	r.Use(readOnlyMiddleware)
 
 	// Handle 404 (Not Found)
 	r.NoRoute(notFoundHandler())
@@ -65,30 +130,56 @@ func (s *APIServer) Start() {
 	// Setup the routes
 	s.setupRoutes(r)
 
+	server := s.httpServer
+	server.Handler = r
+
+	if s.metricsServer != nil {
+		status.Go("metrics-server", s.startMetrics)
+	}
+
 	// Start the server with HTTPS
 	certFile := "server.crt"
 	keyFile := "server.key"
 
-	if _, err := os.Stat(certFile); os.IsNotExist(err) {
-		s.logger.Fatal("Certificate file not found", zap.String("certFile", certFile))
-	}
-	if _, err := os.Stat(keyFile); os.IsNotExist(err) {
-		s.logger.Fatal("Private key file not found", zap.String("keyFile", keyFile))
-	}
+	if !coreutils.FileExists(certFile) || !coreutils.FileExists(keyFile) {
+		if s.profile.EnforceTLS {
+			s.logger.Fatal("Certificate or private key file not found", zap.String("certFile", certFile), zap.String("keyFile", keyFile))
+		}
 
-	// Create a custom HTTP server with TLS
-	server := &http.Server{
-		Addr:     s.listenAddr,
-		Handler:  r,
-		ErrorLog: zap.NewStdLog(s.logger), // Redirect server logs to zap logger
+		// TLS is not enforced in this environment, fall back to plain HTTP
+		s.logger.Warn("Certificate or private key file not found, starting HTTP server without TLS", zap.String("port", s.listenAddr))
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Fatal("Failed to start HTTP server", zap.Error(err))
+		}
+		return
 	}
 
 	s.logger.Info("Starting HTTPS server", zap.String("port", s.listenAddr))
-	if err := server.ListenAndServeTLS(certFile, keyFile); err != nil {
+	if err := server.ListenAndServeTLS(certFile, keyFile); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		s.logger.Fatal("Failed to start HTTPS server", zap.Error(err))
 	}
 }
 
+// startMetrics serves the metrics on their own port over plain HTTP
+func (s *APIServer) startMetrics() {
+	s.logger.Info("Starting metrics server", zap.String("port", s.metricsServer.Addr))
+	if err := s.metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		s.logger.Error("Failed to start metrics server", zap.Error(err))
+	}
+}
+
+// Shutdown gracefully stops the server, waiting for in-flight requests until the context expires
+func (s *APIServer) Shutdown(ctx context.Context) error {
+	if s.metricsServer != nil {
+		if err := s.metricsServer.Shutdown(ctx); err != nil {
+			s.logger.Warn("Failed to stop metrics server", zap.Error(err))
+		}
+	}
+
+	s.logger.Info("Stopping HTTP server")
+	return s.httpServer.Shutdown(ctx)
+}
+
 // Setup the routes
 func (s *APIServer) setupRoutes(r *gin.Engine) {
 	adminSecret := os.Getenv("DEVICES_SERVER_ADMIN_SECRET")
@@ -98,42 +189,198 @@ func (s *APIServer) setupRoutes(r *gin.Engine) {
 
 	r.GET("/health", handlers.HealthHandler)
 
+	// Metrics reveal customer traffic, so without a metrics port they need the admin secret
+	if s.metricsServer == nil {
+		r.GET("/metrics", AdminMiddleware(adminSecret), gin.WrapH(metrics.Handler()))
+	}
+
 	adminGroup := r.Group("/admin")
 	adminGroup.Use(AdminMiddleware(adminSecret))
 	{
 		adminGroup.POST("/generate-admin-token", handlers.GenerateAdminTokenHandler)
 		adminGroup.POST("/generate-token", handlers.GenerateTokenHandler)
+		adminGroup.POST("/impersonate/:customer_id", handlers.ImpersonateHandler)
+		adminGroup.GET("/cache", handlers.CacheStatsHandler)
+		adminGroup.GET("/status", handlers.StatusHandler)
+		adminGroup.GET("/stats/history", handlers.FleetHistory)
+		adminGroup.GET("/crashes", handlers.CrashFetchRecent)
+		adminGroup.GET("/read-only", handlers.ReadOnlyFetch)
+		adminGroup.PUT("/read-only", handlers.ReadOnlySet)
+		adminGroup.GET("/customers/:customer_id/billing-report", handlers.BillingReport)
+		adminGroup.POST("/clone-customer", handlers.CloneCustomer)
+		adminGroup.GET("/integrity-check", handlers.IntegrityCheck)
+		adminGroup.POST("/integrity-check/repair", handlers.IntegrityRepair)
+		adminGroup.POST("/gateway-credentials", handlers.GatewayCredentialIssue)
+		adminGroup.DELETE("/gateway-credentials/:credential_id", handlers.GatewayCredentialRevoke)
+		adminGroup.POST("/gateways/:gateway_id/credentials", handlers.GatewayCredentialRotate)
+
+		// API key routes
+		adminGroup.POST("/api-keys", handlers.APIKeyCreate)
+		adminGroup.GET("/customers/:customer_id/api-keys", handlers.APIKeyFetchByCustomerID)
+		adminGroup.POST("/api-keys/:key_id/rotate", handlers.APIKeyRotate)
+		adminGroup.DELETE("/api-keys/:key_id", handlers.APIKeyRevoke)
+
+		// Device template routes
+		adminGroup.POST("/templates", handlers.TemplateCreate)
+		adminGroup.GET("/templates", handlers.TemplateFetchAll)
+		adminGroup.GET("/templates/:template_id", handlers.TemplateFetchByID)
+		adminGroup.PUT("/templates/:template_id", handlers.TemplateUpdate)
+		adminGroup.DELETE("/templates/:template_id", handlers.TemplateDelete)
 	}
 
 	// Authenticate
 	r.POST("/authenticate", handlers.AuthenticateHandler)
+	r.POST("/token/refresh", handlers.TokenRefreshHandler)
+
+	// Edge gateways register the devices they host with their own credential instead of a customer token
+	gatewayGroup := r.Group("/gateway")
+	gatewayGroup.Use(GatewayAuthMiddleware, usageMiddleware, transactionMiddleware(s.logger))
+	{
+		gatewayGroup.GET("/devices", handlers.GatewayDeviceFetch)
+		gatewayGroup.PUT("/devices", handlers.GatewayDeviceRegister)
+	}
 
 	protectedGroup := r.Group("")
-	protectedGroup.Use(AuthMiddleware)
+	protectedGroup.Use(AuthMiddleware, ScopeMiddleware, SiteScopeMiddleware, usageMiddleware)
+
+	// Prioritization is opt-in and needs the customer set by the auth middleware
+	if s.qos.Enabled {
+		protectedGroup.Use(qosMiddleware(s.qos))
+	}
+
+	// Mutations only hold a database connection once they are authenticated and admitted
+	protectedGroup.Use(transactionMiddleware(s.logger))
 	{
 		// Customer routes
 		protectedGroup.POST("/customers", AdminOnlyMiddleware, handlers.CustomerCreate)
 		protectedGroup.GET("/customers", AdminOnlyMiddleware, handlers.CustomerFetchAll)
+		protectedGroup.POST("/customers/batch-get", handlers.CustomerBatchGet)
+		protectedGroup.POST("/customers/import", AdminOnlyMiddleware, handlers.CustomerImport)
+		protectedGroup.GET("/customers/by-ref/:ref", handlers.CustomerFetchByRef)
+		protectedGroup.GET("/customers/deleted", AdminOnlyMiddleware, handlers.CustomerFetchDeleted)
 		protectedGroup.GET("/customers/:customer_id", handlers.CustomerFetchByID)
 		protectedGroup.PUT("/customers/:customer_id", AdminOnlyMiddleware, handlers.CustomerUpdate)
+		protectedGroup.PATCH("/customers/:customer_id", AdminOnlyMiddleware, handlers.CustomerPatch)
 		protectedGroup.DELETE("/customers/:customer_id", AdminOnlyMiddleware, handlers.CustomerDelete)
+		protectedGroup.POST("/customers/:customer_id/restore", AdminOnlyMiddleware, handlers.CustomerRestore)
+		protectedGroup.GET("/customers/:customer_id/export", AdminOnlyMiddleware, handlers.CustomerExport)
 
 		// Site routes
 		protectedGroup.POST("/customers/:customer_id/sites", AdminOnlyMiddleware, handlers.SiteCreate)
+		protectedGroup.POST("/customers/:customer_id/sites/bulk", AdminOnlyMiddleware, handlers.SiteBulkCreate)
 		protectedGroup.GET("/customers/:customer_id/sites", handlers.SiteFetchByCustomerID)
+		protectedGroup.GET("/customers/:customer_id/stats", handlers.CustomerStats)
+		protectedGroup.GET("/customers/:customer_id/tree", handlers.CustomerTree)
+		protectedGroup.GET("/customers/:customer_id/settings", handlers.CustomerSettingsFetch)
+		protectedGroup.PUT("/customers/:customer_id/settings", AdminOnlyMiddleware, handlers.CustomerSettingsUpdate)
 		protectedGroup.GET("/sites", AdminOnlyMiddleware, handlers.SiteFetchAll)
+		protectedGroup.GET("/sites/search", handlers.SiteSearch)
+		protectedGroup.POST("/sites/batch-get", handlers.SiteBatchGet)
 		protectedGroup.GET("/sites/:site_id", handlers.SiteFetchByID)
 		protectedGroup.PUT("/sites/:site_id", AdminOnlyMiddleware, handlers.SiteUpdate)
+		protectedGroup.PATCH("/sites/:site_id", AdminOnlyMiddleware, handlers.SiteUpdate)
 		protectedGroup.DELETE("/sites/:site_id", AdminOnlyMiddleware, handlers.SiteDelete)
+		protectedGroup.GET("/sites/:site_id/handover-package", handlers.SiteHandoverPackage)
+		protectedGroup.GET("/sites/:site_id/health", handlers.SiteHealth)
+		protectedGroup.GET("/sites/:site_id/energy/daily", handlers.SiteEnergyDaily)
+		protectedGroup.GET("/sites/:site_id/energy/monthly", handlers.SiteEnergyMonthly)
 
 		// Device routes
 		protectedGroup.POST("/customers/:customer_id/sites/:site_id/devices", AdminOnlyMiddleware, handlers.DeviceCreate)
+		protectedGroup.POST("/customers/:customer_id/sites/:site_id/devices/from-template", AdminOnlyMiddleware, handlers.DeviceCreateFromTemplate)
 		protectedGroup.GET("/devices", handlers.DeviceFetchAll)
+		protectedGroup.GET("/devices/search", handlers.DeviceSearch)
+		protectedGroup.GET("/devices/export", handlers.DeviceExport)
+		protectedGroup.GET("/devices/deleted", AdminOnlyMiddleware, handlers.DeviceFetchDeleted)
+		protectedGroup.POST("/devices/import", AdminOnlyMiddleware, handlers.DeviceImport)
+		protectedGroup.POST("/devices/batch-get", handlers.DeviceBatchGet)
+		protectedGroup.GET("/devices/changes/poll", handlers.DeviceChangesPoll)
 		protectedGroup.GET("/customers/:customer_id/devices", handlers.DeviceFetchByCustomerID)
 		protectedGroup.GET("/sites/:site_id/devices", handlers.DeviceFetchBySiteID)
 		protectedGroup.GET("/devices/:device_serial_number", handlers.DeviceFetchBySerialNumber)
+		protectedGroup.GET("/customers/:customer_id/devices/:device_serial_number", handlers.DeviceFetchBySerialNumber)
+		protectedGroup.PUT("/customers/:customer_id/devices/:device_serial_number", AdminOnlyMiddleware, handlers.DeviceUpdate)
+		protectedGroup.DELETE("/customers/:customer_id/devices/:device_serial_number", AdminOnlyMiddleware, handlers.DeviceDelete)
 		protectedGroup.PUT("/devices/:device_serial_number", AdminOnlyMiddleware, handlers.DeviceUpdate)
+		protectedGroup.GET("/devices/:device_serial_number/credentials", AdminOnlyMiddleware, handlers.DeviceCredentialsFetch)
 		protectedGroup.DELETE("/devices/:device_serial_number", AdminOnlyMiddleware, handlers.DeviceDelete)
+		protectedGroup.POST("/devices/:device_serial_number/restore", AdminOnlyMiddleware, handlers.DeviceRestore)
+		protectedGroup.DELETE("/devices/:device_serial_number/purge", AdminOnlyMiddleware, handlers.DevicePurge)
+		protectedGroup.DELETE("/devices", AdminOnlyMiddleware, handlers.DeviceBulkDelete)
+		protectedGroup.PUT("/registrations/devices", AdminOnlyMiddleware, handlers.DeviceRegister)
+
+		// Device topology routes
+		protectedGroup.POST("/devices/:device_serial_number/dependencies", AdminOnlyMiddleware, handlers.DeviceDependencyCreate)
+		protectedGroup.GET("/devices/:device_serial_number/dependencies", handlers.DeviceDependencyFetch)
+		protectedGroup.DELETE("/devices/:device_serial_number/dependencies/:dependency_id", AdminOnlyMiddleware, handlers.DeviceDependencyDelete)
+		protectedGroup.GET("/devices/:device_serial_number/impact", handlers.DeviceImpact)
+		protectedGroup.GET("/controllers/:controller_serial_number/impact", handlers.ControllerImpact)
+
+		// Controller routes
+		protectedGroup.GET("/sites/:site_id/controllers", handlers.ControllerFetchBySiteID)
+		protectedGroup.POST("/sites/:site_id/controllers", AdminOnlyMiddleware, handlers.ControllerCreate)
+		protectedGroup.GET("/sites/:site_id/controllers/:controller_serial_number", handlers.ControllerFetchBySerialNumber)
+		protectedGroup.PUT("/sites/:site_id/controllers/:controller_serial_number", AdminOnlyMiddleware, handlers.ControllerUpdate)
+		protectedGroup.DELETE("/sites/:site_id/controllers/:controller_serial_number", AdminOnlyMiddleware, handlers.ControllerDelete)
+
+		// Tag routes
+		protectedGroup.GET("/tags", AdminOnlyMiddleware, handlers.TagFetchAll)
+		protectedGroup.GET("/devices/:device_serial_number/tags", handlers.DeviceTagFetch)
+		protectedGroup.POST("/devices/:device_serial_number/tags", AdminOnlyMiddleware, handlers.DeviceTagAdd)
+		protectedGroup.DELETE("/devices/:device_serial_number/tags/:tag", AdminOnlyMiddleware, handlers.DeviceTagRemove)
+		protectedGroup.GET("/tag-rules", AdminOnlyMiddleware, handlers.TagRuleFetchAll)
+		protectedGroup.POST("/tag-rules", AdminOnlyMiddleware, handlers.TagRuleCreate)
+		protectedGroup.DELETE("/tag-rules/:rule_id", AdminOnlyMiddleware, handlers.TagRuleDelete)
+
+		// Saved filter routes
+		protectedGroup.GET("/filters", handlers.SavedFilterFetchAll)
+		protectedGroup.POST("/filters", handlers.SavedFilterCreate)
+		protectedGroup.DELETE("/filters/:filter_id", handlers.SavedFilterDelete)
+		protectedGroup.GET("/filters/:filter_id/devices", handlers.SavedFilterDevices)
+
+		// Meter routes
+		protectedGroup.PUT("/devices/:device_serial_number/meter", AdminOnlyMiddleware, handlers.DeviceMeterSet)
+		protectedGroup.GET("/devices/:device_serial_number/meter", handlers.DeviceMeterFetch)
+		protectedGroup.DELETE("/devices/:device_serial_number/meter", AdminOnlyMiddleware, handlers.DeviceMeterDelete)
+
+		// Point address routes
+		protectedGroup.GET("/controllers/:controller_serial_number/points", AdminOnlyMiddleware, handlers.PointAddressExport)
+		protectedGroup.PUT("/controllers/:controller_serial_number/points", AdminOnlyMiddleware, handlers.PointAddressImport)
+
+		// Device status routes
+		protectedGroup.POST("/devices/:device_serial_number/status", handlers.DeviceStatusReport)
+		protectedGroup.GET("/devices/:device_serial_number/status", handlers.DeviceStatusFetch)
+		protectedGroup.GET("/devices/:device_serial_number/status/history", handlers.DeviceStatusHistory)
+		protectedGroup.GET("/devices/:device_serial_number/latest", handlers.DeviceLatestReadings)
+
+		// Statistics routes
+		protectedGroup.GET("/stats/devices", handlers.DeviceStats)
+
+		// Gateway routes
+		protectedGroup.GET("/gateways/presence", handlers.GatewayPresence)
+		protectedGroup.GET("/gateways/:gateway/summary", handlers.GatewaySummary)
+		protectedGroup.GET("/gateways/:gateway/devices", handlers.GatewayFetchDevices)
+		protectedGroup.GET("/sites/:site_id/gateways", handlers.GatewayFetchBySiteID)
+		protectedGroup.POST("/gateways/:gateway/presence", AdminOnlyMiddleware, handlers.GatewayPresenceReport)
+		protectedGroup.POST("/gateways/:gateway/replace", AdminOnlyMiddleware, handlers.GatewayReplace)
+
+		// Provisioning session routes
+		protectedGroup.POST("/provisioning-sessions", AdminOnlyMiddleware, handlers.ProvisioningSessionCreate)
+		protectedGroup.GET("/provisioning-sessions/:session_id", AdminOnlyMiddleware, handlers.ProvisioningSessionFetch)
+		protectedGroup.PUT("/provisioning-sessions/:session_id/site", AdminOnlyMiddleware, handlers.ProvisioningSessionSetSite)
+		protectedGroup.PUT("/provisioning-sessions/:session_id/gateway", AdminOnlyMiddleware, handlers.ProvisioningSessionSetGateway)
+		protectedGroup.POST("/provisioning-sessions/:session_id/devices", AdminOnlyMiddleware, handlers.ProvisioningSessionAddDevices)
+		protectedGroup.POST("/provisioning-sessions/:session_id/tokens", AdminOnlyMiddleware, handlers.ProvisioningSessionAddTokens)
+		protectedGroup.POST("/provisioning-sessions/:session_id/commit", AdminOnlyMiddleware, handlers.ProvisioningSessionCommit)
+		protectedGroup.POST("/provisioning-sessions/:session_id/abort", AdminOnlyMiddleware, handlers.ProvisioningSessionAbort)
+
+		// Action routes
+		protectedGroup.GET("/meta/actions", handlers.ActionFetchAll)
+
+		// Event schema routes
+		protectedGroup.GET("/meta/event-schemas", handlers.EventSchemaFetchAll)
+		protectedGroup.GET("/meta/event-schemas/:event", handlers.EventSchemaFetchVersions)
+		protectedGroup.GET("/meta/event-schemas/:event/:version", handlers.EventSchemaFetch)
 	}
 }
 
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/johandrevandeventer/devices-api-server/internal/dbtest"
+	"github.com/johandrevandeventer/devices-api-server/internal/fixtures"
+	"go.uber.org/zap"
+)
+
+// TestEveryRouteHasFixture checks that the contract fixtures cover every route the server serves
+func TestEveryRouteHasFixture(t *testing.T) {
+	t.Setenv("DEVICES_SERVER_ADMIN_SECRET", "secret")
+	gin.SetMode(gin.TestMode)
+
+	r := gin.New()
+	(&APIServer{logger: zap.NewNop()}).setupRoutes(r)
+
+	covered := fixtures.Routes()
+	var served []string
+	for _, route := range r.Routes() {
+		name := route.Method + " " + route.Path
+		served = append(served, name)
+		if !slices.Contains(covered, name) {
+			t.Errorf("route %s has no fixture", name)
+		}
+	}
+
+	for _, name := range covered {
+		if !slices.Contains(served, name) {
+			t.Errorf("fixture for %s does not match a route", name)
+		}
+	}
+}
+
+// TestTransactionAfterAuth checks that mutations only open a transaction once they are authenticated
+func TestTransactionAfterAuth(t *testing.T) {
+	t.Setenv("DEVICES_SERVER_ADMIN_SECRET", "secret")
+	db := dbtest.Install(t)
+
+	r := gin.New()
+	(&APIServer{logger: zap.NewNop()}).setupRoutes(r)
+
+	for _, route := range []struct{ method, path string }{{"POST", "/customers"}, {"PUT", "/gateway/devices"}} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(route.method, route.path, strings.NewReader(`{}`)))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s: status = %d, want %d", route.method, route.path, w.Code, http.StatusUnauthorized)
+		}
+	}
+
+	if got := db.Transactions(); len(got) != 0 {
+		t.Errorf("transactions = %v, want none before authentication", got)
+	}
+}
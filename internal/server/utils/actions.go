@@ -1,7 +1,36 @@
 package serverutils
 
-var actions = []string{
-	"ADMIN",
-	"DSE_890_API",
-	"DEYE8_API",
+import "slices"
+
+// ActionAdmin is the action of admin tokens
+const ActionAdmin = "ADMIN"
+
+// Action is an action tokens can be issued for, with the scopes that limit the routes its tokens
+// reach. The role of the token still limits it further.
+type Action struct {
+	Name        string
+	Description string
+	Scopes      []string
+}
+
+var actions = []Action{
+	{Name: ActionAdmin, Description: "Admin tokens, which reach every route", Scopes: []string{ScopeAdmin}},
+	{Name: "DSE_890_API", Description: "DSE 890 controller integrations", Scopes: []string{ScopeRead, ScopeDevicesWrite, ScopeFiltersWrite}},
+	{Name: "DEYE8_API", Description: "Deye inverter integrations", Scopes: []string{ScopeRead, ScopeDevicesWrite, ScopeFiltersWrite}},
+	{Name: "READ", Description: "Read-only integrations and dashboards", Scopes: []string{ScopeRead}},
+}
+
+// Actions returns the actions tokens can be issued for
+func Actions() []Action {
+	return slices.Clone(actions)
+}
+
+// ActionScopes returns the scopes tokens issued for the action are granted, or nil for an unknown action
+func ActionScopes(action string) []string {
+	for _, a := range actions {
+		if a.Name == action {
+			return slices.Clone(a.Scopes)
+		}
+	}
+	return nil
 }
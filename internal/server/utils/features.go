@@ -0,0 +1,67 @@
+package serverutils
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// FeaturesHeader is the request header clients list the API features they opt in to in, separated by
+// commas. The response repeats the header with the features that were enabled.
+const FeaturesHeader = "X-API-Features"
+
+// FeatureOmitAuthToken leaves the deprecated auth_token field out of device responses
+const FeatureOmitAuthToken = "omit-auth-token"
+
+// features lists the response fields and behaviours clients can opt in to before they become the
+// default. A feature is removed once it is the default, and is then ignored when requested.
+var features = []string{
+	FeatureOmitAuthToken,
+}
+
+// featuresKey is the context key the features enabled for the request are stored under
+const featuresKey = "api_features"
+
+// Features returns the features clients can opt in to
+func Features() []string {
+	return slices.Clone(features)
+}
+
+// ParseFeatures returns the known features listed in the header value without duplicates, and the
+// features the server does not know
+func ParseFeatures(header string) (enabled, unknown []string) {
+	for _, name := range strings.Split(header, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch {
+		case name == "":
+		case !slices.Contains(features, name):
+			unknown = append(unknown, name)
+		case !slices.Contains(enabled, name):
+			enabled = append(enabled, name)
+		}
+	}
+	return enabled, unknown
+}
+
+// EnableFeatures enables the features listed in the X-API-Features header for the request, warning
+// about the features the server does not know rather than failing the request
+func EnableFeatures(c *gin.Context) {
+	enabled, unknown := ParseFeatures(c.GetHeader(FeaturesHeader))
+	for _, name := range unknown {
+		AddWarning(c, fmt.Sprintf("API feature %s is not known and was ignored", name))
+	}
+
+	if len(enabled) > 0 {
+		c.Set(featuresKey, enabled)
+		c.Header(FeaturesHeader, strings.Join(enabled, ", "))
+	}
+}
+
+// FeatureEnabled reports whether the client opted in to the feature for the request
+func FeatureEnabled(c *gin.Context, name string) bool {
+	enabled, _ := c.Get(featuresKey)
+	list, _ := enabled.([]string)
+	return slices.Contains(list, name)
+}
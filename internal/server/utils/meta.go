@@ -0,0 +1,61 @@
+package serverutils
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestIDHeader is the header the request ID is read from and sent back in. A request without a
+// usable ID, such as one not set by a gateway or proxy, gets a new one.
+const RequestIDHeader = "X-Request-ID"
+
+// Meta is the correlation data sent with JSON responses when response meta is enabled
+type Meta struct {
+	RequestID  string      `json:"request_id"`
+	DurationMS int64       `json:"duration_ms"`
+	Pagination *Pagination `json:"pagination,omitempty"`
+}
+
+// Context keys of the request ID, the time the request started and whether responses carry meta
+const (
+	requestIDKey    = "request_id"
+	requestStartKey = "request_start"
+	metaEnabledKey  = "response_meta"
+)
+
+// requestIDPattern matches the request IDs accepted from clients, which end up in logs and responses
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// StartRequest assigns the request its ID, taken from the X-Request-ID header when the client sent
+// a usable one, and records when it started. Responses of the request carry meta when withMeta is set.
+func StartRequest(c *gin.Context, withMeta bool) {
+	requestID := c.GetHeader(RequestIDHeader)
+	if !requestIDPattern.MatchString(requestID) {
+		requestID = GenerateID()
+	}
+
+	c.Set(requestIDKey, requestID)
+	c.Set(requestStartKey, time.Now())
+	c.Set(metaEnabledKey, withMeta)
+	c.Header(RequestIDHeader, requestID)
+}
+
+// RequestID returns the ID of the request, or an empty string if StartRequest has not been called
+func RequestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+// responseMeta returns the meta of the response, or nil unless response meta is enabled
+func responseMeta(c *gin.Context, pagination *Pagination) *Meta {
+	if !c.GetBool(metaEnabledKey) {
+		return nil
+	}
+
+	return &Meta{
+		RequestID:  RequestID(c),
+		DurationMS: time.Since(c.GetTime(requestStartKey)).Milliseconds(),
+		Pagination: pagination,
+	}
+}
@@ -0,0 +1,64 @@
+package serverutils
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultPerPage = 50
+	MaxPerPage     = 500
+)
+
+// Pagination describes the page of a list response
+type Pagination struct {
+	Page       int   `json:"page"`
+	PerPage    int   `json:"per_page"`
+	Total      int64 `json:"total"`
+	TotalPages int   `json:"total_pages"`
+}
+
+// ParsePagination reads the page and per_page query parameters.
+// It returns nil if neither is set, in which case the full list is returned.
+func ParsePagination(c *gin.Context) (*Pagination, error) {
+	pageParam, hasPage := c.GetQuery("page")
+	perPageParam, hasPerPage := c.GetQuery("per_page")
+	if !hasPage && !hasPerPage {
+		return nil, nil
+	}
+
+	pagination := &Pagination{Page: 1, PerPage: DefaultPerPage}
+
+	if hasPage {
+		page, err := strconv.Atoi(pageParam)
+		if err != nil || page < 1 {
+			return nil, errors.New("page must be a positive integer")
+		}
+		pagination.Page = page
+	}
+
+	if hasPerPage {
+		perPage, err := strconv.Atoi(perPageParam)
+		if err != nil || perPage < 1 || perPage > MaxPerPage {
+			return nil, errors.New("per_page must be an integer between 1 and " + strconv.Itoa(MaxPerPage))
+		}
+		pagination.PerPage = perPage
+	}
+
+	return pagination, nil
+}
+
+// Apply counts the rows of the query and limits it to the requested page
+func (p *Pagination) Apply(query *gorm.DB) (*gorm.DB, error) {
+	// Count over a derived table so the select list and ordering of the query are kept intact
+	if err := query.Session(&gorm.Session{NewDB: true}).Table("(?) AS page_rows", query).Count(&p.Total).Error; err != nil {
+		return nil, err
+	}
+
+	p.TotalPages = int((p.Total + int64(p.PerPage) - 1) / int64(p.PerPage))
+
+	return query.Offset((p.Page - 1) * p.PerPage).Limit(p.PerPage), nil
+}
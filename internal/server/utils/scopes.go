@@ -0,0 +1,40 @@
+package serverutils
+
+import "slices"
+
+// APIKeyHeader is the request header API keys are sent in
+const APIKeyHeader = "X-API-Key"
+
+// APIKeyAction is the action of requests authenticated with an API key. It is not an action tokens
+// can be issued for.
+const APIKeyAction = "API_KEY"
+
+// Scopes tokens and API keys are granted through their action or by the key. A token or key never
+// reaches further than its role allows.
+const (
+	// ScopeAdmin allows every request. It is only granted to admin tokens.
+	ScopeAdmin = "admin"
+	// ScopeRead allows the requests that do not change anything
+	ScopeRead = "read"
+	// ScopeDevicesWrite allows reporting the status of devices
+	ScopeDevicesWrite = "devices:write"
+	// ScopeFiltersWrite allows creating and deleting saved filters
+	ScopeFiltersWrite = "filters:write"
+)
+
+// scopes lists the scopes API keys can be granted
+var scopes = []string{
+	ScopeRead,
+	ScopeDevicesWrite,
+	ScopeFiltersWrite,
+}
+
+// Scopes returns the scopes API keys can be granted
+func Scopes() []string {
+	return slices.Clone(scopes)
+}
+
+// IsValidScope reports whether API keys can be granted the scope
+func IsValidScope(scope string) bool {
+	return slices.Contains(scopes, scope)
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"os"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -15,31 +16,61 @@ import (
 	"go.uber.org/zap"
 )
 
+// NDJSONContentType is the media type of newline-delimited JSON responses.
+const NDJSONContentType = "application/x-ndjson"
+
 // Response structure for JSON responses.
 type Response struct {
-	Status  int    `json:"status"`
-	Message string `json:"message,omitempty"`
-	Data    any    `json:"data,omitempty"`
-	Error   string `json:"error,omitempty"`
+	Status     int         `json:"status"`
+	Message    string      `json:"message,omitempty"`
+	Data       any         `json:"data,omitempty"`
+	Pagination *Pagination `json:"pagination,omitempty"`
+	Warnings   []string    `json:"warnings,omitempty"`
+	Error      string      `json:"error,omitempty"`
+	Meta       *Meta       `json:"meta,omitempty"`
 }
 
+// warningsKey is the context key the warnings of a response are collected under
+const warningsKey = "warnings"
+
 // Claims represents the structure of the JWT claims for the admin route.
 type Claims struct {
 	UserID   string `json:"user_id"`
 	Username string `json:"user_name"`
 	Role     string `json:"role"`
 	Action   string `json:"action"`
+	SiteID   string `json:"site_id,omitempty"`
 	Issuer   string `json:"issuer"`
 	IssuedAt int64  `json:"issued_at"`
+	// ImpersonatedBy names the support operator acting as the customer with an impersonation token
+	ImpersonatedBy string `json:"impersonated_by,omitempty"`
+	// Gateway names the edge gateway a gateway token was issued for
+	Gateway string `json:"gateway,omitempty"`
 	jwt.RegisteredClaims
 }
 
 // WriteJSON sends a JSON response with the provided status code, message, and data.
 func WriteJSON(c *gin.Context, status int, message string, data any) {
 	response := Response{
-		Status:  status,
-		Message: message,
-		Data:    data,
+		Status:   status,
+		Message:  message,
+		Data:     data,
+		Warnings: Warnings(c),
+		Meta:     responseMeta(c, nil),
+	}
+
+	c.JSON(status, response)
+}
+
+// WriteJSONPage sends a JSON response for a list, including the pagination if the list was paginated.
+func WriteJSONPage(c *gin.Context, status int, message string, data any, pagination *Pagination) {
+	response := Response{
+		Status:     status,
+		Message:    message,
+		Data:       data,
+		Pagination: pagination,
+		Warnings:   Warnings(c),
+		Meta:       responseMeta(c, pagination),
 	}
 
 	c.JSON(status, response)
@@ -48,16 +79,36 @@ func WriteJSON(c *gin.Context, status int, message string, data any) {
 // WriteError sends an error response with a status code and logs the error.
 func WriteError(c *gin.Context, status int, message, errMsg string) {
 	response := Response{
-		Status:  status,
-		Message: message,
-		Error:   errMsg,
+		Status:   status,
+		Message:  message,
+		Warnings: Warnings(c),
+		Error:    errMsg,
+		Meta:     responseMeta(c, nil),
 	}
 
 	c.JSON(status, response)
 
 	// Log the error
 	logger := logging.GetLogger("api-server")
-	logger.Error(response.Message, zap.String("error", errMsg))
+	logger.Error(response.Message, zap.String("error", errMsg), zap.String("requestID", RequestID(c)))
+}
+
+// AddWarning adds a warning to the response of the request. Warnings tell clients about deprecations
+// and data-quality issues without failing the request.
+func AddWarning(c *gin.Context, warning string) {
+	c.Set(warningsKey, append(Warnings(c), warning))
+}
+
+// Warnings returns the warnings added to the response of the request
+func Warnings(c *gin.Context) []string {
+	warnings, _ := c.Get(warningsKey)
+	list, _ := warnings.([]string)
+	return list
+}
+
+// AcceptsNDJSON reports whether the client asked for a newline-delimited JSON response.
+func AcceptsNDJSON(c *gin.Context) bool {
+	return strings.Contains(c.GetHeader("Accept"), NDJSONContentType)
 }
 
 // GenerateID generates a new UUID
@@ -65,12 +116,22 @@ func GenerateID() string {
 	return uuid.New().String() // Example: "550e8400-e29b-41d4-a716-446655440000"
 }
 
-// GenerateJWT generates a new JWT token for a user
-func GenerateJWT(userID, username, role, action string, expire bool) (string, error) {
+// GenerateJWT generates a new JWT token for a user, which expires after ttl unless it is 0
+func GenerateJWT(userID, username, role, action string, ttl time.Duration) (string, error) {
+	return GenerateSiteJWT(userID, "", username, role, action, ttl)
+}
+
+// GenerateSiteJWT generates a new JWT token for a user, scoped to a single site when siteID is set.
+// The token expires after ttl unless it is 0.
+func GenerateSiteJWT(userID, siteID, username, role, action string, ttl time.Duration) (string, error) {
 	if !IsValidUUID(userID) {
 		return "", errors.New("invalid user ID")
 	}
 
+	if siteID != "" && !IsValidUUID(siteID) {
+		return "", errors.New("invalid site ID")
+	}
+
 	if !IsValidString(username) {
 		return "", errors.New("invalid username")
 	}
@@ -83,23 +144,105 @@ func GenerateJWT(userID, username, role, action string, expire bool) (string, er
 		return "", errors.New("invalid action")
 	}
 
+	if ttl < 0 {
+		return "", errors.New("invalid ttl")
+	}
+
 	// Create the claims
+	now := time.Now()
+	claims := Claims{
+		UserID:   userID,
+		Username: username,
+		Role:     role,
+		Action:   action,
+		SiteID:   siteID,
+		Issuer:   "Rubicon BMS",
+		IssuedAt: now.Unix(),
+		// A unique ID makes a refreshed token differ from the one it replaces, even within a second
+		RegisteredClaims: jwt.RegisteredClaims{ID: GenerateID()},
+	}
+
+	if ttl > 0 {
+		claims.RegisteredClaims.ExpiresAt = jwt.NewNumericDate(now.Add(ttl))
+	}
+
+	return signJWT(claims)
+}
+
+// GenerateImpersonationJWT generates a token acting as the customer on behalf of a support operator.
+// The token expires after ttl and is accepted without being stored.
+func GenerateImpersonationJWT(customerID, username, action, impersonatedBy string, ttl time.Duration) (string, error) {
+	if !IsValidUUID(customerID) {
+		return "", errors.New("invalid user ID")
+	}
+
+	if !IsValidString(username) {
+		return "", errors.New("invalid username")
+	}
+
+	if !IsValidAction(action) {
+		return "", errors.New("invalid action")
+	}
+
+	if impersonatedBy == "" || ttl <= 0 {
+		return "", errors.New("invalid impersonation")
+	}
+
+	now := time.Now()
 	claims := Claims{
-		UserID:           userID,
-		Username:         username,
-		Role:             role,
-		Action:           action,
-		Issuer:           "Rubicon BMS",
-		IssuedAt:         time.Now().Unix(),
+		UserID:         customerID,
+		Username:       username,
+		Role:           "user",
+		Action:         action,
+		Issuer:         "Rubicon BMS",
+		IssuedAt:       now.Unix(),
+		ImpersonatedBy: impersonatedBy,
 		RegisteredClaims: jwt.RegisteredClaims{
-			// ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)), // Token expires in 24 hours
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
 		},
 	}
 
-	if expire {
-		claims.RegisteredClaims.ExpiresAt = jwt.NewNumericDate(time.Now().Add(24 * time.Hour * 30))
+	return signJWT(claims)
+}
+
+// GatewayRole is the role of the tokens edge gateways authenticate with on the /gateway routes
+const GatewayRole = "gateway"
+
+// GatewayAction is the action of gateway tokens. It is not an action customer tokens can be issued for.
+const GatewayAction = "GATEWAY"
+
+// GenerateGatewayJWT generates a token for an edge gateway at one of the customer's sites
+func GenerateGatewayJWT(customerID, siteID, gateway string) (string, error) {
+	if !IsValidUUID(customerID) {
+		return "", errors.New("invalid user ID")
+	}
+
+	if !IsValidUUID(siteID) {
+		return "", errors.New("invalid site ID")
 	}
 
+	if gateway == "" {
+		return "", errors.New("invalid gateway")
+	}
+
+	claims := Claims{
+		UserID:   customerID,
+		Username: gateway,
+		Role:     GatewayRole,
+		Action:   GatewayAction,
+		SiteID:   siteID,
+		Gateway:  gateway,
+		Issuer:   "Rubicon BMS",
+		IssuedAt: time.Now().Unix(),
+		// A unique ID makes a rotated credential differ from the one it replaces, even within a second
+		RegisteredClaims: jwt.RegisteredClaims{ID: GenerateID()},
+	}
+
+	return signJWT(claims)
+}
+
+// signJWT signs the claims with the JWT secret
+func signJWT(claims Claims) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 
 	JwtSecret := os.Getenv("DEVICES_SERVER_JWT_SECRET")
@@ -136,10 +279,58 @@ func ValidateJWT(tokenStr string) (jwt.MapClaims, error) {
 	return nil, errors.New("invalid token")
 }
 
+// IsTokenExpired reports whether ValidateJWT rejected the token because it has expired
+func IsTokenExpired(err error) bool {
+	return errors.Is(err, jwt.ErrTokenExpired)
+}
+
+// TransactionKey is the context key of the database transaction a mutating request runs in
+const TransactionKey = "db_transaction"
+
+// afterCommitKey is the context key of the functions to run once the transaction of the request commits
+const afterCommitKey = "db_after_commit"
+
+// AfterCommit runs fn once the transaction of the request has been committed, so caches and change
+// notifications never show writes that are rolled back. Outside a transaction fn runs straight away.
+func AfterCommit(c *gin.Context, fn func()) {
+	if _, ok := c.Get(TransactionKey); !ok {
+		fn()
+		return
+	}
+
+	hooks, _ := c.Get(afterCommitKey)
+	fns, _ := hooks.([]func())
+	c.Set(afterCommitKey, append(fns, fn))
+}
+
+// RunAfterCommit runs the functions AfterCommit deferred until the transaction of the request committed
+func RunAfterCommit(c *gin.Context) {
+	hooks, _ := c.Get(afterCommitKey)
+	fns, _ := hooks.([]func())
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// RequestDB returns the transaction the request runs in, or the database instance if the request
+// does not run in one. Queries are bound to the request context, so they are cancelled once the
+// request deadline passes or the client goes away.
+func RequestDB(c *gin.Context) (*devicesdb.BMS_DB, error) {
+	if tx, ok := c.Get(TransactionKey); ok {
+		return tx.(*devicesdb.BMS_DB), nil
+	}
+
+	bmsDB, err := devicesdb.GetDB()
+	if err != nil {
+		return nil, err
+	}
+	return &devicesdb.BMS_DB{DB: bmsDB.DB.WithContext(c.Request.Context())}, nil
+}
+
 // Helper function to get database instance
-// GetDBInstance returns the database instance or handles the error.
+// GetDBInstance returns the database instance, or the transaction of the request, or handles the error.
 func GetDBInstance(c *gin.Context) (*devicesdb.BMS_DB, bool) {
-	bmsDB, err := devicesdb.GetDB()
+	bmsDB, err := RequestDB(c)
 	if err != nil {
 		WriteError(c, http.StatusInternalServerError, "Database error", err.Error())
 		return nil, false
@@ -174,7 +365,7 @@ func IsValidRole(role string) bool {
 // IsValidAction checks if an action is valid.
 func IsValidAction(action string) bool {
 	for _, a := range actions {
-		if a == action {
+		if a.Name == action {
 			return true
 		}
 	}
@@ -0,0 +1,155 @@
+package sitehealth
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/config/app"
+	"github.com/johandrevandeventer/devices-api-server/internal/statushistory"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"go.uber.org/zap"
+)
+
+const day = 24 * time.Hour
+
+// Defaults used when the setting is not configured
+const (
+	defaultComputeInterval = 15 * time.Minute
+	defaultFreshWindow     = time.Hour
+	defaultOnlineWindow    = 15 * time.Minute
+)
+
+// Weights of the parts of the health score, which add up to 1
+const (
+	onlineWeight = 0.6
+	freshWeight  = 0.2
+	faultWeight  = 0.2
+)
+
+// device is the view of a device the health of its site is computed from. Devices that never
+// reported a status or reading have no last seen time, state or last reading.
+type device struct {
+	SiteID      uuid.UUID
+	LastSeen    *time.Time
+	State       *string
+	LastReading *time.Time
+}
+
+// Run computes the health of every site on every interval, pruning snapshots past the retention,
+// until the context is cancelled
+func Run(ctx context.Context, bmsDB *devicesdb.BMS_DB, cfg app.SiteHealthConfig, history app.StatusHistoryConfig, logger *zap.Logger) {
+	interval := time.Duration(cfg.ComputeIntervalMinutes) * time.Minute
+	if interval <= 0 {
+		interval = defaultComputeInterval
+	}
+	freshWindow := time.Duration(cfg.FreshnessMinutes) * time.Minute
+	if freshWindow <= 0 {
+		freshWindow = defaultFreshWindow
+	}
+	onlineWindow := time.Duration(history.OnlineWindowMinutes) * time.Minute
+	if onlineWindow <= 0 {
+		onlineWindow = defaultOnlineWindow
+	}
+	retention := time.Duration(cfg.RetentionDays) * day
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		now := time.Now().UTC()
+
+		if err := Compute(bmsDB, now, onlineWindow, freshWindow); err != nil {
+			logger.Error("Failed to compute site health", zap.Error(err))
+		}
+
+		if retention > 0 {
+			if err := bmsDB.DB.Unscoped().Where("computed_at < ?", now.Add(-retention)).Delete(&models.SiteHealthSnapshot{}).Error; err != nil {
+				logger.Error("Failed to prune site health snapshots", zap.Error(err))
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Compute records a health snapshot for every site with devices
+func Compute(bmsDB *devicesdb.BMS_DB, now time.Time, onlineWindow, freshWindow time.Duration) error {
+	var devices []device
+	if err := bmsDB.DB.Table("devices").
+		Select("devices.site_id, device_statuses.last_seen, device_statuses.state, readings.reported_at AS last_reading").
+		Joins("JOIN sites ON sites.id = devices.site_id AND sites.deleted_at IS NULL").
+		Joins("LEFT JOIN device_statuses ON device_statuses.device_id = devices.id AND device_statuses.deleted_at IS NULL").
+		Joins(`LEFT JOIN (
+			SELECT device_id, MAX(reported_at) AS reported_at FROM point_readings GROUP BY device_id
+		) readings ON readings.device_id = devices.id`).
+		Where("devices.deleted_at IS NULL").
+		Scan(&devices).Error; err != nil {
+		return err
+	}
+
+	snapshots := summarize(devices, now, onlineWindow, freshWindow)
+	if len(snapshots) == 0 {
+		return nil
+	}
+
+	return bmsDB.DB.CreateInBatches(&snapshots, 500).Error
+}
+
+// summarize returns the health snapshot of every site the devices are in
+func summarize(devices []device, now time.Time, onlineWindow, freshWindow time.Duration) []models.SiteHealthSnapshot {
+	bySite := make(map[uuid.UUID]*models.SiteHealthSnapshot)
+	var order []uuid.UUID
+
+	for _, d := range devices {
+		snapshot, ok := bySite[d.SiteID]
+		if !ok {
+			snapshot = &models.SiteHealthSnapshot{SiteID: d.SiteID, ComputedAt: now}
+			bySite[d.SiteID] = snapshot
+			order = append(order, d.SiteID)
+		}
+
+		snapshot.Devices++
+		if d.LastSeen != nil {
+			var state string
+			if d.State != nil {
+				state = *d.State
+			}
+			switch statushistory.State(state, *d.LastSeen, now, onlineWindow) {
+			case models.DeviceStatusOnline:
+				snapshot.OnlineDevices++
+			case models.DeviceStatusFault:
+				snapshot.FaultDevices++
+			}
+		}
+		if d.LastReading != nil && now.Sub(*d.LastReading) <= freshWindow {
+			snapshot.FreshDevices++
+		}
+	}
+
+	snapshots := make([]models.SiteHealthSnapshot, len(order))
+	for i, siteID := range order {
+		snapshot := bySite[siteID]
+		snapshot.Score = score(snapshot.Devices, snapshot.OnlineDevices, snapshot.FaultDevices, snapshot.FreshDevices)
+		snapshots[i] = *snapshot
+	}
+	return snapshots
+}
+
+// score weighs the share of online devices, of devices with fresh readings and of devices without
+// a fault into a percentage, rounded to one decimal
+func score(devices, online, faults, fresh int) float64 {
+	if devices == 0 {
+		return 0
+	}
+
+	total := float64(devices)
+	weighted := onlineWeight*float64(online)/total + freshWeight*float64(fresh)/total + faultWeight*(1-float64(faults)/total)
+	return math.Round(weighted*1000) / 10
+}
@@ -0,0 +1,65 @@
+package sitehealth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+)
+
+var now = time.Date(2025, 1, 10, 12, 0, 0, 0, time.UTC)
+
+func TestSummarize(t *testing.T) {
+	ago := func(d time.Duration) *time.Time {
+		t := now.Add(-d)
+		return &t
+	}
+	fault := models.DeviceStatusFault
+	siteA, siteB := uuid.New(), uuid.New()
+
+	devices := []device{
+		{SiteID: siteA, LastSeen: ago(time.Minute), LastReading: ago(5 * time.Minute)},
+		{SiteID: siteA, LastSeen: ago(2 * time.Minute), LastReading: ago(3 * time.Hour)},
+		{SiteID: siteB},
+		{SiteID: siteA, LastSeen: ago(time.Minute), State: &fault, LastReading: ago(time.Minute)},
+		{SiteID: siteA, LastSeen: ago(2 * time.Hour)},
+	}
+
+	got := summarize(devices, now, 10*time.Minute, time.Hour)
+	want := []models.SiteHealthSnapshot{
+		{SiteID: siteA, ComputedAt: now, Devices: 4, OnlineDevices: 2, FaultDevices: 1, FreshDevices: 2, Score: 55},
+		{SiteID: siteB, ComputedAt: now, Devices: 1, Score: 20},
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d snapshots, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("snapshot %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestScore(t *testing.T) {
+	tests := []struct {
+		name                           string
+		devices, online, faults, fresh int
+		want                           float64
+	}{
+		{name: "no devices", want: 0},
+		{name: "healthy", devices: 3, online: 3, fresh: 3, want: 100},
+		{name: "all faulted", devices: 2, faults: 2, fresh: 2, want: 20},
+		{name: "silent", devices: 5, want: 20},
+		{name: "rounded", devices: 3, online: 1, fresh: 1, want: 46.7},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := score(tt.devices, tt.online, tt.faults, tt.fresh); got != tt.want {
+				t.Errorf("score = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package statestore
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/johandrevandeventer/devices-api-server/internal/status"
+	"github.com/johandrevandeventer/persist"
+)
+
+// Store records the application state in the persist file. When there is no usable persist
+// file, e.g. because the disk is full, the state is kept in memory instead and the store is
+// reported as degraded rather than stopping the application.
+type Store struct {
+	mu       sync.Mutex
+	file     *persist.FilePersister
+	memory   map[string]any
+	degraded string
+}
+
+// New returns a store backed by the persist file
+func New(file *persist.FilePersister) *Store {
+	return &Store{file: file, memory: make(map[string]any)}
+}
+
+// NewDegraded returns a store that keeps the state in memory, recording why the persist file is not used
+func NewDegraded(reason string) *Store {
+	status.SetDegraded("persist", reason)
+	return &Store{memory: make(map[string]any), degraded: reason}
+}
+
+// Set records a state value, falling back to memory if the persist file fails
+func (s *Store) Set(key string, value any) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.memory[key] = value
+
+	if s.file == nil {
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			s.file = nil
+			s.degraded = fmt.Sprintf("persist write failed: %v", r)
+			status.SetDegraded("persist", s.degraded)
+		}
+	}()
+	s.file.Set(key, value)
+}
+
+// Degraded returns why the state is only kept in memory, or an empty string if it is persisted
+func (s *Store) Degraded() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.degraded
+}
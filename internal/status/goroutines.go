@@ -0,0 +1,91 @@
+package status
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/johandrevandeventer/devices-api-server/internal/timefmt"
+)
+
+// Goroutine is a background goroutine started with Go that has not returned yet
+type Goroutine struct {
+	Name      string       `json:"name"`
+	StartedAt timefmt.Time `json:"started_at"`
+}
+
+var (
+	goroutinesMu sync.Mutex
+	goroutines   = make(map[int]Goroutine)
+	nextID       int
+
+	// goroutineExited is closed and replaced every time a goroutine returns, waking WaitGoroutines
+	goroutineExited = make(chan struct{})
+)
+
+// Go runs fn in a goroutine that is reported by Goroutines until it returns, so that shutdown can
+// wait for it and goroutines that never return can be told apart
+func Go(name string, fn func()) {
+	goroutinesMu.Lock()
+	id := nextID
+	nextID++
+	goroutines[id] = Goroutine{Name: name, StartedAt: timefmt.New(time.Now())}
+	goroutinesMu.Unlock()
+
+	go func() {
+		defer func() {
+			goroutinesMu.Lock()
+			defer goroutinesMu.Unlock()
+			delete(goroutines, id)
+			close(goroutineExited)
+			goroutineExited = make(chan struct{})
+		}()
+		fn()
+	}()
+}
+
+// Goroutines returns the goroutines started with Go that are still running, sorted by name
+func Goroutines() []Goroutine {
+	goroutinesMu.Lock()
+	defer goroutinesMu.Unlock()
+
+	running := make([]Goroutine, 0, len(goroutines))
+	for _, goroutine := range goroutines {
+		running = append(running, goroutine)
+	}
+	slices.SortFunc(running, func(a, b Goroutine) int {
+		if n := strings.Compare(a.Name, b.Name); n != 0 {
+			return n
+		}
+		return a.StartedAt.Compare(b.StartedAt.Time)
+	})
+	return running
+}
+
+// WaitGoroutines waits until every goroutine started with Go has returned, or returns an error
+// naming the ones still running once the context is done
+func WaitGoroutines(ctx context.Context) error {
+	for {
+		goroutinesMu.Lock()
+		running := len(goroutines)
+		exited := goroutineExited
+		goroutinesMu.Unlock()
+
+		if running == 0 {
+			return nil
+		}
+
+		select {
+		case <-exited:
+		case <-ctx.Done():
+			var names []string
+			for _, goroutine := range Goroutines() {
+				names = append(names, goroutine.Name)
+			}
+			return fmt.Errorf("%d goroutines still running: %s", len(names), strings.Join(names, ", "))
+		}
+	}
+}
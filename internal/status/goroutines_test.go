@@ -0,0 +1,34 @@
+package status
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGoroutines(t *testing.T) {
+	release := make(chan struct{})
+	Go("test-blocked", func() { <-release })
+	Go("test-done", func() {})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := WaitGoroutines(ctx)
+	if err == nil || !strings.Contains(err.Error(), "test-blocked") || strings.Contains(err.Error(), "test-done") {
+		t.Fatalf("WaitGoroutines() = %v, want the blocked goroutine named", err)
+	}
+
+	running := Goroutines()
+	if len(running) != 1 || running[0].Name != "test-blocked" || running[0].StartedAt.IsZero() {
+		t.Fatalf("Goroutines() = %+v, want the blocked goroutine", running)
+	}
+
+	close(release)
+	if err := WaitGoroutines(context.Background()); err != nil {
+		t.Fatalf("WaitGoroutines() after release = %v", err)
+	}
+	if running := Goroutines(); len(running) != 0 {
+		t.Errorf("Goroutines() after release = %+v, want none", running)
+	}
+}
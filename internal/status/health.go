@@ -0,0 +1,27 @@
+package status
+
+import "sync"
+
+var (
+	degradedMu sync.RWMutex
+	degraded   = make(map[string]string)
+)
+
+// SetDegraded marks a component as running in a degraded state, with the reason
+func SetDegraded(component, reason string) {
+	degradedMu.Lock()
+	defer degradedMu.Unlock()
+	degraded[component] = reason
+}
+
+// Degraded returns the reason each degraded component is degraded
+func Degraded() map[string]string {
+	degradedMu.RLock()
+	defer degradedMu.RUnlock()
+
+	components := make(map[string]string, len(degraded))
+	for component, reason := range degraded {
+		components[component] = reason
+	}
+	return components
+}
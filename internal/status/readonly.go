@@ -0,0 +1,15 @@
+package status
+
+import "sync/atomic"
+
+var readOnly atomic.Bool
+
+// SetReadOnly switches the instance in or out of read-only mode
+func SetReadOnly(enabled bool) {
+	readOnly.Store(enabled)
+}
+
+// IsReadOnly reports whether the instance is in read-only mode, rejecting mutating requests
+func IsReadOnly() bool {
+	return readOnly.Load()
+}
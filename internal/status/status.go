@@ -0,0 +1,41 @@
+package status
+
+import "sync"
+
+// StartupReport summarises what happened while the application was starting
+type StartupReport struct {
+	AppName            string   `json:"app_name"`
+	AppVersion         string   `json:"app_version"`
+	ReleaseDate        string   `json:"release_date"`
+	GoVersion          string   `json:"go_version"`
+	Environment        string   `json:"environment"`
+	StartTime          string   `json:"start_time"`
+	ConfigFilesCreated []string `json:"config_files_created"`
+	ConfigFilesUsed    []string `json:"config_files_used"`
+	TablesCreated      []string `json:"tables_created"`
+	TablesExisting     []string `json:"tables_existing"`
+	IndexesCreated     []string `json:"indexes_created"`
+	IndexesMissing     []string `json:"indexes_missing"`
+	IndexesDropped     []string `json:"indexes_dropped"`
+	ColumnsAdded       []string `json:"columns_added"`
+	Errors             []string `json:"errors"`
+}
+
+var (
+	mu            sync.RWMutex
+	startupReport StartupReport
+)
+
+// SetStartupReport stores the startup report
+func SetStartupReport(report StartupReport) {
+	mu.Lock()
+	defer mu.Unlock()
+	startupReport = report
+}
+
+// GetStartupReport returns the startup report
+func GetStartupReport() StartupReport {
+	mu.RLock()
+	defer mu.RUnlock()
+	return startupReport
+}
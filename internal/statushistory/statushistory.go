@@ -0,0 +1,226 @@
+package statushistory
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/config/app"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"go.uber.org/zap"
+	"gorm.io/gorm/clause"
+)
+
+const day = 24 * time.Hour
+
+// defaultSampleInterval is used when no sample interval is configured
+const defaultSampleInterval = time.Minute
+
+// latestTransitionsQuery selects the latest transition of every device, optionally before a point in time
+const latestTransitionsQuery = `SELECT t.* FROM device_status_transitions t
+	JOIN (
+		SELECT device_id, MAX(changed_at) AS changed_at
+		FROM device_status_transitions
+		WHERE changed_at < ? AND device_id IS NOT NULL
+		GROUP BY device_id
+	) latest ON latest.device_id = t.device_id AND latest.changed_at = t.changed_at`
+
+// Run samples device statuses on every interval, rolling up and pruning once per day,
+// until the context is cancelled
+func Run(ctx context.Context, bmsDB *devicesdb.BMS_DB, cfg app.StatusHistoryConfig, logger *zap.Logger) {
+	interval := time.Duration(cfg.SampleIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultSampleInterval
+	}
+	onlineWindow := time.Duration(cfg.OnlineWindowMinutes) * time.Minute
+	retention := time.Duration(cfg.RawRetentionDays) * day
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var lastRollup time.Time
+
+	for {
+		now := time.Now().UTC()
+
+		if err := Sample(bmsDB, now, onlineWindow); err != nil {
+			logger.Error("Failed to sample device statuses", zap.Error(err))
+		}
+
+		// Roll up the previous day once it is complete
+		yesterday := now.Truncate(day).Add(-day)
+		if lastRollup.Before(yesterday) {
+			if err := Rollup(bmsDB, yesterday); err != nil {
+				logger.Error("Failed to roll up device uptime", zap.Error(err), zap.Time("day", yesterday))
+			} else if err := Prune(bmsDB, now.Add(-retention)); err != nil {
+				logger.Error("Failed to prune device status transitions", zap.Error(err))
+			} else {
+				lastRollup = yesterday
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sample derives the status of every device from its last heartbeat and reported state and
+// records a transition for each device whose status changed since the previous sample. Statuses
+// not yet linked to a device are skipped.
+func Sample(bmsDB *devicesdb.BMS_DB, now time.Time, onlineWindow time.Duration) error {
+	var statuses []models.DeviceStatus
+	if err := bmsDB.DB.Select("device_id", "device_serial_number", "last_seen", "state").
+		Where("device_id IS NOT NULL").
+		Find(&statuses).Error; err != nil {
+		return err
+	}
+
+	var latest []models.DeviceStatusTransition
+	if err := bmsDB.DB.Raw(latestTransitionsQuery, now.Add(time.Second)).Scan(&latest).Error; err != nil {
+		return err
+	}
+
+	currentStatus := make(map[uuid.UUID]string, len(latest))
+	for _, transition := range latest {
+		currentStatus[transition.DeviceID] = transition.Status
+	}
+
+	var transitions []models.DeviceStatusTransition
+	for _, status := range statuses {
+		newStatus := State(status.State, status.LastSeen, now, onlineWindow)
+		changedAt := status.LastSeen
+		if now.Sub(status.LastSeen) > onlineWindow {
+			changedAt = status.LastSeen.Add(onlineWindow)
+		}
+
+		if currentStatus[status.DeviceID] == newStatus {
+			continue
+		}
+
+		if changedAt.After(now) {
+			changedAt = now
+		}
+
+		transitions = append(transitions, models.DeviceStatusTransition{
+			DeviceID:           status.DeviceID,
+			DeviceSerialNumber: status.DeviceSerialNumber,
+			Status:             newStatus,
+			ChangedAt:          changedAt,
+		})
+	}
+
+	if len(transitions) == 0 {
+		return nil
+	}
+
+	return bmsDB.DB.Create(&transitions).Error
+}
+
+// State derives the status of a device from the state it last reported and its last heartbeat.
+// A device goes offline when its heartbeat window runs out, whatever state it reported.
+func State(reported string, lastSeen, now time.Time, onlineWindow time.Duration) string {
+	if now.Sub(lastSeen) > onlineWindow {
+		return models.DeviceStatusOffline
+	}
+	if reported == "" {
+		return models.DeviceStatusOnline
+	}
+	return reported
+}
+
+// Rollup computes the uptime minutes of every device for the given UTC day
+func Rollup(bmsDB *devicesdb.BMS_DB, dayStart time.Time) error {
+	dayEnd := dayStart.Add(day)
+
+	// The state each device was in when the day started
+	var initial []models.DeviceStatusTransition
+	if err := bmsDB.DB.Raw(latestTransitionsQuery, dayStart).Scan(&initial).Error; err != nil {
+		return err
+	}
+
+	var transitions []models.DeviceStatusTransition
+	if err := bmsDB.DB.Where("changed_at >= ? AND changed_at < ? AND device_id IS NOT NULL", dayStart, dayEnd).
+		Order("device_id, changed_at").
+		Find(&transitions).Error; err != nil {
+		return err
+	}
+
+	type state struct {
+		serialNumber string
+		online       bool
+		since        time.Time
+		uptime       time.Duration
+	}
+
+	states := make(map[uuid.UUID]*state)
+	for _, transition := range initial {
+		states[transition.DeviceID] = &state{
+			serialNumber: transition.DeviceSerialNumber,
+			online:       transition.Status == models.DeviceStatusOnline,
+			since:        dayStart,
+		}
+	}
+
+	for _, transition := range transitions {
+		s, ok := states[transition.DeviceID]
+		if !ok {
+			s = &state{serialNumber: transition.DeviceSerialNumber, since: dayStart}
+			states[transition.DeviceID] = s
+		}
+
+		if s.online {
+			s.uptime += transition.ChangedAt.Sub(s.since)
+		}
+
+		s.online = transition.Status == models.DeviceStatusOnline
+		s.since = transition.ChangedAt
+	}
+
+	if len(states) == 0 {
+		return nil
+	}
+
+	rollups := make([]models.DeviceUptimeRollup, 0, len(states))
+	for deviceID, s := range states {
+		if s.online {
+			s.uptime += dayEnd.Sub(s.since)
+		}
+
+		rollups = append(rollups, models.DeviceUptimeRollup{
+			DeviceID:           deviceID,
+			DeviceSerialNumber: s.serialNumber,
+			Day:                dayStart,
+			UptimeMinutes:      int(s.uptime.Minutes()),
+		})
+	}
+
+	return bmsDB.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "device_id"}, {Name: "day"}},
+		DoUpdates: clause.AssignmentColumns([]string{"uptime_minutes", "updated_at"}),
+	}).Create(&rollups).Error
+}
+
+// Prune permanently deletes transitions older than the cutoff, keeping the latest
+// transition of every device so its current state is not lost
+func Prune(bmsDB *devicesdb.BMS_DB, cutoff time.Time) error {
+	var latest []models.DeviceStatusTransition
+	if err := bmsDB.DB.Raw(latestTransitionsQuery, cutoff).Scan(&latest).Error; err != nil {
+		return err
+	}
+
+	query := bmsDB.DB.Unscoped().Where("changed_at < ?", cutoff)
+
+	if len(latest) > 0 {
+		keep := make([]uuid.UUID, len(latest))
+		for i, transition := range latest {
+			keep[i] = transition.ID
+		}
+		query = query.Where("id NOT IN ?", keep)
+	}
+
+	return query.Delete(&models.DeviceStatusTransition{}).Error
+}
@@ -0,0 +1,245 @@
+package tagrules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/config/app"
+	"github.com/johandrevandeventer/devices-api-server/internal/statushistory"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const day = 24 * time.Hour
+
+// defaultEvaluateInterval is used when no evaluation interval is configured
+const defaultEvaluateInterval = 15 * time.Minute
+
+// defaultOnlineWindow is used when the status history has no online window configured
+const defaultOnlineWindow = 15 * time.Minute
+
+// Fields lists the device attributes a rule can match on, in the order they are documented
+var Fields = []string{
+	models.TagRuleFieldStatus,
+	models.TagRuleFieldNoCommsDays,
+	models.TagRuleFieldDeviceType,
+	models.TagRuleFieldGateway,
+	models.TagRuleFieldFirmwareVersion,
+	models.TagRuleFieldHardwareRevision,
+}
+
+// device is the view of a device that rules are matched against. Devices that never reported a
+// status have no last seen time or state.
+type device struct {
+	ID                 uuid.UUID
+	DeviceSerialNumber string
+	DeviceType         string
+	Gateway            string
+	FirmwareVersion    string
+	HardwareRevision   string
+	CreatedAt          time.Time
+	LastSeen           *time.Time
+	State              *string
+}
+
+// Run evaluates the tag rules on every interval until the context is cancelled
+func Run(ctx context.Context, bmsDB *devicesdb.BMS_DB, cfg app.TagRuleConfig, history app.StatusHistoryConfig, logger *zap.Logger) {
+	interval := time.Duration(cfg.EvaluateIntervalMinutes) * time.Minute
+	if interval <= 0 {
+		interval = defaultEvaluateInterval
+	}
+	onlineWindow := time.Duration(history.OnlineWindowMinutes) * time.Minute
+	if onlineWindow <= 0 {
+		onlineWindow = defaultOnlineWindow
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := Evaluate(bmsDB, time.Now().UTC(), onlineWindow); err != nil {
+			logger.Error("Failed to evaluate tag rules", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Evaluate applies the tag of every rule to the devices matching it and removes the tag from the
+// devices the rule applied it to that no longer match. A failing rule does not stop the others.
+func Evaluate(bmsDB *devicesdb.BMS_DB, now time.Time, onlineWindow time.Duration) error {
+	var rules []models.TagRule
+	if err := bmsDB.DB.Order("name").Find(&rules).Error; err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+
+	var devices []device
+	if err := bmsDB.DB.Table("devices").
+		Select("devices.id, devices.device_serial_number, devices.device_type, devices.gateway, devices.firmware_version, devices.hardware_revision, devices.created_at, device_statuses.last_seen, device_statuses.state").
+		Joins("LEFT JOIN device_statuses ON device_statuses.device_id = devices.id AND device_statuses.deleted_at IS NULL").
+		Where("devices.deleted_at IS NULL").
+		Scan(&devices).Error; err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, rule := range rules {
+		if err := apply(bmsDB, rule, devices, now, onlineWindow); err != nil {
+			errs = append(errs, fmt.Errorf("tag rule %s: %w", rule.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// apply brings the links of the rule in line with the devices currently matching it. Devices that
+// already carry the tag, manually or through another rule, keep their existing link.
+func apply(bmsDB *devicesdb.BMS_DB, rule models.TagRule, devices []device, now time.Time, onlineWindow time.Duration) error {
+	matching := make(map[uuid.UUID]device)
+	for _, d := range devices {
+		if matches(rule, d, now, onlineWindow) {
+			matching[d.ID] = d
+		}
+	}
+
+	return bmsDB.DB.Transaction(func(tx *gorm.DB) error {
+		var tag models.Tag
+		err := tx.Where("name = ?", rule.Tag).First(&tag).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			if len(matching) == 0 {
+				return nil
+			}
+			tag = models.Tag{Name: rule.Tag}
+			err = tx.Create(&tag).Error
+		}
+		if err != nil {
+			return err
+		}
+
+		var applied []uuid.UUID
+		if err := tx.Model(&models.DeviceTag{}).Where("rule_id = ?", rule.ID).Pluck("device_id", &applied).Error; err != nil {
+			return err
+		}
+
+		var stale []uuid.UUID
+		current := make(map[uuid.UUID]bool, len(applied))
+		for _, deviceID := range applied {
+			current[deviceID] = true
+			if _, ok := matching[deviceID]; !ok {
+				stale = append(stale, deviceID)
+			}
+		}
+		if len(stale) > 0 {
+			if err := tx.Where("rule_id = ? AND device_id IN ?", rule.ID, stale).Delete(&models.DeviceTag{}).Error; err != nil {
+				return err
+			}
+		}
+
+		var links []models.DeviceTag
+		for deviceID, d := range matching {
+			if current[deviceID] {
+				continue
+			}
+			ruleID := rule.ID
+			links = append(links, models.DeviceTag{TagID: tag.ID, DeviceID: deviceID, DeviceSerialNumber: d.DeviceSerialNumber, RuleID: &ruleID})
+		}
+		if len(links) == 0 {
+			return nil
+		}
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&links).Error
+	})
+}
+
+// matches reports whether the attribute of the device satisfies the condition of the rule
+func matches(rule models.TagRule, d device, now time.Time, onlineWindow time.Duration) bool {
+	var value string
+	switch rule.Field {
+	case models.TagRuleFieldStatus:
+		// A device that never reported has not been online
+		value = models.DeviceStatusOffline
+		if d.LastSeen != nil {
+			var state string
+			if d.State != nil {
+				state = *d.State
+			}
+			value = statushistory.State(state, *d.LastSeen, now, onlineWindow)
+		}
+	case models.TagRuleFieldNoCommsDays:
+		// A device that never reported has been without communication since it was created
+		since := d.CreatedAt
+		if d.LastSeen != nil {
+			since = *d.LastSeen
+		}
+		value = strconv.Itoa(int(now.Sub(since) / day))
+	case models.TagRuleFieldDeviceType:
+		value = d.DeviceType
+	case models.TagRuleFieldGateway:
+		value = d.Gateway
+	case models.TagRuleFieldFirmwareVersion:
+		value = d.FirmwareVersion
+	case models.TagRuleFieldHardwareRevision:
+		value = d.HardwareRevision
+	default:
+		return false
+	}
+
+	switch rule.Operator {
+	case models.TagRuleOperatorEqual:
+		return value == rule.Value
+	case models.TagRuleOperatorNotEqual:
+		return value != rule.Value
+	case models.TagRuleOperatorAtLeast:
+		actual, err := strconv.Atoi(value)
+		if err != nil {
+			return false
+		}
+		threshold, err := strconv.Atoi(rule.Value)
+		return err == nil && actual >= threshold
+	}
+	return false
+}
+
+// Invalid returns why the condition of the rule cannot be evaluated, or an empty string if it can
+func Invalid(rule models.TagRule) string {
+	switch rule.Field {
+	case models.TagRuleFieldNoCommsDays:
+		if rule.Operator != models.TagRuleOperatorAtLeast {
+			return "no_comms_days only supports the gte operator"
+		}
+		if days, err := strconv.Atoi(rule.Value); err != nil || days < 1 {
+			return "no_comms_days must be compared to a whole number of days of at least 1"
+		}
+		return ""
+	case models.TagRuleFieldStatus:
+		switch rule.Value {
+		case models.DeviceStatusOnline, models.DeviceStatusOffline, models.DeviceStatusFault:
+		default:
+			return "status must be compared to online, offline or fault"
+		}
+	case models.TagRuleFieldDeviceType, models.TagRuleFieldGateway, models.TagRuleFieldFirmwareVersion, models.TagRuleFieldHardwareRevision:
+		if rule.Value == "" || len(rule.Value) > 255 {
+			return rule.Field + " must be compared to a value of 1-255 characters"
+		}
+	default:
+		return "field must be one of " + strings.Join(Fields, ", ")
+	}
+
+	if rule.Operator != models.TagRuleOperatorEqual && rule.Operator != models.TagRuleOperatorNotEqual {
+		return rule.Field + " only supports the eq and ne operators"
+	}
+	return ""
+}
@@ -0,0 +1,156 @@
+package tagrules
+
+import (
+	"database/sql/driver"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/dbtest"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+)
+
+var now = time.Date(2025, 1, 10, 12, 0, 0, 0, time.UTC)
+
+func TestMatches(t *testing.T) {
+	seen := func(ago time.Duration) *time.Time {
+		t := now.Add(-ago)
+		return &t
+	}
+	fault := models.DeviceStatusFault
+
+	tests := []struct {
+		name   string
+		rule   models.TagRule
+		device device
+		want   bool
+	}{
+		{
+			name:   "no comms for a week",
+			rule:   models.TagRule{Field: models.TagRuleFieldNoCommsDays, Operator: models.TagRuleOperatorAtLeast, Value: "7"},
+			device: device{LastSeen: seen(8 * day)},
+			want:   true,
+		},
+		{
+			name:   "no comms for six days",
+			rule:   models.TagRule{Field: models.TagRuleFieldNoCommsDays, Operator: models.TagRuleOperatorAtLeast, Value: "7"},
+			device: device{LastSeen: seen(6*day + 23*time.Hour)},
+		},
+		{
+			name:   "never reported since creation",
+			rule:   models.TagRule{Field: models.TagRuleFieldNoCommsDays, Operator: models.TagRuleOperatorAtLeast, Value: "7"},
+			device: device{CreatedAt: now.Add(-7 * day)},
+			want:   true,
+		},
+		{
+			name:   "reported fault",
+			rule:   models.TagRule{Field: models.TagRuleFieldStatus, Operator: models.TagRuleOperatorEqual, Value: models.DeviceStatusFault},
+			device: device{LastSeen: seen(time.Minute), State: &fault},
+			want:   true,
+		},
+		{
+			name:   "fault past the online window is offline",
+			rule:   models.TagRule{Field: models.TagRuleFieldStatus, Operator: models.TagRuleOperatorEqual, Value: models.DeviceStatusOffline},
+			device: device{LastSeen: seen(time.Hour), State: &fault},
+			want:   true,
+		},
+		{
+			name:   "never reported is offline",
+			rule:   models.TagRule{Field: models.TagRuleFieldStatus, Operator: models.TagRuleOperatorNotEqual, Value: models.DeviceStatusOnline},
+			device: device{},
+			want:   true,
+		},
+		{
+			name:   "firmware differs",
+			rule:   models.TagRule{Field: models.TagRuleFieldFirmwareVersion, Operator: models.TagRuleOperatorNotEqual, Value: "2.0.0"},
+			device: device{FirmwareVersion: "1.4.2"},
+			want:   true,
+		},
+		{
+			name:   "device type",
+			rule:   models.TagRule{Field: models.TagRuleFieldDeviceType, Operator: models.TagRuleOperatorEqual, Value: "AHU"},
+			device: device{DeviceType: "FCU"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matches(tt.rule, tt.device, now, 15*time.Minute); got != tt.want {
+				t.Errorf("matches = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  models.TagRule
+		valid bool
+	}{
+		{name: "no comms", rule: models.TagRule{Field: "no_comms_days", Operator: "gte", Value: "7"}, valid: true},
+		{name: "no comms equal", rule: models.TagRule{Field: "no_comms_days", Operator: "eq", Value: "7"}},
+		{name: "no comms zero days", rule: models.TagRule{Field: "no_comms_days", Operator: "gte", Value: "0"}},
+		{name: "status", rule: models.TagRule{Field: "status", Operator: "ne", Value: "online"}, valid: true},
+		{name: "unknown status", rule: models.TagRule{Field: "status", Operator: "eq", Value: "sleeping"}},
+		{name: "status at least", rule: models.TagRule{Field: "status", Operator: "gte", Value: "online"}},
+		{name: "gateway", rule: models.TagRule{Field: "gateway", Operator: "eq", Value: "GW-01"}, valid: true},
+		{name: "empty value", rule: models.TagRule{Field: "gateway", Operator: "eq"}},
+		{name: "unknown field", rule: models.TagRule{Field: "site", Operator: "eq", Value: "Main"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if reason := Invalid(tt.rule); (reason == "") != tt.valid {
+				t.Errorf("Invalid = %q, want valid %v", reason, tt.valid)
+			}
+		})
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	ruleID, tagID := uuid.New(), uuid.New()
+	silent, chatty, removed := uuid.New(), uuid.New(), uuid.New()
+
+	db := dbtest.Install(t)
+	db.On("FROM `tag_rules`", dbtest.Result{
+		Columns: []string{"id", "name", "tag", "field", "operator", "value"},
+		Rows:    [][]driver.Value{{ruleID.String(), "no-comms-7d", "no-comms-7d", "no_comms_days", "gte", "7"}},
+	})
+	db.On("FROM `devices`", dbtest.Result{
+		Columns: []string{"id", "device_serial_number", "created_at", "last_seen"},
+		Rows: [][]driver.Value{
+			{silent.String(), "SN-1", now.Add(-30 * day), now.Add(-8 * day)},
+			{chatty.String(), "SN-2", now.Add(-30 * day), now.Add(-time.Minute)},
+		},
+	})
+	db.On("FROM `tags`", dbtest.Result{Columns: []string{"id", "name"}, Rows: [][]driver.Value{{tagID.String(), "no-comms-7d"}}})
+	db.On("FROM `device_tags`", dbtest.Result{
+		Columns: []string{"device_id"},
+		Rows:    [][]driver.Value{{chatty.String()}, {removed.String()}},
+	})
+
+	if err := Evaluate(devicesdb.BMS_DB_Instance, now, 15*time.Minute); err != nil {
+		t.Fatalf("Evaluate: %v", err)
+	}
+
+	var inserted, deleted []driver.Value
+	for _, query := range db.Queries() {
+		switch {
+		case strings.HasPrefix(query.SQL, "INSERT INTO `device_tags`"):
+			inserted = append(inserted, query.Args...)
+		case strings.HasPrefix(query.SQL, "DELETE FROM `device_tags`"):
+			deleted = append(deleted, query.Args...)
+		}
+	}
+
+	if !slices.Contains(inserted, driver.Value(silent.String())) {
+		t.Errorf("inserted %v, want the silent device tagged", inserted)
+	}
+	if !slices.Contains(deleted, driver.Value(chatty.String())) || !slices.Contains(deleted, driver.Value(removed.String())) {
+		t.Errorf("deleted %v, want the tag removed from the devices that no longer match", deleted)
+	}
+}
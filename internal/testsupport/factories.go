@@ -0,0 +1,123 @@
+// Package testsupport builds the records tests answer scripted queries with, and checks responses
+// against golden files. Records are derived from fixed names, so the same test always sees the
+// same IDs and times and its responses can be compared byte for byte.
+package testsupport
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/johandrevandeventer/devices-api-server/internal/cache"
+	"github.com/johandrevandeventer/devices-api-server/internal/dbtest"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// Time is the time every record is created and updated at
+var Time = time.Date(2025, 1, 1, 8, 0, 0, 0, time.UTC)
+
+// ID returns the ID of the record of the kind with the name, which is the same on every run
+func ID(kind, name string) uuid.UUID {
+	return uuid.NewSHA1(uuid.NameSpaceURL, []byte("devices-api-server/testsupport/"+kind+"/"+name))
+}
+
+// Customer returns a customer with the name, and adds it to the name cache
+func Customer(name string) models.Customer {
+	customer := models.Customer{
+		Model: gorm.Model{CreatedAt: Time, UpdatedAt: Time},
+		ID:    ID("customer", name),
+		Name:  name,
+	}
+	cache.Names().SetCustomer(customer)
+	return customer
+}
+
+// Site returns a site of the customer with the name, and adds it to the name cache
+func Site(customer models.Customer, name string) models.Site {
+	site := models.Site{
+		Model:      gorm.Model{CreatedAt: Time, UpdatedAt: Time},
+		ID:         ID("site", customer.Name+"/"+name),
+		Name:       name,
+		CustomerID: customer.ID,
+		Customer:   customer,
+		Timezone:   "Africa/Johannesburg",
+	}
+	cache.Names().SetSite(site)
+	return site
+}
+
+// Device returns a device at the site with the serial number, wired to controller CTRL-0001 of
+// gateway GW-01
+func Device(site models.Site, serialNumber string) models.Device {
+	return models.Device{
+		Model:                  gorm.Model{CreatedAt: Time, UpdatedAt: Time},
+		ID:                     ID("device", site.ID.String()+"/"+serialNumber),
+		Gateway:                "GW-01",
+		Controller:             "DSE 890",
+		ControllerSerialNumber: "CTRL-0001",
+		DeviceType:             "AHU",
+		DeviceSerialNumber:     serialNumber,
+		DeviceName:             "AHU " + serialNumber,
+		BuildingURL:            "https://bms.example.com/sites/" + site.ID.String(),
+		FirmwareVersion:        "1.4.2",
+		HardwareRevision:       "B",
+		AuthToken:              "token-" + serialNumber,
+		SiteID:                 site.ID,
+		Site:                   site,
+		CustomerID:             site.CustomerID,
+	}
+}
+
+// Controller returns a controller at the site with the serial number
+func Controller(site models.Site, serialNumber string) models.Controller {
+	return models.Controller{
+		Model:           gorm.Model{CreatedAt: Time, UpdatedAt: Time},
+		ID:              ID("controller", site.ID.String()+"/"+serialNumber),
+		CustomerID:      site.CustomerID,
+		SiteID:          site.ID,
+		SerialNumber:    serialNumber,
+		ControllerType:  "DSE 890",
+		FirmwareVersion: "2.1.0",
+	}
+}
+
+// schemas caches the parsed schemas of the values passed to Rows
+var schemas sync.Map
+
+// Rows returns a result with a row per value, with the columns GORM maps the fields of the values
+// to. The values are models, or the structs handlers scan joined queries into, all of one type.
+// Associations are left out, as GORM loads them with queries of their own.
+func Rows(values ...any) dbtest.Result {
+	result := dbtest.Result{}
+	for i, value := range values {
+		s, err := schema.Parse(value, &schemas, schema.NamingStrategy{})
+		if err != nil {
+			panic(fmt.Sprintf("testsupport: %T has no schema: %v", value, err))
+		}
+
+		record := reflect.Indirect(reflect.ValueOf(value))
+		row := []driver.Value{}
+		for _, name := range s.DBNames {
+			if i == 0 {
+				result.Columns = append(result.Columns, name)
+			}
+
+			field := s.FieldsByDBName[name]
+
+			fieldValue, _ := field.ValueOf(context.Background(), record)
+			column, err := driver.DefaultParameterConverter.ConvertValue(fieldValue)
+			if err != nil {
+				panic(fmt.Sprintf("testsupport: %T.%s: %v", value, field.Name, err))
+			}
+			row = append(row, column)
+		}
+		result.Rows = append(result.Rows, row)
+	}
+	return result
+}
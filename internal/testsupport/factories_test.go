@@ -0,0 +1,28 @@
+package testsupport
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRows(t *testing.T) {
+	site := Site(Customer("Customer"), "Site")
+	result := Rows(Device(site, "SN-1"), Device(site, "SN-2"))
+
+	if len(result.Rows) != 2 {
+		t.Fatalf("rows = %d, want 2", len(result.Rows))
+	}
+	id := slices.Index(result.Columns, "id")
+	if id < 0 || slices.Index(result.Columns[id+1:], "id") >= 0 {
+		t.Fatalf("columns = %q, want id once", result.Columns)
+	}
+	if slices.Contains(result.Columns, "site") {
+		t.Errorf("columns = %q, want the site association left out", result.Columns)
+	}
+	if got, want := result.Rows[0][id], ID("device", site.ID.String()+"/SN-1").String(); got != want {
+		t.Errorf("id = %v, want %v", got, want)
+	}
+	if deletedAt := result.Rows[0][slices.Index(result.Columns, "deleted_at")]; deletedAt != nil {
+		t.Errorf("deleted_at = %v, want NULL", deletedAt)
+	}
+}
@@ -0,0 +1,48 @@
+package testsupport
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// update rewrites the golden files with the responses of the tests, run as go test ./... -update
+var update = flag.Bool("update", false, "rewrite the golden files with the output of the tests")
+
+// GoldenDir is the directory of the golden files, relative to the package under test
+const GoldenDir = "testdata/golden"
+
+// Golden compares the JSON with the golden file of the name, after indenting both alike. When the
+// tests run with -update the golden file is written instead, so changes to the API show up as
+// changes to the golden files in review.
+func Golden(t testing.TB, name string, got []byte) {
+	t.Helper()
+
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, got, "", "  "); err != nil {
+		t.Fatalf("%s: invalid JSON: %v\n%s", name, err, got)
+	}
+	indented.WriteByte('\n')
+
+	path := filepath.Join(GoldenDir, name)
+	if *update {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, indented.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%s: %v, run the tests with -update to create it", name, err)
+	}
+	if !bytes.Equal(indented.Bytes(), want) {
+		t.Errorf("%s differs from the golden file, run the tests with -update if the change is intended\ngot:\n%s\nwant:\n%s", name, indented.Bytes(), want)
+	}
+}
@@ -0,0 +1,100 @@
+package timefmt
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	mu       sync.RWMutex
+	location = time.UTC
+)
+
+// SetLocation sets the zone timestamps are formatted in
+func SetLocation(name string) error {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	location = loc
+	mu.Unlock()
+	return nil
+}
+
+// Location returns the zone timestamps are formatted in
+func Location() *time.Location {
+	mu.RLock()
+	defer mu.RUnlock()
+	return location
+}
+
+// Format formats the time as RFC 3339 in the configured zone
+func Format(t time.Time) string {
+	return t.In(Location()).Format(time.RFC3339)
+}
+
+// Time is a time.Time that encodes as RFC 3339 in the configured zone. Response fields use it so
+// times read from the database and times taken from the clock are written the same way.
+type Time struct {
+	time.Time
+}
+
+// New wraps the time for encoding in the configured zone
+func New(t time.Time) Time {
+	return Time{Time: t}
+}
+
+// NewPtr wraps an optional time, returning nil if it is not set
+func NewPtr(t *time.Time) *Time {
+	if t == nil {
+		return nil
+	}
+	return &Time{Time: *t}
+}
+
+// MarshalJSON encodes the time as an RFC 3339 string in the configured zone
+func (t Time) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + Format(t.Time) + `"`), nil
+}
+
+// UnmarshalJSON decodes an RFC 3339 string
+func (t *Time) UnmarshalJSON(data []byte) error {
+	return t.Time.UnmarshalJSON(data)
+}
+
+// Scan reads the time from a database column, so query results can be scanned straight into responses
+func (t *Time) Scan(value any) error {
+	switch v := value.(type) {
+	case nil:
+		t.Time = time.Time{}
+	case time.Time:
+		t.Time = v
+	case []byte:
+		return t.parse(string(v))
+	case string:
+		return t.parse(v)
+	default:
+		return fmt.Errorf("cannot scan %T into a time", value)
+	}
+	return nil
+}
+
+// Value writes the time to a database column
+func (t Time) Value() (driver.Value, error) {
+	return t.Time, nil
+}
+
+// parse reads a time in the layout MySQL returns when times are not parsed by the driver
+func (t *Time) parse(value string) error {
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999", time.RFC3339Nano} {
+		if parsed, err := time.ParseInLocation(layout, value, time.UTC); err == nil {
+			t.Time = parsed
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot parse %q as a time", value)
+}
@@ -0,0 +1,148 @@
+package timefmt
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// setLocation sets the zone for the duration of the test
+func setLocation(t *testing.T, name string) {
+	t.Helper()
+
+	previous := Location()
+	if err := SetLocation(name); err != nil {
+		t.Fatalf("SetLocation(%q): %v", name, err)
+	}
+	t.Cleanup(func() {
+		mu.Lock()
+		location = previous
+		mu.Unlock()
+	})
+}
+
+func TestSetLocationInvalid(t *testing.T) {
+	if err := SetLocation("Not/AZone"); err == nil {
+		t.Error("SetLocation accepted an unknown zone")
+	}
+	if Location() != time.UTC {
+		t.Errorf("Location() = %v after a failed SetLocation, want UTC", Location())
+	}
+}
+
+func TestSetLocationKeepsLocal(t *testing.T) {
+	local := time.Local
+	setLocation(t, "Africa/Johannesburg")
+
+	if time.Local != local {
+		t.Error("SetLocation changed time.Local")
+	}
+}
+
+func TestFormat(t *testing.T) {
+	instant := time.Date(2024, 3, 1, 22, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		zone string
+		want string
+	}{
+		{zone: "UTC", want: "2024-03-01T22:30:00Z"},
+		{zone: "Africa/Johannesburg", want: "2024-03-02T00:30:00+02:00"},
+		{zone: "America/New_York", want: "2024-03-01T17:30:00-05:00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.zone, func(t *testing.T) {
+			setLocation(t, tt.zone)
+
+			if got := Format(instant); got != tt.want {
+				t.Errorf("Format() = %q, want %q", got, tt.want)
+			}
+
+			data, err := json.Marshal(New(instant))
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+			if got := string(data); got != `"`+tt.want+`"` {
+				t.Errorf("MarshalJSON() = %s, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarshalFields(t *testing.T) {
+	setLocation(t, "Africa/Johannesburg")
+
+	instant := time.Date(2024, 3, 1, 22, 30, 0, 0, time.UTC)
+	response := struct {
+		At      Time  `json:"at"`
+		Missing *Time `json:"missing"`
+		Set     *Time `json:"set"`
+		Other   string
+	}{
+		At:    New(instant),
+		Set:   NewPtr(&instant),
+		Other: "2024-03-01T22:30:00Z",
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	// Only the time fields are converted, strings that look like times are left alone
+	want := `{"at":"2024-03-02T00:30:00+02:00","missing":null,"set":"2024-03-02T00:30:00+02:00","Other":"2024-03-01T22:30:00Z"}`
+	if string(data) != want {
+		t.Errorf("Marshal() = %s, want %s", data, want)
+	}
+}
+
+func TestUnmarshalJSON(t *testing.T) {
+	var got Time
+	if err := json.Unmarshal([]byte(`"2024-03-02T00:30:00+02:00"`), &got); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	want := time.Date(2024, 3, 1, 22, 30, 0, 0, time.UTC)
+	if !got.Equal(want) {
+		t.Errorf("Unmarshal() = %v, want %v", got.Time, want)
+	}
+}
+
+func TestScan(t *testing.T) {
+	want := time.Date(2024, 3, 1, 22, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		value any
+		want  time.Time
+		err   bool
+	}{
+		{name: "time", value: want, want: want},
+		{name: "bytes", value: []byte("2024-03-01 22:30:00"), want: want},
+		{name: "string", value: "2024-03-01 22:30:00.000000", want: want},
+		{name: "RFC 3339", value: "2024-03-02T00:30:00+02:00", want: want},
+		{name: "null", value: nil},
+		{name: "unparseable", value: "yesterday", err: true},
+		{name: "wrong type", value: int64(1), err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got Time
+			err := got.Scan(tt.value)
+			if tt.err {
+				if err == nil {
+					t.Errorf("Scan(%v) succeeded, want an error", tt.value)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Scan(%v): %v", tt.value, err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("Scan(%v) = %v, want %v", tt.value, got.Time, tt.want)
+			}
+		})
+	}
+}
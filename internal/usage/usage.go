@@ -0,0 +1,95 @@
+package usage
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	devicesdb "github.com/johandrevandeventer/devices-api-server/pkg/db"
+	"github.com/johandrevandeventer/devices-api-server/pkg/db/models"
+	"go.uber.org/zap"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const day = 24 * time.Hour
+
+// flushInterval is how often the counted requests are written to the database
+const flushInterval = time.Minute
+
+type key struct {
+	customerID uuid.UUID
+	day        time.Time
+}
+
+var (
+	mu     sync.Mutex
+	counts = make(map[key]int64)
+)
+
+// Record counts a request made by the customer
+func Record(customerID string) {
+	id, err := uuid.Parse(customerID)
+	if err != nil {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	counts[key{customerID: id, day: time.Now().UTC().Truncate(day)}]++
+}
+
+// Run writes the counted requests to the database on every interval until the context is cancelled
+func Run(ctx context.Context, bmsDB *devicesdb.BMS_DB, logger *zap.Logger) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := Flush(bmsDB); err != nil {
+				logger.Error("Failed to flush API usage", zap.Error(err))
+			}
+		}
+	}
+}
+
+// Flush adds the counted requests to the daily usage of each customer
+func Flush(bmsDB *devicesdb.BMS_DB) error {
+	mu.Lock()
+	pending := counts
+	counts = make(map[key]int64)
+	mu.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	rows := make([]models.CustomerApiUsage, 0, len(pending))
+	for k, requests := range pending {
+		rows = append(rows, models.CustomerApiUsage{
+			CustomerID: k.customerID,
+			Day:        k.day,
+			Requests:   requests,
+		})
+	}
+
+	err := bmsDB.DB.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "customer_id"}, {Name: "day"}},
+		DoUpdates: clause.Assignments(map[string]any{"requests": gorm.Expr("requests + VALUES(requests)"), "updated_at": time.Now()}),
+	}).Create(&rows).Error
+	if err != nil {
+		// Put the counts back so they are retried on the next flush
+		mu.Lock()
+		for k, requests := range pending {
+			counts[k] += requests
+		}
+		mu.Unlock()
+	}
+
+	return err
+}
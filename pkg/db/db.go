@@ -1,6 +1,7 @@
 package devicesdb
 
 import (
+	"database/sql"
 	"fmt"
 	"os"
 	"time"
@@ -16,6 +17,27 @@ type BMS_DB struct {
 
 var BMS_DB_Instance *BMS_DB
 
+// Options controls how the database connection is opened
+type Options struct {
+	PrepareStmt     bool          // Cache prepared statements per connection
+	MaxOpenConns    int           // Maximum number of open connections
+	MaxIdleConns    int           // Maximum number of idle connections
+	ConnMaxLifetime time.Duration // Maximum time a connection may be reused
+	VerboseSQL      bool          // Log every SQL statement
+}
+
+var dbOptions = Options{
+	PrepareStmt:     true,
+	MaxOpenConns:    1,
+	MaxIdleConns:    5,
+	ConnMaxLifetime: 30 * time.Minute,
+}
+
+// SetOptions sets the options used by NewDB
+func SetOptions(opts Options) {
+	dbOptions = opts
+}
+
 func NewDB() (*BMS_DB, error) {
 	var err error
 
@@ -25,7 +47,15 @@ func NewDB() (*BMS_DB, error) {
 		return nil, fmt.Errorf("DB_URL environment variable not set")
 	}
 
-	DB, err := gorm.Open(mysql.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	logLevel := logger.Silent
+	if dbOptions.VerboseSQL {
+		logLevel = logger.Info
+	}
+
+	DB, err := gorm.Open(mysql.Open(dsn), &gorm.Config{
+		Logger:      logger.Default.LogMode(logLevel),
+		PrepareStmt: dbOptions.PrepareStmt,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
@@ -36,9 +66,9 @@ func NewDB() (*BMS_DB, error) {
 		return nil, fmt.Errorf("failed to get SQL DB: %w", err)
 	}
 
-	sqlDB.SetMaxOpenConns(1)                   // Limit max open connections (adjust as needed)
-	sqlDB.SetMaxIdleConns(5)                   // Keep up to 5 idle connections
-	sqlDB.SetConnMaxLifetime(30 * time.Minute) // Close connections after 30 min
+	sqlDB.SetMaxOpenConns(dbOptions.MaxOpenConns)       // Limit max open connections
+	sqlDB.SetMaxIdleConns(dbOptions.MaxIdleConns)       // Keep idle connections around for reuse
+	sqlDB.SetConnMaxLifetime(dbOptions.ConnMaxLifetime) // Recycle connections after their lifetime
 
 	BMS_DB_Instance = &BMS_DB{DB: DB}
 
@@ -75,18 +105,21 @@ func (db *BMS_DB) HealthCheck() error {
 	return nil
 }
 
-func (db *BMS_DB) TableExists(tableName string) bool {
+// TableExists checks if the table exists in the current database
+func (db *BMS_DB) TableExists(tableName string) (bool, error) {
 	// Get the current database name from the connection string
 	var dbName string
 	err := db.DB.Raw("SELECT DATABASE()").Scan(&dbName).Error
 	if err != nil {
-		fmt.Printf("Failed to get database name: %v\n", err)
-		return false
+		return false, fmt.Errorf("failed to get database name: %w", err)
 	}
 
 	var count int64
-	db.DB.Raw("SELECT count(*) FROM information_schema.tables WHERE table_schema = ? AND table_name = ?", dbName, tableName).Count(&count)
-	return count > 0
+	err = db.DB.Raw("SELECT count(*) FROM information_schema.tables WHERE table_schema = ? AND table_name = ?", dbName, tableName).Count(&count).Error
+	if err != nil {
+		return false, fmt.Errorf("failed to check table %s: %w", tableName, err)
+	}
+	return count > 0, nil
 }
 
 func (db *BMS_DB) Migrate(tableName string, target any) error {
@@ -96,9 +129,65 @@ func (db *BMS_DB) Migrate(tableName string, target any) error {
 	return nil
 }
 
-func (db *BMS_DB) Close() {
+// HasIndex checks if the named index exists on the table of the given model
+func (db *BMS_DB) HasIndex(target any, indexName string) bool {
+	return db.DB.Migrator().HasIndex(target, indexName)
+}
+
+// CreateIndex creates the named index defined on the given model
+func (db *BMS_DB) CreateIndex(target any, indexName string) error {
+	if err := db.DB.Migrator().CreateIndex(target, indexName); err != nil {
+		return fmt.Errorf("failed to create index %s: %w", indexName, err)
+	}
+	return nil
+}
+
+// DropIndex drops the named index from the table of the given model
+func (db *BMS_DB) DropIndex(target any, indexName string) error {
+	if err := db.DB.Migrator().DropIndex(target, indexName); err != nil {
+		return fmt.Errorf("failed to drop index %s: %w", indexName, err)
+	}
+	return nil
+}
+
+// HasColumn checks if the field of the given model has a column in its table
+func (db *BMS_DB) HasColumn(target any, field string) bool {
+	return db.DB.Migrator().HasColumn(target, field)
+}
+
+// AddColumn adds the column for the field of the given model to its table
+func (db *BMS_DB) AddColumn(target any, field string) error {
+	if err := db.DB.Migrator().AddColumn(target, field); err != nil {
+		return fmt.Errorf("failed to add column %s: %w", field, err)
+	}
+	return nil
+}
+
+// Stats returns the connection pool statistics
+func (db *BMS_DB) Stats() (sql.DBStats, error) {
+	sqlDB, err := db.DB.DB()
+	if err != nil {
+		return sql.DBStats{}, fmt.Errorf("failed to get SQL DB: %w", err)
+	}
+	return sqlDB.Stats(), nil
+}
+
+// PreparedStatementCount returns the number of statements held in the prepared statement cache
+func (db *BMS_DB) PreparedStatementCount() int {
+	preparedStmtDB, ok := db.DB.ConnPool.(*gorm.PreparedStmtDB)
+	if !ok {
+		return 0
+	}
+
+	preparedStmtDB.Mux.RLock()
+	defer preparedStmtDB.Mux.RUnlock()
+	return len(preparedStmtDB.Stmts)
+}
+
+func (db *BMS_DB) Close() error {
 	sqlDB, err := db.DB.DB()
-	if err == nil {
-		sqlDB.Close()
+	if err != nil {
+		return fmt.Errorf("failed to get SQL DB: %w", err)
 	}
+	return sqlDB.Close()
 }
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// APIKey is a long-lived key headless clients authenticate with in the X-API-Key header instead of a
+// token. It acts as a customer token, or a site token when SiteID is set, limited to its scopes.
+type APIKey struct {
+	gorm.Model
+	ID         uuid.UUID  `gorm:"type:char(36);primaryKey"`
+	CustomerID uuid.UUID  `gorm:"type:char(36);not null;uniqueIndex:idx_api_keys_customer_name,priority:1"`
+	SiteID     *uuid.UUID `gorm:"type:char(36)"`
+	Name       string     `gorm:"type:varchar(255);not null;uniqueIndex:idx_api_keys_customer_name,priority:2"`
+
+	// Scopes is the comma separated list of scopes the key is granted
+	Scopes string `gorm:"type:varchar(255);not null"`
+
+	// Only the SHA-256 hash of the key is stored, and its prefix to tell keys apart
+	KeyHash string `gorm:"type:char(64);not null;uniqueIndex:idx_api_keys_key_hash"`
+	Prefix  string `gorm:"type:varchar(16);not null"`
+}
+
+// Hook to generate UUID before creating a record
+func (a *APIKey) BeforeCreate(tx *gorm.DB) (err error) {
+	a.ID = uuid.New() // Generate new UUID
+	return
+}
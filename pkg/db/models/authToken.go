@@ -1,17 +1,35 @@
 package models
 
 import (
+	"time"
+
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
 
 type AuthToken struct {
 	gorm.Model
-	ID         uuid.UUID `gorm:"type:char(36);primaryKey"`
-	CustomerID uuid.UUID `gorm:"type:char(36);not null"`
-	Customer   Customer  `gorm:"foreignKey:CustomerID"`
-	Action     string    `gorm:"type:varchar(255);not null;uniqueIndex:idx_customer_action"`
-	Token      string    `gorm:"type:text;not null"`
+	ID         uuid.UUID  `gorm:"type:char(36);primaryKey"`
+	CustomerID uuid.UUID  `gorm:"type:char(36);not null;uniqueIndex:idx_auth_tokens_customer_site_action,priority:1"`
+	Customer   Customer   `gorm:"foreignKey:CustomerID"`
+	SiteID     *uuid.UUID `gorm:"type:char(36);uniqueIndex:idx_auth_tokens_customer_site_action,priority:2"`
+	Action     string     `gorm:"type:varchar(255);not null;uniqueIndex:idx_auth_tokens_customer_site_action,priority:3"`
+	Token      string     `gorm:"type:text;not null"`
+
+	// AllowedCIDRs and CertThumbprint optionally bind the token to the networks, given as a comma
+	// separated list, and the SHA-256 thumbprint of the client certificate it may be presented from
+	AllowedCIDRs   *string `gorm:"type:text"`
+	CertThumbprint *string `gorm:"type:char(64)"`
+
+	// ExpiresAt is when the token stops being accepted, or nil if it does not expire. Until
+	// RefreshExpiresAt it can be exchanged for a new token with the refresh token, of which only the
+	// SHA-256 hash is stored.
+	ExpiresAt        *time.Time `gorm:"type:datetime"`
+	RefreshTokenHash *string    `gorm:"type:char(64);uniqueIndex:idx_auth_tokens_refresh_token_hash" json:"-"`
+	RefreshExpiresAt *time.Time `gorm:"type:datetime"`
+
+	// RefreshToken is the refresh token issued with the token. It is only set when the token is issued.
+	RefreshToken string `gorm:"-"`
 }
 
 // Hook to generate UUID before creating a record
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Controller is a controller installed at a site that devices are wired to. Devices refer to it by
+// ControllerID and still carry its type and serial number, which are kept in step with it.
+type Controller struct {
+	gorm.Model
+	ID              uuid.UUID `gorm:"type:char(36);primaryKey"`
+	CustomerID      uuid.UUID `gorm:"type:char(36);not null"`
+	SiteID          uuid.UUID `gorm:"type:char(36);not null;uniqueIndex:idx_controllers_site_serial_number,priority:1"`
+	SerialNumber    string    `gorm:"type:varchar(255);not null;uniqueIndex:idx_controllers_site_serial_number,priority:2"`
+	ControllerType  string    `gorm:"type:varchar(255);not null"`
+	FirmwareVersion string    `gorm:"type:varchar(64)"`
+}
+
+// Hook to generate UUID before creating a record
+func (c *Controller) BeforeCreate(tx *gorm.DB) (err error) {
+	c.ID = uuid.New() // Generate new UUID
+	return
+}
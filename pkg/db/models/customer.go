@@ -1,6 +1,8 @@
 package models
 
 import (
+	"time"
+
 	"github.com/google/uuid"
 	"gorm.io/gorm"
 )
@@ -9,6 +11,12 @@ type Customer struct {
 	gorm.Model
 	ID   uuid.UUID `gorm:"type:char(36);primaryKey"`
 	Name string    `gorm:"type:char(36);uniqueIndex;not null"`
+
+	ContractStart *time.Time `gorm:"type:date"`
+	ContractEnd   *time.Time `gorm:"type:date"`
+
+	// ExternalRef is the ID of the customer in the CRM and billing systems
+	ExternalRef *string `gorm:"type:varchar(64);uniqueIndex:idx_customers_external_ref"`
 }
 
 // Hook to generate UUID before creating a record
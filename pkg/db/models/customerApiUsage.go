@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type CustomerApiUsage struct {
+	gorm.Model
+	ID         uuid.UUID `gorm:"type:char(36);primaryKey"`
+	CustomerID uuid.UUID `gorm:"type:char(36);not null;uniqueIndex:idx_customer_api_usages_customer_day,priority:1"`
+	Day        time.Time `gorm:"type:date;not null;uniqueIndex:idx_customer_api_usages_customer_day,priority:2"`
+	Requests   int64     `gorm:"not null"`
+}
+
+// Hook to generate UUID before creating a record
+func (u *CustomerApiUsage) BeforeCreate(tx *gorm.DB) (err error) {
+	u.ID = uuid.New() // Generate new UUID
+	return
+}
@@ -0,0 +1,22 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// CustomerSetting is a setting tuning the behaviour of the server for one customer. Value holds the
+// setting as JSON.
+type CustomerSetting struct {
+	gorm.Model
+	ID         uuid.UUID `gorm:"type:char(36);primaryKey"`
+	CustomerID uuid.UUID `gorm:"type:char(36);not null;uniqueIndex:idx_customer_settings_customer_id_key,priority:1"`
+	Key        string    `gorm:"type:varchar(64);not null;uniqueIndex:idx_customer_settings_customer_id_key,priority:2"`
+	Value      string    `gorm:"type:text;not null"`
+}
+
+// Hook to generate UUID before creating a record
+func (s *CustomerSetting) BeforeCreate(tx *gorm.DB) (err error) {
+	s.ID = uuid.New() // Generate new UUID
+	return
+}
@@ -0,0 +1,25 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// DeviceDependency is an edge in the device topology graph: the downstream device depends on the
+// upstream device, e.g. an AHU fed by a meter
+type DeviceDependency struct {
+	gorm.Model
+	ID                     uuid.UUID `gorm:"type:char(36);primaryKey"`
+	UpstreamDeviceID       uuid.UUID `gorm:"type:char(36);uniqueIndex:idx_device_dependencies_device_edge,priority:1"`
+	DownstreamDeviceID     uuid.UUID `gorm:"type:char(36);uniqueIndex:idx_device_dependencies_device_edge,priority:2;index:idx_device_dependencies_downstream_device_id"`
+	UpstreamSerialNumber   string    `gorm:"type:char(255);not null"`
+	DownstreamSerialNumber string    `gorm:"type:char(255);not null"`
+	Relationship           string    `gorm:"type:varchar(64);not null"`
+	Description            string    `gorm:"type:varchar(255)"`
+}
+
+// Hook to generate UUID before creating a record
+func (d *DeviceDependency) BeforeCreate(tx *gorm.DB) (err error) {
+	d.ID = uuid.New() // Generate new UUID
+	return
+}
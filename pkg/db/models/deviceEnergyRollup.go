@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// DeviceEnergyRollup holds the energy a meter device registered on a day, for the site it reported from
+type DeviceEnergyRollup struct {
+	gorm.Model
+	ID                 uuid.UUID `gorm:"type:char(36);primaryKey"`
+	DeviceID           uuid.UUID `gorm:"type:char(36);uniqueIndex:idx_device_energy_rollups_device_site_day,priority:1"`
+	DeviceSerialNumber string    `gorm:"type:char(255);not null"`
+	SiteID             uuid.UUID `gorm:"type:char(36);uniqueIndex:idx_device_energy_rollups_device_site_day,priority:2;index:idx_device_energy_rollups_site_day,priority:1"`
+	Day                time.Time `gorm:"type:date;not null;uniqueIndex:idx_device_energy_rollups_device_site_day,priority:3;index:idx_device_energy_rollups_site_day,priority:2"`
+	KWh                float64   `gorm:"column:kwh;not null"`
+}
+
+// Hook to generate UUID before creating a record
+func (r *DeviceEnergyRollup) BeforeCreate(tx *gorm.DB) (err error) {
+	r.ID = uuid.New() // Generate new UUID
+	return
+}
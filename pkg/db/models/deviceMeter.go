@@ -0,0 +1,25 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// DeviceMeter holds the constants that convert the raw register of a meter device into energy
+type DeviceMeter struct {
+	gorm.Model
+	ID                 uuid.UUID `gorm:"type:char(36);primaryKey"`
+	DeviceID           uuid.UUID `gorm:"type:char(36);uniqueIndex:idx_device_meters_device_id"`
+	DeviceSerialNumber string    `gorm:"type:char(255);not null"`
+	Unit               string    `gorm:"type:varchar(16);not null"`
+	Multiplier         float64   `gorm:"not null;default:1"`
+	PulseConstant      float64   `gorm:"not null;default:0"`
+	Phases             int       `gorm:"not null;default:3"`
+	RegisterPoint      string    `gorm:"type:varchar(128);not null;default:''"`
+}
+
+// Hook to generate UUID before creating a record
+func (m *DeviceMeter) BeforeCreate(tx *gorm.DB) (err error) {
+	m.ID = uuid.New() // Generate new UUID
+	return
+}
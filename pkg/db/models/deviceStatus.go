@@ -10,9 +10,12 @@ import (
 type DeviceStatus struct {
 	gorm.Model
 	ID                 uuid.UUID `gorm:"type:char(36);primaryKey"`
-	DeviceSerialNumber string    `gorm:"type:char(36);not null;unique"`
+	DeviceID           uuid.UUID `gorm:"type:char(36);uniqueIndex:idx_device_statuses_device_id"`
+	DeviceSerialNumber string    `gorm:"type:char(36);not null"`
 	LastSeen           time.Time `gorm:"type:datetime;not null"`
-	Device             Device    `gorm:"foreignKey:DeviceSerialNumber"`
+	State              string    `gorm:"type:varchar(16);not null;default:online"`
+	Detail             string    `gorm:"type:varchar(255)"`
+	Device             Device    `gorm:"foreignKey:DeviceID"`
 }
 
 // Hook to generate UUID before creating a record
@@ -0,0 +1,30 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Device status values reported by gateways and recorded in transitions
+const (
+	DeviceStatusOnline  = "online"
+	DeviceStatusOffline = "offline"
+	DeviceStatusFault   = "fault"
+)
+
+type DeviceStatusTransition struct {
+	gorm.Model
+	ID                 uuid.UUID `gorm:"type:char(36);primaryKey"`
+	DeviceID           uuid.UUID `gorm:"type:char(36);index:idx_device_status_transitions_device_id_changed,priority:1"`
+	DeviceSerialNumber string    `gorm:"type:char(255);not null"`
+	Status             string    `gorm:"type:varchar(16);not null"`
+	ChangedAt          time.Time `gorm:"type:datetime;not null;index:idx_device_status_transitions_device_id_changed,priority:2;index:idx_device_status_transitions_changed_at"`
+}
+
+// Hook to generate UUID before creating a record
+func (t *DeviceStatusTransition) BeforeCreate(tx *gorm.DB) (err error) {
+	t.ID = uuid.New() // Generate new UUID
+	return
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// DeviceTemplate describes a standard piece of equipment that devices can be commissioned from
+type DeviceTemplate struct {
+	gorm.Model
+	ID           uuid.UUID `gorm:"type:char(36);primaryKey"`
+	Name         string    `gorm:"type:varchar(128);not null;uniqueIndex:idx_device_templates_name"`
+	DeviceType   string    `gorm:"type:char(255);not null"`
+	Manufacturer string    `gorm:"type:varchar(128)"`
+	ModelNumber  string    `gorm:"type:varchar(128)"`
+	Description  string    `gorm:"type:varchar(255)"`
+}
+
+// Hook to generate UUID before creating a record
+func (t *DeviceTemplate) BeforeCreate(tx *gorm.DB) (err error) {
+	t.ID = uuid.New() // Generate new UUID
+	return
+}
+
+// DeviceTemplatePoint is a default point of a device template, copied into the point address book
+// of each device created from the template
+type DeviceTemplatePoint struct {
+	gorm.Model
+	ID           uuid.UUID `gorm:"type:char(36);primaryKey"`
+	TemplateID   uuid.UUID `gorm:"type:char(36);not null;uniqueIndex:idx_device_template_points_template_point,priority:1"`
+	PointName    string    `gorm:"type:varchar(128);not null;uniqueIndex:idx_device_template_points_template_point,priority:2"`
+	Protocol     string    `gorm:"type:varchar(16);not null"`
+	ObjectType   string    `gorm:"type:varchar(32)"`
+	Register     int       `gorm:"not null"`
+	FunctionCode int       `gorm:"not null;default:0"`
+	DataType     string    `gorm:"type:varchar(16)"`
+	Scale        float64   `gorm:"not null;default:1"`
+	Offset       float64   `gorm:"not null;default:0"`
+	Unit         string    `gorm:"type:varchar(32)"`
+}
+
+// Hook to generate UUID before creating a record
+func (p *DeviceTemplatePoint) BeforeCreate(tx *gorm.DB) (err error) {
+	p.ID = uuid.New() // Generate new UUID
+	return
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+type DeviceUptimeRollup struct {
+	gorm.Model
+	ID                 uuid.UUID `gorm:"type:char(36);primaryKey"`
+	DeviceID           uuid.UUID `gorm:"type:char(36);uniqueIndex:idx_device_uptime_rollups_device_id_day,priority:1"`
+	DeviceSerialNumber string    `gorm:"type:char(255);not null"`
+	Day                time.Time `gorm:"type:date;not null;uniqueIndex:idx_device_uptime_rollups_device_id_day,priority:2"`
+	UptimeMinutes      int       `gorm:"not null"`
+}
+
+// Hook to generate UUID before creating a record
+func (r *DeviceUptimeRollup) BeforeCreate(tx *gorm.DB) (err error) {
+	r.ID = uuid.New() // Generate new UUID
+	return
+}
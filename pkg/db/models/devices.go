@@ -5,19 +5,31 @@ import (
 	"gorm.io/gorm"
 )
 
+// Scopes a device serial number is unique within
+const (
+	SerialScopeGlobal   = "global"
+	SerialScopeCustomer = "customer"
+)
+
 type Device struct {
 	gorm.Model
-	ID                     uuid.UUID `gorm:"type:char(255);primaryKey"`
-	Gateway                string    `gorm:"type:char(255);not null"`
-	Controller             string    `gorm:"type:char(255);not null"`
-	ControllerSerialNumber string    `gorm:"type:char(255);not null"`
-	DeviceType             string    `gorm:"type:char(255);not null"`
-	DeviceSerialNumber     string    `gorm:"type:char(255);not null;unique"`
-	DeviceName             string    `gorm:"type:char(255);not null"`
-	BuildingURL            string    `gorm:"type:char(255);not null"`
-	AuthToken              string    `gorm:"type:text;not null"`
-	SiteID                 uuid.UUID `gorm:"type:char(255);not null"`
-	Site                   Site      `gorm:"foreignKey:SiteID"`
+	ID                     uuid.UUID  `gorm:"type:char(255);primaryKey"`
+	Gateway                string     `gorm:"type:char(255);not null;index:idx_devices_gateway"`
+	GatewayID              *uuid.UUID `gorm:"type:char(36);index:idx_devices_gateway_id"`
+	Controller             string     `gorm:"type:char(255);not null"`
+	ControllerSerialNumber string     `gorm:"type:char(255);not null;index:idx_devices_controller_serial_number"`
+	ControllerID           *uuid.UUID `gorm:"type:char(36);index:idx_devices_controller_id"`
+	DeviceType             string     `gorm:"type:char(255);not null"`
+	DeviceSerialNumber     string     `gorm:"type:char(255);not null;uniqueIndex:idx_devices_device_serial_number;uniqueIndex:idx_devices_serial_number_customer,priority:1"`
+	DeviceName             string     `gorm:"type:char(255);not null"`
+	BuildingURL            string     `gorm:"type:char(255);not null"`
+	FirmwareVersion        string     `gorm:"type:varchar(64);index:idx_devices_firmware_version"`
+	HardwareRevision       string     `gorm:"type:varchar(64)"`
+	AuthToken              string     `gorm:"type:text;not null"`
+	SiteID                 uuid.UUID  `gorm:"type:char(255);not null;index:idx_devices_site_id"`
+	Site                   Site       `gorm:"foreignKey:SiteID"`
+	CustomerID             uuid.UUID  `gorm:"type:char(255);uniqueIndex:idx_devices_serial_number_customer,priority:2"`
+	DeletedBy              *string    `gorm:"type:char(255)"`
 }
 
 // Hook to generate UUID before creating a record
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// FleetSnapshot is the number of devices of a type a customer had on a day
+type FleetSnapshot struct {
+	gorm.Model
+	ID         uuid.UUID `gorm:"type:char(36);primaryKey"`
+	Day        time.Time `gorm:"type:date;not null;uniqueIndex:idx_fleet_snapshots_day_customer_type,priority:1"`
+	CustomerID uuid.UUID `gorm:"type:char(36);not null;uniqueIndex:idx_fleet_snapshots_day_customer_type,priority:2"`
+	DeviceType string    `gorm:"type:varchar(255);not null;uniqueIndex:idx_fleet_snapshots_day_customer_type,priority:3"`
+	Devices    int       `gorm:"not null"`
+}
+
+// Hook to generate UUID before creating a record
+func (s *FleetSnapshot) BeforeCreate(tx *gorm.DB) (err error) {
+	s.ID = uuid.New() // Generate new UUID
+	return
+}
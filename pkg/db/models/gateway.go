@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Gateway is an edge box at a site that hosts devices. Devices refer to it by GatewayID and still
+// carry its name, and its credential is rotated without touching the devices.
+type Gateway struct {
+	gorm.Model
+	ID         uuid.UUID  `gorm:"type:char(36);primaryKey"`
+	CustomerID uuid.UUID  `gorm:"type:char(36);not null"`
+	SiteID     uuid.UUID  `gorm:"type:char(36);not null;uniqueIndex:idx_gateways_site_name,priority:1"`
+	Name       string     `gorm:"type:varchar(255);not null;uniqueIndex:idx_gateways_site_name,priority:2"`
+	LastSeenAt *time.Time `gorm:"type:datetime"`
+}
+
+// Hook to generate UUID before creating a record
+func (g *Gateway) BeforeCreate(tx *gorm.DB) (err error) {
+	g.ID = uuid.New() // Generate new UUID
+	return
+}
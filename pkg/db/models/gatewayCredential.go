@@ -0,0 +1,30 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// GatewayCredential is the token an edge gateway authenticates with on the /gateway routes, which
+// only reach the devices of the gateway's own site
+type GatewayCredential struct {
+	gorm.Model
+	ID         uuid.UUID `gorm:"type:char(36);primaryKey"`
+	CustomerID uuid.UUID `gorm:"type:char(36);not null"`
+	SiteID     uuid.UUID `gorm:"type:char(36);not null;uniqueIndex:idx_gateway_credentials_site_gateway,priority:1"`
+	Gateway    string    `gorm:"type:varchar(255);not null;uniqueIndex:idx_gateway_credentials_site_gateway,priority:2"`
+	Token      string    `gorm:"type:text;not null"`
+
+	// GatewayID is the gateway the credential was issued to
+	GatewayID *uuid.UUID `gorm:"type:char(36);index:idx_gateway_credentials_gateway_id"`
+
+	// AllowedCIDRs and CertThumbprint optionally bind the credential like those of an AuthToken
+	AllowedCIDRs   *string `gorm:"type:text"`
+	CertThumbprint *string `gorm:"type:char(64)"`
+}
+
+// Hook to generate UUID before creating a record
+func (g *GatewayCredential) BeforeCreate(tx *gorm.DB) (err error) {
+	g.ID = uuid.New() // Generate new UUID
+	return
+}
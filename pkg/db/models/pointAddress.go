@@ -0,0 +1,30 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// PointAddress maps a named point of a device to where its controller reads it over Modbus or BACnet
+type PointAddress struct {
+	gorm.Model
+	ID                     uuid.UUID `gorm:"type:char(36);primaryKey"`
+	ControllerSerialNumber string    `gorm:"type:char(255);not null;index:idx_point_addresses_controller_serial_number"`
+	DeviceID               uuid.UUID `gorm:"type:char(36);uniqueIndex:idx_point_addresses_device_id_point,priority:1"`
+	DeviceSerialNumber     string    `gorm:"type:char(255);not null"`
+	PointName              string    `gorm:"type:varchar(128);not null;uniqueIndex:idx_point_addresses_device_id_point,priority:2"`
+	Protocol               string    `gorm:"type:varchar(16);not null"`
+	ObjectType             string    `gorm:"type:varchar(32)"`
+	Register               int       `gorm:"not null"`
+	FunctionCode           int       `gorm:"not null;default:0"`
+	DataType               string    `gorm:"type:varchar(16)"`
+	Scale                  float64   `gorm:"not null;default:1"`
+	Offset                 float64   `gorm:"not null;default:0"`
+	Unit                   string    `gorm:"type:varchar(32)"`
+}
+
+// Hook to generate UUID before creating a record
+func (p *PointAddress) BeforeCreate(tx *gorm.DB) (err error) {
+	p.ID = uuid.New() // Generate new UUID
+	return
+}
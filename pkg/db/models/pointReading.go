@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// PointReading is the last value a device reported for one of its points, in the unit of the point
+type PointReading struct {
+	gorm.Model
+	ID         uuid.UUID `gorm:"type:char(36);primaryKey"`
+	DeviceID   uuid.UUID `gorm:"type:char(36);uniqueIndex:idx_point_readings_device_id_point,priority:1"`
+	PointName  string    `gorm:"type:varchar(128);not null;uniqueIndex:idx_point_readings_device_id_point,priority:2"`
+	Value      float64   `gorm:"not null"`
+	ReportedAt time.Time `gorm:"type:datetime;not null"`
+}
+
+// Hook to generate UUID before creating a record
+func (r *PointReading) BeforeCreate(tx *gorm.DB) (err error) {
+	r.ID = uuid.New() // Generate new UUID
+	return
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// States of a provisioning session
+const (
+	ProvisioningOpen      = "open"
+	ProvisioningCommitted = "committed"
+	ProvisioningAborted   = "aborted"
+)
+
+// ProvisioningSession stages the site, gateway, devices and tokens an installer sets up for a
+// customer, so they are created together when the session is committed
+type ProvisioningSession struct {
+	gorm.Model
+	ID         uuid.UUID  `gorm:"type:char(36);primaryKey"`
+	CustomerID uuid.UUID  `gorm:"type:char(36);not null;index:idx_provisioning_sessions_customer_id"`
+	State      string     `gorm:"type:varchar(16);not null;default:open"`
+	Plan       string     `gorm:"type:mediumtext;not null"`
+	SiteID     *uuid.UUID `gorm:"type:char(36)"`
+	ExpiresAt  time.Time  `gorm:"type:datetime;not null"`
+}
+
+// Hook to generate UUID before creating a record
+func (p *ProvisioningSession) BeforeCreate(tx *gorm.DB) (err error) {
+	p.ID = uuid.New() // Generate new UUID
+	return
+}
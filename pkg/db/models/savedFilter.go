@@ -0,0 +1,25 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// SavedFilterOwnerAdmin owns the saved filters of admin tokens, which are shared by all admins
+const SavedFilterOwnerAdmin = "admin"
+
+// SavedFilter is a named device list filter. Owner is the customer ID of the tokens that saved it,
+// so every client of the customer sees the same filters, or SavedFilterOwnerAdmin.
+type SavedFilter struct {
+	gorm.Model
+	ID    uuid.UUID `gorm:"type:char(36);primaryKey"`
+	Owner string    `gorm:"type:char(36);not null;uniqueIndex:idx_saved_filters_owner_name,priority:1"`
+	Name  string    `gorm:"type:varchar(64);not null;uniqueIndex:idx_saved_filters_owner_name,priority:2"`
+	Query string    `gorm:"type:varchar(1024);not null"`
+}
+
+// Hook to generate UUID before creating a record
+func (f *SavedFilter) BeforeCreate(tx *gorm.DB) (err error) {
+	f.ID = uuid.New() // Generate new UUID
+	return
+}
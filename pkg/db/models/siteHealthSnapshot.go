@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// SiteHealthSnapshot is the health of a site at a point in time. Fault devices are the alerts of
+// the site and fresh devices those that reported a point reading recently.
+type SiteHealthSnapshot struct {
+	gorm.Model
+	ID            uuid.UUID `gorm:"type:char(36);primaryKey"`
+	SiteID        uuid.UUID `gorm:"type:char(36);not null;index:idx_site_health_snapshots_site_id_computed,priority:1"`
+	ComputedAt    time.Time `gorm:"type:datetime;not null;index:idx_site_health_snapshots_site_id_computed,priority:2;index:idx_site_health_snapshots_computed_at"`
+	Devices       int       `gorm:"not null"`
+	OnlineDevices int       `gorm:"not null"`
+	FaultDevices  int       `gorm:"not null"`
+	FreshDevices  int       `gorm:"not null"`
+	Score         float64   `gorm:"not null"`
+}
+
+// Hook to generate UUID before creating a record
+func (s *SiteHealthSnapshot) BeforeCreate(tx *gorm.DB) (err error) {
+	s.ID = uuid.New() // Generate new UUID
+	return
+}
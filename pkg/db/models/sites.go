@@ -8,9 +8,14 @@ import (
 type Site struct {
 	gorm.Model
 	ID         uuid.UUID `gorm:"type:char(36);primaryKey"`
-	Name       string    `gorm:"type:char(36);uniqueIndex;not null"`
-	CustomerID uuid.UUID `gorm:"type:char(36);not null"`
+	Name       string    `gorm:"type:char(36);not null;uniqueIndex:idx_sites_customer_name,priority:2"`
+	CustomerID uuid.UUID `gorm:"type:char(36);not null;index:idx_sites_customer_id;uniqueIndex:idx_sites_customer_name,priority:1"`
 	Customer   Customer  `gorm:"foreignKey:CustomerID"`
+
+	Address   string   `gorm:"type:varchar(255)"`
+	Latitude  *float64 `gorm:"type:double"`
+	Longitude *float64 `gorm:"type:double"`
+	Timezone  string   `gorm:"type:varchar(64);index:idx_sites_timezone"` // IANA zone, e.g. Africa/Johannesburg
 }
 
 // Hook to generate UUID before creating a record
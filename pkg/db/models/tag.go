@@ -0,0 +1,38 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Tag is an operator-defined label used to group devices, e.g. critical or maintenance-due
+type Tag struct {
+	gorm.Model
+	ID   uuid.UUID `gorm:"type:char(36);primaryKey"`
+	Name string    `gorm:"type:varchar(64);not null;uniqueIndex:idx_tags_name"`
+}
+
+// Hook to generate UUID before creating a record
+func (t *Tag) BeforeCreate(tx *gorm.DB) (err error) {
+	t.ID = uuid.New() // Generate new UUID
+	return
+}
+
+// DeviceTag links a tag to a device. RuleID is set when the tag was applied by a tag rule, which
+// removes the link again once the device no longer matches; manually applied links have no rule.
+type DeviceTag struct {
+	ID                 uuid.UUID  `gorm:"type:char(36);primaryKey"`
+	TagID              uuid.UUID  `gorm:"type:char(36);not null;uniqueIndex:idx_device_tags_tag_device_id,priority:1"`
+	DeviceID           uuid.UUID  `gorm:"type:char(36);uniqueIndex:idx_device_tags_tag_device_id,priority:2;index:idx_device_tags_device_id"`
+	DeviceSerialNumber string     `gorm:"type:char(255);not null"`
+	RuleID             *uuid.UUID `gorm:"type:char(36);index:idx_device_tags_rule_id"`
+	CreatedAt          time.Time
+}
+
+// Hook to generate UUID before creating a record
+func (t *DeviceTag) BeforeCreate(tx *gorm.DB) (err error) {
+	t.ID = uuid.New() // Generate new UUID
+	return
+}
@@ -0,0 +1,42 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Device attributes a tag rule can match on. Status is the status derived from the last heartbeat
+// and no_comms_days the number of whole days since the device was last seen.
+const (
+	TagRuleFieldStatus           = "status"
+	TagRuleFieldNoCommsDays      = "no_comms_days"
+	TagRuleFieldDeviceType       = "device_type"
+	TagRuleFieldGateway          = "gateway"
+	TagRuleFieldFirmwareVersion  = "firmware_version"
+	TagRuleFieldHardwareRevision = "hardware_revision"
+)
+
+// Operators a tag rule compares the device attribute to its value with
+const (
+	TagRuleOperatorEqual    = "eq"
+	TagRuleOperatorNotEqual = "ne"
+	TagRuleOperatorAtLeast  = "gte"
+)
+
+// TagRule applies its tag to the devices matching its condition and removes the tag once they no
+// longer match, e.g. tag no-comms-7d when no_comms_days gte 7
+type TagRule struct {
+	gorm.Model
+	ID       uuid.UUID `gorm:"type:char(36);primaryKey"`
+	Name     string    `gorm:"type:varchar(64);not null;uniqueIndex:idx_tag_rules_name"`
+	Tag      string    `gorm:"type:varchar(64);not null"`
+	Field    string    `gorm:"type:varchar(32);not null"`
+	Operator string    `gorm:"type:varchar(8);not null"`
+	Value    string    `gorm:"type:varchar(255);not null"`
+}
+
+// Hook to generate UUID before creating a record
+func (r *TagRule) BeforeCreate(tx *gorm.DB) (err error) {
+	r.ID = uuid.New() // Generate new UUID
+	return
+}
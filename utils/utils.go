@@ -53,6 +53,11 @@ func GetConnectionsDir() string {
 	return filepath.Join(GetRuntimeDir(), "connections")
 }
 
+// Get the crash report directory
+func GetCrashDir() string {
+	return filepath.Join(GetRuntimeDir(), "crashes")
+}
+
 // FileExists checks if a file exists
 func FileExists(filePath string) bool {
 	_, err := os.Stat(filePath)
@@ -116,9 +121,9 @@ func SaveYAMLFile(filePath string, toSave interface{}, createFile bool) error {
 	return nil
 }
 
-// VerbosePrintln prints a message if the verbose flag is set
+// VerbosePrintln prints a message if the verbose flag is set and quiet mode is off
 func VerbosePrintln(message string) {
-	if flags.FlagVerbose {
+	if flags.FlagVerbose && !flags.FlagQuiet {
 		fmt.Println(message)
 	}
 }